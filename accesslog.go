@@ -0,0 +1,149 @@
+package main
+
+// This file logs HTTP requests, when the config file has an access_log
+// section. Each request is logged once it's done, with its method, path,
+// status, how long it took, and the client's IP address with the end zeroed,
+// so it's roughly where they are but not who. Query strings aren't logged, as
+// they can have connection IDs in them, and neither are the tokens in the
+// paths of tokenPaths.
+//
+// Busy servers can log a sample of requests instead of all of them, and leave
+// out paths like /stats. Websocket connections are left out unless asked for,
+// since they're logged when they end, which says little besides how long
+// someone stayed.
+
+import (
+	"bufio"
+	"errors"
+	"log"
+	"math/rand"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// configAccessLog is the access_log section of the config file.
+type configAccessLog struct {
+	// Sample is the fraction of requests to log, from 0 to 1. They're all
+	// logged if it's left out.
+	Sample float64 `json:"sample"`
+	// Exclude is the paths not to log. Paths ending with a slash leave out
+	// everything under them too.
+	Exclude []string `json:"exclude"`
+	// Websockets logs websocket connections when they end.
+	Websockets bool `json:"websockets"`
+}
+
+// accessLog holds the parsed access_log config.
+type accessLog struct {
+	sample     float64
+	exclude    []string
+	websockets bool
+}
+
+func parseAccessLog(cf configAccessLog) (*accessLog, error) {
+	if cf.Sample < 0 || cf.Sample > 1 {
+		return nil, errors.New("access_log sample must be from 0 to 1")
+	}
+	al := &accessLog{sample: cf.Sample, exclude: cf.Exclude, websockets: cf.Websockets}
+	if al.sample == 0 {
+		al.sample = 1
+	}
+	return al, nil
+}
+
+// wants returns true if the request should be logged. Requests are sampled,
+// so it can return something different for the same request.
+func (al *accessLog) wants(r *http.Request) bool {
+	if !al.websockets && isWebsocketUpgrade(r) {
+		return false
+	}
+	for _, p := range al.exclude {
+		if r.URL.Path == p || (strings.HasSuffix(p, "/") && strings.HasPrefix(r.URL.Path, p)) {
+			return false
+		}
+	}
+	return al.sample >= 1 || rand.Float64() < al.sample
+}
+
+// tokenPaths are the paths ending with a secret token, which is left out of
+// the log.
+var tokenPaths = []string{"/invite/", "/hooks/"}
+
+// redactPath returns the path with any token in it replaced by "-".
+func redactPath(path string) string {
+	for _, p := range tokenPaths {
+		if strings.HasPrefix(path, p) && len(path) > len(p) {
+			return p + "-"
+		}
+	}
+	return path
+}
+
+// logRequest logs the request, which got the status and took d.
+func logRequest(r *http.Request, status int, d time.Duration) {
+	if status == 0 {
+		// Nothing was written, which net/http sends as 200 OK
+		status = http.StatusOK
+	}
+	ip := anonymizeIP(clientAddr(r, int(trustedProxies)))
+	if privateRooms {
+		ip = logAddr(r)
+	}
+	log.Printf("access method=%s path=%q status=%d duration=%s ip=%s",
+		r.Method, redactPath(r.URL.Path), status, d.Round(time.Microsecond), ip)
+}
+
+// anonymizeIP returns the IP address with the end zeroed, leaving the /24
+// network of IPv4 addresses and the /48 of IPv6 ones. It returns "-" if ip is
+// nil, like for unix sockets.
+func anonymizeIP(ip net.IP) string {
+	if ip == nil {
+		return "-"
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4.Mask(net.CIDRMask(24, 8*net.IPv4len)).String()
+	}
+	return ip.Mask(net.CIDRMask(48, 8*net.IPv6len)).String()
+}
+
+// statusRecorder remembers the status written to a response, for the access
+// log. Websockets and Server-Sent Events still work through it.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (sr *statusRecorder) WriteHeader(status int) {
+	if sr.status == 0 {
+		sr.status = status
+	}
+	sr.ResponseWriter.WriteHeader(status)
+}
+
+func (sr *statusRecorder) Write(b []byte) (int, error) {
+	if sr.status == 0 {
+		sr.status = http.StatusOK
+	}
+	return sr.ResponseWriter.Write(b)
+}
+
+func (sr *statusRecorder) Flush() {
+	if f, ok := sr.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (sr *statusRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	h, ok := sr.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("statusRecorder: response can't be hijacked")
+	}
+	return h.Hijack()
+}
+
+// Unwrap is for http.ResponseController.
+func (sr *statusRecorder) Unwrap() http.ResponseWriter {
+	return sr.ResponseWriter
+}
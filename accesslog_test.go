@@ -0,0 +1,94 @@
+package main
+
+import (
+	"net"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestParseAccessLog(t *testing.T) {
+	for _, s := range []string{`{"access_log": {"sample": -0.1}}`, `{"access_log": {"sample": 2}}`} {
+		if _, err := parseConfig([]byte(s)); err == nil {
+			t.Errorf("parseConfig(%s) worked", s)
+		}
+	}
+	c, err := parseConfig([]byte(`{"access_log": {}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.accessLog == nil || c.accessLog.sample != 1 {
+		t.Errorf("access log = %+v, want everything sampled", c.accessLog)
+	}
+	if c, _ := parseConfig([]byte(`{}`)); c.accessLog != nil {
+		t.Error("access log is on without an access_log section")
+	}
+}
+
+func TestAccessLogWants(t *testing.T) {
+	al := &accessLog{sample: 1, exclude: []string{"/stats", "/poll/"}}
+	for _, tt := range []struct {
+		path string
+		want bool
+	}{
+		{"/", true},
+		{"/stats", false},
+		{"/stats/more", true},
+		{"/poll/send", false},
+		{"/poll", true},
+	} {
+		if got := al.wants(httptest.NewRequest("GET", tt.path, nil)); got != tt.want {
+			t.Errorf("wants(%s) = %v, want %v", tt.path, got, tt.want)
+		}
+	}
+
+	ws := httptest.NewRequest("GET", "/connect", nil)
+	ws.Header.Set("Connection", "Upgrade")
+	ws.Header.Set("Upgrade", "websocket")
+	if al.wants(ws) {
+		t.Error("websocket was logged")
+	}
+	al.websockets = true
+	if !al.wants(ws) {
+		t.Error("websocket wasn't logged with websockets on")
+	}
+
+	al.sample = 0.5
+	n := 0
+	for i := 0; i < 1000; i++ {
+		if al.wants(httptest.NewRequest("GET", "/", nil)) {
+			n++
+		}
+	}
+	if n < 350 || n > 650 {
+		t.Errorf("%d of 1000 requests sampled at 0.5", n)
+	}
+}
+
+func TestRedactPath(t *testing.T) {
+	for path, want := range map[string]string{
+		"/invite/abc123": "/invite/-",
+		"/invite/":       "/invite/",
+		"/hooks/abc/def": "/hooks/-",
+		"/room/pizza":    "/room/pizza",
+		"/inviteabc":     "/inviteabc",
+	} {
+		if got := redactPath(path); got != want {
+			t.Errorf("redactPath(%s) = %s, want %s", path, got, want)
+		}
+	}
+}
+
+func TestAnonymizeIP(t *testing.T) {
+	for _, tt := range []struct {
+		ip   net.IP
+		want string
+	}{
+		{net.ParseIP("203.0.113.57"), "203.0.113.0"},
+		{net.ParseIP("2001:db8:1234:5678::1"), "2001:db8:1234::"},
+		{nil, "-"},
+	} {
+		if got := anonymizeIP(tt.ip); got != tt.want {
+			t.Errorf("anonymizeIP(%v) = %q, want %q", tt.ip, got, tt.want)
+		}
+	}
+}
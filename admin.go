@@ -3,58 +3,37 @@ package main
 // This file has functions that handle the admin interface over HTTP.
 
 import (
-	"bufio"
 	"fmt"
 	"io"
 	"log"
 	"net/http"
-	"net/url"
 	"os"
 	"strings"
-	"time"
-
-	"github.com/dustin/go-humanize"
 )
 
-// adminHandler serves the admin.html file, but checks if the provided key is correct first.
+// adminHandler serves the admin.html file to logged in admins, with their
+// CSRF token filled in, and the login form to everyone else.
 func (cs *chatServer) adminHandler(w http.ResponseWriter, r *http.Request) {
-	query, err := url.QueryUnescape(r.URL.RawQuery)
-	if err != nil {
-		// Shouldn't happnen unless there's a browser bug I guess
-		query = r.URL.RawQuery
-	}
-	if query != adminKey {
-		w.WriteHeader(http.StatusForbidden)
+	if r.Method == http.MethodPost || !cs.isAdmin(r) {
+		cs.adminLoginHandler(w, r)
 		return
 	}
-	adminHtml, err := os.Open("html/admin.html")
+	adminHtml, err := os.ReadFile("html/admin.html")
 	if err != nil {
 		log.Printf("chatServer.adminHandler: err opening admin.html: %v", err)
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
-	defer adminHtml.Close()
-	io.Copy(w, adminHtml)
+	c, _ := r.Cookie(adminCookieName)
+	io.WriteString(w, strings.Replace(string(adminHtml), "{{csrf}}", cs.adminKeys.csrfToken(c.Value), 1))
 }
 
-func (cs *chatServer) adminDataHandler(rw http.ResponseWriter, r *http.Request) {
-	if !strings.HasSuffix(r.Header.Get("HX-Current-URL"), "?"+url.QueryEscape(adminKey)) {
-		// Admin data wasn't requested from inside the admin page
-		rw.WriteHeader(http.StatusForbidden)
+// adminDataHandler serves the admin page data all at once. The admin page
+// gets it over /admin-ws instead, see adminlive.go.
+func (cs *chatServer) adminDataHandler(w http.ResponseWriter, r *http.Request) {
+	if !cs.isAdmin(r) {
+		w.WriteHeader(http.StatusForbidden)
 		return
 	}
-
-	cs.roomsMu.Lock()
-	defer cs.roomsMu.Unlock()
-
-	// Write HTML data as it's processed, but with a buffer
-	w := bufio.NewWriter(rw)
-	fmt.Fprintf(w, `<p>%d chat rooms</p><hr />`, len(cs.rooms))
-	for ip, room := range cs.rooms {
-		fmt.Fprintf(
-			w, `<h2>%s</h2><p>%d chatters</p><p>Last message: %s</p>`,
-			ip, room.numClients(), humanize.RelTime(room.whenLastMsg, time.Now(), "ago", "from now"),
-		)
-	}
-	w.Flush()
+	fmt.Fprint(w, renderAdminData(cs.adminSnapshot()))
 }
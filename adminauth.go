@@ -0,0 +1,276 @@
+package main
+
+// This file handles logging in to the admin interface. The admin enters a key
+// on /admin, and gets a signed session cookie that's checked by every admin
+// handler. Sessions expire after adminSessionTTL, and end early if the key
+// they were made with is revoked or changed.
+//
+// Besides the -key flag, keys can be listed in the -admin-keys file, one per
+// line as: <id> <key>. The file is read again whenever it changes, so keys can
+// be added, rotated and revoked without restarting. The ID names the key in
+// the logs, and -key has the ID "main".
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// adminSessionTTL is how long an admin stays logged in.
+const adminSessionTTL = 12 * time.Hour
+
+// adminCookieName is the name of the admin session cookie.
+const adminCookieName = "neartalk_admin"
+
+// mainAdminKeyID is the ID of the key from the -key flag.
+const mainAdminKeyID = "main"
+
+// adminKeyIDRe matches valid key IDs in the -admin-keys file.
+var adminKeyIDRe = regexp.MustCompile(`^[A-Za-z0-9_-]{1,32}$`)
+
+// adminKeyStore holds the admin keys, and signs admin sessions.
+type adminKeyStore struct {
+	// secret signs session cookies. It's made when the server starts, so
+	// restarting logs everyone out.
+	secret []byte
+
+	mu sync.Mutex
+	// keys holds the keys by ID.
+	keys map[string]string
+	// modTime is when the -admin-keys file was last changed, when it was
+	// read.
+	modTime time.Time
+}
+
+func newAdminKeyStore() *adminKeyStore {
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		panic(err)
+	}
+	return &adminKeyStore{secret: secret}
+}
+
+// readAdminKeysFile reads the keys in the -admin-keys file, by ID.
+func readAdminKeysFile(path string) (map[string]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	keys := make(map[string]string)
+	s := bufio.NewScanner(f)
+	for line := 1; s.Scan(); line++ {
+		text := strings.TrimSpace(s.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		id, key, ok := strings.Cut(text, " ")
+		key = strings.TrimSpace(key)
+		if !ok || key == "" {
+			return nil, fmt.Errorf("%s:%d: want <id> <key>", path, line)
+		}
+		if !adminKeyIDRe.MatchString(id) {
+			return nil, fmt.Errorf("%s:%d: IDs can only have letters, numbers, _ and -", path, line)
+		}
+		if _, dup := keys[id]; dup || id == mainAdminKeyID {
+			return nil, fmt.Errorf("%s:%d: duplicate ID %s", path, line, id)
+		}
+		keys[id] = key
+	}
+	return keys, s.Err()
+}
+
+// current returns the admin keys by ID, reading the -admin-keys file again if
+// it has changed. If it can't be read, the keys from before are kept.
+func (ks *adminKeyStore) current() map[string]string {
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+
+	if adminKeysFile == "" {
+		ks.keys = nil
+	} else if fi, err := os.Stat(adminKeysFile); err != nil {
+		log.Printf("adminKeyStore: can't read %s, keeping the keys from before: %v", adminKeysFile, err)
+	} else if !fi.ModTime().Equal(ks.modTime) {
+		keys, err := readAdminKeysFile(adminKeysFile)
+		if err != nil {
+			log.Printf("adminKeyStore: keeping the keys from before: %v", err)
+		} else {
+			log.Printf("adminKeyStore: loaded %d keys from %s", len(keys), adminKeysFile)
+			ks.keys = keys
+			ks.modTime = fi.ModTime()
+		}
+	}
+
+	keys := make(map[string]string, len(ks.keys)+1)
+	for id, key := range ks.keys {
+		keys[id] = key
+	}
+	if adminKey != "" {
+		keys[mainAdminKeyID] = adminKey
+	}
+	return keys
+}
+
+// lookup returns the ID of the key, or false if it isn't an admin key.
+func (ks *adminKeyStore) lookup(key string) (string, bool) {
+	found := ""
+	for id, k := range ks.current() {
+		// Every key is compared so the time taken doesn't give anything away
+		if subtle.ConstantTimeCompare([]byte(k), []byte(key)) == 1 {
+			found = id
+		}
+	}
+	return found, found != ""
+}
+
+// keyFingerprint identifies a key in session cookies, without revealing it.
+func keyFingerprint(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:8])
+}
+
+// sign returns the signature of the session cookie payload.
+func (ks *adminKeyStore) sign(payload string) string {
+	mac := hmac.New(sha256.New, ks.secret)
+	io.WriteString(mac, payload)
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// newSession returns a session cookie value for the key ID.
+func (ks *adminKeyStore) newSession(id, key string, expires time.Time) string {
+	payload := fmt.Sprintf("%s.%d.%s", id, expires.Unix(), keyFingerprint(key))
+	return payload + "." + ks.sign(payload)
+}
+
+// checkSession returns the key ID of the session cookie value, or false if
+// it's invalid, expired, or its key was revoked or changed.
+func (ks *adminKeyStore) checkSession(value string) (string, bool) {
+	i := strings.LastIndex(value, ".")
+	if i < 0 {
+		return "", false
+	}
+	payload, sig := value[:i], value[i+1:]
+	if !hmac.Equal([]byte(sig), []byte(ks.sign(payload))) {
+		return "", false
+	}
+	parts := strings.Split(payload, ".")
+	if len(parts) != 3 {
+		return "", false
+	}
+	expires, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil || time.Now().Unix() > expires {
+		return "", false
+	}
+	key, ok := ks.current()[parts[0]]
+	if !ok || keyFingerprint(key) != parts[2] {
+		return "", false
+	}
+	return parts[0], true
+}
+
+// adminSession returns the ID of the key the admin logged in with, or false
+// if the request isn't from a logged in admin, or it's a POST without the
+// session's CSRF token, see origin.go.
+func (cs *chatServer) adminSession(r *http.Request) (string, bool) {
+	c, err := r.Cookie(adminCookieName)
+	if err != nil || !cs.adminKeys.checkCSRF(r, c.Value) {
+		return "", false
+	}
+	return cs.adminKeys.checkSession(c.Value)
+}
+
+// isAdmin returns true if the request is from a logged in admin.
+func (cs *chatServer) isAdmin(r *http.Request) bool {
+	_, ok := cs.adminSession(r)
+	return ok
+}
+
+// isHTTPS returns true if the request was made over HTTPS, directly or
+// through a proxy.
+func isHTTPS(r *http.Request) bool {
+	return r.TLS != nil || r.Header.Get("X-Forwarded-Proto") == "https"
+}
+
+// adminLoginPage is shown on /admin to admins that aren't logged in.
+const adminLoginPage = `<!DOCTYPE html>
+<html lang="en">
+    <head>
+        <meta charset="UTF-8" />
+        <title>NearTalk Admin</title>
+        <meta name="viewport" content="width=device-width, initial-scale=1.0" />
+        <link href="/simple.css" rel="stylesheet" />
+    </head>
+    <body>
+        <h1>Admin Interface</h1>
+        %s
+        <form method="post" action="/admin">
+            <input type="password" name="key" placeholder="Admin key" autofocus required />
+            <button type="submit">Log in</button>
+        </form>
+    </body>
+</html>`
+
+// adminLoginHandler logs admins in when they POST a key to /admin, and shows
+// the login form to anyone not logged in.
+func (cs *chatServer) adminLoginHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if r.Method != http.MethodPost {
+		fmt.Fprintf(w, adminLoginPage, "")
+		return
+	}
+	key := r.PostFormValue("key")
+	id, ok := cs.adminKeys.lookup(key)
+	if !ok {
+		log.Printf("chatServer.adminLoginHandler: failed login from %s", logAddr(r))
+		// Slow down guessing
+		time.Sleep(time.Second)
+		w.WriteHeader(http.StatusForbidden)
+		fmt.Fprintf(w, adminLoginPage, `<p><strong>That key isn't right.</strong></p>`)
+		return
+	}
+	expires := time.Now().Add(adminSessionTTL)
+	http.SetCookie(w, &http.Cookie{
+		Name:     adminCookieName,
+		Value:    cs.adminKeys.newSession(id, key, expires),
+		Path:     "/",
+		Expires:  expires,
+		HttpOnly: true,
+		Secure:   isHTTPS(r),
+		SameSite: http.SameSiteStrictMode,
+	})
+	cs.audit.record(id, auditLogin, logAddr(r), "")
+	http.Redirect(w, r, "/admin", http.StatusSeeOther)
+}
+
+// adminLogoutHandler ends the admin session.
+func (cs *chatServer) adminLogoutHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     adminCookieName,
+		Value:    "",
+		Path:     "/",
+		MaxAge:   -1,
+		HttpOnly: true,
+		Secure:   isHTTPS(r),
+		SameSite: http.SameSiteStrictMode,
+	})
+	http.Redirect(w, r, "/admin", http.StatusSeeOther)
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestAdminSession(t *testing.T) {
+	defer func(k, f string) { adminKey, adminKeysFile = k, f }(adminKey, adminKeysFile)
+	adminKey = "main key for testing"
+	adminKeysFile = filepath.Join(t.TempDir(), "keys")
+	if err := os.WriteFile(adminKeysFile, []byte("# comment\nalice alice's key\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	ks := newAdminKeyStore()
+	id, ok := ks.lookup("alice's key")
+	if !ok || id != "alice" {
+		t.Fatalf("lookup = %q, %v, want alice", id, ok)
+	}
+	if _, ok := ks.lookup("wrong"); ok {
+		t.Error("lookup of a wrong key worked")
+	}
+	if id, _ := ks.lookup(adminKey); id != mainAdminKeyID {
+		t.Errorf("lookup of -key = %q, want %s", id, mainAdminKeyID)
+	}
+
+	session := ks.newSession("alice", "alice's key", time.Now().Add(time.Hour))
+	if id, ok := ks.checkSession(session); !ok || id != "alice" {
+		t.Errorf("checkSession = %q, %v, want alice", id, ok)
+	}
+	if _, ok := ks.checkSession(session + "x"); ok {
+		t.Error("session with a bad signature worked")
+	}
+	if _, ok := ks.checkSession(ks.newSession("alice", "alice's key", time.Now().Add(-time.Second))); ok {
+		t.Error("expired session worked")
+	}
+	if _, ok := newAdminKeyStore().checkSession(session); ok {
+		t.Error("session worked after a restart")
+	}
+
+	// Rotating the key ends the session
+	if err := os.WriteFile(adminKeysFile, []byte("alice alice's new key\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	later := time.Now().Add(time.Second)
+	os.Chtimes(adminKeysFile, later, later)
+	if _, ok := ks.checkSession(session); ok {
+		t.Error("session worked after its key changed")
+	}
+}
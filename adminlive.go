@@ -0,0 +1,286 @@
+package main
+
+// This file keeps the admin page up to date over a websocket. The admin page
+// connects to /admin-ws, and the adminHub sends it the parts of the page that
+// changed whenever someone joins, leaves, or sends a message, as htmx
+// out-of-band swaps. The page is also refreshed every adminRefreshInterval so
+// times and message rates stay current.
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/dustin/go-humanize"
+	"nhooyr.io/websocket"
+)
+
+// adminRefreshInterval is how often the admin page is updated when nothing
+// happens.
+const adminRefreshInterval = 5 * time.Second
+
+// adminMinInterval is the least time between updates of the admin page, so
+// busy rooms don't flood it.
+const adminMinInterval = 500 * time.Millisecond
+
+// adminSubBuffer is how many updates can be queued for an admin page before
+// it's disconnected for being too slow.
+const adminSubBuffer = 16
+
+// msgRateWindow is how far back messages are counted for the message rate
+// shown to the admin.
+const msgRateWindow = time.Minute
+
+// adminSub is an admin page connected to the adminHub.
+type adminSub struct {
+	// outgoing receives HTML to send to the page. It's closed if the page
+	// can't keep up.
+	outgoing chan string
+}
+
+// adminRoomView is how a room is shown on the admin page.
+type adminRoomView struct {
+	// stats is the part that changes, which is updated in place.
+	stats string
+	// forms is the part with forms, which is only sent once so it doesn't
+	// clear what the admin is typing.
+	forms string
+}
+
+// adminHub sends updates to the admin pages. All its fields except the
+// channels are only accessed by its run goroutine.
+type adminHub struct {
+	cs    *chatServer
+	pokes chan struct{}
+	join  chan *adminSub
+	leave chan *adminSub
+
+	subs map[*adminSub]struct{}
+	// summary and rooms are what the admin pages are currently showing.
+	summary string
+	rooms   map[string]adminRoomView
+}
+
+func newAdminHub(cs *chatServer) *adminHub {
+	h := &adminHub{
+		cs:    cs,
+		pokes: make(chan struct{}, 1),
+		join:  make(chan *adminSub),
+		leave: make(chan *adminSub),
+		subs:  make(map[*adminSub]struct{}),
+		rooms: make(map[string]adminRoomView),
+	}
+	go h.run()
+	return h
+}
+
+// poke tells the hub something changed. It never blocks.
+func (h *adminHub) poke() {
+	select {
+	case h.pokes <- struct{}{}:
+	default:
+		// An update is already coming
+	}
+}
+
+func (h *adminHub) run() {
+	refresh := time.NewTicker(adminRefreshInterval)
+	defer refresh.Stop()
+	for {
+		select {
+		case sub := <-h.join:
+			h.subs[sub] = struct{}{}
+			h.update(sub)
+		case sub := <-h.leave:
+			delete(h.subs, sub)
+		case <-h.pokes:
+			if len(h.subs) > 0 {
+				h.update(nil)
+				time.Sleep(adminMinInterval)
+			}
+		case <-refresh.C:
+			if len(h.subs) > 0 {
+				h.update(nil)
+			}
+		}
+	}
+}
+
+// update sends what changed since the last update to the admin pages. The
+// new page, if any, gets all of it instead.
+func (h *adminHub) update(newSub *adminSub) {
+	summary, rooms := h.cs.adminSnapshot()
+
+	var diff strings.Builder
+	if summary != h.summary {
+		fmt.Fprintf(&diff, `<div id="admin-summary" hx-swap-oob="true">%s</div>`, summary)
+	}
+	for key, v := range rooms {
+		old, ok := h.rooms[key]
+		if !ok {
+			fmt.Fprintf(&diff, `<div id="admin-rooms" hx-swap-oob="beforeend">%s</div>`, adminRoomBlock(key, v))
+		} else if v.stats != old.stats {
+			fmt.Fprintf(&diff, `<div id="%s-stats" hx-swap-oob="true">%s</div>`, adminRoomID(key), v.stats)
+		}
+	}
+	for key := range h.rooms {
+		if _, ok := rooms[key]; !ok {
+			fmt.Fprintf(&diff, `<div id="%s" hx-swap-oob="true"></div>`, adminRoomID(key))
+		}
+	}
+	h.summary = summary
+	h.rooms = rooms
+
+	for sub := range h.subs {
+		s := diff.String()
+		if sub == newSub {
+			s = `<div id="admin-data" hx-swap-oob="true">` + renderAdminData(summary, rooms) + `</div>`
+		}
+		if s == "" {
+			continue
+		}
+		select {
+		case sub.outgoing <- s:
+		default:
+			// Too slow, the handler will disconnect it
+			delete(h.subs, sub)
+			close(sub.outgoing)
+		}
+	}
+}
+
+// adminSnapshot returns the summary for the top of the admin page, and how
+// each room should be shown, by room key.
+func (cs *chatServer) adminSnapshot() (string, map[string]adminRoomView) {
+	cs.roomsMu.Lock()
+	defer cs.roomsMu.Unlock()
+
+	summary := fmt.Sprintf(`<p>%d chat rooms</p><p>%d websocket write timeouts since starting</p>`+
+		`<p>%d messages dropped for slow connections since starting</p>`+
+		`<p>%d connections turned away for being too busy since starting</p>`+
+		`<p>%d chat rooms opened since starting, %d closed when everyone left, %d evicted, %d expired, and %d closed by an admin</p>`,
+		len(cs.rooms), writeTimeouts.Load(), droppedFrames.Load(), turnedAway.Load(),
+		roomCounts.created.Load(), roomCounts.empty.Load(), roomCounts.evicted.Load(), roomCounts.expired.Load(),
+		roomCounts.admin.Load(),
+	) + cs.closedRooms.html()
+	rooms := make(map[string]adminRoomView, len(cs.rooms))
+	for key, room := range cs.rooms {
+		room.clientsMu.Lock()
+		var stats strings.Builder
+		fmt.Fprintf(&stats, `<h2>%s</h2><p>%d chatters</p><p>%d messages in the last minute</p><p>Last message: %s</p>`,
+			template.HTMLEscapeString(roomTitle(key)), len(room.clients), room.recentMsgCount(),
+			humanize.RelTime(room.whenLastMsg, time.Now(), "ago", "from now"),
+		)
+		if room.network != "" {
+			fmt.Fprintf(&stats, `<p>Network: %s</p>`, template.HTMLEscapeString(room.network))
+		}
+		stats.WriteString(room.statsHTML())
+		stats.WriteString(room.adminMutedHTML())
+		slowMode := room.slowMode
+		room.clientsMu.Unlock()
+		if e, ok := room.listing(); ok {
+			fmt.Fprintf(&stats, `<p>Listed in directory as <b>%s</b>: %s</p>`,
+				template.HTMLEscapeString(e.Name), template.HTMLEscapeString(e.Topic))
+			stats.WriteString(adminListingButton(e.Name, cs.isListingHidden(e.Name)))
+		}
+		rooms[key] = adminRoomView{stats: stats.String(), forms: adminWatchLink(key) + adminModeratorForm(key) + adminSlowModeForm(key, slowMode) + adminCloseRoomButton(key)}
+	}
+	return summary, rooms
+}
+
+// renderAdminData renders the whole admin page data, with the rooms sorted by
+// key.
+func renderAdminData(summary string, rooms map[string]adminRoomView) string {
+	keys := make([]string, 0, len(rooms))
+	for key := range rooms {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	var b strings.Builder
+	fmt.Fprintf(&b, `<div id="admin-summary">%s</div><hr /><div id="admin-rooms">`, summary)
+	for _, key := range keys {
+		b.WriteString(adminRoomBlock(key, rooms[key]))
+	}
+	b.WriteString(`</div>`)
+	return b.String()
+}
+
+// adminRoomID returns the HTML element ID for a room on the admin page. Room
+// keys can't be used as is, as they have characters like dots and colons.
+func adminRoomID(key string) string {
+	return "room-" + hex.EncodeToString([]byte(key))
+}
+
+// adminRoomBlock returns the HTML for a room on the admin page.
+func adminRoomBlock(key string, v adminRoomView) string {
+	id := adminRoomID(key)
+	return fmt.Sprintf(`<div id="%s"><div id="%s-stats">%s</div>%s</div>`, id, id, v.stats, v.forms)
+}
+
+// recordMsg records that a chat message was sent in the room, for the
+// message rate.
+// It does not lock the clientsMu, callers should do that.
+func (cr *chatRoom) recordMsg(when time.Time) {
+	cr.recentMsgCount() // Drops the old ones
+	cr.msgTimes = append(cr.msgTimes, when)
+	cr.stats.recordMsg(when)
+	cr.server.msgsToday.add(when)
+	cr.server.admins.poke()
+}
+
+// recentMsgCount returns how many chat messages were sent in the room in the
+// last msgRateWindow.
+// It does not lock the clientsMu, callers should do that.
+func (cr *chatRoom) recentMsgCount() int {
+	cutoff := time.Now().Add(-msgRateWindow)
+	i := 0
+	for i < len(cr.msgTimes) && cr.msgTimes[i].Before(cutoff) {
+		i++
+	}
+	cr.msgTimes = cr.msgTimes[i:]
+	return len(cr.msgTimes)
+}
+
+// adminWSHandler sends live updates to the admin page over a websocket.
+func (cs *chatServer) adminWSHandler(w http.ResponseWriter, r *http.Request) {
+	if !cs.isAdmin(r) {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	conn, err := acceptWS(w, r, nil)
+	if err != nil {
+		log.Printf("chatServer.adminWSHandler: websocket accept error: %v", err)
+		return
+	}
+	defer conn.Close(websocket.StatusInternalError, "")
+	// The page never sends anything
+	ctx := conn.CloseRead(r.Context())
+
+	sub := &adminSub{outgoing: make(chan string, adminSubBuffer)}
+	cs.admins.join <- sub
+	defer func() { cs.admins.leave <- sub }()
+
+	for {
+		select {
+		case s, ok := <-sub.outgoing:
+			if !ok {
+				conn.Close(websocket.StatusPolicyViolation, "connection too slow to keep up with updates")
+				return
+			}
+			wctx, cancel := context.WithTimeout(ctx, writeTimeoutDuration)
+			err := conn.Write(wctx, websocket.MessageText, []byte(s))
+			cancel()
+			if err != nil {
+				return
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,98 @@
+package main
+
+// This file has room aliases, which put people from a set of addresses in
+// one room with a name, instead of a room for each address. They're for
+// places with more than one address, like a campus with a few egress IPs:
+//
+//	"room_aliases": [{"name": "University", "subnets": ["203.0.113.0/24", "198.51.100.7"]}]
+//
+// Aliases are checked before anything else that decides the room for an
+// address, like GeoIP places and -private-rooms, and the name is shown in the
+// room header instead of the address. They're ignored in LAN mode, where
+// lan_rooms does the same, see lanmode.go.
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+// maxConfigRoomName is how long the names of rooms from the config file,
+// aliases and LAN rooms, can be.
+const maxConfigRoomName = 64
+
+// configRoomAlias is a room alias in the config file.
+type configRoomAlias struct {
+	// Name is the room's name, which is shown in the header and is its key.
+	Name string `json:"name"`
+	// Subnets are the addresses whose people are put in the room, in CIDR
+	// notation, or single addresses.
+	Subnets []string `json:"subnets"`
+}
+
+// roomAlias is a parsed configRoomAlias.
+type roomAlias struct {
+	name string
+	nets []*net.IPNet
+}
+
+// checkConfigRoomName returns an error if the name can't be used for a room
+// from the config file, because it's too long, or could be mistaken for the
+// key of another kind of room.
+func checkConfigRoomName(name string) error {
+	if name == "" || len(name) > maxConfigRoomName {
+		return fmt.Errorf("name must be 1 to %d bytes long", maxConfigRoomName)
+	}
+	_, _, err := net.ParseCIDR(name)
+	if strings.HasPrefix(name, namedRoomPrefix) || strings.HasPrefix(name, privateRoomPrefix) ||
+		strings.Contains(name, subroomSep) || strings.EqualFold(name, lanRoomKey) ||
+		net.ParseIP(name) != nil || err == nil {
+		return fmt.Errorf("name %q could be mistaken for another kind of room", name)
+	}
+	return nil
+}
+
+// parseRoomAliases parses and validates the room aliases in the config file.
+func parseRoomAliases(cas []configRoomAlias) ([]roomAlias, error) {
+	names := make(map[string]bool)
+	aliases := make([]roomAlias, 0, len(cas))
+	for i, ca := range cas {
+		name := strings.TrimSpace(ca.Name)
+		if err := checkConfigRoomName(name); err != nil {
+			return nil, fmt.Errorf("room alias %d: %w", i+1, err)
+		}
+		if names[name] {
+			return nil, fmt.Errorf("room alias %d: name %q is already used", i+1, name)
+		}
+		names[name] = true
+		if len(ca.Subnets) == 0 {
+			return nil, fmt.Errorf("room alias %d: no subnets are listed", i+1)
+		}
+		alias := roomAlias{name: name}
+		for _, s := range ca.Subnets {
+			n, err := parseSubnet(s)
+			if err != nil {
+				return nil, fmt.Errorf("room alias %d: %w", i+1, err)
+			}
+			alias.nets = append(alias.nets, n)
+		}
+		aliases = append(aliases, alias)
+	}
+	return aliases, nil
+}
+
+// aliasFor returns the name of the first room alias with a subnet the address
+// is in, or an empty string if there isn't one. The address can be nil.
+func aliasFor(ip net.IP) string {
+	if ip == nil {
+		return ""
+	}
+	for _, alias := range currentConfig().roomAliases {
+		for _, n := range alias.nets {
+			if n.Contains(ip) {
+				return alias.name
+			}
+		}
+	}
+	return ""
+}
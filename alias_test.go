@@ -0,0 +1,58 @@
+package main
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestParseRoomAliases(t *testing.T) {
+	bad := [][]configRoomAlias{
+		{{Name: "", Subnets: []string{"203.0.113.0/24"}}},
+		{{Name: "#campus", Subnets: []string{"203.0.113.0/24"}}},
+		{{Name: "203.0.113.7", Subnets: []string{"203.0.113.0/24"}}},
+		{{Name: "10.1.0.0/16", Subnets: []string{"203.0.113.0/24"}}},
+		{{Name: "lan", Subnets: []string{"203.0.113.0/24"}}},
+		{{Name: "University", Subnets: nil}},
+		{{Name: "University", Subnets: []string{"example.com"}}},
+		{{Name: "University", Subnets: []string{"203.0.113.0/24"}}, {Name: "University", Subnets: []string{"198.51.100.7"}}},
+	}
+	for i, cas := range bad {
+		if _, err := parseRoomAliases(cas); err == nil {
+			t.Errorf("bad room aliases %d were accepted", i)
+		}
+	}
+}
+
+func TestRoomKeyAlias(t *testing.T) {
+	c, err := parseConfig([]byte(`{"room_aliases": [{"name": "University", "subnets": ["203.0.113.0/24", "2001:db8::7"]},
+		{"name": "Library", "subnets": ["203.0.113.9"]}]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer liveConfig.Store(liveConfig.Swap(c))
+	tests := []struct {
+		addr string
+		want string
+	}{
+		{"203.0.113.5:1234", "University"},
+		// The first alias wins
+		{"203.0.113.9:1234", "University"},
+		{"[2001:db8::7]:1234", "University"},
+		{"[2001:db8::8]:1234", "2001:db8::8"},
+		{"198.51.100.7:1234", "198.51.100.7"},
+		{"127.0.0.1:1234", lanRoomKey},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.RemoteAddr = tt.addr
+		if got := roomKey(r); got != tt.want {
+			t.Errorf("roomKey from %s = %q, want %q", tt.addr, got, tt.want)
+		}
+	}
+	if got := erasureRoomKey("203.0.113.5"); got != "University" {
+		t.Errorf("erasing an aliased address erases %q", got)
+	}
+	if got := roomTitle("University"); got != "University" {
+		t.Errorf("alias title = %q", got)
+	}
+}
@@ -0,0 +1,475 @@
+package main
+
+// This file handles scheduled announcements, which are sent to every room or
+// one room at set times, like a reminder that a talk starts soon. They're
+// listed under "announcements" in the config file, or added from the admin
+// page or the REST API, where they last until NearTalk restarts. Each has a
+// schedule, which is one of:
+//
+//	m h dom mon dow    cron-style, like "0 18 * * 5" for 6pm every Friday
+//	@every <duration>  repeating, like "@every 2h30m"
+//	@at <time>         once, like "@at 2026-10-20T18:00:00Z"
+//
+// Cron-style fields can be *, a number, a range like 1-5, a list like 1,3,5,
+// or any of those with a step like */15. Days of the week are 0-7, where both
+// 0 and 7 are Sunday. Times are in the server's timezone.
+//
+// The scheduler goroutine is owned by the chatServer, and sleeps until the
+// next announcement is due.
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// schedule decides when an announcement is sent.
+type schedule interface {
+	// next returns the first time after t the announcement should be sent,
+	// or the zero time if it never should again.
+	next(t time.Time) time.Time
+}
+
+// parseSchedule parses a schedule, see the top of this file.
+func parseSchedule(spec string) (schedule, error) {
+	spec = strings.TrimSpace(spec)
+	if d, ok := strings.CutPrefix(spec, "@every "); ok {
+		dur, err := time.ParseDuration(strings.TrimSpace(d))
+		if err != nil {
+			return nil, err
+		}
+		if dur < time.Minute {
+			return nil, errors.New("@every needs at least a minute between announcements")
+		}
+		return everySchedule(dur), nil
+	}
+	if at, ok := strings.CutPrefix(spec, "@at "); ok {
+		t, err := time.Parse(time.RFC3339, strings.TrimSpace(at))
+		if err != nil {
+			return nil, err
+		}
+		return atSchedule(t), nil
+	}
+	return parseCron(spec)
+}
+
+// everySchedule repeats after the duration.
+type everySchedule time.Duration
+
+func (s everySchedule) next(t time.Time) time.Time {
+	return t.Add(time.Duration(s))
+}
+
+// atSchedule happens once, at the time.
+type atSchedule time.Time
+
+func (s atSchedule) next(t time.Time) time.Time {
+	if at := time.Time(s); at.After(t) {
+		return at
+	}
+	return time.Time{}
+}
+
+// cronSchedule is a cron-style schedule. Each field is a bitmask of the
+// values that match.
+type cronSchedule struct {
+	minute, hour, dom, month, dow uint64
+	// anyDom and anyDow are true if those fields were *, which changes how
+	// days are matched, as in cron.
+	anyDom, anyDow bool
+}
+
+// cronField is the range of values allowed in a cron field.
+type cronField struct {
+	name     string
+	min, max int
+}
+
+var cronFields = [5]cronField{
+	{"minute", 0, 59},
+	{"hour", 0, 23},
+	{"day of month", 1, 31},
+	{"month", 1, 12},
+	{"day of week", 0, 7},
+}
+
+// parseCron parses a cron-style schedule.
+func parseCron(spec string) (*cronSchedule, error) {
+	parts := strings.Fields(spec)
+	if len(parts) != len(cronFields) {
+		return nil, fmt.Errorf("schedule %q should have 5 fields, or start with @every or @at", spec)
+	}
+	var masks [5]uint64
+	for i, part := range parts {
+		mask, err := parseCronField(part, cronFields[i])
+		if err != nil {
+			return nil, err
+		}
+		masks[i] = mask
+	}
+	if masks[4]&(1<<7) != 0 {
+		// 7 is Sunday too
+		masks[4] |= 1
+	}
+	return &cronSchedule{
+		minute: masks[0], hour: masks[1], dom: masks[2], month: masks[3], dow: masks[4],
+		anyDom: parts[2] == "*", anyDow: parts[4] == "*",
+	}, nil
+}
+
+// parseCronField parses one field of a cron-style schedule into a bitmask.
+func parseCronField(s string, f cronField) (uint64, error) {
+	var mask uint64
+	for _, item := range strings.Split(s, ",") {
+		rng, stepStr, hasStep := strings.Cut(item, "/")
+		step := 1
+		if hasStep {
+			var err error
+			if step, err = strconv.Atoi(stepStr); err != nil || step < 1 {
+				return 0, fmt.Errorf("invalid step in %s %q", f.name, item)
+			}
+		}
+		lo, hi := f.min, f.max
+		if rng != "*" {
+			loStr, hiStr, isRange := strings.Cut(rng, "-")
+			var err error
+			if lo, err = strconv.Atoi(loStr); err != nil {
+				return 0, fmt.Errorf("invalid %s %q", f.name, item)
+			}
+			hi = lo
+			if isRange {
+				if hi, err = strconv.Atoi(hiStr); err != nil {
+					return 0, fmt.Errorf("invalid %s %q", f.name, item)
+				}
+			} else if hasStep {
+				hi = f.max
+			}
+		}
+		if lo < f.min || hi > f.max || lo > hi {
+			return 0, fmt.Errorf("%s %q is out of range %d-%d", f.name, item, f.min, f.max)
+		}
+		for v := lo; v <= hi; v += step {
+			mask |= 1 << v
+		}
+	}
+	return mask, nil
+}
+
+// matchesDay returns true if the schedule matches the day of t.
+func (s *cronSchedule) matchesDay(t time.Time) bool {
+	dom := s.dom&(1<<t.Day()) != 0
+	dow := s.dow&(1<<t.Weekday()) != 0
+	if s.anyDom || s.anyDow {
+		return dom && dow
+	}
+	// Like cron, either matching is enough when both are restricted
+	return dom || dow
+}
+
+func (s *cronSchedule) next(t time.Time) time.Time {
+	t = t.Truncate(time.Minute).Add(time.Minute)
+	limit := t.AddDate(5, 0, 0)
+	for t.Before(limit) {
+		switch {
+		case s.month&(1<<t.Month()) == 0:
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, t.Location())
+		case !s.matchesDay(t):
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, t.Location())
+		case s.hour&(1<<t.Hour()) == 0:
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, t.Location())
+		case s.minute&(1<<t.Minute()) == 0:
+			t = t.Add(time.Minute)
+		default:
+			return t
+		}
+	}
+	// Like February 30th
+	return time.Time{}
+}
+
+// configAnnouncement is an announcement in the config file.
+type configAnnouncement struct {
+	Schedule string `json:"schedule"`
+	// Room is the key of the room to send it to, or empty for every room.
+	Room string `json:"room,omitempty"`
+	Text string `json:"text"`
+}
+
+// announcement is a scheduled announcement.
+type announcement struct {
+	id    int
+	spec  string
+	sched schedule
+	room  string
+	text  string
+	// fromConfig is true if it's from the config file, which replaces it
+	// when reloaded.
+	fromConfig bool
+	// due is when it's next sent.
+	due time.Time
+}
+
+// newAnnouncement checks and parses an announcement.
+func newAnnouncement(ca configAnnouncement) (*announcement, error) {
+	text := strings.TrimSpace(ca.Text)
+	if text == "" {
+		return nil, errors.New("announcements need text")
+	}
+	if len(text) > maxAnnouncementLen {
+		return nil, fmt.Errorf("announcements can be at most %d bytes long", maxAnnouncementLen)
+	}
+	sched, err := parseSchedule(ca.Schedule)
+	if err != nil {
+		return nil, err
+	}
+	return &announcement{spec: strings.TrimSpace(ca.Schedule), sched: sched, room: ca.Room, text: text}, nil
+}
+
+// announcer sends the scheduled announcements.
+type announcer struct {
+	cs *chatServer
+	// wake tells the run goroutine the announcements changed.
+	wake chan struct{}
+
+	mu     sync.Mutex
+	items  []*announcement
+	nextID int
+}
+
+func newAnnouncer(cs *chatServer) *announcer {
+	a := &announcer{cs: cs, wake: make(chan struct{}, 1)}
+	go a.run()
+	return a
+}
+
+// poke tells the run goroutine the announcements changed. It never blocks.
+func (a *announcer) poke() {
+	select {
+	case a.wake <- struct{}{}:
+	default:
+	}
+}
+
+// errNeverDue is returned when scheduling an announcement that would never
+// be sent, like one for a time that has passed.
+var errNeverDue = errors.New("that schedule never comes up")
+
+// add schedules the announcement, returning it with its ID and when it's
+// due.
+func (a *announcer) add(an *announcement) (announcement, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	an.due = an.sched.next(time.Now())
+	if an.due.IsZero() {
+		return announcement{}, errNeverDue
+	}
+	a.nextID++
+	an.id = a.nextID
+	a.items = append(a.items, an)
+	a.poke()
+	return *an, nil
+}
+
+// remove unschedules the announcement with the ID, returning false if there
+// isn't one, or it's from the config file.
+func (a *announcer) remove(id int) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for i, an := range a.items {
+		if an.id == id && !an.fromConfig {
+			a.items = append(a.items[:i], a.items[i+1:]...)
+			a.poke()
+			return true
+		}
+	}
+	return false
+}
+
+// setConfigured replaces the announcements from the config file.
+func (a *announcer) setConfigured(anns []*announcement) {
+	a.mu.Lock()
+	kept := a.items[:0]
+	for _, an := range a.items {
+		if !an.fromConfig {
+			kept = append(kept, an)
+		}
+	}
+	a.items = kept
+	a.mu.Unlock()
+	for _, an := range anns {
+		c := *an
+		c.fromConfig = true
+		// One-off announcements that were already sent are skipped
+		a.add(&c)
+	}
+	a.poke()
+}
+
+// list returns the scheduled announcements, soonest first.
+func (a *announcer) list() []announcement {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	anns := make([]announcement, len(a.items))
+	for i, an := range a.items {
+		anns[i] = *an
+	}
+	sort.Slice(anns, func(i, j int) bool { return anns[i].due.Before(anns[j].due) })
+	return anns
+}
+
+// takeDue returns the announcements that are due, and when the next one
+// after them is due, or the zero time if there aren't any more. One-off
+// announcements are removed once they're taken.
+func (a *announcer) takeDue(now time.Time) ([]announcement, time.Time) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	var due []announcement
+	var soonest time.Time
+	kept := a.items[:0]
+	for _, an := range a.items {
+		if !an.due.After(now) {
+			due = append(due, *an)
+			an.due = an.sched.next(now)
+		}
+		if an.due.IsZero() {
+			continue
+		}
+		kept = append(kept, an)
+		if soonest.IsZero() || an.due.Before(soonest) {
+			soonest = an.due
+		}
+	}
+	a.items = kept
+	return due, soonest
+}
+
+func (a *announcer) run() {
+	timer := time.NewTimer(time.Hour)
+	defer timer.Stop()
+	for {
+		due, soonest := a.takeDue(time.Now())
+		for _, an := range due {
+			a.cs.announce(an.room, an.text)
+		}
+		wait := time.Hour
+		if !soonest.IsZero() {
+			wait = time.Until(soonest)
+		}
+		if !timer.Stop() {
+			select {
+			case <-timer.C:
+			default:
+			}
+		}
+		timer.Reset(wait)
+		select {
+		case <-timer.C:
+		case <-a.wake:
+		}
+	}
+}
+
+// announce sends the announcement to the room with the key, or every room if
+// the key is empty. It doesn't wait for busy rooms.
+func (cs *chatServer) announce(key, text string) {
+	cs.roomsMu.Lock()
+	defer cs.roomsMu.Unlock()
+	for k, room := range cs.rooms {
+		if key != "" && k != key {
+			continue
+		}
+		go func(k string, room *chatRoom) {
+			if err := room.announce(context.Background(), text); err != nil {
+				log.Printf("chatServer.announce: skipped room %s: %v", k, err)
+			}
+		}(k, room)
+	}
+}
+
+// adminAnnouncementsHandler serves the admin page list of scheduled
+// announcements. When POSTed, it adds the announcement in the form, or
+// removes the one with the ID in "remove".
+func (cs *chatServer) adminAnnouncementsHandler(w http.ResponseWriter, r *http.Request) {
+	keyID, ok := cs.adminSession(r)
+	if !ok {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	status := ""
+	if r.Method == http.MethodPost {
+		if idStr := r.FormValue("remove"); idStr != "" {
+			id, _ := strconv.Atoi(idStr)
+			if cs.announcer.remove(id) {
+				cs.audit.record(keyID, auditUnschedule, idStr, "")
+			}
+		} else {
+			ca := configAnnouncement{
+				Schedule: r.FormValue("schedule"),
+				Room:     strings.TrimSpace(r.FormValue("room")),
+				Text:     r.FormValue("text"),
+			}
+			an, err := newAnnouncement(ca)
+			if err == nil {
+				_, err = cs.announcer.add(an)
+			}
+			if err != nil {
+				status = err.Error()
+			} else {
+				cs.audit.record(keyID, auditSchedule, an.room, an.spec+": "+an.text)
+				status = "Scheduled."
+			}
+		}
+	}
+	fmt.Fprint(w, adminAnnouncements(cs.announcer.list(), status))
+}
+
+// adminAnnouncements returns the admin page list of scheduled announcements,
+// and the form for adding one, with a status message if status isn't empty.
+func adminAnnouncements(anns []announcement, status string) string {
+	var b strings.Builder
+	b.WriteString(`<div hx-target="this" hx-swap="outerHTML">`)
+	if len(anns) == 0 {
+		b.WriteString(`<p>No announcements scheduled.</p>`)
+	} else {
+		b.WriteString(`<table><thead><tr><th>Next</th><th>Schedule</th><th>Room</th><th>Text</th><th></th></tr></thead><tbody>`)
+		for _, an := range anns {
+			room := "Every room"
+			if an.room != "" {
+				room = an.room
+			}
+			remove := "From config"
+			if !an.fromConfig {
+				vals, _ := json.Marshal(map[string]string{"remove": strconv.Itoa(an.id)})
+				remove = fmt.Sprintf(`<button hx-post="/admin-announcements" hx-vals="%s">Remove</button>`,
+					template.HTMLEscapeString(string(vals)))
+			}
+			fmt.Fprintf(&b, `<tr><td>%s</td><td><code>%s</code></td><td>%s</td><td>%s</td><td>%s</td></tr>`,
+				an.due.Format("2006-01-02 15:04 MST"), template.HTMLEscapeString(an.spec),
+				template.HTMLEscapeString(room), template.HTMLEscapeString(an.text), remove,
+			)
+		}
+		b.WriteString(`</tbody></table>`)
+	}
+	fmt.Fprintf(&b,
+		`<form hx-post="/admin-announcements">`+
+			`<input name="schedule" placeholder="0 18 * * 5, @every 2h, or @at 2026-10-20T18:00:00Z" required /> `+
+			`<input name="room" placeholder="Room key, empty for every room" /> `+
+			`<textarea name="text" rows="2" maxlength="%d" placeholder="Announcement" required></textarea>`+
+			`<button>Schedule</button></form>`,
+		maxAnnouncementLen,
+	)
+	if status != "" {
+		fmt.Fprintf(&b, `<p>%s</p>`, template.HTMLEscapeString(status))
+	}
+	b.WriteString(`</div>`)
+	return b.String()
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCronNext(t *testing.T) {
+	from := time.Date(2026, 10, 16, 12, 30, 15, 0, time.UTC) // A Friday
+	tests := []struct {
+		spec string
+		want time.Time
+	}{
+		{"* * * * *", time.Date(2026, 10, 16, 12, 31, 0, 0, time.UTC)},
+		{"*/15 * * * *", time.Date(2026, 10, 16, 12, 45, 0, 0, time.UTC)},
+		{"0 18 * * 5", time.Date(2026, 10, 16, 18, 0, 0, 0, time.UTC)},
+		{"0 9 * * 1-5", time.Date(2026, 10, 19, 9, 0, 0, 0, time.UTC)},
+		{"0 0 1 1 *", time.Date(2027, 1, 1, 0, 0, 0, 0, time.UTC)},
+		{"0 12 * * 0", time.Date(2026, 10, 18, 12, 0, 0, 0, time.UTC)},
+		{"0 12 * * 7", time.Date(2026, 10, 18, 12, 0, 0, 0, time.UTC)},
+		// Either the day of the month or week, like cron
+		{"0 0 20 * 6", time.Date(2026, 10, 17, 0, 0, 0, 0, time.UTC)},
+		{"0 0 30 2 *", time.Time{}},
+	}
+	for _, tt := range tests {
+		s, err := parseSchedule(tt.spec)
+		if err != nil {
+			t.Errorf("parseSchedule(%q): %v", tt.spec, err)
+			continue
+		}
+		if got := s.next(from); !got.Equal(tt.want) {
+			t.Errorf("%q next = %v, want %v", tt.spec, got, tt.want)
+		}
+	}
+}
+
+func TestParseScheduleErrors(t *testing.T) {
+	for _, spec := range []string{
+		"", "* * * *", "60 * * * *", "* 24 * * *", "* * 0 * *", "5-1 * * * *",
+		"*/0 * * * *", "a * * * *", "@every 10s", "@every soon", "@at tomorrow",
+	} {
+		if _, err := parseSchedule(spec); err == nil {
+			t.Errorf("parseSchedule(%q) worked", spec)
+		}
+	}
+}
+
+func TestAnnouncerTakeDue(t *testing.T) {
+	a := &announcer{wake: make(chan struct{}, 1)}
+	now := time.Now()
+	once, err := newAnnouncement(configAnnouncement{Schedule: "@at " + now.Add(time.Hour).Format(time.RFC3339), Text: "once"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	every, err := newAnnouncement(configAnnouncement{Schedule: "@every 30m", Room: "lan", Text: "every"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := a.add(once); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := a.add(every); err != nil {
+		t.Fatal(err)
+	}
+	past, _ := newAnnouncement(configAnnouncement{Schedule: "@at 2000-01-01T00:00:00Z", Text: "past"})
+	if _, err := a.add(past); err != errNeverDue {
+		t.Errorf("adding a past announcement got %v, want errNeverDue", err)
+	}
+
+	due, next := a.takeDue(now.Add(45 * time.Minute))
+	if len(due) != 1 || due[0].text != "every" {
+		t.Errorf("due after 45m = %+v, want every", due)
+	}
+	if want := now.Add(time.Hour); !next.Equal(once.due) || next.Sub(want) > time.Second {
+		t.Errorf("next = %v, want %v", next, want)
+	}
+	due, _ = a.takeDue(now.Add(2 * time.Hour))
+	if len(due) != 2 {
+		t.Errorf("due after 2h = %+v, want both", due)
+	}
+	if anns := a.list(); len(anns) != 1 || anns[0].text != "every" {
+		t.Errorf("one-off announcement wasn't removed after it was sent: %+v", anns)
+	}
+	if !a.remove(a.list()[0].id) || len(a.list()) != 0 {
+		t.Error("remove didn't remove the announcement")
+	}
+}
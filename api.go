@@ -0,0 +1,463 @@
+package main
+
+// This file has the REST API, which lets external systems look at rooms and
+// post announcements into them. It uses its own tokens, set with the
+// -api-tokens flag, so the admin key doesn't have to be shared.
+//
+// Endpoints:
+//
+//	GET  /api/rooms                  List rooms
+//	DELETE /api/rooms/{key}          Close a room and erase its data
+//	GET  /api/rooms/{key}/users      List the users in a room
+//	POST /api/rooms/{key}/messages   Post an announcement into a room
+//	POST /api/rooms/{key}/merge      Merge a room into another
+//	POST /api/rooms/{key}/split      Split a room by subnets
+//	GET  /api/moves                  List merged and split rooms
+//	DELETE /api/moves/{key}          Undo merging or splitting a room
+//	GET  /api/announcements          List scheduled announcements
+//	POST /api/announcements          Schedule an announcement
+//	DELETE /api/announcements/{id}   Unschedule an announcement
+//	GET  /api/bans                   List bans
+//	POST /api/bans                   Ban an IP address or network
+//	DELETE /api/bans/{target}        Unban an IP address or network
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/makeworld-the-better-one/neartalk/events"
+)
+
+// maxAPIBody is the max size of an API request body in bytes.
+const maxAPIBody = 8 * 1024
+
+// apiKeyID is the key ID recorded in the audit log for actions taken with the
+// API, see auditlog.go.
+const apiKeyID = "api"
+
+// maxAnnouncementLen is the max length of an announcement in bytes.
+const maxAnnouncementLen = 2000
+
+// apiRoom describes a room in API responses.
+type apiRoom struct {
+	Key         string     `json:"key"`
+	Users       int        `json:"users"`
+	Created     time.Time  `json:"created"`
+	LastMessage *time.Time `json:"last_message,omitempty"`
+}
+
+// apiMessage is the request body for posting a message.
+type apiMessage struct {
+	Text string `json:"text"`
+}
+
+// apiAnnouncement describes a scheduled announcement in API responses.
+type apiAnnouncement struct {
+	ID int `json:"id"`
+	configAnnouncement
+	Next time.Time `json:"next"`
+	// FromConfig is true if it's from the config file, so it can't be
+	// removed with the API.
+	FromConfig bool `json:"from_config"`
+}
+
+// apiMerge is the request body for merging a room.
+type apiMerge struct {
+	Into string `json:"into"`
+}
+
+// apiSplit is the request body for splitting a room.
+type apiSplit struct {
+	Subnets []string `json:"subnets"`
+}
+
+// apiBan is the request body for banning an IP address or network.
+type apiBan struct {
+	Target string `json:"target"`
+	Reason string `json:"reason"`
+	// Duration is how long the ban lasts, like "24h", or empty for
+	// forever.
+	Duration string `json:"duration"`
+}
+
+// apiError is the response body for errors.
+type apiError struct {
+	Error string `json:"error"`
+}
+
+// apiTokenList returns the configured API tokens.
+func apiTokenList() []string {
+	var tokens []string
+	for _, t := range strings.Split(apiTokens, ",") {
+		if t = strings.TrimSpace(t); t != "" {
+			tokens = append(tokens, t)
+		}
+	}
+	return tokens
+}
+
+// apiAuthorized returns true if the request has a valid API token in the
+// Authorization header.
+func apiAuthorized(r *http.Request) bool {
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if token == "" {
+		return false
+	}
+	ok := false
+	for _, t := range apiTokenList() {
+		// Check every token so timing doesn't reveal which one matched
+		if subtle.ConstantTimeCompare([]byte(token), []byte(t)) == 1 {
+			ok = true
+		}
+	}
+	return ok
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeAPIError(w http.ResponseWriter, status int, text string) {
+	writeJSON(w, status, apiError{text})
+}
+
+// apiHandler routes requests under /api/.
+func (cs *chatServer) apiHandler(w http.ResponseWriter, r *http.Request) {
+	if len(apiTokenList()) == 0 {
+		// API is disabled
+		http.NotFound(w, r)
+		return
+	}
+	if !apiAuthorized(r) {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="neartalk"`)
+		writeAPIError(w, http.StatusUnauthorized, "invalid or missing API token")
+		return
+	}
+
+	// Path is /api/rooms, /api/rooms/{key}[/{thing}],
+	// /api/announcements[/{id}], /api/moves[/{key}], or
+	// /api/bans[/{target}]. Keys of rooms for subnets and banned networks
+	// have a slash, so it's split before unescaping
+	parts := strings.Split(strings.TrimPrefix(r.URL.EscapedPath(), "/api/"), "/")
+	for i, p := range parts {
+		var err error
+		if parts[i], err = url.PathUnescape(p); err != nil {
+			writeAPIError(w, http.StatusBadRequest, "invalid path")
+			return
+		}
+	}
+	switch {
+	case len(parts) == 1 && parts[0] == "announcements":
+		switch r.Method {
+		case http.MethodGet:
+			writeJSON(w, http.StatusOK, apiAnnouncements(cs.announcer.list()))
+		case http.MethodPost:
+			cs.apiScheduleHandler(w, r)
+		default:
+			writeAPIError(w, http.StatusMethodNotAllowed, "method not allowed")
+		}
+	case len(parts) == 2 && parts[0] == "announcements":
+		if r.Method != http.MethodDelete {
+			writeAPIError(w, http.StatusMethodNotAllowed, "method not allowed")
+			return
+		}
+		id, err := strconv.Atoi(parts[1])
+		if err != nil || !cs.announcer.remove(id) {
+			writeAPIError(w, http.StatusNotFound, "no such announcement, or it's from the config file")
+			return
+		}
+		cs.audit.record(apiKeyID, auditUnschedule, parts[1], "")
+		w.WriteHeader(http.StatusNoContent)
+	case len(parts) == 1 && parts[0] == "rooms":
+		if r.Method != http.MethodGet {
+			writeAPIError(w, http.StatusMethodNotAllowed, "method not allowed")
+			return
+		}
+		cs.apiRoomsHandler(w, r)
+	case len(parts) == 2 && parts[0] == "rooms":
+		if r.Method != http.MethodDelete {
+			writeAPIError(w, http.StatusMethodNotAllowed, "method not allowed")
+			return
+		}
+		e := cs.eraseRoom(parts[1])
+		cs.audit.record(apiKeyID, auditErase, e.Room, "")
+		writeJSON(w, http.StatusOK, e)
+	case len(parts) == 3 && parts[0] == "rooms" && parts[2] == "users":
+		if r.Method != http.MethodGet {
+			writeAPIError(w, http.StatusMethodNotAllowed, "method not allowed")
+			return
+		}
+		cs.apiUsersHandler(w, r, parts[1])
+	case len(parts) == 3 && parts[0] == "rooms" && parts[2] == "messages":
+		if r.Method != http.MethodPost {
+			writeAPIError(w, http.StatusMethodNotAllowed, "method not allowed")
+			return
+		}
+		cs.apiPostHandler(w, r, parts[1])
+	case len(parts) == 3 && parts[0] == "rooms" && (parts[2] == "merge" || parts[2] == "split"):
+		if r.Method != http.MethodPost {
+			writeAPIError(w, http.StatusMethodNotAllowed, "method not allowed")
+			return
+		}
+		cs.apiMoveHandler(w, r, parts[1], parts[2] == "merge")
+	case len(parts) == 1 && parts[0] == "moves":
+		if r.Method != http.MethodGet {
+			writeAPIError(w, http.StatusMethodNotAllowed, "method not allowed")
+			return
+		}
+		writeJSON(w, http.StatusOK, cs.routes.list())
+	case len(parts) == 2 && parts[0] == "moves":
+		if r.Method != http.MethodDelete {
+			writeAPIError(w, http.StatusMethodNotAllowed, "method not allowed")
+			return
+		}
+		if !cs.routes.remove(parts[1]) {
+			writeAPIError(w, http.StatusNotFound, "that room wasn't merged or split")
+			return
+		}
+		cs.audit.record(apiKeyID, auditUndoMove, parts[1], "")
+		w.WriteHeader(http.StatusNoContent)
+	case len(parts) == 1 && parts[0] == "bans":
+		switch r.Method {
+		case http.MethodGet:
+			writeJSON(w, http.StatusOK, cs.bans.list(time.Now()))
+		case http.MethodPost:
+			cs.apiBanHandler(w, r)
+		default:
+			writeAPIError(w, http.StatusMethodNotAllowed, "method not allowed")
+		}
+	case len(parts) == 2 && parts[0] == "bans":
+		if r.Method != http.MethodDelete {
+			writeAPIError(w, http.StatusMethodNotAllowed, "method not allowed")
+			return
+		}
+		removed, err := cs.bans.remove(parts[1])
+		if err != nil {
+			writeAPIError(w, http.StatusInternalServerError, "couldn't remove the ban")
+			return
+		}
+		if !removed {
+			writeAPIError(w, http.StatusNotFound, "no such ban")
+			return
+		}
+		cs.audit.record(apiKeyID, auditUnban, parts[1], "")
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		writeAPIError(w, http.StatusNotFound, "not found")
+	}
+}
+
+// getRoom returns the room with the given key, or nil if it doesn't exist.
+func (cs *chatServer) getRoom(key string) *chatRoom {
+	cs.roomsMu.Lock()
+	defer cs.roomsMu.Unlock()
+	return cs.rooms[key]
+}
+
+func (cs *chatServer) apiRoomsHandler(w http.ResponseWriter, r *http.Request) {
+	cs.roomsMu.Lock()
+	rooms := make([]apiRoom, 0, len(cs.rooms))
+	for key, room := range cs.rooms {
+		ar := apiRoom{
+			Key:     key,
+			Users:   room.numClients(),
+			Created: room.created,
+		}
+		room.clientsMu.Lock()
+		if !room.whenLastMsg.IsZero() {
+			last := room.whenLastMsg
+			ar.LastMessage = &last
+		}
+		room.clientsMu.Unlock()
+		rooms = append(rooms, ar)
+	}
+	cs.roomsMu.Unlock()
+
+	sort.Slice(rooms, func(i, j int) bool { return rooms[i].Key < rooms[j].Key })
+	writeJSON(w, http.StatusOK, rooms)
+}
+
+func (cs *chatServer) apiUsersHandler(w http.ResponseWriter, r *http.Request, key string) {
+	room := cs.getRoom(key)
+	if room == nil {
+		writeAPIError(w, http.StatusNotFound, "no such room")
+		return
+	}
+	room.clientsMu.Lock()
+	users := room.users()
+	room.clientsMu.Unlock()
+
+	// Same format as the user list event
+	writeJSON(w, http.StatusOK, newUserList(users))
+}
+
+func (cs *chatServer) apiPostHandler(w http.ResponseWriter, r *http.Request, key string) {
+	var am apiMessage
+	err := json.NewDecoder(io.LimitReader(r.Body, maxAPIBody)).Decode(&am)
+	if err != nil {
+		writeAPIError(w, http.StatusBadRequest, "invalid JSON body")
+		return
+	}
+	am.Text = strings.TrimSpace(strings.ToValidUTF8(am.Text, "\uFFFD"))
+	if !isMsgTextValid(am.Text) {
+		writeAPIError(w, http.StatusBadRequest, "text is required")
+		return
+	}
+	if len(am.Text) > maxAnnouncementLen {
+		writeAPIError(w, http.StatusBadRequest, "text is too long")
+		return
+	}
+
+	room := cs.getRoom(key)
+	if room == nil {
+		writeAPIError(w, http.StatusNotFound, "no such room")
+		return
+	}
+	if err := room.announce(r.Context(), am.Text); errors.Is(err, errRoomClosed) {
+		writeAPIError(w, http.StatusNotFound, "no such room")
+		return
+	} else if err != nil {
+		writeAPIError(w, http.StatusServiceUnavailable, "room is busy, try again later")
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// apiMoveHandler merges the room with the key into another if merge is true,
+// and splits it otherwise.
+func (cs *chatServer) apiMoveHandler(w http.ResponseWriter, r *http.Request, key string, merge bool) {
+	var move roomMove
+	var err error
+	dec := json.NewDecoder(io.LimitReader(r.Body, maxAPIBody))
+	if merge {
+		var am apiMerge
+		if dec.Decode(&am) != nil {
+			writeAPIError(w, http.StatusBadRequest, "invalid JSON body")
+			return
+		}
+		if move, err = cs.mergeRooms(key, am.Into); err == nil {
+			cs.audit.record(apiKeyID, auditMergeRooms, key, am.Into)
+		}
+	} else {
+		var as apiSplit
+		if dec.Decode(&as) != nil {
+			writeAPIError(w, http.StatusBadRequest, "invalid JSON body")
+			return
+		}
+		var nets []*net.IPNet
+		if nets, err = parseSubnets(strings.Join(as.Subnets, ",")); err == nil {
+			if move, err = cs.splitRoom(key, nets); err == nil {
+				cs.audit.record(apiKeyID, auditSplitRoom, key, strings.Join(as.Subnets, ", "))
+			}
+		}
+	}
+	if err != nil {
+		writeAPIError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, move)
+}
+
+// apiAnnouncements converts scheduled announcements for API responses.
+func apiAnnouncements(anns []announcement) []apiAnnouncement {
+	res := make([]apiAnnouncement, len(anns))
+	for i, an := range anns {
+		res[i] = apiAnnouncement{
+			ID:                 an.id,
+			configAnnouncement: configAnnouncement{Schedule: an.spec, Room: an.room, Text: an.text},
+			Next:               an.due,
+			FromConfig:         an.fromConfig,
+		}
+	}
+	return res
+}
+
+func (cs *chatServer) apiScheduleHandler(w http.ResponseWriter, r *http.Request) {
+	var ca configAnnouncement
+	err := json.NewDecoder(io.LimitReader(r.Body, maxAPIBody)).Decode(&ca)
+	if err != nil {
+		writeAPIError(w, http.StatusBadRequest, "invalid JSON body")
+		return
+	}
+	an, err := newAnnouncement(ca)
+	if err != nil {
+		writeAPIError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	added, err := cs.announcer.add(an)
+	if err != nil {
+		writeAPIError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	cs.audit.record(apiKeyID, auditSchedule, added.room, added.spec+": "+added.text)
+	writeJSON(w, http.StatusCreated, apiAnnouncements([]announcement{added})[0])
+}
+
+func (cs *chatServer) apiBanHandler(w http.ResponseWriter, r *http.Request) {
+	var ab apiBan
+	err := json.NewDecoder(io.LimitReader(r.Body, maxAPIBody)).Decode(&ab)
+	if err != nil {
+		writeAPIError(w, http.StatusBadRequest, "invalid JSON body")
+		return
+	}
+	var d time.Duration
+	if ab.Duration != "" {
+		if d, err = time.ParseDuration(ab.Duration); err != nil || d <= 0 {
+			writeAPIError(w, http.StatusBadRequest, "invalid duration")
+			return
+		}
+	}
+	if _, err := banNet(strings.TrimSpace(ab.Target)); err != nil {
+		writeAPIError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	b, err := cs.bans.add(ab.Target, strings.TrimSpace(ab.Reason), d, time.Now())
+	if err != nil {
+		writeAPIError(w, http.StatusInternalServerError, "couldn't save the ban")
+		return
+	}
+	cs.audit.record(apiKeyID, auditBan, b.Target, b.Reason)
+	writeJSON(w, http.StatusCreated, b)
+}
+
+var (
+	errRoomBusy   = errors.New("room is busy")
+	errRoomClosed = errors.New("room has closed")
+)
+
+// announce queues an announcement from the server for everyone in the room.
+// It waits for space in the room's queue until ctx is done or a few seconds
+// have passed.
+func (cr *chatRoom) announce(ctx context.Context, text string) error {
+	now := time.Now()
+	text = "Announcement: " + text
+	m := msg{
+		raw:     createSpecialMsg(text, "notif"),
+		rawJSON: []string{encodeEvent(events.TypeNotice, events.Notice{Text: text, Time: now})},
+		when:    now,
+	}
+	t := time.NewTimer(5 * time.Second)
+	defer t.Stop()
+	select {
+	case cr.incoming <- m:
+		return nil
+	case <-cr.closed:
+		return errRoomClosed
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-t.C:
+		return errRoomBusy
+	}
+}
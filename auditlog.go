@@ -0,0 +1,143 @@
+package main
+
+// This file keeps the audit log of admin actions, so deployments with several
+// admins can see who did what. Every action taken from the admin interface is
+// recorded with the time, the ID of the key the admin logged in with, and what
+// it was done to. Entries are kept in the storage, see storage.go, so with
+// -audit-log they're appended to that file as JSON lines, which nothing in
+// NearTalk ever rewrites, except to remove old entries for -retention. The
+// most recent entries are also kept in memory, and shown on the admin page.
+
+import (
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// maxAuditEntries is how many audit log entries are kept in memory for the
+// admin page.
+const maxAuditEntries = 200
+
+// Admin actions recorded in the audit log.
+const (
+	auditLogin         = "login"
+	auditHideListing   = "hide-listing"
+	auditUnhideListing = "unhide-listing"
+	auditModerator     = "make-moderator"
+	auditModCode       = "moderator-code"
+	auditSlowMode      = "slow-mode"
+	auditUnmute        = "unmute"
+	auditWatch         = "watch-room"
+	auditMOTD          = "set-motd"
+	auditSchedule      = "schedule-announcement"
+	auditUnschedule    = "unschedule-announcement"
+	auditCloseRoom     = "close-room"
+	auditErase         = "erase-data"
+	auditInvitesOn     = "invites-on"
+	auditInvitesOff    = "invites-off"
+	auditMergeRooms    = "merge-rooms"
+	auditSplitRoom     = "split-room"
+	auditUndoMove      = "undo-room-move"
+	auditBan           = "ban"
+	auditUnban         = "unban"
+)
+
+// auditEntry is one admin action.
+type auditEntry struct {
+	Time time.Time `json:"time"`
+	// KeyID is the ID of the admin key used, see adminauth.go.
+	KeyID  string `json:"key_id"`
+	Action string `json:"action"`
+	// Target is what the action was done to, like a room key.
+	Target string `json:"target"`
+	// Detail is anything else worth knowing, like a nickname.
+	Detail string `json:"detail,omitempty"`
+}
+
+// auditLog records admin actions.
+type auditLog struct {
+	mu sync.Mutex
+	// store is where entries are kept.
+	store storage
+	// recent holds the most recent entries, oldest first.
+	recent []auditEntry
+}
+
+// openAuditLog opens the audit log kept in the storage, loading the most
+// recent entries already in it for the admin page.
+func openAuditLog(store storage) (*auditLog, error) {
+	recent, err := store.loadAudit(maxAuditEntries)
+	if err != nil {
+		return nil, err
+	}
+	return &auditLog{store: store, recent: recent}, nil
+}
+
+// keep adds the entry to the recent ones.
+// It does not lock the mutex, callers should do that.
+func (al *auditLog) keep(e auditEntry) {
+	al.recent = append(al.recent, e)
+	if len(al.recent) > maxAuditEntries {
+		al.recent = al.recent[len(al.recent)-maxAuditEntries:]
+	}
+}
+
+// record adds an admin action to the audit log.
+func (al *auditLog) record(keyID, action, target, detail string) {
+	e := auditEntry{Time: time.Now().UTC(), KeyID: keyID, Action: action, Target: target, Detail: detail}
+	log.Printf("audit: key %s: %s %q %s", keyID, action, target, detail)
+
+	al.mu.Lock()
+	defer al.mu.Unlock()
+	al.keep(e)
+	if err := al.store.appendAudit(e); err != nil {
+		log.Printf("auditLog.record: err writing to audit log: %v", err)
+	}
+}
+
+// purge removes the entries from before the time, for -retention.
+func (al *auditLog) purge(before time.Time) error {
+	al.mu.Lock()
+	defer al.mu.Unlock()
+	al.recent = keepAuditSince(al.recent, before)
+	return al.store.purgeAudit(before)
+}
+
+// entries returns the recent entries, newest first.
+func (al *auditLog) entries() []auditEntry {
+	al.mu.Lock()
+	defer al.mu.Unlock()
+	es := make([]auditEntry, len(al.recent))
+	for i, e := range al.recent {
+		es[len(es)-1-i] = e
+	}
+	return es
+}
+
+// adminAuditHandler serves the recent audit log entries for the admin page.
+func (cs *chatServer) adminAuditHandler(w http.ResponseWriter, r *http.Request) {
+	if !cs.isAdmin(r) {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	es := cs.audit.entries()
+	if len(es) == 0 {
+		fmt.Fprint(w, `<p>No admin actions yet.</p>`)
+		return
+	}
+	var b strings.Builder
+	b.WriteString(`<table><thead><tr><th>Time (UTC)</th><th>Key</th><th>Action</th><th>Target</th><th>Detail</th></tr></thead><tbody>`)
+	for _, e := range es {
+		fmt.Fprintf(&b, `<tr><td>%s</td><td>%s</td><td>%s</td><td>%s</td><td>%s</td></tr>`,
+			e.Time.Format("2006-01-02 15:04:05"), template.HTMLEscapeString(e.KeyID),
+			template.HTMLEscapeString(e.Action), template.HTMLEscapeString(e.Target),
+			template.HTMLEscapeString(e.Detail),
+		)
+	}
+	b.WriteString(`</tbody></table>`)
+	fmt.Fprint(w, b.String())
+}
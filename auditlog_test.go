@@ -0,0 +1,50 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestAuditLog(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	fs, err := openFileStorage("", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	al, err := openAuditLog(fs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	al.record("alice", auditModerator, "room1", "bob")
+	al.record("main", auditWatch, "room2", "")
+	if err := fs.close(); err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := strings.Count(string(b), "\n"); n != 2 {
+		t.Errorf("audit log file has %d lines, want 2", n)
+	}
+
+	// Entries from before are shown after a restart, and new ones are appended
+	if fs, err = openFileStorage("", path); err != nil {
+		t.Fatal(err)
+	}
+	defer fs.close()
+	if al, err = openAuditLog(fs); err != nil {
+		t.Fatal(err)
+	}
+	al.record("alice", auditHideListing, "Cafe", "")
+	es := al.entries()
+	if len(es) != 3 {
+		t.Fatalf("got %d entries, want 3", len(es))
+	}
+	if es[0].Action != auditHideListing || es[2].KeyID != "alice" || es[2].Detail != "bob" {
+		t.Errorf("entries not newest first: %+v", es)
+	}
+}
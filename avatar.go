@@ -0,0 +1,84 @@
+package main
+
+// This file gives everyone a color and a small identicon-style avatar, shown
+// with their nickname in messages and the user list, so it's easier to follow
+// who's talking. Both come from a hash of the session token, so they stay the
+// same across reloads and nickname changes without anything being stored, but
+// don't say anything about the person's address or session. Sessions given a
+// random seed before keep the look it makes.
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"html/template"
+	"strings"
+)
+
+// avatarSize is the number of cells along each side of an avatar.
+const avatarSize = 5
+
+// nickLook is the color and avatar of a person.
+type nickLook struct {
+	// Hue is the hue of their color, from 0 to 359. The themes pick the
+	// saturation and lightness.
+	Hue int `json:"hue"`
+	// Cells has a bit set for each filled cell on the left half of the
+	// avatar, including the middle column. The right half mirrors it.
+	Cells uint16 `json:"cells"`
+}
+
+// lookOf returns the look made from the seed, or nil if the seed is empty.
+func lookOf(seed string) *nickLook {
+	if seed == "" {
+		return nil
+	}
+	sum := sha256.Sum256([]byte(seed))
+	look := &nickLook{
+		Hue:   int(binary.BigEndian.Uint16(sum[:2]) % 360),
+		Cells: binary.BigEndian.Uint16(sum[2:4]),
+	}
+	// An empty avatar would look like a missing one
+	if look.Cells&0x7fff == 0 {
+		look.Cells = 1 << 7
+	}
+	return look
+}
+
+// Style returns the style attribute value that gives an element the color.
+func (l *nickLook) Style() template.CSS {
+	return template.CSS(fmt.Sprintf("--nick-hue: %d", l.Hue))
+}
+
+// Avatar returns the avatar as inline SVG, drawn in the text color.
+func (l *nickLook) Avatar() template.HTML {
+	half := (avatarSize + 1) / 2
+	var path strings.Builder
+	for y := 0; y < avatarSize; y++ {
+		for x := 0; x < half; x++ {
+			if l.Cells&(1<<(y*half+x)) == 0 {
+				continue
+			}
+			fmt.Fprintf(&path, "M%d %dh1v1h-1z", x, y)
+			if mirror := avatarSize - 1 - x; mirror != x {
+				fmt.Fprintf(&path, "M%d %dh1v1h-1z", mirror, y)
+			}
+		}
+	}
+	return template.HTML(fmt.Sprintf(
+		`<svg class="avatar" viewBox="0 0 %d %d" aria-hidden="true"><path fill="currentColor" d="%s" /></svg>`,
+		avatarSize, avatarSize, path.String(),
+	))
+}
+
+// lookSeed returns the session's look seed, which is the one in its settings
+// if it has one, and otherwise comes from the token. Nothing is stored, so
+// visitors without settings don't get any.
+func (s *settingsStore) lookSeed(session string) string {
+	if seed := s.get(session).LookSeed; seed != "" {
+		return seed
+	}
+	sum := sha256.Sum256([]byte("neartalk look " + session))
+	return hex.EncodeToString(sum[:])
+}
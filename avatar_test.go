@@ -0,0 +1,76 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLookOf(t *testing.T) {
+	if lookOf("") != nil {
+		t.Error("empty seed has a look")
+	}
+	a, b := lookOf("seed"), lookOf("seed")
+	if *a != *b {
+		t.Errorf("looks for the same seed differ: %+v, %+v", a, b)
+	}
+	if a.Hue < 0 || a.Hue >= 360 {
+		t.Errorf("hue %d out of range", a.Hue)
+	}
+
+	// Cell 0 is the top left, so the top right is filled too
+	l := &nickLook{Cells: 1}
+	if got := string(l.Avatar()); !strings.Contains(got, `d="M0 0h1v1h-1zM4 0h1v1h-1z"`) {
+		t.Errorf("avatar isn't mirrored: %s", got)
+	}
+	// The middle column isn't doubled
+	l = &nickLook{Cells: 1 << 2}
+	if got := string(l.Avatar()); !strings.Contains(got, `d="M2 0h1v1h-1z"`) {
+		t.Errorf("middle column avatar is %s", got)
+	}
+}
+
+func TestChatMsgLook(t *testing.T) {
+	var err error
+	loadTemplatesOnce.Do(func() { err = loadTemplates(t.TempDir()) })
+	if err != nil {
+		t.Fatal(err)
+	}
+	look := lookOf("seed")
+	m := msg{id: "01A", nick: "ann", text: "hi", author: &client{look: look}, when: time.Now()}
+	_, nonAuthor := createChatMsg(m, nil)
+	if want := fmt.Sprintf(`style="--nick-hue: %d"`, look.Hue); !strings.Contains(nonAuthor, want) {
+		t.Errorf("message %s doesn't have %s", nonAuthor, want)
+	}
+	if !strings.Contains(nonAuthor, `<svg class="avatar"`) {
+		t.Errorf("message %s has no avatar", nonAuthor)
+	}
+
+	users := createUserListMsg([]roomUser{{nick: "ann", look: look}, {nick: "bob"}})
+	if strings.Count(users, `class="avatar"`) != 1 {
+		t.Errorf("user list %s should have one avatar", users)
+	}
+}
+
+func TestLookSeed(t *testing.T) {
+	s, err := newSettingsStore("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := s.lookSeed("session-a")
+	if a != s.lookSeed("session-a") || a == s.lookSeed("session-b") {
+		t.Errorf("seeds for sessions should be the same each time and differ between them")
+	}
+	if strings.Contains(a, "session-a") {
+		t.Errorf("seed %q shows the session", a)
+	}
+	if len(s.sessions) != 0 {
+		t.Errorf("seeds were stored: %+v", s.sessions)
+	}
+	// Seeds given before are kept
+	s.update("session-c", func(ss *sessionSettings) { ss.LookSeed = "old" })
+	if got := s.lookSeed("session-c"); got != "old" {
+		t.Errorf("seed = %q, want the stored one", got)
+	}
+}
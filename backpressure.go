@@ -0,0 +1,143 @@
+package main
+
+// This file handles clients that can't keep up with messages. Frames wait in
+// the client's outgoing channel until they're written, and when it starts to
+// fill up, the least important frames are dropped first: presence updates
+// like the user list go once it's half full, and chat messages once it's
+// three quarters full. Once the client catches up it's told how many
+// messages it missed, and sent a fresh user list. Clients are only
+// disconnected when the channel fills up anyway, or they've been behind for
+// maxBehind.
+//
+// Clients that would rather reconnect than miss anything, like bots keeping
+// logs, can send {"backpressure": "disconnect"} to be disconnected as soon
+// as the channel is full instead.
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/makeworld-the-better-one/neartalk/events"
+)
+
+// Backpressure policies, which clients choose from.
+const (
+	backpressureDrop       = "drop"
+	backpressureDisconnect = "disconnect"
+)
+
+// maxBehind is how long a client can keep falling behind, with frames being
+// dropped, before it's disconnected.
+const maxBehind = 30 * time.Second
+
+// droppedFrames counts every frame dropped for a slow client since the server
+// started.
+var droppedFrames atomic.Int64
+
+// frameKind is how important a frame is, which decides when it's dropped.
+type frameKind int
+
+const (
+	// frameNormal frames are never dropped, like errors or topic changes.
+	frameNormal frameKind = iota
+	// frameChat frames are chat messages, which are dropped and counted.
+	frameChat
+	// frameMinor frames are presence updates, which are dropped first.
+	frameMinor
+)
+
+// roomNeeded returns how many free spaces an outgoing channel with the
+// capacity must have for a frame of this kind to be queued.
+func (k frameKind) roomNeeded(capacity int) int {
+	n := 1
+	switch k {
+	case frameMinor:
+		n = capacity / 2
+	case frameChat:
+		n = capacity / 4
+	}
+	if n < 1 {
+		return 1
+	}
+	return n
+}
+
+// queueFrame queues the frame to be sent to the client, dropping it if the
+// client is falling behind and it's not important enough. If the client can't
+// keep up at all, its closeSlow func is called in a goroutine.
+func (c *client) queueFrame(s string, kind frameKind) {
+	c.behindMu.Lock()
+	defer c.behindMu.Unlock()
+
+	free := cap(c.outgoing) - len(c.outgoing)
+	if !c.behindSince.IsZero() && free >= frameMinor.roomNeeded(cap(c.outgoing)) {
+		c.caughtUp()
+		free = cap(c.outgoing) - len(c.outgoing)
+	}
+	if c.disconnectSlow {
+		kind = frameNormal
+	}
+	if free >= kind.roomNeeded(cap(c.outgoing)) {
+		c.outgoing <- s
+		return
+	}
+	if kind == frameNormal || (!c.behindSince.IsZero() && time.Since(c.behindSince) > maxBehind) {
+		go c.closeSlow()
+		return
+	}
+
+	droppedFrames.Add(1)
+	if c.behindSince.IsZero() {
+		c.behindSince = time.Now()
+	}
+	if kind == frameChat {
+		c.missedMsgs++
+	} else {
+		c.missedPresence = true
+	}
+}
+
+// caughtUp tells the client how many messages it missed while it was behind.
+// It does not lock behindMu, callers should do that.
+func (c *client) caughtUp() {
+	c.behindSince = time.Time{}
+	if c.missedMsgs == 0 {
+		return
+	}
+	text := c.tr("Your connection couldn't keep up, so %d messages weren't shown", c.missedMsgs)
+	c.missedMsgs = 0
+	if c.isJSON() {
+		c.outgoing <- encodeEvent(events.TypeNotice, events.Notice{Text: text, Time: time.Now()})
+	} else {
+		c.outgoing <- createSpecialMsg(text, "notif")
+	}
+}
+
+// missedUsers returns true if the client has caught up after missing presence
+// updates, so it needs a new user list.
+func (c *client) missedUsers() bool {
+	c.behindMu.Lock()
+	defer c.behindMu.Unlock()
+	if !c.missedPresence {
+		return false
+	}
+	if !c.behindSince.IsZero() {
+		if cap(c.outgoing)-len(c.outgoing) < frameMinor.roomNeeded(cap(c.outgoing)) {
+			return false
+		}
+		c.caughtUp()
+	}
+	c.missedPresence = false
+	return true
+}
+
+// setBackpressure sets the client's backpressure policy.
+func (c *client) setBackpressure(policy string) {
+	if policy != backpressureDrop && policy != backpressureDisconnect {
+		c.sendError("Backpressure must be drop or disconnect")
+		return
+	}
+	c.behindMu.Lock()
+	defer c.behindMu.Unlock()
+	c.disconnectSlow = policy == backpressureDisconnect
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestQueueFrame(t *testing.T) {
+	closed := make(chan struct{}, 1)
+	c := &client{outgoing: make(chan string, 8), lang: defaultLang}
+	c.closeSlow = func() { closed <- struct{}{} }
+
+	for i := 0; i < 5; i++ {
+		c.queueFrame("chat", frameChat)
+	}
+	// More than half full, so presence updates are dropped
+	c.queueFrame("users", frameMinor)
+	for i := 0; i < 4; i++ {
+		c.queueFrame("chat", frameChat)
+	}
+	// Chat messages leave space for important frames
+	c.queueFrame("topic", frameNormal)
+	if len(c.outgoing) != 8 {
+		t.Fatalf("%d frames queued, want 8", len(c.outgoing))
+	}
+	if c.missedMsgs != 2 || !c.missedPresence {
+		t.Errorf("missed %d messages and presence %v, want 2 and true", c.missedMsgs, c.missedPresence)
+	}
+
+	// Catching up tells the client what it missed
+	for len(c.outgoing) > 0 {
+		<-c.outgoing
+	}
+	c.queueFrame("chat", frameChat)
+	if got := <-c.outgoing; !strings.Contains(got, "2 messages") {
+		t.Errorf("first frame after catching up is %q, want a notice about 2 missed messages", got)
+	}
+	<-c.outgoing
+	if !c.missedUsers() || c.missedUsers() {
+		t.Error("missedUsers() should be true once after catching up")
+	}
+
+	// Clients that asked for it are disconnected instead
+	c.setBackpressure(backpressureDisconnect)
+	for i := 0; i < 8; i++ {
+		c.queueFrame("chat", frameChat)
+	}
+	select {
+	case <-closed:
+		t.Fatal("closed before the channel was full")
+	case <-time.After(10 * time.Millisecond):
+	}
+	c.queueFrame("chat", frameChat)
+	select {
+	case <-closed:
+	case <-time.After(time.Second):
+		t.Error("not closed once the channel was full")
+	}
+}
@@ -0,0 +1,172 @@
+package main
+
+// This file has the bans made with the API, see api.go. Unlike banned_ips in
+// the config file, they're kept in the storage, see storage.go, so they
+// survive restarts with -storage. Bans can expire. Like banned_ips, banned
+// addresses can't load any page except the admin page, and people already
+// connected stay until they reconnect.
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ban keeps an IP address or network out.
+type ban struct {
+	// Target is the banned IP address or CIDR network.
+	Target string    `json:"target"`
+	Reason string    `json:"reason,omitempty"`
+	Time   time.Time `json:"time"`
+	// Expires is when the ban ends, or nil if it never does.
+	Expires *time.Time `json:"expires,omitempty"`
+}
+
+// expired returns true if the ban has ended by the time.
+func (b ban) expired(now time.Time) bool {
+	return b.Expires != nil && !now.Before(*b.Expires)
+}
+
+// banNet parses a ban target, an IP address or CIDR network.
+func banNet(target string) (*net.IPNet, error) {
+	if ip := net.ParseIP(target); ip != nil {
+		bits := 128
+		if ip4 := ip.To4(); ip4 != nil {
+			ip, bits = ip4, 32
+		}
+		return &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}, nil
+	}
+	_, n, err := net.ParseCIDR(target)
+	if err != nil {
+		return nil, fmt.Errorf("invalid IP address or network %q", target)
+	}
+	return n, nil
+}
+
+// banList holds the bans, and keeps them in the storage.
+type banList struct {
+	mu    sync.Mutex
+	store storage
+	bans  []ban
+	// nets holds the parsed targets of bans.
+	nets []*net.IPNet
+}
+
+// newBanList loads the bans kept in the storage. Bans with targets that don't
+// parse are skipped.
+func newBanList(store storage) (*banList, error) {
+	bans, err := store.loadBans()
+	if err != nil {
+		return nil, err
+	}
+	bl := &banList{store: store}
+	for _, b := range bans {
+		if n, err := banNet(b.Target); err == nil {
+			bl.bans = append(bl.bans, b)
+			bl.nets = append(bl.nets, n)
+		}
+	}
+	return bl, nil
+}
+
+// add bans the target, an IP address or CIDR network, for the duration, or
+// forever if it's 0. A ban with the same target is replaced. The target is
+// normalized, so the ban that was added is returned.
+func (bl *banList) add(target, reason string, d time.Duration, now time.Time) (ban, error) {
+	n, err := banNet(strings.TrimSpace(target))
+	if err != nil {
+		return ban{}, err
+	}
+	b := ban{Target: n.String(), Reason: reason, Time: now.UTC()}
+	if d > 0 {
+		expires := b.Time.Add(d)
+		b.Expires = &expires
+	}
+	if ones, bits := n.Mask.Size(); ones == bits {
+		b.Target = n.IP.String()
+	}
+
+	bl.mu.Lock()
+	defer bl.mu.Unlock()
+	if err := bl.store.saveBan(b); err != nil {
+		return ban{}, err
+	}
+	bl.removeTarget(b.Target)
+	bl.bans = append(bl.bans, b)
+	bl.nets = append(bl.nets, n)
+	return b, nil
+}
+
+// removeTarget removes the ban with the target from memory.
+// It does not lock the mutex, callers should do that.
+func (bl *banList) removeTarget(target string) bool {
+	for i := range bl.bans {
+		if bl.bans[i].Target == target {
+			bl.bans = append(bl.bans[:i], bl.bans[i+1:]...)
+			bl.nets = append(bl.nets[:i], bl.nets[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// remove unbans the target. It returns false if it wasn't banned.
+func (bl *banList) remove(target string) (bool, error) {
+	bl.mu.Lock()
+	defer bl.mu.Unlock()
+	if err := bl.store.removeBan(target); err != nil {
+		return false, err
+	}
+	return bl.removeTarget(target), nil
+}
+
+// list returns the bans that haven't expired.
+func (bl *banList) list(now time.Time) []ban {
+	bl.mu.Lock()
+	defer bl.mu.Unlock()
+	bans := []ban{}
+	for _, b := range bl.bans {
+		if !b.expired(now) {
+			bans = append(bans, b)
+		}
+	}
+	return bans
+}
+
+// isBanned returns true if the IP is in a ban that hasn't expired.
+func (bl *banList) isBanned(ip net.IP, now time.Time) bool {
+	if ip == nil {
+		return false
+	}
+	bl.mu.Lock()
+	defer bl.mu.Unlock()
+	for i, n := range bl.nets {
+		if n.Contains(ip) && !bl.bans[i].expired(now) {
+			return true
+		}
+	}
+	return false
+}
+
+// isBanned returns true if the IP is banned in the config file or with the
+// API.
+func (cs *chatServer) isBanned(ip net.IP) bool {
+	return currentConfig().isBanned(ip) || cs.bans.isBanned(ip, time.Now())
+}
+
+// refuseBanned responds with an error and returns true if the request is
+// from a banned IP. The admin interface is never refused, so admins can't
+// lock themselves out.
+func (cs *chatServer) refuseBanned(w http.ResponseWriter, r *http.Request) bool {
+	if strings.HasPrefix(r.URL.Path, "/admin") {
+		return false
+	}
+	if !cs.isBanned(clientAddr(r, int(trustedProxies))) {
+		return false
+	}
+	http.Error(w, "You are banned from this server.", http.StatusForbidden)
+	return true
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestBanList(t *testing.T) {
+	store := &memoryStorage{}
+	bl, err := newBanList(store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	if _, err := bl.add("203.0.113.7", "spam", 0, now); err != nil {
+		t.Fatal(err)
+	}
+	if b, err := bl.add("198.51.100.9/24", "", time.Hour, now); err != nil || b.Target != "198.51.100.0/24" {
+		t.Errorf("adding a network got %+v, %v, want it normalized", b, err)
+	}
+	if _, err := bl.add("not an address", "", 0, now); err == nil {
+		t.Error("no error for an invalid target")
+	}
+
+	for ip, want := range map[string]bool{
+		"203.0.113.7":   true,
+		"203.0.113.8":   false,
+		"198.51.100.20": true,
+		"192.0.2.1":     false,
+	} {
+		if got := bl.isBanned(net.ParseIP(ip), now); got != want {
+			t.Errorf("isBanned(%s) = %v, want %v", ip, got, want)
+		}
+	}
+	later := now.Add(2 * time.Hour)
+	if bl.isBanned(net.ParseIP("198.51.100.20"), later) || len(bl.list(later)) != 1 {
+		t.Error("the network is still banned after the ban expired")
+	}
+
+	// Bans are loaded from the storage
+	bl, err = newBanList(store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bl.isBanned(net.ParseIP("203.0.113.7"), now) {
+		t.Error("ban wasn't kept in the storage")
+	}
+	if removed, err := bl.remove("203.0.113.7"); !removed || err != nil {
+		t.Errorf("remove = %v, %v", removed, err)
+	}
+	if bl.isBanned(net.ParseIP("203.0.113.7"), now) {
+		t.Error("still banned after removing the ban")
+	}
+}
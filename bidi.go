@@ -0,0 +1,95 @@
+package main
+
+// This file keeps right-to-left text from spoofing what's around it. Unicode
+// bidi control characters change the order text after them is shown in, so
+// without care a nickname with a right-to-left override could make the
+// message next to it read differently, or pass for another nickname.
+// Nicknames can't contain bidi controls at all, and they're isolated from the
+// text around them: with <bdi> in HTML, and with isolate characters in plain
+// text. Messages can use bidi controls, but any they leave open are closed at
+// the end, so they can't leak into the rest of the page. Right-to-left text
+// itself works as usual, each message gets its direction from its first
+// letter.
+
+import "strings"
+
+// Bidi control characters.
+const (
+	bidiLRE = '\u202A' // Left-to-right embedding
+	bidiRLE = '\u202B' // Right-to-left embedding
+	bidiPDF = '\u202C' // Pop directional formatting
+	bidiLRO = '\u202D' // Left-to-right override
+	bidiRLO = '\u202E' // Right-to-left override
+	bidiLRI = '\u2066' // Left-to-right isolate
+	bidiRLI = '\u2067' // Right-to-left isolate
+	bidiFSI = '\u2068' // First strong isolate
+	bidiPDI = '\u2069' // Pop directional isolate
+)
+
+// isBidiControl returns true if r is a character that only affects the
+// direction of text.
+func isBidiControl(r rune) bool {
+	switch r {
+	case '\u061C', '\u200E', '\u200F', // Arabic letter mark, LRM, RLM
+		bidiLRE, bidiRLE, bidiPDF, bidiLRO, bidiRLO,
+		bidiLRI, bidiRLI, bidiFSI, bidiPDI:
+		return true
+	}
+	return false
+}
+
+// stripBidiControls removes all bidi control characters from s.
+func stripBidiControls(s string) string {
+	return strings.Map(func(r rune) rune {
+		if isBidiControl(r) {
+			return -1
+		}
+		return r
+	}, s)
+}
+
+// closeBidi returns s with any embeddings, overrides and isolates it leaves
+// open closed at the end, so they don't affect the text after it.
+func closeBidi(s string) string {
+	if !strings.ContainsAny(s, "\u202A\u202B\u202D\u202E\u2066\u2067\u2068") {
+		return s
+	}
+	// The open ones, true for isolates
+	var open []bool
+	for _, r := range s {
+		switch r {
+		case bidiLRE, bidiRLE, bidiLRO, bidiRLO:
+			open = append(open, false)
+		case bidiLRI, bidiRLI, bidiFSI:
+			open = append(open, true)
+		case bidiPDF:
+			if n := len(open); n > 0 && !open[n-1] {
+				open = open[:n-1]
+			}
+		case bidiPDI:
+			// Closes the last isolate and everything opened inside it
+			for i := len(open) - 1; i >= 0; i-- {
+				if open[i] {
+					open = open[:i]
+					break
+				}
+			}
+		}
+	}
+	var b strings.Builder
+	b.WriteString(s)
+	for i := len(open) - 1; i >= 0; i-- {
+		if open[i] {
+			b.WriteRune(bidiPDI)
+		} else {
+			b.WriteRune(bidiPDF)
+		}
+	}
+	return b.String()
+}
+
+// isolateNick returns the sanitized nickname as plain text, isolated so it
+// can be put in a sentence.
+func isolateNick(nick string) string {
+	return string(bidiFSI) + plainNick(nick) + string(bidiPDI)
+}
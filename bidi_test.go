@@ -0,0 +1,29 @@
+package main
+
+import "testing"
+
+func TestCloseBidi(t *testing.T) {
+	tests := []struct{ in, want string }{
+		{"plain", "plain"},
+		{"\u202Eevil", "\u202Eevil\u202C"},
+		{"\u202Eclosed\u202C", "\u202Eclosed\u202C"},
+		{"\u2067a\u202Bb", "\u2067a\u202Bb\u202C\u2069"},
+		// A PDI closes the embeddings inside its isolate too
+		{"\u2068a\u202Eb\u2069\u202Dc", "\u2068a\u202Eb\u2069\u202Dc\u202C"},
+		{"\u202Ca\u2069", "\u202Ca\u2069"},
+	}
+	for _, tt := range tests {
+		if got := closeBidi(tt.in); got != tt.want {
+			t.Errorf("closeBidi(%+q) = %+q, want %+q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestSanitizeNickBidi(t *testing.T) {
+	if got := sanitizeNick("\u202Eadmin\u200F"); got != "admin" {
+		t.Errorf("sanitizeNick kept bidi controls: %+q", got)
+	}
+	if got := sanitizeNick("שלום"); got != "שלום" {
+		t.Errorf("sanitizeNick changed a right-to-left nick: %+q", got)
+	}
+}
@@ -0,0 +1,129 @@
+package main
+
+// This file has the binary encoding of the JSON protocol. Bots and native
+// clients in busy rooms can ask for the events.SubprotocolCBOR websocket
+// subprotocol when they connect with /connect?proto=json, to get events as
+// CBOR, which is smaller and quicker to decode. Events are still encoded as
+// JSON, and then converted for those clients. Every client in a room is sent
+// the same frames, so each one is converted once and cached.
+
+import (
+	"encoding/json"
+	"errors"
+	"strings"
+	"sync"
+
+	"github.com/fxamacker/cbor/v2"
+	"github.com/makeworld-the-better-one/neartalk/events"
+	"nhooyr.io/websocket"
+)
+
+// errBinaryMsg is returned for binary messages from clients that didn't ask
+// for the binary encoding.
+var errBinaryMsg = errors.New("unexpected binary message")
+
+// binaryCacheSize is how many frames converted to CBOR are kept.
+const binaryCacheSize = 256
+
+// binaryFrames caches frames converted to CBOR.
+var binaryFrames frameCache
+
+// frameCache holds the CBOR for the last binaryCacheSize JSON frames
+// converted. The zero value is ready to use.
+type frameCache struct {
+	mu     sync.Mutex
+	frames map[string][]byte
+	// keys is the cached frames in the order they were added, used as a
+	// ring so the oldest is replaced first.
+	keys []string
+	next int
+}
+
+// get returns the JSON frame converted to CBOR, converting it if it isn't
+// cached.
+func (fc *frameCache) get(s string) ([]byte, error) {
+	fc.mu.Lock()
+	b, ok := fc.frames[s]
+	fc.mu.Unlock()
+	if ok {
+		return b, nil
+	}
+
+	b, err := jsonToCBOR(s)
+	if err != nil {
+		return nil, err
+	}
+
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+	if _, ok := fc.frames[s]; ok {
+		// Converted at the same time by another client
+		return b, nil
+	}
+	if fc.frames == nil {
+		fc.frames = make(map[string][]byte, binaryCacheSize)
+	}
+	if len(fc.keys) < binaryCacheSize {
+		fc.keys = append(fc.keys, s)
+	} else {
+		delete(fc.frames, fc.keys[fc.next])
+		fc.keys[fc.next] = s
+		fc.next = (fc.next + 1) % binaryCacheSize
+	}
+	fc.frames[s] = b
+	return b, nil
+}
+
+// jsonToCBOR converts an encoded event from JSON to CBOR.
+func jsonToCBOR(s string) ([]byte, error) {
+	d := json.NewDecoder(strings.NewReader(s))
+	d.UseNumber()
+	var v interface{}
+	if err := d.Decode(&v); err != nil {
+		return nil, err
+	}
+	return cbor.Marshal(cborValue(v))
+}
+
+// cborValue changes the JSON numbers in v, decoded with UseNumber, to
+// integers where they are, so they aren't encoded as floats.
+func cborValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for k, e := range v {
+			v[k] = cborValue(e)
+		}
+	case []interface{}:
+		for i, e := range v {
+			v[i] = cborValue(e)
+		}
+	case json.Number:
+		if n, err := v.Int64(); err == nil {
+			return n
+		}
+		f, _ := v.Float64()
+		return f
+	}
+	return v
+}
+
+// wsAcceptOptions returns the options for accepting a websocket from a client
+// using the protocol. Only JSON clients can use the binary encoding.
+func wsAcceptOptions(proto string) *websocket.AcceptOptions {
+	if proto != protoJSON {
+		return nil
+	}
+	return &websocket.AcceptOptions{Subprotocols: []string{events.SubprotocolCBOR}}
+}
+
+// decodeClientMsg decodes a message from a websocket client, which is JSON,
+// or CBOR in a binary message if the client asked for the binary encoding.
+func decodeClientMsg(typ websocket.MessageType, b []byte, binary bool, v *htmxJson) error {
+	if typ == websocket.MessageBinary && binary {
+		return cbor.Unmarshal(b, v)
+	}
+	if typ != websocket.MessageText {
+		return errBinaryMsg
+	}
+	return json.Unmarshal(b, v)
+}
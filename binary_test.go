@@ -0,0 +1,68 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/makeworld-the-better-one/neartalk/events"
+)
+
+func TestJSONToCBOR(t *testing.T) {
+	now := time.Date(2026, 10, 16, 12, 0, 0, 0, time.UTC)
+	s := encodeEvent(events.TypeMessage, events.Message{
+		ID: "01J", Nick: "alice", Text: "hi", Mentions: []string{"bob"}, Time: now,
+	})
+	b, err := binaryFrames.get(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(b) >= len(s) {
+		t.Errorf("CBOR is %d bytes, JSON is %d", len(b), len(s))
+	}
+	e, err := events.DecodeCBOR(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var m events.Message
+	if err := e.Decode(&m); err != nil {
+		t.Fatal(err)
+	}
+	if e.Version != events.Version || e.Type != events.TypeMessage || m.Nick != "alice" ||
+		len(m.Mentions) != 1 || !m.Time.Equal(now) {
+		t.Errorf("decoded %+v %+v", e, m)
+	}
+
+	// Numbers stay integers
+	b, err = jsonToCBOR(encodeEvent(events.TypeUnread, events.Unread{Count: 3}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	e, _ = events.DecodeCBOR(b)
+	var u events.Unread
+	if err := e.Decode(&u); err != nil || u.Count != 3 {
+		t.Errorf("decoded unread %+v: %v", u, err)
+	}
+}
+
+func TestFrameCache(t *testing.T) {
+	var fc frameCache
+	first := encodeEvent(events.TypeNotice, events.Notice{Text: "0"})
+	b, _ := fc.get(first)
+	if b2, _ := fc.get(first); &b2[0] != &b[0] {
+		t.Error("frame was converted again")
+	}
+	for i := 1; i <= binaryCacheSize; i++ {
+		if _, err := fc.get(encodeEvent(events.TypeNotice, events.Notice{Text: string(rune('a' + i%26)), Time: time.Unix(int64(i), 0)})); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(fc.frames) != binaryCacheSize {
+		t.Errorf("%d frames cached, want %d", len(fc.frames), binaryCacheSize)
+	}
+	if _, ok := fc.frames[first]; ok {
+		t.Error("oldest frame is still cached")
+	}
+	if _, err := fc.get("not JSON"); err == nil {
+		t.Error("invalid frame was converted")
+	}
+}
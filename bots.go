@@ -0,0 +1,132 @@
+package main
+
+// This file handles bot accounts. The operator lists bots in a file given with
+// the -bots flag, each with a token, the room it joins, and its nickname. Bots
+// connect with the JSON protocol and send their token in the Authorization
+// header. Their nickname is fixed and reserved in their room, they're marked
+// as bots everywhere they appear, and they have their own rate limit on top
+// of the room's.
+//
+// The file has one bot per line, with blank lines and lines starting with #
+// ignored:
+//
+//	<token> <room key> <nickname>
+
+import (
+	"bufio"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+
+	"golang.org/x/time/rate"
+)
+
+// botAccount is a bot configured by the operator.
+type botAccount struct {
+	token string
+	// room is the key of the room the bot joins.
+	room string
+	// nick is the bot's nickname. It is stored sanitized.
+	nick string
+}
+
+// botAccounts holds all the configured bots. It is set by loadBots.
+var botAccounts []*botAccount
+
+var (
+	errBadBotToken  = errors.New("invalid bot token")
+	errBotConnected = errors.New("bot is already connected")
+)
+
+// loadBots reads the bots file at path. An empty path means there are no bots.
+func loadBots(path string) error {
+	botAccounts = nil
+	if path == "" {
+		return nil
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	tokens := make(map[string]bool)
+	s := bufio.NewScanner(f)
+	for line := 1; s.Scan(); line++ {
+		text := strings.TrimSpace(s.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		fields := strings.SplitN(text, " ", 3)
+		if len(fields) != 3 {
+			return fmt.Errorf("%s:%d: want <token> <room key> <nickname>", path, line)
+		}
+		b := &botAccount{
+			token: fields[0],
+			room:  fields[1],
+			nick:  sanitizeNick(fields[2]),
+		}
+		if b.nick == "" {
+			return fmt.Errorf("%s:%d: invalid nickname", path, line)
+		}
+		if tokens[b.token] {
+			return fmt.Errorf("%s:%d: duplicate token", path, line)
+		}
+		tokens[b.token] = true
+		botAccounts = append(botAccounts, b)
+	}
+	return s.Err()
+}
+
+// botForRequest returns the bot whose token is in the request's Authorization
+// header. It returns nil and no error if the request isn't from a bot, and
+// errBadBotToken if the token doesn't match any bot.
+func botForRequest(r *http.Request) (*botAccount, error) {
+	auth := r.Header.Get("Authorization")
+	if auth == "" {
+		return nil, nil
+	}
+	token := strings.TrimPrefix(auth, "Bearer ")
+	var found *botAccount
+	for _, b := range botAccounts {
+		// Check every token so timing doesn't reveal which one matched
+		if subtle.ConstantTimeCompare([]byte(token), []byte(b.token)) == 1 {
+			found = b
+		}
+	}
+	if found == nil {
+		return nil, errBadBotToken
+	}
+	return found, nil
+}
+
+// newBotLimiter returns the rate limiter for a bot's messages.
+func newBotLimiter() *rate.Limiter {
+	c := currentConfig()
+	return rate.NewLimiter(rate.Limit(c.BotRate), c.BotBurst)
+}
+
+// isBotNick returns true if the nickname belongs to a bot in the room with
+// the given key, so users can't take it.
+func isBotNick(roomKey, nick string) bool {
+	for _, b := range botAccounts {
+		if b.room == roomKey && b.nick == nick {
+			return true
+		}
+	}
+	return false
+}
+
+// hasBot returns true if the bot is already connected to the room.
+// It does not lock the clientsMu, callers should do that.
+func (cr *chatRoom) hasBot(b *botAccount) bool {
+	for c := range cr.clients {
+		if c.bot == b {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,122 @@
+package main
+
+// This file has what the bridges to other chat networks share, see irc.go,
+// matrix.go, xmpp.go, and webhook.go. Messages relayed from a bridge are
+// handled by the room like regular chat messages, except they have no author.
+// They're passed on to the room's other bridges, but never back to the one
+// they came from.
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/makeworld-the-better-one/neartalk/events"
+)
+
+// Networks rooms can be bridged to, for msg.bridge
+const (
+	bridgeIRC    = "irc"
+	bridgeMatrix = "matrix"
+	bridgeXMPP   = "xmpp"
+	// Slack and Discord are mirrored with webhooks, see webhook.go
+	bridgeSlack   = "slack"
+	bridgeDiscord = "discord"
+)
+
+// bridgeQueueTimeout is how long a relayed message waits for a busy room
+// before it's dropped.
+const bridgeQueueTimeout = 5 * time.Second
+
+// relayToBridges passes the chat message in the room with the key on to the
+// room's bridges, except the one it came from. Encrypted messages aren't
+// relayed.
+func (cs *chatServer) relayToBridges(key string, b broadcast) {
+	if b.encrypted {
+		return
+	}
+	if b.bridge != bridgeIRC {
+		cs.irc.relay(key, b.alert)
+	}
+	if b.bridge != bridgeMatrix {
+		cs.matrix.relay(key, b.alert)
+	}
+	if b.bridge != bridgeXMPP {
+		cs.xmpp.relay(key, b.alert)
+	}
+	cs.webhooks.relay(key, b.bridge, b.alert)
+}
+
+// relayMemberChange tells the room's bridges that someone with the sanitized
+// nickname joined or left the room with the key. IRC isn't told, it would
+// only be noise in the channel.
+func (cs *chatServer) relayMemberChange(key, nick string, joined bool) {
+	if joined {
+		cs.matrix.relayNotice(key, fmt.Sprintf("%s joined", plainNick(nick)))
+	} else {
+		cs.matrix.relayNotice(key, fmt.Sprintf("%s left", plainNick(nick)))
+	}
+	cs.xmpp.relayPresence(key, plainNick(nick), joined)
+}
+
+// deliverBridged sends the message relayed from a bridge to the room with the
+// key. It's dropped if the room isn't open, since nobody would see it.
+func (cs *chatServer) deliverBridged(key string, m msg) {
+	cs.roomsMu.Lock()
+	room, ok := cs.rooms[key]
+	cs.roomsMu.Unlock()
+	if !ok {
+		return
+	}
+	t := time.NewTimer(bridgeQueueTimeout)
+	defer t.Stop()
+	select {
+	case room.incoming <- m:
+	case <-room.closed:
+	case <-t.C:
+		log.Printf("chatServer.deliverBridged: room %s is busy, dropping a message from %s", key, m.bridge)
+	}
+}
+
+// bridgeNotice returns a notice from a bridge for the room, like someone
+// joining on the other side.
+func bridgeNotice(bridge, text string) msg {
+	now := time.Now()
+	return msg{
+		raw:     createSpecialMsg(text, "notif"),
+		rawJSON: []string{encodeEvent(events.TypeNotice, events.Notice{Text: text, Time: now})},
+		when:    now,
+		bridge:  bridge,
+	}
+}
+
+// handleBridgedMsg handles a chat message relayed from a bridge, like
+// handleMsg does for regular messages.
+// It does not lock the clientsMu, callers should do that.
+func (cr *chatRoom) handleBridgedMsg(m msg) broadcast {
+	if msgTextError(m.text) != "" {
+		return broadcast{}
+	}
+	m.text = currentConfig().filterWords(m.text)
+	m.mentions = findMentions(m.text, cr.roomNicks())
+	cr.whenLastMsg = m.when
+	cr.recordMsg(m.when)
+	m.id = newMsgID()
+	_, nonAuthor := createChatMsg(m, nil)
+	if nonAuthor == "" {
+		return broadcast{}
+	}
+	cr.rememberMsg(m)
+	cr.recordHistory(m)
+	_, nonAuthorJSON := createChatMsgEvents(m)
+	return broadcast{
+		html:       nonAuthor,
+		authorHTML: nonAuthor,
+		json:       []string{nonAuthorJSON},
+		isChat:     true,
+		id:         m.id,
+		mentioned:  m.mentions,
+		alert:      newChatAlert(m),
+		bridge:     m.bridge,
+	}
+}
@@ -0,0 +1,134 @@
+package main
+
+// This file has the room bus, which lets several NearTalk instances run
+// behind a load balancer. Clients for the same room can end up connected to
+// different instances, so each instance passes its room broadcasts on to the
+// others through the bus, and delivers the ones it receives to its own
+// clients.
+//
+// Each instance also publishes the roster of users it has in each room, so
+// the user list shows everyone in the room, not just the users on one
+// instance. Rosters are published when they change and every rosterInterval,
+// and a roster that hasn't been refreshed within rosterTTL is dropped, in case
+// its instance went away without saying so.
+//
+// By default there's only one instance, and localBus is used, which does
+// nothing. The Redis bus is used if -redis-url is set, see redisbus.go.
+//
+// Replies, edits and deletes only work on messages sent through the same
+// instance, as each instance only remembers its own recent messages.
+
+import (
+	"time"
+)
+
+// rosterInterval is how often each instance publishes its rosters.
+const rosterInterval = 30 * time.Second
+
+// rosterTTL is how long a roster from another instance is kept for without
+// being refreshed.
+const rosterTTL = 3 * rosterInterval
+
+// roomBus passes room broadcasts and rosters between instances.
+type roomBus interface {
+	// publish passes a broadcast to the room on every other instance.
+	publish(key string, b broadcast)
+	// publishRoster passes the users in the room on this instance to every
+	// other instance. An empty roster means the instance has left the room.
+	publishRoster(key string, users []roomUser)
+	// subscribe starts delivering broadcasts and rosters from other instances
+	// for the room with the key, until the returned func is called.
+	subscribe(key string, cr *chatRoom) (unsubscribe func())
+}
+
+// localBus is the bus for a single instance. Every client of a room is in
+// the same process, so there's nothing to pass on.
+type localBus struct{}
+
+func (localBus) publish(key string, b broadcast)            {}
+func (localBus) publishRoster(key string, users []roomUser) {}
+func (localBus) subscribe(key string, cr *chatRoom) func()  { return func() {} }
+
+// remoteRoster is the users in a room on another instance.
+type remoteRoster struct {
+	users   []roomUser
+	updated time.Time
+}
+
+// deliverRemote delivers a broadcast from another instance to the clients in
+// the room. It holds the client mutex, except while sending, see send.
+func (cr *chatRoom) deliverRemote(b broadcast) {
+	cr.clientsMu.Lock()
+	if b.topic != nil {
+		cr.topic = *b.topic
+	}
+	if b.isChat {
+		cr.whenLastMsg = time.Now()
+		cr.recordMsg(cr.whenLastMsg)
+	}
+	cr.clientsMu.Unlock()
+	cr.send(b, nil)
+
+	cr.clientsMu.Lock()
+	defer cr.clientsMu.Unlock()
+	cr.pushMentions(b, nil)
+	if b.isChat {
+		cr.setSeenMsg(b.id, nil)
+	}
+}
+
+// setRemoteRoster stores the roster of another instance and updates the user
+// list. If the instance is new to the room, this instance's roster is
+// published back so the new one doesn't have to wait for it.
+// It holds the client mutex.
+func (cr *chatRoom) setRemoteRoster(instance string, users []roomUser) {
+	cr.clientsMu.Lock()
+	_, known := cr.remoteRosters[instance]
+	if len(users) == 0 {
+		delete(cr.remoteRosters, instance)
+	} else {
+		cr.remoteRosters[instance] = remoteRoster{users: users, updated: time.Now()}
+	}
+	local := cr.localUsers()
+	cr.clientsMu.Unlock()
+
+	if !known && len(users) > 0 {
+		cr.server.bus.publishRoster(cr.key, local)
+	}
+	cr.queueLocalUserList()
+}
+
+// refreshRoster publishes this instance's roster, and drops the rosters of
+// other instances that haven't been refreshed in time.
+// It holds the client mutex.
+func (cr *chatRoom) refreshRoster() {
+	cr.clientsMu.Lock()
+	expired := false
+	for instance, r := range cr.remoteRosters {
+		if time.Since(r.updated) > rosterTTL {
+			delete(cr.remoteRosters, instance)
+			expired = true
+		}
+	}
+	local := cr.localUsers()
+	cr.clientsMu.Unlock()
+
+	cr.server.bus.publishRoster(cr.key, local)
+	if expired {
+		cr.queueLocalUserList()
+	}
+}
+
+// queueLocalUserList queues an update of the user list for the clients on
+// this instance only, without any notification. It's used when the users on
+// other instances change, as they've already told their own clients.
+func (cr *chatRoom) queueLocalUserList() {
+	m := createUserListUpdate()
+	m.local = true
+
+	select {
+	case cr.incoming <- m:
+	default:
+		// Room is busy, the next user list update will fix it
+	}
+}
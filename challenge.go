@@ -0,0 +1,285 @@
+package main
+
+// This file has the proof-of-work challenge, which makes connecting cost a
+// little CPU time, so flooding rooms from many addresses at once gets
+// expensive. It's off unless "challenge_difficulty" is set in the config file.
+//
+// The chat page first gets a challenge from /challenge, and looks for a nonce
+// where the SHA-256 of "<challenge>:<nonce>" starts with difficulty zero
+// bits. Posting the solution back sets a pass cookie for the session and the
+// room key of the address it came from, and connections without a valid pass
+// are refused. The pass lasts passTTL, so returning visitors can reconnect
+// without solving it again, but it can't be handed out to connect from
+// elsewhere, and only maxConnsPerPass connections can use it at once. Bots
+// authenticate with their token instead, so they skip it.
+//
+// Challenges and passes are signed with a secret made when the server starts,
+// so restarting, or connecting to another instance, means solving again.
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/bits"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/makeworld-the-better-one/neartalk/ids"
+)
+
+// maxChallengeDifficulty is the most leading zero bits a solution can be
+// asked for. Each bit doubles the work, and 24 takes browsers around a minute.
+const maxChallengeDifficulty = 24
+
+// challengeTTL is how long a challenge can be solved for.
+const challengeTTL = 2 * time.Minute
+
+// passTTL is how long a solved challenge lets the session connect for.
+const passTTL = 24 * time.Hour
+
+// passCookieName is the name of the cookie holding the pass.
+const passCookieName = "neartalk-pass"
+
+// maxConnsPerPass is how many connections can use the same pass at once.
+const maxConnsPerPass = 10
+
+// challengeStore signs challenges and passes, remembers which challenges
+// have been solved so each one only works once, and counts the connections
+// using each pass.
+type challengeStore struct {
+	secret []byte
+
+	mu sync.Mutex
+	// solved holds the solved challenges that haven't expired yet, with when
+	// they expire.
+	solved map[string]time.Time
+	// conns counts the connections using each pass.
+	conns map[string]int
+}
+
+func newChallengeStore() *challengeStore {
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		panic(err)
+	}
+	return &challengeStore{
+		secret: secret,
+		solved: make(map[string]time.Time),
+		conns:  make(map[string]int),
+	}
+}
+
+// sign returns the signature of the payload.
+func (st *challengeStore) sign(payload string) string {
+	mac := hmac.New(sha256.New, st.secret)
+	io.WriteString(mac, payload)
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// verify splits a signed value into its dot separated parts, or returns nil
+// if the signature is wrong or it doesn't have n parts.
+func (st *challengeStore) verify(value string, n int) []string {
+	i := strings.LastIndex(value, ".")
+	if i < 0 {
+		return nil
+	}
+	payload, sig := value[:i], value[i+1:]
+	if !hmac.Equal([]byte(sig), []byte(st.sign(payload))) {
+		return nil
+	}
+	parts := strings.Split(payload, ".")
+	if len(parts) != n {
+		return nil
+	}
+	return parts
+}
+
+// newChallenge returns a new challenge at the difficulty.
+func (st *challengeStore) newChallenge(difficulty int) string {
+	payload := fmt.Sprintf("%s.%d.%d", ids.Random(), time.Now().Add(challengeTTL).Unix(), difficulty)
+	return payload + "." + st.sign(payload)
+}
+
+// leadingZeroBits returns the number of zero bits at the start of b.
+func leadingZeroBits(b []byte) int {
+	n := 0
+	for _, x := range b {
+		n += bits.LeadingZeros8(x)
+		if x != 0 {
+			break
+		}
+	}
+	return n
+}
+
+// solve checks the nonce solves the challenge, at no less than the
+// difficulty. Each challenge can only be solved once.
+func (st *challengeStore) solve(challenge, nonce string, difficulty int) bool {
+	parts := st.verify(challenge, 3)
+	if parts == nil || len(nonce) > 32 {
+		return false
+	}
+	expires, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil || time.Now().Unix() > expires {
+		return false
+	}
+	if d, err := strconv.Atoi(parts[2]); err != nil || d < difficulty {
+		return false
+	}
+	sum := sha256.Sum256([]byte(challenge + ":" + nonce))
+	if leadingZeroBits(sum[:]) < difficulty {
+		return false
+	}
+
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	now := time.Now()
+	for c, exp := range st.solved {
+		if now.After(exp) {
+			delete(st.solved, c)
+		}
+	}
+	if _, ok := st.solved[challenge]; ok {
+		return false
+	}
+	st.solved[challenge] = time.Unix(expires, 0)
+	return true
+}
+
+// addrTag returns the part of a pass that ties it to the room key, signed so
+// the key itself isn't in the cookie.
+func (st *challengeStore) addrTag(key string) string {
+	return st.sign("addr:" + key)
+}
+
+// newPass returns a pass cookie value for the session, from the room key.
+func (st *challengeStore) newPass(session, key string) string {
+	payload := fmt.Sprintf("%s.%s.%d", session, st.addrTag(key), time.Now().Add(passTTL).Unix())
+	return payload + "." + st.sign(payload)
+}
+
+// checkPass returns true if the pass cookie value is valid for the session,
+// from the room key.
+func (st *challengeStore) checkPass(session, key, value string) bool {
+	parts := st.verify(value, 3)
+	if parts == nil || parts[0] != session || !hmac.Equal([]byte(parts[1]), []byte(st.addrTag(key))) {
+		return false
+	}
+	expires, err := strconv.ParseInt(parts[2], 10, 64)
+	return err == nil && time.Now().Unix() <= expires
+}
+
+// acquire counts a new connection using the pass, or returns false if it
+// already has maxConnsPerPass. Every successful call must be matched by a
+// call to release.
+func (st *challengeStore) acquire(pass string) bool {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if st.conns[pass] >= maxConnsPerPass {
+		return false
+	}
+	st.conns[pass]++
+	return true
+}
+
+// release stops counting a connection counted by acquire.
+func (st *challengeStore) release(pass string) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	st.conns[pass]--
+	if st.conns[pass] == 0 {
+		delete(st.conns, pass)
+	}
+}
+
+// validPass returns the request's pass if it has a valid one, or "".
+func (cs *chatServer) validPass(r *http.Request, session string) string {
+	cookie, err := r.Cookie(passCookieName)
+	if err != nil || !cs.challenges.checkPass(session, getIPString(r), cookie.Value) {
+		return ""
+	}
+	return cookie.Value
+}
+
+// passedChallenge returns true if the request can connect without solving a
+// challenge, because challenges are off or it has a valid pass.
+func (cs *chatServer) passedChallenge(r *http.Request, session string) bool {
+	return currentConfig().ChallengeDifficulty == 0 || cs.validPass(r, session) != ""
+}
+
+// requireChallenge responds with an error and returns false if the
+// connection request hasn't passed the challenge, or its pass is already
+// used by too many connections. Otherwise, the connection counts towards its
+// pass until release is called.
+func (cs *chatServer) requireChallenge(w http.ResponseWriter, r *http.Request, session string) (release func(), ok bool) {
+	if currentConfig().ChallengeDifficulty == 0 {
+		return func() {}, true
+	}
+	pass := cs.validPass(r, session)
+	if pass == "" {
+		http.Error(w, "solve the challenge at /challenge first", http.StatusPreconditionRequired)
+		return nil, false
+	}
+	if !cs.challenges.acquire(pass) {
+		http.Error(w, "too many connections with this pass, close some other chat tabs and try again", http.StatusTooManyRequests)
+		return nil, false
+	}
+	return func() { cs.challenges.release(pass) }, true
+}
+
+// challengeResponse is the JSON served by /challenge.
+type challengeResponse struct {
+	Challenge  string `json:"challenge"`
+	Difficulty int    `json:"difficulty"`
+}
+
+// challengeHandler serves a new challenge on GET, and checks a solution on
+// POST, with the "challenge" and "nonce" form values. A right solution sets
+// the pass cookie.
+func (cs *chatServer) challengeHandler(w http.ResponseWriter, r *http.Request) {
+	difficulty := currentConfig().ChallengeDifficulty
+	switch r.Method {
+	case http.MethodGet:
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(challengeResponse{
+			Challenge:  cs.challenges.newChallenge(difficulty),
+			Difficulty: difficulty,
+		})
+	case http.MethodPost:
+		session := getSession(w, r)
+		if !cs.challenges.solve(r.PostFormValue("challenge"), r.PostFormValue("nonce"), difficulty) {
+			http.Error(w, "wrong or expired solution", http.StatusForbidden)
+			return
+		}
+		http.SetCookie(w, &http.Cookie{
+			Name:     passCookieName,
+			Value:    cs.challenges.newPass(session, getIPString(r)),
+			Path:     "/",
+			MaxAge:   int(passTTL.Seconds()),
+			HttpOnly: true,
+			SameSite: http.SameSiteLaxMode,
+		})
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+// challengeGate serves the page that solves the challenge, which reloads the
+// page once it's done. It returns true if the visitor has already passed and
+// can go on to the chat page.
+func (cs *chatServer) challengeGate(w http.ResponseWriter, r *http.Request) bool {
+	if cs.passedChallenge(r, getSession(w, r)) {
+		return true
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	fmt.Fprint(w, renderTemplate("challenge.html", nil))
+	return false
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"crypto/sha256"
+	"strconv"
+	"testing"
+)
+
+// solveTestChallenge finds a nonce for the challenge, like the web UI does.
+func solveTestChallenge(challenge string, difficulty int) string {
+	for nonce := 0; ; nonce++ {
+		sum := sha256.Sum256([]byte(challenge + ":" + strconv.Itoa(nonce)))
+		if leadingZeroBits(sum[:]) >= difficulty {
+			return strconv.Itoa(nonce)
+		}
+	}
+}
+
+func TestLeadingZeroBits(t *testing.T) {
+	tests := []struct {
+		b    []byte
+		want int
+	}{
+		{[]byte{0xff}, 0},
+		{[]byte{0x01, 0xff}, 7},
+		{[]byte{0x00, 0x10}, 11},
+		{[]byte{0x00, 0x00}, 16},
+	}
+	for _, tt := range tests {
+		if got := leadingZeroBits(tt.b); got != tt.want {
+			t.Errorf("leadingZeroBits(%x) = %d, want %d", tt.b, got, tt.want)
+		}
+	}
+}
+
+func TestChallengeSolve(t *testing.T) {
+	st := newChallengeStore()
+	ch := st.newChallenge(8)
+	nonce := solveTestChallenge(ch, 8)
+
+	if st.solve(ch, nonce, 12) {
+		t.Error("challenge solved at a higher difficulty than it was made for")
+	}
+	if st.solve(ch+"x", nonce, 8) {
+		t.Error("tampered challenge solved")
+	}
+	if !st.solve(ch, nonce, 8) {
+		t.Fatal("right solution refused")
+	}
+	if st.solve(ch, nonce, 8) {
+		t.Error("challenge solved twice")
+	}
+	if other := newChallengeStore(); other.solve(st.newChallenge(0), "0", 0) {
+		t.Error("challenge from another server solved")
+	}
+}
+
+func TestChallengePass(t *testing.T) {
+	st := newChallengeStore()
+	pass := st.newPass("session", "203.0.113.1")
+	if !st.checkPass("session", "203.0.113.1", pass) {
+		t.Error("pass refused for its session")
+	}
+	if st.checkPass("other", "203.0.113.1", pass) {
+		t.Error("pass accepted for another session")
+	}
+	if st.checkPass("session", "198.51.100.1", pass) {
+		t.Error("pass accepted from another address")
+	}
+	if st.checkPass("session", "203.0.113.1", pass[:len(pass)-1]) {
+		t.Error("tampered pass accepted")
+	}
+}
+
+func TestChallengePassConns(t *testing.T) {
+	st := newChallengeStore()
+	for i := 0; i < maxConnsPerPass; i++ {
+		if !st.acquire("pass") {
+			t.Fatalf("connection %d refused", i+1)
+		}
+	}
+	if st.acquire("pass") {
+		t.Error("connection over the limit accepted")
+	}
+	if !st.acquire("other") {
+		t.Error("connection with another pass refused")
+	}
+	st.release("pass")
+	if !st.acquire("pass") {
+		t.Error("connection after release refused")
+	}
+}
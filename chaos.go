@@ -0,0 +1,134 @@
+package main
+
+// This file has the fault injection ("chaos") mode, for testing how NearTalk
+// copes with bad networks. It's enabled with the -chaos flag, or by setting
+// chaos in tests, and wraps every client's transport so that frames are
+// randomly delayed or dropped, and some clients are made too slow to keep up.
+// It should never be enabled on a real server.
+//
+// The flag is a comma-separated list of settings:
+//
+//	delay=100ms  Delay each frame sent to a client by up to this long
+//	drop=0.01    Chance of dropping each frame sent to a client
+//	slow=0.05    Chance of a client being slow, so every frame takes slowFrameDelay
+//
+// Frames are delayed in order, so a delay never reorders them.
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// slowFrameDelay is how long each frame takes to send to a slow client.
+const slowFrameDelay = time.Second
+
+// chaosConfig is how faults are injected.
+type chaosConfig struct {
+	// delay is the max random delay before each frame is sent.
+	delay time.Duration
+	// drop is the probability of a frame being dropped.
+	drop float64
+	// slow is the probability of a client being slow.
+	slow float64
+}
+
+// enabled returns true if any faults will be injected.
+func (c chaosConfig) enabled() bool {
+	return c.delay > 0 || c.drop > 0 || c.slow > 0
+}
+
+func (c chaosConfig) String() string {
+	return fmt.Sprintf("delay=%v,drop=%v,slow=%v", c.delay, c.drop, c.slow)
+}
+
+// chaos is the fault injection config in use. It's set from the -chaos flag.
+var chaos chaosConfig
+
+// parseChaos parses a -chaos flag value.
+func parseChaos(s string) (chaosConfig, error) {
+	var c chaosConfig
+	for _, setting := range strings.Split(s, ",") {
+		setting = strings.TrimSpace(setting)
+		if setting == "" {
+			continue
+		}
+		key, value, _ := strings.Cut(setting, "=")
+		var err error
+		switch key {
+		case "delay":
+			c.delay, err = time.ParseDuration(value)
+			if err == nil && c.delay < 0 {
+				err = fmt.Errorf("must not be negative")
+			}
+		case "drop":
+			c.drop, err = parseProbability(value)
+		case "slow":
+			c.slow, err = parseProbability(value)
+		default:
+			return c, fmt.Errorf("unknown chaos setting %q", key)
+		}
+		if err != nil {
+			return c, fmt.Errorf("invalid chaos setting %q: %v", setting, err)
+		}
+	}
+	return c, nil
+}
+
+// parseProbability parses a number from 0 to 1.
+func parseProbability(s string) (float64, error) {
+	p, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return 0, err
+	}
+	if p < 0 || p > 1 {
+		return 0, fmt.Errorf("must be between 0 and 1")
+	}
+	return p, nil
+}
+
+// chaosTransport wraps a transport to inject faults.
+type chaosTransport struct {
+	transport
+	config chaosConfig
+	// slow is true if every frame is delayed by slowFrameDelay.
+	slow bool
+}
+
+// withChaos wraps t so faults are injected into it, if chaos mode is enabled.
+func withChaos(t transport) transport {
+	if !chaos.enabled() {
+		return t
+	}
+	return &chaosTransport{
+		transport: t,
+		config:    chaos,
+		slow:      rand.Float64() < chaos.slow,
+	}
+}
+
+func (t *chaosTransport) send(ctx context.Context, text string) error {
+	delay := time.Duration(0)
+	if t.config.delay > 0 {
+		delay = time.Duration(rand.Int63n(int64(t.config.delay)))
+	}
+	if t.slow {
+		delay += slowFrameDelay
+	}
+	if delay > 0 {
+		timer := time.NewTimer(delay)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		}
+	}
+	if rand.Float64() < t.config.drop {
+		return nil
+	}
+	return t.transport.send(ctx, text)
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseChaos(t *testing.T) {
+	tests := []struct {
+		value   string
+		want    chaosConfig
+		wantErr bool
+	}{
+		{"", chaosConfig{}, false},
+		{"delay=100ms", chaosConfig{delay: 100 * time.Millisecond}, false},
+		{"delay=1s, drop=0.5,slow=1", chaosConfig{delay: time.Second, drop: 0.5, slow: 1}, false},
+		{"drop=0", chaosConfig{}, false},
+		{"delay=-1s", chaosConfig{}, true},
+		{"drop=2", chaosConfig{}, true},
+		{"slow=lots", chaosConfig{}, true},
+		{"jitter=1s", chaosConfig{}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.value, func(t *testing.T) {
+			got, err := parseChaos(tt.value)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseChaos(%q) error = %v, wantErr %v", tt.value, err, tt.wantErr)
+			}
+			if err == nil && got != tt.want {
+				t.Errorf("parseChaos(%q) = %v, want %v", tt.value, got, tt.want)
+			}
+		})
+	}
+}
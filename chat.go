@@ -14,16 +14,15 @@ import (
 	"errors"
 	"fmt"
 	"log"
-	"net"
 	"net/http"
 	"sort"
 	"strings"
 	"sync"
 	"time"
 
+	"github.com/makeworld-the-better-one/neartalk/ids"
 	"golang.org/x/time/rate"
 	"nhooyr.io/websocket"
-	"nhooyr.io/websocket/wsjson"
 )
 
 // clientMsgBuffer controls the max number
@@ -37,11 +36,20 @@ const serverMsgBuffer = 20
 
 // msg is used to pass messages from users around in the server code.
 type msg struct {
-	// nick is the nickname of the user at the time the message was sent.
+	// id identifies the message within the room. It's set when the room
+	// handles the message.
+	id string
+	// replyTo is the ID of the message this one is replying to, if any.
+	replyTo string
+	// nick is the nickname of the author when the room handled the message.
+	// It's set by the room, since the nickname can change before then.
 	// An empty nickname indicates this is a message from the server.
 	nick string
 	// text is the message text. It is stored unsanitized.
 	text string
+	// ciphertext is set instead of text for end-to-end encrypted messages,
+	// see e2ee.go.
+	ciphertext string
 	// author points to the client that sent the message. A nil author
 	// indicates this message is from the server
 	author *client
@@ -52,84 +60,235 @@ type msg struct {
 	// TODO: this is a hack to allow the server to queue messages custom
 	// messages, like join/leave
 	raw string
+	// rawJSON holds encoded events to send to JSON clients along with raw.
+	rawJSON []string
+	// rawByLang holds raw in other languages, by language. See i18n.go.
+	rawByLang map[string]string
+	// previewID is the HTML element ID of the link preview placeholder for
+	// this message. It is empty if there is no preview.
+	previewID string
+	// local is true if a raw message is only for clients on this instance,
+	// and shouldn't be passed on to other instances. See roomBus.
+	local bool
+	// mentions is the sanitized nicknames of the people mentioned in the
+	// text. It's set when the room handles the message.
+	mentions []string
+	// approved is true if a moderator approved the message after it was
+	// held for its links, see linkpolicy.go.
+	approved bool
+	// minor is true if a raw message is only a presence update, see
+	// broadcast.
+	minor bool
+	// userList is true if the user list should be added to a raw message.
+	// It's made when the room handles the message, see members.go.
+	userList bool
+	// bridge is the network the message was relayed from, like bridgeIRC,
+	// or empty if it wasn't. Relayed messages have no author, but nick is
+	// set. See bridge.go.
+	bridge string
+	// older is true if the author asked for an older page of the room's
+	// history instead of sending a message, see history.go.
+	older bool
+	// lockPassword is the password of a "/lock <password>" message, hashed
+	// before the room locks its clientsMu, since hashing is slow. See
+	// lock.go.
+	lockPassword *roomPassword
 }
 
 type chatRoom struct {
 	// incoming is where messages sent by clients are temporarily stored.
 	incoming chan msg
-	// quit is used to stop the chatRoom goroutine
-	quit chan struct{}
+	// members is where clients joining and leaving are sent, see members.go.
+	members chan memberChange
+	// closed is closed when the room closes, see close. Anything waiting on
+	// the room's goroutine gives up then.
+	closed chan struct{}
+	// stopped is closed once the room's goroutine has stopped.
+	stopped chan struct{}
+	// closeOnce makes sure the room is only closed once.
+	closeOnce sync.Once
 	// limiter rate limits the messages sent to the server for this room.
 	// This prevents the server from being spammed by messages.
 	limiter *rate.Limiter
 	// whenLastMsg is when the most recent message was sent
 	whenLastMsg time.Time
+	// msgTimes holds when recent chat messages were sent, oldest first, for
+	// the message rate on the admin page.
+	msgTimes []time.Time
+	// stats holds the activity statistics shown to the admin, see
+	// roomstats.go.
+	stats roomStats
+	// server is the chatServer that owns this room.
+	server *chatServer
+	// key is the key of the room in the chatServer, usually the IP address.
+	key string
+	// created is when the room was created.
+	created time.Time
+	// recent holds the most recent chat messages, for quoting in replies.
+	recent []recentMsg
+	// name is the name of a named room, or empty for rooms based on IP
+	// address. Only named rooms can be listed in the directory.
+	name string
+	// listed is true if the room has opted into the directory.
+	listed bool
+	// nearbyID is the ID the room is shown with to nearby rooms, or empty if
+	// it isn't shown to them. See nearby.go.
+	nearbyID string
+	// topic is the room topic, see topic.go.
+	topic string
+	// network is the name of the network the room is for, or empty if it
+	// isn't known, see netinfo.go.
+	network string
+	// unsubscribe stops the room getting broadcasts from other instances.
+	unsubscribe func()
+	// creator is the session that created the room, who can lock it.
+	creator string
+	// password is the password needed to join a locked room, or nil.
+	password *roomPassword
+	// allowedSessions holds the sessions that can join the room despite it
+	// being locked.
+	allowedSessions map[string]bool
+	// lockVote is the vote to lock the room in progress, or nil.
+	lockVote *lockVote
+	// kickVote is the vote to kick someone in progress, or nil.
+	kickVote *kickVote
+	// kicked holds when kicked sessions can rejoin the room.
+	kicked map[string]time.Time
+	// moderators holds the sessions that are moderators of the room.
+	moderators map[string]bool
+	// guests holds the sessions that joined with an invite, see invite.go.
+	guests map[string]bool
+	// muted holds when sessions muted by a moderator, or for spam, can talk
+	// again.
+	muted map[string]time.Time
+	// spamMuted holds the muted sessions that were muted for spam.
+	spamMuted map[string]bool
+	// held holds the messages waiting for a moderator's approval, oldest
+	// first, and heldCount is how many have ever been held. See
+	// linkpolicy.go.
+	held      []heldMsg
+	heldCount int
+	// spam holds the recent messages of each session, to spot spam. See
+	// spam.go.
+	spam map[string]*spamState
+	// slowMode is how long everyone has to wait between messages, or 0 if
+	// slow mode is off. See slowmode.go.
+	slowMode time.Duration
+	// lastSent holds when each session last sent a message in slow mode.
+	lastSent map[string]time.Time
+	// seen is the latest chat message and who has seen it, for read
+	// receipts. See seen.go.
+	seen seenBy
+	// sendMu is held while a broadcast is sent, so broadcasts aren't
+	// interleaved. It's locked before the clientsMu. See fanout.go.
+	sendMu sync.Mutex
 
 	clientsMu sync.Mutex
 	clients   map[*client]struct{} // map is used for easy removal
+	// observers are admins watching the room, see observe.go. They get
+	// everything sent to the room, but aren't in clients.
+	observers map[*client]struct{}
+	// remoteRosters holds the users in the room on other instances, by
+	// instance ID. See roomBus.
+	remoteRosters map[string]remoteRoster
 }
 
-func newChatRoom() *chatRoom {
+func newChatRoom(cs *chatServer, key string) *chatRoom {
 	cr := &chatRoom{
+		server:   cs,
+		key:      key,
+		created:  time.Now(),
 		incoming: make(chan msg, serverMsgBuffer),
-		quit:     make(chan struct{}),
+		members:  make(chan memberChange),
+		closed:   make(chan struct{}),
+		stopped:  make(chan struct{}),
 		clients:  make(map[*client]struct{}),
-		// TODO: is this a good limiter?
-		limiter: rate.NewLimiter(rate.Every(time.Millisecond*100), 8),
+
+		observers: make(map[*client]struct{}),
+		limiter:   newRoomLimiter(),
+
+		remoteRosters:   make(map[string]remoteRoster),
+		allowedSessions: make(map[string]bool),
+		kicked:          make(map[string]time.Time),
+		moderators:      make(map[string]bool),
+		guests:          make(map[string]bool),
+		muted:           make(map[string]time.Time),
+		lastSent:        make(map[string]time.Time),
+		spamMuted:       make(map[string]bool),
+		spam:            make(map[string]*spamState),
 	}
+	if strings.HasPrefix(key, namedRoomPrefix) {
+		cr.name = key[len(namedRoomPrefix):]
+	}
+	cr.restoreSettings()
+	cr.unsubscribe = cs.bus.subscribe(key, cr)
 	go cr.start()
+	if roomNetwork == roomNetworkRDNS || roomNetwork == roomNetworkASN {
+		go cr.findNetwork()
+	}
 	return cr
 }
 
 func (cr *chatRoom) start() {
+	refresh := time.NewTicker(rosterInterval)
+	defer refresh.Stop()
+	defer close(cr.stopped)
+	// Messages waiting for the rate limit, see ratequeue.go
+	var queue rateQueue
 	for {
 		select {
-		case <-cr.quit:
+		case <-cr.closed:
+			cr.stop(&queue)
 			return
+		case <-refresh.C:
+			cr.refreshRoster()
+			cr.checkPresence()
+			cr.sweepGhosts()
 		case m := <-cr.incoming:
-			cr.limiter.Wait(context.Background())
-
-			authorMsg, chatMsg := cr.handleMsg(m)
-			if chatMsg == "" {
-				// No message needs to be sent to all clients
+			if m.older {
+				// Only the author gets anything, so the room's rate
+				// limit doesn't apply
+				cr.sendOlderHistory(m.author)
 				continue
 			}
-			cr.clientsMu.Lock()
-			for c := range cr.clients {
-				if m.author == c {
-					// This client sent the message, so clear their input field
-					c.sendText(authorMsg + clearInputFieldMsg)
-				} else {
-					c.sendText(chatMsg)
-				}
+			cr.admit(&queue, m, time.Now())
+		case now := <-queue.ready():
+			for _, m := range queue.pop(now) {
+				cr.handle(m)
 			}
-			cr.clientsMu.Unlock()
+		case mc := <-cr.members:
+			cr.handleMemberChange(mc)
 		}
 	}
 }
 
-// addClient adds a client to the chat room.
-// It also generates a nickname for them.
-// The chatServer addClient method should be used by clients instead.
-func (cr *chatRoom) addClient(c *client) {
-	cr.clientsMu.Lock()
-	defer cr.clientsMu.Unlock()
-
-	c.nick = cr.getNewNick()
-	cr.clients[c] = struct{}{}
-	cr.incoming <- createJoinMsg(c, cr.nicks())
-}
+// publish sends the broadcast from the author to everyone in the room, and to
+// other instances unless it's local. author can be nil. It's only called by
+// the room's goroutine.
+func (cr *chatRoom) publish(b broadcast, author *client) {
+	cr.send(b, author)
 
-// removeClient removes a client from the chat room.
-// The chatServer removeClient method should be used by clients instead.
-func (cr *chatRoom) removeClient(c *client) {
 	cr.clientsMu.Lock()
-	defer cr.clientsMu.Unlock()
+	cr.pushMentions(b, author)
+	if b.isChat {
+		cr.setSeenMsg(b.id, author)
+	}
+	local := cr.localUsers()
+	cr.clientsMu.Unlock()
 
-	delete(cr.clients, c)
-	if len(cr.clients) > 0 {
-		// Send leave message to clients left in the room
-		cr.incoming <- createLeaveMsg(c, cr.nicks())
+	if !b.isChat {
+		// Might be a join or leave
+		cr.server.admins.poke()
+	}
+	if b.isChat && b.alert != nil {
+		cr.server.relayToBridges(cr.key, b)
+	}
+	if !b.local {
+		cr.server.bus.publish(cr.key, b)
+		if !b.isChat {
+			// Might be a join, leave, or other user change
+			cr.server.bus.publishRoster(cr.key, local)
+		}
 	}
 }
 
@@ -142,11 +301,14 @@ func (cr *chatRoom) numClients() int {
 }
 
 // nickInUse returns a bool that indicates whether the provided nickname is
-// already used by another client. It does not lock the clientsMu, callers
-// should do that.
+// already used by another client, or reserved for a bot. It does not lock the
+// clientsMu, callers should do that.
 func (cr *chatRoom) nickInUse(nick string) bool {
-	for c := range cr.clients {
-		if nick == c.nick {
+	if isBotNick(cr.key, nick) {
+		return true
+	}
+	for _, u := range cr.users() {
+		if nick == u.nick {
 			return true
 		}
 	}
@@ -168,19 +330,62 @@ func (cr *chatRoom) getNewNick() string {
 	return nick
 }
 
-// nicks returns all the nicknames currently in use in this chat room.
-// The nicknames are sorted alphabetically.
+// roomUser is an entry in the user list.
+type roomUser struct {
+	nick string
+	// idle is true if the user isn't looking at the chat, or hasn't done
+	// anything for a while.
+	idle bool
+	// away is true if the user said they're away, and awayReason is the
+	// reason they gave, unsanitized.
+	away       bool
+	awayReason string
+	// bot is true if the user is a bot.
+	bot bool
+	// mod is true if the user is a moderator of the room.
+	mod bool
+	// guest is true if the user joined with an invite, see invite.go.
+	guest bool
+	// look is the user's color and avatar, or nil if they have none.
+	look *nickLook
+}
+
+// users returns all the users currently in this chat room, for the user list.
+// This includes users connected to other instances, see roomBus.
+// The users are sorted alphabetically by nickname.
 // It does not lock the clientsMu, callers should do that.
-func (cr *chatRoom) nicks() []string {
-	nks := make([]string, len(cr.clients))
+func (cr *chatRoom) users() []roomUser {
+	users := cr.localUsers()
+	for _, r := range cr.remoteRosters {
+		users = append(users, r.users...)
+	}
+	sort.Slice(users, func(i, j int) bool {
+		return users[i].nick < users[j].nick
+	})
+	return users
+}
 
-	i := 0
+// localUsers returns the users in this chat room that are connected to this
+// instance, in no particular order. People with several tabs are only listed
+// once.
+// It does not lock the clientsMu, callers should do that.
+func (cr *chatRoom) localUsers() []roomUser {
+	users := make([]roomUser, 0, len(cr.clients))
+	listed := make(map[any]int)
 	for c := range cr.clients {
-		nks[i] = c.nick
-		i++
+		c.shownIdle = c.isIdle()
+		if i, ok := listed[c.person()]; ok {
+			// They're only idle if every tab is
+			users[i].idle = users[i].idle && c.shownIdle
+			continue
+		}
+		listed[c.person()] = len(users)
+		users = append(users, roomUser{
+			nick: c.nick, idle: c.shownIdle, away: c.away, awayReason: c.awayReason,
+			bot: c.bot != nil, mod: c.moderator, guest: c.guest, look: c.look,
+		})
 	}
-	sort.Strings(nks)
-	return nks
+	return users
 }
 
 type client struct {
@@ -192,16 +397,148 @@ type client struct {
 	outgoing chan string
 	// closeSlow is called if the client can't keep up with messages
 	closeSlow func()
+	// behindMu protects the backpressure fields below, see backpressure.go.
+	behindMu sync.Mutex
+	// behindSince is when frames started being dropped because the client
+	// fell behind, or zero if it's keeping up.
+	behindSince time.Time
+	// missedMsgs is how many chat messages were dropped since then.
+	missedMsgs int
+	// missedPresence is true if presence updates were dropped, so the client
+	// needs a new user list.
+	missedPresence bool
+	// disconnectSlow is true if the client asked to be disconnected instead
+	// of missing frames.
+	disconnectSlow bool
+	// disconnect closes the client's connection with the given reason.
+	disconnect func(code websocket.StatusCode, reason string)
+	// closing is where the client is told to disconnect once it's sent what's
+	// already queued, see disconnectAfterSent.
+	closing chan closeRequest
+	// session is the session token of the browser the client is using.
+	session string
+	// addr is the client's IP address, see connAddr.
+	addr string
+	// moved is where the client's connection is sent the room the admin
+	// moved it to, see roommove.go.
+	moved chan *chatRoom
+	// proto is the protocol the client uses, protoHTML or protoJSON.
+	proto string
+	// acceptLang is the supported language that best matches the browser's
+	// Accept-Language header.
+	acceptLang string
+	// look is the color and avatar of the client's session, see avatar.go.
+	look *nickLook
+
+	// activityMu protects the activity fields below, as they're updated by
+	// the connection and read by the room.
+	activityMu sync.Mutex
+	// active is whether the user is currently looking at the chat tab.
+	active bool
+	// unreadIDs holds the IDs of chat messages received while inactive that
+	// haven't been acknowledged, oldest first.
+	unreadIDs []string
+	// lastAck is the ID of the latest message the client has seen.
+	lastAck string
+	// lastHeartbeat is when the client last sent a heartbeat. It is zero
+	// if the client never has.
+	lastHeartbeat time.Time
+	// lastAlive is when the connection was last known to be alive, because
+	// the client sent something or answered a ping, see heartbeat.go.
+	lastAlive time.Time
+	// lastInteraction is when the user last sent a message or focused the
+	// tab, see presence.go.
+	lastInteraction time.Time
+	// prefs is the notification preferences of the client's session, see
+	// notifyprefs.go.
+	prefs notifyPrefs
+	// lang is the language messages are shown in, see i18n.go.
+	lang string
+
+	// joined is when the client connected.
+	joined time.Time
+	// msgCount is how many chat messages the client has sent, see whois.go.
+	// It is only accessed by the room.
+	msgCount int
+	// lastReport is when the client last used /report. It is only accessed
+	// by the room.
+	lastReport time.Time
+	// searchLimiter limits how often the client can search the history, see
+	// search.go. It's made on the first search, and only accessed by the
+	// room.
+	searchLimiter *rate.Limiter
+	// moderator is true if the client is a moderator of the room. It is
+	// only accessed by the room.
+	moderator bool
+	// guest is true if the client joined the room with an invite, see
+	// invite.go. It is only accessed by the room.
+	guest bool
+	// ignored holds the sessions of the people the client is ignoring, see
+	// ignore.go. It is only accessed by the room.
+	ignored map[string]bool
+	// away is true if the user said they're away with /away, and awayReason
+	// is the reason they gave, unsanitized. They're only accessed by the
+	// room.
+	away       bool
+	awayReason string
+	// shownIdle is whether the user was idle in the last user list. It is
+	// only accessed by the room.
+	shownIdle bool
+	// historyCursor is the ID of the oldest message from the room's history
+	// the client was sent, or empty if it was sent all of it, see
+	// history.go. It is only accessed by the room.
+	historyCursor string
+
+	// bot is the bot account the client is using, or nil for people.
+	bot *botAccount
+	// limiter limits how fast bots can send messages. It is nil for people,
+	// who only have the room's limit.
+	limiter *rate.Limiter
 }
 
-// sendText tries to send the provided string to the client. If the client's
+// sendFrame tries to send the provided string to the client as is. If the client's
 // outgoing channel is full, the client's closeSlow func is called in a goroutine.
+// Frames that can be dropped when the client falls behind should be sent with
+// queueFrame instead.
+func (c *client) sendFrame(s string) {
+	c.queueFrame(s, frameNormal)
+}
+
+// sendText sends HTML to the client if it uses the web UI.
+// JSON clients are skipped.
 func (c *client) sendText(s string) {
+	if !c.isJSON() {
+		c.sendFrame(s)
+	}
+}
+
+// closeRequest is a close code and reason to disconnect a client with.
+type closeRequest struct {
+	code   websocket.StatusCode
+	reason string
+}
+
+// disconnectAfterSent disconnects the client like disconnect, but only once
+// everything already queued for it has been sent.
+func (c *client) disconnectAfterSent(code websocket.StatusCode, reason string) {
 	select {
-	case c.outgoing <- s:
+	case c.closing <- closeRequest{code, reason}:
 	default:
-		go c.closeSlow()
+		// Already closing
+	}
+}
 
+// flush sends everything queued for the client, without waiting for more.
+func (c *client) flush(ctx context.Context, t transport) error {
+	for {
+		select {
+		case text := <-c.outgoing:
+			if err := t.send(ctx, text); err != nil {
+				return err
+			}
+		default:
+			return nil
+		}
 	}
 }
 
@@ -212,21 +549,166 @@ type chatServer struct {
 	rooms   map[string]*chatRoom
 	roomsMu sync.Mutex
 
+	// settings holds the preferences for each session
+	settings *settingsStore
+	// roomSettings holds the saved settings of rooms, see roomsettings.go.
+	roomSettings *roomSettingsStore
+	// reports collects abuse reports for the digest
+	reports *reportLog
+
+	// hiddenListings holds the names of rooms the operator has hidden from
+	// the directory.
+	hiddenListings map[string]bool
+	listingsMu     sync.Mutex
+
+	// conns counts the connected clients, see connlimit.go.
+	conns connCounter
+
+	// accepts paces new connections, see paceAccept. It never limits if
+	// accept_rate is 0, and can be nil if it's never needed.
+	accepts *rate.Limiter
+
+	// bus passes broadcasts between instances of NearTalk. It must be set
+	// before any rooms are created.
+	bus roomBus
+
+	// httpConns maps connection IDs to open SSE and long polling
+	// connections, see httpConn.
+	httpConns   map[string]*httpConn
+	httpConnsMu sync.Mutex
+	// modCodes holds the moderator codes issued by the admin.
+	modCodes *modCodes
+	// invites holds the room invite links, see invite.go.
+	invites *inviteStore
+	// routes holds the rooms the admin merged or split, see roommove.go.
+	routes *roomRoutes
+	// admins sends live updates to the admin page.
+	admins *adminHub
+	// adminKeys holds the keys admins can log in with.
+	adminKeys *adminKeyStore
+	// challenges signs the proof-of-work challenges, see challenge.go.
+	challenges *challengeStore
+	// passwordAttempts counts wrong room passwords, see lock.go.
+	passwordAttempts *passwordAttempts
+	// audit records admin actions.
+	audit *auditLog
+	// store is where bans and message history are kept, see storage.go.
+	store storage
+	// historyWriter writes changes to the message history, see
+	// historywriter.go.
+	historyWriter *historyWriter
+	// bans holds the bans made with the API, see bans.go.
+	bans *banList
+
+	// motdMu protects motd, the message of the day, see motd.go.
+	motdMu sync.Mutex
+	motd   string
+	// announcer sends scheduled announcements.
+	announcer *announcer
+	// irc relays messages between rooms and IRC channels, see irc.go.
+	irc *ircBridges
+	// matrix relays messages between rooms and Matrix rooms, see matrix.go.
+	matrix *matrixBridges
+	// xmpp exposes rooms as XMPP multi-user chats, see xmpp.go.
+	xmpp *xmppGateway
+	// webhooks mirrors rooms into Slack and Discord, see webhook.go.
+	webhooks *webhooks
+	// closedRooms holds the statistics of recently closed rooms.
+	closedRooms closedRooms
+	// roomHooks are called when rooms are created and closed, see
+	// lifecycle.go.
+	roomHooks []roomHook
+	// msgsToday counts the chat messages sent today, for /stats.
+	msgsToday dailyCounter
+	// pusher sends Web Push notifications.
+	pusher *pusher
+
 	serveMux http.ServeMux
 }
 
-func newChatServer() *chatServer {
+func newChatServer(settings *settingsStore) *chatServer {
 	cs := &chatServer{
-		rooms: make(map[string]*chatRoom),
+		rooms:    make(map[string]*chatRoom),
+		settings: settings,
+		reports:  newReportLog(),
+		bus:      localBus{},
+		accepts:  newAcceptLimiter(),
+
+		hiddenListings: make(map[string]bool),
+		httpConns:      make(map[string]*httpConn),
+		modCodes:       newModCodes(),
+		invites:        newInviteStore(),
+		routes:         newRoomRoutes(),
 	}
-	cs.serveMux.Handle("/", noCacheHandler(http.StripPrefix("/", http.FileServer(http.Dir("html")))))
+	cs.roomHooks = []roomHook{countRoom, cs.closedRooms.add}
+	cs.admins = newAdminHub(cs)
+	cs.adminKeys = newAdminKeyStore()
+	cs.challenges = newChallengeStore()
+	cs.passwordAttempts = newPasswordAttempts()
+	cs.roomSettings, _ = newRoomSettingsStore(nil)
+	cs.audit, _ = openAuditLog(&memoryStorage{}) // Memory only, run sets the storage
+	cs.store = &memoryStorage{}
+	cs.historyWriter = newHistoryWriter()
+	cs.bans, _ = newBanList(cs.store)
+	cs.motd = strings.TrimSpace(motdFlag)
+	cs.announcer = newAnnouncer(cs)
+	cs.irc = newIRCBridges(cs)
+	cs.matrix = newMatrixBridges(cs)
+	cs.xmpp = newXMPPGateway(cs)
+	cs.webhooks = newWebhooks(cs)
+	cs.pusher = &pusher{cs: cs, last: make(map[string]time.Time)}
+	cs.serveMux.Handle("/", noCacheHandler(cs.indexHandler(http.StripPrefix("/", http.FileServer(http.Dir("html"))))))
 	cs.serveMux.HandleFunc("/connect", cs.connectHandler)
+	cs.serveMux.HandleFunc("/sse", noCache(cs.sseHandler))
+	cs.serveMux.HandleFunc("/sse/send", noCache(cs.httpSendHandler))
+	cs.serveMux.HandleFunc("/poll", noCache(cs.pollHandler))
+	cs.serveMux.HandleFunc("/poll/send", noCache(cs.httpSendHandler))
 	cs.serveMux.HandleFunc("/admin", noCache(cs.adminHandler))
 	cs.serveMux.HandleFunc("/admin.html", noCache(cs.adminHandler))
+	cs.serveMux.HandleFunc("/admin-logout", noCache(cs.adminLogoutHandler))
 	cs.serveMux.HandleFunc("/admin-data", cs.adminDataHandler)
+	cs.serveMux.HandleFunc("/admin-ws", cs.adminWSHandler)
+	cs.serveMux.HandleFunc("/admin-room", noCache(cs.adminRoomHandler))
+	cs.serveMux.HandleFunc("/admin-room/ws", cs.adminRoomWSHandler)
+	cs.serveMux.HandleFunc("/admin-directory", cs.adminDirectoryHandler)
+	cs.serveMux.HandleFunc("/admin-moderator", cs.adminModeratorHandler)
+	cs.serveMux.HandleFunc("/admin-slowmode", cs.adminSlowModeHandler)
+	cs.serveMux.HandleFunc("/admin-unmute", cs.adminUnmuteHandler)
+	cs.serveMux.HandleFunc("/admin-close-room", cs.adminCloseRoomHandler)
+	cs.serveMux.HandleFunc("/admin-erase", noCache(cs.adminEraseHandler))
+	cs.serveMux.HandleFunc("/admin-move", noCache(cs.adminMoveHandler))
+	cs.serveMux.HandleFunc("/admin-audit", noCache(cs.adminAuditHandler))
+	cs.serveMux.HandleFunc("/admin-motd", noCache(cs.adminMOTDHandler))
+	cs.serveMux.HandleFunc("/admin-announcements", noCache(cs.adminAnnouncementsHandler))
+	cs.serveMux.HandleFunc("/directory", noCache(cs.directoryHandler))
+	cs.serveMux.HandleFunc("/room/", noCache(cs.roomPageHandler))
+	cs.serveMux.HandleFunc("/sub/", noCache(cs.subroomPageHandler))
+	cs.serveMux.HandleFunc("/invite/", noCache(cs.invitePageHandler))
+	cs.serveMux.HandleFunc("/admin-invites", noCache(cs.adminInvitesHandler))
+	cs.serveMux.HandleFunc("/hooks/", noCache(cs.webhookInboundHandler))
+	cs.serveMux.HandleFunc("/lan", noCache(cs.lanLandingHandler))
+	cs.serveMux.HandleFunc("/lan/", noCache(cs.lanRoomPageHandler))
+	for _, path := range captivePortalPaths {
+		cs.serveMux.HandleFunc(path, noCache(captivePortalHandler))
+	}
+	cs.serveMux.HandleFunc("/widget", noCache(cs.widgetHandler))
+	cs.serveMux.HandleFunc("/challenge", noCache(cs.challengeHandler))
+	cs.serveMux.HandleFunc("/diagnose", noCache(func(w http.ResponseWriter, r *http.Request) {
+		http.ServeFile(w, r, "html/diagnose.html")
+	}))
+	cs.serveMux.HandleFunc("/diagnose/ws", diagnoseWSHandler)
+	cs.serveMux.HandleFunc("/diagnose/sse", noCache(diagnoseSSEHandler))
+	cs.serveMux.HandleFunc("/diagnose/poll", noCache(diagnosePollHandler))
 	cs.serveMux.HandleFunc("/version", func(w http.ResponseWriter, r *http.Request) {
 		fmt.Fprint(w, versionInfo)
 	})
+	cs.serveMux.HandleFunc("/events", eventsSchemaHandler)
+	cs.serveMux.HandleFunc("/stats", noCache(cs.statsHandler))
+	cs.serveMux.HandleFunc("/push/key", noCache(pushKeyHandler))
+	cs.serveMux.HandleFunc("/push/subscribe", noCache(cs.pushSubscribeHandler))
+	cs.serveMux.HandleFunc("/push/unsubscribe", noCache(cs.pushUnsubscribeHandler))
+	cs.serveMux.HandleFunc("/api/", noCache(cs.apiHandler))
+	cs.handleDebug()
 	return cs
 }
 
@@ -250,25 +732,52 @@ func noCacheHandler(h http.Handler) http.HandlerFunc {
 
 // addClient adds a client to the approriate chat room, creating it if needed.
 // The room the client is in is returned. It also generates and sets a nickname
-// for the client.
-func (cs *chatServer) addClient(ip string, c *client) *chatRoom {
+// for the client. errTooManyRooms is returned if the room can't be created,
+// errBotConnected if the client is a bot that's already in the room, and
+// errRoomLocked if the room is locked and the client hasn't entered the
+// password, and errKicked if the client was recently kicked from the room.
+func (cs *chatServer) addClient(ip string, c *client) (*chatRoom, error) {
 	cs.roomsMu.Lock()
 	defer cs.roomsMu.Unlock()
 
 	room, ok := cs.rooms[ip]
+	if ok && c.bot != nil {
+		room.clientsMu.Lock()
+		connected := room.hasBot(c.bot)
+		room.clientsMu.Unlock()
+		if connected {
+			return nil, errBotConnected
+		}
+	}
+	if ok && c.bot == nil {
+		room.clientsMu.Lock()
+		allowed := room.mayJoin(c.session)
+		kicked := room.isKicked(c.session)
+		room.clientsMu.Unlock()
+		if !allowed {
+			return nil, errRoomLocked
+		}
+		if kicked {
+			return nil, errKicked
+		}
+	}
 	if !ok {
 		// Room didn't previously exist, create it
-		room = newChatRoom()
+		if err := cs.makeRoomSpace(); err != nil {
+			return nil, err
+		}
+		room = newChatRoom(cs, ip)
+		if room.creator == "" {
+			room.creator = c.session
+		}
 		cs.rooms[ip] = room
+		cs.roomCreated(room)
 	}
 
-	// Nickname generation happens inside the room func
+	// Nickname generation happens in the room's goroutine, which also tells
+	// the client which room it's in
 	room.addClient(c)
-
-	// Insert room name
-	c.outgoing <- fmt.Sprintf(`<h2 id="ip-addr">%s</h2>`, ip)
-
-	return room
+	return room, nil
 }
 
 // removeClient removes a client from the approriate chat room, removing the
@@ -277,35 +786,93 @@ func (cs *chatServer) removeClient(ip string, c *client) {
 	cs.roomsMu.Lock()
 	defer cs.roomsMu.Unlock()
 
+	select {
+	case moved := <-c.moved:
+		// The admin moved it before its connection noticed
+		ip = moved.key
+	default:
+	}
+
 	room, ok := cs.rooms[ip]
 	if !ok {
-		// Room doesn't exist, so ignore
-		log.Printf("chatServer.removeClient: Tried to remove client from non-existent room %s", ip)
+		// Room doesn't exist, it may have been evicted, so ignore
 		return
 	}
 	room.removeClient(c)
 
 	if room.numClients() == 0 {
 		delete(cs.rooms, ip)
-		room.quit <- struct{}{}
+		room.close(roomEmpty)
+		cs.admins.poke()
 	}
 }
 
 func (cs *chatServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if al := currentConfig().accessLog; al != nil && al.wants(r) {
+		sr := &statusRecorder{ResponseWriter: w}
+		start := time.Now()
+		defer func() { logRequest(r, sr.status, time.Since(start)) }()
+		w = sr
+	}
+	setSecurityHeaders(w.Header())
+	if cs.refuseBanned(w, r) || refuseOrigin(w, r) {
+		return
+	}
 	cs.serveMux.ServeHTTP(w, r)
 }
 
 // connectHandler accepts the WebSocket connection and sets up the duplex messaging.
 func (cs *chatServer) connectHandler(w http.ResponseWriter, r *http.Request) {
-	conn, err := websocket.Accept(w, r, nil)
+	bot, err := botForRequest(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+	proto := protoHTML
+	if r.URL.Query().Get("proto") == protoJSON {
+		proto = protoJSON
+	}
+	if bot != nil && proto != protoJSON {
+		http.Error(w, "bots must use the JSON protocol", http.StatusBadRequest)
+		return
+	}
+	if !isWebsocketUpgrade(r) {
+		notUpgradedHandler(w, r)
+		return
+	}
+
+	if !cs.paceAccept(w, r) {
+		return
+	}
+
+	session := getSession(w, r)
+	if bot == nil {
+		release, ok := cs.requireChallenge(w, r, session)
+		if !ok {
+			return
+		}
+		defer release()
+	}
+	key, ok := cs.connectRoomKey(w, r, session)
+	if !ok {
+		return
+	}
+	conn, err := acceptWS(w, r, wsAcceptOptions(proto))
 	if err != nil {
 		log.Printf("subscribeHandler: Websocket accept error: %v", err)
 		return
 	}
 	defer conn.Close(websocket.StatusInternalError, "")
 
-	err = cs.connect(r.Context(), getIPString(r), conn)
-	if errors.Is(err, context.Canceled) {
+	// Bots join their own room instead of the one for their IP
+	if bot != nil {
+		key = bot.room
+	}
+	err = cs.connect(r.Context(), key, connAddr(r), session, proto, matchLang(r.Header.Get("Accept-Language")), bot,
+		newWSTransport(r.Context(), conn))
+	if errors.Is(err, context.Canceled) || errors.Is(err, errHeartbeatTimeout) ||
+		errors.Is(err, errRoomLocked) || errors.Is(err, errKicked) ||
+		errors.Is(err, errServerFull) || errors.Is(err, errTooManyFromAddr) {
 		return
 	}
 	if websocket.CloseStatus(err) == websocket.StatusNormalClosure ||
@@ -319,97 +886,220 @@ func (cs *chatServer) connectHandler(w http.ResponseWriter, r *http.Request) {
 }
 
 // htmxJson decodes a JSON websocket message from the web UI, which uses htmx (htmx.org)
-// This is the message sent when the user sends a message.
+// This is the message sent when the user sends a message. JSON protocol
+// clients send the same fields, see events.Send.
 type htmxJson struct {
-	Msg     string                 `json:"message"`
+	Msg string `json:"message"`
+	// Ciphertext is an end-to-end encrypted message, sent instead of Msg.
+	Ciphertext string `json:"ciphertext"`
+	// ReplyTo is the ID of the message being replied to, if any.
+	ReplyTo string `json:"reply_to"`
+	// Activity is sent by the web UI when the tab gains or loses focus.
+	// It is "active" or "inactive".
+	Activity string `json:"activity"`
+	// Heartbeat is sent regularly to show the client is still connected.
+	Heartbeat string `json:"heartbeat"`
+	// Ack is the ID of the latest message the user has seen, sent by the web
+	// UI along with Activity when the tab is focused.
+	Ack string `json:"ack"`
+	// Notify and Sound change the notification preferences, see
+	// notifyprefs.go.
+	Notify string `json:"notify"`
+	Sound  string `json:"sound"`
+	// Backpressure is what should happen when the client can't keep up, see
+	// backpressure.go.
+	Backpressure string `json:"backpressure"`
+	// Search is sent by the search box, see search.go.
+	Search string `json:"search"`
+	// Older asks for an older page of the room's history, see history.go.
+	Older   string                 `json:"older"`
 	Headers map[string]interface{} `json:"HEADERS"`
 }
 
-// connect creates a client and passes messages to and from it.
-// If the context is cancelled or an error occurs, it returns and removes the client.
-func (cs *chatServer) connect(ctx context.Context, ip string, conn *websocket.Conn) error {
+// connect creates a client and passes messages to and from it over the
+// transport. ip is the room key, and addr is the client's IP address, see
+// connAddr. acceptLang is the language matching the Accept-Language header,
+// see matchLang. bot is nil unless the client authenticated as a bot.
+// If the context is cancelled, the connection ends, or an error occurs, it
+// returns and removes the client.
+func (cs *chatServer) connect(ctx context.Context, ip, addr, session, proto, acceptLang string, bot *botAccount, t transport) error {
+	t = withChaos(t)
+	settings := cs.settings.get(session)
 	cl := &client{
-		outgoing: make(chan string, clientMsgBuffer),
+		session:    session,
+		addr:       addr,
+		moved:      make(chan *chatRoom, 1),
+		proto:      proto,
+		acceptLang: acceptLang,
+		bot:        bot,
+		outgoing:   make(chan string, clientMsgBuffer),
+		closing:    make(chan closeRequest, 1),
+		active:     true,
+		prefs:      prefsOf(settings),
+		lang:       acceptLang,
+		look:       lookOf(cs.settings.lookSeed(session)),
+
+		joined:          time.Now(),
+		lastInteraction: time.Now(),
+		lastAlive:       time.Now(),
 		closeSlow: func() {
-			conn.Close(websocket.StatusPolicyViolation, "connection too slow to keep up with messages")
+			t.close(websocket.StatusPolicyViolation, "connection too slow to keep up with messages")
 		},
+		disconnect: t.close,
 	}
-	room := cs.addClient(ip, cl)
-	defer cs.removeClient(ip, cl)
-
-	// Read websocket messages from user into channel
-	// Cancel context when connection is closed
-	readCh := make(chan string, serverMsgBuffer)
-	ctx, cancel := context.WithCancel(ctx)
-	go func() {
-		for {
-			var webMsg htmxJson
-			err := wsjson.Read(ctx, conn, &webMsg)
-			if err != nil {
-				// Treat any error the same as it being closed
-				cancel()
-				conn.Close(websocket.StatusPolicyViolation, "unexpected error")
-				return
-			}
-			readCh <- webMsg.Msg
+	if isSupportedLang(settings.Lang) {
+		cl.lang = settings.Lang
+	}
+	if bot != nil {
+		cl.limiter = newBotLimiter()
+	}
+	var room *chatRoom
+	err := cs.conns.acquire(addr, bot != nil)
+	if err == nil {
+		defer cs.conns.release(addr, bot != nil)
+		room, err = cs.addClient(ip, cl)
+	}
+	if err != nil {
+		if errors.Is(err, errServerFull) {
+			cl.sendError("The server is full right now, try again later.")
+		} else if errors.Is(err, errTooManyFromAddr) {
+			cl.sendError("There are too many connections from your address, close some other chat tabs and try again.")
+		} else if errors.Is(err, errBotConnected) {
+			cl.sendError("This bot is already connected.")
+		} else if errors.Is(err, errRoomLocked) {
+			cl.sendError("This room is locked, reload the page to enter the password.")
+		} else if errors.Is(err, errKicked) {
+			cl.sendError("You were kicked from this room, try again later.")
+		} else {
+			cl.sendError("The server has too many chat rooms right now, try again later.")
 		}
-	}()
+		t.send(ctx, <-cl.outgoing)
+		t.close(websocket.StatusTryAgainLater, err.Error())
+		return err
+	}
+	// The room changes if the admin moves the client
+	defer func() { cs.removeClient(room.key, cl) }()
+
+	if settings.Theme != "" {
+		cl.sendText(createThemeMsg(settings.Theme))
+	}
+	cl.sendPrefs(cl.prefs)
+
+	heartbeatCheck := time.NewTicker(heartbeatTimeout / 3)
+	defer heartbeatCheck.Stop()
+	pings := time.NewTicker(pingInterval)
+	defer pings.Stop()
+
+	// The web UI sends a message as soon as it's connected, see handshakeTimeout.
+	// Other clients don't have to, so they aren't checked.
+	var handshake <-chan time.Time
+	if !cl.isJSON() {
+		timer := time.NewTimer(handshakeTimeout)
+		defer timer.Stop()
+		handshake = timer.C
+	}
 
 	for {
 		select {
 		case text := <-cl.outgoing:
 			// Send message to user
-			err := writeTimeout(ctx, time.Second*5, conn, text)
+			err := t.send(ctx, text)
+			var wte *writeTimeoutError
+			if errors.As(err, &wte) {
+				t.close(websocket.StatusPolicyViolation, err.Error())
+				return err
+			}
 			if err != nil {
 				return err
 			}
-		case text := <-readCh:
-			// Send message to chat room
-			room.incoming <- msg{
-				nick:   cl.nick,
-				text:   text,
-				author: cl,
-				when:   time.Now(),
+		case webMsg := <-t.received():
+			handshake = nil
+			cl.handleIncoming(room, webMsg)
+		case room = <-cl.moved:
+		case <-handshake:
+			log.Printf("chatServer.connect: web client sent nothing within %v of connecting, a proxy may be buffering frames", handshakeTimeout)
+			cl.sendError(diagnoseHint)
+		case <-heartbeatCheck.C:
+			if cl.heartbeatExpired() {
+				t.close(websocket.StatusPolicyViolation, "no heartbeat received")
+				return errHeartbeatTimeout
+			}
+			if cl.isDead() {
+				t.close(websocket.StatusGoingAway, errConnDead.Error())
+				return errConnDead
 			}
+		case <-pings.C:
+			go cl.ping(ctx, t)
+		case req := <-cl.closing:
+			// Send the rest first, like a notice saying why
+			if err := cl.flush(ctx, t); err != nil {
+				return err
+			}
+			t.close(req.code, req.reason)
+			return nil
+		case <-t.done():
+			return nil
 		case <-ctx.Done():
 			return ctx.Err()
 		}
 	}
 }
 
-func getIPString(r *http.Request) string {
-	xForwardedFor := r.Header.Get("X-Forwarded-For")
-	forwardedIPs := strings.Split(xForwardedFor, ", ")
-	if len(forwardedIPs) > 0 {
-		// The server is reverse-proxied.
-
-		// Return final value in the list, to guard against spoofing
-		// https://stackoverflow.com/a/65270044
-		return forwardedIPs[len(forwardedIPs)-1]
+// handleIncoming handles a message the client sent, whatever the transport.
+func (cl *client) handleIncoming(room *chatRoom, webMsg htmxJson) {
+	cl.alive()
+	if webMsg.Heartbeat != "" {
+		cl.heartbeat()
 	}
-
-	// Otherwise, the server is not being reverse-proxied.
-	// This is most likely during debugging.
-
-	ip, _, err := net.SplitHostPort(r.RemoteAddr)
-	if err != nil {
-		log.Printf("getIPString: net.SplitHostPort(%s): %v", r.RemoteAddr, err)
-		return r.RemoteAddr
+	if webMsg.Activity != "" {
+		n, changed := cl.setActive(webMsg.Activity == "active")
+		// The web UI is always told, to keep the tab title right
+		if changed || !cl.isJSON() {
+			cl.sendUnread(n)
+		}
+		if changed {
+			cl.interacted()
+			room.queueUserList()
+			room.updateSeenBy()
+		}
 	}
-	parsed := net.ParseIP(ip)
-
-	if parsed.IsPrivate() || parsed.IsLoopback() {
-		// IP is from a local address, from the same machine as the server, or from the LAN
-		// This would happen during testing, like if the server is being run on a dev machine
-		// Return a fake IP address key, as there would be multiple IP addresses within the LAN
-		return "lan"
+	if webMsg.Ack != "" && ids.Valid(webMsg.Ack) {
+		if n, changed := cl.ack(webMsg.Ack); changed {
+			cl.sendUnread(n)
+			room.updateSeenBy()
+		}
+	}
+	if webMsg.Notify != "" || webMsg.Sound != "" {
+		room.setNotifyPrefs(cl, webMsg.Notify, webMsg.Sound)
+	}
+	if webMsg.Backpressure != "" {
+		cl.setBackpressure(webMsg.Backpressure)
+	}
+	if webMsg.Heartbeat != "" || webMsg.Activity != "" || webMsg.Ack != "" ||
+		webMsg.Notify != "" || webMsg.Sound != "" || webMsg.Backpressure != "" {
+		return
+	}
+	if cl.limiter != nil && !cl.limiter.Allow() {
+		cl.sendError("You're sending messages too fast, that one was dropped")
+		return
+	}
+	cl.interacted()
+	text := webMsg.Msg
+	if webMsg.Search != "" {
+		text = "/search " + webMsg.Search
+	}
+	// Send message to chat room
+	m := msg{
+		text:       normalizeNewlines(text),
+		ciphertext: webMsg.Ciphertext,
+		replyTo:    webMsg.ReplyTo,
+		author:     cl,
+		when:       time.Now(),
+		older:      webMsg.Older != "",
+	}
+	select {
+	case room.incoming <- m:
+	case <-room.closed:
+		// They're being disconnected
 	}
-	return ip
-}
-
-func writeTimeout(ctx context.Context, timeout time.Duration, conn *websocket.Conn, text string) error {
-	ctx, cancel := context.WithTimeout(ctx, timeout)
-	defer cancel()
-
-	return conn.Write(ctx, websocket.MessageText, []byte(text))
 }
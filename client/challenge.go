@@ -0,0 +1,115 @@
+package client
+
+// This file solves the proof-of-work challenge servers can ask for before
+// connecting, to slow down floods. Dial does it when the server refuses to
+// connect without it, which only takes a moment at the difficulties servers
+// use.
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"math/bits"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// challenge is a challenge from the server's /challenge endpoint.
+type challenge struct {
+	Challenge  string `json:"challenge"`
+	Difficulty int    `json:"difficulty"`
+}
+
+// challengeURL returns the URL of the server's challenge endpoint.
+func challengeURL(serverURL string) (string, error) {
+	u, err := url.Parse(serverURL)
+	if err != nil {
+		return "", fmt.Errorf("client: invalid URL: %w", err)
+	}
+	switch u.Scheme {
+	case "ws":
+		u.Scheme = "http"
+	case "wss":
+		u.Scheme = "https"
+	}
+	u.Path = strings.TrimSuffix(u.Path, "/") + "/challenge"
+	u.RawQuery = ""
+	return u.String(), nil
+}
+
+// solve returns the nonce that solves the challenge: the SHA-256 of
+// "<challenge>:<nonce>" has to start with Difficulty zero bits.
+func (ch challenge) solve(ctx context.Context) (string, error) {
+	for nonce := 0; ; nonce++ {
+		if nonce%(1<<16) == 0 && ctx.Err() != nil {
+			return "", ctx.Err()
+		}
+		n := strconv.Itoa(nonce)
+		sum := sha256.Sum256([]byte(ch.Challenge + ":" + n))
+		zeros := 0
+		for _, b := range sum {
+			zeros += bits.LeadingZeros8(b)
+			if b != 0 {
+				break
+			}
+		}
+		if zeros >= ch.Difficulty {
+			return n, nil
+		}
+	}
+}
+
+// solveChallenge gets a challenge from the server and solves it. It returns
+// the cookies the server set, which let the session connect.
+func solveChallenge(ctx context.Context, serverURL string, hc *http.Client, header http.Header) ([]*http.Cookie, error) {
+	if hc == nil {
+		hc = http.DefaultClient
+	}
+	u, err := challengeURL(serverURL)
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header = header.Clone()
+	resp, err := hc.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	var ch challenge
+	err = json.NewDecoder(resp.Body).Decode(&ch)
+	resp.Body.Close()
+	if err != nil {
+		return nil, fmt.Errorf("reading challenge: %w", err)
+	}
+	nonce, err := ch.solve(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	form := url.Values{"challenge": {ch.Challenge}, "nonce": {nonce}}
+	req, err = http.NewRequestWithContext(ctx, http.MethodPost, u, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header = header.Clone()
+	if req.Header == nil {
+		req.Header = make(http.Header)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	resp, err = hc.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent {
+		return nil, fmt.Errorf("solution refused: %s", resp.Status)
+	}
+	return resp.Cookies(), nil
+}
@@ -0,0 +1,357 @@
+// Package client is a Go client for NearTalk servers. It connects using the
+// JSON protocol, and can be used to write bots or alternative front-ends.
+//
+// A minimal bot that echoes messages looks like this:
+//
+//	c, err := client.Dial(ctx, "https://neartalk.example.com", nil)
+//	if err != nil {
+//		return err
+//	}
+//	defer c.Close()
+//	for e := range c.Events() {
+//		if e.Type != events.TypeMessage {
+//			continue
+//		}
+//		var m events.Message
+//		if err := e.Decode(&m); err != nil || m.Self {
+//			continue
+//		}
+//		c.SendMessage(ctx, "You said: "+m.Text)
+//	}
+//	return c.Err()
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fxamacker/cbor/v2"
+	"github.com/makeworld-the-better-one/neartalk/events"
+	"nhooyr.io/websocket"
+	"nhooyr.io/websocket/wsjson"
+)
+
+// HeartbeatInterval is how often heartbeats are sent to the server.
+const HeartbeatInterval = 30 * time.Second
+
+// eventBuffer is how many events can be waiting in the Events channel. If
+// the channel is full, reading from the server stops until there's space,
+// and the server may disconnect the client if it falls too far behind.
+const eventBuffer = 64
+
+// ErrClosed is returned when using a closed client.
+var ErrClosed = errors.New("client: closed")
+
+// Options configure how the client connects. The zero value is valid.
+type Options struct {
+	// HTTPClient is used for the websocket handshake. http.DefaultClient is
+	// used if it's nil.
+	HTTPClient *http.Client
+	// HTTPHeader is added to the handshake request, for things like cookies.
+	HTTPHeader http.Header
+	// BotToken connects as the bot account with this token, instead of as a
+	// regular user. Bots join the room the operator configured for them.
+	BotToken string
+	// Room joins the named room with this name, instead of the room for the
+	// client's IP address. Servers can turn named rooms off.
+	Room string
+	// Invite joins the room of an invite link, with the token from its
+	// /invite/<token> path. The client joins as a guest.
+	Invite string
+	// Subroom joins the subroom with this name, without the "#", of the
+	// room for the client's IP address. It's where "/join #name" takes
+	// people in the browser.
+	Subroom string
+	// Binary asks the server to send events as CBOR instead of JSON, which
+	// uses less bandwidth and CPU in busy rooms. See
+	// events.SubprotocolCBOR. Older servers send JSON anyway.
+	Binary bool
+}
+
+// Client is a connection to a NearTalk chat room. Its methods are safe for
+// concurrent use.
+type Client struct {
+	conn *websocket.Conn
+	// binary is true if the server agreed to send events as CBOR.
+	binary bool
+	events chan *events.Envelope
+	cancel context.CancelFunc
+	done   chan struct{}
+
+	errMu sync.Mutex
+	err   error
+}
+
+// Dial connects to the NearTalk server at serverURL, which should be the URL
+// of the site, like "https://neartalk.example.com". ws:// and wss:// URLs
+// work as well. The chat room is chosen by the server based on the client's
+// IP address, like in the browser, unless Options.Room is set.
+func Dial(ctx context.Context, serverURL string, opts *Options) (*Client, error) {
+	if opts == nil {
+		opts = &Options{}
+	}
+	u, err := connectURL(serverURL, opts.Room, opts.Invite, opts.Subroom)
+	if err != nil {
+		return nil, err
+	}
+	header := opts.HTTPHeader
+	if opts.BotToken != "" {
+		header = header.Clone()
+		if header == nil {
+			header = make(http.Header)
+		}
+		header.Set("Authorization", "Bearer "+opts.BotToken)
+	}
+	var subprotocols []string
+	if opts.Binary {
+		subprotocols = []string{events.SubprotocolCBOR}
+	}
+	conn, resp, err := websocket.Dial(ctx, u, &websocket.DialOptions{
+		HTTPClient:   opts.HTTPClient,
+		HTTPHeader:   header,
+		Subprotocols: subprotocols,
+	})
+	if err != nil && resp != nil && resp.StatusCode == http.StatusPreconditionRequired {
+		// The server wants a proof-of-work first, see challenge.go
+		cookies, cerr := solveChallenge(ctx, serverURL, opts.HTTPClient, header)
+		if cerr != nil {
+			return nil, fmt.Errorf("client: challenge: %w", cerr)
+		}
+		header = header.Clone()
+		if header == nil {
+			header = make(http.Header)
+		}
+		for _, c := range cookies {
+			header.Add("Cookie", (&http.Cookie{Name: c.Name, Value: c.Value}).String())
+		}
+		conn, _, err = websocket.Dial(ctx, u, &websocket.DialOptions{
+			HTTPClient:   opts.HTTPClient,
+			HTTPHeader:   header,
+			Subprotocols: subprotocols,
+		})
+	}
+	if err != nil {
+		return nil, fmt.Errorf("client: dial: %w", err)
+	}
+	// Messages can be longer than the default limit, especially with HTML
+	conn.SetReadLimit(1 << 20)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	c := &Client{
+		conn:   conn,
+		binary: conn.Subprotocol() == events.SubprotocolCBOR,
+		events: make(chan *events.Envelope, eventBuffer),
+		cancel: cancel,
+		done:   make(chan struct{}),
+	}
+	go c.readLoop(ctx)
+	go c.heartbeatLoop(ctx)
+	return c, nil
+}
+
+// connectURL converts a site URL into the URL of the JSON websocket endpoint,
+// for the named room if room isn't empty, the invite if invite isn't, or
+// the subroom if sub isn't.
+func connectURL(serverURL, room, invite, sub string) (string, error) {
+	u, err := url.Parse(serverURL)
+	if err != nil {
+		return "", fmt.Errorf("client: invalid URL: %w", err)
+	}
+	switch u.Scheme {
+	case "http", "ws":
+		u.Scheme = "ws"
+	case "https", "wss":
+		u.Scheme = "wss"
+	default:
+		return "", fmt.Errorf("client: unsupported URL scheme %q", u.Scheme)
+	}
+	u.Path = strings.TrimSuffix(u.Path, "/") + "/connect"
+	q := url.Values{"proto": {"json"}}
+	if room != "" {
+		q.Set("room", room)
+	}
+	if invite != "" {
+		q.Set("invite", invite)
+	}
+	if sub != "" {
+		q.Set("sub", sub)
+	}
+	u.RawQuery = q.Encode()
+	return u.String(), nil
+}
+
+// readLoop reads events from the server into the events channel until the
+// connection is closed.
+func (c *Client) readLoop(ctx context.Context) {
+	defer close(c.done)
+	defer close(c.events)
+	for {
+		e, err := c.read(ctx)
+		if err != nil {
+			c.setErr(err)
+			c.cancel()
+			return
+		}
+		select {
+		case c.events <- e:
+		case <-ctx.Done():
+			c.setErr(ErrClosed)
+			return
+		}
+	}
+}
+
+// read reads an event from the server, in JSON or CBOR.
+func (c *Client) read(ctx context.Context) (*events.Envelope, error) {
+	if !c.binary {
+		var e events.Envelope
+		if err := wsjson.Read(ctx, c.conn, &e); err != nil {
+			return nil, err
+		}
+		return &e, nil
+	}
+	typ, b, err := c.conn.Read(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if typ != websocket.MessageBinary {
+		return nil, fmt.Errorf("client: expected binary message, got %v", typ)
+	}
+	return events.DecodeCBOR(b)
+}
+
+// heartbeatLoop sends heartbeats until the connection is closed.
+func (c *Client) heartbeatLoop(ctx context.Context) {
+	t := time.NewTicker(HeartbeatInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+			c.send(ctx, events.Send{Heartbeat: "1"})
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (c *Client) setErr(err error) {
+	c.errMu.Lock()
+	defer c.errMu.Unlock()
+	if c.err == nil {
+		c.err = err
+	}
+}
+
+// Err returns the reason the connection closed, once the Events channel has
+// been closed. It returns nil if the connection is still open.
+func (c *Client) Err() error {
+	c.errMu.Lock()
+	defer c.errMu.Unlock()
+	return c.err
+}
+
+// Events returns the channel events from the server are sent on. It is closed
+// when the connection closes, after which Err returns the reason.
+//
+// The first events are always a "room" event, followed by the "join" event
+// for this client.
+func (c *Client) Events() <-chan *events.Envelope {
+	return c.events
+}
+
+func (c *Client) send(ctx context.Context, s events.Send) error {
+	select {
+	case <-c.done:
+		return ErrClosed
+	default:
+	}
+	if !c.binary {
+		return wsjson.Write(ctx, c.conn, s)
+	}
+	b, err := cbor.Marshal(s)
+	if err != nil {
+		return err
+	}
+	return c.conn.Write(ctx, websocket.MessageBinary, b)
+}
+
+// SendMessage sends a chat message to the room. Commands like "/nick" can be
+// sent this way as well.
+func (c *Client) SendMessage(ctx context.Context, text string) error {
+	return c.send(ctx, events.Send{Message: text})
+}
+
+// SendEncrypted sends an end-to-end encrypted chat message, on servers that
+// relay them. The ciphertext is base64 encoded, see events.Encrypted.
+func (c *Client) SendEncrypted(ctx context.Context, ciphertext string) error {
+	return c.send(ctx, events.Send{Ciphertext: ciphertext})
+}
+
+// Reply sends a chat message that replies to the message with the given ID.
+func (c *Client) Reply(ctx context.Context, id, text string) error {
+	return c.send(ctx, events.Send{Message: text, ReplyTo: id})
+}
+
+// SetNick changes the client's nickname. The server responds with a "nick"
+// event if it worked, or an "error" event if not.
+func (c *Client) SetNick(ctx context.Context, nick string) error {
+	return c.SendMessage(ctx, "/nick "+nick)
+}
+
+// SetActive tells the server whether the user is looking at the chat.
+// Inactive users are shown as idle.
+func (c *Client) SetActive(ctx context.Context, active bool) error {
+	activity := "inactive"
+	if active {
+		activity = "active"
+	}
+	return c.send(ctx, events.Send{Activity: activity})
+}
+
+// Ack tells the server the user has seen the message with the given ID, and
+// every message before it. The server responds with an "unread" event if the
+// unread count changed.
+func (c *Client) Ack(ctx context.Context, id string) error {
+	return c.send(ctx, events.Send{Ack: id})
+}
+
+// SetPrefs sets the user's notification preferences for the session: which
+// messages to be notified of, "all", "mentions" or "off", and whether
+// notifications should play a sound. The server responds with a "prefs"
+// event.
+func (c *Client) SetPrefs(ctx context.Context, notify string, sound bool) error {
+	s := events.Send{Notify: notify, Sound: "off"}
+	if sound {
+		s.Sound = "on"
+	}
+	return c.send(ctx, s)
+}
+
+// SetBackpressure sets what happens when the client can't keep up with
+// events: "drop" to miss some, or "disconnect" to be disconnected instead.
+// See events.Send.
+func (c *Client) SetBackpressure(ctx context.Context, policy string) error {
+	return c.send(ctx, events.Send{Backpressure: policy})
+}
+
+// LoadOlder asks for the page of the room's history before the oldest message
+// the client was sent. The server responds with a "history" event, see
+// events.History.
+func (c *Client) LoadOlder(ctx context.Context) error {
+	return c.send(ctx, events.Send{Older: "1"})
+}
+
+// Close closes the connection to the server.
+func (c *Client) Close() error {
+	c.setErr(ErrClosed)
+	err := c.conn.Close(websocket.StatusNormalClosure, "")
+	c.cancel()
+	<-c.done
+	return err
+}
@@ -0,0 +1,311 @@
+// Command neartalk-bench load tests a NearTalk server. It connects many
+// simulated clients spread over several named rooms, has them chat at a
+// steady rate, and reports how long messages took to arrive and how many
+// never did.
+//
+// The server's config file should have a message_rate above -rate, or most
+// messages are rejected. Clients disconnected for being slow count towards
+// the drop rate, since they miss everything after. Don't run it against a
+// server people are using.
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"math/rand"
+	"os"
+	"os/signal"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/makeworld-the-better-one/neartalk/client"
+	"github.com/makeworld-the-better-one/neartalk/events"
+)
+
+// msgPrefix starts every message sent, followed by when it was sent in Unix
+// nanoseconds.
+const msgPrefix = "bench "
+
+// dialers is the most clients connecting at once.
+const dialers = 50
+
+// dialTimeout is how long a client waits to connect before giving up.
+const dialTimeout = 10 * time.Second
+
+var (
+	numClients int
+	numRooms   int
+	duration   time.Duration
+	msgRate    float64
+	drain      time.Duration
+	roomPrefix string
+	binary     bool
+)
+
+func main() {
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [flags] <server URL>\n\nFlags:\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.IntVar(&numClients, "clients", 50, "Number of clients to connect")
+	flag.IntVar(&numRooms, "rooms", 1, "Number of named rooms to spread the clients over")
+	flag.DurationVar(&duration, "duration", 30*time.Second, "How long to send messages for")
+	flag.Float64Var(&msgRate, "rate", 5, "Messages sent per second in each room, by a random client in it")
+	flag.DurationVar(&drain, "drain", 2*time.Second, "How long to wait for messages still arriving after sending stops")
+	flag.StringVar(&roomPrefix, "room-prefix", "bench", "Start of the room names, which are <prefix>-1, <prefix>-2, and so on")
+	flag.BoolVar(&binary, "binary", false, "Have clients get events as CBOR instead of JSON")
+	flag.Parse()
+
+	if flag.NArg() != 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	if numClients < 1 || numRooms < 1 || numRooms > numClients {
+		fmt.Fprintln(os.Stderr, "-clients and -rooms must be positive, with at least one client per room")
+		os.Exit(2)
+	}
+	if msgRate <= 0 {
+		fmt.Fprintln(os.Stderr, "-rate must be positive")
+		os.Exit(2)
+	}
+
+	if err := run(flag.Arg(0)); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+func run(serverURL string) error {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	st := &stats{}
+	rooms := make([]*room, numRooms)
+	for i := range rooms {
+		rooms[i] = &room{name: fmt.Sprintf("%s-%d", roomPrefix, i+1)}
+	}
+
+	fmt.Printf("Connecting %d clients to %d rooms...\n", numClients, numRooms)
+	start := time.Now()
+	var readers sync.WaitGroup
+	connect(ctx, serverURL, rooms, st, &readers)
+	defer readers.Wait()
+	defer closeAll(rooms)
+	if ctx.Err() != nil {
+		return nil
+	}
+	connected := 0
+	for _, r := range rooms {
+		connected += len(r.clients)
+	}
+	if connected == 0 {
+		return errors.New("no clients could connect")
+	}
+	fmt.Printf("Connected %d clients in %s, sending for %s...\n",
+		connected, time.Since(start).Round(time.Millisecond), duration)
+
+	var senders sync.WaitGroup
+	for _, r := range rooms {
+		if len(r.clients) == 0 {
+			continue
+		}
+		senders.Add(1)
+		go func(r *room) {
+			defer senders.Done()
+			r.send(ctx, st)
+		}(r)
+	}
+	senders.Wait()
+
+	select {
+	case <-time.After(drain):
+	case <-ctx.Done():
+	}
+	closeAll(rooms)
+	readers.Wait()
+
+	st.report(os.Stdout, connected)
+	return nil
+}
+
+// connect connects numClients clients, adding each to a room in turn. Each
+// client starts reading events as soon as it's connected, so it doesn't fall
+// behind while the rest connect, and readers is done once they've all stopped.
+func connect(ctx context.Context, serverURL string, rooms []*room, st *stats, readers *sync.WaitGroup) {
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, dialers)
+	for i := 0; i < numClients; i++ {
+		r := rooms[i%len(rooms)]
+		wg.Add(1)
+		sem <- struct{}{}
+		go func() {
+			defer wg.Done()
+			defer func() { <-sem }()
+			dialCtx, cancel := context.WithTimeout(ctx, dialTimeout)
+			defer cancel()
+			c, err := client.Dial(dialCtx, serverURL, &client.Options{Room: r.name, Binary: binary})
+			if err != nil {
+				if st.failed.Add(1) == 1 {
+					fmt.Fprintf(os.Stderr, "couldn't connect: %v\n", err)
+				}
+				return
+			}
+			r.mu.Lock()
+			r.clients = append(r.clients, c)
+			r.mu.Unlock()
+			readers.Add(1)
+			go func() {
+				defer readers.Done()
+				r.read(c, st)
+			}()
+		}()
+	}
+	wg.Wait()
+}
+
+// closeAll disconnects every client.
+func closeAll(rooms []*room) {
+	for _, r := range rooms {
+		for _, c := range r.clients {
+			c.Close()
+		}
+	}
+}
+
+// room is a named room and the clients connected to it.
+type room struct {
+	name string
+
+	mu      sync.Mutex
+	clients []*client.Client
+}
+
+// size returns how many clients are connected to the room.
+func (r *room) size() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return len(r.clients)
+}
+
+// send has a random client in the room send a message at msgRate, for the
+// -duration or until the context is done. The context isn't given a deadline,
+// since writes that time out close the connection.
+func (r *room) send(ctx context.Context, st *stats) {
+	t := time.NewTicker(time.Duration(float64(time.Second) / msgRate))
+	defer t.Stop()
+	end := time.After(duration)
+	for {
+		select {
+		case <-t.C:
+		case <-end:
+			return
+		case <-ctx.Done():
+			return
+		}
+		c := r.clients[rand.Intn(len(r.clients))]
+		// Count it first, so a fast reply can't be received before it's expected
+		st.expected.Add(int64(len(r.clients)))
+		err := c.SendMessage(ctx, msgPrefix+strconv.FormatInt(time.Now().UnixNano(), 10))
+		if err != nil {
+			st.expected.Add(-int64(len(r.clients)))
+			if ctx.Err() != nil {
+				return
+			}
+			continue
+		}
+		st.sent.Add(1)
+	}
+}
+
+// read records the events the client receives until it's closed.
+func (r *room) read(c *client.Client, st *stats) {
+	for e := range c.Events() {
+		switch e.Type {
+		case events.TypeMessage:
+			var m events.Message
+			if err := e.Decode(&m); err != nil {
+				continue
+			}
+			ns, ok := strings.CutPrefix(m.Text, msgPrefix)
+			if !ok {
+				continue
+			}
+			sent, err := strconv.ParseInt(ns, 10, 64)
+			if err != nil {
+				continue
+			}
+			st.received.Add(1)
+			st.addLatency(time.Since(time.Unix(0, sent)))
+		case events.TypeError:
+			// Most likely the room's rate limit, so nobody gets the message
+			st.rejected.Add(1)
+			st.expected.Add(-int64(r.size()))
+		}
+	}
+	if err := c.Err(); err != nil && !errors.Is(err, client.ErrClosed) {
+		if st.disconnected.Add(1) == 1 {
+			fmt.Fprintf(os.Stderr, "disconnected: %v\n", err)
+		}
+	}
+}
+
+// stats holds what was measured, for every room together.
+type stats struct {
+	sent, rejected atomic.Int64
+	expected       atomic.Int64
+	received       atomic.Int64
+	failed         atomic.Int64
+	disconnected   atomic.Int64
+	latenciesMu    sync.Mutex
+	latencies      []time.Duration
+}
+
+func (st *stats) addLatency(d time.Duration) {
+	st.latenciesMu.Lock()
+	defer st.latenciesMu.Unlock()
+	st.latencies = append(st.latencies, d)
+}
+
+// percentile returns the latency that p percent of messages arrived within.
+// The latencies must be sorted.
+func percentile(sorted []time.Duration, p float64) time.Duration {
+	if len(sorted) == 0 {
+		return 0
+	}
+	i := int(float64(len(sorted)-1) * p / 100)
+	return sorted[i]
+}
+
+// report prints the results.
+func (st *stats) report(out io.Writer, connected int) {
+	st.latenciesMu.Lock()
+	defer st.latenciesMu.Unlock()
+	sort.Slice(st.latencies, func(i, j int) bool { return st.latencies[i] < st.latencies[j] })
+
+	expected, received := st.expected.Load(), st.received.Load()
+	dropped := 0.0
+	if expected > 0 && received < expected {
+		dropped = 100 * float64(expected-received) / float64(expected)
+	}
+
+	fmt.Fprintf(out, "\nclients     %d connected to %d rooms, %d failed to connect, %d disconnected\n",
+		connected, numRooms, st.failed.Load(), st.disconnected.Load())
+	fmt.Fprintf(out, "messages    %d sent, %d rejected by the server\n", st.sent.Load(), st.rejected.Load())
+	fmt.Fprintf(out, "deliveries  %d of %d, %.2f%% dropped\n", received, expected, dropped)
+	if len(st.latencies) == 0 {
+		return
+	}
+	fmt.Fprintf(out, "latency     p50 %s  p90 %s  p99 %s  max %s\n",
+		percentile(st.latencies, 50).Round(time.Microsecond),
+		percentile(st.latencies, 90).Round(time.Microsecond),
+		percentile(st.latencies, 99).Round(time.Microsecond),
+		st.latencies[len(st.latencies)-1].Round(time.Microsecond))
+}
@@ -0,0 +1,463 @@
+// Command neartalk-cli is a terminal client for NearTalk. It connects to a
+// server using the JSON protocol and shows the chat line by line, so it works
+// over SSH and on machines without a browser.
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/makeworld-the-better-one/neartalk/client"
+	"github.com/makeworld-the-better-one/neartalk/events"
+)
+
+const prompt = "> "
+
+// ANSI escape codes
+const (
+	clearLine   = "\r\033[K"
+	clearScreen = "\033[H\033[2J"
+	bold        = "\033[1m"
+	dim         = "\033[2m"
+	red         = "\033[31m"
+	reset       = "\033[0m"
+)
+
+var (
+	nickFlag  string
+	notifyArg string
+	noColor   bool
+	roomFlag  string
+)
+
+func main() {
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [flags] <server URL>\n\nFlags:\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.StringVar(&nickFlag, "nick", "", "Nickname to use after connecting")
+	flag.StringVar(&notifyArg, "notify", "mention", "When to ring the terminal bell: mention (of @your-nick), all, or none")
+	flag.BoolVar(&noColor, "no-color", false, "Don't use colors or bold text")
+	flag.StringVar(&roomFlag, "room", "", "Named room to join, instead of the room for your IP address")
+	flag.Parse()
+
+	if flag.NArg() != 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	switch notifyArg {
+	case "mention", "all", "none":
+	default:
+		fmt.Fprintf(os.Stderr, "invalid -notify value %q\n", notifyArg)
+		os.Exit(2)
+	}
+
+	if err := run(flag.Arg(0)); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+func run(serverURL string) error {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	c, err := client.Dial(ctx, serverURL, &client.Options{Room: roomFlag})
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	t := &term{c: c, out: os.Stdout}
+	if nickFlag != "" {
+		if err := c.SetNick(ctx, nickFlag); err != nil {
+			return err
+		}
+	}
+
+	lines := make(chan string)
+	go readLines(os.Stdin, lines)
+
+	for {
+		select {
+		case e, ok := <-c.Events():
+			if !ok {
+				t.clearPrompt()
+				if err := c.Err(); err != nil && !errors.Is(err, client.ErrClosed) {
+					return fmt.Errorf("disconnected: %w", err)
+				}
+				return nil
+			}
+			t.handleEvent(e)
+		case line, ok := <-lines:
+			if !ok {
+				// stdin closed
+				return nil
+			}
+			if quit := t.handleInput(ctx, line); quit {
+				return nil
+			}
+		case <-ctx.Done():
+			t.clearPrompt()
+			return nil
+		}
+		t.showPrompt()
+	}
+}
+
+// readLines sends each line of r on ch, and closes ch at EOF. A line ending
+// with a backslash continues on the next one, so messages can have several
+// lines.
+func readLines(r io.Reader, ch chan<- string) {
+	s := bufio.NewScanner(r)
+	var cont []string
+	for s.Scan() {
+		if line, ok := strings.CutSuffix(s.Text(), "\\"); ok {
+			cont = append(cont, line)
+			continue
+		}
+		ch <- strings.Join(append(cont, s.Text()), "\n")
+		cont = nil
+	}
+	if len(cont) > 0 {
+		ch <- strings.Join(cont, "\n")
+	}
+	close(ch)
+}
+
+// term holds the state of the terminal UI.
+type term struct {
+	c   *client.Client
+	out io.Writer
+
+	room  string
+	nick  string
+	users events.UserList
+
+	// prompted is true if the prompt is the last thing on the screen
+	prompted bool
+
+	// Message IDs are long, so messages are shown with short numbers
+	// instead. msgIDs holds the ID for each number, minus one.
+	msgIDs  []string
+	msgNums map[string]int
+}
+
+// msgNum returns the short number for a message ID, giving it one if it
+// doesn't have one yet.
+func (t *term) msgNum(id string) int {
+	if n, ok := t.msgNums[id]; ok {
+		return n
+	}
+	if t.msgNums == nil {
+		t.msgNums = make(map[string]int)
+	}
+	t.msgIDs = append(t.msgIDs, id)
+	t.msgNums[id] = len(t.msgIDs)
+	return len(t.msgIDs)
+}
+
+// msgID returns the message ID for a short number typed by the user, like
+// "3" or "#3". Anything else is returned as is, so full IDs work too.
+func (t *term) msgID(num string) string {
+	n, err := strconv.Atoi(strings.TrimPrefix(num, "#"))
+	if err != nil || n < 1 || n > len(t.msgIDs) {
+		return num
+	}
+	return t.msgIDs[n-1]
+}
+
+// style wraps s in the given ANSI codes, unless colors are disabled.
+func style(codes, s string) string {
+	if noColor {
+		return s
+	}
+	return codes + s + reset
+}
+
+func (t *term) clearPrompt() {
+	if t.prompted && !noColor {
+		fmt.Fprint(t.out, clearLine)
+	}
+	t.prompted = false
+}
+
+func (t *term) showPrompt() {
+	if !t.prompted {
+		fmt.Fprint(t.out, prompt)
+		t.prompted = true
+	}
+}
+
+// printf prints a line of output, over the top of the prompt.
+func (t *term) printf(format string, a ...interface{}) {
+	t.clearPrompt()
+	fmt.Fprintf(t.out, format+"\n", a...)
+}
+
+// info prints a line that isn't a chat message, like a join or notice.
+func (t *term) info(when time.Time, format string, a ...interface{}) {
+	t.printf("%s %s", timestamp(when), style(dim, "-- "+fmt.Sprintf(format, a...)))
+}
+
+func timestamp(when time.Time) string {
+	if when.IsZero() {
+		when = time.Now()
+	}
+	return when.Local().Format("15:04")
+}
+
+// bell rings the terminal bell.
+func (t *term) bell() {
+	fmt.Fprint(t.out, "\a")
+}
+
+func (t *term) handleEvent(e *events.Envelope) {
+	switch e.Type {
+	case events.TypeRoom:
+		var r events.Room
+		if e.Decode(&r) != nil {
+			return
+		}
+		if r.Name == t.room && r.Nick == t.nick {
+			// Sent again once the room's network is found
+			if r.Network != "" {
+				t.info(time.Time{}, "Network: %s", r.Network)
+			}
+			return
+		}
+		t.room, t.nick = r.Name, r.Nick
+		t.printf("Connected to room %s as %s. Type /help for commands.", style(bold, r.Name), style(bold, r.Nick))
+		if r.Network != "" {
+			t.info(time.Time{}, "Network: %s", r.Network)
+		}
+		if r.Topic != "" {
+			t.info(time.Time{}, "Topic: %s", r.Topic)
+		}
+
+	case events.TypeMessage, events.TypeEdit:
+		var m events.Message
+		if e.Decode(&m) != nil {
+			return
+		}
+		t.printMessage(&m, e.Type == events.TypeEdit)
+		if !m.Self && e.Type == events.TypeMessage && notifyArg == "all" {
+			t.bell()
+		}
+
+	case events.TypeEncrypted:
+		// Only the web UI can decrypt these
+		var en events.Encrypted
+		if e.Decode(&en) != nil {
+			return
+		}
+		t.printMessage(&events.Message{
+			ID: en.ID, Nick: en.Nick, Text: style(dim, "(encrypted message)"), Self: en.Self, Time: en.Time,
+		}, false)
+
+	case events.TypeMention:
+		// Sent right after the message that mentions the user
+		if notifyArg == "mention" {
+			t.bell()
+		}
+
+	case events.TypeDelete:
+		var d events.Delete
+		if e.Decode(&d) != nil {
+			return
+		}
+		t.info(time.Time{}, "message #%d was deleted", t.msgNum(d.ID))
+
+	case events.TypeJoin:
+		var j events.Join
+		if e.Decode(&j) != nil {
+			return
+		}
+		t.info(j.Time, "%s joined", j.Nick)
+
+	case events.TypeLeave:
+		var l events.Leave
+		if e.Decode(&l) != nil {
+			return
+		}
+		t.info(l.Time, "%s left", l.Nick)
+
+	case events.TypeNick:
+		var n events.NickChange
+		if e.Decode(&n) != nil {
+			return
+		}
+		if n.Old == t.nick {
+			t.nick = n.New
+		}
+		t.info(n.Time, "%s is now %s", n.Old, n.New)
+
+	case events.TypeUsers:
+		// Only shown on request with /users, there's one after every join
+		var u events.UserList
+		if e.Decode(&u) != nil {
+			return
+		}
+		t.users = u
+
+	case events.TypeNotice:
+		var n events.Notice
+		if e.Decode(&n) != nil {
+			return
+		}
+		t.info(n.Time, "%s", n.Text)
+
+	case events.TypeMOTD:
+		var m events.MOTD
+		if e.Decode(&m) != nil {
+			return
+		}
+		t.info(m.Time, "Message of the day: %s", m.Text)
+
+	case events.TypeClear:
+		var c events.Clear
+		if e.Decode(&c) != nil {
+			return
+		}
+		if c.Self {
+			if noColor {
+				t.info(c.Time, "Cleared your chat")
+			} else {
+				t.clearPrompt()
+				fmt.Fprint(t.out, clearScreen)
+			}
+			return
+		}
+		t.info(c.Time, "%s cleared the chat, earlier messages are gone for everyone else", c.Nick)
+
+	case events.TypeError:
+		var er events.Error
+		if e.Decode(&er) != nil {
+			return
+		}
+		t.printf("%s", style(red, "error: "+er.Text))
+	}
+}
+
+func (t *term) printMessage(m *events.Message, edit bool) {
+	var b strings.Builder
+	b.WriteString(timestamp(m.Time))
+	b.WriteString(" ")
+	b.WriteString(style(dim, fmt.Sprintf("#%d", t.msgNum(m.ID))))
+	b.WriteString(" ")
+	if m.Self {
+		b.WriteString(style(bold, "<"+m.Nick+">"))
+	} else {
+		b.WriteString("<" + m.Nick + ">")
+	}
+	if m.ReplyTo != "" {
+		b.WriteString(style(dim, fmt.Sprintf(" (re #%d)", t.msgNum(m.ReplyTo))))
+	}
+	b.WriteString(" ")
+	// Indent the lines after the first, so they stand out from other messages
+	b.WriteString(strings.ReplaceAll(m.Text, "\n", "\n    "))
+	if edit {
+		b.WriteString(style(dim, " (edited)"))
+	}
+	t.printf("%s", b.String())
+}
+
+const helpText = `Commands handled by neartalk-cli:
+  /users              Show who is in the room
+  /reply <num> <text> Reply to the message with that number
+  /quit               Disconnect and exit
+  /help               Show this help
+Everything else is sent to the server, including its commands like
+/nick <name>, /whois <nick>, /clear, /edit <num> <text>, and /delete <num>. End a line
+with \ to continue the message on the next line.`
+
+// handleInput handles a line the user typed. It returns true if the program
+// should exit.
+func (t *term) handleInput(ctx context.Context, line string) bool {
+	line = strings.TrimSpace(line)
+	if line == "" {
+		return false
+	}
+	cmd, arg := line, ""
+	if i := strings.IndexByte(line, ' '); i != -1 {
+		cmd, arg = line[:i], strings.TrimSpace(line[i+1:])
+	}
+
+	var err error
+	switch cmd {
+	case "/quit", "/exit":
+		return true
+	case "/help":
+		t.printf("%s", helpText)
+	case "/users":
+		t.printUsers()
+	case "/reply":
+		id, text := arg, ""
+		if i := strings.IndexByte(arg, ' '); i != -1 {
+			id, text = arg[:i], strings.TrimSpace(arg[i+1:])
+		}
+		if id == "" || text == "" {
+			t.printf("%s", style(red, "usage: /reply <number> <text>"))
+			return false
+		}
+		err = t.c.Reply(ctx, t.msgID(id), text)
+	case "/edit", "/delete":
+		// Translate the message number into the ID the server knows
+		parts := strings.SplitN(arg, " ", 2)
+		parts[0] = t.msgID(parts[0])
+		err = t.c.SendMessage(ctx, cmd+" "+strings.Join(parts, " "))
+	default:
+		err = t.c.SendMessage(ctx, line)
+	}
+	if err != nil {
+		t.printf("%s", style(red, "error: "+err.Error()))
+	}
+	return false
+}
+
+func (t *term) printUsers() {
+	idle := make(map[string]bool, len(t.users.Idle))
+	for _, nick := range t.users.Idle {
+		idle[nick] = true
+	}
+	mods := make(map[string]bool, len(t.users.Mods))
+	for _, nick := range t.users.Mods {
+		mods[nick] = true
+	}
+	guests := make(map[string]bool, len(t.users.Guests))
+	for _, nick := range t.users.Guests {
+		guests[nick] = true
+	}
+	nicks := make([]string, len(t.users.Nicks))
+	copy(nicks, t.users.Nicks)
+	sort.Strings(nicks)
+	for i, nick := range nicks {
+		if mods[nick] {
+			nicks[i] += " (mod)"
+		}
+		if guests[nick] {
+			nicks[i] += " (guest)"
+		}
+		if reason, ok := t.users.Away[nick]; ok {
+			if reason == "" {
+				nicks[i] = style(dim, nicks[i]+" (away)")
+			} else {
+				nicks[i] = style(dim, nicks[i]+" (away: "+reason+")")
+			}
+		} else if idle[nick] {
+			nicks[i] = style(dim, nicks[i]+" (idle)")
+		}
+	}
+	t.printf("%d in %s: %s", len(nicks), t.room, strings.Join(nicks, ", "))
+}
@@ -0,0 +1,371 @@
+package main
+
+// This file handles the config file, which holds the settings that can be
+// changed while NearTalk is running: rate limits, the word filter, banned IPs,
+// the message of the day, scheduled announcements, the Web Push key, the
+// wordlists for random nicknames, who can change room topics, the
+// proof-of-work challenge for connecting, spam detection, the link policy,
+// access logging, IRC and Matrix bridges, the XMPP gateway, Slack and Discord
+// webhooks, room aliases, and the rooms for LAN mode. It's a JSON file given
+// with -config, like:
+//
+//	{
+//	    "message_rate": 10,
+//	    "message_burst": 8,
+//	    "accept_rate": 20,
+//	    "accept_burst": 100,
+//	    "bot_rate": 1,
+//	    "bot_burst": 5,
+//	    "word_filter": ["badword"],
+//	    "banned_ips": ["203.0.113.7", "198.51.100.0/24"],
+//	    "motd": "Welcome! Be nice.",
+//	    "announcements": [{"schedule": "0 18 * * 5", "text": "Happy Friday!"}],
+//	    "vapid_private_key": "...",
+//	    "vapid_subject": "mailto:admin@example.com",
+//	    "nickname_lists": ["colors.txt", "fruits.txt"],
+//	    "topic_mods_only": true,
+//	    "challenge_difficulty": 16,
+//	    "spam_filter": {"mute": "10m", "repeats": 4, "burst": 8, "window": "10s", "max_links": 4},
+//	    "link_policy": "hold",
+//	    "link_allow": ["example.com"],
+//	    "link_deny": ["bad.example"],
+//	    "access_log": {"sample": 0.1, "exclude": ["/stats"]},
+//	    "irc_bridges": [{"room": "203.0.113.5", "server": "irc.libera.chat:6697", "tls": true, "channel": "#example"}],
+//	    "matrix_bridges": [{"room": "lan", "homeserver": "https://matrix.org", "access_token": "...", "matrix_room": "#example:matrix.org"}],
+//	    "xmpp_gateway": {"server": "localhost:5347", "domain": "chat.example.com", "secret": "...", "rooms": {"lan": "lan"}},
+//	    "webhooks": [{"room": "203.0.113.5", "url": "https://hooks.slack.com/services/..."}],
+//	    "room_aliases": [{"name": "University", "subnets": ["203.0.113.0/24"]}],
+//	    "lan_rooms": [{"name": "Ground floor", "subnets": ["192.168.10.0/24"]}]
+//	}
+//
+// Every field is optional, and the rate limits and MOTD default to their flags.
+// Sending NearTalk SIGHUP reads the file again. The new config replaces the
+// old one all at once, so nothing ever sees half of each, and nobody is
+// disconnected. If the file is invalid, the old config is kept.
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"regexp"
+	"strings"
+	"sync/atomic"
+
+	"golang.org/x/time/rate"
+)
+
+const (
+	// defaultMessageRate is how many messages per second each room handles.
+	defaultMessageRate = 10
+	// defaultMessageBurst is how many messages a room handles at once before
+	// defaultMessageRate applies.
+	defaultMessageBurst = 8
+)
+
+// configFile holds the config file as it's written.
+type configFile struct {
+	MessageRate  float64  `json:"message_rate"`
+	MessageBurst int      `json:"message_burst"`
+	AcceptRate   float64  `json:"accept_rate"`
+	AcceptBurst  int      `json:"accept_burst"`
+	BotRate      float64  `json:"bot_rate"`
+	BotBurst     int      `json:"bot_burst"`
+	WordFilter   []string `json:"word_filter"`
+	BannedIPs    []string `json:"banned_ips"`
+	MOTD         string   `json:"motd"`
+	// Announcements are scheduled announcements, see announce.go.
+	Announcements []configAnnouncement `json:"announcements"`
+	// VAPIDPrivateKey and VAPIDSubject enable Web Push notifications, see
+	// webpush.go. The subject is a mailto: or https: URL push services can
+	// use to contact the operator.
+	VAPIDPrivateKey string `json:"vapid_private_key"`
+	VAPIDSubject    string `json:"vapid_subject"`
+	// NicknameLists are the wordlist files random nicknames are made from,
+	// see nicknames.go. The defaults are used if it's empty.
+	NicknameLists []string `json:"nickname_lists"`
+	// TopicModsOnly only lets moderators change room topics, see topic.go.
+	TopicModsOnly bool `json:"topic_mods_only"`
+	// ChallengeDifficulty is how many leading zero bits the proof-of-work
+	// challenge asks for, or 0 for no challenge. See challenge.go.
+	ChallengeDifficulty int `json:"challenge_difficulty"`
+	// LinkPolicy is what happens to links in messages, and LinkAllow and
+	// LinkDeny are domains that are always or never allowed. See
+	// linkpolicy.go.
+	LinkPolicy string   `json:"link_policy"`
+	LinkAllow  []string `json:"link_allow"`
+	LinkDeny   []string `json:"link_deny"`
+	// SpamFilter turns on spam detection, see spam.go.
+	SpamFilter *configSpamFilter `json:"spam_filter"`
+	// AccessLog turns on logging HTTP requests, see accesslog.go.
+	AccessLog *configAccessLog `json:"access_log"`
+	// IRCBridges relay messages between rooms and IRC channels, see irc.go.
+	IRCBridges []configIRCBridge `json:"irc_bridges"`
+	// MatrixBridges mirror rooms into Matrix rooms, see matrix.go.
+	MatrixBridges []configMatrixBridge `json:"matrix_bridges"`
+	// XMPPGateway exposes rooms as XMPP multi-user chats, see xmpp.go.
+	XMPPGateway *configXMPPGateway `json:"xmpp_gateway"`
+	// Webhooks mirror rooms into Slack or Discord channels, see webhook.go.
+	Webhooks []configWebhook `json:"webhooks"`
+	// RoomAliases put the people from sets of addresses in one room, see
+	// alias.go.
+	RoomAliases []configRoomAlias `json:"room_aliases"`
+	// LANRooms give subnets rooms of their own in LAN mode, see lanmode.go.
+	LANRooms []configLANRoom `json:"lan_rooms"`
+}
+
+// config is the config in use, ready to be used. It must not be changed once
+// it's made, a new one replaces it instead.
+type config struct {
+	configFile
+	// wordFilter matches the filtered words, or is nil if there are none.
+	wordFilter *regexp.Regexp
+	// bannedNets holds the banned IPs and networks.
+	bannedNets []*net.IPNet
+	// announcements holds the parsed Announcements.
+	announcements []*announcement
+	// vapid is the parsed VAPIDPrivateKey, or nil if Web Push is disabled.
+	vapid *vapidKey
+	// nickLists holds the words in the NicknameLists files.
+	nickLists [][]string
+	// spam is the parsed SpamFilter, or nil if spam detection is off.
+	spam *spamFilter
+	// accessLog is the parsed AccessLog, or nil if requests aren't logged.
+	accessLog *accessLog
+	// roomAliases holds the parsed RoomAliases.
+	roomAliases []roomAlias
+	// lanRooms holds the parsed LANRooms.
+	lanRooms []lanRoom
+}
+
+// liveConfig is the config in use. It's nil until loadConfig is called.
+var liveConfig atomic.Pointer[config]
+
+// currentConfig returns the config in use.
+func currentConfig() *config {
+	if c := liveConfig.Load(); c != nil {
+		return c
+	}
+	c, _ := parseConfig(nil)
+	return c
+}
+
+// parseConfig parses the config file contents. The rate limits not in the
+// file come from the flags. If b is nil, the config is just the flags.
+func parseConfig(b []byte) (*config, error) {
+	cf := configFile{
+		MessageRate:  defaultMessageRate,
+		MessageBurst: defaultMessageBurst,
+		AcceptRate:   acceptRate,
+		AcceptBurst:  int(acceptBurst),
+		BotRate:      botRate,
+		BotBurst:     int(botBurst),
+		MOTD:         motdFlag,
+	}
+	if b != nil {
+		if err := json.Unmarshal(b, &cf); err != nil {
+			return nil, err
+		}
+	}
+	if len(cf.MOTD) > maxMOTDLen {
+		return nil, fmt.Errorf("motd can be at most %d bytes long", maxMOTDLen)
+	}
+	if cf.ChallengeDifficulty < 0 || cf.ChallengeDifficulty > maxChallengeDifficulty {
+		return nil, fmt.Errorf("challenge_difficulty must be from 0 to %d", maxChallengeDifficulty)
+	}
+	if err := validateLinkPolicy(cf); err != nil {
+		return nil, err
+	}
+	if cf.MessageRate <= 0 || cf.BotRate < 0 || cf.MessageBurst < 1 || cf.BotBurst < 0 || cf.AcceptBurst < 0 {
+		return nil, errors.New("message_rate and message_burst must be positive, and the other limits can't be negative")
+	}
+
+	c := &config{configFile: cf}
+	var words []string
+	for _, w := range cf.WordFilter {
+		if w = strings.TrimSpace(w); w != "" {
+			words = append(words, regexp.QuoteMeta(w))
+		}
+	}
+	if len(words) > 0 {
+		c.wordFilter = regexp.MustCompile(`(?i)\b(` + strings.Join(words, "|") + `)\b`)
+	}
+	for _, s := range cf.BannedIPs {
+		if !strings.Contains(s, "/") {
+			ip := net.ParseIP(s)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid banned IP %q", s)
+			}
+			bits := 8 * net.IPv6len
+			if ip4 := ip.To4(); ip4 != nil {
+				ip, bits = ip4, 8*net.IPv4len
+			}
+			c.bannedNets = append(c.bannedNets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, n, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid banned network %q", s)
+		}
+		c.bannedNets = append(c.bannedNets, n)
+	}
+	for i, ca := range cf.Announcements {
+		an, err := newAnnouncement(ca)
+		if err != nil {
+			return nil, fmt.Errorf("announcement %d: %w", i+1, err)
+		}
+		c.announcements = append(c.announcements, an)
+	}
+	if cf.VAPIDPrivateKey != "" {
+		if !strings.HasPrefix(cf.VAPIDSubject, "mailto:") && !strings.HasPrefix(cf.VAPIDSubject, "https://") {
+			return nil, errors.New("vapid_subject must be a mailto: or https:// URL")
+		}
+		var err error
+		if c.vapid, err = parseVAPIDKey(cf.VAPIDPrivateKey); err != nil {
+			return nil, err
+		}
+	}
+	if cf.SpamFilter != nil {
+		var err error
+		if c.spam, err = parseSpamFilter(*cf.SpamFilter); err != nil {
+			return nil, err
+		}
+	}
+	if cf.AccessLog != nil {
+		var err error
+		if c.accessLog, err = parseAccessLog(*cf.AccessLog); err != nil {
+			return nil, err
+		}
+	}
+	if len(cf.RoomAliases) > 0 {
+		var err error
+		if c.roomAliases, err = parseRoomAliases(cf.RoomAliases); err != nil {
+			return nil, err
+		}
+	}
+	if len(cf.LANRooms) > 0 {
+		var err error
+		if c.lanRooms, err = parseLANRooms(cf.LANRooms); err != nil {
+			return nil, err
+		}
+	}
+	if err := validateIRCBridges(cf.IRCBridges); err != nil {
+		return nil, err
+	}
+	if err := validateMatrixBridges(cf.MatrixBridges); err != nil {
+		return nil, err
+	}
+	if err := validateXMPPGateway(cf.XMPPGateway); err != nil {
+		return nil, err
+	}
+	if err := validateWebhooks(cf.Webhooks); err != nil {
+		return nil, err
+	}
+	if len(cf.NicknameLists) > 0 {
+		var err error
+		if c.nickLists, err = loadNickLists(cf.NicknameLists); err != nil {
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+// newRoomLimiter returns the rate limiter for a room's messages.
+func newRoomLimiter() *rate.Limiter {
+	c := currentConfig()
+	return rate.NewLimiter(rate.Limit(c.MessageRate), c.MessageBurst)
+}
+
+// readConfigFile reads and parses the config file at path. An empty path
+// means there is no config file.
+func readConfigFile(path string) (*config, error) {
+	if path == "" {
+		return parseConfig(nil)
+	}
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	c, err := parseConfig(b)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return c, nil
+}
+
+// loadConfig reads the -config file and puts it in use.
+func (cs *chatServer) loadConfig() error {
+	c, err := readConfigFile(configPath)
+	if err != nil {
+		return err
+	}
+	old := liveConfig.Swap(c)
+	cs.applyConfig(c)
+	if motdChanged(old, c) {
+		cs.setMOTD(c.MOTD)
+	}
+	cs.announcer.setConfigured(c.announcements)
+	cs.irc.setConfigured(c.IRCBridges)
+	cs.matrix.setConfigured(c.MatrixBridges)
+	cs.xmpp.setConfigured(c.XMPPGateway)
+	cs.webhooks.setConfigured(c.Webhooks)
+	return nil
+}
+
+// applyConfig updates the rate limiters already made to match the config.
+func (cs *chatServer) applyConfig(c *config) {
+	if cs.accepts != nil {
+		cs.accepts.SetLimit(acceptLimit(c.AcceptRate))
+		cs.accepts.SetBurst(acceptBurstOf(c.AcceptBurst))
+	}
+
+	cs.roomsMu.Lock()
+	defer cs.roomsMu.Unlock()
+	for _, room := range cs.rooms {
+		room.limiter.SetLimit(rate.Limit(c.MessageRate))
+		room.limiter.SetBurst(c.MessageBurst)
+		room.clientsMu.Lock()
+		for cl := range room.clients {
+			if cl.limiter != nil {
+				cl.limiter.SetLimit(rate.Limit(c.BotRate))
+				cl.limiter.SetBurst(c.BotBurst)
+			}
+		}
+		room.clientsMu.Unlock()
+	}
+}
+
+// reloadConfig reads the -config file again, keeping the old config if it's
+// invalid.
+func (cs *chatServer) reloadConfig() {
+	if err := cs.loadConfig(); err != nil {
+		log.Printf("reloading config, keeping the old one: %v", err)
+		return
+	}
+	log.Printf("reloaded config from %s", configPath)
+}
+
+// filterWords replaces the filtered words in the text with asterisks.
+func (c *config) filterWords(text string) string {
+	if c.wordFilter == nil {
+		return text
+	}
+	return c.wordFilter.ReplaceAllStringFunc(text, func(w string) string {
+		return strings.Repeat("*", len([]rune(w)))
+	})
+}
+
+// isBanned returns true if the IP is banned.
+func (c *config) isBanned(ip net.IP) bool {
+	if ip == nil {
+		return false
+	}
+	for _, n := range c.bannedNets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"net"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestParseConfig(t *testing.T) {
+	c, err := parseConfig([]byte(`{"message_rate": 2, "word_filter": ["darn", "a.b"], "banned_ips": ["203.0.113.7", "198.51.100.0/24", "2001:db8::/32"]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.MessageRate != 2 || c.MessageBurst != defaultMessageBurst {
+		t.Errorf("message limits = %v, %d", c.MessageRate, c.MessageBurst)
+	}
+
+	for text, want := range map[string]string{
+		"oh darn it":     "oh **** it",
+		"DARN":           "****",
+		"darnit":         "darnit",
+		"a.b and axb":    "*** and axb",
+		"nothing to see": "nothing to see",
+	} {
+		if got := c.filterWords(text); got != want {
+			t.Errorf("filterWords(%q) = %q, want %q", text, got, want)
+		}
+	}
+
+	for ip, want := range map[string]bool{
+		"203.0.113.7":        true,
+		"203.0.113.8":        false,
+		"198.51.100.200":     true,
+		"::ffff:203.0.113.7": true,
+		"2001:db8::1":        true,
+		"2001:db9::1":        false,
+	} {
+		if got := c.isBanned(net.ParseIP(ip)); got != want {
+			t.Errorf("isBanned(%s) = %v, want %v", ip, got, want)
+		}
+	}
+
+	for _, bad := range []string{
+		`{"banned_ips": ["nope"]}`,
+		`{"banned_ips": ["1.2.3.4/99"]}`,
+		`{"message_rate": 0}`,
+		`{"message_rate": "fast"}`,
+	} {
+		if _, err := parseConfig([]byte(bad)); err == nil {
+			t.Errorf("parseConfig(%s) worked", bad)
+		}
+	}
+}
+
+func TestReloadConfig(t *testing.T) {
+	defer func(p string, c *config) { configPath = p; liveConfig.Store(c) }(configPath, liveConfig.Load())
+	configPath = filepath.Join(t.TempDir(), "config.json")
+	if err := os.WriteFile(configPath, []byte(`{"message_rate": 5}`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	cs := newChatServer(nil)
+	if err := cs.loadConfig(); err != nil {
+		t.Fatal(err)
+	}
+	room := newChatRoom(cs, "test")
+	defer room.close(roomEmpty)
+	cs.rooms["test"] = room
+	if room.limiter.Limit() != 5 {
+		t.Errorf("room limit = %v, want 5", room.limiter.Limit())
+	}
+
+	if err := os.WriteFile(configPath, []byte(`{"message_rate": 20, "banned_ips": ["203.0.113.7"]}`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	cs.reloadConfig()
+	if room.limiter.Limit() != 20 {
+		t.Errorf("room limit after reload = %v, want 20", room.limiter.Limit())
+	}
+	r := httptest.NewRequest("GET", "/", nil)
+	r.RemoteAddr = "203.0.113.7:1234"
+	w := httptest.NewRecorder()
+	cs.ServeHTTP(w, r)
+	if w.Code != 403 {
+		t.Errorf("banned IP got status %d, want 403", w.Code)
+	}
+
+	// An invalid config is ignored
+	if err := os.WriteFile(configPath, []byte(`{`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	cs.reloadConfig()
+	if room.limiter.Limit() != 20 || !currentConfig().isBanned(net.ParseIP("203.0.113.7")) {
+		t.Error("invalid config replaced the old one")
+	}
+}
+
+func TestConfigNicknameLists(t *testing.T) {
+	defer liveConfig.Store(liveConfig.Load())
+	dir := t.TempDir()
+	colors := filepath.Join(dir, "colors.txt")
+	fruits := filepath.Join(dir, "fruits.txt")
+	bad := filepath.Join(dir, "bad.txt")
+	os.WriteFile(colors, []byte("# Colors\nteal\n\n"), 0o600)
+	os.WriteFile(fruits, []byte("mango\n"), 0o600)
+	os.WriteFile(bad, []byte("two words\n"), 0o600)
+
+	c, err := parseConfig([]byte(`{"nickname_lists": ["` + colors + `", "` + fruits + `"]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	liveConfig.Store(c)
+	if got := genNick(); got != "TealMango" {
+		t.Errorf("genNick() = %q, want TealMango", got)
+	}
+
+	for _, lists := range []string{
+		`["` + bad + `"]`,
+		`["` + filepath.Join(dir, "missing.txt") + `"]`,
+		`["` + colors + `", "` + colors + `", "` + colors + `", "` + colors + `", "` + colors + `"]`,
+	} {
+		if _, err := parseConfig([]byte(`{"nickname_lists": ` + lists + `}`)); err == nil {
+			t.Errorf("nickname_lists %s worked", lists)
+		}
+	}
+}
@@ -0,0 +1,99 @@
+package main
+
+// This file limits how many clients can be connected at once, in total with
+// -max-clients and from each IP address with -max-clients-per-ip, so opening
+// lots of connections can't run a small server out of memory or file
+// descriptors. Bots don't count towards the limit for their address, since
+// they're usually all run from the same machine. When several instances
+// share Redis, each one has its own limits.
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+)
+
+var (
+	errServerFull      = errors.New("too many clients connected")
+	errTooManyFromAddr = errors.New("too many clients connected from this address")
+)
+
+// connCounter counts the connected clients, in total and by address. The
+// zero value is ready to use.
+type connCounter struct {
+	mu     sync.Mutex
+	total  uint
+	byAddr map[string]uint
+}
+
+// acquire counts a new client from the address, or returns errServerFull or
+// errTooManyFromAddr if that would go over a limit. Bots are only counted in
+// the total. Every successful call must be matched by a call to release.
+func (cc *connCounter) acquire(addr string, bot bool) error {
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+
+	if maxClients != 0 && cc.total >= maxClients {
+		return errServerFull
+	}
+	if !bot {
+		if maxClientsPerIP != 0 && cc.byAddr[addr] >= maxClientsPerIP {
+			return errTooManyFromAddr
+		}
+		if cc.byAddr == nil {
+			cc.byAddr = make(map[string]uint)
+		}
+		cc.byAddr[addr]++
+	}
+	cc.total++
+	return nil
+}
+
+// release stops counting a client counted by acquire.
+func (cc *connCounter) release(addr string, bot bool) {
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+
+	cc.total--
+	if bot {
+		return
+	}
+	cc.byAddr[addr]--
+	if cc.byAddr[addr] == 0 {
+		delete(cc.byAddr, addr)
+	}
+}
+
+// count returns how many clients are connected.
+func (cc *connCounter) count() uint {
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+	return cc.total
+}
+
+// wait waits until no clients are connected, or the context is done.
+func (cc *connCounter) wait(ctx context.Context) error {
+	t := time.NewTicker(10 * time.Millisecond)
+	defer t.Stop()
+	for {
+		if cc.count() == 0 {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-t.C:
+		}
+	}
+}
+
+// connAddr returns the IP address the request came from, for the limits.
+// Unlike the room key, addresses on the LAN are kept apart.
+func connAddr(r *http.Request) string {
+	if ip := clientAddr(r, int(trustedProxies)); ip != nil {
+		return ip.String()
+	}
+	return r.RemoteAddr
+}
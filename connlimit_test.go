@@ -0,0 +1,58 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestConnCounter(t *testing.T) {
+	defer func(total, perIP uint) { maxClients, maxClientsPerIP = total, perIP }(maxClients, maxClientsPerIP)
+	maxClients, maxClientsPerIP = 3, 1
+
+	var cc connCounter
+	if err := cc.acquire("203.0.113.1", false); err != nil {
+		t.Fatal(err)
+	}
+	if err := cc.acquire("203.0.113.1", false); !errors.Is(err, errTooManyFromAddr) {
+		t.Errorf("second client from the address: %v, want errTooManyFromAddr", err)
+	}
+	// Bots only count towards the total
+	if err := cc.acquire("203.0.113.1", true); err != nil {
+		t.Fatal(err)
+	}
+	if err := cc.acquire("203.0.113.2", false); err != nil {
+		t.Fatal(err)
+	}
+	if err := cc.acquire("203.0.113.3", false); !errors.Is(err, errServerFull) {
+		t.Errorf("client over the total: %v, want errServerFull", err)
+	}
+
+	cc.release("203.0.113.1", false)
+	if err := cc.acquire("203.0.113.1", false); err != nil {
+		t.Errorf("client after release: %v", err)
+	}
+	if len(cc.byAddr) != 2 {
+		t.Errorf("counting %d addresses, want 2", len(cc.byAddr))
+	}
+}
+
+func TestConnCounterWait(t *testing.T) {
+	var cc connCounter
+	if err := cc.wait(context.Background()); err != nil {
+		t.Errorf("wait with no clients: %v", err)
+	}
+	if err := cc.acquire("203.0.113.1", false); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := cc.wait(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("wait with a client connected: %v, want context.DeadlineExceeded", err)
+	}
+	go cc.release("203.0.113.1", false)
+	if err := cc.wait(context.Background()); err != nil {
+		t.Errorf("wait after release: %v", err)
+	}
+}
@@ -0,0 +1,198 @@
+package data
+
+// Emoji maps shortcodes (without the surrounding colons) to Unicode emoji.
+// It's a hand-picked subset of the shortcodes used by GitHub and Slack.
+var Emoji = map[string]string{
+	"+1":                "👍",
+	"-1":                "👎",
+	"100":               "💯",
+	"alien":             "👽",
+	"angry":             "😠",
+	"apple":             "🍎",
+	"astonished":        "😲",
+	"avocado":           "🥑",
+	"baby":              "👶",
+	"balloon":           "🎈",
+	"banana":            "🍌",
+	"beer":              "🍺",
+	"beers":             "🍻",
+	"bell":              "🔔",
+	"bike":              "🚲",
+	"birthday":          "🎂",
+	"blush":             "😊",
+	"book":              "📖",
+	"boom":              "💥",
+	"bow":               "🙇",
+	"brain":             "🧠",
+	"broken_heart":      "💔",
+	"bug":               "🐛",
+	"bulb":              "💡",
+	"burrito":           "🌯",
+	"bus":               "🚌",
+	"cake":              "🍰",
+	"calendar":          "📆",
+	"camera":            "📷",
+	"car":               "🚗",
+	"cat":               "🐱",
+	"champagne":         "🍾",
+	"check":             "✔️",
+	"cherries":          "🍒",
+	"clap":              "👏",
+	"clock":             "🕒",
+	"cloud":             "☁️",
+	"clown":             "🤡",
+	"coffee":            "☕",
+	"computer":          "💻",
+	"confused":          "😕",
+	"cookie":            "🍪",
+	"cool":              "🆒",
+	"cow":               "🐮",
+	"crab":              "🦀",
+	"cry":               "😢",
+	"crystal_ball":      "🔮",
+	"dancer":            "💃",
+	"disappointed":      "😞",
+	"dizzy":             "💫",
+	"dog":               "🐶",
+	"doughnut":          "🍩",
+	"dragon":            "🐉",
+	"drooling_face":     "🤤",
+	"eyes":              "👀",
+	"eyeroll":           "🙄",
+	"face_with_monocle": "🧐",
+	"facepalm":          "🤦",
+	"fearful":           "😨",
+	"fire":              "🔥",
+	"fireworks":         "🎆",
+	"fish":              "🐟",
+	"fist":              "✊",
+	"flushed":           "😳",
+	"fox":               "🦊",
+	"frog":              "🐸",
+	"frowning":          "😦",
+	"ghost":             "👻",
+	"gift":              "🎁",
+	"grimacing":         "😬",
+	"grin":              "😁",
+	"grinning":          "😀",
+	"guitar":            "🎸",
+	"hamburger":         "🍔",
+	"hammer":            "🔨",
+	"hand":              "✋",
+	"handshake":         "🤝",
+	"headphones":        "🎧",
+	"heart":             "❤️",
+	"heart_eyes":        "😍",
+	"hearts":            "♥️",
+	"hugs":              "🤗",
+	"hundred":           "💯",
+	"hushed":            "😯",
+	"ice_cream":         "🍨",
+	"innocent":          "😇",
+	"joy":               "😂",
+	"key":               "🔑",
+	"kiss":              "💋",
+	"kissing_heart":     "😘",
+	"laughing":          "😆",
+	"lock":              "🔒",
+	"mag":               "🔍",
+	"mask":              "😷",
+	"medal":             "🏅",
+	"money_with_wings":  "💸",
+	"monkey":            "🐒",
+	"moon":              "🌙",
+	"muscle":            "💪",
+	"musical_note":      "🎵",
+	"nerd_face":         "🤓",
+	"neutral_face":      "😐",
+	"no_entry":          "⛔",
+	"no_mouth":          "😶",
+	"ok":                "🆗",
+	"ok_hand":           "👌",
+	"open_mouth":        "😮",
+	"owl":               "🦉",
+	"package":           "📦",
+	"palm_tree":         "🌴",
+	"panda_face":        "🐼",
+	"partying_face":     "🥳",
+	"pencil":            "📝",
+	"penguin":           "🐧",
+	"pensive":           "😔",
+	"phone":             "☎️",
+	"pig":               "🐷",
+	"pizza":             "🍕",
+	"point_down":        "👇",
+	"point_left":        "👈",
+	"point_right":       "👉",
+	"point_up":          "☝️",
+	"poop":              "💩",
+	"popcorn":           "🍿",
+	"pray":              "🙏",
+	"question":          "❓",
+	"rabbit":            "🐰",
+	"rage":              "😡",
+	"rainbow":           "🌈",
+	"raised_hands":      "🙌",
+	"relaxed":           "☺️",
+	"relieved":          "😌",
+	"robot":             "🤖",
+	"rocket":            "🚀",
+	"rofl":              "🤣",
+	"rose":              "🌹",
+	"sandwich":          "🥪",
+	"scream":            "😱",
+	"see_no_evil":       "🙈",
+	"shrug":             "🤷",
+	"skull":             "💀",
+	"sleeping":          "😴",
+	"sleepy":            "😪",
+	"slightly_smiling":  "🙂",
+	"smile":             "😄",
+	"smiley":            "😃",
+	"smirk":             "😏",
+	"snail":             "🐌",
+	"snake":             "🐍",
+	"sneezing_face":     "🤧",
+	"snowflake":         "❄️",
+	"snowman":           "⛄",
+	"sob":               "😭",
+	"soccer":            "⚽",
+	"sparkles":          "✨",
+	"speak_no_evil":     "🙊",
+	"star":              "⭐",
+	"star_struck":       "🤩",
+	"stuck_out_tongue":  "😛",
+	"sun":               "☀️",
+	"sunglasses":        "😎",
+	"sweat":             "😓",
+	"sweat_smile":       "😅",
+	"taco":              "🌮",
+	"tada":              "🎉",
+	"tea":               "🍵",
+	"thinking":          "🤔",
+	"thumbsdown":        "👎",
+	"thumbsup":          "👍",
+	"tired_face":        "😫",
+	"trophy":            "🏆",
+	"turtle":            "🐢",
+	"umbrella":          "☂️",
+	"unamused":          "😒",
+	"unicorn":           "🦄",
+	"upside_down_face":  "🙃",
+	"v":                 "✌️",
+	"warning":           "⚠️",
+	"wave":              "👋",
+	"weary":             "😩",
+	"whale":             "🐳",
+	"wine_glass":        "🍷",
+	"wink":              "😉",
+	"woozy_face":        "🥴",
+	"worried":           "😟",
+	"x":                 "❌",
+	"yawning_face":      "🥱",
+	"yum":               "😋",
+	"zany_face":         "🤪",
+	"zap":               "⚡",
+	"zipper_mouth_face": "🤐",
+	"zzz":               "💤",
+}
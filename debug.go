@@ -0,0 +1,229 @@
+package main
+
+// This file has endpoints for finding out what's wrong with a running server,
+// like leaked goroutines or a room that has stopped handling messages. The
+// net/http/pprof profiles are under /debug/pprof/, and /debug/runtime dumps
+// goroutine counts by the function that started them, and how many messages
+// are waiting for each room and its clients.
+//
+// They're only for admins, either logged in or sending an admin key as a
+// bearer token, so they can be fetched with curl:
+//
+//	curl -H "Authorization: Bearer $KEY" https://neartalk.example.com/debug/pprof/heap > heap.pb.gz
+//
+// Importing net/http/pprof also registers its handlers on
+// http.DefaultServeMux, which NearTalk never serves.
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"log"
+	"net/http"
+	"net/http/pprof"
+	"runtime"
+	rpprof "runtime/pprof"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// debugLockWait is how long /debug/runtime waits for the roomsMu, and
+// debugRoomLockWait for each room's clientsMu, before reporting them as held
+// instead. A mutex that's stuck is one of the things it's for.
+const (
+	debugLockWait     = time.Second
+	debugRoomLockWait = 100 * time.Millisecond
+)
+
+// handleDebug registers the debug endpoints.
+func (cs *chatServer) handleDebug() {
+	cs.serveMux.HandleFunc("/debug/pprof/", noCache(cs.debugOnly(pprof.Index)))
+	cs.serveMux.HandleFunc("/debug/pprof/cmdline", noCache(cs.debugOnly(pprof.Cmdline)))
+	cs.serveMux.HandleFunc("/debug/pprof/profile", noCache(cs.debugOnly(longDebug(pprof.Profile))))
+	cs.serveMux.HandleFunc("/debug/pprof/symbol", noCache(cs.debugOnly(pprof.Symbol)))
+	cs.serveMux.HandleFunc("/debug/pprof/trace", noCache(cs.debugOnly(longDebug(pprof.Trace))))
+	cs.serveMux.HandleFunc("/debug/runtime", noCache(cs.debugOnly(cs.runtimeHandler)))
+}
+
+// debugOnly only lets admins use the handler. Requests can use the admin
+// session cookie, or an admin key as a bearer token.
+func (cs *chatServer) debugOnly(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if cs.isAdmin(r) {
+			next(w, r)
+			return
+		}
+		key, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		if _, ok := cs.adminKeys.lookup(key); !ok {
+			log.Printf("chatServer.debugOnly: wrong key from %s", logAddr(r))
+			// Slow down guessing, like logging in
+			time.Sleep(time.Second)
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		next(w, r)
+	}
+}
+
+// longDebug lets the pprof handlers that take the "seconds" query parameter
+// run for longer than the server's WriteTimeout.
+func longDebug(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		sec, err := strconv.ParseInt(r.FormValue("seconds"), 10, 64)
+		if err != nil || sec <= 0 {
+			// pprof's default
+			sec = 30
+		}
+		http.NewResponseController(w).SetWriteDeadline(time.Now().Add(time.Duration(sec)*time.Second + 10*time.Second))
+		// pprof refuses profiles longer than the WriteTimeout, so tell it
+		// there isn't one
+		ctx := context.WithValue(r.Context(), http.ServerContextKey, &http.Server{})
+		next(w, r.WithContext(ctx))
+	}
+}
+
+// runtimeDump is what /debug/runtime returns, as JSON.
+type runtimeDump struct {
+	Goroutines int `json:"goroutines"`
+	// GoroutinesByFunc counts the goroutines by the function they were
+	// started with.
+	GoroutinesByFunc map[string]int `json:"goroutines_by_func"`
+	HeapBytes        uint64         `json:"heap_bytes"`
+	// Clients is how many clients are connected, see connCounter.
+	Clients uint `json:"clients"`
+	// RoomsLocked is true if the roomsMu was held for longer than
+	// debugLockWait, in which case Rooms is empty.
+	RoomsLocked bool       `json:"rooms_locked,omitempty"`
+	Rooms       []roomDump `json:"rooms"`
+}
+
+// roomDump is a room in a runtimeDump.
+type roomDump struct {
+	Key       string `json:"key"`
+	Clients   int    `json:"clients"`
+	Observers int    `json:"observers"`
+	// Incoming and Members are how many messages, and joins or leaves, are
+	// waiting for the room's goroutine.
+	Incoming int `json:"incoming"`
+	Members  int `json:"members"`
+	// MaxOutgoing is the most frames waiting to be sent to one client, and
+	// TotalOutgoing is how many are waiting for all of them.
+	MaxOutgoing   int       `json:"max_outgoing"`
+	TotalOutgoing int       `json:"total_outgoing"`
+	LastActivity  time.Time `json:"last_activity"`
+	// ClientsLocked is true if the room's clientsMu was held for longer than
+	// debugRoomLockWait, in which case only Incoming and Members are set.
+	ClientsLocked bool `json:"clients_locked,omitempty"`
+}
+
+// runtimeHandler serves the runtime dump.
+func (cs *chatServer) runtimeHandler(w http.ResponseWriter, r *http.Request) {
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+	d := runtimeDump{
+		Goroutines:       runtime.NumGoroutine(),
+		GoroutinesByFunc: goroutinesByFunc(),
+		HeapBytes:        mem.HeapAlloc,
+		Clients:          cs.conns.count(),
+		Rooms:            []roomDump{},
+	}
+	if !tryLock(&cs.roomsMu, debugLockWait) {
+		d.RoomsLocked = true
+		writeJSON(w, http.StatusOK, d)
+		return
+	}
+	rooms := make(map[string]*chatRoom, len(cs.rooms))
+	for key, room := range cs.rooms {
+		rooms[key] = room
+	}
+	cs.roomsMu.Unlock()
+	// Rooms are dumped without holding the roomsMu, so people can still
+	// join while waiting for a stuck room
+	for key, room := range rooms {
+		d.Rooms = append(d.Rooms, room.dump(key))
+	}
+	sort.Slice(d.Rooms, func(i, j int) bool { return d.Rooms[i].Key < d.Rooms[j].Key })
+	writeJSON(w, http.StatusOK, d)
+}
+
+// dump returns the room's part of the runtime dump.
+func (cr *chatRoom) dump(key string) roomDump {
+	d := roomDump{
+		Key:      key,
+		Incoming: len(cr.incoming),
+		Members:  len(cr.members),
+	}
+	if !tryLock(&cr.clientsMu, debugRoomLockWait) {
+		d.ClientsLocked = true
+		return d
+	}
+	defer cr.clientsMu.Unlock()
+	// Like lastActivity, which locks the clientsMu itself
+	d.LastActivity = cr.created
+	if cr.whenLastMsg.After(cr.created) {
+		d.LastActivity = cr.whenLastMsg
+	}
+	d.Clients = len(cr.clients)
+	d.Observers = len(cr.observers)
+	for c := range cr.clients {
+		n := len(c.outgoing)
+		d.TotalOutgoing += n
+		if n > d.MaxOutgoing {
+			d.MaxOutgoing = n
+		}
+	}
+	return d
+}
+
+// tryLock locks the mutex, unless it's held for longer than d, in which case
+// it returns false.
+func tryLock(mu *sync.Mutex, d time.Duration) bool {
+	deadline := time.Now().Add(d)
+	for !mu.TryLock() {
+		if time.Now().After(deadline) {
+			return false
+		}
+		time.Sleep(time.Millisecond)
+	}
+	return true
+}
+
+// goroutinesByFunc counts the running goroutines by the function they were
+// started with, from the goroutine profile.
+func goroutinesByFunc() map[string]int {
+	var buf bytes.Buffer
+	rpprof.Lookup("goroutine").WriteTo(&buf, 1)
+
+	// The profile lists each group of goroutines with the same stack as a
+	// line starting with how many there are, then a line for each frame
+	// starting with "#", with the function they were started with last
+	counts := make(map[string]int)
+	n, fn := 0, ""
+	s := bufio.NewScanner(&buf)
+	for s.Scan() {
+		line := s.Text()
+		if count, _, ok := strings.Cut(line, " @ "); ok {
+			if fn != "" {
+				counts[fn] += n
+			}
+			n, _ = strconv.Atoi(count)
+			fn = ""
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) >= 3 && fields[0] == "#" && strings.HasPrefix(fields[1], "0x") {
+			fn, _, _ = strings.Cut(fields[2], "+0x")
+		}
+	}
+	if fn != "" {
+		counts[fn] += n
+	}
+	return counts
+}
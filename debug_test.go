@@ -0,0 +1,49 @@
+package main
+
+import (
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestGoroutinesByFunc(t *testing.T) {
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := 0; i < 3; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			<-stop
+		}()
+	}
+	defer wg.Wait()
+	defer close(stop)
+
+	n := 0
+	for fn, count := range goroutinesByFunc() {
+		if strings.HasSuffix(fn, ".TestGoroutinesByFunc.func1") {
+			n += count
+		}
+	}
+	if n != 3 {
+		t.Errorf("counted %d goroutines started by the test, want 3", n)
+	}
+}
+
+func TestTryLock(t *testing.T) {
+	var mu sync.Mutex
+	if !tryLock(&mu, time.Millisecond) {
+		t.Fatal("couldn't lock an unlocked mutex")
+	}
+	if tryLock(&mu, 10*time.Millisecond) {
+		t.Error("locked a held mutex")
+	}
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		mu.Unlock()
+	}()
+	if !tryLock(&mu, time.Second) {
+		t.Error("couldn't lock the mutex once it was unlocked")
+	}
+}
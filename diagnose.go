@@ -0,0 +1,118 @@
+package main
+
+// This file helps figure out why someone can't connect. Some networks and
+// proxies block or break websockets, so clients that never finish the
+// handshake on /connect are logged and told about the /diagnose page. That
+// page tests which transports work from the visitor's network, using the
+// small test endpoints below.
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"nhooyr.io/websocket"
+)
+
+// handshakeTimeout is how long a web UI client has after connecting to send
+// its first message. The web UI sends its activity as soon as it gets the
+// room name, so if nothing arrives, frames aren't getting through.
+const handshakeTimeout = 15 * time.Second
+
+// diagnoseHint is shown to clients that seem to have a broken connection.
+const diagnoseHint = "Your connection to the chat doesn't seem to be working properly. " +
+	"Your network might be blocking it, visit /diagnose to find out."
+
+// isWebsocketUpgrade returns true if the request asks to upgrade to a
+// websocket. Proxies that don't support websockets often strip these headers.
+func isWebsocketUpgrade(r *http.Request) bool {
+	return headerHasToken(r.Header.Get("Connection"), "upgrade") &&
+		strings.EqualFold(r.Header.Get("Upgrade"), "websocket")
+}
+
+// headerHasToken returns true if the comma separated header value contains
+// token, ignoring case.
+func headerHasToken(value, token string) bool {
+	for _, t := range strings.Split(value, ",") {
+		if strings.EqualFold(strings.TrimSpace(t), token) {
+			return true
+		}
+	}
+	return false
+}
+
+// notUpgradedHandler responds to a request to /connect that isn't a websocket
+// upgrade, explaining the likely problem.
+func notUpgradedHandler(w http.ResponseWriter, r *http.Request) {
+	log.Printf("connectHandler: request without websocket upgrade (Connection: %q, Upgrade: %q), a proxy may be stripping the headers",
+		r.Header.Get("Connection"), r.Header.Get("Upgrade"))
+	w.Header().Set("Connection", "Upgrade")
+	w.Header().Set("Upgrade", "websocket")
+	http.Error(w, "This endpoint needs a websocket connection, but the request wasn't one. "+
+		"A proxy or firewall between you and the server may be blocking websockets. "+
+		"Visit /diagnose to test your connection.", http.StatusUpgradeRequired)
+}
+
+// diagnoseWSHandler is a websocket echo endpoint for the diagnose page.
+func diagnoseWSHandler(w http.ResponseWriter, r *http.Request) {
+	if !isWebsocketUpgrade(r) {
+		notUpgradedHandler(w, r)
+		return
+	}
+	conn, err := acceptWS(w, r, nil)
+	if err != nil {
+		return
+	}
+	defer conn.Close(websocket.StatusInternalError, "")
+
+	ctx, cancel := context.WithTimeout(r.Context(), 10*time.Second)
+	defer cancel()
+	typ, b, err := conn.Read(ctx)
+	if err != nil {
+		return
+	}
+	if err := conn.Write(ctx, typ, b); err != nil {
+		return
+	}
+	conn.Close(websocket.StatusNormalClosure, "")
+}
+
+// diagnoseSSEHandler sends a Server-Sent Event after a delay, for the diagnose
+// page. Proxies that buffer responses will hold the event back, so the page
+// can tell streaming doesn't work.
+func diagnoseSSEHandler(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming not supported", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	// Tell nginx not to buffer this
+	w.Header().Set("X-Accel-Buffering", "no")
+	fmt.Fprint(w, ": connected\n\n")
+	flusher.Flush()
+
+	select {
+	case <-time.After(time.Second):
+	case <-r.Context().Done():
+		return
+	}
+	fmt.Fprint(w, "event: ok\ndata: ok\n\n")
+	flusher.Flush()
+}
+
+// diagnosePollHandler waits before responding, like a long-poll request with
+// nothing new, for the diagnose page. Proxies with short timeouts will cut it
+// off.
+func diagnosePollHandler(w http.ResponseWriter, r *http.Request) {
+	select {
+	case <-time.After(3 * time.Second):
+	case <-r.Context().Done():
+		return
+	}
+	fmt.Fprint(w, "ok")
+}
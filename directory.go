@@ -0,0 +1,166 @@
+package main
+
+// This file handles the public room directory at /directory. Rooms based on
+// IP addresses are never listed, since that would publish where people are,
+// but named rooms can opt in with the /directory command so others with the
+// same interests can find them. The operator can hide listings from the
+// admin page.
+
+import (
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/makeworld-the-better-one/neartalk/events"
+)
+
+// directoryEntry is a room shown in the directory.
+type directoryEntry struct {
+	Name  string
+	Topic string
+	Users int
+}
+
+// listing returns the directory entry for the room, and whether it should be
+// shown in the directory at all.
+// It holds the client mutex.
+func (cr *chatRoom) listing() (directoryEntry, bool) {
+	cr.clientsMu.Lock()
+	defer cr.clientsMu.Unlock()
+	if cr.name == "" || !cr.listed {
+		return directoryEntry{}, false
+	}
+	return directoryEntry{Name: cr.name, Topic: cr.topic, Users: len(cr.clients)}, true
+}
+
+// directory returns the listed rooms that the operator hasn't hidden, with
+// the busiest rooms first.
+func (cs *chatServer) directory() []directoryEntry {
+	cs.roomsMu.Lock()
+	defer cs.roomsMu.Unlock()
+
+	var entries []directoryEntry
+	for _, room := range cs.rooms {
+		e, ok := room.listing()
+		if ok && !cs.isListingHidden(e.Name) {
+			entries = append(entries, e)
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].Users != entries[j].Users {
+			return entries[i].Users > entries[j].Users
+		}
+		return entries[i].Name < entries[j].Name
+	})
+	return entries
+}
+
+// directoryHandler serves the public directory page.
+func (cs *chatServer) directoryHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	fmt.Fprint(w, renderTemplate("directory.html", cs.directory()))
+}
+
+// handleDirectoryCmd handles "/directory <topic>" and "/directory off". The
+// topic becomes the room topic, see topic.go, and unlisting the room keeps it.
+// It returns a broadcast like handleMsg, so the room knows it was listed.
+// It does not lock the clientsMu, callers should do that.
+func (cr *chatRoom) handleDirectoryCmd(m msg) broadcast {
+	arg := strings.TrimSpace(strings.ToValidUTF8(m.text[len("/directory"):], "\uFFFD"))
+	if cr.name == "" {
+		m.author.sendError("Only named rooms can be listed in the directory")
+		return broadcast{}
+	}
+	if arg == "" {
+		m.author.sendError("Usage: /directory <topic>, or /directory off")
+		return broadcast{}
+	}
+
+	var text string
+	if arg == "off" {
+		if !cr.listed {
+			m.author.sendError("This room isn't listed in the directory")
+			return broadcast{}
+		}
+		cr.listed = false
+		text = fmt.Sprintf("%s removed this room from the public directory", isolateNick(m.author.nick))
+	} else {
+		if len(arg) > maxTopicLen {
+			m.author.sendError(m.author.tr("Topics can be at most %d bytes long", maxTopicLen))
+			return broadcast{}
+		}
+		if cr.server.isListingHidden(cr.name) {
+			m.author.sendError("The server operator has removed this room from the directory")
+			return broadcast{}
+		}
+		if !cr.mayChangeTopic(m.author) {
+			return broadcast{}
+		}
+		cr.listed = true
+		topic := sanitizeTopic(arg)
+		return cr.changeTopic(m.author, topic,
+			fmt.Sprintf("%s listed this room in the public directory: %s", isolateNick(m.author.nick), topic), m.when)
+	}
+	s := createSpecialMsg(text, "notif")
+	return broadcast{
+		html:       s,
+		authorHTML: s + clearInputFieldMsg,
+		json:       []string{encodeEvent(events.TypeNotice, events.Notice{Text: text, Time: m.when})},
+	}
+}
+
+// isListingHidden returns true if the operator hid the named room from the
+// directory.
+func (cs *chatServer) isListingHidden(name string) bool {
+	cs.listingsMu.Lock()
+	defer cs.listingsMu.Unlock()
+	return cs.hiddenListings[name]
+}
+
+// adminDirectoryHandler hides or unhides a room in the directory. It's
+// requested from the admin page, with the room name in the "name" form value
+// and "hide" set to "true" or "false".
+func (cs *chatServer) adminDirectoryHandler(w http.ResponseWriter, r *http.Request) {
+	keyID, ok := cs.adminSession(r)
+	if !ok || r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	name := r.FormValue("name")
+	if name == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	cs.listingsMu.Lock()
+	if r.FormValue("hide") == "true" {
+		cs.hiddenListings[name] = true
+	} else {
+		delete(cs.hiddenListings, name)
+	}
+	cs.listingsMu.Unlock()
+	if r.FormValue("hide") == "true" {
+		cs.audit.record(keyID, auditHideListing, name, "")
+	} else {
+		cs.audit.record(keyID, auditUnhideListing, name, "")
+	}
+
+	fmt.Fprint(w, adminListingButton(name, r.FormValue("hide") == "true"))
+}
+
+// adminListingButton returns the admin page button that hides or unhides a
+// room in the directory.
+func adminListingButton(name string, hidden bool) string {
+	label, hide := "Hide from directory", "true"
+	if hidden {
+		label, hide = "Unhide in directory", "false"
+	}
+	vals, _ := json.Marshal(map[string]string{"name": name, "hide": hide})
+	return fmt.Sprintf(
+		`<button hx-post="/admin-directory" hx-vals="%s" hx-swap="outerHTML">%s</button>`,
+		template.HTMLEscapeString(string(vals)), label,
+	)
+}
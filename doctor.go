@@ -0,0 +1,440 @@
+package main
+
+// This file has the doctor command, which checks that the server is set up
+// properly without starting it. Run it with the same flags as the server:
+//
+//	neartalk doctor -key ... -redis-url ...
+//
+// Every check prints a line saying whether it passed. Failures and warnings
+// also say how to fix them. The exit status is 1 if any check failed, so it
+// can be used in deploy scripts before going live.
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/makeworld-the-better-one/neartalk/data"
+	"github.com/redis/go-redis/v9"
+)
+
+// htmlAssets are the files in the html directory that the web UI needs. They
+// are served from the working directory, not embedded in the binary.
+var htmlAssets = []string{
+	"index.html", "index.css", "index.js", "fallback.js", "simple.css", "about.html",
+	"privacy_policy.html", "admin.html", "admin-room.html", "admin-room.js", "busy.html",
+	"diagnose.html", "diagnose.js", "challenge.js", "widget.js", "push-sw.js",
+}
+
+type checkStatus int
+
+const (
+	checkOK checkStatus = iota
+	checkWarn
+	checkFail
+)
+
+func (s checkStatus) String() string {
+	switch s {
+	case checkWarn:
+		return "warn"
+	case checkFail:
+		return "FAIL"
+	}
+	return "ok"
+}
+
+// checkResult is the outcome of a doctor check.
+type checkResult struct {
+	status checkStatus
+	detail string
+	// fix says what to do about a warning or failure.
+	fix string
+}
+
+func checkPassed(format string, a ...interface{}) checkResult {
+	return checkResult{status: checkOK, detail: fmt.Sprintf(format, a...)}
+}
+
+func checkWarned(detail, fix string) checkResult {
+	return checkResult{status: checkWarn, detail: detail, fix: fix}
+}
+
+func checkFailed(detail, fix string) checkResult {
+	return checkResult{status: checkFail, detail: detail, fix: fix}
+}
+
+// doctorChecks are run in order by runDoctor.
+var doctorChecks = []struct {
+	name  string
+	check func() checkResult
+}{
+	{"admin key", checkAdminKey},
+	{"flags", checkFlags},
+	{"html assets", checkHTMLAssets},
+	{"templates", checkTemplates},
+	{"wordlists", checkWordlists},
+	{"listen address", checkListen},
+	{"proxy headers", checkProxyHeaders},
+	{"redis", checkRedis},
+	{"geoip database", checkGeoIP},
+	{"asn database", checkASN},
+	{"bots file", checkBots},
+	{"config file", checkConfigFile},
+	{"settings file", checkSettingsFile},
+	{"storage", checkStorage},
+}
+
+// runDoctor runs all the checks, printing the results to w. It returns the
+// exit status.
+func runDoctor(w io.Writer) int {
+	// Loading things logs about them, which would be noise here
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	network, addr := listenAddr()
+	if network == "unix" {
+		addr = unixPrefix + addr
+	} else {
+		addr = "http://" + addr
+	}
+	fmt.Fprintf(w, "Checking the setup for %s\n\n", addr)
+	var warnings, failures int
+	for _, c := range doctorChecks {
+		res := c.check()
+		fmt.Fprintf(w, "%-4s  %s: %s\n", res.status, c.name, res.detail)
+		if res.fix != "" {
+			fmt.Fprintf(w, "      %s\n", res.fix)
+		}
+		switch res.status {
+		case checkWarn:
+			warnings++
+		case checkFail:
+			failures++
+		}
+	}
+
+	fmt.Fprintf(w, "\n%d failed, %d warned\n", failures, warnings)
+	if failures > 0 {
+		return 1
+	}
+	return 0
+}
+
+func checkAdminKey() checkResult {
+	keys := make(map[string]string)
+	if adminKeysFile != "" {
+		var err error
+		keys, err = readAdminKeysFile(adminKeysFile)
+		if err != nil {
+			return checkFailed(err.Error(), "Fix the -admin-keys file, each line should be: <id> <key>")
+		}
+	}
+	if adminKey != "" {
+		keys[mainAdminKeyID] = adminKey
+	}
+	if len(keys) == 0 {
+		return checkFailed("not set", "Set an admin key with -key or -admin-keys, the server won't start without one.")
+	}
+	for id, key := range keys {
+		if len(key) < 12 {
+			return checkWarned(fmt.Sprintf("key %s is shorter than 12 characters", id),
+				"Use longer keys, anyone who guesses one can use the admin page.")
+		}
+	}
+	return checkPassed("%d set", len(keys))
+}
+
+func checkFlags() checkResult {
+	if err := validateRoomPolicy(); err != nil {
+		return checkFailed(err.Error(), "Fix -room-policy.")
+	}
+	if err := validateRoomLifecycle(); err != nil {
+		return checkFailed(err.Error(), "Fix -room-expiry or -room-webhook.")
+	}
+	if err := validateRoomDisplay(); err != nil {
+		return checkFailed(err.Error(), "Fix -room-display.")
+	}
+	if err := validateHistory(); err != nil {
+		return checkFailed(err.Error(), "Lower -history.")
+	}
+	if err := validateRoomNetwork(); err != nil {
+		return checkFailed(err.Error(), "Fix -room-network, or leave it off.")
+	}
+	if err := validateWidgetOrigins(); err != nil {
+		return checkFailed(err.Error(), "Fix -widget-origins.")
+	}
+	if err := validateOrigins("-allowed-origins", allowedOrigins); err != nil {
+		return checkFailed(err.Error(), "Fix -allowed-origins.")
+	}
+	if err := validateOrigins("-frame-ancestors", frameAncestors); err != nil {
+		return checkFailed(err.Error(), "Fix -frame-ancestors.")
+	}
+	if geoLevel != geoLevelCity && geoLevel != geoLevelRegion && geoLevel != geoLevelNone {
+		return checkFailed(fmt.Sprintf("invalid -geoip-level %q", geoLevel),
+			fmt.Sprintf("Use %q, %q, or %q.", geoLevelCity, geoLevelRegion, geoLevelNone))
+	}
+	if err := validateNearby(); err != nil {
+		return checkFailed(err.Error(), "Fix -nearby.")
+	}
+	if err := validateLANMode(); err != nil {
+		return checkFailed(err.Error(), "Leave out -private-rooms and -nearby with -lan-mode.")
+	}
+	c, err := parseChaos(chaosFlag)
+	if err != nil {
+		return checkFailed(err.Error(), "Fix -chaos, or leave it out.")
+	}
+	if c.enabled() {
+		return checkWarned(fmt.Sprintf("chaos mode is enabled (%v)", c),
+			"Leave out -chaos on a real server, it gives everyone a bad connection.")
+	}
+	if acceptRate <= 0 {
+		return checkWarned("connections aren't paced",
+			"Crowds joining at once can overload the server, consider leaving -accept-rate at its default.")
+	}
+	return checkPassed("valid")
+}
+
+func checkHTMLAssets() checkResult {
+	dir, err := filepath.Abs("html")
+	if err != nil {
+		dir = "html"
+	}
+	var missing []string
+	for _, name := range htmlAssets {
+		if _, err := os.Stat(filepath.Join(dir, name)); err != nil {
+			missing = append(missing, name)
+		}
+	}
+	if len(missing) == len(htmlAssets) {
+		return checkFailed(fmt.Sprintf("no html directory at %s", dir),
+			"Run NearTalk from the directory that has the html folder from the repo, it isn't built into the binary.")
+	}
+	if len(missing) > 0 {
+		return checkFailed(fmt.Sprintf("missing %v in %s", missing, dir),
+			"Copy the missing files from the html folder in the repo.")
+	}
+	return checkPassed("all %d files in %s", len(htmlAssets), dir)
+}
+
+func checkTemplates() checkResult {
+	if err := loadTemplates(templatesDir); err != nil {
+		return checkFailed(err.Error(), fmt.Sprintf("Fix or remove the template in %s, the defaults are built in.", templatesDir))
+	}
+	var custom []string
+	for _, name := range templateNames {
+		if _, err := os.Stat(filepath.Join(templatesDir, name)); err == nil {
+			custom = append(custom, name)
+		}
+	}
+	if len(custom) == 0 {
+		return checkPassed("using the built-in defaults")
+	}
+	return checkPassed("using custom %v from %s", custom, templatesDir)
+}
+
+func checkWordlists() checkResult {
+	if len(data.Adjectives) == 0 || len(data.Animals) == 0 {
+		return checkFailed("nickname wordlists are empty", "Rebuild NearTalk from an unmodified data package.")
+	}
+	return checkPassed("built in, %d adjectives and %d animals for nicknames", len(data.Adjectives), len(data.Animals))
+}
+
+func checkListen() checkResult {
+	if os.Getenv("LISTEN_FDS") != "" {
+		return checkPassed("started by systemd socket activation")
+	}
+	network, addr := listenAddr()
+	if network == "unix" {
+		if err := removeStaleSocket(addr); err != nil {
+			return checkFailed(err.Error(), "Stop whatever is using the socket, or choose another path with -listen.")
+		}
+	}
+	l, err := net.Listen(network, addr)
+	if err != nil {
+		return checkFailed(err.Error(),
+			"Stop whatever is using the address, or choose another with -listen, or -host and -port. Ports below 1024 need extra permissions.")
+	}
+	l.Close()
+	return checkPassed("%s is free", addr)
+}
+
+// isLoopbackListen returns true if NearTalk only accepts connections from the
+// same machine.
+func isLoopbackListen() bool {
+	network, addr := listenAddr()
+	if network == "unix" {
+		return true
+	}
+	h, _, err := net.SplitHostPort(addr)
+	return err == nil && isLoopbackHost(h)
+}
+
+// isLoopbackHost returns true if the host only accepts connections from the
+// same machine.
+func isLoopbackHost(h string) bool {
+	if h == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(h)
+	return ip != nil && ip.IsLoopback()
+}
+
+func checkProxyHeaders() checkResult {
+	loopback := isLoopbackListen()
+	if trustedProxies == 0 && loopback {
+		_, addr := listenAddr()
+		return checkWarned(
+			fmt.Sprintf("listening on %s with -trusted-proxies 0, so clients can only come through a local proxy, but its headers are ignored", addr),
+			"Everyone would share the proxy's room. Set -trusted-proxies to the number of proxies in front of NearTalk.")
+	}
+	if trustedProxies > 0 && !loopback {
+		return checkWarned(
+			fmt.Sprintf("reachable from other machines with -trusted-proxies %d", trustedProxies),
+			"Clients connecting directly can choose their room with a fake X-Forwarded-For. Listen on 127.0.0.1 behind the proxy, or set -trusted-proxies 0 if there is no proxy.")
+	}
+	if trustedProxies == 0 {
+		return checkPassed("no proxies trusted, client addresses come from the connection")
+	}
+	return checkPassed("-trusted-proxies %d behind a local proxy", trustedProxies)
+}
+
+func checkRedis() checkResult {
+	if redisURL == "" {
+		return checkPassed("not used")
+	}
+	opts, err := redis.ParseURL(redisURL)
+	if err != nil {
+		return checkFailed(err.Error(), "Fix -redis-url, it should look like redis://localhost:6379/0.")
+	}
+	client := redis.NewClient(opts)
+	defer client.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := client.Ping(ctx).Err(); err != nil {
+		return checkFailed(fmt.Sprintf("can't reach %s: %v", opts.Addr, err),
+			"Make sure Redis is running and reachable from this machine, with the right password if it needs one.")
+	}
+	return checkPassed("reachable at %s", opts.Addr)
+}
+
+func checkGeoIP() checkResult {
+	if geoIPDB == "" {
+		return checkPassed("not used, rooms are per IP address")
+	}
+	if err := loadGeoIP(geoIPDB); err != nil {
+		return checkFailed(err.Error(), "Download a GeoLite2 City database from MaxMind and pass it with -geoip-db.")
+	}
+	defer func() {
+		geoDB.Close()
+		geoDB = nil
+	}()
+	age := time.Since(time.Unix(int64(geoDB.Metadata.BuildEpoch), 0))
+	if age > 60*24*time.Hour {
+		return checkWarned(fmt.Sprintf("%s is %d days old", geoIPDB, int(age.Hours()/24)),
+			"Download a newer database, addresses move between places over time.")
+	}
+	if geoLevel == geoLevelNone {
+		return checkPassed("%s, only used for nearby rooms", geoDB.Metadata.DatabaseType)
+	}
+	return checkPassed("%s, grouping by %s", geoDB.Metadata.DatabaseType, geoLevel)
+}
+
+func checkASN() checkResult {
+	if asnDBPath == "" {
+		return checkPassed("not used")
+	}
+	if err := loadASN(asnDBPath); err != nil {
+		return checkFailed(err.Error(), "Download a GeoLite2 ASN database from MaxMind and pass it with -asn-db.")
+	}
+	defer func() {
+		asnDB.Close()
+		asnDB = nil
+	}()
+	age := time.Since(time.Unix(int64(asnDB.Metadata.BuildEpoch), 0))
+	if age > 60*24*time.Hour {
+		return checkWarned(fmt.Sprintf("%s is %d days old", asnDBPath, int(age.Hours()/24)),
+			"Download a newer database, addresses move between networks over time.")
+	}
+	if roomNetwork != roomNetworkASN {
+		return checkWarned("not used without -room-network asn", "Pass -room-network asn to show the organizations.")
+	}
+	return checkPassed("%s", asnDB.Metadata.DatabaseType)
+}
+
+func checkBots() checkResult {
+	if botsFile == "" {
+		return checkPassed("not used")
+	}
+	if err := loadBots(botsFile); err != nil {
+		return checkFailed(err.Error(), "Fix the bots file, each line should be: <token> <room key> <nickname>")
+	}
+	return checkPassed("%d bots", len(botAccounts))
+}
+
+func checkConfigFile() checkResult {
+	if configPath == "" {
+		return checkPassed("not used")
+	}
+	c, err := readConfigFile(configPath)
+	if err != nil {
+		return checkFailed(err.Error(), "Fix the config file, see config.go for what it should look like.")
+	}
+	return checkPassed("%d filtered words and %d banned IPs or networks", len(c.WordFilter), len(c.bannedNets))
+}
+
+func checkSettingsFile() checkResult {
+	if settingsFile == "" {
+		return checkPassed("not used, settings are only kept in memory")
+	}
+	b, err := os.ReadFile(settingsFile)
+	if err != nil && !os.IsNotExist(err) {
+		return checkFailed(err.Error(), "Make sure NearTalk can read the -settings-file.")
+	}
+	if err == nil {
+		var sessions map[string]*sessionSettings
+		if err := json.Unmarshal(b, &sessions); err != nil {
+			return checkFailed(fmt.Sprintf("%s is corrupt: %v", settingsFile, err),
+				"Delete it to start over, users will lose their saved nicknames and themes.")
+		}
+	}
+	// Settings are saved by writing a temporary file next to it
+	f, err := os.CreateTemp(filepath.Dir(settingsFile), ".neartalk-doctor-*")
+	if err != nil {
+		return checkFailed(fmt.Sprintf("can't write to %s: %v", filepath.Dir(settingsFile), err),
+			"Make sure NearTalk can write to the directory of the -settings-file.")
+	}
+	f.Close()
+	os.Remove(f.Name())
+	return checkPassed("%s is usable", settingsFile)
+}
+
+func checkStorage() checkResult {
+	if storageDSN == "" {
+		return checkPassed("not used, see -room-settings-file and -audit-log")
+	}
+	store, err := openStorage(storageDSN)
+	if err != nil {
+		return checkFailed(err.Error(), "Fix -storage, and make sure the database is running and NearTalk can connect to it.")
+	}
+	defer store.close()
+	if _, err := store.loadRoomSettings(); err != nil {
+		return checkFailed(fmt.Sprintf("can't read room settings: %v", err), "Make sure NearTalk can read and write its tables.")
+	}
+	if _, err := store.loadAudit(1); err != nil {
+		return checkFailed(fmt.Sprintf("can't read the audit log: %v", err), "Make sure NearTalk can read and write its tables.")
+	}
+	if _, err := store.loadBans(); err != nil {
+		return checkFailed(fmt.Sprintf("can't read bans: %v", err), "Make sure NearTalk can read and write its tables.")
+	}
+	if _, err := store.loadHistory("", "", 1); err != nil {
+		return checkFailed(fmt.Sprintf("can't read message history: %v", err), "Make sure NearTalk can read and write its tables.")
+	}
+	return checkPassed("connected")
+}
@@ -0,0 +1,28 @@
+package main
+
+import "testing"
+
+func TestCheckProxyHeaders(t *testing.T) {
+	defer func(h string, p uint) { host, trustedProxies = h, p }(host, trustedProxies)
+	tests := []struct {
+		host    string
+		trusted uint
+		want    checkStatus
+	}{
+		{"127.0.0.1", 1, checkOK},
+		{"localhost", 2, checkOK},
+		{"::1", 0, checkWarn},
+		{"127.0.0.1", 0, checkWarn},
+		{"0.0.0.0", 0, checkOK},
+		{"", 0, checkOK},
+		{"0.0.0.0", 1, checkWarn},
+		{"", 1, checkWarn},
+	}
+	for _, tt := range tests {
+		host, trustedProxies = tt.host, tt.trusted
+		if got := checkProxyHeaders(); got.status != tt.want {
+			t.Errorf("host %q with %d trusted proxies: got %v (%s), want %v",
+				tt.host, tt.trusted, got.status, got.detail, tt.want)
+		}
+	}
+}
@@ -0,0 +1,99 @@
+package main
+
+// This file relays end-to-end encrypted messages, enabled with -e2ee. The web
+// UI encrypts them in the browser with a key made from a passphrase the
+// people in the room agree on some other way, see html/e2ee.js, so the
+// server only ever sees ciphertext. It can't render, filter, or quote those
+// messages, so they skip all of that, but they still count against the size
+// and rate limits like any other message. Anyone without the passphrase sees
+// "Encrypted message" instead.
+//
+// Encrypted messages can't be replied to, edited or deleted, since the
+// server doesn't keep them.
+
+import (
+	"encoding/base64"
+	"strings"
+	"time"
+
+	"github.com/makeworld-the-better-one/neartalk/events"
+)
+
+// maxCiphertextLen is the max length of the base64 ciphertext of an
+// encrypted message. It leaves room for maxMsgTextLen characters of a few
+// bytes each, plus the nonce and tag.
+const maxCiphertextLen = 4 * ((maxMsgTextLen*6 + e2eeOverhead + 2) / 3)
+
+// e2eeOverhead is the bytes AES-GCM adds to each message: a 12 byte nonce
+// before the ciphertext, and a 16 byte tag after it.
+const e2eeOverhead = 12 + 16
+
+// isValidCiphertext returns true if s could be an encrypted message from the
+// web UI. Only the encoding and length can be checked.
+func isValidCiphertext(s string) bool {
+	if len(s) > maxCiphertextLen {
+		return false
+	}
+	b, err := base64.StdEncoding.DecodeString(s)
+	return err == nil && len(b) > e2eeOverhead
+}
+
+// handleEncryptedMsg handles an end-to-end encrypted message, passing its
+// ciphertext on to the room as is.
+// It does not lock the clientsMu, callers should do that.
+func (cr *chatRoom) handleEncryptedMsg(m msg) broadcast {
+	if !e2eeEnabled {
+		m.author.sendError("This server doesn't relay encrypted messages")
+		return broadcast{}
+	}
+	if !isValidCiphertext(m.ciphertext) {
+		m.author.sendError("That encrypted message is invalid or too long")
+		return broadcast{}
+	}
+	if !cr.checkSlowMode(m.author, m.when) {
+		return broadcast{}
+	}
+	if b, spam := cr.checkSpam(m.author, "", m.when); spam {
+		return b
+	}
+	cr.whenLastMsg = m.when
+	cr.recordMsg(m.when)
+	m.author.msgCount++
+	m.id = newMsgID()
+
+	data := chatMsgData{
+		ID:         m.id,
+		Time:       m.when.UTC().Format(time.RFC3339),
+		Nick:       nickHTML(m.nick),
+		Ciphertext: m.ciphertext,
+		Bot:        m.author.bot != nil,
+		Look:       m.author.look,
+	}
+	author, nonAuthor := renderChatMsg(data)
+	e := events.Encrypted{
+		ID:         m.id,
+		Nick:       plainNick(m.nick),
+		Ciphertext: m.ciphertext,
+		Time:       m.when,
+		Bot:        m.author.bot != nil,
+	}
+	nonAuthorJSON := encodeEvent(events.TypeEncrypted, e)
+	e.Self = true
+	return broadcast{
+		html:       nonAuthor,
+		authorHTML: author,
+		json:       []string{nonAuthorJSON},
+		authorJSON: []string{encodeEvent(events.TypeEncrypted, e)},
+		isChat:     true,
+		id:         m.id,
+		alert:      &chatAlert{ID: m.id, Nick: m.nick, Text: "Encrypted message", Time: m.when},
+		encrypted:  true,
+	}
+}
+
+// isE2EECmd returns true if the text is the web UI's /e2ee command. The web
+// UI handles it without sending it, so if it gets here it came from another
+// client, and would give the passphrase away if it was sent to the room.
+func isE2EECmd(text string) bool {
+	return text == "/e2ee" || strings.HasPrefix(text, "/e2ee ")
+}
@@ -0,0 +1,26 @@
+package main
+
+import (
+	"encoding/base64"
+	"strings"
+	"testing"
+)
+
+func TestIsValidCiphertext(t *testing.T) {
+	tests := []struct {
+		s    string
+		want bool
+	}{
+		{base64.StdEncoding.EncodeToString(make([]byte, e2eeOverhead+1)), true},
+		{base64.StdEncoding.EncodeToString(make([]byte, e2eeOverhead)), false},
+		{"", false},
+		{"hello world", false},
+		{strings.Repeat("A", maxCiphertextLen), true},
+		{strings.Repeat("A", maxCiphertextLen+4), false},
+	}
+	for _, tt := range tests {
+		if got := isValidCiphertext(tt.s); got != tt.want {
+			t.Errorf("isValidCiphertext(%.20q...) = %v, want %v", tt.s, got, tt.want)
+		}
+	}
+}
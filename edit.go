@@ -0,0 +1,130 @@
+package main
+
+// This file handles the /edit and /delete commands, which let authors change
+// their recent messages.
+
+import (
+	"strings"
+	"time"
+
+	"github.com/makeworld-the-better-one/neartalk/events"
+)
+
+// findEditableMsg returns the remembered message with the given ID if the
+// client is allowed to edit or delete it. Otherwise it returns an error
+// message for the client.
+// It does not lock the clientsMu, callers should do that.
+func (cr *chatRoom) findEditableMsg(c *client, id string) (*recentMsg, string) {
+	if editWindow <= 0 {
+		return nil, "Editing and deleting messages is disabled on this server"
+	}
+	rm := cr.findRecentMsg(strings.TrimPrefix(id, "#"))
+	if rm == nil || rm.author != c {
+		return nil, "You don't have a recent message with that ID"
+	}
+	if time.Since(rm.when) > editWindow {
+		return nil, "That message is too old to change"
+	}
+	return rm, ""
+}
+
+// handleEditCmd handles "/edit <id> <text>".
+// It returns a broadcast like handleMsg.
+// It does not lock the clientsMu, callers should do that.
+func (cr *chatRoom) handleEditCmd(m msg) broadcast {
+	args := strings.SplitN(strings.TrimSpace(m.text[len("/edit "):]), " ", 2)
+	if len(args) != 2 || strings.TrimSpace(args[1]) == "" {
+		m.author.sendError("Usage: /edit <id> <new text>")
+		return broadcast{}
+	}
+	rm, errText := cr.findEditableMsg(m.author, args[0])
+	if rm == nil {
+		m.author.sendError(errText)
+		return broadcast{}
+	}
+	if errText := msgTextError(args[1]); errText != "" {
+		m.author.sendError(errText)
+		return broadcast{}
+	}
+
+	text, ok := linkPolicyText(m.author, args[1])
+	if !ok {
+		m.author.sendError("Links need a moderator's approval here, so edits can't add them")
+		return broadcast{}
+	}
+	args[1] = currentConfig().filterWords(text)
+	edited := msg{
+		id:      rm.id,
+		replyTo: rm.replyTo,
+		nick:    rm.nick,
+		text:    args[1],
+		author:  rm.author,
+		when:    rm.when,
+	}
+	edited.mentions = findMentions(edited.text, cr.roomNicks())
+	var quoted *recentMsg
+	if rm.replyTo != "" {
+		quoted = cr.findRecentMsg(rm.replyTo)
+	}
+	data, ok := newChatMsgData(edited, quoted)
+	if !ok {
+		m.author.sendError("Invalid message")
+		return broadcast{}
+	}
+	rm.text = args[1]
+	rm.edited = true
+	cr.editHistory(rm.id, rm.text)
+	data.Edited = true
+	data.Replace = true
+	author, nonAuthor := renderChatMsg(data)
+
+	e := events.Message{
+		ID:       edited.id,
+		ReplyTo:  edited.replyTo,
+		Nick:     plainNick(edited.nick),
+		Text:     edited.text,
+		HTML:     renderMsgText(edited.text, edited.mentions),
+		Mentions: plainNicks(edited.mentions),
+		Time:     edited.when,
+		Edited:   true,
+		Bot:      data.Bot,
+	}
+	nonAuthorJSON := encodeEvent(events.TypeEdit, e)
+	e.Self = true
+	return broadcast{
+		html:       nonAuthor,
+		authorHTML: author,
+		json:       []string{nonAuthorJSON},
+		authorJSON: []string{encodeEvent(events.TypeEdit, e)},
+		// Highlighted, but nobody is notified again for an edit
+		mentioned: edited.mentions,
+	}
+}
+
+// handleDeleteCmd handles "/delete <id>".
+// It returns a broadcast like handleMsg.
+// It does not lock the clientsMu, callers should do that.
+func (cr *chatRoom) handleDeleteCmd(m msg) broadcast {
+	rm, errText := cr.findEditableMsg(m.author, strings.TrimSpace(m.text[len("/delete "):]))
+	if rm == nil {
+		m.author.sendError(errText)
+		return broadcast{}
+	}
+	author, nonAuthor := renderChatMsg(chatMsgData{
+		ID:      rm.id,
+		Time:    rm.when.UTC().Format(time.RFC3339),
+		Nick:    nickHTML(rm.nick),
+		Look:    rm.author.look,
+		Deleted: true,
+		Replace: true,
+	})
+	// rm points into cr.recent, so it can't be used after forgetting it
+	id := rm.id
+	cr.forgetMsg(id)
+	cr.deleteHistory(id)
+	return broadcast{
+		html:       nonAuthor,
+		authorHTML: author,
+		json:       []string{encodeEvent(events.TypeDelete, events.Delete{ID: id})},
+	}
+}
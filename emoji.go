@@ -0,0 +1,42 @@
+package main
+
+import (
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/makeworld-the-better-one/neartalk/data"
+)
+
+// maxEmojiResults is the max number of shortcodes listed by the /emoji command.
+const maxEmojiResults = 30
+
+var shortcodeRe = regexp.MustCompile(`:([a-z0-9_+-]+):`)
+
+// expandEmoji replaces emoji shortcodes like :smile: with the emoji itself.
+// Unknown shortcodes are left alone.
+func expandEmoji(text string) string {
+	return shortcodeRe.ReplaceAllStringFunc(text, func(sc string) string {
+		if e, ok := data.Emoji[sc[1:len(sc)-1]]; ok {
+			return e
+		}
+		return sc
+	})
+}
+
+// searchEmoji returns a sorted list of "emoji :shortcode:" strings for every
+// shortcode containing the search term.
+func searchEmoji(term string) []string {
+	term = strings.Trim(strings.ToLower(term), ":")
+	var results []string
+	for sc, e := range data.Emoji {
+		if strings.Contains(sc, term) {
+			results = append(results, e+" :"+sc+":")
+		}
+	}
+	sort.Slice(results, func(i, j int) bool {
+		// Sort by shortcode, not by emoji
+		return results[i][strings.Index(results[i], ":"):] < results[j][strings.Index(results[j], ":"):]
+	})
+	return results
+}
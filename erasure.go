@@ -0,0 +1,184 @@
+package main
+
+// This file deletes what NearTalk keeps about a room, for data protection
+// laws like the GDPR. Messages are only in the memory of open rooms, unless
+// -history is set, see history.go. A room's history, saved settings, abuse
+// reports, and the statistics of recently closed rooms are kept by room key,
+// which is often an IP address.
+//
+// Admins can erase it all from the admin page, or with
+// DELETE /api/rooms/{key}, see api.go. The room is closed, which drops its
+// messages, and the rest is deleted. An IP address can be given instead of
+// the room key. With -retention, message history, saved room settings,
+// closed room statistics, and audit log entries older than that are deleted
+// automatically.
+
+import (
+	"fmt"
+	"html/template"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// retentionInterval is how often data older than -retention is deleted.
+const retentionInterval = time.Hour
+
+// erasure is what was deleted for a room. It's the API response for
+// erasing one.
+type erasure struct {
+	Room string `json:"room"`
+	// Closed is true if the room was open, and so was closed.
+	Closed bool `json:"closed"`
+	// Settings is true if the room had saved settings.
+	Settings bool `json:"settings"`
+	// Reports is true if the room had abuse reports waiting for the digest.
+	Reports bool `json:"reports"`
+	// ClosedStats is how many times the room was in the list of recently
+	// closed rooms.
+	ClosedStats int `json:"closed_stats"`
+	// History is true if -history is set, so the room's message history was
+	// deleted.
+	History bool `json:"history"`
+	// Banned is true if the IP address is in banned_ips in the config file,
+	// or banned with the API. That isn't changed, bans have to be removed
+	// separately.
+	Banned bool `json:"banned"`
+}
+
+// erasureRoomKey returns the room key to erase for the target, which is a
+// room key or an IP address. Addresses with a room alias erase the alias's
+// room. With -private-rooms, the address is hashed with the current secret,
+// so only the room it's in now can be found.
+func erasureRoomKey(target string) string {
+	ip := net.ParseIP(target)
+	if ip == nil {
+		return target
+	}
+	if alias := aliasFor(ip); alias != "" {
+		return alias
+	}
+	key := addrRoomKey(ip)
+	if privateRooms && key != "lan" {
+		return privateKey(key)
+	}
+	return key
+}
+
+// eraseRoom closes the room for the target, a room key or an IP address, and
+// deletes everything kept about it.
+func (cs *chatServer) eraseRoom(target string) erasure {
+	key := erasureRoomKey(target)
+	e := erasure{Room: key}
+	if ip := net.ParseIP(target); ip != nil {
+		e.Banned = cs.isBanned(ip)
+	}
+
+	// Closing the room saves its settings and records its statistics, so
+	// it's closed first
+	e.Closed = cs.closeRoom(key, roomClosedByAdmin)
+	e.Settings = cs.roomSettings.remove(key)
+	e.Reports = cs.reports.remove(key)
+	e.ClosedStats = cs.closedRooms.remove(key)
+	if historyLen > 0 {
+		if err := cs.historyWriter.erase(cs.store, key); err != nil {
+			log.Printf("chatServer.eraseRoom: erasing history: %v", err)
+		}
+		e.History = true
+	}
+	if err := cs.roomSettings.save(); err != nil {
+		log.Printf("chatServer.eraseRoom: saving room settings: %v", err)
+	}
+	return e
+}
+
+// summary describes what was erased, for the admin page.
+func (e erasure) summary() string {
+	var done []string
+	if e.Closed {
+		done = append(done, "closed the room")
+	}
+	if e.Settings {
+		done = append(done, "deleted its saved settings")
+	}
+	if e.Reports {
+		done = append(done, "deleted its reports")
+	}
+	if e.ClosedStats > 0 {
+		done = append(done, "deleted its statistics")
+	}
+	if e.History {
+		done = append(done, "deleted its message history")
+	}
+	s := "Nothing was kept about " + roomTitle(e.Room) + "."
+	if len(done) > 0 {
+		s = fmt.Sprintf("For %s: %s.", roomTitle(e.Room), strings.Join(done, ", "))
+	}
+	if e.Banned {
+		s += " The address is still banned, in banned_ips in the config file or with the API."
+	}
+	return s
+}
+
+// applyRetention deletes what's older than -retention.
+func (cs *chatServer) applyRetention(now time.Time) {
+	before := now.Add(-retention)
+	cs.closedRooms.expire(before)
+	// Saving expires old settings first
+	if err := cs.roomSettings.save(); err != nil {
+		log.Printf("chatServer.applyRetention: saving room settings: %v", err)
+	}
+	if err := cs.audit.purge(before); err != nil {
+		log.Printf("chatServer.applyRetention: purging audit log: %v", err)
+	}
+	if err := cs.store.purgeHistory(before); err != nil {
+		log.Printf("chatServer.applyRetention: purging history: %v", err)
+	}
+}
+
+// runRetention deletes what's older than -retention every
+// retentionInterval. It never returns.
+func (cs *chatServer) runRetention() {
+	cs.applyRetention(time.Now())
+	for now := range time.Tick(retentionInterval) {
+		cs.applyRetention(now)
+	}
+}
+
+// adminEraseHandler serves the admin page form for erasing a room's data,
+// and erases it when the form is sent.
+func (cs *chatServer) adminEraseHandler(w http.ResponseWriter, r *http.Request) {
+	keyID, ok := cs.adminSession(r)
+	if !ok {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	if r.Method != http.MethodPost {
+		fmt.Fprint(w, adminEraseForm(""))
+		return
+	}
+	target := strings.TrimSpace(r.FormValue("target"))
+	if target == "" {
+		fmt.Fprint(w, adminEraseForm("Enter a room key or IP address."))
+		return
+	}
+	e := cs.eraseRoom(target)
+	cs.audit.record(keyID, auditErase, e.Room, "")
+	fmt.Fprint(w, adminEraseForm(e.summary()))
+}
+
+// adminEraseForm returns the admin page form for erasing a room's data, with
+// a status message under it if status isn't empty.
+func adminEraseForm(status string) string {
+	var b strings.Builder
+	b.WriteString(`<form hx-post="/admin-erase" hx-swap="outerHTML" hx-confirm="Close this room and delete everything kept about it?">` +
+		`<input name="target" placeholder="Room key or IP address" required /> ` +
+		`<button>Erase</button>`)
+	if status != "" {
+		fmt.Fprintf(&b, `<p>%s</p>`, template.HTMLEscapeString(status))
+	}
+	b.WriteString(`</form>`)
+	return b.String()
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestErasureRoomKey(t *testing.T) {
+	defer func(p bool) { privateRooms = p }(privateRooms)
+	for target, want := range map[string]string{
+		"203.0.113.5":     "203.0.113.5",
+		"192.168.1.2":     "lan",
+		"#lobby":          "#lobby",
+		"Toronto, Canada": "Toronto, Canada",
+	} {
+		if got := erasureRoomKey(target); got != want {
+			t.Errorf("erasureRoomKey(%q) = %q, want %q", target, got, want)
+		}
+	}
+	privateRooms = true
+	if got, want := erasureRoomKey("203.0.113.5"), privateKey("203.0.113.5"); got != want {
+		t.Errorf("erasureRoomKey() = %q with -private-rooms, want %q", got, want)
+	}
+}
+
+func TestEraseRoom(t *testing.T) {
+	cs := newChatServer(nil)
+	var err error
+	if cs.roomSettings, err = newRoomSettingsStore(&memoryStorage{}); err != nil {
+		t.Fatal(err)
+	}
+	cs.roomSettings.put("203.0.113.5", savedRoom{Topic: "Games"})
+	cs.roomSettings.put("203.0.113.6", savedRoom{Topic: "Music"})
+	cs.reports.add("203.0.113.5", "spam", false)
+	now := time.Now()
+	for _, key := range []string{"203.0.113.5", "203.0.113.6", "203.0.113.5"} {
+		cs.closedRooms.add(roomEvent{Event: roomEventClosed, Room: key, Time: now, Created: now})
+	}
+
+	e := cs.eraseRoom("203.0.113.5")
+	if want := (erasure{Room: "203.0.113.5", Settings: true, Reports: true, ClosedStats: 2}); e != want {
+		t.Errorf("eraseRoom() = %+v, want %+v", e, want)
+	}
+	if _, ok := cs.roomSettings.get("203.0.113.5"); ok {
+		t.Error("the room's settings are still saved")
+	}
+	if _, ok := cs.roomSettings.get("203.0.113.6"); !ok {
+		t.Error("another room's settings were erased")
+	}
+	if len(cs.closedRooms.rooms) != 1 || cs.closedRooms.rooms[0].key != "203.0.113.6" {
+		t.Errorf("closed rooms = %+v, want just the other room", cs.closedRooms.rooms)
+	}
+	if e := cs.eraseRoom("203.0.113.5"); e != (erasure{Room: "203.0.113.5"}) {
+		t.Errorf("eraseRoom() again = %+v, want nothing erased", e)
+	}
+}
+
+func TestApplyRetention(t *testing.T) {
+	defer func(r time.Duration) { retention = r }(retention)
+	retention = 72 * time.Hour
+	cs := newChatServer(nil)
+	now := time.Now()
+	old := now.Add(-100 * time.Hour)
+	cs.closedRooms.add(roomEvent{Event: roomEventClosed, Room: "old", Time: old, Created: old})
+	cs.closedRooms.add(roomEvent{Event: roomEventClosed, Room: "new", Time: now, Created: now})
+	cs.audit.store.appendAudit(auditEntry{Time: old, Action: auditWatch, Target: "old"})
+	cs.audit.record("main", auditWatch, "new", "")
+
+	cs.applyRetention(now)
+	if len(cs.closedRooms.rooms) != 1 || cs.closedRooms.rooms[0].key != "new" {
+		t.Errorf("closed rooms = %+v, want just the new one", cs.closedRooms.rooms)
+	}
+	es, err := cs.audit.store.loadAudit(10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(es) != 1 || es[0].Target != "new" {
+		t.Errorf("audit log = %+v, want just the new entry", es)
+	}
+}
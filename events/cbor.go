@@ -0,0 +1,32 @@
+package events
+
+import (
+	"github.com/fxamacker/cbor/v2"
+)
+
+// SubprotocolCBOR is the websocket subprotocol for getting events encoded as
+// CBOR (RFC 8949) instead of JSON, which is smaller and quicker to decode in
+// busy rooms. Clients using the JSON protocol can ask for it when they
+// connect, and if the server agrees, every event is sent as a binary message
+// holding the Envelope as a CBOR map, with Data as a CBOR map too rather than
+// embedded JSON. Keys are the same as in JSON, and times are still RFC 3339
+// strings. Clients can then send Send structs encoded as CBOR in binary
+// messages, or keep sending JSON in text messages.
+const SubprotocolCBOR = "neartalk.cbor"
+
+// cborEnvelope is an Envelope in the CBOR encoding.
+type cborEnvelope struct {
+	Version int             `cbor:"v"`
+	Type    Type            `cbor:"type"`
+	Data    cbor.RawMessage `cbor:"data"`
+}
+
+// DecodeCBOR decodes an event sent with SubprotocolCBOR. The Envelope's Data
+// is left empty, Decode decodes the CBOR data instead.
+func DecodeCBOR(b []byte) (*Envelope, error) {
+	var ce cborEnvelope
+	if err := cbor.Unmarshal(b, &ce); err != nil {
+		return nil, err
+	}
+	return &Envelope{Version: ce.Version, Type: ce.Type, cbor: ce.Data}, nil
+}
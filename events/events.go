@@ -0,0 +1,389 @@
+// Package events defines the JSON events that a NearTalk server sends to
+// clients. The web UI receives pre-rendered HTML for htmx instead, but every
+// HTML update it gets has a matching event here, so alternative front-ends
+// can be built without parsing HTML.
+//
+// Every event is sent as an Envelope, which holds the schema version, the
+// event type, and the event data. The data for each type is one of the
+// structs in this package:
+//
+//	Type        Data
+//	"message"   Message
+//	"edit"      Message
+//	"delete"    Delete
+//	"join"      Join
+//	"leave"     Leave
+//	"nick"      NickChange
+//	"users"     UserList
+//	"room"      Room
+//	"notice"    Notice
+//	"error"     Error
+//	"clear"     Clear
+//	"unread"    Unread
+//	"seen"      Seen
+//	"motd"      MOTD
+//	"topic"     Topic
+//	"encrypted" Encrypted
+//	"subrooms"  Subrooms
+//	"search"    Search
+//	"history"   History
+//
+// Clients send messages to the server as JSON too, using the Send struct.
+// Commands like "/nick new-name" are sent as regular messages.
+//
+// Events can be sent as CBOR instead of JSON, see SubprotocolCBOR.
+//
+// Clients should ignore event types they don't know about, as new ones may be
+// added without changing the version. The version only changes when existing
+// events change in a way that isn't backwards compatible.
+package events
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/fxamacker/cbor/v2"
+)
+
+// Version is the version of the event schema described by this package.
+const Version = 1
+
+// Type is the type of an event.
+type Type string
+
+// Event types.
+const (
+	TypeMessage   Type = "message"
+	TypeEdit      Type = "edit"
+	TypeDelete    Type = "delete"
+	TypeJoin      Type = "join"
+	TypeLeave     Type = "leave"
+	TypeNick      Type = "nick"
+	TypeUsers     Type = "users"
+	TypeRoom      Type = "room"
+	TypeNotice    Type = "notice"
+	TypeError     Type = "error"
+	TypeClear     Type = "clear"
+	TypeUnread    Type = "unread"
+	TypeSeen      Type = "seen"
+	TypeMOTD      Type = "motd"
+	TypeMention   Type = "mention"
+	TypePrefs     Type = "prefs"
+	TypeTopic     Type = "topic"
+	TypeEncrypted Type = "encrypted"
+	TypeSubrooms  Type = "subrooms"
+	TypeSearch    Type = "search"
+	TypeHistory   Type = "history"
+)
+
+// Types is all the event types in this version of the schema.
+var Types = []Type{
+	TypeMessage, TypeEdit, TypeDelete, TypeJoin, TypeLeave, TypeNick,
+	TypeUsers, TypeRoom, TypeNotice, TypeError, TypeClear, TypeUnread,
+	TypeSeen, TypeMOTD, TypeMention, TypePrefs, TypeTopic, TypeEncrypted,
+	TypeSubrooms, TypeSearch, TypeHistory,
+}
+
+// Envelope wraps every event sent to a client.
+type Envelope struct {
+	// Version is the schema version, see the Version const.
+	Version int `json:"v"`
+	// Type tells you which struct Data decodes into.
+	Type Type `json:"type"`
+	// Data is the event itself.
+	Data json.RawMessage `json:"data"`
+
+	// cbor is the event itself for events decoded with DecodeCBOR, in which
+	// case Data is empty.
+	cbor cbor.RawMessage
+}
+
+// New creates an Envelope of the given type that holds data.
+func New(t Type, data interface{}) (*Envelope, error) {
+	b, err := json.Marshal(data)
+	if err != nil {
+		return nil, err
+	}
+	return &Envelope{Version: Version, Type: t, Data: b}, nil
+}
+
+// Decode decodes the event data into v, which should be a pointer to the
+// struct for the envelope's type.
+func (e *Envelope) Decode(v interface{}) error {
+	if e.cbor != nil {
+		return cbor.Unmarshal(e.cbor, v)
+	}
+	return json.Unmarshal(e.Data, v)
+}
+
+// Message is a chat message sent by a user.
+type Message struct {
+	// ID identifies the message. IDs are ULIDs, so they sort in the order
+	// messages were sent.
+	ID string `json:"id"`
+	// ReplyTo is the ID of the message this one replies to, or empty.
+	ReplyTo string `json:"reply_to,omitempty"`
+	// Nick is the nickname of the author when the message was sent.
+	// Like all nicknames in events, it is not escaped.
+	Nick string `json:"nick"`
+	// Text is the message text as the author wrote it. It is not escaped, so
+	// it must be escaped before being displayed as HTML. It can have several
+	// lines, separated by "\n".
+	Text string `json:"text"`
+	// HTML is the message text rendered to HTML by the server, with
+	// formatting, links and line breaks. It is safe to display as is.
+	// Mentions are rendered as <span class="mention">.
+	HTML string `json:"html"`
+	// Mentions is the nicknames of the people in the room mentioned with
+	// "@nick" in the text, if any.
+	Mentions []string `json:"mentions,omitempty"`
+	// Self is true if the client receiving the event sent the message.
+	Self bool `json:"self"`
+	// Edited is true if the author has edited the message. Edits are sent
+	// as "edit" events, which replace the message with the same ID.
+	Edited bool `json:"edited,omitempty"`
+	// Time is when the message was sent.
+	Time time.Time `json:"time"`
+	// Bot is true if the author is a bot account.
+	Bot bool `json:"bot,omitempty"`
+	// History is true if the message was sent before the client joined, and
+	// is replayed from the room's history.
+	History bool `json:"history,omitempty"`
+}
+
+// Delete is sent when the author deletes a message.
+type Delete struct {
+	// ID is the ID of the deleted message.
+	ID string `json:"id"`
+}
+
+// Join is sent when a user joins the room. It is followed by a UserList.
+type Join struct {
+	Nick string    `json:"nick"`
+	Time time.Time `json:"time"`
+}
+
+// Leave is sent when a user leaves the room. It is followed by a UserList.
+type Leave struct {
+	Nick string    `json:"nick"`
+	Time time.Time `json:"time"`
+}
+
+// NickChange is sent when a user changes their nickname. It is followed by a
+// UserList.
+type NickChange struct {
+	Old  string    `json:"old"`
+	New  string    `json:"new"`
+	Time time.Time `json:"time"`
+}
+
+// UserList holds the nicknames of everyone currently in the room, sorted
+// alphabetically. It replaces any previous user list.
+type UserList struct {
+	Nicks []string `json:"nicks"`
+	// Idle holds the nicknames of users who aren't looking at the chat, or
+	// haven't done anything for a while. Users who are away are included.
+	Idle []string `json:"idle,omitempty"`
+	// Away holds the users who said they're away, by nickname, with the
+	// reason they gave. The reason can be empty.
+	Away map[string]string `json:"away,omitempty"`
+	// Bots holds the nicknames of bot accounts.
+	Bots []string `json:"bots,omitempty"`
+	// Mods holds the nicknames of the room's moderators.
+	Mods []string `json:"mods,omitempty"`
+	// Guests holds the nicknames of people who joined with an invite link
+	// from another network.
+	Guests []string `json:"guests,omitempty"`
+}
+
+// Room is sent after connecting, and tells the client which room it is in.
+// It's sent again if that changes, like when an admin moves the client to
+// another room, or once the room's network is found.
+type Room struct {
+	// Name is the room name shown to users, usually the IP address.
+	Name string `json:"name"`
+	// Nick is the nickname the server gave the client.
+	Nick string `json:"nick"`
+	// Topic is the room topic, or empty if it has none.
+	Topic string `json:"topic,omitempty"`
+	// Network is the name of the network the room is for, like its reverse
+	// DNS name, on servers that show it. It's empty until it's found.
+	Network string `json:"network,omitempty"`
+}
+
+// Encrypted is an end-to-end encrypted chat message, on servers that relay
+// them. Only people with the room's passphrase can read it, see the README.
+// It can't be replied to, edited or deleted.
+type Encrypted struct {
+	ID   string `json:"id"`
+	Nick string `json:"nick"`
+	// Ciphertext is the base64 encoded AES-GCM nonce, ciphertext and tag.
+	Ciphertext string    `json:"ciphertext"`
+	Self       bool      `json:"self"`
+	Time       time.Time `json:"time"`
+	Bot        bool      `json:"bot,omitempty"`
+}
+
+// Subrooms lists the topic rooms people on the same network split off into
+// with "/join #name". It's sent to everyone in the main room, the lobby, and
+// its subrooms whenever someone joins or leaves one of them, and replaces any
+// previous list.
+type Subrooms struct {
+	// Current is the name of the subroom the client is in, without the "#",
+	// or empty in the lobby.
+	Current string `json:"current,omitempty"`
+	// LobbyUsers is how many people are in the lobby.
+	LobbyUsers int `json:"lobby_users"`
+	// Rooms holds the subrooms with anyone in them, sorted by name. It's
+	// empty when there are none.
+	Rooms []Subroom `json:"rooms"`
+}
+
+// Subroom is a subroom in Subrooms.
+type Subroom struct {
+	Name  string `json:"name"`
+	Users int    `json:"users"`
+}
+
+// Search is the results of searching the room's history with
+// "/search <term>", sent only to the client that searched. Servers only keep
+// history if the operator turned it on.
+type Search struct {
+	// Term is what was searched for.
+	Term string `json:"term"`
+	// Messages holds a page of the messages with the term, newest first.
+	Messages []Message `json:"messages"`
+	// Before is the ID to search for older messages with, by sending
+	// "/search before:<id> <term>", or empty if there are none.
+	Before string `json:"before,omitempty"`
+}
+
+// History is a page of older messages from the room's history, sent only to
+// the client that asked for it with Send.Older. Each page is older than the
+// last one, starting from the messages replayed when the client joined.
+type History struct {
+	// Messages holds the page of messages, oldest first.
+	Messages []Message `json:"messages"`
+	// More is true if there are older messages to ask for.
+	More bool `json:"more"`
+}
+
+// Topic is sent when someone changes the room topic.
+type Topic struct {
+	// Topic is the new topic, or empty if it was removed.
+	Topic string `json:"topic"`
+	// Nick is who changed it.
+	Nick string    `json:"nick"`
+	Time time.Time `json:"time"`
+}
+
+// Notice is an informational message from the server.
+type Notice struct {
+	Text string    `json:"text"`
+	Time time.Time `json:"time"`
+}
+
+// Clear is sent when a moderator clears the chat, or when the client clears
+// its own with /clear. Clients should remove all the messages shown so far.
+type Clear struct {
+	// Nick is the moderator who cleared the chat.
+	Nick string `json:"nick"`
+	// Self is true if the client cleared only its own chat. Nick is then the
+	// client's nickname, and nobody else's chat changed.
+	Self bool      `json:"self,omitempty"`
+	Time time.Time `json:"time"`
+}
+
+// Unread is sent when the number of messages the client hasn't acknowledged
+// changes. Messages only count as unread if they arrive while the client is
+// inactive, see Send.
+type Unread struct {
+	Count int `json:"count"`
+}
+
+// Seen is sent when the number of people who have seen the latest message in
+// the room changes. It's only sent if the server has read receipts enabled.
+type Seen struct {
+	// ID is the ID of the latest message.
+	ID string `json:"id"`
+	// Count is how many people other than the author have seen it.
+	Count int `json:"count"`
+}
+
+// Error tells the client something it did failed, like an invalid command.
+type Error struct {
+	Text string `json:"text"`
+}
+
+// Send is sent by clients to post a message to the room, or to report
+// presence.
+type Send struct {
+	// Message is the message text, or a command like "/nick new-name".
+	// Messages can have several lines, separated by "\n" or "\r\n", up to
+	// the server's limit on lines and length.
+	Message string `json:"message,omitempty"`
+	// ReplyTo is the ID of the message being replied to, if any.
+	ReplyTo string `json:"reply_to,omitempty"`
+	// Activity is "active" or "inactive", to tell the server whether the
+	// user is looking at the chat. Inactive users are marked idle.
+	Activity string `json:"activity,omitempty"`
+	// Heartbeat can be set to any non-empty value to tell the server the
+	// client is still there. Once a client sends a heartbeat, it must keep
+	// sending one at least every 30 seconds, or it will be disconnected.
+	Heartbeat string `json:"heartbeat,omitempty"`
+	// Ack is the ID of the latest message the user has seen. It and every
+	// message before it stop counting as unread. Becoming active acknowledges
+	// every message received so far.
+	Ack string `json:"ack,omitempty"`
+	// Notify sets which messages the user wants to be notified of: "all",
+	// "mentions" or "off". Sound is "on" or "off". Either can be sent alone,
+	// and the server responds with a "prefs" event. They're kept for the
+	// session, so other tabs and later connections get them too.
+	Notify string `json:"notify,omitempty"`
+	Sound  string `json:"sound,omitempty"`
+	// Ciphertext is an end-to-end encrypted message, sent instead of
+	// Message, see Encrypted.
+	Ciphertext string `json:"ciphertext,omitempty"`
+	// Search searches the room's history, like sending "/search " followed
+	// by it as Message.
+	Search string `json:"search,omitempty"`
+	// Older can be set to any non-empty value to ask for the page of the
+	// room's history before the oldest message the client was sent, which
+	// the server keeps track of. The server responds with a "history" event.
+	Older string `json:"older,omitempty"`
+	// Backpressure is what happens when the client can't keep up with
+	// events. With "drop", the default, presence updates and then messages
+	// are dropped until it catches up, when it gets a notice saying how many
+	// messages it missed. With "disconnect", the server disconnects the
+	// client instead of dropping anything.
+	Backpressure string `json:"backpressure,omitempty"`
+}
+
+// MOTD is the message of the day. It's sent after joining a room if the
+// server has one, and again whenever an admin sends it to every room.
+type MOTD struct {
+	Text string    `json:"text"`
+	Time time.Time `json:"time"`
+}
+
+// Prefs is the user's notification preferences. It's sent after joining a
+// room, and whenever the preferences change. Mention events aren't sent if
+// Notify is "off".
+type Prefs struct {
+	// Notify is "all", "mentions" or "off".
+	Notify string `json:"notify"`
+	// Sound is true if notifications should play a sound.
+	Sound bool `json:"sound"`
+}
+
+// Mention is sent to a user when a message mentions them with "@nick", right
+// after the message event.
+type Mention struct {
+	// ID is the ID of the message.
+	ID string `json:"id"`
+	// Nick is the nickname of the author.
+	Nick string `json:"nick"`
+	// Text is the message text, with any spoilers left out.
+	Text string    `json:"text"`
+	Time time.Time `json:"time"`
+}
@@ -0,0 +1,22 @@
+package main
+
+// This file exposes the JSON event schema from the events package, so
+// alternative front-ends can check which version the server speaks.
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/makeworld-the-better-one/neartalk/events"
+)
+
+// eventsSchemaHandler writes the event schema version, the event types the
+// server can send, and the websocket subprotocols it has for other encodings.
+func eventsSchemaHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(struct {
+		Version      int           `json:"version"`
+		Types        []events.Type `json:"types"`
+		Subprotocols []string      `json:"subprotocols"`
+	}{events.Version, events.Types, []string{events.SubprotocolCBOR}})
+}
@@ -0,0 +1,105 @@
+package main
+
+// This file sends broadcasts to everyone in a room. The room renders each
+// broadcast once, then snapshots who it goes to while holding the clientsMu,
+// and sends it without holding it, so big rooms don't hold up joins, leaves,
+// and commands while every client is written to. Sending only queues frames,
+// see backpressure.go, but in rooms with more than fanOutBatch clients the
+// work is still split between up to fanOutWorkers goroutines.
+
+import (
+	"runtime"
+	"sync"
+)
+
+// fanOutBatch is the fewest clients each goroutine sends a broadcast to.
+// Smaller rooms are sent to by the room's goroutine alone.
+const fanOutBatch = 64
+
+// fanOutWorkers is the most goroutines a broadcast is sent from.
+var fanOutWorkers = runtime.GOMAXPROCS(0)
+
+// recipient is a client a broadcast is sent to, snapshotted so it can be sent
+// without holding the clientsMu.
+type recipient struct {
+	c *client
+	// nick is the client's nickname when the broadcast was sent.
+	nick string
+	// author is true if the client caused the broadcast, and tab is true if
+	// it's another tab of the client that did, see tabs.go.
+	author, tab bool
+}
+
+// send sends the broadcast from the author to everyone in the room, see
+// recipients. Broadcasts are sent one at a time, in the order they're sent in.
+// It holds the client mutex while finding who to send to, but not while
+// sending.
+func (cr *chatRoom) send(b broadcast, author *client) {
+	cr.sendMu.Lock()
+	defer cr.sendMu.Unlock()
+	cr.clientsMu.Lock()
+	rs := cr.recipients(b, author)
+	cr.clientsMu.Unlock()
+	fanOut(b, rs)
+}
+
+// recipients returns who the broadcast from the author should be sent to:
+// everyone in the room, except people ignoring the author if it's a chat
+// message, and anyone watching the room. author can be nil.
+// It does not lock the clientsMu, callers should do that.
+func (cr *chatRoom) recipients(b broadcast, author *client) []recipient {
+	rs := make([]recipient, 0, len(cr.clients)+len(cr.observers))
+	for c := range cr.clients {
+		if b.isChat && c.isIgnoring(author) {
+			continue
+		}
+		rs = append(rs, recipient{
+			c: c, nick: c.nick, author: c == author, tab: c != author && c.isTabOf(author),
+		})
+	}
+	for c := range cr.observers {
+		rs = append(rs, recipient{c: c, nick: c.nick})
+	}
+	return rs
+}
+
+// fanOut sends the broadcast to the recipients, and returns once it's been
+// queued for all of them, so broadcasts are never reordered.
+func fanOut(b broadcast, rs []recipient) {
+	workers := len(rs) / fanOutBatch
+	if workers > fanOutWorkers {
+		workers = fanOutWorkers
+	}
+	if workers <= 1 {
+		for _, r := range rs {
+			r.deliver(b)
+		}
+		return
+	}
+
+	var wg sync.WaitGroup
+	per := (len(rs) + workers - 1) / workers
+	for start := 0; start < len(rs); start += per {
+		end := start + per
+		if end > len(rs) {
+			end = len(rs)
+		}
+		wg.Add(1)
+		go func(rs []recipient) {
+			defer wg.Done()
+			for _, r := range rs {
+				r.deliver(b)
+			}
+		}(rs[start:end])
+	}
+	wg.Wait()
+}
+
+// deliver sends the broadcast to the recipient.
+func (r recipient) deliver(b broadcast) {
+	if r.tab {
+		r.c.deliverToTab(b)
+	} else {
+		r.c.deliverAs(b, r.nick, r.author)
+	}
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+)
+
+func TestFanOut(t *testing.T) {
+	defer func(n int) { fanOutWorkers = n }(fanOutWorkers)
+	fanOutWorkers = 4
+
+	author := &client{session: "a", outgoing: make(chan string, 1), active: true}
+	tab := &client{session: "a", outgoing: make(chan string, 1), active: true}
+	ignoring := &client{session: "i", outgoing: make(chan string, 1), ignored: map[string]bool{"a": true}}
+	cr := &chatRoom{clients: map[*client]struct{}{author: {}, tab: {}, ignoring: {}}}
+	for i := 0; i < 5*fanOutBatch; i++ {
+		cr.clients[&client{session: "other", outgoing: make(chan string, 1), active: true}] = struct{}{}
+	}
+
+	b := broadcast{html: "msg", authorHTML: "mine", isChat: true, id: "01A"}
+	cr.send(b, author)
+	for c := range cr.clients {
+		var got string
+		select {
+		case got = <-c.outgoing:
+		default:
+		}
+		want := "msg"
+		switch c {
+		case author:
+			want = "mine" + clearInputFieldMsg
+		case tab:
+			want = "mine"
+		case ignoring:
+			want = ""
+		}
+		if got != want {
+			t.Errorf("client %s got %q, want %q", c.session, got, want)
+		}
+	}
+}
+
+func BenchmarkFanOut(b *testing.B) {
+	// Clients falling behind are sent a notice once they catch up
+	var err error
+	loadTemplatesOnce.Do(func() { err = loadTemplates(b.TempDir()) })
+	if err != nil {
+		b.Fatal(err)
+	}
+	for _, n := range []int{10, 100, 1000} {
+		b.Run(fmt.Sprint(n), func(b *testing.B) {
+			cr := &chatRoom{clients: make(map[*client]struct{}, n)}
+			var wg sync.WaitGroup
+			for i := 0; i < n; i++ {
+				c := &client{session: fmt.Sprint(i), outgoing: make(chan string, clientMsgBuffer), active: true}
+				cr.clients[c] = struct{}{}
+				// Stand in for the goroutine writing to the connection
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					for range c.outgoing {
+					}
+				}()
+			}
+			bc := broadcast{html: "<p>hello everyone</p>", isChat: true, id: "01A"}
+
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				cr.send(bc, nil)
+			}
+			b.StopTimer()
+			for c := range cr.clients {
+				close(c.outgoing)
+			}
+			wg.Wait()
+		})
+	}
+}
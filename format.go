@@ -0,0 +1,179 @@
+package main
+
+// This file handles the light markdown-style formatting that can be used in
+// chat messages. Message text is always HTML escaped before any of this
+// happens, so the only HTML that ends up in a message is the tags added here.
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+var (
+	// fencedCodeRe matches ```code blocks```. An optional language name
+	// directly after the opening backticks is used for highlighting.
+	fencedCodeRe = regexp.MustCompile("(?s)```(?:([\\w+#-]*)\n)?(.+?)```")
+	// inlineCodeRe matches `inline code`.
+	inlineCodeRe = regexp.MustCompile("`([^`\n]+)`")
+	// spoilerRe matches ||spoiler text||.
+	spoilerRe = regexp.MustCompile(`\|\|([^|]+)\|\|`)
+	// boldRe matches *bold text*. The text can't start or end with a space,
+	// so things like "2 * 3 * 4" aren't made bold.
+	boldRe = regexp.MustCompile(`\*([^*\s](?:[^*]*[^*\s])?)\*`)
+	// italicRe matches _italic text_. The underscores can't be touching
+	// other word characters either, see italicSpans, so snake_case_names
+	// are left alone.
+	italicRe = regexp.MustCompile(`_[^_\s](?:[^_]*[^_\s])?_`)
+)
+
+// splitApply finds all matches of re in s. The submatches of each match are
+// passed to match, and the text in between matches is passed to other.
+// The results are joined and returned.
+func splitApply(s string, re *regexp.Regexp, match func(sub []string) string, other func(string) string) string {
+	var b strings.Builder
+	last := 0
+	for _, idx := range re.FindAllStringSubmatchIndex(s, -1) {
+		b.WriteString(other(s[last:idx[0]]))
+
+		sub := make([]string, len(idx)/2)
+		for i := range sub {
+			if idx[2*i] >= 0 {
+				sub[i] = s[idx[2*i]:idx[2*i+1]]
+			}
+		}
+		b.WriteString(match(sub))
+		last = idx[1]
+	}
+	b.WriteString(other(s[last:]))
+	return b.String()
+}
+
+// linkify turns URLs in the provided HTML escaped text into links. The text
+// that isn't part of a URL is passed to other, and the results are joined.
+func linkify(text string, other func(string) string) string {
+	return splitApply(text, urlRe,
+		func(sub []string) string {
+			return fmt.Sprintf(`<a href="%s" target="_blank" rel="noopener noreferrer">%s</a>`, sub[0], sub[0])
+		},
+		other,
+	)
+}
+
+// emphasis is a bold or italic span of text, from its opening character to
+// just after its closing one.
+type emphasis struct {
+	start, end int
+	tag        string
+}
+
+// isWordByte returns true for the bytes matched by \w in a regexp.
+func isWordByte(b byte) bool {
+	return b == '_' || '0' <= b && b <= '9' || 'a' <= b && b <= 'z' || 'A' <= b && b <= 'Z'
+}
+
+// italicSpans returns the _italic_ spans in the text, whose underscores
+// aren't touching other word characters.
+func italicSpans(text string) []emphasis {
+	var spans []emphasis
+	for pos := 0; pos < len(text); {
+		idx := italicRe.FindStringIndex(text[pos:])
+		if idx == nil {
+			break
+		}
+		start, end := pos+idx[0], pos+idx[1]
+		if (start > 0 && isWordByte(text[start-1])) || (end < len(text) && isWordByte(text[end])) {
+			// The closing underscore might open another span
+			pos = start + 1
+			continue
+		}
+		spans = append(spans, emphasis{start, end, "em"})
+		pos = end
+	}
+	return spans
+}
+
+// formatEmphasis expands emoji shortcodes and applies bold and italic
+// formatting to text. A span that overlaps an earlier one without being
+// inside it is left as it is, since its tags couldn't nest.
+func formatEmphasis(text string) string {
+	text = expandEmoji(text)
+	var spans []emphasis
+	for _, idx := range boldRe.FindAllStringIndex(text, -1) {
+		spans = append(spans, emphasis{idx[0], idx[1], "strong"})
+	}
+	spans = append(spans, italicSpans(text)...)
+	sort.Slice(spans, func(i, j int) bool { return spans[i].start < spans[j].start })
+
+	// The characters around each span that's kept are replaced with tags
+	tags := make(map[int]string)
+	var kept []emphasis
+outer:
+	for _, sp := range spans {
+		for _, k := range kept {
+			if sp.start < k.end && sp.end > k.end {
+				continue outer
+			}
+		}
+		kept = append(kept, sp)
+		tags[sp.start] = "<" + sp.tag + ">"
+		tags[sp.end-1] = "</" + sp.tag + ">"
+	}
+	var b strings.Builder
+	for i := 0; i < len(text); i++ {
+		if tag, ok := tags[i]; ok {
+			b.WriteString(tag)
+		} else {
+			b.WriteByte(text[i])
+		}
+	}
+	return b.String()
+}
+
+// formatSpoilers hides spoilers in the text until they're clicked, and
+// linkifies and formats the rest. Mentions of the nicknames are formatted
+// too, see formatMentions.
+func formatSpoilers(text string, mentions []string) string {
+	format := func(s string) string {
+		return linkify(s, func(s string) string {
+			return formatMentions(s, mentions, formatEmphasis)
+		})
+	}
+	return splitApply(text, spoilerRe,
+		func(sub []string) string {
+			return `<span class="spoiler" tabindex="0" title="Spoiler, click to show">` +
+				format(sub[1]) + `</span>`
+		},
+		format,
+	)
+}
+
+// hideSpoilers replaces spoilers in plain message text, for places where the
+// text is shown without a way to reveal them, like quotes.
+func hideSpoilers(text string) string {
+	return spoilerRe.ReplaceAllString(text, "[spoiler]")
+}
+
+// formatMsgText applies formatting to HTML escaped message text, and
+// linkifies any URLs and mentions of the sanitized nicknames. Code blocks and
+// inline code are left as is, and formatting is never applied inside URLs.
+// Spoilers are hidden until clicked. Newlines outside of code blocks become
+// line breaks, code blocks keep them as they are.
+func formatMsgText(text string, mentions []string) string {
+	return splitApply(text, fencedCodeRe,
+		func(sub []string) string {
+			return fmt.Sprintf(`<pre><code>%s</code></pre>`, highlightCode(sub[2], sub[1]))
+		},
+		func(s string) string {
+			return splitApply(s, inlineCodeRe,
+				func(sub []string) string {
+					return fmt.Sprintf(`<code>%s</code>`, sub[1])
+				},
+				func(s string) string {
+					return breakLines(formatSpoilers(s, mentions))
+				},
+			)
+		},
+	)
+}
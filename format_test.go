@@ -0,0 +1,33 @@
+package main
+
+import "testing"
+
+func TestFormatEmphasis(t *testing.T) {
+	for _, c := range []struct{ text, want string }{
+		{"*bold*", "<strong>bold</strong>"},
+		{"_italic_", "<em>italic</em>"},
+		{"_a_ _b_", "<em>a</em> <em>b</em>"},
+		{"*bold _both_ bold*", "<strong>bold <em>both</em> bold</strong>"},
+		{"_it *both* it_", "<em>it <strong>both</strong> it</em>"},
+		{"2 * 3 * 4", "2 * 3 * 4"},
+		{"snake_case_name", "snake_case_name"},
+		{"a_b_ c_", "a_b_ c_"},
+		{"_a__b_", "_a__b_"},
+		{"(_aside_)", "(<em>aside</em>)"},
+		{"_café_", "<em>café</em>"},
+		// Overlapping spans would misnest, so the later one is left alone
+		{"_a *b_ c*", "<em>a *b</em> c*"},
+		{"*a _b* c_", "<strong>a _b</strong> c_"},
+	} {
+		if got := formatEmphasis(c.text); got != c.want {
+			t.Errorf("formatEmphasis(%q) = %q, want %q", c.text, got, c.want)
+		}
+	}
+}
+
+func TestRenderMsgTextEmphasisNests(t *testing.T) {
+	want := "<em>a *b</em> c*"
+	if got := renderMsgText("_a *b_ c*", nil); got != want {
+		t.Errorf("renderMsgText = %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,149 @@
+package main
+
+// This file groups clients into rooms by where they are, using a MaxMind
+// GeoIP database given with the -geoip-db flag. Mobile carriers often put
+// people in the same place behind many different IP addresses, which would
+// scatter them into separate rooms, so grouping by city or region brings them
+// back together. Clients whose place isn't in the database still get a room
+// for their IP address. With -geoip-level none, rooms aren't grouped, and
+// the database is only used to find nearby rooms, see nearby.go.
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/oschwald/maxminddb-golang"
+)
+
+// GeoIP grouping levels for the -geoip-level flag
+const (
+	geoLevelCity   = "city"
+	geoLevelRegion = "region"
+	geoLevelNone   = "none"
+)
+
+// geoDB is the open GeoIP database, or nil if GeoIP grouping is disabled. It
+// is set by loadGeoIP.
+var geoDB *maxminddb.Reader
+
+// geoRecord holds the parts of a GeoIP City database record that are used.
+type geoRecord struct {
+	City struct {
+		Names map[string]string `maxminddb:"names"`
+	} `maxminddb:"city"`
+	Subdivisions []struct {
+		Names map[string]string `maxminddb:"names"`
+	} `maxminddb:"subdivisions"`
+	Country struct {
+		Names map[string]string `maxminddb:"names"`
+	} `maxminddb:"country"`
+}
+
+// loadGeoIP opens the GeoIP database at path. An empty path disables GeoIP
+// grouping.
+func loadGeoIP(path string) error {
+	if geoLevel != geoLevelCity && geoLevel != geoLevelRegion && geoLevel != geoLevelNone {
+		return fmt.Errorf("invalid GeoIP level %q, must be %q, %q, or %q", geoLevel, geoLevelCity, geoLevelRegion, geoLevelNone)
+	}
+	if path == "" {
+		return nil
+	}
+	db, err := maxminddb.Open(path)
+	if err != nil {
+		return err
+	}
+	if !strings.Contains(db.Metadata.DatabaseType, "City") {
+		db.Close()
+		return fmt.Errorf("%s is a %s database, but a City database is needed", path, db.Metadata.DatabaseType)
+	}
+	geoDB = db
+	if geoLevel == geoLevelNone {
+		log.Printf("not grouping rooms, %s is only used for nearby rooms", db.Metadata.DatabaseType)
+	} else {
+		log.Printf("grouping rooms by %s with %s", geoLevel, db.Metadata.DatabaseType)
+	}
+	return nil
+}
+
+// roomKey returns the key of the room the request's client belongs in. It's
+// the name of the room alias for their address if there is one, see
+// alias.go, the client's place if GeoIP grouping is enabled and the place is
+// known, and their IP address otherwise, see getIPString. With
+// -private-rooms, addresses are hashed, see privateKey.
+func roomKey(r *http.Request) string {
+	if lanMode {
+		return lanRoomKeyFor(clientAddr(r, int(trustedProxies)))
+	}
+	if alias := aliasFor(clientAddr(r, int(trustedProxies))); alias != "" {
+		return alias
+	}
+	ip := getIPString(r)
+	if place := lookupPlace(ip); place != "" {
+		return place
+	}
+	if privateRooms && ip != lanRoomKey {
+		return privateKey(ip)
+	}
+	return ip
+}
+
+// lookupPlace returns the name of the place the IP address is in, at the
+// -geoip-level. It returns an empty string if GeoIP grouping is disabled or
+// the place isn't known.
+func lookupPlace(ip string) string {
+	return lookupPlaceAt(ip, geoLevel)
+}
+
+// lookupPlaceAt is like lookupPlace, but at the given level.
+func lookupPlaceAt(ip, level string) string {
+	if geoDB == nil || level == geoLevelNone {
+		return ""
+	}
+	addr := net.ParseIP(ip)
+	if addr == nil {
+		// Like "lan"
+		return ""
+	}
+	var rec geoRecord
+	if err := geoDB.Lookup(addr, &rec); err != nil {
+		log.Printf("lookupPlace: GeoIP lookup: %v", err)
+		return ""
+	}
+	return placeName(rec, level)
+}
+
+// placeName returns the English name of the place in the record at the given
+// level, like "Toronto, Ontario, Canada" for a city. It returns an empty string
+// if the record doesn't go down to that level.
+func placeName(rec geoRecord, level string) string {
+	country := rec.Country.Names["en"]
+	region := ""
+	if len(rec.Subdivisions) > 0 {
+		region = rec.Subdivisions[0].Names["en"]
+	}
+	city := rec.City.Names["en"]
+
+	var parts []string
+	switch level {
+	case geoLevelCity:
+		if city == "" {
+			return ""
+		}
+		parts = []string{city, region, country}
+	case geoLevelRegion:
+		if region == "" {
+			return ""
+		}
+		parts = []string{region, country}
+	}
+	var name []string
+	for _, p := range parts {
+		if p != "" {
+			name = append(name, p)
+		}
+	}
+	return strings.Join(name, ", ")
+}
@@ -0,0 +1,43 @@
+package main
+
+import "testing"
+
+func TestPlaceName(t *testing.T) {
+	names := func(en string) map[string]string {
+		if en == "" {
+			return nil
+		}
+		return map[string]string{"en": en, "fr": "?"}
+	}
+	record := func(city, region, country string) geoRecord {
+		var rec geoRecord
+		rec.City.Names = names(city)
+		if region != "" {
+			rec.Subdivisions = append(rec.Subdivisions, struct {
+				Names map[string]string `maxminddb:"names"`
+			}{names(region)})
+		}
+		rec.Country.Names = names(country)
+		return rec
+	}
+	tests := []struct {
+		name  string
+		rec   geoRecord
+		level string
+		want  string
+	}{
+		{"city", record("Toronto", "Ontario", "Canada"), geoLevelCity, "Toronto, Ontario, Canada"},
+		{"city without region", record("Singapore", "", "Singapore"), geoLevelCity, "Singapore, Singapore"},
+		{"unknown city", record("", "Ontario", "Canada"), geoLevelCity, ""},
+		{"region", record("Toronto", "Ontario", "Canada"), geoLevelRegion, "Ontario, Canada"},
+		{"unknown region", record("", "", "Canada"), geoLevelRegion, ""},
+		{"empty", geoRecord{}, geoLevelCity, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := placeName(tt.rec, tt.level); got != tt.want {
+				t.Errorf("placeName() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
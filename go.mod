@@ -1,13 +1,24 @@
 module github.com/makeworld-the-better-one/neartalk
 
-go 1.17
+go 1.20
 
 require (
 	github.com/dustin/go-humanize v1.0.1-0.20210705192016-249ff6c91207
+	github.com/fxamacker/cbor/v2 v2.7.0
+	github.com/lib/pq v1.10.9
+	github.com/mattn/go-sqlite3 v1.14.33
+	github.com/oschwald/maxminddb-golang v1.12.0
+	github.com/redis/go-redis/v9 v9.0.5
 	github.com/rivo/uniseg v0.2.0
 	golang.org/x/text v0.3.7
 	golang.org/x/time v0.0.0-20191024005414-555d28b269f0
 	nhooyr.io/websocket v1.8.7
 )
 
-require github.com/klauspost/compress v1.10.3 // indirect
+require (
+	github.com/cespare/xxhash/v2 v2.2.0 // indirect
+	github.com/dgryski/go-rendezvous v0.0.0-20200823014737-9f7001d12a5f // indirect
+	github.com/klauspost/compress v1.10.3 // indirect
+	github.com/x448/float16 v0.8.4 // indirect
+	golang.org/x/sys v0.10.0 // indirect
+)
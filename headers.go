@@ -0,0 +1,48 @@
+package main
+
+// This file sets the security headers sent with every response. The Content
+// Security Policy only lets pages load scripts and styles from NearTalk
+// itself, and the exact versions of htmx and sanitize.css they use from
+// unpkg.com, and only lets NearTalk's own pages show them in a frame.
+// Operators embedding NearTalk in another site can list it in
+// -frame-ancestors, or in -widget-origins to only allow the widget.
+//
+// Inline scripts aren't allowed, the pages' scripts are in the html directory.
+// Inline styles are, as htmx adds some.
+
+import (
+	"net/http"
+	"strings"
+)
+
+// cspSources is the Content Security Policy for every page, except
+// frame-ancestors.
+const cspSources = "default-src 'self'; " +
+	"script-src 'self' https://unpkg.com/htmx.org@1.6.0; " +
+	"style-src 'self' 'unsafe-inline' https://unpkg.com/sanitize.css https://unpkg.com/sanitize.css/; " +
+	"img-src 'self' data:; " +
+	"connect-src 'self'; " +
+	"object-src 'none'; " +
+	"base-uri 'self'; " +
+	"form-action 'self'"
+
+// contentSecurityPolicy returns the Content Security Policy for a page that
+// the origins can show in a frame, as well as NearTalk's own pages.
+func contentSecurityPolicy(frameOrigins []string) string {
+	return cspSources + "; frame-ancestors " + strings.Join(append([]string{"'self'"}, frameOrigins...), " ")
+}
+
+// frameAncestorList returns the origins in -frame-ancestors.
+func frameAncestorList() []string {
+	return originList(frameAncestors)
+}
+
+// setSecurityHeaders sets the security headers for a response. Handlers can
+// replace the Content Security Policy to let more sites frame the page, see
+// widgetHandler.
+func setSecurityHeaders(h http.Header) {
+	h.Set("Content-Security-Policy", contentSecurityPolicy(frameAncestorList()))
+	h.Set("X-Content-Type-Options", "nosniff")
+	// Links in messages shouldn't tell other sites which room they were in
+	h.Set("Referrer-Policy", "same-origin")
+}
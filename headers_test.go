@@ -0,0 +1,47 @@
+package main
+
+import (
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+func TestSecurityHeaders(t *testing.T) {
+	defer func(f string) { frameAncestors = f }(frameAncestors)
+
+	h := http.Header{}
+	setSecurityHeaders(h)
+	csp := h.Get("Content-Security-Policy")
+	if !strings.HasSuffix(csp, "; frame-ancestors 'self'") || !strings.Contains(csp, "script-src 'self' https://unpkg.com/htmx.org@1.6.0;") {
+		t.Errorf("Content-Security-Policy = %q", csp)
+	}
+	if h.Get("X-Content-Type-Options") != "nosniff" || h.Get("Referrer-Policy") != "same-origin" {
+		t.Errorf("headers = %v", h)
+	}
+
+	frameAncestors = "https://example.com, https://intranet.example.org/"
+	setSecurityHeaders(h)
+	if csp := h.Get("Content-Security-Policy"); !strings.HasSuffix(csp, "; frame-ancestors 'self' https://example.com https://intranet.example.org") {
+		t.Errorf("Content-Security-Policy with -frame-ancestors = %q", csp)
+	}
+}
+
+// The Content Security Policy doesn't allow inline scripts, so pages must
+// load them from files.
+func TestNoInlineScripts(t *testing.T) {
+	inline := regexp.MustCompile(`<script(\s+defer)?\s*>|\son[a-z]+="`)
+	pages, _ := filepath.Glob("html/*.html")
+	templates, _ := filepath.Glob("templates/*.html")
+	for _, page := range append(pages, templates...) {
+		b, err := os.ReadFile(page)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if loc := inline.FindIndex(b); loc != nil {
+			t.Errorf("%s has an inline script: %q", page, b[loc[0]:loc[1]])
+		}
+	}
+}
@@ -0,0 +1,115 @@
+package main
+
+// This file handles heartbeats sent by clients. A dead connection can look
+// alive for a long time if nothing is sent over it, so clients send a
+// heartbeat regularly, and are disconnected if they stop. This keeps the user
+// list accurate.
+//
+// Not every client sends heartbeats, so the server also pings every
+// connection, and one that hasn't answered or sent anything in deadAfter is
+// closed. Rooms regularly sweep out clients like that whose connections
+// weren't cleaned up, so they don't linger in the user list as ghosts.
+
+import (
+	"context"
+	"errors"
+	"log"
+	"time"
+
+	"nhooyr.io/websocket"
+)
+
+// heartbeatTimeout is how long a client that sends heartbeats can go without
+// one before being disconnected. Clients send one every 30 seconds, so this
+// allows for a couple to be missed.
+const heartbeatTimeout = 90 * time.Second
+
+var errHeartbeatTimeout = errors.New("no heartbeat received")
+
+// pingInterval is how often connections are pinged.
+const pingInterval = 30 * time.Second
+
+// pingTimeout is how long a client has to answer a ping.
+const pingTimeout = 15 * time.Second
+
+// deadAfter is how long a connection can go without answering a ping or
+// sending anything before it's treated as dead. It allows for a couple of
+// pings to be missed.
+const deadAfter = 3 * pingInterval
+
+var errConnDead = errors.New("connection stopped responding")
+
+// heartbeat records that a heartbeat was received from the client.
+func (c *client) heartbeat() {
+	c.activityMu.Lock()
+	defer c.activityMu.Unlock()
+	c.lastHeartbeat = time.Now()
+}
+
+// heartbeatExpired returns true if the client has sent heartbeats before,
+// but hasn't sent one recently. Clients that have never sent a heartbeat
+// never expire.
+func (c *client) heartbeatExpired() bool {
+	c.activityMu.Lock()
+	defer c.activityMu.Unlock()
+	return !c.lastHeartbeat.IsZero() && time.Since(c.lastHeartbeat) > heartbeatTimeout
+}
+
+// alive records that the connection is alive.
+func (c *client) alive() {
+	c.activityMu.Lock()
+	defer c.activityMu.Unlock()
+	c.lastAlive = time.Now()
+}
+
+// isDead returns true if the connection hasn't been known to be alive for
+// deadAfter.
+func (c *client) isDead() bool {
+	c.activityMu.Lock()
+	defer c.activityMu.Unlock()
+	return time.Since(c.lastAlive) > deadAfter
+}
+
+// ping pings the client's connection, recording that it's alive if it
+// answers.
+func (c *client) ping(ctx context.Context, t transport) {
+	ctx, cancel := context.WithTimeout(ctx, pingTimeout)
+	defer cancel()
+	if t.ping(ctx) == nil {
+		c.alive()
+	}
+}
+
+// sweepGhosts removes the clients whose connections are dead from the room,
+// closing them in case they're still open. The room is told they left, with
+// the corrected user list, and closed if nobody is left.
+func (cr *chatRoom) sweepGhosts() {
+	cr.clientsMu.Lock()
+	var dead []*client
+	for c := range cr.clients {
+		if c.isDead() {
+			dead = append(dead, c)
+		}
+	}
+	cr.clientsMu.Unlock()
+	if len(dead) == 0 {
+		return
+	}
+	log.Printf("chatRoom.sweepGhosts: removing %d dead clients", len(dead))
+	for _, c := range dead {
+		go c.disconnect(websocket.StatusGoingAway, errConnDead.Error())
+		// Not from this goroutine, since the room is closed by telling it
+		go cr.server.removeClient(cr.key, c)
+	}
+}
+
+// queueUserList queues an update of the user list for all clients, without
+// any notification. It's used when user details like idleness change.
+func (cr *chatRoom) queueUserList() {
+	m := createUserListUpdate()
+	select {
+	case cr.incoming <- m:
+	default:
+		// Room is busy, the next user list update will fix it
+	}
+}
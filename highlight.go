@@ -0,0 +1,242 @@
+package main
+
+// This file does syntax highlighting for code blocks in messages, so people
+// sharing snippets can read them more easily. The language comes from the
+// name after the opening backticks, like ```go. It's a simple highlighter,
+// it only knows keywords, strings, comments and numbers, but that's most of
+// what helps when reading a short snippet. Code blocks are limited to
+// maxHighlightLen, larger ones are shown without highlighting.
+
+import (
+	"html"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// maxHighlightLen is the max size in bytes of a code block that will be
+// highlighted.
+const maxHighlightLen = 4000
+
+// codeLang describes the syntax of a language, as far as highlighting goes.
+type codeLang struct {
+	keywords map[string]bool
+	// lineComments start comments that last until the end of the line.
+	lineComments []string
+	// blockComment is the start and end of block comments, if the language
+	// has them.
+	blockComment [2]string
+	// quotes are the characters that start and end strings. Strings can't
+	// go over several lines, except with backticks.
+	quotes string
+}
+
+// words makes a set of the space separated words.
+func words(s string) map[string]bool {
+	m := make(map[string]bool)
+	for _, w := range strings.Fields(s) {
+		m[w] = true
+	}
+	return m
+}
+
+var (
+	cLikeLang = &codeLang{
+		keywords: words(`auto break case char const continue default do double else enum
+			extern float for goto if inline int long register return short signed sizeof
+			static struct switch typedef union unsigned void volatile while bool true false
+			class public private protected new delete this throw try catch namespace using
+			template virtual override final import package extends implements interface
+			null nullptr boolean byte static_cast include define`),
+		lineComments: []string{"//"},
+		blockComment: [2]string{"/*", "*/"},
+		quotes:       `"'`,
+	}
+	codeLangs = map[string]*codeLang{
+		"go": {
+			keywords: words(`break case chan const continue default defer else fallthrough
+				for func go goto if import interface map package range return select struct
+				switch type var nil true false iota`),
+			lineComments: []string{"//"},
+			blockComment: [2]string{"/*", "*/"},
+			quotes:       "\"'`",
+		},
+		"js": {
+			keywords: words(`async await break case catch class const continue debugger
+				default delete do else export extends finally for function if import in
+				instanceof let new of return super switch this throw try typeof var void
+				while with yield null undefined true false interface type enum`),
+			lineComments: []string{"//"},
+			blockComment: [2]string{"/*", "*/"},
+			quotes:       "\"'`",
+		},
+		"python": {
+			keywords: words(`and as assert async await break class continue def del elif
+				else except finally for from global if import in is lambda nonlocal not or
+				pass raise return try while with yield None True False self`),
+			lineComments: []string{"#"},
+			quotes:       `"'`,
+		},
+		"sh": {
+			keywords: words(`if then else elif fi case esac for while until do done in
+				function return local export echo exit`),
+			lineComments: []string{"#"},
+			quotes:       `"'`,
+		},
+		"rust": {
+			keywords: words(`as async await break const continue crate else enum extern
+				false fn for if impl in let loop match mod move mut pub ref return self Self
+				static struct super trait true type unsafe use where while dyn`),
+			lineComments: []string{"//"},
+			blockComment: [2]string{"/*", "*/"},
+			quotes:       `"`,
+		},
+		"sql": {
+			keywords: words(`select from where insert into values update set delete create
+				table drop alter add join left right inner outer on group by order having
+				limit offset as and or not null is in like distinct union all primary key
+				SELECT FROM WHERE INSERT INTO VALUES UPDATE SET DELETE CREATE TABLE DROP
+				ALTER ADD JOIN LEFT RIGHT INNER OUTER ON GROUP BY ORDER HAVING LIMIT OFFSET
+				AS AND OR NOT NULL IS IN LIKE DISTINCT UNION ALL PRIMARY KEY`),
+			lineComments: []string{"--"},
+			blockComment: [2]string{"/*", "*/"},
+			quotes:       `'"`,
+		},
+		"json": {
+			keywords: words(`true false null`),
+			quotes:   `"`,
+		},
+		"c": cLikeLang,
+	}
+	// codeLangAliases maps other names for languages to the ones in codeLangs.
+	codeLangAliases = map[string]string{
+		"golang":     "go",
+		"javascript": "js",
+		"ts":         "js",
+		"typescript": "js",
+		"py":         "python",
+		"bash":       "sh",
+		"shell":      "sh",
+		"zsh":        "sh",
+		"rs":         "rust",
+		"cpp":        "c",
+		"c++":        "c",
+		"h":          "c",
+		"java":       "c",
+		"cs":         "c",
+		"csharp":     "c",
+	}
+)
+
+// findCodeLang returns the language with the given name, or nil if it's not
+// known.
+func findCodeLang(name string) *codeLang {
+	name = strings.ToLower(name)
+	if alias, ok := codeLangAliases[name]; ok {
+		name = alias
+	}
+	return codeLangs[name]
+}
+
+// isWordRune returns true if r can be part of a keyword or name.
+func isWordRune(r rune) bool {
+	return r == '_' || unicode.IsLetter(r) || unicode.IsDigit(r)
+}
+
+// highlightCode returns the HTML escaped code with syntax highlighting for
+// the language. The code is given HTML escaped too, as it is in formatMsgText.
+// If the language isn't known or the code is too big, the code is returned
+// as is.
+func highlightCode(code, langName string) string {
+	lang := findCodeLang(langName)
+	if lang == nil || len(code) > maxHighlightLen {
+		return code
+	}
+	code = html.UnescapeString(code)
+
+	var b strings.Builder
+	span := func(class, s string) {
+		b.WriteString(`<span class="hl-` + class + `">` + html.EscapeString(s) + `</span>`)
+	}
+	for i := 0; i < len(code); {
+		rest := code[i:]
+		if n := lang.commentLen(rest); n > 0 {
+			span("c", rest[:n])
+			i += n
+			continue
+		}
+		r, size := utf8.DecodeRuneInString(rest)
+		switch {
+		case strings.ContainsRune(lang.quotes, r):
+			n := stringLen(rest, r)
+			span("s", rest[:n])
+			i += n
+		case unicode.IsDigit(r):
+			n := wordLen(rest, true)
+			span("n", rest[:n])
+			i += n
+		case isWordRune(r):
+			n := wordLen(rest, false)
+			if lang.keywords[rest[:n]] {
+				span("k", rest[:n])
+			} else {
+				b.WriteString(html.EscapeString(rest[:n]))
+			}
+			i += n
+		default:
+			b.WriteString(html.EscapeString(rest[:size]))
+			i += size
+		}
+	}
+	return b.String()
+}
+
+// commentLen returns the length of the comment s starts with, or zero if it
+// doesn't start with one. A block comment that isn't closed goes until the
+// end of s.
+func (lang *codeLang) commentLen(s string) int {
+	for _, lc := range lang.lineComments {
+		if strings.HasPrefix(s, lc) {
+			if n := strings.IndexByte(s, '\n'); n != -1 {
+				return n
+			}
+			return len(s)
+		}
+	}
+	start, end := lang.blockComment[0], lang.blockComment[1]
+	if start != "" && strings.HasPrefix(s, start) {
+		if n := strings.Index(s[len(start):], end); n != -1 {
+			return len(start) + n + len(end)
+		}
+		return len(s)
+	}
+	return 0
+}
+
+// stringLen returns the length of the string s starts with, which is quoted
+// with q. Backslashes escape the next character. Strings end at a newline if
+// they aren't closed, unless they're quoted with backticks.
+func stringLen(s string, q rune) int {
+	for i := 1; i < len(s); i++ {
+		switch {
+		case s[i] == '\\' && q != '`':
+			i++
+		case rune(s[i]) == q:
+			return i + 1
+		case s[i] == '\n' && q != '`':
+			return i
+		}
+	}
+	return len(s)
+}
+
+// wordLen returns the length of the word s starts with. Dots are part of the
+// word if dots is true, for numbers like 1.5.
+func wordLen(s string, dots bool) int {
+	for i, r := range s {
+		if !isWordRune(r) && !(dots && r == '.') {
+			return i
+		}
+	}
+	return len(s)
+}
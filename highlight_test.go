@@ -0,0 +1,54 @@
+package main
+
+import (
+	"html"
+	"strings"
+	"testing"
+)
+
+func TestHighlightCode(t *testing.T) {
+	tests := []struct {
+		code string
+		lang string
+		want string
+	}{
+		{"x := 1", "", "x := 1"},
+		{"x := 1", "nope", "x := 1"},
+		{
+			"func f() { // hi\n\treturn \"a\\\"b\" }",
+			"go",
+			`<span class="hl-k">func</span> f() { <span class="hl-c">// hi</span>` + "\n\t" +
+				`<span class="hl-k">return</span> <span class="hl-s">&#34;a\&#34;b&#34;</span> }`,
+		},
+		{
+			"if x < 1.5: pass # done",
+			"PY",
+			`<span class="hl-k">if</span> x &lt; <span class="hl-n">1.5</span>: <span class="hl-k">pass</span> <span class="hl-c"># done</span>`,
+		},
+		{
+			"/* unclosed\nint x",
+			"c++",
+			`<span class="hl-c">/* unclosed` + "\n" + `int x</span>`,
+		},
+		{"'unclosed\nselect", "sql", `<span class="hl-s">&#39;unclosed</span>` + "\n" + `<span class="hl-k">select</span>`},
+		{"self.x", "python", `<span class="hl-k">self</span>.x`},
+	}
+	for _, tt := range tests {
+		if got := highlightCode(html.EscapeString(tt.code), tt.lang); got != tt.want {
+			t.Errorf("highlightCode(%q, %q) =\n%s\nwant\n%s", tt.code, tt.lang, got, tt.want)
+		}
+	}
+
+	big := strings.Repeat("return ", maxHighlightLen)
+	if got := highlightCode(big, "go"); got != big {
+		t.Error("code longer than maxHighlightLen was highlighted")
+	}
+}
+
+func TestFormatCodeBlock(t *testing.T) {
+	got := renderMsgText("```go\nvar x = *y*\n```", nil)
+	want := `<pre><code><span class="hl-k">var</span> x = *y*` + "\n" + `</code></pre>`
+	if got != want {
+		t.Errorf("renderMsgText of a Go code block = %q, want %q", got, want)
+	}
+}
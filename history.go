@@ -0,0 +1,228 @@
+package main
+
+// This file keeps the history of rooms with -history, so people who join a
+// room see the messages sent before they did, and can search them, see
+// search.go. Joining sends the most recent -history messages, and older pages
+// of the same size are sent when the client asks, as the web UI does when
+// scrolled to the top. The room keeps track of the oldest message each client
+// was sent, so clients don't need to say where a page starts. Chat messages
+// are kept in the storage, see storage.go, by room key, and edits and
+// deletions are applied to them. End-to-end encrypted messages are never
+// kept, see e2ee.go. With -retention, messages older than that are deleted,
+// and erasing a room's data deletes its history, see erasure.go.
+
+import (
+	"fmt"
+	"html/template"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/makeworld-the-better-one/neartalk/events"
+)
+
+// maxHistoryLen is the max value of -history.
+const maxHistoryLen = 500
+
+// historyMsg is a chat message kept in a room's history.
+type historyMsg struct {
+	ID      string
+	Room    string
+	ReplyTo string
+	Nick    string // Sanitized
+	Text    string // Unsanitized
+	Time    time.Time
+	Bot     bool
+	Edited  bool
+}
+
+// validateHistory checks the -history flag.
+func validateHistory() error {
+	if historyLen > maxHistoryLen {
+		return fmt.Errorf("-history can't be more than %d", maxHistoryLen)
+	}
+	return nil
+}
+
+// recordHistory adds the chat message to the room's history, if -history is
+// set. It's written in the background, see historywriter.go.
+func (cr *chatRoom) recordHistory(m msg) {
+	if historyLen == 0 {
+		return
+	}
+	store := cr.server.store
+	hm := historyMsg{
+		ID:      m.id,
+		Room:    cr.key,
+		ReplyTo: m.replyTo,
+		Nick:    m.nick,
+		Text:    m.text,
+		Time:    m.when.UTC(),
+		Bot:     m.author != nil && m.author.bot != nil,
+	}
+	cr.server.historyWriter.add(historyWrite{room: cr.key, what: "adding a message", f: func() error {
+		return store.appendHistory(hm)
+	}}, false)
+}
+
+// editHistory replaces the text of a message in the room's history.
+func (cr *chatRoom) editHistory(id, text string) {
+	if historyLen == 0 {
+		return
+	}
+	store, key := cr.server.store, cr.key
+	cr.server.historyWriter.add(historyWrite{room: key, what: "editing a message", f: func() error {
+		return store.editHistory(key, id, text)
+	}}, false)
+}
+
+// deleteHistory removes a message from the room's history.
+func (cr *chatRoom) deleteHistory(id string) {
+	if historyLen == 0 {
+		return
+	}
+	store, key := cr.server.store, cr.key
+	cr.server.historyWriter.add(historyWrite{room: key, what: "deleting a message", f: func() error {
+		return store.deleteHistory(key, id)
+	}}, false)
+}
+
+// clearHistory erases the room's history, after the changes queued before it.
+// It waits for room in the queue rather than dropping the erase, but not for
+// the erase itself.
+func (cr *chatRoom) clearHistory() {
+	if historyLen == 0 {
+		return
+	}
+	store, key := cr.server.store, cr.key
+	cr.server.historyWriter.add(historyWrite{room: key, what: "clearing the history", f: func() error {
+		return store.eraseHistory(key)
+	}}, true)
+}
+
+// loadHistory returns the most recent messages in the room's history to show
+// someone joining, oldest first.
+func (cr *chatRoom) loadHistory() []historyMsg {
+	if historyLen == 0 {
+		return nil
+	}
+	cr.server.historyWriter.wait(cr.key)
+	ms, err := cr.server.store.loadHistory(cr.key, "", int(historyLen))
+	if err != nil {
+		log.Printf("chatRoom.loadHistory: %v", err)
+	}
+	return ms
+}
+
+// historyCursor returns where the page of history before the messages starts,
+// or empty if there are no older messages.
+func historyCursor(ms []historyMsg) string {
+	if len(ms) < int(historyLen) {
+		return ""
+	}
+	return ms[0].ID
+}
+
+// createHistoryMoreMsg tells the web UI whether there is older history to ask
+// for.
+func createHistoryMoreMsg(more bool) string {
+	return fmt.Sprintf(`<div id="history-more" data-more="%t" hx-swap-oob="true"></div>`, more)
+}
+
+// sendHistory sends the messages from the room's history to the client as it
+// joins. It's only called by the room's goroutine.
+func sendHistory(c *client, ms []historyMsg) {
+	if historyLen == 0 {
+		return
+	}
+	c.historyCursor = historyCursor(ms)
+	if !c.isJSON() {
+		frame := createHistoryMoreMsg(c.historyCursor != "")
+		if len(ms) > 0 {
+			frame = appendToLog(renderHistory(ms)) + frame
+		}
+		c.sendFrame(frame)
+		return
+	}
+	for _, m := range ms {
+		c.sendFrame(encodeEvent(events.TypeMessage, historyEvent(m)))
+	}
+}
+
+// sendOlderHistory sends the client the page of the room's history before
+// the oldest message it was sent. It's only called by the room's goroutine.
+func (cr *chatRoom) sendOlderHistory(c *client) {
+	if historyLen == 0 {
+		c.sendError("Message history isn't kept on this server")
+		return
+	}
+	var ms []historyMsg
+	if c.historyCursor != "" {
+		cr.server.historyWriter.wait(cr.key)
+		var err error
+		ms, err = cr.server.store.loadHistory(cr.key, c.historyCursor, int(historyLen))
+		if err != nil {
+			log.Printf("chatRoom.sendOlderHistory: %v", err)
+			c.sendError("Loading older messages failed, try again later")
+			return
+		}
+		c.historyCursor = historyCursor(ms)
+	}
+	more := c.historyCursor != ""
+
+	if c.isJSON() {
+		e := events.History{Messages: make([]events.Message, len(ms)), More: more}
+		for i, m := range ms {
+			e.Messages[i] = historyEvent(m)
+		}
+		c.sendEvent(events.TypeHistory, e)
+		return
+	}
+	frame := createHistoryMoreMsg(more)
+	if len(ms) > 0 {
+		frame = prependToLog(renderHistory(ms)) + frame
+	}
+	c.sendFrame(frame)
+}
+
+// historyEvent converts a message from the history for JSON clients.
+func historyEvent(m historyMsg) events.Message {
+	return events.Message{
+		ID:      m.ID,
+		ReplyTo: m.ReplyTo,
+		Nick:    plainNick(m.Nick),
+		Text:    m.Text,
+		HTML:    renderMsgText(m.Text, nil),
+		Edited:  m.Edited,
+		Time:    m.Time,
+		Bot:     m.Bot,
+		History: true,
+	}
+}
+
+// renderHistory renders the messages for the web UI. Replies quote the
+// messages they reply to if those are among the messages.
+func renderHistory(ms []historyMsg) string {
+	var b strings.Builder
+	for i, m := range ms {
+		data := chatMsgData{
+			ID:      m.ID,
+			Time:    m.Time.UTC().Format(time.RFC3339),
+			Nick:    nickHTML(m.Nick),
+			Text:    template.HTML(renderMsgText(m.Text, nil)),
+			Edited:  m.Edited,
+			Bot:     m.Bot,
+			History: true,
+		}
+		if m.ReplyTo != "" {
+			for _, q := range ms[:i] {
+				if q.ID == m.ReplyTo {
+					data.Quote = &quoteData{ID: q.ID, Nick: nickHTML(q.Nick), Text: template.HTML(quoteText(q.Text))}
+					break
+				}
+			}
+		}
+		b.WriteString(renderTemplate("message.html", data))
+	}
+	return b.String()
+}
@@ -0,0 +1,33 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRenderHistory(t *testing.T) {
+	var err error
+	loadTemplatesOnce.Do(func() { err = loadTemplates(t.TempDir()) })
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	rows := renderHistory([]historyMsg{
+		{ID: "01A", Nick: "ann", Text: "hi <b>", Time: now},
+		{ID: "01B", ReplyTo: "01A", Nick: "bob", Text: "hello", Time: now, Edited: true},
+		{ID: "01C", ReplyTo: "01X", Nick: "bob", Text: "what?", Time: now},
+	})
+	if strings.Count(rows, `data-history="true"`) != 3 {
+		t.Errorf("history %s doesn't mark every message", rows)
+	}
+	if strings.Contains(rows, "<b>") {
+		t.Errorf("history %s isn't escaped", rows)
+	}
+	if strings.Count(rows, `data-reply-to="01A"`) != 1 || strings.Contains(rows, "01X") {
+		t.Errorf("history %s should only quote messages in it", rows)
+	}
+	if !strings.Contains(rows, "(edited)") {
+		t.Errorf("history %s doesn't show the edit", rows)
+	}
+}
@@ -0,0 +1,120 @@
+package main
+
+// This file writes changes to message history in the background, see
+// history.go. Rooms hand each new message, edit and deletion to a single
+// writer goroutine and carry on, so a slow database never holds up sending
+// messages to a room. Changes are written in the order they were made.
+// Reading a room's history first waits for its queued changes, so someone
+// joining sees the messages sent just before they did.
+
+import (
+	"log"
+	"sync"
+	"time"
+)
+
+// historyQueueLen is how many changes can wait to be written. Past that,
+// new ones are dropped until the storage catches up.
+const historyQueueLen = 1024
+
+// historyWrite is a change to a room's history waiting to be written.
+type historyWrite struct {
+	room string
+	// what says what the change is, for the log.
+	what string
+	f    func() error
+}
+
+// historyWriter writes changes to the history in its own goroutine.
+type historyWriter struct {
+	queue chan historyWrite
+
+	mu sync.Mutex
+	// pending counts each room's changes waiting to be written, and drained
+	// is closed once a room has none.
+	pending map[string]int
+	drained map[string]chan struct{}
+}
+
+// newHistoryWriter starts a history writer. Its goroutine runs for as long
+// as the program does.
+func newHistoryWriter() *historyWriter {
+	w := &historyWriter{
+		queue:   make(chan historyWrite, historyQueueLen),
+		pending: make(map[string]int),
+		drained: make(map[string]chan struct{}),
+	}
+	go w.run()
+	return w
+}
+
+func (w *historyWriter) run() {
+	for hw := range w.queue {
+		if err := hw.f(); err != nil {
+			log.Printf("historyWriter: %s in room %s: %v", hw.what, hw.room, err)
+		}
+		w.written(hw.room)
+	}
+}
+
+// written counts a change to the room as done.
+func (w *historyWriter) written(room string) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.pending[room]--
+	if w.pending[room] == 0 {
+		close(w.drained[room])
+		delete(w.pending, room)
+		delete(w.drained, room)
+	}
+}
+
+// add queues the change. If the queue is full, the change is dropped, unless
+// block is true, and then add waits for room in the queue.
+func (w *historyWriter) add(hw historyWrite, block bool) {
+	w.mu.Lock()
+	if w.pending[hw.room] == 0 {
+		w.drained[hw.room] = make(chan struct{})
+	}
+	w.pending[hw.room]++
+	w.mu.Unlock()
+
+	if block {
+		w.queue <- hw
+		return
+	}
+	select {
+	case w.queue <- hw:
+	default:
+		log.Printf("historyWriter: queue is full, dropping %s in room %s", hw.what, hw.room)
+		w.written(hw.room)
+	}
+}
+
+// wait waits until the changes to the room queued so far are written, or
+// sqlTimeout has passed.
+func (w *historyWriter) wait(room string) {
+	w.mu.Lock()
+	drained := w.drained[room]
+	w.mu.Unlock()
+	if drained == nil {
+		return
+	}
+	t := time.NewTimer(sqlTimeout)
+	defer t.Stop()
+	select {
+	case <-drained:
+	case <-t.C:
+	}
+}
+
+// erase deletes the room's history from the storage once the changes queued
+// before are written, and returns when it's done.
+func (w *historyWriter) erase(store storage, room string) error {
+	errc := make(chan error, 1)
+	w.add(historyWrite{room: room, what: "erasing", f: func() error {
+		errc <- store.eraseHistory(room)
+		return nil
+	}}, true)
+	return <-errc
+}
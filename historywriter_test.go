@@ -0,0 +1,38 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/makeworld-the-better-one/neartalk/ids"
+)
+
+func TestHistoryWriter(t *testing.T) {
+	w := newHistoryWriter()
+	store := &memoryStorage{}
+	unblock := make(chan struct{})
+	w.add(historyWrite{room: "a", what: "waiting", f: func() error {
+		<-unblock
+		return nil
+	}}, false)
+	for _, text := range []string{"one", "two", "three"} {
+		m := historyMsg{ID: ids.New(), Room: "a", Text: text, Time: time.Now()}
+		w.add(historyWrite{room: "a", what: "adding", f: func() error { return store.appendHistory(m) }}, false)
+	}
+	// Other rooms don't wait
+	w.wait("b")
+
+	time.AfterFunc(10*time.Millisecond, func() { close(unblock) })
+	w.wait("a")
+	ms, err := store.loadHistory("a", "", 10)
+	if err != nil || len(ms) != 3 || ms[0].Text != "one" || ms[2].Text != "three" {
+		t.Fatalf("history after waiting = %+v, %v, want the three in order", ms, err)
+	}
+
+	if err := w.erase(store, "a"); err != nil {
+		t.Fatal(err)
+	}
+	if ms, _ := store.loadHistory("a", "", 10); len(ms) != 0 {
+		t.Errorf("history after erasing = %+v", ms)
+	}
+}
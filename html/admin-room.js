@@ -0,0 +1,17 @@
+// The admin page for watching a room, see observe.go.
+
+htmx.on("htmx:load", function(evt) {
+    var parent = evt.detail.elt.parentElement
+    if (parent == null || parent.id != "message-table-tbody") {
+        return
+    }
+    // Convert UTC datetime from server into local timestamp
+    var ts = evt.detail.elt.cells[0]
+    if (ts.textContent != "") {
+        ts.textContent = new Date(ts.textContent).toLocaleTimeString()
+    }
+})
+
+var params = new URLSearchParams(location.search)
+document.getElementById("room-name").textContent = params.get("name") || params.get("room")
+document.getElementById("watch").setAttribute("hx-ws", "connect:/admin-room/ws" + location.search)
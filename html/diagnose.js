@@ -0,0 +1,91 @@
+// The connection test page, see diagnose.go.
+
+// Each test calls done with whether it worked and some details.
+// timeout is in milliseconds.
+function withTimeout(timeout, test) {
+    return new Promise(function(resolve) {
+        var finished = false
+        function done(ok, detail) {
+            if (!finished) {
+                finished = true
+                resolve({ok: ok, detail: detail})
+            }
+        }
+        setTimeout(function() { done(false, "Timed out") }, timeout)
+        try {
+            test(done)
+        } catch (e) {
+            done(false, e.toString())
+        }
+    })
+}
+
+function testWebSocket() {
+    return withTimeout(8000, function(done) {
+        var proto = location.protocol == "https:" ? "wss://" : "ws://"
+        var ws = new WebSocket(proto + location.host + "/diagnose/ws")
+        ws.onopen = function() { ws.send("ping") }
+        ws.onmessage = function(evt) {
+            done(evt.data == "ping", "Connected and echoed a message")
+            ws.close()
+        }
+        ws.onerror = function() { done(false, "Couldn't connect") }
+    })
+}
+
+function testSSE() {
+    return withTimeout(8000, function(done) {
+        var start = Date.now()
+        var es = new EventSource("/diagnose/sse")
+        es.addEventListener("ok", function() {
+            es.close()
+            var took = Date.now() - start
+            if (took > 4000) {
+                done(false, "Events were delayed by " + took + "ms, something is buffering them")
+            } else {
+                done(true, "Received a streamed event")
+            }
+        })
+        es.onerror = function() {
+            es.close()
+            done(false, "Couldn't connect")
+        }
+    })
+}
+
+function testLongPoll() {
+    return withTimeout(10000, function(done) {
+        fetch("/diagnose/poll", {cache: "no-store"}).then(function(resp) {
+            return resp.text().then(function(text) {
+                done(resp.ok && text == "ok", "A request held open for a few seconds completed")
+            })
+        }).catch(function(e) { done(false, e.toString()) })
+    })
+}
+
+function show(id, result) {
+    var row = document.getElementById(id)
+    row.cells[1].textContent = result.ok ? "Works" : "Doesn't work"
+    row.cells[1].style.color = result.ok ? "green" : "red"
+    row.cells[2].textContent = result.detail
+}
+
+document.addEventListener("DOMContentLoaded", function() {
+    Promise.all([
+        testWebSocket().then(function(r) { show("test-ws", r); return r }),
+        testSSE().then(function(r) { show("test-sse", r); return r }),
+        testLongPoll().then(function(r) { show("test-poll", r); return r }),
+    ]).then(function(results) {
+        var summary = document.getElementById("summary")
+        if (results[0].ok) {
+            summary.textContent = "WebSockets work, so NearTalk should work on this network. " +
+                "If it doesn't, try reloading the page."
+        } else if (results[1].ok || results[2].ok) {
+            summary.textContent = "WebSockets are blocked on this network, but other ways of " +
+                "connecting work. NearTalk will use them when it can."
+        } else {
+            summary.textContent = "Nothing worked. This network is probably blocking NearTalk, " +
+                "try another one, or ask the network administrator."
+        }
+    })
+})
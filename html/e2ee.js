@@ -0,0 +1,128 @@
+// End-to-end encryption, for servers started with -e2ee, see e2ee.go.
+//
+// Everyone who wants to read the encrypted messages in a room sends
+// "/e2ee <passphrase>" with the same passphrase, agreed on some other way.
+// The command is never sent to the server. The passphrase is turned into an
+// AES-GCM key with PBKDF2, salted with the room name, and from then on
+// messages are encrypted before they're sent, until "/e2ee off". Commands
+// are still sent as usual, since the server has to read them.
+(function() {
+    var key = null
+    var encoder = new TextEncoder()
+    var decoder = new TextDecoder()
+    var label = "Encrypted message"
+
+    function deriveKey(passphrase) {
+        var room = document.getElementById("ip-addr").textContent
+        return crypto.subtle.importKey("raw", encoder.encode(passphrase), "PBKDF2", false, ["deriveKey"]).then(function(base) {
+            return crypto.subtle.deriveKey(
+                {name: "PBKDF2", salt: encoder.encode("neartalk e2ee " + room), iterations: 250000, hash: "SHA-256"},
+                base, {name: "AES-GCM", length: 256}, false, ["encrypt", "decrypt"]
+            )
+        })
+    }
+
+    function toBase64(bytes) {
+        var s = ""
+        for (var i = 0; i < bytes.length; i++) {
+            s += String.fromCharCode(bytes[i])
+        }
+        return btoa(s)
+    }
+
+    function fromBase64(s) {
+        var raw = atob(s)
+        var bytes = new Uint8Array(raw.length)
+        for (var i = 0; i < raw.length; i++) {
+            bytes[i] = raw.charCodeAt(i)
+        }
+        return bytes
+    }
+
+    // The ciphertext is the 12 byte nonce followed by the encrypted text
+    // and its tag
+    function encrypt(text) {
+        var iv = crypto.getRandomValues(new Uint8Array(12))
+        return crypto.subtle.encrypt({name: "AES-GCM", iv: iv}, key, encoder.encode(text)).then(function(ct) {
+            var out = new Uint8Array(iv.length + ct.byteLength)
+            out.set(iv)
+            out.set(new Uint8Array(ct), iv.length)
+            return toBase64(out)
+        })
+    }
+
+    function decrypt(elt) {
+        elt.textContent = label
+        elt.classList.remove("decrypted")
+        if (key == null) {
+            return
+        }
+        var data = fromBase64(elt.dataset.ciphertext)
+        crypto.subtle.decrypt({name: "AES-GCM", iv: data.slice(0, 12)}, key, data.slice(12)).then(function(pt) {
+            elt.textContent = decoder.decode(pt)
+            elt.classList.add("decrypted")
+        }).catch(function() {
+            // Sent with a different passphrase
+        })
+    }
+
+    function decryptAll() {
+        document.querySelectorAll("#message-table-tbody .encrypted").forEach(decrypt)
+    }
+
+    // The placeholder shows whether messages will be encrypted
+    function showStatus() {
+        document.getElementById("message-input").placeholder = key == null ? "" : "Messages are end-to-end encrypted"
+    }
+
+    function setPassphrase(passphrase) {
+        document.getElementById("message-input").value = ""
+        if (passphrase == "" || passphrase == "off") {
+            key = null
+            showStatus()
+            decryptAll()
+            return
+        }
+        deriveKey(passphrase).then(function(k) {
+            key = k
+            showStatus()
+            decryptAll()
+        })
+    }
+
+    // Runs before htmx or fallback.js send the form, so the text can be kept
+    // from them
+    document.addEventListener("submit", function(evt) {
+        if (evt.target.id != "send-form") {
+            return
+        }
+        var input = document.getElementById("message-input")
+        var text = input.value.trim()
+        if (text == "/e2ee" || text.startsWith("/e2ee ")) {
+            evt.preventDefault()
+            evt.stopImmediatePropagation()
+            setPassphrase(text.slice("/e2ee".length).trim())
+            return
+        }
+        if (key == null || text == "" || text.startsWith("/")) {
+            return
+        }
+        evt.preventDefault()
+        evt.stopImmediatePropagation()
+        encrypt(text).then(function(ct) {
+            document.getElementById("ciphertext-input").value = ct
+            htmx.trigger("#e2ee-form", "e2ee")
+        })
+    }, true)
+
+    htmx.on("htmx:load", function(evt) {
+        if (evt.detail.elt.id == "message-input") {
+            // The server replaces the input after each message
+            showStatus()
+            return
+        }
+        if (evt.detail.elt.querySelectorAll) {
+            evt.detail.elt.querySelectorAll(".encrypted").forEach(decrypt)
+        }
+    })
+})()
@@ -0,0 +1,158 @@
+// Falls back to other transports when the websocket doesn't work, which
+// happens on networks that block websockets. Server-Sent Events are tried
+// first, and then long polling. Messages from the server are swapped in like
+// htmx does for websocket messages, and forms using hx-ws="send" are POSTed to
+// the transport's send endpoint instead. See sse.go and poll.go.
+(function() {
+    // How long to wait for each transport to connect before trying the next
+    var fallbackAfter = 8000
+
+    // room is the named room to join, if any, see namedroom.go, and invite
+    // is the invite being used, see invite.go
+    var room = document.body.dataset.room
+    var invite = document.body.dataset.invite
+    var roomQuery = room ? "room=" + encodeURIComponent(room) : invite ? "invite=" + encodeURIComponent(invite) : ""
+
+    var transport = null
+    // sendURL is where messages go, it's null until connected
+    var sendURL = null
+
+    // Swaps a frame from the server into the page, like htmx does with
+    // hx-swap-oob for websocket messages.
+    function applyFrame(html) {
+        var tmpl = document.createElement("template")
+        tmpl.innerHTML = html
+        Array.from(tmpl.content.children).forEach(function(elt) {
+            var target = document.getElementById(elt.id)
+            if (target == null) {
+                return
+            }
+            var added = []
+            var swap = elt.getAttribute("hx-swap-oob")
+            if (swap == "beforeend") {
+                added = Array.from(elt.children)
+                added.forEach(function(child) { target.appendChild(child) })
+            } else if (swap == "afterbegin") {
+                added = Array.from(elt.children)
+                target.prepend.apply(target, added)
+            } else {
+                elt.removeAttribute("hx-swap-oob")
+                target.replaceWith(elt)
+                added = [elt]
+            }
+            added.forEach(function(e) {
+                htmx.process(e)
+                htmx.trigger(e, "htmx:load", {elt: e})
+            })
+        })
+    }
+
+    function send(form) {
+        var data = {}
+        new FormData(form).forEach(function(value, key) { data[key] = value })
+        fetch(sendURL, {
+            method: "POST",
+            headers: {"Content-Type": "application/json"},
+            body: JSON.stringify(data)
+        })
+    }
+
+    // Catch form sends before htmx does, in the capture phase
+    function intercept(evt) {
+        if (transport == null) {
+            return
+        }
+        var form = evt.target.closest && evt.target.closest("form[hx-ws]")
+        if (form == null) {
+            return
+        }
+        evt.preventDefault()
+        evt.stopImmediatePropagation()
+        if (sendURL != null) {
+            send(form)
+        }
+    }
+    document.addEventListener("submit", intercept, true)
+    document.addEventListener("activity", intercept, true)
+    document.addEventListener("e2ee", intercept, true)
+    document.addEventListener("older", intercept, true)
+
+    function stopWebSocket() {
+        // Stop htmx from using or reconnecting the websocket
+        var data = document.body["htmx-internal-data"]
+        if (data && data.webSocket) {
+            data.webSocket.onmessage = null
+            data.webSocket.onclose = null
+            data.webSocket.close()
+        }
+        window.WebSocket = function() {
+            this.readyState = 3
+            this.send = function() {}
+            this.close = function() {}
+            this.addEventListener = function() {}
+        }
+    }
+
+    function startSSE() {
+        transport = "sse"
+        var es = new EventSource(roomQuery ? "/sse?" + roomQuery : "/sse")
+        es.addEventListener("connection", function(evt) {
+            sendURL = "/sse/send?id=" + encodeURIComponent(evt.data)
+        })
+        es.onmessage = function(evt) {
+            applyFrame(evt.data)
+        }
+        es.addEventListener("close", function() {
+            // The server closed the connection on purpose, don't reconnect
+            sendURL = null
+            es.close()
+        })
+        setTimeout(function() {
+            if (transport == "sse" && sendURL == null) {
+                // Events are blocked or buffered
+                es.close()
+                startPolling()
+            }
+        }, fallbackAfter)
+    }
+
+    function startPolling() {
+        transport = "poll"
+        fetch(roomQuery ? "/poll?" + roomQuery : "/poll", {method: "POST"}).then(function(resp) {
+            if (resp.status == 503) {
+                // Too many people are connecting, see pacing.go
+                location.href = "/busy.html"
+            }
+            return resp.json()
+        }).then(function(data) {
+            var id = encodeURIComponent(data.id)
+            sendURL = "/poll/send?id=" + id
+            poll("/poll?id=" + id)
+        })
+    }
+
+    function poll(url) {
+        fetch(url, {cache: "no-store"}).then(function(resp) {
+            if (!resp.ok) {
+                throw new Error(resp.status)
+            }
+            return resp.json()
+        }).then(function(data) {
+            data.frames.forEach(applyFrame)
+            if (data.closed) {
+                sendURL = null
+                return
+            }
+            poll(url)
+        }).catch(function() {
+            sendURL = null
+        })
+    }
+
+    setTimeout(function() {
+        if (document.getElementById("ip-addr").textContent == "") {
+            stopWebSocket()
+            startSSE()
+        }
+    }, fallbackAfter)
+})()
@@ -0,0 +1,271 @@
+// The chat page: notifications, replying and editing by clicking or with the
+// keyboard, Web Push, and telling the server whether the chat is being looked
+// at. The chat itself is swapped in by htmx.
+
+htmx.on("htmx:load", function(evt) {
+    if (evt.detail.elt.id == "unread") {
+        // Show unread message count in tab title
+        var count = parseInt(evt.detail.elt.dataset.count)
+        document.title = count > 0 ? "(" + count + ") NearTalk" : "NearTalk"
+        return
+    }
+    if (evt.detail.elt.id == "alert") {
+        // A message the user wants to know about, alert them if
+        // they're not looking
+        var a = evt.detail.elt.dataset
+        if (document.hasFocus()) {
+            return
+        }
+        if (a.sound == "true") {
+            playAlertSound()
+        }
+        if (window.Notification && Notification.permission == "granted") {
+            // The nick is isolated so right-to-left names don't reorder the title
+            var nick = "\u2068" + a.nick + "\u2069"
+            var title = a.mention == "true" ? nick + " mentioned you" : nick
+            var n = new Notification(title, {body: a.text, tag: a.msgId})
+            n.onclick = function() { window.focus(); n.close() }
+        }
+        return
+    }
+    if (evt.detail.elt.id == "prefs") {
+        // Server sent the notification preferences for this session
+        document.getElementById("notify-select").value = evt.detail.elt.dataset.notify
+        document.getElementById("sound-select").value = evt.detail.elt.dataset.sound == "true" ? "on" : "off"
+        return
+    }
+    if (evt.detail.elt.id == "ip-addr") {
+        // Connected, tell the server the connection works both ways
+        document.getElementById("connection-warning").hidden = true
+        // A page of history asked for before reconnecting won't come
+        historyHeight = null
+        sendActivity()
+        return
+    }
+    if (evt.detail.elt.id == "search-results") {
+        // Convert UTC datetimes from server into local timestamps
+        evt.detail.elt.querySelectorAll(".search-time").forEach(function(ts) {
+            ts.textContent = new Date(ts.textContent).toLocaleString()
+        })
+        return
+    }
+    if (evt.detail.elt.id == "history-more") {
+        // Server sent a page of history, or said whether there is one
+        historyMore = evt.detail.elt.dataset.more == "true"
+        var messages = document.getElementById("messages")
+        if (historyHeight != null) {
+            // Keep the same messages in view after older ones were added
+            messages.scrollTop += messages.scrollHeight - historyHeight
+            historyHeight = null
+        }
+        if (messages.scrollHeight <= messages.clientHeight) {
+            // Can't scroll yet, so load more until it can
+            loadOlder()
+        }
+        return
+    }
+    if (evt.detail.elt.id == "goto") {
+        // Server sent the page of the subroom the user joined
+        window.location.href = evt.detail.elt.dataset.href
+        return
+    }
+    if (evt.detail.elt.id == "theme") {
+        // Server sent the theme for this session
+        document.body.className = "theme-" + evt.detail.elt.dataset.theme
+        return
+    }
+    var eleID = evt.detail.elt.parentElement.attributes["id"]
+    if (eleID != undefined && eleID.value == "message-table-tbody") {
+        // New message has arrived in chat
+        if (isShownTwice(evt.detail.elt)) {
+            // Replayed from history after reconnecting, and already shown
+            evt.detail.elt.remove()
+            return
+        }
+
+        // Focus input when message arrives
+        document.getElementById("message-input").focus()
+
+        // Convert UTC datetime from server into local timestamp
+        var ts = evt.detail.elt.cells[0]
+        if (ts.textContent == "") {
+            // No timestamp provided, skip
+            return
+        }
+        var d = new Date(ts.textContent)
+        ts.innerHTML = d.toLocaleTimeString()
+    }
+});
+
+// Older history is loaded a page at a time when scrolled to the top.
+// historyMore is whether the server has more, and historyHeight is the height
+// of the messages when a page was asked for, or null if none is loading.
+var historyMore = false
+var historyHeight = null
+function loadOlder() {
+    var messages = document.getElementById("messages")
+    if (!historyMore || historyHeight != null || messages.scrollTop > 50) {
+        return
+    }
+    historyHeight = messages.scrollHeight
+    htmx.trigger("#older-form", "older")
+}
+document.getElementById("messages").addEventListener("scroll", loadOlder)
+
+// Clicking a message replies to it
+document.addEventListener("click", function(evt) {
+    var spoiler = evt.target.closest(".spoiler")
+    if (spoiler != null && !spoiler.classList.contains("revealed")) {
+        // Clicking a spoiler shows it, instead of replying
+        spoiler.classList.add("revealed")
+        return
+    }
+    if (evt.target.closest("a")) {
+        return
+    }
+    if (evt.target.id == "reply-indicator") {
+        // Cancel the reply
+        document.getElementById("reply-to-input").value = ""
+        evt.target.textContent = ""
+        return
+    }
+    var row = evt.target.closest("#message-table-tbody > tr[data-msg-id]")
+    if (row == null || window.getSelection().toString() != "") {
+        return
+    }
+    document.getElementById("reply-to-input").value = row.dataset.msgId
+    document.getElementById("reply-indicator").textContent =
+        "Replying to " + row.cells[1].textContent + " (click to cancel)"
+    document.getElementById("message-input").focus()
+})
+
+// Pressing up in an empty input starts editing your last message
+document.addEventListener("keydown", function(evt) {
+    var input = document.getElementById("message-input")
+    if (evt.key != "ArrowUp" || evt.target != input || input.value != "") {
+        return
+    }
+    var mine = document.querySelectorAll("#message-table-tbody > tr[data-msg-id] > td.my-msg")
+    if (mine.length == 0) {
+        return
+    }
+    var last = mine[mine.length - 1].cloneNode(true)
+    last.querySelectorAll(".quote, .notif, .link-preview").forEach(function(e) { e.remove() })
+    last.querySelectorAll("br").forEach(function(e) { e.replaceWith("\n") })
+    input.value = "/edit " + mine[mine.length - 1].parentElement.dataset.msgId + " " + last.textContent.trim()
+    fitInput()
+    evt.preventDefault()
+})
+
+// Enter sends the message, Shift+Enter starts a new line
+document.addEventListener("keydown", function(evt) {
+    if (evt.key != "Enter" || evt.shiftKey || evt.isComposing || evt.target.id != "message-input") {
+        return
+    }
+    evt.preventDefault()
+    htmx.trigger("#send-form", "submit")
+})
+
+// Ask to show notifications for mentions once the user starts
+// chatting, browsers only allow asking after the user does something
+document.addEventListener("submit", function(evt) {
+    if (evt.target.id == "send-form" && window.Notification && Notification.permission == "default") {
+        Notification.requestPermission().then(subscribePush)
+    }
+})
+
+// Asking from the notification preferences works too
+document.addEventListener("change", function(evt) {
+    if (evt.target.id == "notify-select" && evt.target.value != "off" &&
+        window.Notification && Notification.permission == "default") {
+        Notification.requestPermission().then(subscribePush)
+    }
+})
+
+// A short beep for alerts, if the user turned sound on
+function playAlertSound() {
+    var AudioContext = window.AudioContext || window.webkitAudioContext
+    if (!AudioContext) {
+        return
+    }
+    var ctx = new AudioContext()
+    var osc = ctx.createOscillator()
+    var gain = ctx.createGain()
+    osc.frequency.value = 880
+    gain.gain.value = 0.1
+    osc.connect(gain)
+    gain.connect(ctx.destination)
+    osc.onended = function() { ctx.close() }
+    osc.start()
+    osc.stop(ctx.currentTime + 0.15)
+}
+
+// Subscribe to Web Push, so mentions are notified even when the tab
+// is in the background, if the server has it enabled
+function subscribePush() {
+    if (!window.Notification || Notification.permission != "granted" ||
+        !("serviceWorker" in navigator) || !window.PushManager) {
+        return
+    }
+    fetch("/push/key").then(function(resp) {
+        return resp.ok ? resp.json() : null
+    }).then(function(key) {
+        if (key == null) {
+            return null
+        }
+        var raw = atob(key.public_key.replace(/-/g, "+").replace(/_/g, "/"))
+        var serverKey = new Uint8Array(raw.length)
+        for (var i = 0; i < raw.length; i++) {
+            serverKey[i] = raw.charCodeAt(i)
+        }
+        return navigator.serviceWorker.register("/push-sw.js").then(function(reg) {
+            return reg.pushManager.subscribe({userVisibleOnly: true, applicationServerKey: serverKey})
+        })
+    }).then(function(sub) {
+        if (sub != null) {
+            return fetch("/push/subscribe", {method: "POST", body: JSON.stringify(sub)})
+        }
+    }).catch(function(err) {
+        console.log("Web Push not available:", err)
+    })
+}
+subscribePush()
+
+// The message input grows with its text, up to a few lines
+function fitInput() {
+    var input = document.getElementById("message-input")
+    input.rows = Math.min(input.value.split("\n").length, 6)
+}
+document.addEventListener("input", function(evt) {
+    if (evt.target.id == "message-input") {
+        fitInput()
+    }
+})
+
+// Returns true if a message row with the same ID is already in the log
+function isShownTwice(row) {
+    return row.id != "" && document.querySelectorAll('[id="' + row.id + '"]').length > 1
+}
+
+// Tell the server whether the user is looking at the chat
+function sendActivity(heartbeat) {
+    var active = document.visibilityState == "visible" && document.hasFocus()
+    document.getElementById("activity-input").value = active ? "active" : "inactive"
+    document.getElementById("heartbeat-input").value = heartbeat === true ? "1" : ""
+    // Looking at the chat means the latest message has been seen
+    var rows = document.querySelectorAll("#message-table-tbody > tr[data-msg-id]")
+    document.getElementById("ack-input").value = active && rows.length > 0 ? rows[rows.length - 1].dataset.msgId : ""
+    htmx.trigger("#activity-form", "activity")
+}
+window.addEventListener("focus", sendActivity)
+window.addEventListener("blur", sendActivity)
+document.addEventListener("visibilitychange", sendActivity)
+// Heartbeat, so the server knows the connection is still alive
+setInterval(function() { sendActivity(true) }, 30000)
+
+// Warn if the chat doesn't connect, since some networks block it
+setTimeout(function() {
+    if (document.getElementById("ip-addr").textContent == "") {
+        document.getElementById("connection-warning").hidden = false
+    }
+}, 25000)
@@ -0,0 +1,26 @@
+// Service worker that shows Web Push notifications from NearTalk, see
+// webpush.go. Each push is a "mention" event from the JSON protocol.
+
+self.addEventListener("push", function(evt) {
+    var e = evt.data ? evt.data.json() : null
+    if (e == null || e.type != "mention") {
+        return
+    }
+    // The same tag as the page's own notification, so there's only one
+    evt.waitUntil(self.registration.showNotification(e.data.nick + " mentioned you", {
+        body: e.data.text,
+        tag: e.data.id,
+    }))
+})
+
+self.addEventListener("notificationclick", function(evt) {
+    evt.notification.close()
+    evt.waitUntil(clients.matchAll({type: "window"}).then(function(windows) {
+        for (var i = 0; i < windows.length; i++) {
+            if ("focus" in windows[i]) {
+                return windows[i].focus()
+            }
+        }
+        return clients.openWindow("/")
+    }))
+})
@@ -0,0 +1,137 @@
+// The widget talks to the page embedding it with postMessage. Every
+// message in both directions is an object with source "neartalk".
+//
+// Sent to the embedding page:
+//   {source: "neartalk", type: "message", id, nick, text}  A new chat message
+//   {source: "neartalk", type: "unread", count}            Unread message count changed
+//   {source: "neartalk", type: "users", count}             Number of users changed
+//   {source: "neartalk", type: "mention", id, nick, text, sound}  A message mentioned the user
+//   {source: "neartalk", type: "alert", id, nick, text, sound}    Any other message, if the user
+//                                                                  wants to be notified of all
+//
+// Accepted from the embedding page:
+//   {source: "neartalk", type: "send", text}   Send a chat message
+//   {source: "neartalk", type: "focus"}        Focus the message input
+//
+// The origins allowed to embed the widget are in meta tags on the page.
+var allowedOrigins = Array.prototype.map.call(
+    document.querySelectorAll('meta[name="neartalk-widget-origin"]'),
+    function(meta) { return meta.content })
+
+function notifyParent(data) {
+    if (window.parent == window) {
+        return
+    }
+    data.source = "neartalk"
+    allowedOrigins.forEach(function(origin) {
+        // Only delivered if the parent has this origin
+        window.parent.postMessage(data, origin)
+    })
+}
+
+window.addEventListener("message", function(evt) {
+    if (allowedOrigins.indexOf("*") == -1 && allowedOrigins.indexOf(evt.origin) == -1) {
+        return
+    }
+    var data = evt.data
+    if (data == null || data.source != "neartalk") {
+        return
+    }
+    var input = document.getElementById("message-input")
+    if (data.type == "send" && typeof data.text == "string") {
+        input.value = data.text
+        htmx.trigger("#send-form", "submit")
+    } else if (data.type == "focus") {
+        input.focus()
+    }
+})
+
+// Clicking a spoiler shows it
+document.addEventListener("click", function(evt) {
+    var spoiler = evt.target.closest(".spoiler")
+    if (spoiler != null) {
+        spoiler.classList.add("revealed")
+    }
+})
+
+// Enter sends the message, Shift+Enter starts a new line
+document.addEventListener("keydown", function(evt) {
+    if (evt.key != "Enter" || evt.shiftKey || evt.isComposing || evt.target.id != "message-input") {
+        return
+    }
+    evt.preventDefault()
+    htmx.trigger("#send-form", "submit")
+})
+
+// The message input grows with its text, up to a few lines
+document.addEventListener("input", function(evt) {
+    if (evt.target.id == "message-input") {
+        evt.target.rows = Math.min(evt.target.value.split("\n").length, 6)
+    }
+})
+
+htmx.on("htmx:load", function(evt) {
+    var elt = evt.detail.elt
+    if (elt.id == "unread") {
+        notifyParent({type: "unread", count: parseInt(elt.dataset.count)})
+        return
+    }
+    if (elt.id == "alert") {
+        notifyParent({
+            type: elt.dataset.mention == "true" ? "mention" : "alert",
+            id: elt.dataset.msgId, nick: elt.dataset.nick, text: elt.dataset.text,
+            sound: elt.dataset.sound == "true",
+        })
+        return
+    }
+    if (elt.id == "ip-addr") {
+        // Connected, tell the server the connection works both ways
+        sendActivity()
+        return
+    }
+    if (elt.id == "theme") {
+        document.body.className = "theme-" + elt.dataset.theme
+        return
+    }
+    if (elt.id == "users-header-p") {
+        notifyParent({type: "users", count: document.querySelectorAll("#users-list > p").length})
+        return
+    }
+    var parent = elt.parentElement
+    if (parent == null || parent.id != "message-table-tbody") {
+        return
+    }
+    if (elt.id != "" && document.querySelectorAll('[id="' + elt.id + '"]').length > 1) {
+        // Replayed from history after reconnecting, and already shown
+        elt.remove()
+        return
+    }
+    var ts = elt.cells[0]
+    if (ts.textContent != "") {
+        ts.innerHTML = new Date(ts.textContent).toLocaleTimeString()
+    }
+    if (elt.dataset.msgId && !elt.dataset.history && !elt.cells[2].classList.contains("my-msg")) {
+        var text = elt.cells[2].cloneNode(true)
+        text.querySelectorAll(".quote, .notif, .link-preview").forEach(function(e) { e.remove() })
+        notifyParent({
+            type: "message",
+            id: elt.dataset.msgId,
+            nick: elt.cells[1].textContent,
+            text: text.textContent.trim()
+        })
+    }
+})
+
+function sendActivity(heartbeat) {
+    var active = document.visibilityState == "visible" && document.hasFocus()
+    document.getElementById("activity-input").value = active ? "active" : "inactive"
+    document.getElementById("heartbeat-input").value = heartbeat === true ? "1" : ""
+    // Looking at the chat means the latest message has been seen
+    var rows = document.querySelectorAll("#message-table-tbody > tr[data-msg-id]")
+    document.getElementById("ack-input").value = active && rows.length > 0 ? rows[rows.length - 1].dataset.msgId : ""
+    htmx.trigger("#activity-form", "activity")
+}
+window.addEventListener("focus", sendActivity)
+window.addEventListener("blur", sendActivity)
+document.addEventListener("visibilitychange", sendActivity)
+setInterval(function() { sendActivity(true) }, 30000)
@@ -0,0 +1,176 @@
+package main
+
+// This file translates the messages the server generates, like join notices
+// and errors. The translations are message catalogs in locales/, one JSON file
+// per language, mapping the English text to the translated one. Text that
+// has values filled in is looked up by its format, so it's translated with tr
+// before formatting. Anything without a translation is shown in English.
+//
+// Each client has a language, which is the one set with /language, or else
+// the best match for the browser's Accept-Language header. Notices for the
+// whole room are rendered in every language, and each client is sent the
+// one in its language, see broadcast.langHTML.
+
+import (
+	"embed"
+	"encoding/json"
+	"fmt"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+//go:embed locales/*.json
+var localeFiles embed.FS
+
+// defaultLang is the language the server's messages are written in.
+const defaultLang = "en"
+
+// langNameKey is the catalog entry with the language's name, in the language.
+const langNameKey = "_name"
+
+// catalogs maps language codes to their message catalogs.
+var catalogs = loadCatalogs()
+
+// loadCatalogs loads the embedded message catalogs. They're part of the
+// binary, so a bad one is a bug and panics.
+func loadCatalogs() map[string]map[string]string {
+	files, err := localeFiles.ReadDir("locales")
+	if err != nil {
+		panic(err)
+	}
+	cats := make(map[string]map[string]string, len(files))
+	for _, f := range files {
+		b, err := localeFiles.ReadFile("locales/" + f.Name())
+		if err != nil {
+			panic(err)
+		}
+		var cat map[string]string
+		if err := json.Unmarshal(b, &cat); err != nil {
+			panic(fmt.Sprintf("locales/%s: %v", f.Name(), err))
+		}
+		cats[strings.TrimSuffix(f.Name(), path.Ext(f.Name()))] = cat
+	}
+	return cats
+}
+
+// isSupportedLang returns true if messages can be shown in the language.
+func isSupportedLang(lang string) bool {
+	return lang == defaultLang || catalogs[lang] != nil
+}
+
+// supportedLangs returns the codes of every supported language, sorted.
+func supportedLangs() []string {
+	langs := []string{defaultLang}
+	for lang := range catalogs {
+		langs = append(langs, lang)
+	}
+	sort.Strings(langs)
+	return langs
+}
+
+// langName returns the name of the language, in the language.
+func langName(lang string) string {
+	if name := catalogs[lang][langNameKey]; name != "" {
+		return name
+	}
+	if lang == defaultLang {
+		return "English"
+	}
+	return lang
+}
+
+// tr returns the text in the language. If args are given, the text is a
+// format and they're filled in.
+func tr(lang, text string, args ...interface{}) string {
+	if t, ok := catalogs[lang][text]; ok {
+		text = t
+	}
+	if len(args) == 0 {
+		return text
+	}
+	return fmt.Sprintf(text, args...)
+}
+
+// matchLang returns the supported language that best matches the
+// Accept-Language header, or defaultLang if none do. Regional variants like
+// "fr-CA" match the base language.
+func matchLang(header string) string {
+	type choice struct {
+		lang string
+		q    float64
+	}
+	var choices []choice
+	for _, part := range strings.Split(header, ",") {
+		tag, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		q := 1.0
+		if v, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			var err error
+			if q, err = strconv.ParseFloat(v, 64); err != nil {
+				continue
+			}
+		}
+		base, _, _ := strings.Cut(strings.ToLower(strings.TrimSpace(tag)), "-")
+		if q > 0 && isSupportedLang(base) {
+			choices = append(choices, choice{base, q})
+		}
+	}
+	sort.SliceStable(choices, func(i, j int) bool { return choices[i].q > choices[j].q })
+	if len(choices) == 0 {
+		return defaultLang
+	}
+	return choices[0].lang
+}
+
+// localized returns the results of render for every supported language
+// other than defaultLang, by language.
+func localized(render func(lang string) string) map[string]string {
+	m := make(map[string]string, len(catalogs))
+	for lang := range catalogs {
+		m[lang] = render(lang)
+	}
+	return m
+}
+
+// language returns the client's language.
+func (c *client) language() string {
+	c.activityMu.Lock()
+	defer c.activityMu.Unlock()
+	return c.lang
+}
+
+// tr returns the text in the client's language, see tr.
+func (c *client) tr(text string, args ...interface{}) string {
+	return tr(c.language(), text, args...)
+}
+
+// handleLanguageCmd handles the /language command. "/language auto" goes
+// back to the browser's language.
+func (cr *chatRoom) handleLanguageCmd(c *client, arg string) {
+	lang := strings.ToLower(strings.TrimSpace(arg))
+	langs := supportedLangs()
+	if lang == "" {
+		c.sendNotice(c.tr("Your language is %s. Available languages: %s",
+			langName(c.language()), strings.Join(langs, ", ")))
+		return
+	}
+	if lang != "auto" && !isSupportedLang(lang) {
+		c.sendError(c.tr("Unknown language, use one of: %s", strings.Join(langs, ", ")))
+		return
+	}
+	cr.server.settings.update(c.session, func(ss *sessionSettings) {
+		if lang == "auto" {
+			ss.Lang = ""
+		} else {
+			ss.Lang = lang
+		}
+	})
+	if lang == "auto" {
+		lang = c.acceptLang
+	}
+	c.activityMu.Lock()
+	c.lang = lang
+	c.activityMu.Unlock()
+	c.sendNotice(c.tr("Language set to %s", langName(lang)))
+}
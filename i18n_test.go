@@ -0,0 +1,60 @@
+package main
+
+import (
+	"regexp"
+	"strings"
+	"testing"
+)
+
+func TestMatchLang(t *testing.T) {
+	tests := []struct{ header, want string }{
+		{"", "en"},
+		{"fr-CA,fr;q=0.9,en;q=0.8", "fr"},
+		{"ja,es;q=0.5", "es"},
+		{"en;q=0.4,de", "de"},
+		{"fr;q=0,es;q=0.1", "es"},
+		{"*", "en"},
+		{"xx,yy", "en"},
+	}
+	for _, tt := range tests {
+		if got := matchLang(tt.header); got != tt.want {
+			t.Errorf("matchLang(%q) = %s, want %s", tt.header, got, tt.want)
+		}
+	}
+}
+
+// TestCatalogs checks every translation fills in the same values as the
+// English text, so formatting never goes wrong.
+func TestCatalogs(t *testing.T) {
+	verbs := regexp.MustCompile(`%[a-z]`)
+	for lang, cat := range catalogs {
+		if cat[langNameKey] == "" {
+			t.Errorf("%s has no name", lang)
+		}
+		for en, translated := range cat {
+			if strings.Join(verbs.FindAllString(en, -1), "") != strings.Join(verbs.FindAllString(translated, -1), "") {
+				t.Errorf("%s translation of %q has different values: %q", lang, en, translated)
+			}
+		}
+	}
+}
+
+func TestDeliverLocalized(t *testing.T) {
+	var err error
+	loadTemplatesOnce.Do(func() { err = loadTemplates(t.TempDir()) })
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := &client{nick: "ann", lang: "de", active: true, outgoing: make(chan string, 2)}
+	m := createJoinMsg(&client{nick: "bob"}, nil)
+	b := broadcast{html: m.raw, authorHTML: m.raw, langHTML: m.rawByLang}
+	c.deliver(b, false)
+	if got := <-c.outgoing; !strings.Contains(got, "<bdi>bob</bdi> ist beigetreten") {
+		t.Errorf("German join notice is %s", got)
+	}
+	c.lang = "en"
+	c.deliver(b, false)
+	if got := <-c.outgoing; !strings.Contains(got, "<bdi>bob</bdi> has joined") {
+		t.Errorf("English join notice is %s", got)
+	}
+}
@@ -0,0 +1,287 @@
+// Package ids generates the IDs NearTalk uses for messages and sessions.
+//
+// IDs are ULIDs: 26 characters of Crockford's base32, holding a 48-bit
+// millisecond timestamp followed by 80 random bits. They sort by the time
+// they were created, so history can be paged and replayed by comparing IDs,
+// and IDs made in the same millisecond by the same Generator still sort in
+// the order they were made. Tokens, for secrets like session tokens, have the
+// same form, but all 128 bits are random.
+//
+// The time and randomness come from a Source, which tests can swap out with
+// SetSource to get predictable IDs.
+package ids
+
+import (
+	"crypto/rand"
+	"errors"
+	"io"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Len is the length of an ID string.
+const Len = 26
+
+// encoding is Crockford's base32 alphabet.
+const encoding = "0123456789ABCDEFGHJKMNPQRSTVWXYZ"
+
+// maxTime is the largest timestamp that fits in an ID.
+const maxTime = 1<<48 - 1
+
+// ErrInvalid is returned when parsing a string that isn't an ID.
+var ErrInvalid = errors.New("ids: invalid ID")
+
+// Source provides the time and randomness for new IDs.
+type Source struct {
+	// Now returns the current time. time.Now is used if it's nil.
+	Now func() time.Time
+	// Entropy is read for the random part of IDs. crypto/rand is used if
+	// it's nil.
+	Entropy io.Reader
+}
+
+// Generator creates IDs. Its methods are safe for concurrent use.
+type Generator struct {
+	mu     sync.Mutex
+	src    Source
+	last   [16]byte
+	lastMs uint64
+	// used is false until the first ID is made
+	used bool
+}
+
+// NewGenerator returns a Generator that uses src.
+func NewGenerator(src Source) *Generator {
+	return &Generator{src: src}
+}
+
+// source returns the Source's functions, or the defaults for unset ones.
+func (g *Generator) source() (now func() time.Time, entropy io.Reader) {
+	now, entropy = time.Now, rand.Reader
+	if g.src.Now != nil {
+		now = g.src.Now
+	}
+	if g.src.Entropy != nil {
+		entropy = g.src.Entropy
+	}
+	return now, entropy
+}
+
+// New returns a new ID. It panics if reading from the Source's entropy fails.
+func (g *Generator) New() string {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	now, entropy := g.source()
+	ms := uint64(now().UnixNano() / int64(time.Millisecond))
+	if ms > maxTime {
+		panic("ids: time is too far in the future")
+	}
+
+	var id [16]byte
+	if g.used && ms <= g.lastMs {
+		// Same millisecond as the last ID, or the clock went backwards.
+		// Increment the last ID instead so IDs from this generator always
+		// sort in order.
+		id = g.last
+		if !increment(id[6:]) {
+			// The random part overflowed, move on to the next millisecond
+			ms = g.lastMs + 1
+			putTime(&id, ms)
+			if _, err := io.ReadFull(entropy, id[6:]); err != nil {
+				panic(err)
+			}
+		} else {
+			ms = g.lastMs
+		}
+	} else {
+		putTime(&id, ms)
+		if _, err := io.ReadFull(entropy, id[6:]); err != nil {
+			panic(err)
+		}
+	}
+	g.last = id
+	g.lastMs = ms
+	g.used = true
+	return encode(id)
+}
+
+// Random returns a new ID with all 80 random bits freshly generated, for IDs
+// that must not be guessable from the ones before them. Unlike New, IDs made
+// in the same millisecond aren't in order, because New makes them by
+// incrementing the previous ID. Secrets should use Token instead.
+func (g *Generator) Random() string {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	now, entropy := g.source()
+	var id [16]byte
+	putTime(&id, uint64(now().UnixNano()/int64(time.Millisecond))&maxTime)
+	if _, err := io.ReadFull(entropy, id[6:]); err != nil {
+		panic(err)
+	}
+	return encode(id)
+}
+
+// Token returns a new token with all 128 bits random, for secrets like
+// session tokens. It's a valid ID, but holds no time, so tokens don't sort.
+func (g *Generator) Token() string {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	_, entropy := g.source()
+	var id [16]byte
+	if _, err := io.ReadFull(entropy, id[:]); err != nil {
+		panic(err)
+	}
+	return encode(id)
+}
+
+// putTime writes a millisecond timestamp into the first 6 bytes of id.
+func putTime(id *[16]byte, ms uint64) {
+	for i := 5; i >= 0; i-- {
+		id[i] = byte(ms)
+		ms >>= 8
+	}
+}
+
+// increment adds one to b as a big-endian number. It returns false if it
+// overflowed.
+func increment(b []byte) bool {
+	for i := len(b) - 1; i >= 0; i-- {
+		b[i]++
+		if b[i] != 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// encode returns the base32 form of id.
+func encode(id [16]byte) string {
+	// 128 bits is 26 base32 characters with 2 bits of padding at the start
+	var out [Len]byte
+	var acc uint64
+	bits := 2 // the padding bits
+	j := 0
+	for _, b := range id {
+		acc = acc<<8 | uint64(b)
+		bits += 8
+		for bits >= 5 {
+			bits -= 5
+			out[j] = encoding[(acc>>uint(bits))&31]
+			j++
+		}
+	}
+	return string(out[:])
+}
+
+// decode returns the bytes of the ID s, which must already be normalized.
+func decode(s string) ([16]byte, error) {
+	var id [16]byte
+	if len(s) != Len {
+		return id, ErrInvalid
+	}
+	// The first character only holds 3 bits
+	if strings.IndexByte(encoding[:8], s[0]) == -1 {
+		return id, ErrInvalid
+	}
+	var acc uint64
+	bits := -2 // skip the padding bits
+	j := 0
+	for i := 0; i < Len; i++ {
+		v := strings.IndexByte(encoding, s[i])
+		if v == -1 {
+			return id, ErrInvalid
+		}
+		acc = acc<<5 | uint64(v)
+		bits += 5
+		if bits >= 8 {
+			bits -= 8
+			id[j] = byte(acc >> uint(bits))
+			j++
+		}
+	}
+	return id, nil
+}
+
+// Normalize returns s in the canonical form of an ID, so IDs typed by users
+// are found regardless of case. Like Crockford's base32 specifies, I and L
+// are read as 1, and O as 0. It doesn't check whether s is valid.
+func Normalize(s string) string {
+	return strings.Map(func(r rune) rune {
+		switch r {
+		case 'i', 'I', 'l', 'L':
+			return '1'
+		case 'o', 'O':
+			return '0'
+		}
+		if r >= 'a' && r <= 'z' {
+			return r - 'a' + 'A'
+		}
+		return r
+	}, s)
+}
+
+// Valid returns true if s is an ID in canonical form.
+func Valid(s string) bool {
+	_, err := decode(s)
+	return err == nil
+}
+
+// Time returns the time the ID was created, to the millisecond.
+func Time(s string) (time.Time, error) {
+	id, err := decode(s)
+	if err != nil {
+		return time.Time{}, err
+	}
+	var ms int64
+	for _, b := range id[:6] {
+		ms = ms<<8 | int64(b)
+	}
+	return time.Unix(ms/1000, (ms%1000)*int64(time.Millisecond)), nil
+}
+
+var (
+	defaultMu  sync.RWMutex
+	defaultGen = NewGenerator(Source{})
+)
+
+// New returns a new ID from the default Generator.
+func New() string {
+	defaultMu.RLock()
+	g := defaultGen
+	defaultMu.RUnlock()
+	return g.New()
+}
+
+// Random returns a new unguessable ID from the default Generator.
+func Random() string {
+	defaultMu.RLock()
+	g := defaultGen
+	defaultMu.RUnlock()
+	return g.Random()
+}
+
+// Token returns a new token from the default Generator.
+func Token() string {
+	defaultMu.RLock()
+	g := defaultGen
+	defaultMu.RUnlock()
+	return g.Token()
+}
+
+// SetSource makes the default Generator use src, and returns a function that
+// restores the previous one. It's meant for tests.
+func SetSource(src Source) (restore func()) {
+	defaultMu.Lock()
+	defer defaultMu.Unlock()
+	prev := defaultGen
+	defaultGen = NewGenerator(src)
+	return func() {
+		defaultMu.Lock()
+		defer defaultMu.Unlock()
+		defaultGen = prev
+	}
+}
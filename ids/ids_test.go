@@ -0,0 +1,139 @@
+package ids
+
+import (
+	"bytes"
+	"sort"
+	"testing"
+	"time"
+)
+
+// zeroes is an entropy source that only returns zero bytes.
+type zeroes struct{}
+
+func (zeroes) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = 0
+	}
+	return len(p), nil
+}
+
+func fixedTime(t time.Time) func() time.Time {
+	return func() time.Time { return t }
+}
+
+func TestNewKnownValue(t *testing.T) {
+	// Example from the ULID spec
+	when := time.Unix(0, 1469918176385*int64(time.Millisecond))
+	g := NewGenerator(Source{Now: fixedTime(when), Entropy: zeroes{}})
+
+	if got, want := g.New(), "01ARYZ6S410000000000000000"; got != want {
+		t.Errorf("New() = %q, want %q", got, want)
+	}
+	// Same millisecond, so the random part is incremented
+	if got, want := g.New(), "01ARYZ6S410000000000000001"; got != want {
+		t.Errorf("second New() = %q, want %q", got, want)
+	}
+}
+
+func TestRoundTrip(t *testing.T) {
+	when := time.Date(2022, 1, 2, 3, 4, 5, 6e6, time.UTC)
+	entropy := bytes.NewReader(bytes.Repeat([]byte{0xab}, 10))
+	id := NewGenerator(Source{Now: fixedTime(when), Entropy: entropy}).New()
+
+	if !Valid(id) {
+		t.Fatalf("Valid(%q) = false", id)
+	}
+	got, err := Time(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !got.Equal(when) {
+		t.Errorf("Time(%q) = %v, want %v", id, got, when)
+	}
+	b, _ := decode(id)
+	if !bytes.Equal(b[6:], bytes.Repeat([]byte{0xab}, 10)) {
+		t.Errorf("random part = %x", b[6:])
+	}
+}
+
+func TestMonotonic(t *testing.T) {
+	g := NewGenerator(Source{Now: fixedTime(time.Unix(1000, 0))})
+	var got []string
+	for i := 0; i < 1000; i++ {
+		got = append(got, g.New())
+	}
+	if !sort.StringsAreSorted(got) {
+		t.Error("IDs from the same millisecond aren't sorted")
+	}
+
+	// The clock going backwards shouldn't break the order either
+	g.src.Now = fixedTime(time.Unix(999, 0))
+	if id := g.New(); id <= got[len(got)-1] {
+		t.Errorf("ID after clock went backwards %q <= %q", id, got[len(got)-1])
+	}
+}
+
+func TestRandom(t *testing.T) {
+	g := NewGenerator(Source{Now: fixedTime(time.Unix(1000, 0))})
+	a, b := g.Random(), g.Random()
+	if a[10:] == b[10:] || a[:10] != b[:10] {
+		t.Errorf("Random() IDs %q and %q should only share the time", a, b)
+	}
+}
+
+func TestToken(t *testing.T) {
+	ones := bytes.NewReader(bytes.Repeat([]byte{0xff}, 16))
+	if got := NewGenerator(Source{Entropy: ones}).Token(); got != "7ZZZZZZZZZZZZZZZZZZZZZZZZZ" {
+		t.Errorf("Token() with all bits set = %q", got)
+	}
+	g := NewGenerator(Source{Now: fixedTime(time.Unix(1000, 0))})
+	a, b := g.Token(), g.Token()
+	if !Valid(a) || a[:10] == b[:10] {
+		t.Errorf("Token() = %q and %q, want valid tokens without the time", a, b)
+	}
+}
+
+func TestNormalize(t *testing.T) {
+	tests := []struct {
+		in, want string
+	}{
+		{"01aryz6s410000000000000000", "01ARYZ6S410000000000000000"},
+		{"OlARYZ6S4I0000000000000000", "01ARYZ6S410000000000000000"},
+	}
+	for _, tt := range tests {
+		if got := Normalize(tt.in); got != tt.want {
+			t.Errorf("Normalize(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestValid(t *testing.T) {
+	tests := []struct {
+		in   string
+		want bool
+	}{
+		{"01ARYZ6S410000000000000000", true},
+		{"7ZZZZZZZZZZZZZZZZZZZZZZZZZ", true},
+		{"8ZZZZZZZZZZZZZZZZZZZZZZZZZ", false}, // overflows 128 bits
+		{"01ARYZ6S41000000000000000", false},  // too short
+		{"01ARYZ6S41000000000000000U", false}, // not in the alphabet
+		{"01aryz6s410000000000000000", false}, // not normalized
+		{"", false},
+	}
+	for _, tt := range tests {
+		if got := Valid(tt.in); got != tt.want {
+			t.Errorf("Valid(%q) = %v, want %v", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestSetSource(t *testing.T) {
+	restore := SetSource(Source{Now: fixedTime(time.Unix(0, 0)), Entropy: zeroes{}})
+	if got, want := New(), "00000000000000000000000000"; got != want {
+		t.Errorf("New() = %q, want %q", got, want)
+	}
+	restore()
+	if New() == "00000000000000000000000001" {
+		t.Error("restore didn't restore the default source")
+	}
+}
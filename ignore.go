@@ -0,0 +1,71 @@
+package main
+
+// This file handles ignoring people. "/ignore <nick>" stops a client from
+// receiving the chat messages of someone in the room, and "/unignore <nick>"
+// undoes it. "/ignore" on its own lists who is being ignored. Ignoring is
+// only for the one client, nobody else is told about it, and it's forgotten
+// when the client disconnects.
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// isIgnoring returns true if the client is ignoring the author.
+// It does not lock the clientsMu, callers should do that.
+func (c *client) isIgnoring(author *client) bool {
+	return author != nil && c.ignored[author.session]
+}
+
+// handleIgnoreCmd handles "/ignore", "/ignore <nick>", and "/unignore <nick>".
+// It does not lock the clientsMu, callers should do that.
+func (cr *chatRoom) handleIgnoreCmd(m msg) {
+	cmd, nick, _ := strings.Cut(m.text, " ")
+	nick = strings.TrimSpace(nick)
+
+	if nick == "" {
+		if cmd == "/unignore" {
+			m.author.sendError("Usage: /unignore <nick>")
+			return
+		}
+		var nicks []string
+		for c := range cr.clients {
+			if m.author.ignored[c.session] {
+				nicks = append(nicks, isolateNick(c.nick))
+			}
+		}
+		if len(nicks) == 0 {
+			m.author.sendNotice("You aren't ignoring anyone here")
+			return
+		}
+		sort.Strings(nicks)
+		m.author.sendNotice("You're ignoring " + strings.Join(nicks, ", "))
+		return
+	}
+
+	target := cr.clientByNick(sanitizeNick(nick))
+	if target == nil {
+		m.author.sendError("There's nobody in the room with that nickname")
+		return
+	}
+	if cmd == "/unignore" {
+		if !m.author.ignored[target.session] {
+			m.author.sendError("You aren't ignoring them")
+			return
+		}
+		delete(m.author.ignored, target.session)
+		m.author.sendNotice(fmt.Sprintf("You'll see messages from %s again", isolateNick(target.nick)))
+		return
+	}
+	if target.session == m.author.session {
+		m.author.sendError("You can't ignore yourself")
+		return
+	}
+	if m.author.ignored == nil {
+		m.author.ignored = make(map[string]bool)
+	}
+	m.author.ignored[target.session] = true
+	m.author.sendNotice(fmt.Sprintf("You won't see messages from %s anymore, send /unignore %s to undo it",
+		isolateNick(target.nick), isolateNick(target.nick)))
+}
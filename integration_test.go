@@ -0,0 +1,3542 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	ntclient "github.com/makeworld-the-better-one/neartalk/client"
+	"github.com/makeworld-the-better-one/neartalk/events"
+	"github.com/makeworld-the-better-one/neartalk/ids"
+	"nhooyr.io/websocket"
+)
+
+// loadTemplatesOnce loads the default templates for every test. They're only
+// loaded once, as clients left behind by earlier tests might still be using
+// them.
+var loadTemplatesOnce sync.Once
+
+// newTestServer starts a NearTalk server for integration tests.
+func newTestServer(t *testing.T) *httptest.Server {
+	t.Helper()
+	var err error
+	loadTemplatesOnce.Do(func() { err = loadTemplates(t.TempDir()) })
+	if err != nil {
+		t.Fatal(err)
+	}
+	settings, err := newSettingsStore("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cs := newChatServer(settings)
+	srv := httptest.NewServer(cs)
+	t.Cleanup(func() {
+		srv.Close()
+		// Rooms would otherwise outlive the test, and race with later tests
+		// that set flags
+		cs.closeRooms()
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		waitForRoomsClosed(ctx, t, cs)
+	})
+	return srv
+}
+
+// setFlag sets a flag's variable for the test, and sets it back once the
+// test is done and its servers are closed. Servers read flags from their own
+// goroutines, so it must be called before newTestServer.
+func setFlag[T any](t *testing.T, flag *T, v T) {
+	t.Helper()
+	old := *flag
+	*flag = v
+	t.Cleanup(func() { *flag = old })
+}
+
+// dialTestClient connects a client to the test server.
+func dialTestClient(ctx context.Context, t *testing.T, srv *httptest.Server) *ntclient.Client {
+	t.Helper()
+	c, err := ntclient.Dial(ctx, srv.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Close() })
+	return c
+}
+
+// nextEvent waits for the next event of the given type, skipping others,
+// and decodes it into v.
+func nextEvent(ctx context.Context, t *testing.T, c *ntclient.Client, typ events.Type, v interface{}) {
+	t.Helper()
+	for {
+		select {
+		case e, ok := <-c.Events():
+			if !ok {
+				t.Fatalf("connection closed waiting for %s event: %v", typ, c.Err())
+			}
+			if e.Type != typ {
+				continue
+			}
+			if err := e.Decode(v); err != nil {
+				t.Fatal(err)
+			}
+			return
+		case <-ctx.Done():
+			t.Fatalf("timed out waiting for %s event", typ)
+		}
+	}
+}
+
+// waitForRoomsClosed waits until every room on the server has closed, after
+// its clients are.
+func waitForRoomsClosed(ctx context.Context, t *testing.T, cs *chatServer) {
+	t.Helper()
+	for {
+		cs.roomsMu.Lock()
+		n := len(cs.rooms)
+		cs.roomsMu.Unlock()
+		if n == 0 {
+			return
+		}
+		select {
+		case <-ctx.Done():
+			t.Fatal("room never closed")
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+}
+
+func TestIntegrationChat(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	srv := newTestServer(t)
+
+	// Predictable message IDs
+	idTime := time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)
+	defer ids.SetSource(ids.Source{Now: func() time.Time { return idTime }})()
+
+	alice := dialTestClient(ctx, t, srv)
+	var room events.Room
+	nextEvent(ctx, t, alice, events.TypeRoom, &room)
+	if room.Name != "lan" {
+		t.Errorf("room name = %q, want lan", room.Name)
+	}
+
+	bob := dialTestClient(ctx, t, srv)
+	var users events.UserList
+	nextEvent(ctx, t, bob, events.TypeUsers, &users)
+	if len(users.Nicks) != 2 {
+		t.Fatalf("user list = %v, want 2 users", users.Nicks)
+	}
+
+	if err := alice.SetNick(ctx, "Alice & Co"); err != nil {
+		t.Fatal(err)
+	}
+	var nick events.NickChange
+	nextEvent(ctx, t, bob, events.TypeNick, &nick)
+	if nick.Old != room.Nick || nick.New != "Alice & Co" {
+		t.Errorf("nick change = %+v, want %s to Alice & Co", nick, room.Nick)
+	}
+
+	if err := alice.SendMessage(ctx, "hello *world*"); err != nil {
+		t.Fatal(err)
+	}
+	var m events.Message
+	nextEvent(ctx, t, bob, events.TypeMessage, &m)
+	if m.Nick != "Alice & Co" || m.Text != "hello *world*" || m.Self {
+		t.Errorf("bob got message %+v", m)
+	}
+	if m.HTML != "hello <strong>world</strong>" {
+		t.Errorf("message HTML = %q", m.HTML)
+	}
+	if when, err := ids.Time(m.ID); err != nil || !when.Equal(idTime) {
+		t.Errorf("message ID %q has time %v, %v", m.ID, when, err)
+	}
+	var self events.Message
+	nextEvent(ctx, t, alice, events.TypeMessage, &self)
+	if !self.Self || self.ID != m.ID {
+		t.Errorf("alice got message %+v, want self copy of %s", self, m.ID)
+	}
+
+	if err := bob.Reply(ctx, m.ID, "hi"); err != nil {
+		t.Fatal(err)
+	}
+	var reply events.Message
+	nextEvent(ctx, t, alice, events.TypeMessage, &reply)
+	if reply.ReplyTo != m.ID {
+		t.Errorf("reply to = %q, want %q", reply.ReplyTo, m.ID)
+	}
+
+	if err := bob.SetNick(ctx, "Alice & Co"); err != nil {
+		t.Fatal(err)
+	}
+	var e events.Error
+	nextEvent(ctx, t, bob, events.TypeError, &e)
+
+	bob.Close()
+	var leave events.Leave
+	nextEvent(ctx, t, alice, events.TypeLeave, &leave)
+}
+
+func TestIntegrationBot(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	// Test clients connect from localhost, which is the "lan" room
+	setFlag(t, &botAccounts, []*botAccount{{token: "secret", room: "lan", nick: "Helper"}})
+	setFlag(t, &botRate, 1)
+	setFlag(t, &botBurst, 1)
+	srv := newTestServer(t)
+
+	if _, err := ntclient.Dial(ctx, srv.URL, &ntclient.Options{BotToken: "wrong"}); err == nil {
+		t.Error("dialing with an invalid bot token worked")
+	}
+
+	alice := dialTestClient(ctx, t, srv)
+	nextEvent(ctx, t, alice, events.TypeJoin, &events.Join{})
+
+	bot, err := ntclient.Dial(ctx, srv.URL, &ntclient.Options{BotToken: "secret"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bot.Close()
+	var room events.Room
+	nextEvent(ctx, t, bot, events.TypeRoom, &room)
+	if room.Name != "lan" || room.Nick != "Helper" {
+		t.Errorf("bot got room %+v", room)
+	}
+
+	var users events.UserList
+	nextEvent(ctx, t, alice, events.TypeJoin, &events.Join{})
+	nextEvent(ctx, t, alice, events.TypeUsers, &users)
+	if len(users.Bots) != 1 || users.Bots[0] != "Helper" {
+		t.Errorf("user list bots = %v", users.Bots)
+	}
+
+	// Bot nicknames are reserved
+	if err := alice.SetNick(ctx, "Helper"); err != nil {
+		t.Fatal(err)
+	}
+	nextEvent(ctx, t, alice, events.TypeError, &events.Error{})
+
+	// The burst is 1, so the second message is dropped
+	if err := bot.SendMessage(ctx, "beep"); err != nil {
+		t.Fatal(err)
+	}
+	if err := bot.SendMessage(ctx, "boop"); err != nil {
+		t.Fatal(err)
+	}
+	var m events.Message
+	nextEvent(ctx, t, alice, events.TypeMessage, &m)
+	if m.Nick != "Helper" || !m.Bot || m.Text != "beep" {
+		t.Errorf("alice got bot message %+v", m)
+	}
+	nextEvent(ctx, t, bot, events.TypeError, &events.Error{})
+}
+
+func TestIntegrationLongPoll(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	srv := newTestServer(t)
+
+	jar, err := cookiejar.New(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hc := &http.Client{Jar: jar}
+	resp, err := hc.Post(srv.URL+"/poll?proto=json", "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var opened struct{ ID string }
+	err = json.NewDecoder(resp.Body).Decode(&opened)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// nextPolled polls until an event of the given type arrives
+	var polled []events.Envelope
+	nextPolled := func(typ events.Type, v interface{}) {
+		t.Helper()
+		for ctx.Err() == nil {
+			for i, e := range polled {
+				if e.Type == typ {
+					polled = polled[i+1:]
+					if err := e.Decode(v); err != nil {
+						t.Fatal(err)
+					}
+					return
+				}
+			}
+			polled = nil
+			req, _ := http.NewRequestWithContext(ctx, http.MethodGet, srv.URL+"/poll?id="+opened.ID, nil)
+			resp, err := hc.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var data struct{ Frames []string }
+			err = json.NewDecoder(resp.Body).Decode(&data)
+			resp.Body.Close()
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, f := range data.Frames {
+				var e events.Envelope
+				if err := json.Unmarshal([]byte(f), &e); err != nil {
+					t.Fatal(err)
+				}
+				polled = append(polled, e)
+			}
+		}
+		t.Fatalf("timed out waiting for polled %s event", typ)
+	}
+
+	var room events.Room
+	nextPolled(events.TypeRoom, &room)
+	if room.Name != "lan" {
+		t.Errorf("room name = %q, want lan", room.Name)
+	}
+
+	alice := dialTestClient(ctx, t, srv)
+	nextPolled(events.TypeJoin, &events.Join{})
+
+	// Other sessions can't send on the connection
+	resp, err = http.Post(srv.URL+"/poll/send?id="+opened.ID, "application/json", strings.NewReader(`{"message":"hi"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("sending without the session got status %d", resp.StatusCode)
+	}
+
+	resp, err = hc.Post(srv.URL+"/poll/send?id="+opened.ID, "application/json", strings.NewReader(`{"message":"hi"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	var m events.Message
+	nextEvent(ctx, t, alice, events.TypeMessage, &m)
+	if m.Nick != room.Nick || m.Text != "hi" {
+		t.Errorf("alice got message %+v", m)
+	}
+	nextPolled(events.TypeMessage, &m)
+	if !m.Self {
+		t.Errorf("poller got message %+v, want self copy", m)
+	}
+}
+
+func TestIntegrationChaos(t *testing.T) {
+	t.Run("delay", func(t *testing.T) {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		// Delays must not reorder messages
+		setFlag(t, &chaos, chaosConfig{delay: 20 * time.Millisecond})
+		srv := newTestServer(t)
+
+		alice := dialTestClient(ctx, t, srv)
+		nextEvent(ctx, t, alice, events.TypeRoom, &events.Room{})
+		bob := dialTestClient(ctx, t, srv)
+		nextEvent(ctx, t, bob, events.TypeRoom, &events.Room{})
+
+		texts := []string{"one", "two", "three", "four", "five"}
+		for _, text := range texts {
+			if err := alice.SendMessage(ctx, text); err != nil {
+				t.Fatal(err)
+			}
+		}
+		for _, want := range texts {
+			var m events.Message
+			nextEvent(ctx, t, bob, events.TypeMessage, &m)
+			if m.Text != want {
+				t.Fatalf("bob got message %q, want %q", m.Text, want)
+			}
+		}
+	})
+
+	t.Run("slow", func(t *testing.T) {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		// Slow clients that would rather not miss anything fall behind and
+		// are disconnected
+		setFlag(t, &chaos, chaosConfig{slow: 1})
+		srv := newTestServer(t)
+
+		slow := dialTestClient(ctx, t, srv)
+		if err := slow.SetBackpressure(ctx, backpressureDisconnect); err != nil {
+			t.Fatal(err)
+		}
+		cs := srv.Config.Handler.(*chatServer)
+		var cr *chatRoom
+		for asked := false; !asked; {
+			cs.roomsMu.Lock()
+			cr = cs.rooms["lan"]
+			cs.roomsMu.Unlock()
+			if cr != nil {
+				cr.clientsMu.Lock()
+				for c := range cr.clients {
+					c.behindMu.Lock()
+					asked = asked || c.disconnectSlow
+					c.behindMu.Unlock()
+				}
+				cr.clientsMu.Unlock()
+			}
+			select {
+			case <-ctx.Done():
+				t.Fatal("backpressure policy was never set")
+			case <-time.After(10 * time.Millisecond):
+			}
+		}
+		for i := 0; i < clientMsgBuffer*2; i++ {
+			// The room closes once the slow client is gone
+			if err := cr.announce(ctx, "flood"); err == errRoomClosed {
+				break
+			} else if err != nil {
+				t.Fatal(err)
+			}
+		}
+		for open := true; open; {
+			select {
+			case _, open = <-slow.Events():
+			case <-ctx.Done():
+				t.Fatal("slow client was never disconnected")
+			}
+		}
+	})
+}
+
+// testBus links the instances of a test hub, like Redis does.
+type testBus struct {
+	hub      *testBusHub
+	instance string
+}
+
+// testBusHub passes messages between testBus instances in order.
+type testBusHub struct {
+	mu    sync.Mutex
+	rooms map[string]map[string]*chatRoom // By key, then instance
+	queue chan func()
+}
+
+func newTestBusHub(t *testing.T) *testBusHub {
+	h := &testBusHub{rooms: make(map[string]map[string]*chatRoom), queue: make(chan func(), 100)}
+	done := make(chan struct{})
+	t.Cleanup(func() { close(done) })
+	go func() {
+		for {
+			select {
+			case f := <-h.queue:
+				f()
+			case <-done:
+				return
+			}
+		}
+	}()
+	return h
+}
+
+// others calls f for the room on every other instance.
+func (b *testBus) others(key string, f func(cr *chatRoom)) {
+	b.hub.queue <- func() {
+		b.hub.mu.Lock()
+		var rooms []*chatRoom
+		for instance, cr := range b.hub.rooms[key] {
+			if instance != b.instance {
+				rooms = append(rooms, cr)
+			}
+		}
+		b.hub.mu.Unlock()
+		for _, cr := range rooms {
+			f(cr)
+		}
+	}
+}
+
+func (b *testBus) publish(key string, br broadcast) {
+	b.others(key, func(cr *chatRoom) { cr.deliverRemote(br) })
+}
+
+func (b *testBus) publishRoster(key string, users []roomUser) {
+	b.others(key, func(cr *chatRoom) { cr.setRemoteRoster(b.instance, users) })
+}
+
+func (b *testBus) subscribe(key string, cr *chatRoom) func() {
+	b.hub.mu.Lock()
+	defer b.hub.mu.Unlock()
+	if b.hub.rooms[key] == nil {
+		b.hub.rooms[key] = make(map[string]*chatRoom)
+	}
+	b.hub.rooms[key][b.instance] = cr
+	return func() {
+		b.hub.mu.Lock()
+		defer b.hub.mu.Unlock()
+		delete(b.hub.rooms[key], b.instance)
+	}
+}
+
+func TestIntegrationBus(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	hub := newTestBusHub(t)
+	srv1 := newTestServer(t)
+	srv1.Config.Handler.(*chatServer).bus = &testBus{hub: hub, instance: "one"}
+	srv2 := newTestServer(t)
+	srv2.Config.Handler.(*chatServer).bus = &testBus{hub: hub, instance: "two"}
+
+	alice := dialTestClient(ctx, t, srv1)
+	var room events.Room
+	nextEvent(ctx, t, alice, events.TypeRoom, &room)
+	bob := dialTestClient(ctx, t, srv2)
+
+	// Both see each other in the user list
+	for _, c := range []*ntclient.Client{alice, bob} {
+		for {
+			var users events.UserList
+			nextEvent(ctx, t, c, events.TypeUsers, &users)
+			if len(users.Nicks) == 2 {
+				break
+			}
+		}
+	}
+
+	// Nicknames on other instances are in use
+	if err := bob.SetNick(ctx, room.Nick); err != nil {
+		t.Fatal(err)
+	}
+	nextEvent(ctx, t, bob, events.TypeError, &events.Error{})
+
+	if err := alice.SendMessage(ctx, "hello"); err != nil {
+		t.Fatal(err)
+	}
+	var m events.Message
+	nextEvent(ctx, t, bob, events.TypeMessage, &m)
+	if m.Nick != room.Nick || m.Text != "hello" || m.Self {
+		t.Errorf("bob got message %+v", m)
+	}
+
+	// Leaving removes alice from bob's user list
+	alice.Close()
+	for {
+		var users events.UserList
+		nextEvent(ctx, t, bob, events.TypeUsers, &users)
+		if len(users.Nicks) == 1 {
+			break
+		}
+	}
+}
+
+func TestIntegrationNamedRoom(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	setFlag(t, &namedRooms, true)
+	srv := newTestServer(t)
+
+	alice, err := ntclient.Dial(ctx, srv.URL, &ntclient.Options{Room: "Book-Club"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer alice.Close()
+	var room events.Room
+	nextEvent(ctx, t, alice, events.TypeRoom, &room)
+	if room.Name != "#book-club" {
+		t.Errorf("room name = %q, want #book-club", room.Name)
+	}
+
+	// The creator can lock the room without a vote
+	if err := alice.SendMessage(ctx, "/lock hunter2"); err != nil {
+		t.Fatal(err)
+	}
+	var notice events.Notice
+	nextEvent(ctx, t, alice, events.TypeNotice, &notice)
+	if strings.Contains(notice.Text, "hunter2") {
+		t.Errorf("notice %q shows the password", notice.Text)
+	}
+
+	jar, err := cookiejar.New(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	httpClient := &http.Client{Jar: jar}
+	if _, err := ntclient.Dial(ctx, srv.URL, &ntclient.Options{HTTPClient: httpClient, Room: "book-club"}); err == nil {
+		t.Fatal("joining without the password worked")
+	}
+
+	post := func(password string) int {
+		t.Helper()
+		resp, err := httpClient.PostForm(srv.URL+"/room/book-club", map[string][]string{"password": {password}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	if code := post("wrong"); code != http.StatusForbidden {
+		t.Errorf("wrong password got status %d", code)
+	}
+	// The right password redirects to the room page
+	if code := post("hunter2"); code != http.StatusOK {
+		t.Errorf("right password got status %d", code)
+	}
+
+	bob, err := ntclient.Dial(ctx, srv.URL, &ntclient.Options{HTTPClient: httpClient, Room: "book-club"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bob.Close()
+	nextEvent(ctx, t, bob, events.TypeRoom, &room)
+	if room.Name != "#book-club" {
+		t.Errorf("bob joined room %q", room.Name)
+	}
+
+	// Named rooms are separate from the room for the IP address
+	carol := dialTestClient(ctx, t, srv)
+	nextEvent(ctx, t, carol, events.TypeRoom, &room)
+	if room.Name != "lan" {
+		t.Errorf("carol joined room %q", room.Name)
+	}
+}
+
+func TestIntegrationLockVote(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	srv := newTestServer(t)
+
+	alice := dialTestClient(ctx, t, srv)
+	nextEvent(ctx, t, alice, events.TypeRoom, &events.Room{})
+	bob := dialTestClient(ctx, t, srv)
+	nextEvent(ctx, t, bob, events.TypeRoom, &events.Room{})
+	carol := dialTestClient(ctx, t, srv)
+	nextEvent(ctx, t, carol, events.TypeRoom, &events.Room{})
+
+	// There's no vote to agree with yet
+	if err := bob.SendMessage(ctx, "/lock yes"); err != nil {
+		t.Fatal(err)
+	}
+	nextEvent(ctx, t, bob, events.TypeError, &events.Error{})
+
+	// Bob didn't create the room, so two of the three have to agree
+	if err := bob.SendMessage(ctx, "/lock hunter2"); err != nil {
+		t.Fatal(err)
+	}
+	var notice events.Notice
+	nextEvent(ctx, t, carol, events.TypeNotice, &notice)
+	if !strings.Contains(notice.Text, "1 more") {
+		t.Errorf("vote notice = %q", notice.Text)
+	}
+	dave, err := ntclient.Dial(ctx, srv.URL, nil)
+	if err != nil {
+		t.Fatalf("joining during the vote failed: %v", err)
+	}
+	// Closing while the server is still writing can stall the close until
+	// the write times out, so wait for what's sent on joining
+	for got := map[events.Type]bool{}; !got[events.TypePrefs] || !got[events.TypeJoin]; {
+		select {
+		case e := <-dave.Events():
+			got[e.Type] = true
+		case <-ctx.Done():
+			t.Fatal("timed out waiting for dave to join")
+		}
+	}
+	dave.Close()
+	nextEvent(ctx, t, carol, events.TypeLeave, &events.Leave{})
+
+	if err := carol.SendMessage(ctx, "/lock yes"); err != nil {
+		t.Fatal(err)
+	}
+	nextEvent(ctx, t, alice, events.TypeNotice, &notice)
+	nextEvent(ctx, t, alice, events.TypeNotice, &notice)
+	if !strings.Contains(notice.Text, "locked") {
+		t.Errorf("lock notice = %q", notice.Text)
+	}
+	if _, err := ntclient.Dial(ctx, srv.URL, nil); err == nil {
+		t.Fatal("joining the locked room without the password worked")
+	}
+
+	if err := bob.SendMessage(ctx, "/unlock"); err != nil {
+		t.Fatal(err)
+	}
+	nextEvent(ctx, t, bob, events.TypeError, &events.Error{})
+	if err := alice.SendMessage(ctx, "/unlock"); err != nil {
+		t.Fatal(err)
+	}
+	nextEvent(ctx, t, bob, events.TypeNotice, &notice)
+	if !strings.Contains(notice.Text, "unlocked") {
+		t.Errorf("unlock notice = %q", notice.Text)
+	}
+	dialTestClient(ctx, t, srv)
+}
+
+func TestIntegrationVotekick(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	srv := newTestServer(t)
+
+	alice := dialTestClient(ctx, t, srv)
+	nextEvent(ctx, t, alice, events.TypeRoom, &events.Room{})
+	jar, err := cookiejar.New(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bobOpts := &ntclient.Options{HTTPClient: &http.Client{Jar: jar}}
+	bob, err := ntclient.Dial(ctx, srv.URL, bobOpts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bob.Close()
+	var bobRoom events.Room
+	nextEvent(ctx, t, bob, events.TypeRoom, &bobRoom)
+	carol := dialTestClient(ctx, t, srv)
+	nextEvent(ctx, t, carol, events.TypeRoom, &events.Room{})
+
+	if err := alice.SendMessage(ctx, "/votekick "+bobRoom.Nick); err != nil {
+		t.Fatal(err)
+	}
+	var notice events.Notice
+	nextEvent(ctx, t, carol, events.TypeNotice, &notice)
+	if !strings.Contains(notice.Text, "1 more") {
+		t.Errorf("vote notice = %q", notice.Text)
+	}
+	if err := carol.SendMessage(ctx, "/votekick yes"); err != nil {
+		t.Fatal(err)
+	}
+	nextEvent(ctx, t, alice, events.TypeNotice, &notice)
+	nextEvent(ctx, t, alice, events.TypeNotice, &notice)
+	if !strings.Contains(notice.Text, "kicked") {
+		t.Errorf("kick notice = %q", notice.Text)
+	}
+	var leave events.Leave
+	nextEvent(ctx, t, alice, events.TypeLeave, &leave)
+	if leave.Nick != bobRoom.Nick {
+		t.Errorf("%s left, want %s", leave.Nick, bobRoom.Nick)
+	}
+
+	// Bob can't come back for a while
+	bob, err = ntclient.Dial(ctx, srv.URL, bobOpts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bob.Close()
+	nextEvent(ctx, t, bob, events.TypeError, &events.Error{})
+}
+
+func TestIntegrationModerator(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	srv := newTestServer(t)
+	code := srv.Config.Handler.(*chatServer).modCodes.issue("lan")
+
+	alice := dialTestClient(ctx, t, srv)
+	var room events.Room
+	nextEvent(ctx, t, alice, events.TypeRoom, &room)
+	bob := dialTestClient(ctx, t, srv)
+	var bobRoom events.Room
+	nextEvent(ctx, t, bob, events.TypeRoom, &bobRoom)
+
+	// Only moderators can use moderator commands
+	if err := bob.SendMessage(ctx, "/mute "+room.Nick); err != nil {
+		t.Fatal(err)
+	}
+	nextEvent(ctx, t, bob, events.TypeError, &events.Error{})
+
+	// Anyone can clear their own chat, but only moderators everyone's
+	if err := bob.SendMessage(ctx, "/clear"); err != nil {
+		t.Fatal(err)
+	}
+	var clear events.Clear
+	nextEvent(ctx, t, bob, events.TypeClear, &clear)
+	if !clear.Self || clear.Nick != bobRoom.Nick {
+		t.Errorf("bob's own clear = %+v, want self-clear by %s", clear, bobRoom.Nick)
+	}
+	if err := bob.SendMessage(ctx, "/clear room"); err != nil {
+		t.Fatal(err)
+	}
+	nextEvent(ctx, t, bob, events.TypeError, &events.Error{})
+
+	if err := alice.SendMessage(ctx, "/claim "+code); err != nil {
+		t.Fatal(err)
+	}
+	var notice events.Notice
+	nextEvent(ctx, t, bob, events.TypeNotice, &notice)
+	var users events.UserList
+	nextEvent(ctx, t, bob, events.TypeUsers, &users)
+	if len(users.Mods) != 1 || users.Mods[0] != room.Nick {
+		t.Errorf("user list mods = %v, want %s", users.Mods, room.Nick)
+	}
+	// Codes only work once
+	if err := bob.SendMessage(ctx, "/claim "+code); err != nil {
+		t.Fatal(err)
+	}
+	nextEvent(ctx, t, bob, events.TypeError, &events.Error{})
+
+	if err := alice.SendMessage(ctx, "/mute "+bobRoom.Nick); err != nil {
+		t.Fatal(err)
+	}
+	nextEvent(ctx, t, bob, events.TypeNotice, &events.Notice{})
+	if err := bob.SendMessage(ctx, "hello?"); err != nil {
+		t.Fatal(err)
+	}
+	nextEvent(ctx, t, bob, events.TypeError, &events.Error{})
+
+	if err := alice.SendMessage(ctx, "/clear room"); err != nil {
+		t.Fatal(err)
+	}
+	var roomClear events.Clear
+	nextEvent(ctx, t, bob, events.TypeClear, &roomClear)
+	if roomClear.Self || roomClear.Nick != room.Nick {
+		t.Errorf("cleared by %q, want %q", roomClear.Nick, room.Nick)
+	}
+
+	if err := alice.SendMessage(ctx, "/kick "+bobRoom.Nick); err != nil {
+		t.Fatal(err)
+	}
+	var leave events.Leave
+	nextEvent(ctx, t, alice, events.TypeLeave, &leave)
+	if leave.Nick != bobRoom.Nick {
+		t.Errorf("%s left, want %s", leave.Nick, bobRoom.Nick)
+	}
+}
+
+func TestIntegrationIgnore(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	srv := newTestServer(t)
+
+	alice := dialTestClient(ctx, t, srv)
+	nextEvent(ctx, t, alice, events.TypeRoom, &events.Room{})
+	bob := dialTestClient(ctx, t, srv)
+	var bobRoom events.Room
+	nextEvent(ctx, t, bob, events.TypeRoom, &bobRoom)
+
+	if err := alice.SendMessage(ctx, "/ignore "+bobRoom.Nick); err != nil {
+		t.Fatal(err)
+	}
+	nextEvent(ctx, t, alice, events.TypeNotice, &events.Notice{})
+	if err := alice.SendMessage(ctx, "/ignore"); err != nil {
+		t.Fatal(err)
+	}
+	var list events.Notice
+	nextEvent(ctx, t, alice, events.TypeNotice, &list)
+	if !strings.Contains(list.Text, bobRoom.Nick) {
+		t.Errorf("ignore list = %q, want %s", list.Text, bobRoom.Nick)
+	}
+
+	if err := bob.SendMessage(ctx, "can you hear me"); err != nil {
+		t.Fatal(err)
+	}
+	nextEvent(ctx, t, bob, events.TypeMessage, &events.Message{})
+	if err := alice.SendMessage(ctx, "/unignore "+bobRoom.Nick); err != nil {
+		t.Fatal(err)
+	}
+	nextEvent(ctx, t, alice, events.TypeNotice, &events.Notice{})
+	if err := bob.SendMessage(ctx, "how about now"); err != nil {
+		t.Fatal(err)
+	}
+	var m events.Message
+	nextEvent(ctx, t, alice, events.TypeMessage, &m)
+	if m.Text != "how about now" {
+		t.Errorf("alice got %q while ignoring bob", m.Text)
+	}
+}
+
+func TestIntegrationUnread(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	setFlag(t, &readReceipts, true)
+	srv := newTestServer(t)
+
+	alice := dialTestClient(ctx, t, srv)
+	nextEvent(ctx, t, alice, events.TypeRoom, &events.Room{})
+	bob := dialTestClient(ctx, t, srv)
+	nextEvent(ctx, t, bob, events.TypeRoom, &events.Room{})
+
+	if err := bob.SetActive(ctx, false); err != nil {
+		t.Fatal(err)
+	}
+	var unread events.Unread
+	nextEvent(ctx, t, bob, events.TypeUnread, &unread)
+
+	var msgs [2]events.Message
+	for i, text := range []string{"one", "two"} {
+		if err := alice.SendMessage(ctx, text); err != nil {
+			t.Fatal(err)
+		}
+		nextEvent(ctx, t, bob, events.TypeMessage, &msgs[i])
+		nextEvent(ctx, t, bob, events.TypeUnread, &unread)
+		if unread.Count != i+1 {
+			t.Errorf("unread count = %d, want %d", unread.Count, i+1)
+		}
+	}
+
+	if err := bob.Ack(ctx, msgs[0].ID); err != nil {
+		t.Fatal(err)
+	}
+	nextEvent(ctx, t, bob, events.TypeUnread, &unread)
+	if unread.Count != 1 {
+		t.Errorf("unread count after ack = %d, want 1", unread.Count)
+	}
+
+	if err := bob.SetActive(ctx, true); err != nil {
+		t.Fatal(err)
+	}
+	nextEvent(ctx, t, bob, events.TypeUnread, &unread)
+	if unread.Count != 0 {
+		t.Errorf("unread count after becoming active = %d, want 0", unread.Count)
+	}
+	for {
+		var seen events.Seen
+		nextEvent(ctx, t, alice, events.TypeSeen, &seen)
+		if seen.Count == 0 {
+			continue
+		}
+		if seen.ID != msgs[1].ID || seen.Count != 1 {
+			t.Errorf("seen = %+v, want %s seen by 1", seen, msgs[1].ID)
+		}
+		break
+	}
+}
+
+func TestIntegrationWhois(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	srv := newTestServer(t)
+
+	alice := dialTestClient(ctx, t, srv)
+	var aliceRoom events.Room
+	nextEvent(ctx, t, alice, events.TypeRoom, &aliceRoom)
+	bob := dialTestClient(ctx, t, srv)
+	var bobRoom events.Room
+	nextEvent(ctx, t, bob, events.TypeRoom, &bobRoom)
+
+	for _, text := range []string{"hi", "hello", "/away lunch"} {
+		if err := alice.SendMessage(ctx, text); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for {
+		var users events.UserList
+		nextEvent(ctx, t, bob, events.TypeUsers, &users)
+		if _, ok := users.Away[aliceRoom.Nick]; ok {
+			break
+		}
+	}
+	if err := bob.SendMessage(ctx, "/users"); err != nil {
+		t.Fatal(err)
+	}
+	var n events.Notice
+	nextEvent(ctx, t, bob, events.TypeNotice, &n)
+	for _, want := range []string{
+		"2 people here: ",
+		"\u2068" + aliceRoom.Nick + "\u2069 (away: lunch)",
+		"\u2068" + bobRoom.Nick + "\u2069",
+	} {
+		if !strings.Contains(n.Text, want) {
+			t.Errorf("/users notice = %q, want it to contain %q", n.Text, want)
+		}
+	}
+
+	if err := bob.SendMessage(ctx, "/whois "+aliceRoom.Nick); err != nil {
+		t.Fatal(err)
+	}
+	nextEvent(ctx, t, bob, events.TypeNotice, &n)
+	want := "\u2068" + aliceRoom.Nick + "\u2069: joined under a minute ago, 2 messages sent, away: lunch"
+	if n.Text != want {
+		t.Errorf("/whois notice = %q, want %q", n.Text, want)
+	}
+
+	if err := bob.SendMessage(ctx, "/whois nobody"); err != nil {
+		t.Fatal(err)
+	}
+	var e events.Error
+	nextEvent(ctx, t, bob, events.TypeError, &e)
+}
+
+func TestIntegrationTopic(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	srv := newTestServer(t)
+
+	alice := dialTestClient(ctx, t, srv)
+	var aliceRoom events.Room
+	nextEvent(ctx, t, alice, events.TypeRoom, &aliceRoom)
+	if aliceRoom.Topic != "" {
+		t.Errorf("new room topic = %q, want none", aliceRoom.Topic)
+	}
+	bob := dialTestClient(ctx, t, srv)
+	nextEvent(ctx, t, bob, events.TypeRoom, &events.Room{})
+
+	if err := alice.SendMessage(ctx, "/topic Board\ngames   tonight"); err != nil {
+		t.Fatal(err)
+	}
+	var topic events.Topic
+	nextEvent(ctx, t, bob, events.TypeTopic, &topic)
+	if topic.Topic != "Board games tonight" || topic.Nick != aliceRoom.Nick {
+		t.Errorf("topic = %+v, want Board games tonight by %s", topic, aliceRoom.Nick)
+	}
+
+	// New joiners get the topic
+	carol := dialTestClient(ctx, t, srv)
+	var carolRoom events.Room
+	nextEvent(ctx, t, carol, events.TypeRoom, &carolRoom)
+	if carolRoom.Topic != "Board games tonight" {
+		t.Errorf("joiner's topic = %q, want Board games tonight", carolRoom.Topic)
+	}
+
+	c, err := parseConfig([]byte(`{"topic_mods_only": true}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	old := liveConfig.Swap(c)
+	if err := bob.SendMessage(ctx, "/topic off"); err != nil {
+		t.Fatal(err)
+	}
+	nextEvent(ctx, t, bob, events.TypeError, &events.Error{})
+	liveConfig.Store(old)
+
+	if err := bob.SendMessage(ctx, "/topic off"); err != nil {
+		t.Fatal(err)
+	}
+	var removed events.Topic
+	nextEvent(ctx, t, carol, events.TypeTopic, &removed)
+	if removed.Topic != "" {
+		t.Errorf("topic = %q after /topic off, want none", removed.Topic)
+	}
+}
+
+func TestIntegrationEncrypted(t *testing.T) {
+	ciphertext := base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{7}, e2eeOverhead+5))
+	t.Run("disabled", func(t *testing.T) {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		setFlag(t, &e2eeEnabled, false)
+		srv := newTestServer(t)
+
+		alice := dialTestClient(ctx, t, srv)
+		nextEvent(ctx, t, alice, events.TypeRoom, &events.Room{})
+		if err := alice.SendEncrypted(ctx, ciphertext); err != nil {
+			t.Fatal(err)
+		}
+		nextEvent(ctx, t, alice, events.TypeError, &events.Error{})
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	setFlag(t, &e2eeEnabled, true)
+	srv := newTestServer(t)
+
+	alice := dialTestClient(ctx, t, srv)
+	var aliceRoom events.Room
+	nextEvent(ctx, t, alice, events.TypeRoom, &aliceRoom)
+	bob := dialTestClient(ctx, t, srv)
+	nextEvent(ctx, t, bob, events.TypeRoom, &events.Room{})
+
+	if err := alice.SendEncrypted(ctx, ciphertext); err != nil {
+		t.Fatal(err)
+	}
+	var e events.Encrypted
+	nextEvent(ctx, t, bob, events.TypeEncrypted, &e)
+	if e.Ciphertext != ciphertext || e.Nick != aliceRoom.Nick || e.Self {
+		t.Errorf("encrypted event = %+v, want alice's ciphertext", e)
+	}
+	if err := alice.SendEncrypted(ctx, "not base64!"); err != nil {
+		t.Fatal(err)
+	}
+	nextEvent(ctx, t, alice, events.TypeError, &events.Error{})
+
+	// The passphrase isn't sent to the room by mistake
+	if err := alice.SendMessage(ctx, "/e2ee secret"); err != nil {
+		t.Fatal(err)
+	}
+	nextEvent(ctx, t, alice, events.TypeError, &events.Error{})
+}
+
+func TestIntegrationChallenge(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	c, err := parseConfig([]byte(`{"challenge_difficulty": 8}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer liveConfig.Store(liveConfig.Swap(c))
+	srv := newTestServer(t)
+
+	// Without a pass, connecting is refused and the page solves it first
+	_, resp, err := websocket.Dial(ctx, "ws"+strings.TrimPrefix(srv.URL, "http")+"/connect", nil)
+	if err == nil || resp == nil || resp.StatusCode != http.StatusPreconditionRequired {
+		t.Fatalf("connecting without a pass: %v, want status 428", err)
+	}
+	resp, err = http.Get(srv.URL + "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	page, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if !strings.Contains(string(page), "/challenge") {
+		t.Error("chat page served without solving the challenge")
+	}
+
+	// The client package solves it on its own
+	alice := dialTestClient(ctx, t, srv)
+	nextEvent(ctx, t, alice, events.TypeRoom, &events.Room{})
+}
+
+func TestIntegrationMaxClientsPerIP(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	setFlag(t, &maxClientsPerIP, 1)
+	srv := newTestServer(t)
+
+	alice := dialTestClient(ctx, t, srv)
+	nextEvent(ctx, t, alice, events.TypeRoom, &events.Room{})
+
+	bob := dialTestClient(ctx, t, srv)
+	var e events.Error
+	nextEvent(ctx, t, bob, events.TypeError, &e)
+	if !strings.Contains(e.Text, "too many connections") {
+		t.Errorf("second client got error %q", e.Text)
+	}
+}
+
+func TestIntegrationSlowMode(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	srv := newTestServer(t)
+	code := srv.Config.Handler.(*chatServer).modCodes.issue("lan")
+
+	alice := dialTestClient(ctx, t, srv)
+	nextEvent(ctx, t, alice, events.TypeRoom, &events.Room{})
+	bob := dialTestClient(ctx, t, srv)
+	nextEvent(ctx, t, bob, events.TypeRoom, &events.Room{})
+
+	// Only moderators can turn it on
+	if err := bob.SendMessage(ctx, "/slowmode 1m"); err != nil {
+		t.Fatal(err)
+	}
+	nextEvent(ctx, t, bob, events.TypeError, &events.Error{})
+
+	if err := alice.SendMessage(ctx, "/claim "+code); err != nil {
+		t.Fatal(err)
+	}
+	nextEvent(ctx, t, bob, events.TypeNotice, &events.Notice{})
+	if err := alice.SendMessage(ctx, "/slowmode 1m"); err != nil {
+		t.Fatal(err)
+	}
+	var notice events.Notice
+	nextEvent(ctx, t, bob, events.TypeNotice, &notice)
+	if !strings.Contains(notice.Text, "turned on slow mode") {
+		t.Errorf("bob got notice %q", notice.Text)
+	}
+
+	// The second message is too soon
+	for _, text := range []string{"one", "two"} {
+		if err := bob.SendMessage(ctx, text); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var e events.Error
+	nextEvent(ctx, t, bob, events.TypeError, &e)
+	if !strings.Contains(e.Text, "send another message in 1m0s") && !strings.Contains(e.Text, "in 59s") {
+		t.Errorf("bob got error %q", e.Text)
+	}
+	var m events.Message
+	nextEvent(ctx, t, alice, events.TypeMessage, &m)
+	if m.Text != "one" {
+		t.Errorf("alice got %q, want the first message", m.Text)
+	}
+
+	// Moderators aren't slowed down
+	for _, text := range []string{"three", "four"} {
+		if err := alice.SendMessage(ctx, text); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, want := range []string{"three", "four"} {
+		var m events.Message
+		nextEvent(ctx, t, bob, events.TypeMessage, &m)
+		if m.Text != want {
+			t.Errorf("bob got %q, want %q", m.Text, want)
+		}
+	}
+}
+
+func TestIntegrationSpamFilter(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	c, err := parseConfig([]byte(`{"spam_filter": {"repeats": 3}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer liveConfig.Store(liveConfig.Swap(c))
+	srv := newTestServer(t)
+
+	alice := dialTestClient(ctx, t, srv)
+	nextEvent(ctx, t, alice, events.TypeRoom, &events.Room{})
+	bob := dialTestClient(ctx, t, srv)
+	var bobRoom events.Room
+	nextEvent(ctx, t, bob, events.TypeRoom, &bobRoom)
+
+	for _, text := range []string{"buy my coins", "Buy my coins!", "BUY MY COINS", "please"} {
+		if err := bob.SendMessage(ctx, text); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var notice events.Notice
+	nextEvent(ctx, t, alice, events.TypeNotice, &notice)
+	if !strings.Contains(notice.Text, bobRoom.Nick) || !strings.Contains(notice.Text, "was muted for 5 minutes") {
+		t.Errorf("alice got notice %q", notice.Text)
+	}
+	var e events.Error
+	nextEvent(ctx, t, bob, events.TypeError, &e)
+	if !strings.Contains(e.Text, "muted for spam") {
+		t.Errorf("bob got error %q", e.Text)
+	}
+}
+
+func TestIntegrationLinkApproval(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	c, err := parseConfig([]byte(`{"link_policy": "hold"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer liveConfig.Store(liveConfig.Swap(c))
+	srv := newTestServer(t)
+	code := srv.Config.Handler.(*chatServer).modCodes.issue("lan")
+
+	alice := dialTestClient(ctx, t, srv)
+	nextEvent(ctx, t, alice, events.TypeRoom, &events.Room{})
+	bob := dialTestClient(ctx, t, srv)
+	nextEvent(ctx, t, bob, events.TypeRoom, &events.Room{})
+
+	// Nobody can approve it yet
+	if err := bob.SendMessage(ctx, "see https://example.com"); err != nil {
+		t.Fatal(err)
+	}
+	nextEvent(ctx, t, bob, events.TypeError, &events.Error{})
+
+	if err := alice.SendMessage(ctx, "/claim "+code); err != nil {
+		t.Fatal(err)
+	}
+	nextEvent(ctx, t, bob, events.TypeNotice, &events.Notice{})
+	if err := bob.SendMessage(ctx, "see https://example.com"); err != nil {
+		t.Fatal(err)
+	}
+	var held events.Notice
+	nextEvent(ctx, t, bob, events.TypeNotice, &held)
+	var notice events.Notice
+	for !strings.Contains(notice.Text, "/approve 1") {
+		notice = events.Notice{}
+		nextEvent(ctx, t, alice, events.TypeNotice, &notice)
+	}
+
+	if err := alice.SendMessage(ctx, "/approve 1"); err != nil {
+		t.Fatal(err)
+	}
+	var m events.Message
+	nextEvent(ctx, t, alice, events.TypeMessage, &m)
+	if m.Text != "see https://example.com" || m.Self {
+		t.Errorf("alice got %+v, want bob's approved message", m)
+	}
+	m = events.Message{}
+	nextEvent(ctx, t, bob, events.TypeMessage, &m)
+	if !m.Self {
+		t.Errorf("bob got %+v, want their own message", m)
+	}
+}
+
+func TestIntegrationRoomSettingsSaved(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	srv := newTestServer(t)
+	cs := srv.Config.Handler.(*chatServer)
+	var err error
+	if cs.roomSettings, err = newRoomSettingsStore(&fileStorage{roomsPath: filepath.Join(t.TempDir(), "rooms.json")}); err != nil {
+		t.Fatal(err)
+	}
+
+	alice := dialTestClient(ctx, t, srv)
+	nextEvent(ctx, t, alice, events.TypeRoom, &events.Room{})
+	if err := alice.SendMessage(ctx, "/topic Board games"); err != nil {
+		t.Fatal(err)
+	}
+	nextEvent(ctx, t, alice, events.TypeTopic, &events.Topic{})
+	alice.Close()
+	waitForRoomsClosed(ctx, t, cs)
+
+	bob := dialTestClient(ctx, t, srv)
+	var room events.Room
+	nextEvent(ctx, t, bob, events.TypeRoom, &room)
+	if room.Topic != "Board games" {
+		t.Errorf("topic after the room reopened = %q", room.Topic)
+	}
+}
+
+func TestIntegrationAway(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	srv := newTestServer(t)
+
+	alice := dialTestClient(ctx, t, srv)
+	var aliceRoom events.Room
+	nextEvent(ctx, t, alice, events.TypeRoom, &aliceRoom)
+	bob := dialTestClient(ctx, t, srv)
+	nextEvent(ctx, t, bob, events.TypeRoom, &events.Room{})
+
+	if err := alice.SendMessage(ctx, "brb"); err != nil {
+		t.Fatal(err)
+	}
+	var m events.Message
+	nextEvent(ctx, t, bob, events.TypeMessage, &m)
+	if err := alice.SendMessage(ctx, "/away getting coffee"); err != nil {
+		t.Fatal(err)
+	}
+	for {
+		var users events.UserList
+		nextEvent(ctx, t, bob, events.TypeUsers, &users)
+		if reason, ok := users.Away[aliceRoom.Nick]; ok {
+			if reason != "getting coffee" {
+				t.Errorf("away reason = %q, want getting coffee", reason)
+			}
+			break
+		}
+	}
+
+	if err := bob.Reply(ctx, m.ID, "where are you"); err != nil {
+		t.Fatal(err)
+	}
+	var n events.Notice
+	nextEvent(ctx, t, bob, events.TypeNotice, &n)
+	if want := "\u2068" + aliceRoom.Nick + "\u2069 is away: getting coffee"; n.Text != want {
+		t.Errorf("notice = %q, want %q", n.Text, want)
+	}
+	// Mentioning them tells you too
+	if err := bob.SendMessage(ctx, "@"+aliceRoom.Nick+" hello?"); err != nil {
+		t.Fatal(err)
+	}
+	nextEvent(ctx, t, bob, events.TypeNotice, &n)
+	if !strings.Contains(n.Text, "is away: getting coffee") {
+		t.Errorf("notice after mentioning = %q", n.Text)
+	}
+
+	if err := alice.SendMessage(ctx, "/back"); err != nil {
+		t.Fatal(err)
+	}
+	for {
+		var users events.UserList
+		nextEvent(ctx, t, bob, events.TypeUsers, &users)
+		if _, ok := users.Away[aliceRoom.Nick]; !ok {
+			break
+		}
+	}
+}
+
+// adminLogin logs in to the admin page with the key, returning the header to
+// send with admin requests.
+func adminLogin(t *testing.T, srv *httptest.Server, key string) http.Header {
+	t.Helper()
+	c := srv.Client()
+	c.CheckRedirect = func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }
+	resp, err := c.PostForm(srv.URL+"/admin", url.Values{"key": {key}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusSeeOther {
+		t.Fatalf("admin login got status %d", resp.StatusCode)
+	}
+	h := http.Header{}
+	for _, cookie := range resp.Cookies() {
+		h.Add("Cookie", cookie.String())
+	}
+
+	// And the CSRF token from the admin page, for POSTs
+	req, err := http.NewRequest("GET", srv.URL+"/admin", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header = h.Clone()
+	resp, err = c.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	page, _ := io.ReadAll(resp.Body)
+	_, token, ok := strings.Cut(string(page), `"X-CSRF-Token": "`)
+	token, _, _ = strings.Cut(token, `"`)
+	if !ok || token == "" {
+		t.Fatal("no CSRF token on the admin page")
+	}
+	h.Set(csrfHeader, token)
+	return h
+}
+
+func TestIntegrationAdminLive(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	setFlag(t, &adminKey, "test admin key")
+	srv := newTestServer(t)
+
+	if _, resp, err := websocket.Dial(ctx, "ws"+srv.URL[len("http"):]+"/admin-ws", nil); err == nil {
+		t.Error("admin websocket connected without logging in")
+	} else if resp == nil || resp.StatusCode != http.StatusForbidden {
+		t.Errorf("no login got %v, want 403", err)
+	}
+
+	admin, _, err := websocket.Dial(ctx, "ws"+srv.URL[len("http"):]+"/admin-ws",
+		&websocket.DialOptions{HTTPHeader: adminLogin(t, srv, adminKey)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer admin.Close(websocket.StatusNormalClosure, "")
+	read := func() string {
+		t.Helper()
+		_, b, err := admin.Read(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(b)
+	}
+	if s := read(); !strings.Contains(s, `id="admin-data"`) || !strings.Contains(s, "0 chat rooms") {
+		t.Errorf("first admin update = %q, want all the data with no rooms", s)
+	}
+
+	c := dialTestClient(ctx, t, srv)
+	nextEvent(ctx, t, c, events.TypeRoom, &events.Room{})
+	for {
+		s := read()
+		if strings.Contains(s, `id="admin-rooms" hx-swap-oob="beforeend"`) {
+			if !strings.Contains(s, "1 chatters") {
+				t.Errorf("new room update = %q, want 1 chatter", s)
+			}
+			break
+		}
+	}
+
+	if err := c.SendMessage(ctx, "hello"); err != nil {
+		t.Fatal(err)
+	}
+	for {
+		if strings.Contains(read(), "1 messages in the last minute") {
+			break
+		}
+	}
+}
+
+func TestIntegrationObserver(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	setFlag(t, &adminKey, "test admin key")
+	srv := newTestServer(t)
+
+	alice := dialTestClient(ctx, t, srv)
+	var room events.Room
+	nextEvent(ctx, t, alice, events.TypeRoom, &room)
+
+	admin, _, err := websocket.Dial(ctx, "ws"+srv.URL[len("http"):]+"/admin-room/ws?room="+url.QueryEscape(room.Name),
+		&websocket.DialOptions{HTTPHeader: adminLogin(t, srv, adminKey)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer admin.Close(websocket.StatusNormalClosure, "")
+	_, b, err := admin.Read(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(b), `id="users-list"`) {
+		t.Errorf("first frame = %q, want the user list", b)
+	}
+
+	if err := alice.SendMessage(ctx, "is anyone watching"); err != nil {
+		t.Fatal(err)
+	}
+	for {
+		_, b, err := admin.Read(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if strings.Contains(string(b), "is anyone watching") {
+			break
+		}
+	}
+
+	// The observer isn't in the room
+	bob := dialTestClient(ctx, t, srv)
+	var users events.UserList
+	nextEvent(ctx, t, bob, events.TypeUsers, &users)
+	if len(users.Nicks) != 2 {
+		t.Errorf("users = %v, want only alice and bob", users.Nicks)
+	}
+}
+
+func TestIntegrationMOTD(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	setFlag(t, &adminKey, "test admin key")
+	setFlag(t, &motdFlag, "Welcome to the test")
+	srv := newTestServer(t)
+
+	a := dialTestClient(ctx, t, srv)
+	var m events.MOTD
+	nextEvent(ctx, t, a, events.TypeMOTD, &m)
+	if m.Text != "Welcome to the test" {
+		t.Errorf("MOTD on joining = %q", m.Text)
+	}
+
+	req, err := http.NewRequest("POST", srv.URL+"/admin-motd",
+		strings.NewReader(url.Values{"motd": {"New rules"}, "broadcast": {"on"}}.Encode()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header = adminLogin(t, srv, adminKey)
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("setting the MOTD got status %d", resp.StatusCode)
+	}
+	nextEvent(ctx, t, a, events.TypeMOTD, &m)
+	if m.Text != "New rules" {
+		t.Errorf("broadcast MOTD = %q, want New rules", m.Text)
+	}
+
+	b := dialTestClient(ctx, t, srv)
+	nextEvent(ctx, t, b, events.TypeMOTD, &m)
+	if m.Text != "New rules" {
+		t.Errorf("MOTD on joining after the change = %q, want New rules", m.Text)
+	}
+}
+
+func TestIntegrationPublicStats(t *testing.T) {
+	t.Run("off", func(t *testing.T) {
+		setFlag(t, &publicStatsFlag, false)
+		srv := newTestServer(t)
+		resp, err := http.Get(srv.URL + "/stats")
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusNotFound {
+			t.Errorf("/stats without -public-stats got status %d, want 404", resp.StatusCode)
+		}
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	setFlag(t, &publicStatsFlag, true)
+	srv := newTestServer(t)
+	c := dialTestClient(ctx, t, srv)
+	nextEvent(ctx, t, c, events.TypeRoom, &events.Room{})
+	if err := c.SendMessage(ctx, "hello"); err != nil {
+		t.Fatal(err)
+	}
+	nextEvent(ctx, t, c, events.TypeMessage, &events.Message{})
+
+	resp, err := http.Get(srv.URL + "/stats")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var stats publicStats
+	if err := json.NewDecoder(resp.Body).Decode(&stats); err != nil {
+		t.Fatal(err)
+	}
+	if stats.Rooms != 1 || stats.Users != 1 || stats.MessagesToday != 1 {
+		t.Errorf("stats = %+v, want 1 room, 1 user, and 1 message", stats)
+	}
+}
+
+func TestIntegrationMultiLine(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	srv := newTestServer(t)
+
+	c := dialTestClient(ctx, t, srv)
+	nextEvent(ctx, t, c, events.TypeRoom, &events.Room{})
+	if err := c.SendMessage(ctx, "first\r\nsecond"); err != nil {
+		t.Fatal(err)
+	}
+	var m events.Message
+	nextEvent(ctx, t, c, events.TypeMessage, &m)
+	if m.Text != "first\nsecond" || m.HTML != "first<br />second" {
+		t.Errorf("multi-line message has text %q and HTML %q", m.Text, m.HTML)
+	}
+
+	if err := c.SendMessage(ctx, strings.Repeat("line\n", maxMsgLines+1)); err != nil {
+		t.Fatal(err)
+	}
+	var e events.Error
+	nextEvent(ctx, t, c, events.TypeError, &e)
+	if !strings.Contains(e.Text, "too many lines") {
+		t.Errorf("error for too many lines = %q", e.Text)
+	}
+}
+
+func TestIntegrationMention(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	srv := newTestServer(t)
+
+	a := dialTestClient(ctx, t, srv)
+	nextEvent(ctx, t, a, events.TypeRoom, &events.Room{})
+	b := dialTestClient(ctx, t, srv)
+	var room events.Room
+	nextEvent(ctx, t, b, events.TypeRoom, &room)
+
+	if err := a.SendMessage(ctx, "hey @"+room.Nick+" ||secret||"); err != nil {
+		t.Fatal(err)
+	}
+	var m events.Message
+	nextEvent(ctx, t, b, events.TypeMessage, &m)
+	if len(m.Mentions) != 1 || m.Mentions[0] != room.Nick {
+		t.Errorf("message mentions = %q, want %q", m.Mentions, room.Nick)
+	}
+	var mention events.Mention
+	nextEvent(ctx, t, b, events.TypeMention, &mention)
+	if mention.ID != m.ID || mention.Text != "hey @"+room.Nick+" [spoiler]" {
+		t.Errorf("mention event = %+v for message %s", mention, m.ID)
+	}
+
+	// The author isn't notified about their own message
+	if err := a.SendMessage(ctx, "done"); err != nil {
+		t.Fatal(err)
+	}
+	for m.Text != "done" {
+		select {
+		case e := <-a.Events():
+			if e.Type == events.TypeMention {
+				t.Fatal("author got a mention event")
+			}
+			if e.Type == events.TypeMessage {
+				e.Decode(&m)
+			}
+		case <-ctx.Done():
+			t.Fatal("timed out waiting for the message")
+		}
+	}
+}
+
+func TestIntegrationWebPush(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	pushes := make(chan []byte, 10)
+	pushSrv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasPrefix(r.Header.Get("Authorization"), "vapid t=") || r.Header.Get("Content-Encoding") != "aes128gcm" {
+			t.Errorf("push has headers %v", r.Header)
+		}
+		body, _ := io.ReadAll(r.Body)
+		pushes <- body
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer pushSrv.Close()
+	setFlag(t, &pushClient, pushSrv.Client())
+
+	var keys strings.Builder
+	runVAPIDKeys(&keys)
+	_, rest, _ := strings.Cut(keys.String(), `"vapid_private_key": "`)
+	vapidPrivate, _, _ := strings.Cut(rest, `"`)
+	c, err := parseConfig([]byte(`{"vapid_private_key": "` + vapidPrivate + `", "vapid_subject": "mailto:a@example.com"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer liveConfig.Store(liveConfig.Swap(c))
+	srv := newTestServer(t)
+
+	// b subscribes and then leaves the tab
+	cookie := http.Header{"Cookie": {sessionCookieName + "=" + ids.Random()}}
+	ps, priv, auth := testPushSubscription(t, pushSrv.URL+"/sub")
+	body, _ := json.Marshal(ps)
+	req, _ := http.NewRequest("POST", srv.URL+"/push/subscribe", bytes.NewReader(body))
+	req.Header = cookie.Clone()
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("subscribing got status %d", resp.StatusCode)
+	}
+	b, err := ntclient.Dial(ctx, srv.URL, &ntclient.Options{HTTPHeader: cookie})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+	var room events.Room
+	nextEvent(ctx, t, b, events.TypeRoom, &room)
+	if err := b.SetActive(ctx, false); err != nil {
+		t.Fatal(err)
+	}
+
+	a := dialTestClient(ctx, t, srv)
+	nextEvent(ctx, t, a, events.TypeRoom, &events.Room{})
+	if err := a.SendMessage(ctx, "@"+room.Nick+" come back"); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case body := <-pushes:
+		var e events.Envelope
+		var m events.Mention
+		if err := json.Unmarshal(decryptPush(t, body, priv, auth), &e); err != nil || e.Decode(&m) != nil {
+			t.Fatalf("push isn't an event: %v", err)
+		}
+		if e.Type != events.TypeMention || m.Text != "@"+room.Nick+" come back" {
+			t.Errorf("pushed %s event %+v", e.Type, m)
+		}
+	case <-ctx.Done():
+		t.Fatal("timed out waiting for the push")
+	}
+}
+
+func TestIntegrationNotifyPrefs(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	srv := newTestServer(t)
+
+	cookie := http.Header{"Cookie": {sessionCookieName + "=" + ids.Random()}}
+	b, err := ntclient.Dial(ctx, srv.URL, &ntclient.Options{HTTPHeader: cookie})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+	var room events.Room
+	nextEvent(ctx, t, b, events.TypeRoom, &room)
+	var prefs events.Prefs
+	nextEvent(ctx, t, b, events.TypePrefs, &prefs)
+	if prefs != (events.Prefs{Notify: "mentions"}) {
+		t.Errorf("default prefs = %+v", prefs)
+	}
+
+	if err := b.SetPrefs(ctx, "off", true); err != nil {
+		t.Fatal(err)
+	}
+	nextEvent(ctx, t, b, events.TypePrefs, &prefs)
+	if prefs != (events.Prefs{Notify: "off", Sound: true}) {
+		t.Errorf("prefs after setting = %+v", prefs)
+	}
+
+	// With notifications off, mentions still arrive but aren't alerted
+	a := dialTestClient(ctx, t, srv)
+	nextEvent(ctx, t, a, events.TypeRoom, &events.Room{})
+	for _, text := range []string{"@" + room.Nick + " hi", "done"} {
+		if err := a.SendMessage(ctx, text); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var m events.Message
+	for m.Text != "done" {
+		select {
+		case e := <-b.Events():
+			if e.Type == events.TypeMention {
+				t.Fatal("got a mention event with notifications off")
+			}
+			if e.Type == events.TypeMessage {
+				e.Decode(&m)
+			}
+		case <-ctx.Done():
+			t.Fatal("timed out waiting for the message")
+		}
+	}
+
+	// The preferences are kept for the session
+	b2, err := ntclient.Dial(ctx, srv.URL, &ntclient.Options{HTTPHeader: cookie})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b2.Close()
+	nextEvent(ctx, t, b2, events.TypePrefs, &prefs)
+	if prefs != (events.Prefs{Notify: "off", Sound: true}) {
+		t.Errorf("prefs on reconnecting = %+v", prefs)
+	}
+
+	if err := b2.SetPrefs(ctx, "loud", false); err != nil {
+		t.Fatal(err)
+	}
+	nextEvent(ctx, t, b2, events.TypeError, &events.Error{})
+}
+
+func TestIntegrationLanguage(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	srv := newTestServer(t)
+
+	header := http.Header{
+		"Cookie":          {sessionCookieName + "=" + ids.Random()},
+		"Accept-Language": {"fr-CA,fr;q=0.9,en;q=0.5"},
+	}
+	c, err := ntclient.Dial(ctx, srv.URL, &ntclient.Options{HTTPHeader: header})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	nextEvent(ctx, t, c, events.TypeRoom, &events.Room{})
+
+	var e events.Error
+	if err := c.SetNick(ctx, " "); err != nil {
+		t.Fatal(err)
+	}
+	nextEvent(ctx, t, c, events.TypeError, &e)
+	if e.Text != "Le pseudo ne peut pas être vide" {
+		t.Errorf("error in French is %q", e.Text)
+	}
+
+	// The language set with /language wins over the browser's
+	if err := c.SendMessage(ctx, "/language es"); err != nil {
+		t.Fatal(err)
+	}
+	var n events.Notice
+	nextEvent(ctx, t, c, events.TypeNotice, &n)
+	if n.Text != "Idioma cambiado a Español" {
+		t.Errorf("notice is %q", n.Text)
+	}
+	c2, err := ntclient.Dial(ctx, srv.URL, &ntclient.Options{HTTPHeader: header})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c2.Close()
+	nextEvent(ctx, t, c2, events.TypeRoom, &events.Room{})
+	if err := c2.SetNick(ctx, " "); err != nil {
+		t.Fatal(err)
+	}
+	nextEvent(ctx, t, c2, events.TypeError, &e)
+	if e.Text != "El apodo no puede estar vacío" {
+		t.Errorf("error after /language es is %q", e.Text)
+	}
+}
+
+func TestIntegrationTabsMerged(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	srv := newTestServer(t)
+
+	bob := dialTestClient(ctx, t, srv)
+	nextEvent(ctx, t, bob, events.TypeRoom, &events.Room{})
+
+	cookie := http.Header{"Cookie": {sessionCookieName + "=" + ids.Random()}}
+	tab1, err := ntclient.Dial(ctx, srv.URL, &ntclient.Options{HTTPHeader: cookie})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tab1.Close()
+	var room1 events.Room
+	nextEvent(ctx, t, tab1, events.TypeRoom, &room1)
+	tab2, err := ntclient.Dial(ctx, srv.URL, &ntclient.Options{HTTPHeader: cookie})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var room2 events.Room
+	nextEvent(ctx, t, tab2, events.TypeRoom, &room2)
+	if room2.Nick != room1.Nick {
+		t.Errorf("second tab is %q, want the same nickname as the first, %q", room2.Nick, room1.Nick)
+	}
+	var ul events.UserList
+	nextEvent(ctx, t, tab2, events.TypeUsers, &ul)
+	if len(ul.Nicks) != 2 {
+		t.Errorf("second tab got user list %v, want two people", ul.Nicks)
+	}
+
+	if err := tab1.SendMessage(ctx, "hi"); err != nil {
+		t.Fatal(err)
+	}
+	var m events.Message
+	nextEvent(ctx, t, tab2, events.TypeMessage, &m)
+	if !m.Self {
+		t.Errorf("second tab got %+v, want it shown as their own message", m)
+	}
+	tab2.Close()
+	if err := tab1.SendMessage(ctx, "still here"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Bob only sees one join, and no leave for the closed tab
+	joins := 0
+	for {
+		var e *events.Envelope
+		select {
+		case e = <-bob.Events():
+		case <-ctx.Done():
+			t.Fatal("timed out waiting for messages")
+		}
+		switch e.Type {
+		case events.TypeJoin:
+			var j events.Join
+			e.Decode(&j)
+			if j.Nick == room1.Nick {
+				joins++
+			}
+		case events.TypeLeave:
+			t.Fatal("bob was told about a tab closing")
+		case events.TypeMessage:
+			e.Decode(&m)
+		}
+		if m.Text == "still here" {
+			break
+		}
+	}
+	if joins != 1 {
+		t.Errorf("bob was told about %d joins, want 1", joins)
+	}
+}
+
+func TestIntegrationSweepGhosts(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	srv := newTestServer(t)
+	cs := srv.Config.Handler.(*chatServer)
+
+	alice := dialTestClient(ctx, t, srv)
+	nextEvent(ctx, t, alice, events.TypeRoom, &events.Room{})
+	bob := dialTestClient(ctx, t, srv)
+	var room events.Room
+	nextEvent(ctx, t, bob, events.TypeRoom, &room)
+
+	// Bob's connection stops responding without being closed
+	cs.roomsMu.Lock()
+	cr := cs.rooms["lan"]
+	cs.roomsMu.Unlock()
+	cr.clientsMu.Lock()
+	for c := range cr.clients {
+		if plainNick(c.nick) == room.Nick {
+			c.activityMu.Lock()
+			c.lastAlive = time.Now().Add(-2 * deadAfter)
+			c.activityMu.Unlock()
+		}
+	}
+	cr.clientsMu.Unlock()
+	cr.sweepGhosts()
+
+	var l events.Leave
+	nextEvent(ctx, t, alice, events.TypeLeave, &l)
+	if l.Nick != room.Nick {
+		t.Errorf("alice was told %q left, want %q", l.Nick, room.Nick)
+	}
+	var ul events.UserList
+	nextEvent(ctx, t, alice, events.TypeUsers, &ul)
+	if len(ul.Nicks) != 1 {
+		t.Errorf("user list after the sweep is %v, want just alice", ul.Nicks)
+	}
+}
+
+func TestIntegrationJoinFlood(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	srv := newTestServer(t)
+
+	cs := srv.Config.Handler.(*chatServer)
+
+	// More joins at once than the room's queue holds, or it can handle
+	// within its rate limit. Some may be too slow for so many joins and be
+	// disconnected, but every join has to finish.
+	const n = 3 * serverMsgBuffer
+	var (
+		wg      sync.WaitGroup
+		mu      sync.Mutex
+		clients []*ntclient.Client
+	)
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			c, err := ntclient.Dial(ctx, srv.URL, nil)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			mu.Lock()
+			clients = append(clients, c)
+			mu.Unlock()
+			go func() {
+				for range c.Events() {
+				}
+			}()
+		}()
+	}
+	wg.Wait()
+
+	// And every leave
+	for _, c := range clients {
+		c.Close()
+	}
+	waitForRoomsClosed(ctx, t, cs)
+
+	alice := dialTestClient(ctx, t, srv)
+	nextEvent(ctx, t, alice, events.TypeRoom, &events.Room{})
+	if err := alice.SendMessage(ctx, "hi"); err != nil {
+		t.Fatal(err)
+	}
+	nextEvent(ctx, t, alice, events.TypeMessage, &events.Message{})
+	alice.Close()
+	waitForRoomsClosed(ctx, t, cs)
+}
+
+func TestIntegrationNickUserList(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	srv := newTestServer(t)
+
+	alice := dialTestClient(ctx, t, srv)
+	nextEvent(ctx, t, alice, events.TypeRoom, &events.Room{})
+
+	// Bob joins while alice's nickname is changing
+	if err := alice.SetNick(ctx, "Alpha"); err != nil {
+		t.Fatal(err)
+	}
+	bob := dialTestClient(ctx, t, srv)
+	var room events.Room
+	nextEvent(ctx, t, bob, events.TypeRoom, &room)
+	if err := bob.SendMessage(ctx, "done"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Whatever order it happened in, the last user list is up to date
+	var users events.UserList
+	for {
+		var e *events.Envelope
+		select {
+		case e = <-bob.Events():
+		case <-ctx.Done():
+			t.Fatal("timed out waiting for bob's message")
+		}
+		if e.Type == events.TypeUsers {
+			users = events.UserList{}
+			e.Decode(&users)
+		}
+		var m events.Message
+		if e.Type == events.TypeMessage && e.Decode(&m) == nil && m.Text == "done" {
+			break
+		}
+	}
+	if len(users.Nicks) != 2 || !(users.Nicks[0] == "Alpha" || users.Nicks[1] == "Alpha") {
+		t.Errorf("bob's user list is %v, want Alpha and %s", users.Nicks, room.Nick)
+	}
+}
+
+func TestIntegrationRoomExpiry(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	setFlag(t, &roomExpiry, time.Hour)
+	srv := newTestServer(t)
+	cs := srv.Config.Handler.(*chatServer)
+	hooked := make(chan roomEvent, 2)
+	cs.roomHooks = append(cs.roomHooks, func(e roomEvent) { hooked <- e })
+
+	alice := dialTestClient(ctx, t, srv)
+	nextEvent(ctx, t, alice, events.TypeRoom, &events.Room{})
+	if e := <-hooked; e.Event != roomEventCreated || e.Room != "lan" {
+		t.Errorf("room hook got %+v, want lan created", e)
+	}
+
+	cs.expireRooms(time.Now().Add(59 * time.Minute))
+	if err := alice.SendMessage(ctx, "still here"); err != nil {
+		t.Fatal(err)
+	}
+	nextEvent(ctx, t, alice, events.TypeMessage, &events.Message{})
+
+	// An hour after that message
+	cs.expireRooms(time.Now().Add(time.Hour))
+	var n events.Notice
+	nextEvent(ctx, t, alice, events.TypeNotice, &n)
+	if n.Text != "This room was closed after 1h without messages." {
+		t.Errorf("notice = %q", n.Text)
+	}
+	for range alice.Events() {
+	}
+	if err := alice.Err(); err == nil || !strings.Contains(err.Error(), "chat room closed after 1h") {
+		t.Errorf("alice was disconnected with %v", err)
+	}
+	if e := <-hooked; e.Event != roomEventClosed || e.Reason != roomExpired || e.Messages != 1 {
+		t.Errorf("room hook got %+v, want lan expired with 1 message", e)
+	}
+	waitForRoomsClosed(ctx, t, cs)
+}
+
+func TestIntegrationRateQueue(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	srv := newTestServer(t)
+	cs := srv.Config.Handler.(*chatServer)
+
+	alice := dialTestClient(ctx, t, srv)
+	nextEvent(ctx, t, alice, events.TypeRoom, &events.Room{})
+	cs.roomsMu.Lock()
+	cr := cs.rooms["lan"]
+	cs.roomsMu.Unlock()
+	cr.limiter.SetBurst(1)
+	cr.limiter.SetLimit(2)
+
+	// The first is handled right away, the next four wait up to two seconds,
+	// and the rest would wait too long
+	texts := []string{"one", "two", "three", "four", "five", "six", "seven"}
+	for _, text := range texts {
+		if err := alice.SendMessage(ctx, text); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Joining isn't held up by the messages waiting
+	bob := dialTestClient(ctx, t, srv)
+	nextEvent(ctx, t, bob, events.TypeRoom, &events.Room{})
+
+	var got []string
+	refused := 0
+	for len(got)+refused < len(texts) {
+		select {
+		case e, ok := <-alice.Events():
+			if !ok {
+				t.Fatalf("alice was disconnected: %v", alice.Err())
+			}
+			var m events.Message
+			if e.Type == events.TypeError {
+				refused++
+			} else if e.Type == events.TypeMessage && e.Decode(&m) == nil {
+				got = append(got, m.Text)
+			}
+		case <-ctx.Done():
+			t.Fatalf("timed out with messages %v and %d refused", got, refused)
+		}
+	}
+	if refused < 2 || len(got) < 4 {
+		t.Errorf("got messages %v and %d refused, want the last ones refused", got, refused)
+	}
+	for i, text := range got {
+		if text != texts[i] {
+			t.Errorf("got messages %v, want them in order", got)
+			break
+		}
+	}
+	// Bob was in the room before the last one was sent
+	var m events.Message
+	for m.Text != got[len(got)-1] {
+		nextEvent(ctx, t, bob, events.TypeMessage, &m)
+	}
+}
+
+func TestIntegrationCloseRoom(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	srv := newTestServer(t)
+	cs := srv.Config.Handler.(*chatServer)
+
+	alice := dialTestClient(ctx, t, srv)
+	nextEvent(ctx, t, alice, events.TypeRoom, &events.Room{})
+	cr := cs.getRoom("lan")
+	cr.limiter.SetBurst(1)
+	cr.limiter.SetLimit(1)
+
+	// The first is sent, and the rest wait for the rate limit until the room
+	// closes
+	for _, text := range []string{"one", "two", "three"} {
+		if err := alice.SendMessage(ctx, text); err != nil {
+			t.Fatal(err)
+		}
+	}
+	nextEvent(ctx, t, alice, events.TypeMessage, &events.Message{})
+	if !cs.closeRoom("lan", roomClosedByAdmin) {
+		t.Fatal("the room wasn't found")
+	}
+	if cs.closeRoom("lan", roomClosedByAdmin) {
+		t.Error("the room was closed twice")
+	}
+
+	var errs []string
+	var notice string
+	for e := range alice.Events() {
+		switch e.Type {
+		case events.TypeError:
+			var ev events.Error
+			e.Decode(&ev)
+			errs = append(errs, ev.Text)
+		case events.TypeNotice:
+			var n events.Notice
+			e.Decode(&n)
+			notice = n.Text
+		case events.TypeMessage:
+			t.Error("a message was sent after the room closed")
+		}
+	}
+	if len(errs) != 2 || errs[0] != "The room closed before your message was sent" {
+		t.Errorf("alice got errors %q, want the two messages refused", errs)
+	}
+	if notice != "This room was closed by the admin." {
+		t.Errorf("alice got notice %q", notice)
+	}
+	if err := alice.Err(); err == nil || !strings.Contains(err.Error(), "chat room closed by the admin") {
+		t.Errorf("alice was disconnected with %v", err)
+	}
+	if cs.getRoom("lan") != nil {
+		t.Error("the room is still there")
+	}
+}
+
+func TestIntegrationBinary(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	srv := newTestServer(t)
+	wsURL := "ws" + strings.TrimPrefix(srv.URL, "http") + "/connect"
+
+	// The web UI can't ask for it
+	conn, _, err := websocket.Dial(ctx, wsURL, &websocket.DialOptions{Subprotocols: []string{events.SubprotocolCBOR}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p := conn.Subprotocol(); p != "" {
+		t.Errorf("web UI client got subprotocol %q", p)
+	}
+	conn.Close(websocket.StatusNormalClosure, "")
+
+	alice, err := ntclient.Dial(ctx, srv.URL, &ntclient.Options{Binary: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer alice.Close()
+	nextEvent(ctx, t, alice, events.TypeJoin, &events.Join{})
+	bob := dialTestClient(ctx, t, srv)
+	nextEvent(ctx, t, bob, events.TypeJoin, &events.Join{})
+
+	// Events are sent as binary messages
+	raw, _, err := websocket.Dial(ctx, wsURL+"?proto=json", &websocket.DialOptions{Subprotocols: []string{events.SubprotocolCBOR}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer raw.Close(websocket.StatusNormalClosure, "")
+	if p := raw.Subprotocol(); p != events.SubprotocolCBOR {
+		t.Fatalf("got subprotocol %q", p)
+	}
+	typ, b, err := raw.Read(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e, err := events.DecodeCBOR(b); typ != websocket.MessageBinary || err != nil || e.Type != events.TypeRoom {
+		t.Errorf("first message was %v %q: %v", typ, b, err)
+	}
+
+	if err := alice.SendMessage(ctx, "hello from CBOR"); err != nil {
+		t.Fatal(err)
+	}
+	var m events.Message
+	nextEvent(ctx, t, bob, events.TypeMessage, &m)
+	if m.Text != "hello from CBOR" {
+		t.Errorf("bob got %q", m.Text)
+	}
+	nextEvent(ctx, t, alice, events.TypeMessage, &m)
+	if m.Text != "hello from CBOR" || !m.Self || m.Time.IsZero() {
+		t.Errorf("alice got %+v", m)
+	}
+
+	if err := bob.SendMessage(ctx, "hello from JSON"); err != nil {
+		t.Fatal(err)
+	}
+	nextEvent(ctx, t, alice, events.TypeMessage, &m)
+	if m.Text != "hello from JSON" || m.Self {
+		t.Errorf("alice got %+v", m)
+	}
+}
+
+func TestIntegrationOrigins(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	wsURL := func(srv *httptest.Server) string {
+		return "ws" + strings.TrimPrefix(srv.URL, "http") + "/connect?proto=json"
+	}
+	from := func(origin string) *websocket.DialOptions {
+		return &websocket.DialOptions{HTTPHeader: http.Header{"Origin": {origin}}}
+	}
+
+	// Pages on other sites can't connect
+	t.Run("not allowed", func(t *testing.T) {
+		setFlag(t, &allowedOrigins, "")
+		srv := newTestServer(t)
+		if _, resp, err := websocket.Dial(ctx, wsURL(srv), from("https://evil.example")); err == nil {
+			t.Error("connected from another origin")
+		} else if resp == nil || resp.StatusCode != http.StatusForbidden {
+			t.Errorf("connecting from another origin: %v, want 403", err)
+		}
+		req, _ := http.NewRequestWithContext(ctx, "GET", srv.URL+"/sse", nil)
+		req.Header.Set("Origin", "https://evil.example")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusForbidden {
+			t.Errorf("event stream from another origin got status %d, want 403", resp.StatusCode)
+		}
+	})
+
+	// Unless they're allowed, and the server's own pages always can
+	setFlag(t, &allowedOrigins, "https://evil.example")
+	setFlag(t, &adminKey, "test admin key")
+	srv := newTestServer(t)
+	for _, origin := range []string{"https://evil.example", srv.URL} {
+		conn, _, err := websocket.Dial(ctx, wsURL(srv), from(origin))
+		if err != nil {
+			t.Fatalf("connecting from %s: %v", origin, err)
+		}
+		conn.Close(websocket.StatusNormalClosure, "")
+	}
+
+	// Admin actions need the CSRF token
+	h := adminLogin(t, srv, adminKey)
+	post := func(h http.Header) int {
+		req, _ := http.NewRequestWithContext(ctx, "POST", srv.URL+"/admin-motd",
+			strings.NewReader(url.Values{"motd": {"Forged"}}.Encode()))
+		req.Header = h
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	noToken := h.Clone()
+	noToken.Del(csrfHeader)
+	if code := post(noToken); code != http.StatusForbidden {
+		t.Errorf("admin POST without the CSRF token got status %d, want 403", code)
+	}
+	if code := post(h); code != http.StatusOK {
+		t.Errorf("admin POST with the CSRF token got status %d", code)
+	}
+	waitForRoomsClosed(ctx, t, srv.Config.Handler.(*chatServer))
+}
+
+func TestIntegrationSecurityHeaders(t *testing.T) {
+	setFlag(t, &widgetOrigins, "https://intranet.example.com")
+	srv := newTestServer(t)
+
+	for _, path := range []string{"/", "/connect", "/widget"} {
+		resp, err := http.Get(srv.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.Header.Get("X-Content-Type-Options") != "nosniff" || resp.Header.Get("Referrer-Policy") == "" {
+			t.Errorf("%s is missing security headers: %v", path, resp.Header)
+		}
+		csp := resp.Header.Get("Content-Security-Policy")
+		if !strings.Contains(csp, "default-src 'self'") {
+			t.Errorf("%s has Content-Security-Policy %q", path, csp)
+		}
+		// Only the widget can be framed by other sites
+		framed := strings.HasSuffix(csp, "frame-ancestors 'self' https://intranet.example.com")
+		if framed != (path == "/widget") {
+			t.Errorf("%s has Content-Security-Policy %q", path, csp)
+		}
+	}
+}
+
+func TestIntegrationDebug(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	setFlag(t, &adminKey, "test admin key")
+	srv := newTestServer(t)
+
+	get := func(path string, h http.Header) *http.Response {
+		t.Helper()
+		req, _ := http.NewRequestWithContext(ctx, "GET", srv.URL+path, nil)
+		req.Header = h
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+	for _, h := range []http.Header{{}, {"Authorization": {"Bearer wrong key"}}} {
+		resp := get("/debug/runtime", h)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusForbidden {
+			t.Errorf("/debug/runtime with %v got status %d, want 403", h, resp.StatusCode)
+		}
+	}
+
+	alice := dialTestClient(ctx, t, srv)
+	nextEvent(ctx, t, alice, events.TypeJoin, &events.Join{})
+	bearer := http.Header{"Authorization": {"Bearer " + adminKey}}
+	resp := get("/debug/runtime", bearer)
+	var d runtimeDump
+	err := json.NewDecoder(resp.Body).Decode(&d)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d.Clients != 1 || len(d.Rooms) != 1 || d.Rooms[0].Clients != 1 || d.Rooms[0].ClientsLocked {
+		t.Errorf("runtime dump = %+v", d)
+	}
+	started := 0
+	for fn, n := range d.GoroutinesByFunc {
+		if strings.HasSuffix(fn, ".(*chatRoom).start") {
+			started += n
+		}
+	}
+	// Other tests' rooms might still be closing
+	if started < 1 {
+		t.Error("the room's goroutine wasn't counted")
+	}
+
+	// The profiles work when logged in too
+	resp = get("/debug/pprof/", adminLogin(t, srv, adminKey))
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || !strings.Contains(string(body), "goroutine") {
+		t.Errorf("pprof index got status %d", resp.StatusCode)
+	}
+	resp = get("/debug/pprof/profile?seconds=1", bearer)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("CPU profile got status %d", resp.StatusCode)
+	}
+}
+
+// lockedBuffer is a bytes.Buffer that's safe to use from several goroutines,
+// for capturing logs.
+type lockedBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *lockedBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+func TestIntegrationAccessLog(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	c, err := parseConfig([]byte(`{"access_log": {"exclude": ["/stats"]}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer liveConfig.Store(liveConfig.Swap(c))
+	var logs lockedBuffer
+	log.SetOutput(&logs)
+	defer log.SetOutput(os.Stderr)
+	srv := newTestServer(t)
+
+	for _, path := range []string{"/events?secret=1", "/stats", "/admin-motd"} {
+		resp, err := http.Post(srv.URL+path, "text/plain", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+	}
+	alice := dialTestClient(ctx, t, srv)
+	nextEvent(ctx, t, alice, events.TypeJoin, &events.Join{})
+	alice.Close()
+	waitForRoomsClosed(ctx, t, srv.Config.Handler.(*chatServer))
+
+	out := logs.String()
+	for _, want := range []string{
+		`access method=POST path="/events" status=200 duration=`,
+		`access method=POST path="/admin-motd" status=403 duration=`,
+		" ip=127.0.0.0\n",
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("access log is missing %q:\n%s", want, out)
+		}
+	}
+	for _, unwanted := range []string{"secret", `path="/stats"`, `path="/connect"`} {
+		if strings.Contains(out, unwanted) {
+			t.Errorf("access log has %q:\n%s", unwanted, out)
+		}
+	}
+}
+
+func TestIntegrationPrivateRooms(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	setFlag(t, &privateRooms, true)
+	setFlag(t, &trustedProxies, 1)
+	srv := newTestServer(t)
+
+	dial := func(ip string) events.Room {
+		t.Helper()
+		c, err := ntclient.Dial(ctx, srv.URL, &ntclient.Options{
+			HTTPHeader: http.Header{"X-Forwarded-For": {ip}},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { c.Close() })
+		var room events.Room
+		nextEvent(ctx, t, c, events.TypeRoom, &room)
+		nextEvent(ctx, t, c, events.TypeJoin, &events.Join{})
+		return room
+	}
+	alice := dial("203.0.113.5")
+	bob := dial("203.0.113.5")
+	carol := dial("203.0.113.6")
+	if !strings.HasPrefix(alice.Name, "Room ") || bob.Name != alice.Name {
+		t.Errorf("room names = %q and %q, want the same pseudonym", alice.Name, bob.Name)
+	}
+	if carol.Name == alice.Name {
+		t.Errorf("room name = %q for another address, want a different room", carol.Name)
+	}
+
+	cs := srv.Config.Handler.(*chatServer)
+	cs.roomsMu.Lock()
+	defer cs.roomsMu.Unlock()
+	if len(cs.rooms) != 2 {
+		t.Errorf("%d rooms, want 2", len(cs.rooms))
+	}
+	for key := range cs.rooms {
+		if strings.Contains(key, "203.0.113") {
+			t.Errorf("room key %q has the address", key)
+		}
+	}
+}
+
+func TestIntegrationRoomDisplay(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	setFlag(t, &roomDisplay, roomDisplayNameSubnet)
+	setFlag(t, &trustedProxies, 1)
+	srv := newTestServer(t)
+
+	c, err := ntclient.Dial(ctx, srv.URL, &ntclient.Options{
+		HTTPHeader: http.Header{"X-Forwarded-For": {"203.0.113.5"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	var room events.Room
+	nextEvent(ctx, t, c, events.TypeRoom, &room)
+	nextEvent(ctx, t, c, events.TypeJoin, &events.Join{})
+	if want := "Room " + roomPseudonym("203.0.113.5") + " (203.0.113.0/24)"; room.Name != want {
+		t.Errorf("room name = %q, want %q", room.Name, want)
+	}
+}
+
+func TestIntegrationErase(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	setFlag(t, &adminKey, "test admin key")
+	srv := newTestServer(t)
+	cs := srv.Config.Handler.(*chatServer)
+
+	alice := dialTestClient(ctx, t, srv)
+	nextEvent(ctx, t, alice, events.TypeJoin, &events.Join{})
+	cs.reports.add("lan", "rude", false)
+
+	req, err := http.NewRequest("POST", srv.URL+"/admin-erase", strings.NewReader(url.Values{"target": {"127.0.0.1"}}.Encode()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header = adminLogin(t, srv, adminKey)
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if want := "For lan: closed the room, deleted its reports, deleted its statistics."; !strings.Contains(string(body), want) {
+		t.Errorf("erasing got %q, want %q", body, want)
+	}
+
+	var n events.Notice
+	nextEvent(ctx, t, alice, events.TypeNotice, &n)
+	if n.Text != "This room was closed by the admin." {
+		t.Errorf("alice got notice %q", n.Text)
+	}
+	if cs.getRoom("lan") != nil || cs.closedRooms.remove("lan") != 0 || cs.reports.remove("lan") {
+		t.Error("something is still kept about the room")
+	}
+	if es := cs.audit.entries(); len(es) == 0 || es[0].Action != auditErase || es[0].Target != "lan" {
+		t.Errorf("audit log = %+v, want the erasure", es)
+	}
+}
+
+func TestIntegrationInvite(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	setFlag(t, &invitesFlag, true)
+	setFlag(t, &trustedProxies, 1)
+	srv := newTestServer(t)
+
+	alice := dialTestClient(ctx, t, srv)
+	nextEvent(ctx, t, alice, events.TypeJoin, &events.Join{})
+	if err := alice.SendMessage(ctx, "/invite 1h"); err != nil {
+		t.Fatal(err)
+	}
+	var n events.Notice
+	nextEvent(ctx, t, alice, events.TypeNotice, &n)
+	_, token, _ := strings.Cut(n.Text, "/invite/")
+	token, _, _ = strings.Cut(token, " ")
+	if token == "" {
+		t.Fatalf("invite notice = %q, want a link", n.Text)
+	}
+
+	// Bob is on another network
+	bob, err := ntclient.Dial(ctx, srv.URL, &ntclient.Options{
+		Invite:     token,
+		HTTPHeader: http.Header{"X-Forwarded-For": {"203.0.113.5"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bob.Close()
+	var room events.Room
+	nextEvent(ctx, t, bob, events.TypeRoom, &room)
+	if room.Name != "lan" {
+		t.Errorf("bob joined %q, want alice's room", room.Name)
+	}
+	var users events.UserList
+	nextEvent(ctx, t, alice, events.TypeUsers, &users)
+	if len(users.Nicks) != 2 || len(users.Guests) != 1 || users.Guests[0] != room.Nick {
+		t.Errorf("user list = %+v, want bob as a guest", users)
+	}
+	if err := bob.SendMessage(ctx, "/invite"); err != nil {
+		t.Fatal(err)
+	}
+	var e events.Error
+	nextEvent(ctx, t, bob, events.TypeError, &e)
+	if e.Text != "Guests can't invite anyone" {
+		t.Errorf("guest inviting got %q", e.Text)
+	}
+
+	srv.Config.Handler.(*chatServer).invites.setEnabled(false)
+	if _, err := ntclient.Dial(ctx, srv.URL, &ntclient.Options{Invite: token}); err == nil {
+		t.Error("the invite still worked with invites off")
+	}
+}
+
+func TestIntegrationNearby(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	setFlag(t, &nearbyPolicy, nearbySubnet)
+	setFlag(t, &invitesFlag, true)
+	setFlag(t, &trustedProxies, 1)
+	srv := newTestServer(t)
+	dial := func(addr string) *ntclient.Client {
+		c, err := ntclient.Dial(ctx, srv.URL, &ntclient.Options{
+			HTTPHeader: http.Header{"X-Forwarded-For": {addr}},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { c.Close() })
+		nextEvent(ctx, t, c, events.TypeJoin, &events.Join{})
+		return c
+	}
+	send := func(c *ntclient.Client, text string) events.Notice {
+		if err := c.SendMessage(ctx, text); err != nil {
+			t.Fatal(err)
+		}
+		var n events.Notice
+		nextEvent(ctx, t, c, events.TypeNotice, &n)
+		return n
+	}
+
+	alice := dial("203.0.113.5")
+	bob := dial("203.0.7.9")
+	carol := dial("198.51.100.1")
+	if n := send(bob, "/nearby"); n.Text != "No rooms nearby are showing themselves right now" {
+		t.Errorf("/nearby before any room was shown got %q", n.Text)
+	}
+
+	send(alice, "/nearby on")
+	n := send(bob, "/nearby")
+	if strings.Contains(n.Text, "203.0.113") {
+		t.Errorf("/nearby showed the address: %q", n.Text)
+	}
+	id, _, ok := strings.Cut(strings.TrimPrefix(n.Text, "Rooms nearby: "), ":")
+	if !ok || len(id) != nearbyIDLen {
+		t.Fatalf("/nearby got %q, want alice's room", n.Text)
+	}
+	if n := send(carol, "/nearby"); n.Text != "No rooms nearby are showing themselves right now" {
+		t.Errorf("/nearby from another subnet got %q", n.Text)
+	}
+
+	n = send(bob, "/hop "+strings.ToLower(id))
+	_, token, _ := strings.Cut(n.Text, "/invite/")
+	token, _, _ = strings.Cut(token, " ")
+	if token == "" {
+		t.Fatalf("/hop got %q, want a link", n.Text)
+	}
+	visitor, err := ntclient.Dial(ctx, srv.URL, &ntclient.Options{
+		Invite:     token,
+		HTTPHeader: http.Header{"X-Forwarded-For": {"203.0.7.9"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer visitor.Close()
+	var room events.Room
+	nextEvent(ctx, t, visitor, events.TypeRoom, &room)
+	var users events.UserList
+	nextEvent(ctx, t, alice, events.TypeUsers, &users)
+	if len(users.Guests) != 1 || users.Guests[0] != room.Nick {
+		t.Errorf("user list = %+v, want the visitor as a guest", users)
+	}
+
+	send(alice, "/nearby off")
+	if n := send(bob, "/nearby"); n.Text != "No rooms nearby are showing themselves right now" {
+		t.Errorf("/nearby after the room was hidden got %q", n.Text)
+	}
+}
+
+func TestIntegrationIRCBridge(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	srv := newTestServer(t)
+	cs := srv.Config.Handler.(*chatServer)
+	alice := dialTestClient(ctx, t, srv)
+	var join events.Join
+	nextEvent(ctx, t, alice, events.TypeJoin, &join)
+
+	// A fake IRC server with one channel
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	cs.irc.setConfigured([]configIRCBridge{{Room: "lan", Server: ln.Addr().String(), Nick: "bridge", Channel: "#test"}})
+	defer cs.irc.setConfigured(nil)
+	conn, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	r := bufio.NewReader(conn)
+	expect := func(prefix string) string {
+		t.Helper()
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				t.Fatalf("waiting for %q: %v", prefix, err)
+			}
+			if strings.HasPrefix(line, prefix) {
+				return strings.TrimRight(line, "\r\n")
+			}
+		}
+	}
+	expect("USER ")
+	io.WriteString(conn, ":irc.test 001 bridge :Welcome\r\n")
+	expect("JOIN #test")
+	io.WriteString(conn, ":bridge!b@host JOIN #test\r\n")
+	io.WriteString(conn, ":bob!b@host PRIVMSG #test :hello \x02from\x02 irc\r\n")
+
+	var m events.Message
+	nextEvent(ctx, t, alice, events.TypeMessage, &m)
+	if m.Nick != "irc/bob" || m.Text != "hello from irc" {
+		t.Errorf("got %q from %q, want the IRC message", m.Text, m.Nick)
+	}
+	if err := alice.SendMessage(ctx, "hi bob"); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := expect("PRIVMSG "), "PRIVMSG #test :<"+join.Nick+"> hi bob"; got != want {
+		t.Errorf("IRC got %q, want %q", got, want)
+	}
+}
+
+func TestIntegrationMatrixBridge(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	srv := newTestServer(t)
+	cs := srv.Config.Handler.(*chatServer)
+	alice := dialTestClient(ctx, t, srv)
+	var join events.Join
+	nextEvent(ctx, t, alice, events.TypeJoin, &join)
+
+	// A fake homeserver with one room
+	syncs := make(chan string, 10)
+	sent := make(chan matrixMessage, 10)
+	hs := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer token" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		switch path := strings.TrimPrefix(r.URL.Path, "/_matrix/client/v3"); {
+		case path == "/account/whoami":
+			io.WriteString(w, `{"user_id": "@bridge:test"}`)
+		case path == "/join/#test:test":
+			io.WriteString(w, `{"room_id": "!room:test"}`)
+		case path == "/sync" && r.URL.Query().Get("since") == "":
+			io.WriteString(w, `{"next_batch": "1", "rooms": {"join": {"!room:test": {
+				"state": {"events": [{"type": "m.room.member", "sender": "@bob:test", "state_key": "@bob:test",
+					"content": {"membership": "join", "displayname": "Bob"}}]},
+				"timeline": {"events": [{"type": "m.room.message", "sender": "@bob:test",
+					"content": {"msgtype": "m.text", "body": "old history"}}]}}}}}`)
+		case path == "/sync":
+			select {
+			case s := <-syncs:
+				io.WriteString(w, s)
+			case <-time.After(50 * time.Millisecond):
+				io.WriteString(w, `{"next_batch": "1"}`)
+			case <-r.Context().Done():
+			}
+		case strings.HasPrefix(path, "/rooms/!room:test/send/m.room.message/"):
+			var m matrixMessage
+			json.NewDecoder(r.Body).Decode(&m)
+			sent <- m
+			io.WriteString(w, `{"event_id": "$1"}`)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer hs.Close()
+	cs.matrix.setConfigured([]configMatrixBridge{{Room: "lan", Homeserver: hs.URL, AccessToken: "token", MatrixRoom: "#test:test"}})
+	defer cs.matrix.setConfigured(nil)
+	nextSent := func() matrixMessage {
+		t.Helper()
+		select {
+		case m := <-sent:
+			return m
+		case <-ctx.Done():
+			t.Fatal("timed out waiting for a message to Matrix")
+			return matrixMessage{}
+		}
+	}
+
+	syncs <- `{"next_batch": "2", "rooms": {"join": {"!room:test": {"timeline": {"events": [
+		{"type": "m.room.message", "sender": "@bob:test", "content": {"msgtype": "m.text", "body": "hello from matrix"}}]}}}}}`
+	var m events.Message
+	nextEvent(ctx, t, alice, events.TypeMessage, &m)
+	if m.Nick != "matrix/Bob" || m.Text != "hello from matrix" {
+		t.Errorf("got %q from %q, want the Matrix message", m.Text, m.Nick)
+	}
+
+	if err := alice.SendMessage(ctx, "hi bob"); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := nextSent(), (matrixMessage{MsgType: "m.text", Body: "<" + join.Nick + "> hi bob"}); got.MsgType != want.MsgType || got.Body != want.Body {
+		t.Errorf("Matrix got %+v, want %+v", got, want)
+	}
+	carol := dialTestClient(ctx, t, srv)
+	var carolJoin events.Join
+	nextEvent(ctx, t, carol, events.TypeJoin, &carolJoin)
+	if got := nextSent(); got.MsgType != "m.notice" || got.Body != carolJoin.Nick+" joined" {
+		t.Errorf("Matrix got %+v, want a join notice", got)
+	}
+
+	syncs <- `{"next_batch": "3", "rooms": {"join": {"!room:test": {"timeline": {"events": [
+		{"type": "m.room.member", "sender": "@dave:test", "state_key": "@dave:test", "content": {"membership": "join"}}]}}}}}`
+	var n events.Notice
+	nextEvent(ctx, t, alice, events.TypeNotice, &n)
+	if n.Text != "dave joined on Matrix" {
+		t.Errorf("got notice %q, want dave joining", n.Text)
+	}
+}
+
+func TestIntegrationXMPPGateway(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	srv := newTestServer(t)
+	cs := srv.Config.Handler.(*chatServer)
+	alice := dialTestClient(ctx, t, srv)
+	var join events.Join
+	nextEvent(ctx, t, alice, events.TypeJoin, &join)
+
+	// A fake XMPP server, with the gateway as a component
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	cs.xmpp.setConfigured(&configXMPPGateway{Server: ln.Addr().String(), Domain: "chat.test", Secret: "secret", Rooms: map[string]string{"lan": "lan"}})
+	defer cs.xmpp.setConfigured(nil)
+	conn, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	d := xml.NewDecoder(conn)
+	type stanza struct {
+		XMLName xml.Name
+		From    string `xml:"from,attr"`
+		To      string `xml:"to,attr"`
+		Type    string `xml:"type,attr"`
+		Inner   string `xml:",innerxml"`
+	}
+	expect := func(kind, from string) stanza {
+		t.Helper()
+		for {
+			tok, err := d.Token()
+			if err != nil {
+				t.Fatalf("waiting for <%s> from %s: %v", kind, from, err)
+			}
+			se, ok := tok.(xml.StartElement)
+			if !ok {
+				continue
+			}
+			var s stanza
+			if err := d.DecodeElement(&s, &se); err != nil {
+				t.Fatal(err)
+			}
+			if s.XMLName.Local == kind && s.From == from {
+				return s
+			}
+		}
+	}
+	if tok, err := d.Token(); err != nil || tok.(xml.StartElement).Name.Local != "stream" {
+		t.Fatalf("got %v, %v, want the stream header", tok, err)
+	}
+	io.WriteString(conn, `<stream:stream xmlns:stream='http://etherx.jabber.org/streams' xmlns='jabber:component:accept' from='chat.test' id='abc'>`)
+	sum := sha1.Sum([]byte("abcsecret"))
+	if hs := expect("handshake", ""); hs.Inner != hex.EncodeToString(sum[:]) {
+		t.Fatalf("got handshake %q, want the digest", hs.Inner)
+	}
+	io.WriteString(conn, "<handshake/>")
+
+	io.WriteString(conn, `<presence from='bob@test/phone' to='lan@chat.test/bob'><x xmlns='http://jabber.org/protocol/muc'/></presence>`)
+	expect("presence", "lan@chat.test/"+join.Nick)
+	if self := expect("presence", "lan@chat.test/bob"); !strings.Contains(self.Inner, "110") {
+		t.Errorf("got %s, want bob's own presence", self.Inner)
+	}
+	expect("message", "lan@chat.test")
+	var n events.Notice
+	nextEvent(ctx, t, alice, events.TypeNotice, &n)
+	if n.Text != "bob joined on XMPP" {
+		t.Errorf("got notice %q, want bob joining", n.Text)
+	}
+
+	io.WriteString(conn, `<message from='bob@test/phone' to='lan@chat.test' type='groupchat'><body>hello from xmpp</body></message>`)
+	expect("message", "lan@chat.test/bob")
+	var m events.Message
+	nextEvent(ctx, t, alice, events.TypeMessage, &m)
+	if m.Nick != "xmpp/bob" || m.Text != "hello from xmpp" {
+		t.Errorf("got %q from %q, want the XMPP message", m.Text, m.Nick)
+	}
+	if err := alice.SendMessage(ctx, "hi bob"); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := expect("message", "lan@chat.test/"+join.Nick).Inner, "<body>hi bob</body>"; got != want {
+		t.Errorf("XMPP got %s, want %s", got, want)
+	}
+
+	carol := dialTestClient(ctx, t, srv)
+	var carolJoin events.Join
+	nextEvent(ctx, t, carol, events.TypeJoin, &carolJoin)
+	if p := expect("presence", "lan@chat.test/"+carolJoin.Nick); p.To != "bob@test/phone" || p.Type != "" {
+		t.Errorf("got %+v, want carol's presence for bob", p)
+	}
+}
+
+func TestIntegrationWebhook(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	srv := newTestServer(t)
+	cs := srv.Config.Handler.(*chatServer)
+	alice := dialTestClient(ctx, t, srv)
+	var join events.Join
+	nextEvent(ctx, t, alice, events.TypeJoin, &join)
+
+	// A fake Slack webhook
+	posted := make(chan string, 10)
+	hook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var p struct{ Text string }
+		json.NewDecoder(r.Body).Decode(&p)
+		posted <- p.Text
+	}))
+	defer hook.Close()
+	c, err := parseConfig([]byte(`{"webhooks": [{"room": "lan", "url": "` + hook.URL + `", "kind": "slack", "inbound_token": "0123456789abcdef"}]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer liveConfig.Store(liveConfig.Swap(c))
+	cs.webhooks.setConfigured(c.Webhooks)
+	defer cs.webhooks.setConfigured(nil)
+
+	if err := alice.SendMessage(ctx, "the printer is on fire"); err != nil {
+		t.Fatal(err)
+	}
+	nextEvent(ctx, t, alice, events.TypeMessage, &events.Message{})
+	select {
+	case text := <-posted:
+		if want := "*" + join.Nick + "*: the printer is on fire"; text != want {
+			t.Errorf("Slack got %q, want %q", text, want)
+		}
+	case <-ctx.Done():
+		t.Fatal("timed out waiting for the webhook")
+	}
+
+	resp, err := http.PostForm(srv.URL+"/hooks/wrong-token-0123456", url.Values{"user_name": {"mallory"}, "text": {"hi"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("wrong token got %s, want 404", resp.Status)
+	}
+	resp, err = http.PostForm(srv.URL+"/hooks/0123456789abcdef", url.Values{"user_name": {"it"}, "text": {"on our way &amp; bringing <https://example.com/extinguisher|an extinguisher>"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent {
+		t.Errorf("inbound message got %s, want 204", resp.Status)
+	}
+	var m events.Message
+	nextEvent(ctx, t, alice, events.TypeMessage, &m)
+	if want := "on our way & bringing https://example.com/extinguisher"; m.Nick != "slack/it" || m.Text != want {
+		t.Errorf("got %q from %q, want the Slack message", m.Text, m.Nick)
+	}
+	select {
+	case text := <-posted:
+		t.Errorf("the Slack message was posted back as %q", text)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestIntegrationLANMode(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	setFlag(t, &lanMode, true)
+	c, err := parseConfig([]byte(`{"lan_rooms": [{"name": "Ground floor", "subnets": ["127.0.0.0/8"]}]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer liveConfig.Store(liveConfig.Swap(c))
+	srv := newTestServer(t)
+
+	alice := dialTestClient(ctx, t, srv)
+	var room events.Room
+	nextEvent(ctx, t, alice, events.TypeRoom, &room)
+	if room.Name != "Ground floor" {
+		t.Errorf("joined %q, want the room for the subnet", room.Name)
+	}
+
+	resp, err := http.Get(srv.URL + "/lan")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if !strings.Contains(string(body), "<strong>Ground floor</strong></a> (your network)") ||
+		!strings.Contains(string(body), `<a href="/lan/lan">lan</a>`) {
+		t.Errorf("landing page doesn't list the rooms:\n%s", body)
+	}
+
+	noRedirects := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+	resp, err = noRedirects.Get(srv.URL + "/generate_204")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusFound || resp.Header.Get("Location") != "/lan" {
+		t.Errorf("captive portal check got %s to %q, want a redirect to /lan", resp.Status, resp.Header.Get("Location"))
+	}
+
+	resp, err = http.Get(srv.URL + "/lan/lan")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ = io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if !strings.Contains(string(body), `hx-ws="connect:/connect?lan=lan"`) {
+		t.Error("the page for the lan room doesn't connect to it")
+	}
+	_, resp, err = websocket.Dial(ctx, srv.URL+"/connect?lan=attic", nil)
+	if err == nil || resp == nil || resp.StatusCode != http.StatusNotFound {
+		t.Errorf("connecting to a missing LAN room got %v, want a 404", err)
+	}
+}
+
+func TestIntegrationSubrooms(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	srv := newTestServer(t)
+	alice := dialTestClient(ctx, t, srv)
+	nextEvent(ctx, t, alice, events.TypeJoin, &events.Join{})
+
+	if err := alice.SendMessage(ctx, "/join #Music"); err != nil {
+		t.Fatal(err)
+	}
+	var n events.Notice
+	nextEvent(ctx, t, alice, events.TypeNotice, &n)
+	if !strings.Contains(n.Text, "sub=music") {
+		t.Errorf("/join got %q, want how to connect to #music", n.Text)
+	}
+
+	bob, err := ntclient.Dial(ctx, srv.URL, &ntclient.Options{Subroom: "music"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var room events.Room
+	nextEvent(ctx, t, bob, events.TypeRoom, &room)
+	if !strings.HasSuffix(room.Name, " #music") {
+		t.Errorf("subroom name = %q", room.Name)
+	}
+	var list events.Subrooms
+	nextEvent(ctx, t, bob, events.TypeSubrooms, &list)
+	if list.Current != "music" || list.LobbyUsers != 1 {
+		t.Errorf("bob got subroom list %+v", list)
+	}
+	list = events.Subrooms{}
+	nextEvent(ctx, t, alice, events.TypeSubrooms, &list)
+	if list.Current != "" || len(list.Rooms) != 1 || list.Rooms[0] != (events.Subroom{Name: "music", Users: 1}) {
+		t.Errorf("alice got subroom list %+v, want #music with bob", list)
+	}
+
+	// The subroom is removed from the list once it's empty
+	bob.Close()
+	nextEvent(ctx, t, alice, events.TypeSubrooms, &list)
+	if len(list.Rooms) != 0 {
+		t.Errorf("subroom list after bob left = %+v", list)
+	}
+
+	if _, err := ntclient.Dial(ctx, srv.URL, &ntclient.Options{Subroom: "lobby"}); err == nil {
+		t.Error("joined a subroom named lobby")
+	}
+}
+
+func TestIntegrationMergeSplit(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	setFlag(t, &apiTokens, "test token")
+	setFlag(t, &trustedProxies, 1)
+	srv := newTestServer(t)
+	dial := func(addr string) (*ntclient.Client, events.Room) {
+		c, err := ntclient.Dial(ctx, srv.URL, &ntclient.Options{
+			HTTPHeader: http.Header{"X-Forwarded-For": {addr}},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { c.Close() })
+		var room events.Room
+		nextEvent(ctx, t, c, events.TypeRoom, &room)
+		nextEvent(ctx, t, c, events.TypeJoin, &events.Join{})
+		return c, room
+	}
+	api := func(method, path, body string) *http.Response {
+		req, err := http.NewRequest(method, srv.URL+path, strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Authorization", "Bearer test token")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { resp.Body.Close() })
+		return resp
+	}
+
+	alice, _ := dial("203.0.113.5")
+	bob, _ := dial("2001:db8::5")
+	resp := api("POST", "/api/rooms/203.0.113.5/merge", `{"into": "2001:db8::5"}`)
+	var move roomMove
+	if err := json.NewDecoder(resp.Body).Decode(&move); err != nil || move.Moved["2001:db8::5"] != 1 {
+		t.Errorf("merging got %s %+v, %v", resp.Status, move, err)
+	}
+	var n events.Notice
+	nextEvent(ctx, t, alice, events.TypeNotice, &n)
+	if !strings.HasPrefix(n.Text, "The admin merged this room") {
+		t.Errorf("alice got notice %q", n.Text)
+	}
+	var room events.Room
+	nextEvent(ctx, t, alice, events.TypeRoom, &room)
+	if room.Name != "2001:db8::5" {
+		t.Errorf("alice was moved to %q", room.Name)
+	}
+	// alice's messages go to the new room
+	if err := alice.SendMessage(ctx, "hi bob"); err != nil {
+		t.Fatal(err)
+	}
+	var m events.Message
+	nextEvent(ctx, t, bob, events.TypeMessage, &m)
+	if m.Text != "hi bob" {
+		t.Errorf("bob got %q", m.Text)
+	}
+	if _, room := dial("203.0.113.5"); room.Name != "2001:db8::5" {
+		t.Errorf("joining the merged room went to %q", room.Name)
+	}
+
+	dave, _ := dial("10.1.2.3")
+	_, room = dial("10.9.9.9")
+	if room.Name != "lan" {
+		t.Fatalf("private addresses joined %q", room.Name)
+	}
+	resp = api("POST", "/api/rooms/lan/split", `{"subnets": ["10.1.0.0/16"]}`)
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("splitting got %s", resp.Status)
+	}
+	nextEvent(ctx, t, dave, events.TypeRoom, &room)
+	if room.Name != "10.1.0.0/16" {
+		t.Errorf("dave was moved to %q", room.Name)
+	}
+	resp = api("GET", "/api/rooms/10.1.0.0%2F16/users", "")
+	var users events.UserList
+	if err := json.NewDecoder(resp.Body).Decode(&users); err != nil || len(users.Nicks) != 1 {
+		t.Errorf("users of the subnet room = %+v, %v", users, err)
+	}
+
+	var routes []apiRoute
+	if err := json.NewDecoder(api("GET", "/api/moves", "").Body).Decode(&routes); err != nil || len(routes) != 2 {
+		t.Errorf("moves = %+v, %v", routes, err)
+	}
+	if resp := api("DELETE", "/api/moves/lan", ""); resp.StatusCode != http.StatusNoContent {
+		t.Errorf("undoing the split got %s", resp.Status)
+	}
+	if _, room := dial("10.1.2.3"); room.Name != "lan" {
+		t.Errorf("joining after undoing the split went to %q", room.Name)
+	}
+}
+
+func TestIntegrationRoomNetwork(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	setFlag(t, &roomNetwork, roomNetworkRDNS)
+	setFlag(t, &trustedProxies, 1)
+	found := make(chan struct{})
+	setFlag(t, &networkNames, newNetworkNameCache(func(ctx context.Context, ip net.IP) string {
+		// Found after alice joined
+		<-found
+		return "gw.example.edu"
+	}))
+	srv := newTestServer(t)
+	alice, err := ntclient.Dial(ctx, srv.URL, &ntclient.Options{
+		HTTPHeader: http.Header{"X-Forwarded-For": {"203.0.113.5"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer alice.Close()
+	var room events.Room
+	nextEvent(ctx, t, alice, events.TypeRoom, &room)
+	if room.Network != "" {
+		t.Errorf("network was known before it was found: %q", room.Network)
+	}
+	close(found)
+	nextEvent(ctx, t, alice, events.TypeRoom, &room)
+	if room.Name != "203.0.113.5" || room.Network != "gw.example.edu" {
+		t.Errorf("room event after the network was found = %+v", room)
+	}
+}
+
+func TestIntegrationHistory(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	setFlag(t, &historyLen, 2)
+	setFlag(t, &editWindow, time.Minute)
+	srv := newTestServer(t)
+	cs := srv.Config.Handler.(*chatServer)
+
+	alice := dialTestClient(ctx, t, srv)
+	var sent []events.Message
+	for _, text := range []string{"one", "two", "three", "four"} {
+		if err := alice.SendMessage(ctx, text); err != nil {
+			t.Fatal(err)
+		}
+		var m events.Message
+		nextEvent(ctx, t, alice, events.TypeMessage, &m)
+		sent = append(sent, m)
+	}
+	if err := alice.SendMessage(ctx, "/edit "+sent[2].ID+" 3"); err != nil {
+		t.Fatal(err)
+	}
+	nextEvent(ctx, t, alice, events.TypeEdit, &events.Message{})
+	if err := alice.SendMessage(ctx, "/delete "+sent[3].ID); err != nil {
+		t.Fatal(err)
+	}
+	nextEvent(ctx, t, alice, events.TypeDelete, &events.Delete{})
+	// History outlives the room
+	alice.Close()
+	waitForRoomsClosed(ctx, t, cs)
+
+	bob := dialTestClient(ctx, t, srv)
+	nextEvent(ctx, t, bob, events.TypeRoom, &events.Room{})
+	var got []events.Message
+	for len(got) < 2 {
+		select {
+		case e, ok := <-bob.Events():
+			if !ok {
+				t.Fatalf("connection closed: %v", bob.Err())
+			}
+			if e.Type == events.TypeJoin {
+				t.Fatalf("join came before the history, got %+v", got)
+			}
+			if e.Type != events.TypeMessage {
+				continue
+			}
+			var m events.Message
+			if err := e.Decode(&m); err != nil {
+				t.Fatal(err)
+			}
+			got = append(got, m)
+		case <-ctx.Done():
+			t.Fatalf("timed out waiting for history, got %+v", got)
+		}
+	}
+	if got[0].ID != sent[1].ID || got[0].Text != "two" || !got[0].History {
+		t.Errorf("first history message = %+v, want two", got[0])
+	}
+	if got[1].ID != sent[2].ID || got[1].Text != "3" || !got[1].Edited || !got[1].History {
+		t.Errorf("second history message = %+v, want the edited three", got[1])
+	}
+	nextEvent(ctx, t, bob, events.TypeJoin, &events.Join{})
+
+	// Older pages start where the last one ended
+	if err := bob.LoadOlder(ctx); err != nil {
+		t.Fatal(err)
+	}
+	var h events.History
+	nextEvent(ctx, t, bob, events.TypeHistory, &h)
+	if len(h.Messages) != 1 || h.Messages[0].ID != sent[0].ID || !h.Messages[0].History || h.More {
+		t.Errorf("older history = %+v, want one and no more", h)
+	}
+	if err := bob.LoadOlder(ctx); err != nil {
+		t.Fatal(err)
+	}
+	var last events.History
+	nextEvent(ctx, t, bob, events.TypeHistory, &last)
+	if len(last.Messages) != 0 || last.More {
+		t.Errorf("history after the last page = %+v, want nothing", last)
+	}
+
+	// Erasing the room deletes its history
+	cs.eraseRoom("lan")
+	if ms, err := cs.store.loadHistory("lan", "", 10); err != nil || len(ms) != 0 {
+		t.Errorf("history after erasing = %+v, %v", ms, err)
+	}
+}
+
+func TestIntegrationAPIBan(t *testing.T) {
+	setFlag(t, &apiTokens, "test token")
+	setFlag(t, &trustedProxies, 1)
+	srv := newTestServer(t)
+	api := func(method, path, body string) *http.Response {
+		req, err := http.NewRequest(method, srv.URL+path, strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Authorization", "Bearer test token")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp
+	}
+	get := func(addr string) int {
+		req, err := http.NewRequest("GET", srv.URL+"/", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("X-Forwarded-For", addr)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	if resp := api("POST", "/api/bans", `{"target": "203.0.113.9/24", "reason": "spam", "duration": "1h"}`); resp.StatusCode != http.StatusCreated {
+		t.Fatalf("banning got %s", resp.Status)
+	}
+	if resp := api("POST", "/api/bans", `{"target": "nope"}`); resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("banning an invalid target got %s", resp.Status)
+	}
+	if code := get("203.0.113.5"); code != http.StatusForbidden {
+		t.Errorf("banned address got %d", code)
+	}
+	if code := get("192.0.2.1"); code != http.StatusOK {
+		t.Errorf("other address got %d", code)
+	}
+	if resp := api("DELETE", "/api/bans/"+url.PathEscape("203.0.113.0/24"), ""); resp.StatusCode != http.StatusNoContent {
+		t.Errorf("unbanning got %s", resp.Status)
+	}
+	if code := get("203.0.113.5"); code != http.StatusOK {
+		t.Errorf("unbanned address got %d", code)
+	}
+}
+
+func TestIntegrationSearch(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	setFlag(t, &historyLen, 5)
+	srv := newTestServer(t)
+
+	alice := dialTestClient(ctx, t, srv)
+	for i := 0; i < searchPageSize+2; i++ {
+		text := fmt.Sprintf("pizza %d", i)
+		if i == 3 {
+			text = "pasta"
+		}
+		if err := alice.SendMessage(ctx, text); err != nil {
+			t.Fatal(err)
+		}
+		nextEvent(ctx, t, alice, events.TypeMessage, &events.Message{})
+	}
+
+	if err := alice.SendMessage(ctx, "/search PIZZA"); err != nil {
+		t.Fatal(err)
+	}
+	var s events.Search
+	nextEvent(ctx, t, alice, events.TypeSearch, &s)
+	if s.Term != "PIZZA" || len(s.Messages) != searchPageSize || s.Before == "" {
+		t.Fatalf("first page = %+v, want a full page and a cursor", s)
+	}
+	if m := s.Messages[0]; m.Text != fmt.Sprintf("pizza %d", searchPageSize+1) || !m.History {
+		t.Errorf("newest result = %+v", m)
+	}
+
+	if err := alice.SendMessage(ctx, "/search before:"+s.Before+" PIZZA"); err != nil {
+		t.Fatal(err)
+	}
+	var older events.Search
+	nextEvent(ctx, t, alice, events.TypeSearch, &older)
+	if len(older.Messages) != 1 || older.Messages[0].Text != "pizza 0" || older.Before != "" {
+		t.Errorf("second page = %+v, want the oldest and no cursor", older)
+	}
+}
+
+func TestIntegrationClearHistory(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	setFlag(t, &historyLen, 5)
+	srv := newTestServer(t)
+	code := srv.Config.Handler.(*chatServer).modCodes.issue("lan")
+
+	alice := dialTestClient(ctx, t, srv)
+	if err := alice.SendMessage(ctx, "/claim "+code); err != nil {
+		t.Fatal(err)
+	}
+	for _, text := range []string{"pizza 1", "pizza 2"} {
+		if err := alice.SendMessage(ctx, text); err != nil {
+			t.Fatal(err)
+		}
+		nextEvent(ctx, t, alice, events.TypeMessage, &events.Message{})
+	}
+	if err := alice.SendMessage(ctx, "/clear room"); err != nil {
+		t.Fatal(err)
+	}
+	nextEvent(ctx, t, alice, events.TypeClear, &events.Clear{})
+
+	// Nothing is replayed to someone joining after
+	bob := dialTestClient(ctx, t, srv)
+	nextEvent(ctx, t, bob, events.TypeRoom, &events.Room{})
+	for joined := false; !joined; {
+		select {
+		case e, ok := <-bob.Events():
+			if !ok {
+				t.Fatalf("connection closed: %v", bob.Err())
+			}
+			if e.Type == events.TypeMessage {
+				t.Fatal("got history after the room was cleared")
+			}
+			joined = e.Type == events.TypeJoin
+		case <-ctx.Done():
+			t.Fatal("timed out waiting for join")
+		}
+	}
+
+	// Or found by searching
+	if err := bob.SendMessage(ctx, "/search pizza"); err != nil {
+		t.Fatal(err)
+	}
+	var s events.Search
+	nextEvent(ctx, t, bob, events.TypeSearch, &s)
+	if len(s.Messages) != 0 {
+		t.Errorf("search after clearing = %+v, want nothing", s)
+	}
+}
+
+func TestIntegrationDelete(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	setFlag(t, &editWindow, time.Minute)
+	srv := newTestServer(t)
+
+	alice := dialTestClient(ctx, t, srv)
+	nextEvent(ctx, t, alice, events.TypeRoom, &events.Room{})
+	bob := dialTestClient(ctx, t, srv)
+	nextEvent(ctx, t, bob, events.TypeRoom, &events.Room{})
+
+	var sent []events.Message
+	for _, text := range []string{"keep", "oops"} {
+		if err := alice.SendMessage(ctx, text); err != nil {
+			t.Fatal(err)
+		}
+		var m events.Message
+		nextEvent(ctx, t, alice, events.TypeMessage, &m)
+		nextEvent(ctx, t, bob, events.TypeMessage, &events.Message{})
+		sent = append(sent, m)
+	}
+
+	// Only the author can delete it
+	if err := bob.SendMessage(ctx, "/delete "+sent[1].ID); err != nil {
+		t.Fatal(err)
+	}
+	nextEvent(ctx, t, bob, events.TypeError, &events.Error{})
+
+	if err := alice.SendMessage(ctx, "/delete "+sent[1].ID); err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range []*ntclient.Client{alice, bob} {
+		var d events.Delete
+		nextEvent(ctx, t, c, events.TypeDelete, &d)
+		if d.ID != sent[1].ID {
+			t.Errorf("deleted ID = %s, want %s, not %s", d.ID, sent[1].ID, sent[0].ID)
+		}
+	}
+
+	// It's gone, so it can't be deleted twice
+	if err := alice.SendMessage(ctx, "/delete "+sent[1].ID); err != nil {
+		t.Fatal(err)
+	}
+	var e events.Error
+	nextEvent(ctx, t, alice, events.TypeError, &e)
+	if !strings.Contains(e.Text, "recent message") {
+		t.Errorf("deleting again = %q, want an error about the ID", e.Text)
+	}
+}
+
+func TestIntegrationReport(t *testing.T) {
+	for _, delivered := range []bool{false, true} {
+		t.Run(fmt.Sprintf("delivered=%v", delivered), func(t *testing.T) {
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			if delivered {
+				setFlag(t, &notifyWebhook, "http://127.0.0.1:1/")
+				setFlag(t, &reportInterval, time.Hour)
+			}
+			srv := newTestServer(t)
+			cs := srv.Config.Handler.(*chatServer)
+
+			alice := dialTestClient(ctx, t, srv)
+			nextEvent(ctx, t, alice, events.TypeRoom, &events.Room{})
+			if err := alice.SendMessage(ctx, "/report spam"); err != nil {
+				t.Fatal(err)
+			}
+			var n events.Notice
+			nextEvent(ctx, t, alice, events.TypeNotice, &n)
+			if delivered != strings.Contains(n.Text, "sent to the server operator") {
+				t.Errorf("reply to the report = %q", n.Text)
+			}
+			if cs.reports.remove("lan") != delivered {
+				t.Errorf("report kept = %v, want %v", !delivered, delivered)
+			}
+		})
+	}
+}
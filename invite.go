@@ -0,0 +1,231 @@
+package main
+
+// This file handles invite links, which let someone on another network join
+// a room for an IP address for a while. Anyone in the room can send
+// "/invite 30m" to get a link that works for that long, and whoever opens it
+// joins the room as a guest, marked in the user list, until everyone leaves
+// the room. Named rooms don't need invites, anyone can join them already.
+// The admin can turn invites off from the admin page, or start the server
+// with -invites=false, and then links stop working. Guests who already
+// joined can stay.
+//
+// Invites are only kept in memory, so they stop working on restart, and with
+// Redis they only work on the instance that made them.
+
+import (
+	"bytes"
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/makeworld-the-better-one/neartalk/ids"
+)
+
+const (
+	// defaultInviteTTL is how long an invite works for if /invite isn't
+	// given a duration.
+	defaultInviteTTL = 30 * time.Minute
+	// maxInviteTTL is the longest an invite can work for.
+	maxInviteTTL = 24 * time.Hour
+)
+
+// invite is a room invite link.
+type invite struct {
+	room    string
+	expires time.Time
+}
+
+// inviteStore holds the invites that haven't expired.
+type inviteStore struct {
+	mu      sync.Mutex
+	invites map[string]invite
+	// off is true if the admin turned invites off.
+	off bool
+}
+
+func newInviteStore() *inviteStore {
+	return &inviteStore{invites: make(map[string]invite), off: !invitesFlag}
+}
+
+// issue returns a new invite token for the room, which works until the
+// time. It returns false if invites are off.
+func (is *inviteStore) issue(key string, expires time.Time) (string, bool) {
+	is.mu.Lock()
+	defer is.mu.Unlock()
+	if is.off {
+		return "", false
+	}
+	now := time.Now()
+	for token, inv := range is.invites {
+		if now.After(inv.expires) {
+			delete(is.invites, token)
+		}
+	}
+	token := ids.Token()
+	is.invites[token] = invite{room: key, expires: expires}
+	return token, true
+}
+
+// room returns the key of the room the token is an invite to, and false if
+// it isn't a working invite.
+func (is *inviteStore) room(token string) (string, bool) {
+	is.mu.Lock()
+	defer is.mu.Unlock()
+	inv, ok := is.invites[token]
+	if is.off || !ok || time.Now().After(inv.expires) {
+		return "", false
+	}
+	return inv.room, true
+}
+
+// enabled returns false if the admin turned invites off.
+func (is *inviteStore) enabled() bool {
+	is.mu.Lock()
+	defer is.mu.Unlock()
+	return !is.off
+}
+
+// setEnabled turns invites on or off. Turning them off forgets every invite,
+// so they don't come back when invites are turned on again.
+func (is *inviteStore) setEnabled(on bool) {
+	is.mu.Lock()
+	defer is.mu.Unlock()
+	is.off = !on
+	if !on {
+		is.invites = make(map[string]invite)
+	}
+}
+
+// handleInviteCmd handles "/invite [duration]", which sends the author an
+// invite link to the room.
+// It does not lock the clientsMu, callers should do that.
+func (cr *chatRoom) handleInviteCmd(m msg) {
+	switch {
+	case strings.HasPrefix(cr.key, namedRoomPrefix):
+		m.author.sendError("Anyone can join named rooms, share the room's address instead")
+		return
+	case m.author.guest:
+		m.author.sendError("Guests can't invite anyone")
+		return
+	case m.author.bot != nil:
+		m.author.sendError("Bots can't invite anyone")
+		return
+	case cr.password != nil:
+		m.author.sendError("This room is locked, share the password instead")
+		return
+	}
+
+	ttl := defaultInviteTTL
+	if arg := strings.TrimSpace(m.text[len("/invite"):]); arg != "" {
+		d, err := time.ParseDuration(arg)
+		if err != nil || d < time.Minute || d > maxInviteTTL {
+			m.author.sendError(fmt.Sprintf("Usage: /invite <duration>, like /invite 30m, up to %v", maxInviteTTL))
+			return
+		}
+		ttl = d
+	}
+	token, ok := cr.server.invites.issue(cr.key, m.when.Add(ttl))
+	if !ok {
+		m.author.sendError("Invites are turned off on this server")
+		return
+	}
+	if m.author.isJSON() {
+		m.author.sendNotice(fmt.Sprintf("Anyone who opens /invite/%s in the next %v can join this room as a guest", token, ttl))
+		return
+	}
+	m.author.sendFrame(renderTemplate("invite.html", struct {
+		Time  string
+		Token string
+		TTL   string
+	}{m.when.UTC().Format(time.RFC3339), token, ttl.String()}) + clearInputFieldMsg)
+}
+
+// acceptInvite returns the key of the room the invite token is for, and lets
+// the session join it as a guest. It returns false if the token isn't a
+// working invite, or the room has closed or been locked since. Someone from
+// the room's own network isn't a guest.
+// It holds the roomsMu.
+func (cs *chatServer) acceptInvite(token, session, ownKey string) (string, bool) {
+	key, ok := cs.invites.room(token)
+	if !ok {
+		return "", false
+	}
+	if key == ownKey {
+		return key, true
+	}
+	cs.roomsMu.Lock()
+	defer cs.roomsMu.Unlock()
+	room, ok := cs.rooms[key]
+	if !ok {
+		return "", false
+	}
+	room.clientsMu.Lock()
+	defer room.clientsMu.Unlock()
+	if room.password != nil && !room.allowedSessions[session] {
+		return "", false
+	}
+	room.guests[session] = true
+	return key, true
+}
+
+// invitePageHandler serves the chat page for an invite link at
+// /invite/<token>, which joins the room the invite is for.
+func (cs *chatServer) invitePageHandler(w http.ResponseWriter, r *http.Request) {
+	token := strings.TrimPrefix(r.URL.Path, "/invite/")
+	if _, ok := cs.invites.room(token); !ok {
+		http.Error(w, "This invite has expired, ask for a new one.", http.StatusNotFound)
+		return
+	}
+	if !cs.challengeGate(w, r) {
+		return
+	}
+
+	page, err := os.ReadFile("html/index.html")
+	if err != nil {
+		log.Printf("chatServer.invitePageHandler: err reading index.html: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	// Connect to the room the invite is for instead of the one for the IP
+	// address
+	page = bytes.Replace(page, []byte(`<body hx-ws="connect:/connect">`), []byte(fmt.Sprintf(
+		`<body hx-ws="connect:/connect?invite=%s" data-invite="%s">`, url.QueryEscape(token), template.HTMLEscapeString(token),
+	)), 1)
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Write(page)
+}
+
+// adminInvitesHandler serves the admin page button for turning invites on
+// and off, and turns them on or off when it's pressed.
+func (cs *chatServer) adminInvitesHandler(w http.ResponseWriter, r *http.Request) {
+	keyID, ok := cs.adminSession(r)
+	if !ok {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	if r.Method == http.MethodPost {
+		on := r.FormValue("on") == "true"
+		cs.invites.setEnabled(on)
+		action := auditInvitesOff
+		if on {
+			action = auditInvitesOn
+		}
+		cs.audit.record(keyID, action, "", "")
+	}
+	fmt.Fprint(w, adminInvitesButton(cs.invites.enabled()))
+}
+
+// adminInvitesButton returns the admin page button for turning invites on or
+// off.
+func adminInvitesButton(on bool) string {
+	if on {
+		return `<p>Invites are on. <button hx-post="/admin-invites" hx-vals='{"on": "false"}' hx-target="closest p" hx-swap="outerHTML">Turn off</button></p>`
+	}
+	return `<p>Invites are off. <button hx-post="/admin-invites" hx-vals='{"on": "true"}' hx-target="closest p" hx-swap="outerHTML">Turn on</button></p>`
+}
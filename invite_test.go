@@ -0,0 +1,39 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestInviteStore(t *testing.T) {
+	defer func(f bool) { invitesFlag = f }(invitesFlag)
+	invitesFlag = true
+	is := newInviteStore()
+
+	token, ok := is.issue("203.0.113.5", time.Now().Add(time.Hour))
+	if !ok {
+		t.Fatal("issue() = false with invites on")
+	}
+	if key, ok := is.room(token); !ok || key != "203.0.113.5" {
+		t.Errorf("room() = %q, %v, want the room", key, ok)
+	}
+	if _, ok := is.room("nonsense"); ok {
+		t.Error("room() = true for a made up token")
+	}
+	expired, _ := is.issue("203.0.113.5", time.Now().Add(-time.Second))
+	if _, ok := is.room(expired); ok {
+		t.Error("room() = true for an expired invite")
+	}
+
+	is.setEnabled(false)
+	if _, ok := is.room(token); ok {
+		t.Error("room() = true with invites off")
+	}
+	if _, ok := is.issue("203.0.113.5", time.Now().Add(time.Hour)); ok {
+		t.Error("issue() = true with invites off")
+	}
+	is.setEnabled(true)
+	if _, ok := is.room(token); ok {
+		t.Error("room() = true for an invite made before invites were turned off")
+	}
+}
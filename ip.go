@@ -0,0 +1,189 @@
+package main
+
+// This file works out the IP address of a client, which decides what chat
+// room they're in. When NearTalk is reverse-proxied, the client IP comes from
+// the X-Forwarded-For or Forwarded (RFC 7239) headers. Those headers can be
+// spoofed by clients, so only the hops added by trusted proxies are used.
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// getIPString returns the room key for the request's client, which is their
+// IP address, or "lan" for local addresses.
+func getIPString(r *http.Request) string {
+	return clientIP(r, int(trustedProxies))
+}
+
+// clientIP returns the room key for the request's client, trusting the given
+// number of reverse proxies in front of the server.
+func clientIP(r *http.Request, trusted int) string {
+	ip := clientAddr(r, trusted)
+	if ip == nil {
+		if r.RemoteAddr == "" || r.RemoteAddr == "@" {
+			// Connected over a unix socket, so from the same machine
+			return lanRoomKey
+		}
+		if !privateRooms {
+			log.Printf("clientIP: invalid remote address %s", r.RemoteAddr)
+		}
+		return r.RemoteAddr
+	}
+	return addrRoomKey(ip)
+}
+
+// addrRoomKey returns the room key for the IP address, which is the address,
+// or "lan" for local addresses.
+func addrRoomKey(ip net.IP) string {
+	if ip.IsPrivate() || ip.IsLoopback() {
+		// IP is from a local address, from the same machine as the server, or from the LAN
+		// This would happen during testing, like if the server is being run on a dev machine
+		// Return a fake IP address key, as there would be multiple IP addresses within the LAN
+		return lanRoomKey
+	}
+	return ip.String()
+}
+
+// clientAddr returns the IP address of the request's client, trusting the
+// given number of reverse proxies in front of the server. It returns nil if
+// there's no valid address.
+func clientAddr(r *http.Request, trusted int) net.IP {
+	// Build the chain of addresses, ending with the one that connected to us
+	var chain []string
+	if trusted > 0 {
+		if fwd := r.Header.Values("Forwarded"); len(fwd) > 0 {
+			chain = parseForwarded(fwd)
+		} else {
+			chain = parseXForwardedFor(r.Header.Values("X-Forwarded-For"))
+		}
+	}
+	remote := stripPort(r.RemoteAddr)
+	chain = append(chain, remote)
+
+	// Each trusted proxy added one hop, so skip over those from the end.
+	// If there are fewer hops than expected, the proxies didn't add headers,
+	// and so the first hop is the best guess.
+	i := len(chain) - 1 - trusted
+	if i < 0 {
+		i = 0
+	}
+
+	ip := net.ParseIP(chain[i])
+	if ip == nil {
+		// Obfuscated or unknown address, so use the proxy address instead
+		// to avoid creating rooms out of garbage
+		ip = net.ParseIP(remote)
+		if ip == nil {
+			return nil
+		}
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		// Handle IPv4-mapped IPv6 addresses
+		ip = ip4
+	}
+	return ip
+}
+
+// parseXForwardedFor returns the addresses from X-Forwarded-For header
+// values, in order. Ports and IPv6 brackets are removed.
+func parseXForwardedFor(values []string) []string {
+	var addrs []string
+	for _, v := range values {
+		for _, addr := range strings.Split(v, ",") {
+			addr = strings.TrimSpace(addr)
+			if addr == "" {
+				continue
+			}
+			addrs = append(addrs, stripPort(addr))
+		}
+	}
+	return addrs
+}
+
+// parseForwarded returns the "for" addresses from Forwarded header values,
+// in order. Ports and IPv6 brackets are removed. Hops without a "for"
+// parameter are returned as empty strings, so the number of hops stays right.
+func parseForwarded(values []string) []string {
+	var addrs []string
+	for _, v := range values {
+		for _, elem := range splitQuoted(v, ',') {
+			var addr string
+			for _, pair := range splitQuoted(elem, ';') {
+				eq := strings.IndexByte(pair, '=')
+				if eq == -1 {
+					continue
+				}
+				if !strings.EqualFold(strings.TrimSpace(pair[:eq]), "for") {
+					continue
+				}
+				addr = strings.TrimSpace(pair[eq+1:])
+				if len(addr) >= 2 && addr[0] == '"' && addr[len(addr)-1] == '"' {
+					addr = strings.ReplaceAll(addr[1:len(addr)-1], `\`, "")
+				}
+				addr = stripPort(addr)
+			}
+			addrs = append(addrs, addr)
+		}
+	}
+	return addrs
+}
+
+// splitQuoted splits s on sep, ignoring any seps inside double quotes.
+// Empty parts are dropped.
+func splitQuoted(s string, sep byte) []string {
+	var parts []string
+	inQuotes := false
+	start := 0
+	for i := 0; i < len(s); i++ {
+		switch {
+		case s[i] == '\\' && inQuotes:
+			i++ // Skip escaped character
+		case s[i] == '"':
+			inQuotes = !inQuotes
+		case s[i] == sep && !inQuotes:
+			if part := strings.TrimSpace(s[start:i]); part != "" {
+				parts = append(parts, part)
+			}
+			start = i + 1
+		}
+	}
+	if part := strings.TrimSpace(s[start:]); part != "" {
+		parts = append(parts, part)
+	}
+	return parts
+}
+
+// parseSubnet parses a subnet in CIDR notation, or a single address as a
+// subnet of just that address.
+func parseSubnet(s string) (*net.IPNet, error) {
+	if !strings.Contains(s, "/") {
+		ip := net.ParseIP(s)
+		if ip == nil {
+			return nil, fmt.Errorf("invalid address %q", s)
+		}
+		bits := 8 * net.IPv6len
+		if ip4 := ip.To4(); ip4 != nil {
+			ip, bits = ip4, 8*net.IPv4len
+		}
+		return &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}, nil
+	}
+	_, n, err := net.ParseCIDR(s)
+	if err != nil {
+		return nil, fmt.Errorf("invalid subnet %q", s)
+	}
+	return n, nil
+}
+
+// stripPort removes the port and IPv6 brackets from an address, if there
+// are any. Addresses that aren't IPs are returned as is.
+func stripPort(addr string) string {
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		return host
+	}
+	// No port
+	return strings.TrimSuffix(strings.TrimPrefix(addr, "["), "]")
+}
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"net/http"
+	"reflect"
+	"testing"
+)
+
+func TestParseXForwardedFor(t *testing.T) {
+	tests := []struct {
+		name   string
+		values []string
+		want   []string
+	}{
+		{"empty", nil, nil},
+		{"single", []string{"203.0.113.1"}, []string{"203.0.113.1"}},
+		{"comma space", []string{"203.0.113.1, 198.51.100.2"}, []string{"203.0.113.1", "198.51.100.2"}},
+		{"no spaces", []string{"203.0.113.1,198.51.100.2"}, []string{"203.0.113.1", "198.51.100.2"}},
+		{"extra spaces", []string{"  203.0.113.1 ,   198.51.100.2  "}, []string{"203.0.113.1", "198.51.100.2"}},
+		{"empty entries", []string{"203.0.113.1,, ,198.51.100.2,"}, []string{"203.0.113.1", "198.51.100.2"}},
+		{"ipv4 port", []string{"203.0.113.1:8080"}, []string{"203.0.113.1"}},
+		{"ipv6", []string{"2001:db8::1"}, []string{"2001:db8::1"}},
+		{"bracketed ipv6", []string{"[2001:db8::1]"}, []string{"2001:db8::1"}},
+		{"bracketed ipv6 port", []string{"[2001:db8::1]:443"}, []string{"2001:db8::1"}},
+		{"multiple headers", []string{"203.0.113.1", "198.51.100.2, 192.0.2.3"}, []string{"203.0.113.1", "198.51.100.2", "192.0.2.3"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := parseXForwardedFor(tt.values)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseXForwardedFor(%q) = %q, want %q", tt.values, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseForwarded(t *testing.T) {
+	tests := []struct {
+		name   string
+		values []string
+		want   []string
+	}{
+		{"empty", nil, nil},
+		{"single", []string{"for=203.0.113.1"}, []string{"203.0.113.1"}},
+		{"case insensitive", []string{"For=203.0.113.1"}, []string{"203.0.113.1"}},
+		{"quoted", []string{`for="203.0.113.1"`}, []string{"203.0.113.1"}},
+		{"quoted port", []string{`for="203.0.113.1:4711"`}, []string{"203.0.113.1"}},
+		{"ipv6", []string{`for="[2001:db8:cafe::17]"`}, []string{"2001:db8:cafe::17"}},
+		{"ipv6 port", []string{`for="[2001:db8:cafe::17]:4711"`}, []string{"2001:db8:cafe::17"}},
+		{"other params", []string{"for=192.0.2.60;proto=http;by=203.0.113.43"}, []string{"192.0.2.60"}},
+		{"params before for", []string{"proto=https; for=192.0.2.60"}, []string{"192.0.2.60"}},
+		{"multiple hops", []string{"for=192.0.2.43, for=198.51.100.17"}, []string{"192.0.2.43", "198.51.100.17"}},
+		{"multiple headers", []string{"for=192.0.2.43", "for=198.51.100.17"}, []string{"192.0.2.43", "198.51.100.17"}},
+		{"hop without for", []string{"for=192.0.2.43, proto=https"}, []string{"192.0.2.43", ""}},
+		{"obfuscated", []string{"for=_hidden, for=unknown"}, []string{"_hidden", "unknown"}},
+		{"quoted separators", []string{`for="192.0.2.43";ext="a,b;c", for=198.51.100.17`}, []string{"192.0.2.43", "198.51.100.17"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := parseForwarded(tt.values)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseForwarded(%q) = %q, want %q", tt.values, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestClientIP(t *testing.T) {
+	tests := []struct {
+		name       string
+		remoteAddr string
+		headers    map[string][]string
+		trusted    int
+		want       string
+	}{
+		{
+			name:       "direct",
+			remoteAddr: "203.0.113.1:5000",
+			trusted:    0,
+			want:       "203.0.113.1",
+		},
+		{
+			name:       "direct ignores headers",
+			remoteAddr: "203.0.113.1:5000",
+			headers:    map[string][]string{"X-Forwarded-For": {"198.51.100.2"}},
+			trusted:    0,
+			want:       "203.0.113.1",
+		},
+		{
+			name:       "direct loopback",
+			remoteAddr: "127.0.0.1:5000",
+			trusted:    0,
+			want:       "lan",
+		},
+		{
+			name:       "direct private",
+			remoteAddr: "192.168.1.5:5000",
+			trusted:    0,
+			want:       "lan",
+		},
+		{
+			name:       "direct ipv6",
+			remoteAddr: "[2001:db8::1]:5000",
+			trusted:    0,
+			want:       "2001:db8::1",
+		},
+		{
+			name:       "direct unix socket",
+			remoteAddr: "@",
+			trusted:    0,
+			want:       "lan",
+		},
+		{
+			name:       "unix socket proxy",
+			remoteAddr: "@",
+			headers:    map[string][]string{"X-Forwarded-For": {"203.0.113.1"}},
+			trusted:    1,
+			want:       "203.0.113.1",
+		},
+		{
+			name:       "one proxy",
+			remoteAddr: "127.0.0.1:5000",
+			headers:    map[string][]string{"X-Forwarded-For": {"203.0.113.1"}},
+			trusted:    1,
+			want:       "203.0.113.1",
+		},
+		{
+			name:       "one proxy spoofed",
+			remoteAddr: "127.0.0.1:5000",
+			headers:    map[string][]string{"X-Forwarded-For": {"198.51.100.99, 203.0.113.1"}},
+			trusted:    1,
+			want:       "203.0.113.1",
+		},
+		{
+			name:       "two proxies",
+			remoteAddr: "127.0.0.1:5000",
+			headers:    map[string][]string{"X-Forwarded-For": {"198.51.100.99, 203.0.113.1, 10.0.0.2"}},
+			trusted:    2,
+			want:       "203.0.113.1",
+		},
+		{
+			name:       "one proxy no header",
+			remoteAddr: "203.0.113.1:5000",
+			trusted:    1,
+			want:       "203.0.113.1",
+		},
+		{
+			name:       "fewer hops than proxies",
+			remoteAddr: "127.0.0.1:5000",
+			headers:    map[string][]string{"X-Forwarded-For": {"203.0.113.1"}},
+			trusted:    3,
+			want:       "203.0.113.1",
+		},
+		{
+			name:       "xff with port",
+			remoteAddr: "127.0.0.1:5000",
+			headers:    map[string][]string{"X-Forwarded-For": {"203.0.113.1:1234"}},
+			trusted:    1,
+			want:       "203.0.113.1",
+		},
+		{
+			name:       "xff bracketed ipv6",
+			remoteAddr: "127.0.0.1:5000",
+			headers:    map[string][]string{"X-Forwarded-For": {"[2001:db8::1]:1234"}},
+			trusted:    1,
+			want:       "2001:db8::1",
+		},
+		{
+			name:       "xff ipv4 mapped ipv6",
+			remoteAddr: "127.0.0.1:5000",
+			headers:    map[string][]string{"X-Forwarded-For": {"::ffff:203.0.113.1"}},
+			trusted:    1,
+			want:       "203.0.113.1",
+		},
+		{
+			name:       "xff private",
+			remoteAddr: "127.0.0.1:5000",
+			headers:    map[string][]string{"X-Forwarded-For": {"10.1.2.3"}},
+			trusted:    1,
+			want:       "lan",
+		},
+		{
+			name:       "xff garbage",
+			remoteAddr: "203.0.113.7:5000",
+			headers:    map[string][]string{"X-Forwarded-For": {"not-an-ip"}},
+			trusted:    1,
+			want:       "203.0.113.7",
+		},
+		{
+			name:       "forwarded preferred",
+			remoteAddr: "127.0.0.1:5000",
+			headers: map[string][]string{
+				"Forwarded":       {`for="[2001:db8:cafe::17]:4711";proto=https`},
+				"X-Forwarded-For": {"198.51.100.2"},
+			},
+			trusted: 1,
+			want:    "2001:db8:cafe::17",
+		},
+		{
+			name:       "forwarded two proxies",
+			remoteAddr: "127.0.0.1:5000",
+			headers:    map[string][]string{"Forwarded": {"for=198.51.100.99, for=203.0.113.1, for=10.0.0.2"}},
+			trusted:    2,
+			want:       "203.0.113.1",
+		},
+		{
+			name:       "forwarded obfuscated",
+			remoteAddr: "203.0.113.7:5000",
+			headers:    map[string][]string{"Forwarded": {"for=_hidden"}},
+			trusted:    1,
+			want:       "203.0.113.7",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r, err := http.NewRequest(http.MethodGet, "/connect", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			r.RemoteAddr = tt.remoteAddr
+			for k, vs := range tt.headers {
+				for _, v := range vs {
+					r.Header.Add(k, v)
+				}
+			}
+			if got := clientIP(r, tt.trusted); got != tt.want {
+				t.Errorf("clientIP() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,452 @@
+package main
+
+// This file bridges rooms to IRC channels, so a community that already has a
+// channel can overlap with the room for its place. Each bridge listed under
+// "irc_bridges" in the config file connects to an IRC server, joins the
+// channel, and relays chat messages both ways. Messages from the room are
+// sent to the channel as "<nick> text", and messages from the channel show
+// up in the room from "irc/nick":
+//
+//	"irc_bridges": [{"room": "203.0.113.5", "server": "irc.libera.chat:6697",
+//	    "tls": true, "nick": "neartalk", "channel": "#example"}]
+//
+// Only chat messages are relayed, not joins, commands, or encrypted messages.
+// Messages from the channel are dropped while nobody is in the room, since
+// nobody would see them, and messages from the room are dropped while the
+// bridge isn't in the channel.
+//
+// Bridges are started and stopped when the config file is reloaded, and
+// reconnect with a growing delay when the connection drops. With Redis, only
+// messages sent through the instance running the bridge reach the channel,
+// so it's best to bridge a room on one instance and point its people there.
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unicode/utf8"
+
+	"golang.org/x/time/rate"
+)
+
+const (
+	// ircNickPrefix is added to the nicknames of people on IRC in the room.
+	ircNickPrefix = bridgeIRC + "/"
+	// defaultIRCNick is the bridge's nickname if the config doesn't set one.
+	defaultIRCNick = "neartalk"
+	// ircMaxText is how many bytes of text are sent in each IRC message.
+	// Lines can only be 512 bytes, including the command and channel.
+	ircMaxText = 400
+	// ircDialTimeout is how long connecting to the IRC server can take.
+	ircDialTimeout = 30 * time.Second
+	// ircReadTimeout is how long the server can be silent before the
+	// connection is dropped. Servers send PINGs more often than this.
+	ircReadTimeout = 5 * time.Minute
+	// ircMaxBackoff is the longest wait between reconnecting.
+	ircMaxBackoff = 5 * time.Minute
+	// ircQueue is how many messages can wait to be sent to the channel.
+	ircQueue = 100
+	// ircRate and ircBurst limit how fast messages are sent to the channel,
+	// so the server doesn't disconnect the bridge for flooding.
+	ircRate  = 2
+	ircBurst = 5
+)
+
+// configIRCBridge is a bridge in the config file.
+type configIRCBridge struct {
+	// Room is the key of the room, like an IP address or "#name" for a named
+	// room.
+	Room string `json:"room"`
+	// Server is the IRC server's host and port.
+	Server string `json:"server"`
+	TLS    bool   `json:"tls"`
+	// Nick is the bridge's nickname on IRC. defaultIRCNick is used if it's
+	// empty.
+	Nick    string `json:"nick"`
+	Channel string `json:"channel"`
+	// Password is the server password, sent with PASS, if there is one.
+	Password string `json:"password"`
+}
+
+// validateIRCBridges returns an error if a bridge in the config file is
+// invalid, and fills in the default nickname.
+func validateIRCBridges(cbs []configIRCBridge) error {
+	rooms := make(map[string]bool)
+	for i := range cbs {
+		cb := &cbs[i]
+		if cb.Nick == "" {
+			cb.Nick = defaultIRCNick
+		}
+		if cb.Room == "" {
+			return fmt.Errorf("irc bridge %d: room is missing", i+1)
+		}
+		if rooms[cb.Room] {
+			return fmt.Errorf("irc bridge %d: room %s is already bridged", i+1, cb.Room)
+		}
+		rooms[cb.Room] = true
+		if _, _, err := net.SplitHostPort(cb.Server); err != nil {
+			return fmt.Errorf("irc bridge %d: server must be a host and port, like irc.libera.chat:6697", i+1)
+		}
+		if !strings.HasPrefix(cb.Channel, "#") && !strings.HasPrefix(cb.Channel, "&") ||
+			strings.ContainsAny(cb.Channel, " ,\x07\r\n") {
+			return fmt.Errorf("irc bridge %d: invalid channel %q", i+1, cb.Channel)
+		}
+		if strings.ContainsAny(cb.Nick, " !@:\r\n") {
+			return fmt.Errorf("irc bridge %d: invalid nick %q", i+1, cb.Nick)
+		}
+		if strings.ContainsAny(cb.Password, "\r\n") {
+			return fmt.Errorf("irc bridge %d: invalid password", i+1)
+		}
+	}
+	return nil
+}
+
+// ircBridges holds the running bridges.
+type ircBridges struct {
+	cs      *chatServer
+	mu      sync.Mutex
+	bridges map[configIRCBridge]*ircBridge
+}
+
+func newIRCBridges(cs *chatServer) *ircBridges {
+	return &ircBridges{cs: cs, bridges: make(map[configIRCBridge]*ircBridge)}
+}
+
+// setConfigured starts the bridges from the config file that aren't running
+// yet, and stops the ones that aren't in it anymore.
+// It holds the mutex.
+func (ib *ircBridges) setConfigured(cbs []configIRCBridge) {
+	ib.mu.Lock()
+	defer ib.mu.Unlock()
+	keep := make(map[configIRCBridge]bool)
+	for _, cb := range cbs {
+		keep[cb] = true
+		if _, ok := ib.bridges[cb]; !ok {
+			b := newIRCBridge(ib.cs, cb)
+			ib.bridges[cb] = b
+			go b.run()
+		}
+	}
+	for cb, b := range ib.bridges {
+		if !keep[cb] {
+			b.stop()
+			delete(ib.bridges, cb)
+		}
+	}
+}
+
+// relay passes the chat message in the room with the key on to IRC, if the
+// room is bridged.
+// It holds the mutex.
+func (ib *ircBridges) relay(key string, a *chatAlert) {
+	ib.mu.Lock()
+	defer ib.mu.Unlock()
+	for cb, b := range ib.bridges {
+		if cb.Room == key {
+			b.send(plainNick(a.Nick), a.Text)
+		}
+	}
+}
+
+// ircBridge is the connection to IRC for one bridged room.
+type ircBridge struct {
+	cs  *chatServer
+	cfg configIRCBridge
+	// out holds the lines of text waiting to be sent to the channel.
+	out chan string
+	// joined is true while the bridge is in the channel.
+	joined atomic.Bool
+
+	done     chan struct{}
+	stopOnce sync.Once
+	// connMu protects conn, the current connection, so stop can close it.
+	connMu sync.Mutex
+	conn   net.Conn
+}
+
+func newIRCBridge(cs *chatServer, cfg configIRCBridge) *ircBridge {
+	return &ircBridge{cs: cs, cfg: cfg, out: make(chan string, ircQueue), done: make(chan struct{})}
+}
+
+// stop disconnects the bridge for good.
+func (b *ircBridge) stop() {
+	b.stopOnce.Do(func() {
+		close(b.done)
+		b.connMu.Lock()
+		if b.conn != nil {
+			b.conn.Close()
+		}
+		b.connMu.Unlock()
+	})
+}
+
+// run connects to IRC and reconnects whenever the connection drops, until
+// the bridge is stopped.
+func (b *ircBridge) run() {
+	backoff := time.Second
+	for {
+		start := time.Now()
+		err := b.session()
+		select {
+		case <-b.done:
+			return
+		default:
+		}
+		if time.Since(start) > ircMaxBackoff {
+			// It was working for a while
+			backoff = time.Second
+		}
+		log.Printf("ircBridge: %s on %s: %v, reconnecting in %v", b.cfg.Channel, b.cfg.Server, err, backoff)
+		select {
+		case <-b.done:
+			return
+		case <-time.After(backoff):
+		}
+		if backoff *= 2; backoff > ircMaxBackoff {
+			backoff = ircMaxBackoff
+		}
+	}
+}
+
+// session connects to IRC, joins the channel, and relays messages until the
+// connection drops.
+func (b *ircBridge) session() error {
+	d := &net.Dialer{Timeout: ircDialTimeout}
+	var conn net.Conn
+	var err error
+	if b.cfg.TLS {
+		host, _, _ := net.SplitHostPort(b.cfg.Server)
+		conn, err = tls.DialWithDialer(d, "tcp", b.cfg.Server, &tls.Config{ServerName: host})
+	} else {
+		conn, err = d.Dial("tcp", b.cfg.Server)
+	}
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	b.connMu.Lock()
+	b.conn = conn
+	b.connMu.Unlock()
+	select {
+	case <-b.done:
+		// Stopped while connecting
+		return nil
+	default:
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	defer b.joined.Store(false)
+	w := &ircWriter{conn: conn}
+	go b.writeChannel(ctx, w)
+
+	nick := b.cfg.Nick
+	if b.cfg.Password != "" {
+		w.printf("PASS %s", b.cfg.Password)
+	}
+	w.printf("NICK %s", nick)
+	w.printf("USER %s 0 * :NearTalk bridge", b.cfg.Nick)
+
+	r := bufio.NewReader(conn)
+	for {
+		conn.SetReadDeadline(time.Now().Add(ircReadTimeout))
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return err
+		}
+		prefix, cmd, params := parseIRCLine(line)
+		switch cmd {
+		case "PING":
+			if len(params) > 0 {
+				w.printf("PONG :%s", params[len(params)-1])
+			}
+		case "001":
+			// Registered
+			w.printf("JOIN %s", b.cfg.Channel)
+		case "433":
+			// Nickname in use
+			nick += "_"
+			w.printf("NICK %s", nick)
+		case "JOIN":
+			if ircNick(prefix) == nick && len(params) > 0 && strings.EqualFold(params[0], b.cfg.Channel) {
+				b.joined.Store(true)
+			}
+		case "KICK":
+			if len(params) > 1 && strings.EqualFold(params[0], b.cfg.Channel) && params[1] == nick {
+				return errors.New("kicked from the channel")
+			}
+		case "PRIVMSG":
+			if len(params) == 2 && strings.EqualFold(params[0], b.cfg.Channel) {
+				b.deliver(ircNick(prefix), params[1])
+			}
+		case "ERROR":
+			if len(params) > 0 {
+				return fmt.Errorf("server error: %s", params[0])
+			}
+			return errors.New("server error")
+		}
+	}
+}
+
+// writeChannel sends the waiting lines of text to the channel, until the ctx
+// is done.
+func (b *ircBridge) writeChannel(ctx context.Context, w *ircWriter) {
+	limiter := rate.NewLimiter(ircRate, ircBurst)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case text := <-b.out:
+			if limiter.Wait(ctx) != nil {
+				return
+			}
+			w.printf("PRIVMSG %s :%s", b.cfg.Channel, text)
+		}
+	}
+}
+
+// send queues the chat message from the room to be sent to the channel. It's
+// dropped if the bridge isn't in the channel or is too far behind.
+func (b *ircBridge) send(nick, text string) {
+	if !b.joined.Load() {
+		return
+	}
+	for _, line := range ircLines("<"+nick+"> ", text) {
+		select {
+		case b.out <- line:
+		default:
+			log.Printf("ircBridge: %s on %s is too far behind, dropping a message", b.cfg.Channel, b.cfg.Server)
+			return
+		}
+	}
+}
+
+// deliver sends the message from someone on IRC to the room, if it's open.
+func (b *ircBridge) deliver(nick, text string) {
+	if action, ok := strings.CutPrefix(text, "\x01ACTION "); ok {
+		text = "_" + strings.TrimSuffix(action, "\x01") + "_"
+	} else if strings.HasPrefix(text, "\x01") {
+		// Other CTCP requests, like VERSION
+		return
+	}
+	text = strings.TrimSpace(stripIRCFormatting(text))
+	if nick == "" || text == "" {
+		return
+	}
+
+	b.cs.deliverBridged(b.cfg.Room, msg{nick: sanitizeNick(ircNickPrefix + nick), text: text, when: time.Now(), bridge: bridgeIRC})
+}
+
+// ircWriter writes lines to an IRC connection, one at a time.
+type ircWriter struct {
+	mu   sync.Mutex
+	conn net.Conn
+}
+
+// printf writes a line. Errors are ignored, since the connection is read
+// from too, and reading fails when it's broken.
+func (w *ircWriter) printf(format string, a ...interface{}) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.conn.SetWriteDeadline(time.Now().Add(ircDialTimeout))
+	fmt.Fprintf(w.conn, format+"\r\n", a...)
+}
+
+// parseIRCLine splits an IRC line into its prefix, command, and parameters.
+// The prefix is empty if the line doesn't have one.
+func parseIRCLine(line string) (prefix, cmd string, params []string) {
+	line = strings.TrimRight(line, "\r\n")
+	if strings.HasPrefix(line, "@") {
+		// IRCv3 message tags
+		_, line, _ = strings.Cut(line, " ")
+	}
+	if strings.HasPrefix(line, ":") {
+		prefix, line, _ = strings.Cut(line[1:], " ")
+	}
+	line, trailing, hasTrailing := strings.Cut(line, " :")
+	if strings.HasPrefix(line, ":") {
+		// No middle parameters, like "PING :server"
+		line, trailing, hasTrailing = "", line[1:], true
+	}
+	fields := strings.Fields(line)
+	if len(fields) == 0 {
+		if hasTrailing {
+			return prefix, "", []string{trailing}
+		}
+		return prefix, "", nil
+	}
+	cmd, params = strings.ToUpper(fields[0]), fields[1:]
+	if hasTrailing {
+		params = append(params, trailing)
+	}
+	return prefix, cmd, params
+}
+
+// ircNick returns the nickname in a "nick!user@host" prefix.
+func ircNick(prefix string) string {
+	nick, _, _ := strings.Cut(prefix, "!")
+	return nick
+}
+
+// stripIRCFormatting removes IRC bold, color, and other formatting codes.
+func stripIRCFormatting(text string) string {
+	var b strings.Builder
+	for i := 0; i < len(text); i++ {
+		switch text[i] {
+		case '\x02', '\x0f', '\x11', '\x16', '\x1d', '\x1e', '\x1f':
+		case '\x03':
+			// Color, followed by up to two digits, and optionally a comma and
+			// up to two more for the background
+			fg := ircColorDigits(text[i+1:])
+			i += fg
+			if fg > 0 && i+2 < len(text) && text[i+1] == ',' && ircColorDigits(text[i+2:]) > 0 {
+				i += 1 + ircColorDigits(text[i+2:])
+			}
+		default:
+			b.WriteByte(text[i])
+		}
+	}
+	return b.String()
+}
+
+// ircColorDigits returns how many digits of a color code start s, up to two.
+func ircColorDigits(s string) int {
+	n := 0
+	for n < len(s) && n < 2 && s[n] >= '0' && s[n] <= '9' {
+		n++
+	}
+	return n
+}
+
+// ircLines splits the text into IRC messages starting with the prefix, one
+// for each line of text, with long lines split into several.
+func ircLines(prefix, text string) []string {
+	limit := ircMaxText - len(prefix)
+	if limit < ircMaxText/2 {
+		limit = ircMaxText / 2
+	}
+	var lines []string
+	for _, line := range strings.Split(normalizeNewlines(text), "\n") {
+		line = strings.TrimSpace(line)
+		for line != "" {
+			n := len(line)
+			if n > limit {
+				n = limit
+				for n > 0 && !utf8.RuneStart(line[n]) {
+					n--
+				}
+			}
+			lines = append(lines, prefix+line[:n])
+			line = line[n:]
+		}
+	}
+	return lines
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseIRCLine(t *testing.T) {
+	tests := []struct {
+		line   string
+		prefix string
+		cmd    string
+		params []string
+	}{
+		{"PING :irc.example.com\r\n", "", "PING", []string{"irc.example.com"}},
+		{":bob!b@host PRIVMSG #test :hello there\r\n", "bob!b@host", "PRIVMSG", []string{"#test", "hello there"}},
+		{":srv 001 neartalk :Welcome\r\n", "srv", "001", []string{"neartalk", "Welcome"}},
+		{":neartalk!n@host JOIN #test\r\n", "neartalk!n@host", "JOIN", []string{"#test"}},
+		{"@time=2026-10-16T12:00:00Z :bob!b@host PRIVMSG #test ::)\r\n", "bob!b@host", "PRIVMSG", []string{"#test", ":)"}},
+		{"ERROR :Closing link\r\n", "", "ERROR", []string{"Closing link"}},
+	}
+	for _, tt := range tests {
+		prefix, cmd, params := parseIRCLine(tt.line)
+		if prefix != tt.prefix || cmd != tt.cmd || !reflect.DeepEqual(params, tt.params) {
+			t.Errorf("parseIRCLine(%q) = %q, %q, %q, want %q, %q, %q",
+				tt.line, prefix, cmd, params, tt.prefix, tt.cmd, tt.params)
+		}
+	}
+}
+
+func TestStripIRCFormatting(t *testing.T) {
+	tests := []struct{ in, want string }{
+		{"plain", "plain"},
+		{"\x02bold\x02 and \x1ditalic\x1d", "bold and italic"},
+		{"\x0304red\x03 and \x0312,01blue on black\x0f", "red and blue on black"},
+		{"\x033,5green", "green"},
+		{"\x033, x", ", x"},
+		{"\x03,5 comma", ",5 comma"},
+		{"10\x03", "10"},
+	}
+	for _, tt := range tests {
+		if got := stripIRCFormatting(tt.in); got != tt.want {
+			t.Errorf("stripIRCFormatting(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestIRCLines(t *testing.T) {
+	got := ircLines("<alice> ", "hello\r\n\nworld ")
+	if want := []string{"<alice> hello", "<alice> world"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("ircLines() = %q, want %q", got, want)
+	}
+	long := strings.Repeat("é", ircMaxText)
+	got = ircLines("<alice> ", long)
+	var rejoined string
+	for _, line := range got {
+		if len(line) > ircMaxText {
+			t.Errorf("line is %d bytes, over %d", len(line), ircMaxText)
+		}
+		rejoined += strings.TrimPrefix(line, "<alice> ")
+	}
+	if rejoined != long {
+		t.Error("splitting a long line lost or broke characters")
+	}
+}
+
+func TestValidateIRCBridges(t *testing.T) {
+	valid := configIRCBridge{Room: "lan", Server: "irc.example.com:6697", Channel: "#test"}
+	cbs := []configIRCBridge{valid}
+	if err := validateIRCBridges(cbs); err != nil {
+		t.Fatal(err)
+	}
+	if cbs[0].Nick != defaultIRCNick {
+		t.Errorf("nick = %q, want the default", cbs[0].Nick)
+	}
+	bad := []func(*configIRCBridge){
+		func(cb *configIRCBridge) { cb.Room = "" },
+		func(cb *configIRCBridge) { cb.Server = "irc.example.com" },
+		func(cb *configIRCBridge) { cb.Channel = "test" },
+		func(cb *configIRCBridge) { cb.Channel = "#a b" },
+		func(cb *configIRCBridge) { cb.Nick = "nick\r\nQUIT" },
+		func(cb *configIRCBridge) { cb.Password = "pw\nQUIT" },
+	}
+	for i, change := range bad {
+		cb := valid
+		change(&cb)
+		if err := validateIRCBridges([]configIRCBridge{cb}); err == nil {
+			t.Errorf("bad bridge %d was accepted", i)
+		}
+	}
+	if err := validateIRCBridges([]configIRCBridge{valid, valid}); err == nil {
+		t.Error("bridging a room twice was accepted")
+	}
+}
@@ -0,0 +1,275 @@
+package main
+
+// This file has LAN mode, for servers started with -lan-mode that only serve
+// one network, like a venue, an office, or a hotspot with no internet. Rooms
+// aren't split by IP address: everyone is in the room called "lan", unless
+// the config file gives their network's subnets a room of its own, like one
+// for each Wi-Fi SSID or VLAN:
+//
+//	"lan_rooms": [{"name": "Ground floor", "subnets": ["192.168.10.0/24"]},
+//	    {"name": "Guest Wi-Fi", "subnets": ["10.20.0.0/16", "fd00:20::/64"]}]
+//
+// The landing page at /lan lists the local rooms with how many people are in
+// them, and anyone on the network can join any of them from there. When the
+// network sends everyone's web traffic to NearTalk, the addresses phones and
+// laptops check for a captive portal redirect to it, so it opens when they
+// join.
+//
+// LAN mode also changes the defaults of some flags to save bandwidth and
+// skip features that only make sense across networks, see lanModeDefaults.
+// Flags given on the command line are left alone.
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"html/template"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// lanRoomKey is the key of the room for everyone whose network doesn't have
+// a room of its own, and for every local address outside of LAN mode too.
+const lanRoomKey = "lan"
+
+// lanModeDefaults are the flags LAN mode changes the defaults of, and their
+// values in LAN mode. Without an idle timer, presence updates are only sent
+// when people switch tabs, which saves bandwidth on a busy network. Invites
+// are for people on other networks, which a single-network server doesn't
+// have.
+var lanModeDefaults = map[string]string{
+	"idle-after": "0",
+	"invites":    "false",
+}
+
+// applyLANModeDefaults sets the flags in lanModeDefaults that weren't given
+// on the command line, if LAN mode is on.
+func applyLANModeDefaults(fs *flag.FlagSet) {
+	if !lanMode {
+		return
+	}
+	set := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) { set[f.Name] = true })
+	for name, value := range lanModeDefaults {
+		if !set[name] {
+			if err := fs.Set(name, value); err != nil {
+				log.Printf("applyLANModeDefaults: -%s: %v", name, err)
+			}
+		}
+	}
+}
+
+// validateLANMode returns an error if -lan-mode is used with flags that
+// split rooms by address some other way.
+func validateLANMode() error {
+	if !lanMode {
+		return nil
+	}
+	if privateRooms {
+		return errors.New("-lan-mode can't be used with -private-rooms, rooms aren't keyed by address in LAN mode")
+	}
+	if nearbyPolicy != nearbyOff {
+		return errors.New("-lan-mode can't be used with -nearby, there's only one network")
+	}
+	return nil
+}
+
+// configLANRoom is a LAN room in the config file.
+type configLANRoom struct {
+	// Name is the room's name, which is shown in the header and is its key.
+	Name string `json:"name"`
+	// Subnets are the networks whose people are put in the room, in CIDR
+	// notation, or single addresses.
+	Subnets []string `json:"subnets"`
+}
+
+// lanRoom is a parsed configLANRoom.
+type lanRoom struct {
+	name string
+	// slug is the name as used in the URL of the room, like "ground-floor".
+	slug string
+	nets []*net.IPNet
+}
+
+// lanSlugRe matches the runs of characters that are left out of slugs.
+var lanSlugRe = regexp.MustCompile(`[^a-z0-9]+`)
+
+// lanSlug returns the name as used in URLs, like "ground-floor" for "Ground
+// floor".
+func lanSlug(name string) string {
+	return strings.Trim(lanSlugRe.ReplaceAllString(strings.ToLower(name), "-"), "-")
+}
+
+// parseLANRooms parses and validates the LAN rooms in the config file.
+func parseLANRooms(crs []configLANRoom) ([]lanRoom, error) {
+	slugs := map[string]bool{lanRoomKey: true}
+	rooms := make([]lanRoom, 0, len(crs))
+	for i, cr := range crs {
+		name := strings.TrimSpace(cr.Name)
+		if err := checkConfigRoomName(name); err != nil {
+			return nil, fmt.Errorf("lan room %d: %w", i+1, err)
+		}
+		slug := lanSlug(name)
+		if slug == "" {
+			return nil, fmt.Errorf("lan room %d: name %q needs some letters or numbers", i+1, name)
+		}
+		if slugs[slug] {
+			return nil, fmt.Errorf("lan room %d: name %q is already used", i+1, name)
+		}
+		slugs[slug] = true
+		if len(cr.Subnets) == 0 {
+			return nil, fmt.Errorf("lan room %d: no subnets are listed", i+1)
+		}
+		room := lanRoom{name: name, slug: slug}
+		for _, s := range cr.Subnets {
+			n, err := parseSubnet(s)
+			if err != nil {
+				return nil, fmt.Errorf("lan room %d: %w", i+1, err)
+			}
+			room.nets = append(room.nets, n)
+		}
+		rooms = append(rooms, room)
+	}
+	return rooms, nil
+}
+
+// lanRoomKeyFor returns the key of the LAN room for the address, which is
+// the first room with a subnet it's in, or lanRoomKey. The address can be
+// nil.
+func lanRoomKeyFor(ip net.IP) string {
+	if ip == nil {
+		return lanRoomKey
+	}
+	for _, room := range currentConfig().lanRooms {
+		for _, n := range room.nets {
+			if n.Contains(ip) {
+				return room.name
+			}
+		}
+	}
+	return lanRoomKey
+}
+
+// lanRoomBySlug returns the key of the LAN room with the slug, and false if
+// there isn't one.
+func lanRoomBySlug(slug string) (string, bool) {
+	if slug == lanRoomKey {
+		return lanRoomKey, true
+	}
+	for _, room := range currentConfig().lanRooms {
+		if room.slug == slug {
+			return room.name, true
+		}
+	}
+	return "", false
+}
+
+// lanEntry is a room shown on the landing page.
+type lanEntry struct {
+	Name  string
+	Slug  string
+	Topic string
+	Users int
+	// Here is true for the room of the visitor's own network.
+	Here bool
+}
+
+// lanEntries returns the LAN rooms for the landing page, with the room for
+// the key marked.
+// It holds the roomsMu.
+func (cs *chatServer) lanEntries(key string) []lanEntry {
+	entries := []lanEntry{{Name: lanRoomKey, Slug: lanRoomKey}}
+	for _, room := range currentConfig().lanRooms {
+		entries = append(entries, lanEntry{Name: room.name, Slug: room.slug})
+	}
+	cs.roomsMu.Lock()
+	defer cs.roomsMu.Unlock()
+	for i := range entries {
+		e := &entries[i]
+		e.Here = e.Name == key
+		if room, ok := cs.rooms[e.Name]; ok {
+			room.clientsMu.Lock()
+			e.Topic = room.topic
+			e.Users = len(room.users())
+			room.clientsMu.Unlock()
+		}
+	}
+	return entries
+}
+
+// lanLandingHandler serves the landing page at /lan in LAN mode, which lists
+// the local rooms.
+func (cs *chatServer) lanLandingHandler(w http.ResponseWriter, r *http.Request) {
+	if !lanMode {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	fmt.Fprint(w, renderTemplate("lan.html", cs.lanEntries(cs.clientRoomKey(r))))
+}
+
+// lanRoomPageHandler serves the chat page for a LAN room at /lan/<slug>, so
+// people can join the rooms of other networks on the LAN, and for its
+// subrooms at /lan/<slug>/<name>, see subroom.go. If the room is locked,
+// visitors have to enter the password first.
+func (cs *chatServer) lanRoomPageHandler(w http.ResponseWriter, r *http.Request) {
+	if !lanMode {
+		http.NotFound(w, r)
+		return
+	}
+	slug, sub, isSub := strings.Cut(strings.TrimPrefix(r.URL.Path, "/lan/"), "/")
+	key, ok := lanRoomBySlug(slug)
+	if !ok {
+		http.Error(w, "There's no room here with that name.", http.StatusNotFound)
+		return
+	}
+	if isSub {
+		cs.serveSubroomPage(w, r, key, sub)
+		return
+	}
+	if !cs.challengeGate(w, r) || !cs.passwordGate(w, r, key, key) {
+		return
+	}
+
+	page, err := os.ReadFile("html/index.html")
+	if err != nil {
+		log.Printf("chatServer.lanRoomPageHandler: err reading index.html: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	// Connect to the LAN room instead of the one for the network
+	page = bytes.Replace(page, []byte(`<body hx-ws="connect:/connect">`), []byte(fmt.Sprintf(
+		`<body hx-ws="connect:/connect?lan=%s">`, template.HTMLEscapeString(slug),
+	)), 1)
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Write(page)
+}
+
+// captivePortalPaths are the addresses operating systems and browsers check
+// to see if they're behind a captive portal.
+var captivePortalPaths = []string{
+	"/generate_204",              // Android, Chrome
+	"/gen_204",                   // Android
+	"/hotspot-detect.html",       // Apple
+	"/library/test/success.html", // Apple
+	"/connecttest.txt",           // Windows
+	"/ncsi.txt",                  // Windows
+	"/success.txt",               // Firefox
+	"/canonical.html",            // Firefox
+	"/check_network_status.txt",  // NetworkManager
+}
+
+// captivePortalHandler redirects the captive portal checks to the landing
+// page in LAN mode, so it opens when people join the network.
+func captivePortalHandler(w http.ResponseWriter, r *http.Request) {
+	if !lanMode {
+		http.NotFound(w, r)
+		return
+	}
+	http.Redirect(w, r, "/lan", http.StatusFound)
+}
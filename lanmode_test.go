@@ -0,0 +1,89 @@
+package main
+
+import (
+	"flag"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestParseLANRooms(t *testing.T) {
+	rooms, err := parseLANRooms([]configLANRoom{
+		{Name: " Ground floor ", Subnets: []string{"192.168.10.0/24", "fd00:10::/64"}},
+		{Name: "Guest Wi-Fi", Subnets: []string{"10.20.0.5"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rooms[0].name != "Ground floor" || rooms[0].slug != "ground-floor" || len(rooms[0].nets) != 2 {
+		t.Errorf("got %+v, want the ground floor", rooms[0])
+	}
+	if rooms[1].slug != "guest-wi-fi" || !rooms[1].nets[0].Contains(net.ParseIP("10.20.0.5")) || rooms[1].nets[0].Contains(net.ParseIP("10.20.0.6")) {
+		t.Errorf("got %+v, want the guest Wi-Fi with one address", rooms[1])
+	}
+
+	bad := [][]configLANRoom{
+		{{Name: "", Subnets: []string{"10.0.0.0/8"}}},
+		{{Name: "#music", Subnets: []string{"10.0.0.0/8"}}},
+		{{Name: "10.0.0.1", Subnets: []string{"10.0.0.0/8"}}},
+		{{Name: "Floor #2", Subnets: []string{"10.0.0.0/8"}}},
+		{{Name: "LAN", Subnets: []string{"10.0.0.0/8"}}},
+		{{Name: "!!!", Subnets: []string{"10.0.0.0/8"}}},
+		{{Name: "Office", Subnets: nil}},
+		{{Name: "Office", Subnets: []string{"10.0.0.0/33"}}},
+		{{Name: "Office", Subnets: []string{"10.0.0.0/8"}}, {Name: "office", Subnets: []string{"10.1.0.0/16"}}},
+	}
+	for i, crs := range bad {
+		if _, err := parseLANRooms(crs); err == nil {
+			t.Errorf("bad LAN rooms %d were accepted", i)
+		}
+	}
+}
+
+func TestLANRoomKeyFor(t *testing.T) {
+	c, err := parseConfig([]byte(`{"lan_rooms": [{"name": "Ground floor", "subnets": ["192.168.10.0/24"]},
+		{"name": "Everywhere else", "subnets": ["192.168.0.0/16"]}]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer liveConfig.Store(liveConfig.Swap(c))
+	tests := []struct {
+		ip   string
+		want string
+	}{
+		{"192.168.10.7", "Ground floor"},
+		{"192.168.20.7", "Everywhere else"},
+		{"10.0.0.1", lanRoomKey},
+		{"203.0.113.5", lanRoomKey},
+		{"", lanRoomKey},
+	}
+	for _, tt := range tests {
+		if got := lanRoomKeyFor(net.ParseIP(tt.ip)); got != tt.want {
+			t.Errorf("lanRoomKeyFor(%q) = %q, want %q", tt.ip, got, tt.want)
+		}
+	}
+	if key, ok := lanRoomBySlug("ground-floor"); !ok || key != "Ground floor" {
+		t.Errorf("lanRoomBySlug(ground-floor) = %q, %v", key, ok)
+	}
+	if _, ok := lanRoomBySlug("attic"); ok {
+		t.Error("found a room that isn't there")
+	}
+}
+
+func TestApplyLANModeDefaults(t *testing.T) {
+	defer func(on, inv bool, idle time.Duration) { lanMode, invitesFlag, idleAfter = on, inv, idle }(lanMode, invitesFlag, idleAfter)
+	fs := flag.NewFlagSet("neartalk", flag.ContinueOnError)
+	fs.BoolVar(&lanMode, "lan-mode", false, "")
+	fs.BoolVar(&invitesFlag, "invites", true, "")
+	fs.DurationVar(&idleAfter, "idle-after", 5*time.Minute, "")
+	if err := fs.Parse([]string{"-lan-mode", "-invites=true"}); err != nil {
+		t.Fatal(err)
+	}
+	applyLANModeDefaults(fs)
+	if !invitesFlag {
+		t.Error("-invites was given, but it was changed")
+	}
+	if idleAfter != 0 {
+		t.Errorf("-idle-after = %v, want the LAN mode default", idleAfter)
+	}
+}
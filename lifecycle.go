@@ -0,0 +1,350 @@
+package main
+
+// This file has what happens when rooms are created and closed. The room
+// hooks are called for both, which keep the counts and the list of recently
+// closed rooms on the admin page, and send the room webhook if -room-webhook
+// is set.
+//
+// Rooms are closed with close, whether everyone left, the room was evicted
+// or expired, the admin closed it, or the server is shutting down. It stops
+// the room's goroutine, refusing the messages still waiting for it, and
+// disconnects whoever is left.
+//
+// Rooms normally close when the last person leaves, but a tab left open
+// would keep its room, and the room's goroutine, forever. So with
+// -room-expiry, rooms nobody has sent a message in for that long are closed,
+// telling whoever is still there.
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"net/url"
+	"sync/atomic"
+	"time"
+
+	"nhooyr.io/websocket"
+)
+
+// roomCloseReason is why a room closed.
+type roomCloseReason string
+
+const (
+	// roomEmpty is a room everyone left.
+	roomEmpty roomCloseReason = "empty"
+	// roomEvicted is a room closed to make space for a new one, see
+	// makeRoomSpace.
+	roomEvicted roomCloseReason = "evicted"
+	// roomExpired is a room nobody had sent a message in for roomExpiry.
+	roomExpired roomCloseReason = "expired"
+	// roomClosedByAdmin is a room the admin closed from the admin page.
+	roomClosedByAdmin roomCloseReason = "admin"
+	// roomShutdown is a room closed because the server is shutting down.
+	roomShutdown roomCloseReason = "shutdown"
+	// roomMoved is a room the admin moved everyone out of, by merging or
+	// splitting it, see roommove.go.
+	roomMoved roomCloseReason = "moved"
+)
+
+// Room events.
+const (
+	roomEventCreated = "created"
+	roomEventClosed  = "closed"
+)
+
+// roomEvent is a room being created or closed. It's what's sent to the room
+// webhook, as JSON.
+type roomEvent struct {
+	// Event is roomEventCreated or roomEventClosed.
+	Event string `json:"event"`
+	// Room is the room key, which is an IP address or a place for rooms that
+	// aren't named.
+	Room    string    `json:"room"`
+	Time    time.Time `json:"time"`
+	Created time.Time `json:"created"`
+	// The rest are only set for closed rooms.
+	Reason    roomCloseReason `json:"reason,omitempty"`
+	PeakUsers int             `json:"peak_users,omitempty"`
+	Messages  int             `json:"messages,omitempty"`
+}
+
+// roomHook is called when a room is created or closed. It's called while
+// holding the roomsMu, so it must not block.
+type roomHook func(e roomEvent)
+
+// roomCounts counts rooms created and closed since the server started, by
+// why they closed.
+var roomCounts struct {
+	created, empty, evicted, expired, admin atomic.Int64
+}
+
+// countRoom is the room hook that keeps roomCounts.
+func countRoom(e roomEvent) {
+	if e.Event == roomEventCreated {
+		roomCounts.created.Add(1)
+		return
+	}
+	switch e.Reason {
+	case roomEmpty:
+		roomCounts.empty.Add(1)
+	case roomEvicted:
+		roomCounts.evicted.Add(1)
+	case roomExpired:
+		roomCounts.expired.Add(1)
+	case roomClosedByAdmin:
+		roomCounts.admin.Add(1)
+	}
+}
+
+// roomCreated calls the room hooks for a room that was just created.
+// It does not lock the roomsMu, callers should do that.
+func (cs *chatServer) roomCreated(cr *chatRoom) {
+	cs.callRoomHooks(roomEvent{Event: roomEventCreated, Room: cr.key, Time: cr.created, Created: cr.created})
+}
+
+// roomClosed calls the room hooks for a room that was just closed.
+// It does not lock the roomsMu or the room's clientsMu, callers should do
+// that.
+func (cs *chatServer) roomClosed(cr *chatRoom, reason roomCloseReason) {
+	cs.callRoomHooks(roomEvent{
+		Event:     roomEventClosed,
+		Room:      cr.key,
+		Time:      time.Now(),
+		Created:   cr.created,
+		Reason:    reason,
+		PeakUsers: cr.stats.peakUsers,
+		Messages:  cr.stats.totalMsgs,
+	})
+}
+
+func (cs *chatServer) callRoomHooks(e roomEvent) {
+	for _, hook := range cs.roomHooks {
+		hook(e)
+	}
+}
+
+// roomWebhookQueue is how many room events can wait to be sent to the room
+// webhook. Any more are dropped.
+const roomWebhookQueue = 100
+
+// roomWebhook POSTs room events to a URL as JSON, one at a time, so a slow
+// webhook doesn't hold up the rooms.
+type roomWebhook struct {
+	url    string
+	events chan roomEvent
+}
+
+func newRoomWebhook(target string) *roomWebhook {
+	w := &roomWebhook{url: target, events: make(chan roomEvent, roomWebhookQueue)}
+	go w.run()
+	return w
+}
+
+// hook is the room hook that queues the event to be sent.
+func (w *roomWebhook) hook(e roomEvent) {
+	select {
+	case w.events <- e:
+	default:
+		log.Printf("roomWebhook: too many events waiting, dropped %s event for room %s", e.Event, e.Room)
+	}
+}
+
+func (w *roomWebhook) run() {
+	for e := range w.events {
+		b, err := json.Marshal(e)
+		if err == nil {
+			err = postJSON(w.url, b)
+		}
+		if err != nil {
+			log.Printf("roomWebhook: %s event for room %s: %v", e.Event, e.Room, err)
+		}
+	}
+}
+
+// expiryInterval is how often rooms are checked for expiry.
+const expiryInterval = time.Minute
+
+// runRoomExpiry closes expired rooms every expiryInterval. It never returns,
+// so it should be run in a goroutine.
+func (cs *chatServer) runRoomExpiry() {
+	for now := range time.Tick(expiryInterval) {
+		cs.expireRooms(now)
+	}
+}
+
+// expireRooms closes every room nobody has sent a message in for
+// roomExpiry, as of now.
+func (cs *chatServer) expireRooms(now time.Time) {
+	cs.roomsMu.Lock()
+	defer cs.roomsMu.Unlock()
+	expired := false
+	for key, room := range cs.rooms {
+		idle := room.lastActivity()
+		if now.Sub(idle) < roomExpiry {
+			continue
+		}
+		log.Printf("chatServer.expireRooms: closing room %s, idle since %v", key, idle)
+		delete(cs.rooms, key)
+		room.close(roomExpired)
+		expired = true
+	}
+	if expired {
+		cs.admins.poke()
+	}
+}
+
+// validateRoomLifecycle returns an error if -room-expiry or -room-webhook is
+// invalid.
+func validateRoomLifecycle() error {
+	if roomExpiry < 0 {
+		return errors.New("-room-expiry can't be negative")
+	}
+	if roomWebhookURL == "" {
+		return nil
+	}
+	u, err := url.Parse(roomWebhookURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("-room-webhook %q isn't an http or https URL", roomWebhookURL)
+	}
+	return nil
+}
+
+// closeMessage returns the close status and reason everyone in a room is
+// disconnected with when it closes for the reason, and the notice they're
+// sent first.
+func closeMessage(reason roomCloseReason) (status websocket.StatusCode, closeReason, notice string) {
+	switch reason {
+	case roomExpired:
+		d := roundDuration(roomExpiry)
+		return websocket.StatusNormalClosure,
+			fmt.Sprintf("chat room closed after %s without messages", d),
+			fmt.Sprintf("This room was closed after %s without messages.", d)
+	case roomClosedByAdmin:
+		return websocket.StatusNormalClosure, "chat room closed by the admin",
+			"This room was closed by the admin."
+	case roomShutdown:
+		return websocket.StatusGoingAway, "server is shutting down",
+			"The server is shutting down, try again in a moment."
+	}
+	return websocket.StatusTryAgainLater, "chat room closed to make space for others",
+		"This room was closed to make space for others."
+}
+
+// close closes the room. Its goroutine is stopped, and everyone still in it
+// is told why and disconnected. Then its settings are saved and the room
+// hooks are called. The room must already have been removed from the
+// chatServer. It's safe to call more than once, from any goroutine except
+// the room's own.
+func (cr *chatRoom) close(reason roomCloseReason) {
+	cr.closeOnce.Do(func() {
+		close(cr.closed)
+		<-cr.stopped
+
+		if reason != roomEmpty && reason != roomMoved {
+			status, closeReason, notice := closeMessage(reason)
+			// The web UI doesn't show why it was disconnected, so they're
+			// sent a notice too
+			cr.send(roomNotice(notice, time.Now()), nil)
+			cr.clientsMu.Lock()
+			for c := range cr.clients {
+				c.disconnectAfterSent(status, closeReason)
+			}
+			cr.clientsMu.Unlock()
+		}
+
+		cr.clientsMu.Lock()
+		defer cr.clientsMu.Unlock()
+		cr.clients = make(map[*client]struct{})
+		cr.saveSettings()
+		cr.closeObservers()
+		cr.server.roomClosed(cr, reason)
+	})
+}
+
+// stop refuses the messages still waiting for the room, and tells other
+// instances this one has left it. It's only called by the room's goroutine,
+// once the room has closed.
+func (cr *chatRoom) stop(q *rateQueue) {
+	cr.unsubscribe()
+	cr.server.bus.publishRoster(cr.key, nil)
+	for _, qm := range q.msgs {
+		refuseClosed(qm.m)
+	}
+	q.stop()
+	for {
+		select {
+		case m := <-cr.incoming:
+			refuseClosed(m)
+		default:
+			return
+		}
+	}
+}
+
+// refuseClosed tells the author of a message that wasn't sent because the
+// room closed.
+func refuseClosed(m msg) {
+	if m.author != nil {
+		m.author.sendError("The room closed before your message was sent")
+	}
+}
+
+// closeRoom removes the room with the key and closes it. It returns false if
+// there's no such room.
+// It holds the roomsMu.
+func (cs *chatServer) closeRoom(key string, reason roomCloseReason) bool {
+	cs.roomsMu.Lock()
+	defer cs.roomsMu.Unlock()
+	room, ok := cs.rooms[key]
+	if !ok {
+		return false
+	}
+	delete(cs.rooms, key)
+	room.close(reason)
+	cs.admins.poke()
+	return true
+}
+
+// closeRooms closes every room, for when the server is shutting down.
+// It holds the roomsMu.
+func (cs *chatServer) closeRooms() {
+	cs.roomsMu.Lock()
+	defer cs.roomsMu.Unlock()
+	for key, room := range cs.rooms {
+		delete(cs.rooms, key)
+		room.close(roomShutdown)
+	}
+}
+
+// adminCloseRoomHandler closes the room with the key in the "room" form
+// value, from the admin page.
+func (cs *chatServer) adminCloseRoomHandler(w http.ResponseWriter, r *http.Request) {
+	keyID, ok := cs.adminSession(r)
+	if !ok || r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	key := r.FormValue("room")
+	if key == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	if !cs.closeRoom(key, roomClosedByAdmin) {
+		fmt.Fprint(w, `<span class="error">That room is gone.</span>`)
+		return
+	}
+	cs.audit.record(keyID, auditCloseRoom, key, "")
+	fmt.Fprint(w, `<span>Closed.</span>`)
+}
+
+// adminCloseRoomButton returns the admin page button for closing the room.
+func adminCloseRoomButton(key string) string {
+	vals, _ := json.Marshal(map[string]string{"room": key})
+	return fmt.Sprintf(
+		`<button hx-post="/admin-close-room" hx-vals="%s" hx-confirm="Close this room and disconnect everyone in it?" hx-swap="outerHTML">Close room</button>`,
+		template.HTMLEscapeString(string(vals)),
+	)
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestValidateRoomLifecycle(t *testing.T) {
+	defer func(d time.Duration, u string) { roomExpiry, roomWebhookURL = d, u }(roomExpiry, roomWebhookURL)
+
+	for _, tt := range []struct {
+		expiry  time.Duration
+		webhook string
+		ok      bool
+	}{
+		{0, "", true},
+		{24 * time.Hour, "https://example.com/hooks/rooms", true},
+		{-time.Hour, "", false},
+		{0, "example.com/hooks", false},
+		{0, "ftp://example.com", false},
+	} {
+		roomExpiry, roomWebhookURL = tt.expiry, tt.webhook
+		if err := validateRoomLifecycle(); (err == nil) != tt.ok {
+			t.Errorf("validateRoomLifecycle() with %v and %q = %v", tt.expiry, tt.webhook, err)
+		}
+	}
+}
+
+func TestClosedRoomsHook(t *testing.T) {
+	var c closedRooms
+	created := time.Date(2026, 10, 16, 12, 0, 0, 0, time.UTC)
+	c.add(roomEvent{Event: roomEventCreated, Room: "lan", Time: created, Created: created})
+	if c.html() != "" {
+		t.Error("a created room was listed as closed")
+	}
+	c.add(roomEvent{
+		Event: roomEventClosed, Room: "lan", Time: created.Add(90 * time.Minute), Created: created,
+		Reason: roomExpired, PeakUsers: 2, Messages: 5,
+	})
+	if s := c.html(); !strings.Contains(s, "<td>lan</td><td>13:30</td><td>expired</td><td>1h30m</td><td>2</td><td>5</td>") {
+		t.Errorf("closed rooms table = %q", s)
+	}
+}
@@ -0,0 +1,210 @@
+package main
+
+// This file applies the link policy from the config file, which decides what
+// happens to links in messages. With "link_policy" set to "allow", the
+// default, links are sent as usual. With "strip", they're replaced with
+// "[link removed]", and with "hold", messages with links are only sent once a
+// moderator of the room approves them with "/approve <number>", or dropped
+// with "/reject <number>".
+//
+// Links to the domains in "link_allow", or their subdomains, are always
+// allowed, so "strip" or "hold" with an allow list only lets those through.
+// Links to the domains in "link_deny" are never allowed, and are removed even
+// with "allow". Moderators and bots aren't held back by the policy, and
+// encrypted messages can't be checked.
+
+import (
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// Link policies, for link_policy in the config file.
+const (
+	linkPolicyAllow = "allow"
+	linkPolicyStrip = "strip"
+	linkPolicyHold  = "hold"
+)
+
+// strippedLink is what links that aren't allowed are replaced with.
+const strippedLink = "[link removed]"
+
+// maxHeldMsgs is the most messages a room holds for approval at once. The
+// oldest is dropped to make space.
+const maxHeldMsgs = 20
+
+// heldMsg is a message waiting for a moderator's approval.
+type heldMsg struct {
+	// num is what moderators approve or reject it with.
+	num int
+	m   msg
+}
+
+// validateLinkPolicy returns an error if the link policy config is invalid.
+func validateLinkPolicy(cf configFile) error {
+	switch cf.LinkPolicy {
+	case "", linkPolicyAllow, linkPolicyStrip, linkPolicyHold:
+	default:
+		return fmt.Errorf("invalid link_policy %q, must be %q, %q, or %q",
+			cf.LinkPolicy, linkPolicyAllow, linkPolicyStrip, linkPolicyHold)
+	}
+	for _, d := range append(cf.LinkAllow, cf.LinkDeny...) {
+		if d == "" || strings.ContainsAny(d, "/: ") {
+			return fmt.Errorf("invalid link domain %q, use just the domain, like example.com", d)
+		}
+	}
+	return nil
+}
+
+// matchesDomain returns true if host is one of the domains or a subdomain of
+// one.
+func matchesDomain(host string, domains []string) bool {
+	host = strings.TrimSuffix(strings.ToLower(host), ".")
+	for _, d := range domains {
+		d = strings.TrimSuffix(strings.ToLower(d), ".")
+		if host == d || strings.HasSuffix(host, "."+d) {
+			return true
+		}
+	}
+	return false
+}
+
+// linkAllowed returns true if the link can be sent without being removed or
+// held. Links without a host, like mailto: links, are only allowed by the
+// "allow" policy.
+func (c *config) linkAllowed(link string) bool {
+	u, err := url.Parse(link)
+	host := ""
+	if err == nil {
+		host = u.Hostname()
+	}
+	if host != "" && matchesDomain(host, c.LinkDeny) {
+		return false
+	}
+	if c.LinkPolicy == "" || c.LinkPolicy == linkPolicyAllow {
+		return true
+	}
+	return host != "" && matchesDomain(host, c.LinkAllow)
+}
+
+// stripLinks returns the text with the links that aren't allowed replaced,
+// and whether there were any.
+func (c *config) stripLinks(text string) (string, bool) {
+	found := false
+	text = urlRe.ReplaceAllStringFunc(text, func(link string) string {
+		if c.linkAllowed(link) {
+			return link
+		}
+		found = true
+		return strippedLink
+	})
+	return text, found
+}
+
+// linkPolicyText applies the link policy to text sent by the client, and
+// returns it. It returns false if the text would have to be held for
+// approval instead.
+func linkPolicyText(c *client, text string) (string, bool) {
+	if c.moderator || c.bot != nil {
+		return text, true
+	}
+	cfg := currentConfig()
+	stripped, found := cfg.stripLinks(text)
+	if found && cfg.LinkPolicy == linkPolicyHold {
+		return text, false
+	}
+	return stripped, true
+}
+
+// applyLinkPolicy applies the link policy to the message. It returns false if
+// the message was held for approval, or refused because there's nobody to
+// approve it.
+// It does not lock the clientsMu, callers should do that.
+func (cr *chatRoom) applyLinkPolicy(m *msg) bool {
+	text, ok := linkPolicyText(m.author, m.text)
+	if ok {
+		m.text = text
+		return true
+	}
+
+	var mods []*client
+	for c := range cr.clients {
+		if c.moderator {
+			mods = append(mods, c)
+		}
+	}
+	if len(mods) == 0 {
+		m.author.sendError("Links need a moderator's approval here, and there are no moderators in the room")
+		return false
+	}
+	cr.heldCount++
+	if len(cr.held) >= maxHeldMsgs {
+		cr.held = cr.held[1:]
+	}
+	cr.held = append(cr.held, heldMsg{num: cr.heldCount, m: *m})
+	m.author.sendNotice("Your message has links, so it will be sent once a moderator approves it")
+	for _, c := range mods {
+		c.sendNotice(c.tr("%s wants to send a message with links, send /approve %d or /reject %d: %s",
+			plainNick(m.author.nick), cr.heldCount, cr.heldCount, m.text))
+	}
+	return false
+}
+
+// takeHeldMsg removes the held message with the number from the argument and
+// returns it, or sends the moderator an error and returns false.
+// It does not lock the clientsMu, callers should do that.
+func (cr *chatRoom) takeHeldMsg(m msg, cmd string) (heldMsg, bool) {
+	if !m.author.moderator {
+		m.author.sendError("Only moderators can use " + cmd)
+		return heldMsg{}, false
+	}
+	num, err := strconv.Atoi(strings.TrimSpace(m.text[len(cmd):]))
+	if err != nil {
+		m.author.sendError(m.author.tr("Usage: %s <number>", cmd))
+		return heldMsg{}, false
+	}
+	for i, h := range cr.held {
+		if h.num != num {
+			continue
+		}
+		cr.held = append(cr.held[:i], cr.held[i+1:]...)
+		if _, ok := cr.clients[h.m.author]; !ok {
+			m.author.sendError("They've left the room, so the message can't be sent")
+			return heldMsg{}, false
+		}
+		return h, true
+	}
+	m.author.sendError("There's no message waiting for approval with that number")
+	return heldMsg{}, false
+}
+
+// handleApprovalCmd handles the "/approve <number>" and "/reject <number>"
+// moderator commands. Approved messages go through the room again, as if the
+// author just sent them.
+// It does not lock the clientsMu, callers should do that.
+func (cr *chatRoom) handleApprovalCmd(m msg) broadcast {
+	cmd, _, _ := strings.Cut(m.text, " ")
+	h, ok := cr.takeHeldMsg(m, cmd)
+	if !ok {
+		return broadcast{}
+	}
+	if cmd == "/reject" {
+		h.m.author.sendError("A moderator didn't approve your message with links")
+		m.author.sendNotice("The message was rejected")
+		return broadcast{}
+	}
+
+	approved := h.m
+	approved.approved = true
+	approved.when = m.when
+	select {
+	case cr.incoming <- approved:
+		m.author.sendNotice("The message was approved")
+	default:
+		// Keep it for another try
+		cr.held = append(cr.held, h)
+		m.author.sendError("The room is too busy right now, try again")
+	}
+	return broadcast{}
+}
@@ -0,0 +1,40 @@
+package main
+
+import "testing"
+
+func TestStripLinks(t *testing.T) {
+	tests := []struct {
+		config string
+		text   string
+		want   string
+	}{
+		{`{}`, "see https://example.com", "see https://example.com"},
+		{`{"link_deny": ["bad.example"]}`, "see https://www.bad.example/x and https://example.com",
+			"see [link removed] and https://example.com"},
+		{`{"link_policy": "strip"}`, "see https://example.com", "see [link removed]"},
+		{`{"link_policy": "strip", "link_allow": ["example.com"]}`,
+			"https://docs.example.com/a https://notexample.com mailto:a@example.com",
+			"https://docs.example.com/a [link removed] [link removed]"},
+	}
+	for _, tt := range tests {
+		c, err := parseConfig([]byte(tt.config))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, _ := c.stripLinks(tt.text); got != tt.want {
+			t.Errorf("with %s, stripLinks(%q) = %q, want %q", tt.config, tt.text, got, tt.want)
+		}
+	}
+}
+
+func TestValidateLinkPolicy(t *testing.T) {
+	for _, s := range []string{
+		`{"link_policy": "block"}`,
+		`{"link_allow": ["https://example.com"]}`,
+		`{"link_deny": [""]}`,
+	} {
+		if _, err := parseConfig([]byte(s)); err == nil {
+			t.Errorf("parseConfig(%s) succeeded", s)
+		}
+	}
+}
@@ -0,0 +1,123 @@
+package main
+
+// This file opens the listener the HTTP server runs on. By default that's TCP
+// on -host and -port, but -listen can give a TCP address or a unix socket like
+// unix:/run/neartalk.sock, for sitting behind a reverse proxy on the same
+// machine. When started by systemd socket activation, the socket systemd
+// passed in is used instead, and the flags are ignored.
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// unixPrefix starts -listen addresses that are unix sockets.
+const unixPrefix = "unix:"
+
+// unixSocketMode is the file mode of unix sockets NearTalk makes, so a proxy
+// in the same group can connect.
+const unixSocketMode = 0o660
+
+// systemdFirstFD is the first file descriptor passed by systemd socket
+// activation, see sd_listen_fds(3).
+const systemdFirstFD = 3
+
+// listenAddr returns the network and address to listen on, from -listen, or
+// -host and -port if it isn't set.
+func listenAddr() (string, string) {
+	if path, ok := strings.CutPrefix(listenFlag, unixPrefix); ok {
+		return "unix", path
+	}
+	if listenFlag != "" {
+		return "tcp", listenFlag
+	}
+	return "tcp", net.JoinHostPort(host, strconv.FormatUint(uint64(port), 10))
+}
+
+// listenDescription returns a description of where the server listens, for
+// logs.
+func listenDescription(l net.Listener) string {
+	if l.Addr().Network() == "unix" {
+		return unixPrefix + l.Addr().String()
+	}
+	return "http://" + l.Addr().String()
+}
+
+// listen opens the listener for the HTTP server.
+func listen() (net.Listener, error) {
+	l, err := systemdListener()
+	if err != nil {
+		return nil, fmt.Errorf("systemd socket activation: %w", err)
+	}
+	if l != nil {
+		return l, nil
+	}
+
+	network, addr := listenAddr()
+	if network != "unix" {
+		return net.Listen(network, addr)
+	}
+	if err := removeStaleSocket(addr); err != nil {
+		return nil, err
+	}
+	l, err = net.Listen(network, addr)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(addr, unixSocketMode); err != nil {
+		l.Close()
+		return nil, err
+	}
+	return l, nil
+}
+
+// removeStaleSocket removes the unix socket at path if it was left behind by
+// a server that didn't shut down cleanly. Sockets still in use and other kinds
+// of files are left alone.
+func removeStaleSocket(path string) error {
+	fi, err := os.Lstat(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if fi.Mode()&os.ModeSocket == 0 {
+		return fmt.Errorf("%s exists and isn't a socket", path)
+	}
+	if c, err := net.Dial("unix", path); err == nil {
+		c.Close()
+		return fmt.Errorf("%s is in use by another server", path)
+	}
+	log.Printf("removing stale socket %s", path)
+	return os.Remove(path)
+}
+
+// systemdListener returns the socket passed in by systemd socket activation,
+// or nil if NearTalk wasn't started that way.
+func systemdListener() (net.Listener, error) {
+	pid, err := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	if err != nil || pid != os.Getpid() {
+		return nil, nil
+	}
+	n, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || n < 1 {
+		return nil, errors.New("LISTEN_FDS is not set, or is 0")
+	}
+	if n > 1 {
+		log.Printf("systemd passed %d sockets, only the first is used", n)
+	}
+	// So child processes don't think the sockets are for them
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+
+	f := os.NewFile(systemdFirstFD, "systemd socket")
+	defer f.Close()
+	return net.FileListener(f)
+}
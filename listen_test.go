@@ -0,0 +1,75 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestListenUnix(t *testing.T) {
+	defer func(l string) { listenFlag = l }(listenFlag)
+	path := filepath.Join(t.TempDir(), "neartalk.sock")
+	listenFlag = unixPrefix + path
+
+	// Left behind by a server that crashed
+	stale, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	stale.Close()
+
+	l, err := listen()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	if got := listenDescription(l); got != listenFlag {
+		t.Errorf("listenDescription = %q, want %q", got, listenFlag)
+	}
+	fi, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Mode().Perm() != unixSocketMode {
+		t.Errorf("socket mode = %v, want %v", fi.Mode().Perm(), os.FileMode(unixSocketMode))
+	}
+	if _, err := listen(); err == nil {
+		t.Error("listened on a socket that's in use")
+	}
+
+	go http.Serve(l, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, getIPString(r))
+	}))
+	c := http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, "unix", path)
+		},
+	}}
+	resp, err := c.Get("http://neartalk/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	b, _ := io.ReadAll(resp.Body)
+	if string(b) != "lan" {
+		t.Errorf("room key over a unix socket = %q, want lan", b)
+	}
+}
+
+func TestListenNotSocket(t *testing.T) {
+	defer func(l string) { listenFlag = l }(listenFlag)
+	path := filepath.Join(t.TempDir(), "file")
+	if err := os.WriteFile(path, nil, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	listenFlag = unixPrefix + path
+	if l, err := listen(); err == nil {
+		l.Close()
+		t.Error("replaced a file that isn't a socket")
+	}
+}
@@ -0,0 +1,412 @@
+package main
+
+// This file handles locking rooms with a password. The person who created a
+// room can lock it with "/lock <password>", and anyone else can propose
+// locking it, which happens if most of the room agrees by sending
+// "/lock yes". Everyone in the room when it's locked can still rejoin, but
+// newcomers are shown a form to enter the password before they can connect.
+// "/unlock" removes the password. Like everything else about a room, the
+// password is forgotten once everyone has left, unless room settings are
+// saved, see roomsettings.go.
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/makeworld-the-better-one/neartalk/events"
+)
+
+// maxRoomPasswordLen is the max length of a room password in bytes.
+const maxRoomPasswordLen = 100
+
+// lockVoteDuration is how long a vote to lock a room lasts.
+const lockVoteDuration = time.Minute
+
+// errRoomLocked is returned when a client joining a room hasn't entered its
+// password.
+var errRoomLocked = errors.New("room is locked")
+
+// roomPasswordIterations is how many PBKDF2 iterations room passwords are
+// hashed with, so guessing a password from a saved hash is slow.
+const roomPasswordIterations = 250000
+
+// roomPassword is the hashed password of a locked room.
+type roomPassword struct {
+	salt []byte
+	hash []byte
+	// iterations is how many PBKDF2 iterations the hash took. It's 0 for
+	// passwords saved before they were hashed with PBKDF2, which were hashed
+	// once with SHA-256.
+	iterations int
+}
+
+// newRoomPassword hashes the password with a random salt.
+func newRoomPassword(password string) *roomPassword {
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		panic(err)
+	}
+	return &roomPassword{
+		salt:       salt,
+		hash:       hashRoomPassword(salt, password, roomPasswordIterations),
+		iterations: roomPasswordIterations,
+	}
+}
+
+// hashRoomPassword hashes the password with PBKDF2-HMAC-SHA256, or once with
+// SHA-256 if iterations is 0.
+func hashRoomPassword(salt []byte, password string, iterations int) []byte {
+	if iterations == 0 {
+		h := sha256.New()
+		h.Write(salt)
+		h.Write([]byte(password))
+		return h.Sum(nil)
+	}
+	return pbkdf2([]byte(password), salt, iterations)
+}
+
+// pbkdf2 derives a key the size of a SHA-256 hash from the password, as in
+// RFC 8018. Only one block is needed for that size.
+func pbkdf2(password, salt []byte, iterations int) []byte {
+	prf := hmac.New(sha256.New, password)
+	prf.Write(salt)
+	prf.Write([]byte{0, 0, 0, 1})
+	u := prf.Sum(nil)
+	key := append([]byte(nil), u...)
+	for i := 1; i < iterations; i++ {
+		prf.Reset()
+		prf.Write(u)
+		u = prf.Sum(u[:0])
+		for j := range key {
+			key[j] ^= u[j]
+		}
+	}
+	return key
+}
+
+// matches returns true if password is the room password.
+func (p *roomPassword) matches(password string) bool {
+	return subtle.ConstantTimeCompare(p.hash, hashRoomPassword(p.salt, password, p.iterations)) == 1
+}
+
+// lockVote is a vote in progress to lock a room.
+type lockVote struct {
+	password *roomPassword
+	proposer *client
+	yes      map[*client]bool
+	expires  time.Time
+}
+
+// mayJoin returns true if the session can join the room, because it isn't
+// locked or the session has entered the password.
+// It does not lock the clientsMu, callers should do that.
+func (cr *chatRoom) mayJoin(session string) bool {
+	return cr.password == nil || cr.allowedSessions[session]
+}
+
+// mayJoinRoom returns true if the session can join the room with the key.
+// Rooms that don't exist yet can always be joined, unless their saved
+// settings say they're locked.
+func (cs *chatServer) mayJoinRoom(key, session string) bool {
+	cs.roomsMu.Lock()
+	defer cs.roomsMu.Unlock()
+	room, ok := cs.rooms[key]
+	if !ok {
+		return cs.roomSettings.mayJoin(key, session)
+	}
+	room.clientsMu.Lock()
+	defer room.clientsMu.Unlock()
+	return room.mayJoin(session)
+}
+
+// enterRoomPassword lets the session join the room if the password is right.
+// It returns false if it's wrong. Rooms that aren't locked can always be
+// joined. Hashing the password is slow, so no lock is held while it's
+// checked.
+func (cs *chatServer) enterRoomPassword(key, session, password string) bool {
+	cs.roomsMu.Lock()
+	room, ok := cs.rooms[key]
+	cs.roomsMu.Unlock()
+	if !ok {
+		return cs.roomSettings.enterPassword(key, session, password)
+	}
+	room.clientsMu.Lock()
+	p := room.password
+	room.clientsMu.Unlock()
+	if p == nil {
+		return true
+	}
+	if !p.matches(password) {
+		return false
+	}
+	room.clientsMu.Lock()
+	defer room.clientsMu.Unlock()
+	if room.password != p {
+		// Unlocked, or locked with another password, while checking
+		return room.password == nil
+	}
+	room.allowedSessions[session] = true
+	room.saveSettings()
+	return true
+}
+
+// maxPasswordAttempts is how many wrong passwords an address can enter in
+// passwordAttemptWindow before it has to wait for the window to end.
+const maxPasswordAttempts = 5
+
+// passwordAttemptWindow is how long wrong passwords count against an
+// address.
+const passwordAttemptWindow = 15 * time.Minute
+
+// passwordAttempts counts wrong room passwords by address, so passwords can't
+// be guessed quickly.
+type passwordAttempts struct {
+	mu sync.Mutex
+	// failed holds the addresses that entered a wrong password.
+	failed map[string]*failedAttempts
+}
+
+// failedAttempts is the wrong passwords entered from an address.
+type failedAttempts struct {
+	count int
+	// until is when the window of the first one ends.
+	until time.Time
+}
+
+func newPasswordAttempts() *passwordAttempts {
+	return &passwordAttempts{failed: make(map[string]*failedAttempts)}
+}
+
+// allowed returns true if the address can try another password.
+func (pa *passwordAttempts) allowed(addr string, now time.Time) bool {
+	pa.mu.Lock()
+	defer pa.mu.Unlock()
+	for a, f := range pa.failed {
+		if !now.Before(f.until) {
+			delete(pa.failed, a)
+		}
+	}
+	f, ok := pa.failed[addr]
+	return !ok || f.count < maxPasswordAttempts
+}
+
+// fail counts a wrong password from the address.
+func (pa *passwordAttempts) fail(addr string, now time.Time) {
+	pa.mu.Lock()
+	defer pa.mu.Unlock()
+	f, ok := pa.failed[addr]
+	if !ok {
+		f = &failedAttempts{until: now.Add(passwordAttemptWindow)}
+		pa.failed[addr] = f
+	}
+	f.count++
+}
+
+// passwordPageData is passed to the password.html template.
+type passwordPageData struct {
+	// Title is the name of the room shown on the page.
+	Title string
+	// Action is where the form is POSTed.
+	Action string
+	// Wrong is true if the visitor entered the wrong password.
+	Wrong bool
+	// TooMany is true if the visitor entered too many wrong passwords, and
+	// has to wait before trying again.
+	TooMany bool
+}
+
+// passwordGate serves the password form for a locked room, and checks the
+// password when the form is POSTed back to the same path. It returns true if
+// the visitor can go on to the chat page.
+func (cs *chatServer) passwordGate(w http.ResponseWriter, r *http.Request, key, title string) bool {
+	session := getSession(w, r)
+	data := passwordPageData{Title: title, Action: r.URL.Path}
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+		if cs.mayJoinRoom(key, session) {
+			return true
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		fmt.Fprint(w, renderTemplate("password.html", data))
+	case http.MethodPost:
+		addr := clientAddr(r, int(trustedProxies)).String()
+		if !cs.passwordAttempts.allowed(addr, time.Now()) {
+			data.TooMany = true
+			w.Header().Set("Content-Type", "text/html; charset=utf-8")
+			w.Header().Set("Retry-After", strconv.Itoa(int(passwordAttemptWindow.Seconds())))
+			w.WriteHeader(http.StatusTooManyRequests)
+			fmt.Fprint(w, renderTemplate("password.html", data))
+			return false
+		}
+		if cs.enterRoomPassword(key, session, r.PostFormValue("password")) {
+			http.Redirect(w, r, r.URL.Path, http.StatusSeeOther)
+			return false
+		}
+		cs.passwordAttempts.fail(addr, time.Now())
+		data.Wrong = true
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.WriteHeader(http.StatusForbidden)
+		fmt.Fprint(w, renderTemplate("password.html", data))
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+	return false
+}
+
+// indexHandler serves the chat page, asking for the password first if the
+// room for the visitor's address is locked, and solving the challenge before
+// that if it's on, see challenge.go. Other files are passed on to next.
+func (cs *chatServer) indexHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/" && r.URL.Path != "/index.html" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		key := cs.clientRoomKey(r)
+		if cs.challengeGate(w, r) && cs.passwordGate(w, r, key, key) {
+			next.ServeHTTP(w, r)
+		}
+	})
+}
+
+// roomNotice returns a broadcast of a notice for everyone in the room, which
+// also clears the author's input field.
+func roomNotice(text string, when time.Time) broadcast {
+	s := createSpecialMsg(text, "notif")
+	return broadcast{
+		html:       s,
+		authorHTML: s + clearInputFieldMsg,
+		json:       []string{encodeEvent(events.TypeNotice, events.Notice{Text: text, Time: when})},
+	}
+}
+
+// lock sets the room password. Everyone in the room can still rejoin.
+// It does not lock the clientsMu, callers should do that.
+func (cr *chatRoom) lock(p *roomPassword) {
+	cr.password = p
+	cr.lockVote = nil
+	for c := range cr.clients {
+		cr.allowedSessions[c.session] = true
+	}
+	cr.saveSettings()
+}
+
+// lockVotesNeeded returns how many more votes the current lock vote needs to
+// pass, which is a majority of the clients in the room.
+// It does not lock the clientsMu, callers should do that.
+func (cr *chatRoom) lockVotesNeeded() int {
+	yes := 0
+	for c := range cr.lockVote.yes {
+		if _, ok := cr.clients[c]; ok {
+			yes++
+		}
+	}
+	return len(cr.clients)/2 + 1 - yes
+}
+
+// lockPasswordArg returns the password of a "/lock <password>" message, and
+// false if the message isn't one or the password can't be used.
+func lockPasswordArg(text string) (string, bool) {
+	if !strings.HasPrefix(text, "/lock ") {
+		return "", false
+	}
+	arg := strings.TrimSpace(text[len("/lock"):])
+	return arg, arg != "" && arg != "yes" && len(arg) <= maxRoomPasswordLen
+}
+
+// handleLockCmd handles "/lock <password>", and "/lock yes" to agree with a
+// vote to lock the room.
+// It does not lock the clientsMu, callers should do that.
+func (cr *chatRoom) handleLockCmd(m msg) broadcast {
+	arg := strings.TrimSpace(m.text[len("/lock"):])
+	if arg == "" {
+		m.author.sendError("Usage: /lock <password>")
+		return broadcast{}
+	}
+	if cr.password != nil {
+		m.author.sendError("This room is already locked, send /unlock first")
+		return broadcast{}
+	}
+	if cr.lockVote != nil && m.when.After(cr.lockVote.expires) {
+		cr.lockVote = nil
+	}
+
+	if arg == "yes" {
+		if cr.lockVote == nil {
+			m.author.sendError("Nobody wants to lock this room right now, send /lock <password> to lock it")
+			return broadcast{}
+		}
+		if cr.lockVote.yes[m.author] {
+			m.author.sendError("You already voted to lock this room")
+			return broadcast{}
+		}
+		cr.lockVote.yes[m.author] = true
+		if needed := cr.lockVotesNeeded(); needed > 0 {
+			return roomNotice(fmt.Sprintf("%s agreed to lock this room, %d more votes are needed",
+				isolateNick(m.author.nick), needed), m.when)
+		}
+		cr.lock(cr.lockVote.password)
+		return roomNotice("This room was locked by vote, newcomers need the password to join", m.when)
+	}
+
+	if len(arg) > maxRoomPasswordLen {
+		m.author.sendError(fmt.Sprintf("Passwords can be at most %d bytes long", maxRoomPasswordLen))
+		return broadcast{}
+	}
+	if m.author.session == cr.creator {
+		cr.lock(m.lockPassword)
+		return roomNotice(fmt.Sprintf("%s locked this room, newcomers need the password to join",
+			isolateNick(m.author.nick)), m.when)
+	}
+	if cr.lockVote != nil {
+		m.author.sendError(fmt.Sprintf("%s already wants to lock this room, send /lock yes to agree",
+			isolateNick(cr.lockVote.proposer.nick)))
+		return broadcast{}
+	}
+
+	cr.lockVote = &lockVote{
+		password: m.lockPassword,
+		proposer: m.author,
+		yes:      map[*client]bool{m.author: true},
+		expires:  m.when.Add(lockVoteDuration),
+	}
+	needed := cr.lockVotesNeeded()
+	if needed <= 0 {
+		cr.lock(cr.lockVote.password)
+		return roomNotice(fmt.Sprintf("%s locked this room, newcomers need the password to join",
+			isolateNick(m.author.nick)), m.when)
+	}
+	return roomNotice(fmt.Sprintf("%s wants to lock this room with a password. Send /lock yes within a minute to agree, %d more votes are needed",
+		isolateNick(m.author.nick), needed), m.when)
+}
+
+// handleUnlockCmd handles "/unlock". Only the person who created the room can
+// unlock it, unless they've left, and then anyone in the room can.
+// It does not lock the clientsMu, callers should do that.
+func (cr *chatRoom) handleUnlockCmd(m msg) broadcast {
+	if cr.password == nil {
+		m.author.sendError("This room isn't locked")
+		return broadcast{}
+	}
+	if m.author.session != cr.creator {
+		for c := range cr.clients {
+			if c.session == cr.creator {
+				m.author.sendError("Only the person who created this room can unlock it")
+				return broadcast{}
+			}
+		}
+	}
+	cr.password = nil
+	cr.allowedSessions = make(map[string]bool)
+	cr.saveSettings()
+	return roomNotice(fmt.Sprintf("%s unlocked this room", isolateNick(m.author.nick)), m.when)
+}
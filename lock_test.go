@@ -0,0 +1,68 @@
+package main
+
+import (
+	"encoding/hex"
+	"testing"
+	"time"
+)
+
+func TestRoomPassword(t *testing.T) {
+	p := newRoomPassword("hunter2")
+	if !p.matches("hunter2") {
+		t.Error("right password doesn't match")
+	}
+	for _, wrong := range []string{"", "hunter", "hunter22", "Hunter2"} {
+		if p.matches(wrong) {
+			t.Errorf("wrong password %q matches", wrong)
+		}
+	}
+	if q := newRoomPassword("hunter2"); string(q.hash) == string(p.hash) {
+		t.Error("same password has the same hash, salt isn't random")
+	}
+}
+
+func TestPBKDF2(t *testing.T) {
+	// From RFC 7914, section 11
+	tests := []struct {
+		password, salt string
+		iterations     int
+		want           string
+	}{
+		{"passwd", "salt", 1, "55ac046e56e3089fec1691c22544b605f94185216dde0465e68b9d57c20dacbc"},
+		{"Password", "NaCl", 80000, "4ddcd8f60b98be21830cee5ef22701f9641a4418d04c0414aeff08876b34ab56"},
+	}
+	for _, tt := range tests {
+		if got := hex.EncodeToString(pbkdf2([]byte(tt.password), []byte(tt.salt), tt.iterations)); got != tt.want {
+			t.Errorf("pbkdf2(%q, %q, %d) = %s, want %s", tt.password, tt.salt, tt.iterations, got, tt.want)
+		}
+	}
+}
+
+func TestRoomPasswordUnsalted(t *testing.T) {
+	// Passwords saved before PBKDF2 still work
+	salt := []byte("0123456789abcdef")
+	p := &roomPassword{salt: salt, hash: hashRoomPassword(salt, "hunter2", 0)}
+	if !p.matches("hunter2") || p.matches("hunter3") {
+		t.Error("password hashed with SHA-256 doesn't match right")
+	}
+}
+
+func TestPasswordAttempts(t *testing.T) {
+	pa := newPasswordAttempts()
+	now := time.Now()
+	for i := 0; i < maxPasswordAttempts; i++ {
+		if !pa.allowed("192.0.2.1", now) {
+			t.Fatalf("attempt %d refused", i+1)
+		}
+		pa.fail("192.0.2.1", now)
+	}
+	if pa.allowed("192.0.2.1", now) {
+		t.Error("allowed after too many wrong passwords")
+	}
+	if !pa.allowed("192.0.2.2", now) {
+		t.Error("another address was refused")
+	}
+	if !pa.allowed("192.0.2.1", now.Add(passwordAttemptWindow)) {
+		t.Error("still refused after the window")
+	}
+}
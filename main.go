@@ -6,40 +6,246 @@ import (
 	"fmt"
 	"log"
 	"math/rand"
-	"net"
 	"net/http"
 	"os"
 	"os/signal"
-	"strconv"
 	"syscall"
 	"time"
 )
 
 // Flag vars
 var (
-	host        string
-	port        uint
-	adminKey    string
-	versionFlag bool
+	host             string
+	port             uint
+	listenFlag       string
+	adminKey         string
+	adminKeysFile    string
+	versionFlag      bool
+	noFormatting     bool
+	templatesDir     string
+	linkPreviews     bool
+	maxRooms         uint
+	roomPolicy       string
+	roomExpiry       time.Duration
+	roomWebhookURL   string
+	editWindow       time.Duration
+	trustedProxies   uint
+	settingsFile     string
+	roomSettingsFile string
+	auditLogFile     string
+	storageDSN       string
+	configPath       string
+	motdFlag         string
+
+	notifyWebhook string
+	notifyEmail   string
+	smtpAddr      string
+	smtpUser      string
+	smtpPass      string
+	smtpFrom      string
+
+	reportInterval  time.Duration
+	reportThreshold uint
+
+	apiTokens string
+
+	botsFile string
+	botRate  float64
+	botBurst uint
+
+	widgetOrigins  string
+	allowedOrigins string
+	frameAncestors string
+
+	chaosFlag string
+
+	redisURL string
+
+	geoIPDB  string
+	geoLevel string
+
+	acceptRate  float64
+	acceptBurst uint
+
+	maxClients      uint
+	maxClientsPerIP uint
+
+	namedRooms  bool
+	invitesFlag bool
+
+	privateRooms bool
+	roomDisplay  string
+
+	roomNetwork string
+	asnDBPath   string
+
+	nearbyPolicy string
+
+	lanMode bool
+
+	readReceipts bool
+
+	e2eeEnabled bool
+
+	idleAfter time.Duration
+
+	retention time.Duration
+
+	historyLen uint
+
+	tripcodeKey string
+
+	publicStatsFlag bool
 )
 
 func main() {
 	flag.StringVar(&host, "host", "127.0.0.1", "Host for HTTP server")
 	flag.UintVar(&port, "port", 8000, "Port number for HTTP server")
+	flag.StringVar(&listenFlag, "listen", "", "Address to listen on instead of -host and -port, like 127.0.0.1:8000, or a unix socket like unix:/run/neartalk.sock. Ignored when started by systemd socket activation")
 	flag.StringVar(&adminKey, "key", "", "Key/password to access admin interface")
+	flag.StringVar(&adminKeysFile, "admin-keys", "", "File listing more admin keys, one per line as: <id> <key>. It's read again when it changes, so keys can be rotated without restarting")
 	flag.BoolVar(&versionFlag, "version", false, "See version info")
-	flag.Parse()
+	flag.BoolVar(&noFormatting, "no-formatting", false, "Disable bold, italic, and code formatting in messages")
+	flag.StringVar(&templatesDir, "templates", "templates", "Directory with custom message templates")
+	flag.BoolVar(&linkPreviews, "link-previews", false, "Fetch and show previews of links in messages")
+	flag.UintVar(&maxRooms, "max-rooms", 0, "Max number of chat rooms at once, 0 for no limit")
+	flag.StringVar(&roomPolicy, "room-policy", roomPolicyRefuse, `What to do when -max-rooms is reached: "refuse" new rooms or "evict-idle" the longest idle room`)
+	flag.DurationVar(&roomExpiry, "room-expiry", 0, "Close rooms nobody has sent a message in for this long, like 24h, disconnecting whoever is still in them. 0 to keep rooms open while anyone is in them")
+	flag.DurationVar(&retention, "retention", 0, "Delete message history, saved room settings, closed room statistics, and audit log entries older than this, like 72h. 0 to keep them as usual")
+	flag.UintVar(&historyLen, "history", 0, "How many of a room's recent messages to show people when they join it. They're kept in the -storage, or in memory without it. 0 to keep no messages")
+	flag.StringVar(&roomWebhookURL, "room-webhook", "", "URL to POST a JSON event to whenever a chat room is created or closed, for metrics. Rooms that aren't named are identified by IP address, place, or hashed address with -private-rooms")
+	flag.DurationVar(&editWindow, "edit-window", 5*time.Minute, "How long authors can edit or delete their messages, 0 to disable")
+	flag.UintVar(&trustedProxies, "trusted-proxies", 1, "Number of reverse proxies in front of the server, for finding client IPs in X-Forwarded-For or Forwarded headers")
+	flag.StringVar(&roomSettingsFile, "room-settings-file", "", "File to save room topics, passwords, and slow mode to, so they survive restarts and empty rooms. They're forgotten when rooms close if not set")
+	flag.StringVar(&settingsFile, "settings-file", "", "File to save user settings to, so they survive restarts. Settings are only kept in memory if not set")
+	flag.StringVar(&configPath, "config", "", "JSON config file with rate limits, the word filter, and banned IPs. Send SIGHUP to reload it without restarting")
+	flag.StringVar(&motdFlag, "motd", "", "Message of the day, shown to everyone when they join a room. It can be changed from the config file or the admin page")
+	flag.StringVar(&auditLogFile, "audit-log", "", "File to append a log of admin actions to. The recent ones are shown on the admin page either way")
+	flag.StringVar(&storageDSN, "storage", "", `Where to keep room settings and the audit log instead of -room-settings-file and -audit-log, and bans and message history: "memory", "sqlite:<path>", or a postgres:// URL`)
+	flag.StringVar(&notifyWebhook, "notify-webhook", "", "URL to POST operator notifications to, like report digests")
+	flag.StringVar(&notifyEmail, "notify-email", "", "Email address to send operator notifications to")
+	flag.StringVar(&smtpAddr, "smtp", "localhost:25", "SMTP server host:port for email notifications")
+	flag.StringVar(&smtpUser, "smtp-user", "", "SMTP username")
+	flag.StringVar(&smtpPass, "smtp-pass", "", "SMTP password")
+	flag.StringVar(&smtpFrom, "smtp-from", "", "From address for email notifications")
+	flag.DurationVar(&reportInterval, "report-digest", 24*time.Hour, "How often to send a digest of abuse reports")
+	flag.UintVar(&reportThreshold, "report-threshold", 3, "Min reports a room needs to be included in the digest")
+	flag.StringVar(&apiTokens, "api-tokens", "", "Comma-separated tokens that can use the REST API under /api/. The API is disabled if not set")
+	flag.StringVar(&botsFile, "bots", "", "File listing bot accounts, one per line as: <token> <room key> <nickname>")
+	flag.Float64Var(&botRate, "bot-rate", 1, "Messages per second each bot can send")
+	flag.UintVar(&botBurst, "bot-burst", 5, "Messages a bot can send at once before -bot-rate applies")
+	flag.StringVar(&widgetOrigins, "widget-origins", "", "Comma-separated origins like https://example.com that can embed the chat widget at /widget, or * for any. The widget is disabled if not set")
+	flag.StringVar(&frameAncestors, "frame-ancestors", "", "Comma-separated origins like https://example.com that can show NearTalk's pages in a frame, besides its own. * for any. See -widget-origins to only allow the widget")
+	flag.StringVar(&allowedOrigins, "allowed-origins", "", "Comma-separated origins like https://example.com whose pages can connect to chat rooms and send requests, besides the server's own host. * for any")
+	flag.StringVar(&chaosFlag, "chaos", "", "Inject faults for testing, like delay=100ms,drop=0.01,slow=0.05. Never use this on a real server")
+	flag.StringVar(&redisURL, "redis-url", "", "Redis server URL like redis://localhost:6379/0, for sharing rooms between several NearTalk instances")
+	flag.StringVar(&geoIPDB, "geoip-db", "", "MaxMind GeoIP2 or GeoLite2 City database file, to group rooms by place instead of IP address")
+	flag.StringVar(&geoLevel, "geoip-level", geoLevelCity, `How to group rooms with -geoip-db: by "city" or "region", or "none" to only use it for -nearby`)
+	flag.Float64Var(&acceptRate, "accept-rate", 20, "New connections accepted per second, to pace crowds joining at once. 0 for no limit")
+	flag.UintVar(&acceptBurst, "accept-burst", 100, "New connections accepted at once before -accept-rate applies")
+	flag.UintVar(&maxClients, "max-clients", 0, "Max number of clients connected at once, 0 for no limit")
+	flag.UintVar(&maxClientsPerIP, "max-clients-per-ip", 0, "Max number of clients connected at once from each IP address, not counting bots. 0 for no limit")
+	flag.BoolVar(&privateRooms, "private-rooms", false, `Key rooms by a hash of the IP address that changes daily, and show them as pseudonyms like "Room AmberFox-42". Addresses are never shown or logged`)
+	flag.StringVar(&roomDisplay, "room-display", roomDisplayIP, `How to show rooms for IP addresses in the room header and admin page: the "ip" address, a "name" like "Room AmberFox-42", or a "name-subnet" with the /24 or /48 subnet`)
+	flag.StringVar(&roomNetwork, "room-network", roomNetworkOff, `Show which network rooms for IP addresses are for, under the room name and on the admin page: "off", the "rdns" reverse DNS name, or the "asn" organization from -asn-db`)
+	flag.StringVar(&asnDBPath, "asn-db", "", "MaxMind GeoLite2 ASN database file, for -room-network asn")
+	flag.BoolVar(&invitesFlag, "invites", true, "Let people send /invite for a link that lets someone on another network join their room as a guest for a while. It can be turned off from the admin page too")
+	flag.StringVar(&nearbyPolicy, "nearby", nearbyOff, `Let rooms show themselves to nearby rooms with /nearby: "off", rooms in the same /16 "subnet", or the same "city" in -geoip-db too`)
+	flag.BoolVar(&lanMode, "lan-mode", false, `Serve a single network, like a venue or a hotspot: everyone is in one room unless the config file gives their subnet one, the rooms are listed at /lan, and captive portal checks open it. It turns off -invites and -idle-after unless they're given`)
+	flag.BoolVar(&namedRooms, "named-rooms", true, "Let people join named rooms at /room/<name>, from any network")
+	flag.DurationVar(&idleAfter, "idle-after", 5*time.Minute, "How long people can go without sending a message or focusing the chat before they're shown as idle, 0 to only go by focus")
+	flag.StringVar(&tripcodeKey, "tripcode-key", "", "Secret key for tripcodes in nicknames like name#secret. The admin key is used if not set")
+	flag.BoolVar(&publicStatsFlag, "public-stats", false, "Serve totals for the whole server at /stats as JSON, like the number of rooms and people, for a counter on a landing page")
+	flag.BoolVar(&readReceipts, "read-receipts", false, `Show how many people have seen the latest message, as "Seen by N"`)
+	flag.BoolVar(&e2eeEnabled, "e2ee", false, "Relay end-to-end encrypted messages, which the server can't read, filter, or show to moderators")
+	// "neartalk vapid-keys" makes a key for Web Push, see webpush.go
+	if len(os.Args) == 2 && os.Args[1] == "vapid-keys" {
+		if err := runVAPIDKeys(os.Stdout); err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		return
+	}
+	// "neartalk doctor [flags]" checks the setup instead of starting, see doctor.go
+	args := os.Args[1:]
+	doctor := len(args) > 0 && args[0] == "doctor"
+	if doctor {
+		args = args[1:]
+	}
+	flag.CommandLine.Parse(args)
+	applyLANModeDefaults(flag.CommandLine)
 
 	if versionFlag {
 		fmt.Print(versionInfo)
 		return
 	}
-	if adminKey == "" {
+	if doctor {
+		os.Exit(runDoctor(os.Stdout))
+	}
+	if adminKey == "" && adminKeysFile == "" {
 		fmt.Println("No admin key set! Use -help for details.")
 		return
 	}
+	if adminKeysFile != "" {
+		if _, err := readAdminKeysFile(adminKeysFile); err != nil {
+			fmt.Println(err)
+			return
+		}
+	}
+	if _, err := readConfigFile(configPath); err != nil {
+		fmt.Println(err)
+		return
+	}
+	if err := validateRoomPolicy(); err != nil {
+		fmt.Println(err)
+		return
+	}
+	if err := validateRoomLifecycle(); err != nil {
+		fmt.Println(err)
+		return
+	}
+	if err := validateRoomDisplay(); err != nil {
+		fmt.Println(err)
+		return
+	}
+	if err := validateHistory(); err != nil {
+		fmt.Println(err)
+		return
+	}
+	if err := validateRoomNetwork(); err != nil {
+		fmt.Println(err)
+		return
+	}
+	if err := validateNearby(); err != nil {
+		fmt.Println(err)
+		return
+	}
+	if err := validateLANMode(); err != nil {
+		fmt.Println(err)
+		return
+	}
+	if err := validateWidgetOrigins(); err != nil {
+		fmt.Println(err)
+		return
+	}
+	if err := validateOrigins("-allowed-origins", allowedOrigins); err != nil {
+		fmt.Println(err)
+		return
+	}
+	if err := validateOrigins("-frame-ancestors", frameAncestors); err != nil {
+		fmt.Println(err)
+		return
+	}
+	var err error
+	if chaos, err = parseChaos(chaosFlag); err != nil {
+		fmt.Println(err)
+		return
+	}
+	if chaos.enabled() {
+		log.Printf("chaos mode is enabled (%v), clients will have a bad connection", chaos)
+	}
 
-	err := run()
+	err = run()
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -48,14 +254,77 @@ func main() {
 func run() error {
 	rand.Seed(time.Now().UnixNano())
 
-	l, err := net.Listen("tcp", net.JoinHostPort(host, strconv.FormatUint(uint64(port), 10)))
+	if err := loadTemplates(templatesDir); err != nil {
+		return err
+	}
+	if err := loadBots(botsFile); err != nil {
+		return fmt.Errorf("loading bots: %w", err)
+	}
+	if err := loadGeoIP(geoIPDB); err != nil {
+		return fmt.Errorf("loading GeoIP database: %w", err)
+	}
+	if err := loadASN(asnDBPath); err != nil {
+		return fmt.Errorf("loading ASN database: %w", err)
+	}
+
+	l, err := listen()
 	if err != nil {
 		return err
 	}
-	log.Printf("listening on http://%v", l.Addr())
+	log.Printf("listening on %s", listenDescription(l))
+
+	settings, err := newSettingsStore(settingsFile)
+	if err != nil {
+		return fmt.Errorf("loading settings: %w", err)
+	}
+
+	store, err := openStorage(storageDSN)
+	if err != nil {
+		return fmt.Errorf("opening storage: %w", err)
+	}
+	defer store.close()
+	audit, err := openAuditLog(store)
+	if err != nil {
+		return fmt.Errorf("opening audit log: %w", err)
+	}
 
 	// Create and run HTTP server
-	cs := newChatServer()
+	cs := newChatServer(settings)
+	cs.audit = audit
+	cs.store = store
+	if cs.bans, err = newBanList(store); err != nil {
+		return fmt.Errorf("loading bans: %w", err)
+	}
+	var roomStore storage
+	if keepsRoomSettings() {
+		roomStore = store
+	}
+	if cs.roomSettings, err = newRoomSettingsStore(roomStore); err != nil {
+		return fmt.Errorf("loading room settings: %w", err)
+	}
+	if err := cs.loadConfig(); err != nil {
+		return fmt.Errorf("loading config: %w", err)
+	}
+	if redisURL != "" {
+		rb, err := newRedisBus(redisURL)
+		if err != nil {
+			return fmt.Errorf("connecting to Redis: %w", err)
+		}
+		defer rb.close()
+		cs.bus = rb
+	}
+	if reportInterval > 0 {
+		go cs.runReportDigests(reportInterval, int(reportThreshold))
+	}
+	if roomWebhookURL != "" {
+		cs.roomHooks = append(cs.roomHooks, newRoomWebhook(roomWebhookURL).hook)
+	}
+	if roomExpiry > 0 {
+		go cs.runRoomExpiry()
+	}
+	if retention > 0 {
+		go cs.runRetention()
+	}
 	s := &http.Server{
 		Handler:      cs,
 		ReadTimeout:  time.Second * 10,
@@ -66,18 +335,42 @@ func run() error {
 		errc <- s.Serve(l)
 	}()
 
-	// Wait for server error or process signals (like Ctrl-C)
+	// Wait for server error or process signals (like Ctrl-C), reloading the
+	// config on SIGHUP
 	sigs := make(chan os.Signal, 1)
 	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
-	select {
-	case err := <-errc:
-		log.Printf("failed to serve: %v", err)
-	case sig := <-sigs:
-		log.Printf("terminating: %v", sig)
+	hups := make(chan os.Signal, 1)
+	signal.Notify(hups, syscall.SIGHUP)
+wait:
+	for {
+		select {
+		case err := <-errc:
+			log.Printf("failed to serve: %v", err)
+			break wait
+		case sig := <-sigs:
+			log.Printf("terminating: %v", sig)
+			break wait
+		case <-hups:
+			cs.reloadConfig()
+		}
 	}
 
-	// Gracefully shut down HTTP server with 5 second timeout
+	// Gracefully shut down HTTP server with 5 second timeout. Shutdown doesn't
+	// wait for websockets, so then the rooms are closed, telling everyone, and
+	// their connections are given the rest of the time to end
 	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
 	defer cancel()
-	return s.Shutdown(ctx)
+	err = s.Shutdown(ctx)
+	cs.closeRooms()
+	if waitErr := cs.conns.wait(ctx); waitErr != nil {
+		log.Printf("waiting for clients to disconnect: %v", waitErr)
+	}
+
+	if saveErr := settings.save(); saveErr != nil {
+		log.Printf("saving settings: %v", saveErr)
+	}
+	if saveErr := cs.roomSettings.save(); saveErr != nil {
+		log.Printf("saving room settings: %v", saveErr)
+	}
+	return err
 }
@@ -0,0 +1,477 @@
+package main
+
+// This file bridges rooms to Matrix rooms. Each bridge listed under
+// "matrix_bridges" in the config file logs in to a homeserver as a regular
+// Matrix user with an access token, joins the Matrix room, and mirrors it
+// with the NearTalk room:
+//
+//	"matrix_bridges": [{"room": "203.0.113.5", "homeserver": "https://matrix.org",
+//	    "access_token": "syt_...", "matrix_room": "#example:matrix.org"}]
+//
+// Chat messages from the room are sent to Matrix as "<nick> text", and
+// people joining and leaving the room are sent as notices. Messages from
+// Matrix show up in the room from "matrix/name", where the name is the
+// sender's display name in the Matrix room, or the local part of their user
+// ID if they don't have one. Matrix users joining and leaving are shown as
+// notices in the room.
+//
+// Notices from Matrix aren't relayed, since they're usually from bots, and
+// neither are edits, reactions, or files. Like IRC bridges, see irc.go,
+// messages are dropped while nobody's on the other side to see them, bridges
+// follow the config file when it's reloaded, and with Redis only messages
+// sent through the instance running the bridge reach Matrix.
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// matrixNickPrefix is added to the nicknames of people on Matrix in the
+	// room.
+	matrixNickPrefix = bridgeMatrix + "/"
+	// matrixSyncTimeout is how long the homeserver can hold a sync request
+	// open waiting for events.
+	matrixSyncTimeout = 30 * time.Second
+	// matrixRequestTimeout is how long other requests to the homeserver can
+	// take.
+	matrixRequestTimeout = 30 * time.Second
+	// matrixMaxBackoff is the longest wait between retrying after an error.
+	matrixMaxBackoff = 5 * time.Minute
+	// matrixQueue is how many messages can wait to be sent to Matrix.
+	matrixQueue = 100
+)
+
+// configMatrixBridge is a bridge in the config file.
+type configMatrixBridge struct {
+	// Room is the key of the room, like an IP address or "#name" for a named
+	// room.
+	Room string `json:"room"`
+	// Homeserver is the URL of the bridge user's homeserver.
+	Homeserver  string `json:"homeserver"`
+	AccessToken string `json:"access_token"`
+	// MatrixRoom is the ID or alias of the Matrix room, like
+	// "!abc:matrix.org" or "#example:matrix.org".
+	MatrixRoom string `json:"matrix_room"`
+}
+
+// validateMatrixBridges returns an error if a bridge in the config file is
+// invalid.
+func validateMatrixBridges(cbs []configMatrixBridge) error {
+	rooms := make(map[string]bool)
+	for i, cb := range cbs {
+		if cb.Room == "" {
+			return fmt.Errorf("matrix bridge %d: room is missing", i+1)
+		}
+		if rooms[cb.Room] {
+			return fmt.Errorf("matrix bridge %d: room %s is already bridged", i+1, cb.Room)
+		}
+		rooms[cb.Room] = true
+		u, err := url.Parse(cb.Homeserver)
+		if err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+			return fmt.Errorf("matrix bridge %d: homeserver must be a URL like https://matrix.org", i+1)
+		}
+		if cb.AccessToken == "" {
+			return fmt.Errorf("matrix bridge %d: access_token is missing", i+1)
+		}
+		if !strings.HasPrefix(cb.MatrixRoom, "!") && !strings.HasPrefix(cb.MatrixRoom, "#") {
+			return fmt.Errorf("matrix bridge %d: matrix_room must be a room ID or alias, like #example:matrix.org", i+1)
+		}
+	}
+	return nil
+}
+
+// matrixBridges holds the running bridges.
+type matrixBridges struct {
+	cs      *chatServer
+	mu      sync.Mutex
+	bridges map[configMatrixBridge]*matrixBridge
+}
+
+func newMatrixBridges(cs *chatServer) *matrixBridges {
+	return &matrixBridges{cs: cs, bridges: make(map[configMatrixBridge]*matrixBridge)}
+}
+
+// setConfigured starts the bridges from the config file that aren't running
+// yet, and stops the ones that aren't in it anymore.
+// It holds the mutex.
+func (mb *matrixBridges) setConfigured(cbs []configMatrixBridge) {
+	mb.mu.Lock()
+	defer mb.mu.Unlock()
+	keep := make(map[configMatrixBridge]bool)
+	for _, cb := range cbs {
+		keep[cb] = true
+		if _, ok := mb.bridges[cb]; !ok {
+			b := newMatrixBridge(mb.cs, cb)
+			mb.bridges[cb] = b
+			go b.run()
+		}
+	}
+	for cb, b := range mb.bridges {
+		if !keep[cb] {
+			b.stop()
+			delete(mb.bridges, cb)
+		}
+	}
+}
+
+// relay passes the chat message in the room with the key on to Matrix, if
+// the room is bridged.
+// It holds the mutex.
+func (mb *matrixBridges) relay(key string, a *chatAlert) {
+	mb.relayEvent(key, "m.text", "<"+plainNick(a.Nick)+"> "+a.Text)
+}
+
+// relayNotice passes a notice about the room with the key, like someone
+// joining, on to Matrix, if the room is bridged.
+// It holds the mutex.
+func (mb *matrixBridges) relayNotice(key, text string) {
+	mb.relayEvent(key, "m.notice", text)
+}
+
+// relayEvent sends a message of the msgtype to the Matrix room the room with
+// the key is bridged to.
+// It holds the mutex.
+func (mb *matrixBridges) relayEvent(key, msgtype, body string) {
+	mb.mu.Lock()
+	defer mb.mu.Unlock()
+	for cb, b := range mb.bridges {
+		if cb.Room == key {
+			b.send(matrixMessage{MsgType: msgtype, Body: body})
+		}
+	}
+}
+
+// matrixMessage is the content of an m.room.message event.
+type matrixMessage struct {
+	MsgType string `json:"msgtype"`
+	Body    string `json:"body"`
+	// RelatesTo is set for replies and edits.
+	RelatesTo *struct {
+		RelType   string    `json:"rel_type,omitempty"`
+		InReplyTo *struct{} `json:"m.in_reply_to,omitempty"`
+	} `json:"m.relates_to,omitempty"`
+}
+
+// matrixEvent is an event from the sync API, with the parts that are used.
+type matrixEvent struct {
+	Type     string          `json:"type"`
+	Sender   string          `json:"sender"`
+	StateKey *string         `json:"state_key"`
+	Content  json.RawMessage `json:"content"`
+	Unsigned struct {
+		PrevContent *matrixMember `json:"prev_content"`
+	} `json:"unsigned"`
+}
+
+// matrixMember is the content of an m.room.member event.
+type matrixMember struct {
+	Membership  string `json:"membership"`
+	DisplayName string `json:"displayname"`
+}
+
+// matrixSync is a response from the sync API, with the parts that are used.
+type matrixSync struct {
+	NextBatch string `json:"next_batch"`
+	Rooms     struct {
+		Join map[string]struct {
+			State struct {
+				Events []matrixEvent `json:"events"`
+			} `json:"state"`
+			Timeline struct {
+				Events []matrixEvent `json:"events"`
+			} `json:"timeline"`
+		} `json:"join"`
+	} `json:"rooms"`
+}
+
+// matrixOutgoing is a message waiting to be sent to a Matrix room.
+type matrixOutgoing struct {
+	roomID string
+	msg    matrixMessage
+}
+
+// matrixBridge is the connection to Matrix for one bridged room.
+type matrixBridge struct {
+	cs     *chatServer
+	cfg    configMatrixBridge
+	client *http.Client
+	// out holds the messages waiting to be sent to Matrix.
+	out chan matrixOutgoing
+	// roomID is the ID of the Matrix room while the bridge is in it, or
+	// empty.
+	roomID atomic.Value
+
+	// userID is the bridge's own user ID. It's only used by the sync
+	// goroutine.
+	userID string
+	// names holds the display names of the people in the Matrix room, by
+	// user ID. It's only used by the sync goroutine.
+	names map[string]string
+	// txn counts the messages sent, for their transaction IDs. It's only
+	// used by the send goroutine.
+	txn int
+
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+func newMatrixBridge(cs *chatServer, cfg configMatrixBridge) *matrixBridge {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &matrixBridge{
+		cs:     cs,
+		cfg:    cfg,
+		client: &http.Client{Timeout: matrixSyncTimeout + matrixRequestTimeout},
+		out:    make(chan matrixOutgoing, matrixQueue),
+		names:  make(map[string]string),
+		ctx:    ctx,
+		cancel: cancel,
+	}
+}
+
+// stop disconnects the bridge for good.
+func (b *matrixBridge) stop() {
+	b.cancel()
+}
+
+// run joins the Matrix room and syncs with it, starting over whenever there's
+// an error, until the bridge is stopped.
+func (b *matrixBridge) run() {
+	go b.sendLoop()
+	backoff := time.Second
+	for {
+		start := time.Now()
+		err := b.session()
+		if b.ctx.Err() != nil {
+			return
+		}
+		if time.Since(start) > matrixMaxBackoff {
+			// It was working for a while
+			backoff = time.Second
+		}
+		log.Printf("matrixBridge: %s: %v, retrying in %v", b.cfg.MatrixRoom, err, backoff)
+		select {
+		case <-b.ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+		if backoff *= 2; backoff > matrixMaxBackoff {
+			backoff = matrixMaxBackoff
+		}
+	}
+}
+
+// session joins the Matrix room and relays its messages until there's an
+// error.
+func (b *matrixBridge) session() error {
+	defer b.roomID.Store("")
+	var whoami struct {
+		UserID string `json:"user_id"`
+	}
+	if err := b.request(http.MethodGet, "/account/whoami", nil, &whoami); err != nil {
+		return err
+	}
+	b.userID = whoami.UserID
+	var join struct {
+		RoomID string `json:"room_id"`
+	}
+	if err := b.request(http.MethodPost, "/join/"+url.PathEscape(b.cfg.MatrixRoom), struct{}{}, &join); err != nil {
+		return err
+	}
+	filter, _ := json.Marshal(map[string]interface{}{
+		"room": map[string]interface{}{
+			"rooms":    []string{join.RoomID},
+			"timeline": map[string]int{"limit": 50},
+		},
+		"presence":     map[string][]string{"types": {}},
+		"account_data": map[string][]string{"types": {}},
+	})
+	since := ""
+	for {
+		q := url.Values{"filter": {string(filter)}}
+		if since != "" {
+			q.Set("since", since)
+			q.Set("timeout", fmt.Sprint(matrixSyncTimeout.Milliseconds()))
+		}
+		var s matrixSync
+		if err := b.request(http.MethodGet, "/sync?"+q.Encode(), nil, &s); err != nil {
+			return err
+		}
+		room := s.Rooms.Join[join.RoomID]
+		for _, e := range room.State.Events {
+			b.handleEvent(e, false)
+		}
+		for _, e := range room.Timeline.Events {
+			// The first sync has the room's history, which isn't relayed
+			b.handleEvent(e, since != "")
+		}
+		since = s.NextBatch
+		b.roomID.Store(join.RoomID)
+	}
+}
+
+// handleEvent handles an event in the Matrix room. It only remembers display
+// names, unless relay is true.
+func (b *matrixBridge) handleEvent(e matrixEvent, relay bool) {
+	switch e.Type {
+	case "m.room.member":
+		var m matrixMember
+		if e.StateKey == nil || json.Unmarshal(e.Content, &m) != nil {
+			return
+		}
+		user := *e.StateKey
+		wasIn := e.Unsigned.PrevContent != nil && e.Unsigned.PrevContent.Membership == "join"
+		if m.Membership == "join" {
+			b.names[user] = m.DisplayName
+		}
+		name := b.nick(user)
+		if m.Membership != "join" {
+			delete(b.names, user)
+		}
+		if !relay || user == b.userID {
+			return
+		}
+		switch {
+		case m.Membership == "join" && !wasIn:
+			b.cs.deliverBridged(b.cfg.Room, bridgeNotice(bridgeMatrix, fmt.Sprintf("%s joined on Matrix", name)))
+		case m.Membership != "join" && wasIn:
+			b.cs.deliverBridged(b.cfg.Room, bridgeNotice(bridgeMatrix, fmt.Sprintf("%s left on Matrix", name)))
+		}
+	case "m.room.message":
+		var m matrixMessage
+		if !relay || e.Sender == b.userID || json.Unmarshal(e.Content, &m) != nil {
+			return
+		}
+		if m.RelatesTo != nil && m.RelatesTo.RelType == "m.replace" {
+			// Edits
+			return
+		}
+		text := m.Body
+		if m.RelatesTo != nil && m.RelatesTo.InReplyTo != nil {
+			text = stripMatrixReplyFallback(text)
+		}
+		switch m.MsgType {
+		case "m.text":
+		case "m.emote":
+			text = "_" + text + "_"
+		default:
+			return
+		}
+		if text = strings.TrimSpace(text); text == "" {
+			return
+		}
+		b.cs.deliverBridged(b.cfg.Room, msg{
+			nick: sanitizeNick(matrixNickPrefix + b.nick(e.Sender)), text: text, when: time.Now(), bridge: bridgeMatrix,
+		})
+	}
+}
+
+// nick returns the name the user is shown with: their display name, or the
+// local part of their user ID if they don't have one.
+func (b *matrixBridge) nick(user string) string {
+	if name := b.names[user]; name != "" {
+		return name
+	}
+	local, _, _ := strings.Cut(strings.TrimPrefix(user, "@"), ":")
+	return local
+}
+
+// stripMatrixReplyFallback removes the quote of the message being replied to
+// from the start of a reply, which is there for clients that don't show
+// replies.
+func stripMatrixReplyFallback(text string) string {
+	lines := strings.Split(text, "\n")
+	i := 0
+	for i < len(lines) && strings.HasPrefix(lines[i], ">") {
+		i++
+	}
+	return strings.Join(lines[i:], "\n")
+}
+
+// send queues the message to be sent to Matrix. It's dropped if the bridge
+// isn't in the Matrix room or is too far behind.
+func (b *matrixBridge) send(m matrixMessage) {
+	roomID, _ := b.roomID.Load().(string)
+	if roomID == "" {
+		return
+	}
+	select {
+	case b.out <- matrixOutgoing{roomID: roomID, msg: m}:
+	default:
+		log.Printf("matrixBridge: %s is too far behind, dropping a message", b.cfg.MatrixRoom)
+	}
+}
+
+// sendLoop sends the waiting messages to Matrix, until the bridge is
+// stopped. Messages that can't be sent are dropped.
+func (b *matrixBridge) sendLoop() {
+	start := time.Now().UnixNano()
+	for {
+		select {
+		case <-b.ctx.Done():
+			return
+		case o := <-b.out:
+			b.txn++
+			path := fmt.Sprintf("/rooms/%s/send/m.room.message/neartalk-%d-%d", url.PathEscape(o.roomID), start, b.txn)
+			if err := b.request(http.MethodPut, path, o.msg, nil); err != nil {
+				log.Printf("matrixBridge: %s: sending a message: %v", b.cfg.MatrixRoom, err)
+			}
+		}
+	}
+}
+
+// request makes a request to the client-server API, sending body as JSON if
+// it isn't nil, and decoding the response into v if it isn't nil.
+func (b *matrixBridge) request(method, path string, body, v interface{}) error {
+	var r io.Reader
+	if body != nil {
+		j, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		r = bytes.NewReader(j)
+	}
+	req, err := http.NewRequestWithContext(b.ctx, method,
+		strings.TrimSuffix(b.cfg.Homeserver, "/")+"/_matrix/client/v3"+path, r)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+b.cfg.AccessToken)
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	resp, err := b.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		var e struct {
+			ErrCode string `json:"errcode"`
+			Error   string `json:"error"`
+		}
+		json.NewDecoder(io.LimitReader(resp.Body, 4096)).Decode(&e)
+		if e.ErrCode != "" {
+			return fmt.Errorf("%s %s: %s: %s", method, strings.SplitN(path, "?", 2)[0], e.ErrCode, e.Error)
+		}
+		return fmt.Errorf("%s %s: %s", method, strings.SplitN(path, "?", 2)[0], resp.Status)
+	}
+	if v == nil {
+		return nil
+	}
+	if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+		return errors.New("invalid response from the homeserver")
+	}
+	return nil
+}
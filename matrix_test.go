@@ -0,0 +1,40 @@
+package main
+
+import "testing"
+
+func TestStripMatrixReplyFallback(t *testing.T) {
+	tests := []struct{ in, want string }{
+		{"> <@bob:example.org> the quote\n> more of it\n\nthe reply", "\nthe reply"},
+		{"no quote", "no quote"},
+		{"first line\n> not a fallback", "first line\n> not a fallback"},
+	}
+	for _, tt := range tests {
+		if got := stripMatrixReplyFallback(tt.in); got != tt.want {
+			t.Errorf("stripMatrixReplyFallback(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestValidateMatrixBridges(t *testing.T) {
+	valid := configMatrixBridge{Room: "lan", Homeserver: "https://matrix.example.org", AccessToken: "token", MatrixRoom: "#test:example.org"}
+	if err := validateMatrixBridges([]configMatrixBridge{valid}); err != nil {
+		t.Fatal(err)
+	}
+	bad := []func(*configMatrixBridge){
+		func(cb *configMatrixBridge) { cb.Room = "" },
+		func(cb *configMatrixBridge) { cb.Homeserver = "matrix.example.org" },
+		func(cb *configMatrixBridge) { cb.Homeserver = "ftp://matrix.example.org" },
+		func(cb *configMatrixBridge) { cb.AccessToken = "" },
+		func(cb *configMatrixBridge) { cb.MatrixRoom = "test" },
+	}
+	for i, change := range bad {
+		cb := valid
+		change(&cb)
+		if err := validateMatrixBridges([]configMatrixBridge{cb}); err == nil {
+			t.Errorf("bad bridge %d was accepted", i)
+		}
+	}
+	if err := validateMatrixBridges([]configMatrixBridge{valid, valid}); err == nil {
+		t.Error("bridging a room twice was accepted")
+	}
+}
@@ -0,0 +1,162 @@
+package main
+
+// This file changes who's in a room. Clients joining and leaving are handed
+// to the room's goroutine, which is the only place the clients in a room and
+// their nicknames are changed, in order with the messages it handles. So the
+// user lists sent with joins, leaves and nickname changes are always made
+// from the room as it is right then, and can't be undone by a change that
+// was queued before them. Other goroutines can still read the room while
+// holding the clientsMu.
+
+import (
+	"fmt"
+	"html/template"
+	"time"
+
+	"github.com/makeworld-the-better-one/neartalk/events"
+)
+
+// memberChange is a client joining or leaving a room, see chatRoom.members.
+type memberChange struct {
+	c    *client
+	join bool
+	// done is closed once the client has been added or removed.
+	done chan struct{}
+}
+
+// addClient adds a client to the chat room, and returns once it's in it.
+// See join.
+// The chatServer addClient method should be used by clients instead.
+func (cr *chatRoom) addClient(c *client) {
+	cr.changeMembers(c, true)
+}
+
+// removeClient removes a client from the chat room, and returns once it's
+// gone. See leave.
+// The chatServer removeClient method should be used by clients instead.
+func (cr *chatRoom) removeClient(c *client) {
+	cr.changeMembers(c, false)
+}
+
+// changeMembers hands the client joining or leaving to the room's goroutine,
+// and waits for it to be added or removed. Nothing changes if the room has
+// closed. It must not be called by the room's goroutine, or while holding
+// the clientsMu.
+func (cr *chatRoom) changeMembers(c *client, join bool) {
+	done := make(chan struct{})
+	select {
+	case cr.members <- memberChange{c: c, join: join, done: done}:
+		<-done
+	case <-cr.closed:
+	}
+}
+
+// handleMemberChange adds or removes the client, then tells the room. It's
+// only called by the room's goroutine.
+func (cr *chatRoom) handleMemberChange(mc memberChange) {
+	var b broadcast
+	if mc.join {
+		b = cr.join(mc.c)
+	} else {
+		b = cr.leave(mc.c)
+	}
+	// The client is in the room, so it can start sending messages, which are
+	// handled after the broadcast is sent
+	close(mc.done)
+	if mc.join {
+		// Loaded once nothing waits on the join, like chatServer.addClient
+		// holding the roomsMu, so a slow storage only holds up this room
+		sendHistory(mc.c, cr.loadHistory())
+	}
+	if !b.empty() {
+		cr.publish(b, nil)
+	}
+}
+
+// join adds the client to the room, giving them a nickname, either the last
+// one they set in their session, or a generated one. The client is told which
+// room it's in, and the broadcast announcing it is returned. The history is
+// sent after, see handleMemberChange. Another tab of someone already in the room isn't announced, see
+// addTab.
+// It holds the client mutex.
+func (cr *chatRoom) join(c *client) broadcast {
+	cr.clientsMu.Lock()
+	defer cr.clientsMu.Unlock()
+
+	if tab := cr.otherTab(c); tab != nil {
+		cr.addTab(c, tab)
+		cr.sendRoomInfo(c)
+		cr.sendUserList(c)
+		cr.subroomsChanged()
+		return broadcast{}
+	}
+
+	if c.bot != nil {
+		c.nick = c.bot.nick
+	} else if nick := cr.server.settings.get(c.session).Nick; nick != "" && !cr.nickInUse(nick) {
+		c.nick = nick
+	} else {
+		c.nick = cr.getNewNick()
+	}
+	c.moderator = cr.moderators[c.session]
+	c.guest = cr.guests[c.session]
+	cr.clients[c] = struct{}{}
+	cr.stats.recordUsers(time.Now(), len(cr.clients))
+	cr.sendRoomInfo(c)
+	cr.server.relayMemberChange(cr.key, c.nick, true)
+	cr.subroomsChanged()
+	return rawBroadcast(createJoinMsg(c, cr.users()))
+}
+
+// leave removes the client from the room, and returns the broadcast telling
+// everyone left. Nobody is told if another tab of theirs is still in the
+// room.
+// It holds the client mutex.
+func (cr *chatRoom) leave(c *client) broadcast {
+	cr.clientsMu.Lock()
+	defer cr.clientsMu.Unlock()
+
+	if _, ok := cr.clients[c]; !ok {
+		// Already removed, like when the room was closed
+		return broadcast{}
+	}
+	delete(cr.clients, c)
+	cr.stats.recordUsers(time.Now(), len(cr.clients))
+	if cr.otherTab(c) != nil {
+		return broadcast{}
+	}
+	cr.server.relayMemberChange(cr.key, c.nick, false)
+	cr.subroomsChanged()
+	if len(cr.clients) == 0 {
+		return broadcast{}
+	}
+	return rawBroadcast(createLeaveMsg(c, cr.users()))
+}
+
+// sendRoomInfo tells a client that just joined the name of the room, its
+// nickname, the topic and the network, followed by the message of the day.
+// It does not lock the clientsMu, callers should do that.
+func (cr *chatRoom) sendRoomInfo(c *client) {
+	if c.isJSON() {
+		c.sendEvent(events.TypeRoom, events.Room{Name: roomTitle(cr.key), Nick: c.nick, Topic: cr.topic, Network: cr.network})
+	} else {
+		s := fmt.Sprintf(`<h2 id="ip-addr">%s</h2>`, template.HTMLEscapeString(roomTitle(cr.key))) +
+			createTopicMsg(cr.topic) + createNetworkMsg(cr.network)
+		if historyLen > 0 {
+			s += searchBox
+		}
+		c.sendText(s)
+	}
+	cr.server.sendMOTD(c)
+}
+
+// sendUserList sends the user list to just the client.
+// It does not lock the clientsMu, callers should do that.
+func (cr *chatRoom) sendUserList(c *client) {
+	users := cr.users()
+	if c.isJSON() {
+		c.sendFrame(createUserListEvent(users))
+	} else {
+		c.sendFrame(createUserListMsg(users))
+	}
+}
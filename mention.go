@@ -0,0 +1,132 @@
+package main
+
+// This file handles @mentions. When a message has "@" followed by the
+// nickname of someone in the room, the mention is shown as a highlighted span,
+// which stands out more for the person mentioned than for everyone else. The
+// mentioned person is also alerted, depending on their notification
+// preferences, see notifyprefs.go.
+
+import (
+	"html/template"
+	"regexp"
+	"sort"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/makeworld-the-better-one/neartalk/events"
+)
+
+// mentionSpan is the HTML a mention of the nickname is rendered as. The nick
+// is sanitized.
+func mentionSpan(nick string) string {
+	return `<bdi class="mention">@` + nick + `</bdi>`
+}
+
+// highlightMentions highlights the mentions of the nickname in the rendered
+// message HTML, for the person with that nickname. The nick is sanitized.
+// Users can't write HTML, so the only mention spans are the ones added by
+// formatMentions.
+func highlightMentions(s, nick string) string {
+	return strings.ReplaceAll(s, mentionSpan(nick), `<bdi class="mention mention-me">@`+nick+`</bdi>`)
+}
+
+// mentionLocs returns where each mention of the nicknames is in the HTML
+// escaped text, and which nickname it mentions. A mention is "@" followed by
+// the nickname, ignoring case, without a letter or digit right before or
+// after it. The nicks are sanitized.
+func mentionLocs(text string, nicks []string) (locs [][2]int, mentioned []string) {
+	if len(nicks) == 0 || !strings.Contains(text, "@") {
+		return nil, nil
+	}
+	// Longest first, so "@bobby" isn't taken as "@bob"
+	sorted := append([]string(nil), nicks...)
+	sort.Slice(sorted, func(i, j int) bool { return len(sorted[i]) > len(sorted[j]) })
+	byLower := make(map[string]string, len(sorted))
+	quoted := make([]string, len(sorted))
+	for i, nick := range sorted {
+		byLower[strings.ToLower(nick)] = nick
+		quoted[i] = regexp.QuoteMeta(nick)
+	}
+	re := regexp.MustCompile(`(?i)@(` + strings.Join(quoted, "|") + `)`)
+
+	for _, idx := range re.FindAllStringSubmatchIndex(text, -1) {
+		before, _ := utf8.DecodeLastRuneInString(text[:idx[0]])
+		after, _ := utf8.DecodeRuneInString(text[idx[1]:])
+		if isMentionBoundary(before) || isMentionBoundary(after) {
+			continue
+		}
+		locs = append(locs, [2]int{idx[0], idx[1]})
+		mentioned = append(mentioned, byLower[strings.ToLower(text[idx[2]:idx[3]])])
+	}
+	return locs, mentioned
+}
+
+// isMentionBoundary returns true if the rune touching a mention means it's
+// not one, like the "a" in "a@example.com".
+func isMentionBoundary(r rune) bool {
+	return r != utf8.RuneError && (unicode.IsLetter(r) || unicode.IsDigit(r) || r == '_')
+}
+
+// findMentions returns the sanitized nicknames mentioned in the message text,
+// without duplicates, from the sanitized nicknames given.
+func findMentions(text string, nicks []string) []string {
+	_, mentioned := mentionLocs(template.HTMLEscapeString(text), nicks)
+	var unique []string
+	for _, nick := range mentioned {
+		if !containsNick(unique, nick) {
+			unique = append(unique, nick)
+		}
+	}
+	return unique
+}
+
+// containsNick returns true if the nickname is in the list.
+func containsNick(nicks []string, nick string) bool {
+	for _, n := range nicks {
+		if n == nick {
+			return true
+		}
+	}
+	return false
+}
+
+// formatMentions turns mentions of the sanitized nicknames in HTML escaped
+// text into mention spans. The text in between is passed to other, and the
+// results are joined.
+func formatMentions(text string, nicks []string, other func(string) string) string {
+	locs, mentioned := mentionLocs(text, nicks)
+	if len(locs) == 0 {
+		return other(text)
+	}
+	var b strings.Builder
+	last := 0
+	for i, loc := range locs {
+		b.WriteString(other(text[last:loc[0]]))
+		b.WriteString(mentionSpan(mentioned[i]))
+		last = loc[1]
+	}
+	b.WriteString(other(text[last:]))
+	return b.String()
+}
+
+// roomNicks returns the sanitized nicknames of everyone in the room.
+// It does not lock the clientsMu, callers should do that.
+func (cr *chatRoom) roomNicks() []string {
+	users := cr.users()
+	nicks := make([]string, len(users))
+	for i, u := range users {
+		nicks[i] = u.nick
+	}
+	return nicks
+}
+
+// createMentionEvent creates the mention event for JSON clients.
+func createMentionEvent(a *chatAlert) string {
+	return encodeEvent(events.TypeMention, events.Mention{
+		ID:   a.ID,
+		Nick: plainNick(a.Nick),
+		Text: a.Text,
+		Time: a.Time,
+	})
+}
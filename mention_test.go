@@ -0,0 +1,44 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestFindMentions(t *testing.T) {
+	nicks := []string{"bob", "bobby", "Ann Lee", "a&amp;b"}
+	tests := []struct {
+		text string
+		want []string
+	}{
+		{"hi @bob", []string{"bob"}},
+		{"@BOBBY and @bob and @bob", []string{"bobby", "bob"}},
+		{"hey @Ann Lee!", []string{"Ann Lee"}},
+		{"@a&b, look", []string{"a&amp;b"}},
+		{"mail bob@bob.com", nil},
+		{"@bobcat", nil},
+		{"@_bob", nil},
+		{"no mentions", nil},
+	}
+	for _, tt := range tests {
+		if got := findMentions(tt.text, nicks); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("findMentions(%q) = %q, want %q", tt.text, got, tt.want)
+		}
+	}
+}
+
+func TestRenderMentions(t *testing.T) {
+	got := renderMsgText("@Bob: see https://example.com/@bob and `@bob` *@bob*", []string{"bob"})
+	want := `<bdi class="mention">@bob</bdi>: see ` +
+		`<a href="https://example.com/@bob" target="_blank" rel="noopener noreferrer">https://example.com/@bob</a> and ` +
+		`<code>@bob</code> *<bdi class="mention">@bob</bdi>*`
+	if got != want {
+		t.Errorf("renderMsgText with mentions =\n%s\nwant\n%s", got, want)
+	}
+
+	got = highlightMentions(`<bdi class="mention">@bob</bdi> <bdi class="mention">@ann</bdi>`, "bob")
+	want = `<bdi class="mention mention-me">@bob</bdi> <bdi class="mention">@ann</bdi>`
+	if got != want {
+		t.Errorf("highlightMentions = %s, want %s", got, want)
+	}
+}
@@ -10,10 +10,12 @@ package main
 import (
 	"fmt"
 	"html"
+	"html/template"
 	"regexp"
 	"strings"
 	"time"
 
+	"github.com/makeworld-the-better-one/neartalk/events"
 	"github.com/rivo/uniseg"
 	"golang.org/x/text/unicode/norm"
 )
@@ -21,6 +23,10 @@ import (
 const maxNickLen = 30
 const maxMsgTextLen = 512
 
+// maxMsgLines is the max number of lines in a message, so pasting something
+// long can't push the whole chat off the screen.
+const maxMsgLines = 20
+
 // URL Regex
 // Source:
 // John Gruber has a blog post: https://daringfireball.net/2010/07/improved_regex_for_matching_urls
@@ -34,52 +40,170 @@ const maxMsgTextLen = 512
 var urlRe = regexp.MustCompile(`(?i)\b(?:[a-z][\w.+-]+:(?:/{1,3}|[?+]?[a-z0-9%]))(?:[^\s()<>]+|\(([^\s()<>]+|(\([^\s()<>]+\)))*\))+(?:\(([^\s()<>]+|(\([^\s()<>]+\)))*\)|[^\s\x60!()\[\]{};:'".,<>?«»“”‘’])`)
 
 // Sending this through the websocket to htmx clears whatever message was
-// written in the input field. This is used to clear the field after the user
-// sends a message.
-const clearInputFieldMsg = `<input name="message" id="message-input" type="text" />`
+// written in the input field, and any message being replied to. This is used
+// to clear the field after the user sends a message.
+const clearInputFieldMsg = `<textarea name="message" id="message-input" rows="1"></textarea>` +
+	`<input name="reply_to" id="reply-to-input" type="hidden" />` +
+	`<p id="reply-indicator"></p>`
+
+// createClearLogMsg creates the htmx swap that empties the message log, and
+// the "Seen by" indicator with it.
+func createClearLogMsg() string {
+	return `<tbody id="message-table-tbody" hx-swap-oob="true"></tbody>` + createSeenByMsg(0)
+}
+
+// quoteData is the quoted message shown above a reply.
+type quoteData struct {
+	ID   string
+	Nick template.HTML
+	Text template.HTML
+}
+
+// chatMsgData is the data for the message.html template.
+type chatMsgData struct {
+	ID    string
+	Time  string
+	Nick  template.HTML
+	Text  template.HTML
+	Quote *quoteData
+	// Self is true when the message is being sent to its author.
+	Self bool
+	// Edited is true if the message was edited by the author.
+	Edited bool
+	// Deleted is true if the message was deleted by the author.
+	Deleted bool
+	// Replace is true if the message replaces an existing one in the log,
+	// instead of being appended.
+	Replace bool
+	// Bot is true if the author is a bot.
+	Bot bool
+	// History is true if the message is replayed from the room's history,
+	// see history.go.
+	History bool
+	// Look is the author's color and avatar, or nil if they have none.
+	Look *nickLook
+	// Ciphertext is set instead of Text for end-to-end encrypted messages,
+	// which the web UI decrypts. See e2ee.go.
+	Ciphertext string
+}
+
+// newChatMsgData creates template data for a message. The quoted message can
+// be nil if the message isn't a reply. The bool is false if the message text
+// is invalid.
+func newChatMsgData(m msg, quoted *recentMsg) (chatMsgData, bool) {
+	sanitizedMsgText := renderMsgText(m.text, m.mentions)
+	if !isMsgTextValid(sanitizedMsgText) {
+		return chatMsgData{}, false
+	}
+	if m.previewID != "" {
+		sanitizedMsgText += createPreviewPlaceholder(m.previewID)
+	}
+	data := chatMsgData{
+		ID:   m.id,
+		Time: m.when.UTC().Format(time.RFC3339),
+		Nick: nickHTML(m.nick), // nick is already sanitized
+		Text: template.HTML(sanitizedMsgText),
+		Bot:  m.author != nil && m.author.bot != nil,
+	}
+	if m.author != nil {
+		data.Look = m.author.look
+	}
+	if quoted != nil {
+		data.Quote = &quoteData{
+			ID:   quoted.id,
+			Nick: nickHTML(quoted.nick),
+			Text: template.HTML(quoteText(quoted.text)),
+		}
+	}
+	return data, true
+}
+
+// appendToLog wraps rendered message rows so they're added to the end of the
+// message log.
+func appendToLog(rows string) string {
+	return `<tbody id="message-table-tbody" hx-swap-oob="beforeend">` + rows + `</tbody>`
+}
+
+// prependToLog wraps rendered message rows so they're added to the start of
+// the message log.
+func prependToLog(rows string) string {
+	return `<tbody id="message-table-tbody" hx-swap-oob="afterbegin">` + rows + `</tbody>`
+}
+
+// renderChatMsg renders the message for the author and for everyone else.
+func renderChatMsg(data chatMsgData) (string, string) {
+	nonAuthor := renderTemplate("message.html", data)
+	data.Self = true
+	author := renderTemplate("message.html", data)
+	if !data.Replace {
+		return appendToLog(author), appendToLog(nonAuthor)
+	}
+	return author, nonAuthor
+}
 
 // createChatMsg takes the message from a user and returns HTML
 // that can be sent over websocket to the htmx web UI.
+// The quoted message can be nil if the message isn't a reply.
 // It returns two messages, one for the author, and one for everyone else.
 // It will return empty strings if the provided msg is considered invalid.
-func createChatMsg(m msg) (string, string) {
-	sanitizedMsgText := renderMsgText(m.text)
-	if !isMsgTextValid(sanitizedMsgText) {
+func createChatMsg(m msg, quoted *recentMsg) (string, string) {
+	data, ok := newChatMsgData(m, quoted)
+	if !ok {
 		return "", ""
 	}
-	ts := m.when.UTC().Format(time.RFC3339)
-	author := fmt.Sprintf(
-		// Add message to log
-		`<tbody id="message-table-tbody" hx-swap-oob="beforeend">
-			<tr><td>%s</td><td class="my-nick">%s</td><td class="my-msg">%s</td></tr>
-		</tbody>`,
-		ts, m.nick, sanitizedMsgText, // nick is already sanitized
-	)
-	nonAuthor := fmt.Sprintf(
-		// Add message to log
-		`<tbody id="message-table-tbody" hx-swap-oob="beforeend">
-			<tr><td>%s</td><td>%s</td><td>%s</td></tr>
-		</tbody>`,
-		ts, m.nick, sanitizedMsgText,
-	)
-	return author, nonAuthor
+	return renderChatMsg(data)
 }
 
 func isMsgTextValid(s string) bool {
 	return s != ""
 }
 
+// normalizeNewlines turns Windows and old Mac line endings into "\n".
+func normalizeNewlines(text string) string {
+	text = strings.ReplaceAll(text, "\r\n", "\n")
+	return strings.ReplaceAll(text, "\r", "\n")
+}
+
+// msgTextError returns an error message for the author if the message text
+// is too long, or an empty string if it's fine. Each newline counts as one
+// character, so the limits are the same however the text was typed.
+func msgTextError(text string) string {
+	text = strings.TrimSpace(normalizeNewlines(text))
+	if uniseg.GraphemeClusterCount(text) > maxMsgTextLen {
+		return fmt.Sprintf("That message is too long, the limit is %d characters", maxMsgTextLen)
+	}
+	if strings.Count(text, "\n")+1 > maxMsgLines {
+		return fmt.Sprintf("That message has too many lines, the limit is %d", maxMsgLines)
+	}
+	return ""
+}
+
+// breakLines turns the newlines in HTML escaped text into line breaks.
+func breakLines(text string) string {
+	return strings.ReplaceAll(text, "\n", "<br />")
+}
+
 // createUserListMsg creates HTML that can replace the current user list.
 // It assume the nicknames provided are already HTML escaped.
-func createUserListMsg(nicks []string) string {
-	var b strings.Builder
-	b.WriteString(`<div id="users-list">`)
-	for i := range nicks {
-		b.WriteString(fmt.Sprintf(`<p>%s</p>`, nicks[i]))
+func createUserListMsg(users []roomUser) string {
+	type userData struct {
+		Nick       template.HTML
+		Idle       bool
+		Away       bool
+		AwayReason string
+		Bot        bool
+		Mod        bool
+		Guest      bool
+		Look       *nickLook
 	}
-	b.WriteString(`</div>`)
-	b.WriteString(fmt.Sprintf(`<p id="users-header-p" class="bold">Users (%d)</p>`, len(nicks)))
-	return b.String()
+	data := make([]userData, len(users))
+	for i, u := range users {
+		data[i] = userData{
+			Nick: nickHTML(u.nick), Idle: u.idle, Away: u.away, AwayReason: u.awayReason,
+			Bot: u.bot, Mod: u.mod, Guest: u.guest, Look: u.look,
+		}
+	}
+	return renderTemplate("userlist.html", data)
 }
 
 // createSpecialMsg creates a message not from any specific user, that has a
@@ -90,35 +214,151 @@ func createSpecialMsg(text string, class string) string {
 		// Notification messages are timestamped
 		ts = time.Now().UTC().Format(time.RFC3339)
 	}
-	return fmt.Sprintf(
-		// Add message to log
-		`<tbody id="message-table-tbody" hx-swap-oob="beforeend">
-			<tr class="special-msg"><td>%s</td><td></td><td class="%s">%s</td></tr>
-		</tbody>`,
-		ts, class, html.EscapeString(text),
-	)
+	return renderTemplate("special.html", struct {
+		Time  string
+		Class string
+		Text  string
+	}{ts, class, text})
+}
+
+// nickNotice holds the data for templates that announce something about a user.
+type nickNotice struct {
+	Time string
+	Nick template.HTML
+	// Text is the whole announcement with the nick, in the reader's language.
+	Text template.HTML
+}
+
+// renderNickNotice renders the template announcing something about the
+// client, with text being the announcement's format. The result is in every
+// language, see i18n.go.
+func renderNickNotice(name, text string, c *client, now time.Time, users []roomUser) (string, map[string]string) {
+	userList := createUserListMsg(users)
+	render := func(lang string) string {
+		nick := nickHTML(c.nick)
+		return renderTemplate(name, nickNotice{
+			Time: now.UTC().Format(time.RFC3339),
+			Nick: nick,
+			Text: template.HTML(tr(lang, text, nick)),
+		}) + userList
+	}
+	return render(defaultLang), localized(render)
+}
+
+// newUserList converts users into the UserList event data.
+func newUserList(users []roomUser) events.UserList {
+	e := events.UserList{Nicks: make([]string, len(users))}
+	for i := range users {
+		e.Nicks[i] = plainNick(users[i].nick)
+		if users[i].idle || users[i].away {
+			e.Idle = append(e.Idle, e.Nicks[i])
+		}
+		if users[i].away {
+			if e.Away == nil {
+				e.Away = make(map[string]string)
+			}
+			e.Away[e.Nicks[i]] = users[i].awayReason
+		}
+		if users[i].bot {
+			e.Bots = append(e.Bots, e.Nicks[i])
+		}
+		if users[i].mod {
+			e.Mods = append(e.Mods, e.Nicks[i])
+		}
+		if users[i].guest {
+			e.Guests = append(e.Guests, e.Nicks[i])
+		}
+	}
+	return e
+}
+
+// createUserListEvent creates a user list event for JSON clients.
+func createUserListEvent(users []roomUser) string {
+	return encodeEvent(events.TypeUsers, newUserList(users))
+}
+
+// createUserListUpdate creates a msg struct that updates the user list
+// without any notification. The user list is made when the room handles it.
+func createUserListUpdate() msg {
+	return msg{userList: true, when: time.Now(), minor: true}
+}
+
+// rawBroadcast returns the broadcast for a msg that's already rendered.
+func rawBroadcast(m msg) broadcast {
+	return broadcast{
+		html: m.raw, authorHTML: m.raw, langHTML: m.rawByLang, json: m.rawJSON, local: m.local, minor: m.minor,
+	}
 }
 
 // createJoinMsg creates a msg struct that can be sent to a chat room when a client joins.
-func createJoinMsg(c *client, nicks []string) msg {
+func createJoinMsg(c *client, users []roomUser) msg {
+	now := time.Now()
+	raw, rawByLang := renderNickNotice("join.html", "%s has joined", c, now, users)
 	return msg{
-		raw: createSpecialMsg(fmt.Sprintf("%s has joined", c.nick), "notif") +
-			createUserListMsg(nicks),
-		when: time.Now(),
+		raw:       raw,
+		rawByLang: rawByLang,
+		rawJSON: []string{
+			encodeEvent(events.TypeJoin, events.Join{Nick: plainNick(c.nick), Time: now}),
+			createUserListEvent(users),
+		},
+		when: now,
 	}
 }
 
 // createLeaveMsg creates a msg struct that can be sent to a chat room when a client leaves.
-func createLeaveMsg(c *client, nicks []string) msg {
+func createLeaveMsg(c *client, users []roomUser) msg {
+	now := time.Now()
+	raw, rawByLang := renderNickNotice("leave.html", "%s has left", c, now, users)
 	return msg{
-		raw: createSpecialMsg(fmt.Sprintf("%s has left", c.nick), "notif") +
-			createUserListMsg(nicks),
-		when: time.Now(),
+		raw:       raw,
+		rawByLang: rawByLang,
+		rawJSON: []string{
+			encodeEvent(events.TypeLeave, events.Leave{Nick: plainNick(c.nick), Time: now}),
+			createUserListEvent(users),
+		},
+		when: now,
 	}
 }
 
+// createChatMsgEvents creates the message events for JSON clients, one for
+// the author, and one for everyone else.
+func createChatMsgEvents(m msg) (string, string) {
+	e := events.Message{
+		ID:       m.id,
+		ReplyTo:  m.replyTo,
+		Nick:     plainNick(m.nick),
+		Text:     m.text,
+		HTML:     renderMsgText(m.text, m.mentions),
+		Mentions: plainNicks(m.mentions),
+		Time:     m.when,
+		Bot:      m.author != nil && m.author.bot != nil,
+	}
+	nonAuthor := encodeEvent(events.TypeMessage, e)
+	e.Self = true
+	return encodeEvent(events.TypeMessage, e), nonAuthor
+}
+
+// plainNick unescapes a sanitized nickname, for JSON clients.
+func plainNick(nick string) string {
+	return html.UnescapeString(nick)
+}
+
+// plainNicks unescapes sanitized nicknames, for JSON clients.
+func plainNicks(nicks []string) []string {
+	if len(nicks) == 0 {
+		return nil
+	}
+	plain := make([]string, len(nicks))
+	for i, nick := range nicks {
+		plain[i] = plainNick(nick)
+	}
+	return plain
+}
+
 func sanitizeNick(nick string) string {
 	nick = strings.ToValidUTF8(nick, "\uFFFD")
+	// Bidi controls could make the nick look like another, see bidi.go
+	nick = stripBidiControls(nick)
 	nick = strings.TrimSpace(nick)
 	// Unicode normalization, to prevent look-alike nicknames
 	nick = norm.NFC.String(nick)
@@ -136,9 +376,11 @@ func sanitizeNick(nick string) string {
 	return nick
 }
 
-func renderMsgText(text string) string {
+// renderMsgText renders message text to HTML. Mentions of the sanitized
+// nicknames in mentions are rendered as mention spans.
+func renderMsgText(text string, mentions []string) string {
 	text = strings.ToValidUTF8(text, "\uFFFD")
-	text = strings.TrimSpace(text)
+	text = strings.TrimSpace(normalizeNewlines(text))
 
 	// TODO: is this too slow?
 	g := uniseg.NewGraphemes(text)
@@ -148,55 +390,277 @@ func renderMsgText(text string) string {
 		b.Write(g.Bytes())
 		i++
 	}
-	text = b.String()
+	text = closeBidi(b.String())
 	text = html.EscapeString(text)
 
-	// Linkify URLs
-	text = urlRe.ReplaceAllStringFunc(text, func(urlText string) string {
-		return fmt.Sprintf(`<a href="%s" target="_blank" rel="noopener noreferrer">%s</a>`, urlText, urlText)
-	})
-
-	return text
+	if noFormatting {
+		// Just linkify URLs, expand emoji, and keep line breaks and mentions
+		return linkify(text, func(s string) string {
+			return breakLines(formatMentions(s, mentions, expandEmoji))
+		})
+	}
+	return formatMsgText(text, mentions)
 }
 
 // Message handlers
 
 // handleMsg takes a msg and performs the appropriate action.
 // This may involve sending a message back to the author. If a message should
-// sent to all chat room clients, handleMsg returns a two strings, one to send
-// to the author, and another to send to everyone else.
-// Otherwise empty strings are returned.
-func (cr *chatRoom) handleMsg(m msg) (string, string) {
+// be sent to all chat room clients, handleMsg returns it as a broadcast.
+// Otherwise an empty broadcast is returned.
+func (cr *chatRoom) handleMsg(m msg) broadcast {
+	if m.author != nil && m.raw == "" && m.bridge == "" {
+		if password, ok := lockPasswordArg(m.text); ok {
+			m.lockPassword = newRoomPassword(password)
+		}
+	}
 	cr.clientsMu.Lock()
 	defer cr.clientsMu.Unlock()
 
+	if m.userList {
+		// Made now instead of when it was queued, so it's never out of date
+		users := cr.users()
+		m.raw += createUserListMsg(users)
+		m.rawJSON = append(m.rawJSON, createUserListEvent(users))
+	}
 	if m.raw != "" {
 		// Message is already rendered
-		return m.raw, m.raw
+		return rawBroadcast(m)
+	}
+	if m.bridge != "" {
+		return cr.handleBridgedMsg(m)
+	}
+	m.nick = m.author.nick
+
+	if cr.isMuted(m.author.session) && !strings.HasPrefix(m.text, "/report") {
+		if cr.spamMuted[m.author.session] {
+			m.author.sendError("You were muted for spam, you can't send messages for now")
+		} else {
+			m.author.sendError("A moderator muted you, you can't send messages for now")
+		}
+		return broadcast{}
+	}
+
+	if m.ciphertext != "" {
+		return cr.handleEncryptedMsg(m)
+	}
+	if isE2EECmd(m.text) {
+		m.author.sendError("Encryption is set up in the web UI, this would have sent your passphrase to the room")
+		return broadcast{}
 	}
 
 	if strings.HasPrefix(m.text, "/nick ") && len(m.text) > len("/nick ") {
-		newNick := sanitizeNick(m.text[len("/nick "):])
-		if newNick == "" {
-			// Empty nickname, invalid
-			m.author.sendText(createSpecialMsg("Nickname cannot be empty", "error"))
-			return "", ""
+		if m.author.bot != nil {
+			m.author.sendError("Bots can't change their nickname")
+			return broadcast{}
+		}
+		newNick, err := parseNick(m.text[len("/nick "):])
+		if err != nil {
+			m.author.sendError(err.Error())
+			return broadcast{}
 		}
 		if cr.nickInUse(newNick) {
-			m.author.sendText(createSpecialMsg("That nickname is already in use", "error"))
-			return "", ""
+			m.author.sendError("That nickname is already in use")
+			return broadcast{}
 		}
 		oldNick := m.author.nick
-		m.author.nick = newNick
+		for _, c := range cr.tabsOf(m.author) {
+			c.nick = newNick
+		}
+		cr.server.settings.update(m.author.session, func(ss *sessionSettings) { ss.Nick = newNick })
 		// Tell everyone about name change, and update user list
-		s := createSpecialMsg(
-			fmt.Sprintf("%s is now known as %s", oldNick, newNick), "notif",
-		) +
-			createUserListMsg(cr.nicks())
-		return s, s
+		users := cr.users()
+		userList := createUserListMsg(users)
+		render := func(lang string) string {
+			return createSpecialMsg(
+				tr(lang, "%s is now known as %s", isolateNick(oldNick), isolateNick(newNick)), "notif",
+			) + userList
+		}
+		s := render(defaultLang)
+		return broadcast{
+			html:       s,
+			authorHTML: s,
+			langHTML:   localized(render),
+			json: []string{
+				encodeEvent(events.TypeNick, events.NickChange{
+					Old: plainNick(oldNick), New: plainNick(newNick), Time: m.when,
+				}),
+				createUserListEvent(users),
+			},
+		}
+	}
+
+	if m.text == "/language" || strings.HasPrefix(m.text, "/language ") {
+		cr.handleLanguageCmd(m.author, m.text[len("/language"):])
+		return broadcast{}
+	}
+
+	if m.text == "/users" {
+		cr.handleUsersCmd(m.author)
+		return broadcast{}
+	}
+
+	if m.text == "/whois" || strings.HasPrefix(m.text, "/whois ") {
+		cr.handleWhoisCmd(m.author, m.text[len("/whois"):])
+		return broadcast{}
+	}
+
+	if m.text == "/theme" || strings.HasPrefix(m.text, "/theme ") {
+		cr.handleThemeCmd(m.author, m.text[len("/theme"):])
+		return broadcast{}
+	}
+
+	if m.text == "/ignore" || strings.HasPrefix(m.text, "/ignore ") ||
+		m.text == "/unignore" || strings.HasPrefix(m.text, "/unignore ") {
+		cr.handleIgnoreCmd(m)
+		return broadcast{}
+	}
+
+	if m.text == "/away" || strings.HasPrefix(m.text, "/away ") || m.text == "/back" {
+		return cr.handleAwayCmd(m)
+	}
+
+	if m.text == "/report" || strings.HasPrefix(m.text, "/report ") {
+		cr.handleReportCmd(m.author, m.text[len("/report"):])
+		return broadcast{}
+	}
+
+	if m.text == "/topic" || strings.HasPrefix(m.text, "/topic ") {
+		return cr.handleTopicCmd(m)
+	}
+
+	if m.text == "/slowmode" || strings.HasPrefix(m.text, "/slowmode ") {
+		return cr.handleSlowModeCmd(m)
+	}
+
+	if m.text == "/directory" || strings.HasPrefix(m.text, "/directory ") {
+		return cr.handleDirectoryCmd(m)
+	}
+
+	if m.text == "/lock" || strings.HasPrefix(m.text, "/lock ") {
+		return cr.handleLockCmd(m)
+	}
+
+	if m.text == "/nearby" || strings.HasPrefix(m.text, "/nearby ") {
+		return cr.handleNearbyCmd(m)
+	}
+
+	if m.text == "/hop" || strings.HasPrefix(m.text, "/hop ") {
+		cr.handleHopCmd(m)
+		return broadcast{}
+	}
+
+	if m.text == "/invite" || strings.HasPrefix(m.text, "/invite ") {
+		cr.handleInviteCmd(m)
+		return broadcast{}
+	}
+
+	if m.text == "/join" || strings.HasPrefix(m.text, "/join ") {
+		cr.handleJoinCmd(m)
+		return broadcast{}
+	}
+
+	if m.text == "/unlock" {
+		return cr.handleUnlockCmd(m)
+	}
+
+	if m.text == "/votekick" || strings.HasPrefix(m.text, "/votekick ") {
+		return cr.handleVotekickCmd(m)
+	}
+
+	if strings.HasPrefix(m.text, "/approve ") || strings.HasPrefix(m.text, "/reject ") {
+		return cr.handleApprovalCmd(m)
+	}
+
+	if b, ok := cr.handleModCmd(m); ok {
+		return b
+	}
+
+	if strings.HasPrefix(m.text, "/edit ") {
+		return cr.handleEditCmd(m)
+	}
+
+	if strings.HasPrefix(m.text, "/delete ") {
+		return cr.handleDeleteCmd(m)
+	}
+
+	if m.text == "/search" || strings.HasPrefix(m.text, "/search ") {
+		cr.handleSearchCmd(m)
+		return broadcast{}
+	}
+
+	if m.text == "/emoji" || strings.HasPrefix(m.text, "/emoji ") {
+		term := strings.TrimSpace(m.text[len("/emoji"):])
+		results := searchEmoji(term)
+		if len(results) == 0 {
+			m.author.sendError("No emoji found")
+			return broadcast{}
+		}
+		text := strings.Join(results, "  ")
+		if len(results) > maxEmojiResults {
+			text = strings.Join(results[:maxEmojiResults], "  ") +
+				fmt.Sprintf("  (and %d more)", len(results)-maxEmojiResults)
+		}
+		m.author.sendNotice(text)
+		return broadcast{}
 	}
 
 	// Regular message
+	if errText := msgTextError(m.text); errText != "" {
+		m.author.sendError(errText)
+		return broadcast{}
+	}
+	if !m.approved {
+		// Approved messages were already checked when they were held
+		if !cr.checkSlowMode(m.author, m.when) {
+			return broadcast{}
+		}
+		if b, spam := cr.checkSpam(m.author, m.text, m.when); spam {
+			return b
+		}
+		if !cr.applyLinkPolicy(&m) {
+			return broadcast{}
+		}
+	}
+	m.text = currentConfig().filterWords(m.text)
+	m.mentions = findMentions(m.text, cr.roomNicks())
 	cr.whenLastMsg = m.when
-	return createChatMsg(m)
+	cr.recordMsg(m.when)
+	m.author.msgCount++
+	if linkPreviews {
+		// Previewing a link in a spoiler would give it away
+		if u := singlePreviewURL(hideSpoilers(m.text)); u != "" {
+			m.previewID = newPreviewID()
+			go cr.sendPreview(m.previewID, u)
+		}
+	}
+	m.id = newMsgID()
+	var quoted *recentMsg
+	if m.replyTo != "" {
+		quoted = cr.findRecentMsg(m.replyTo)
+		if quoted == nil {
+			m.replyTo = ""
+		} else {
+			m.replyTo = quoted.id
+		}
+	}
+	cr.tellIfAway(m.author, quoted, m.mentions)
+	author, nonAuthor := createChatMsg(m, quoted)
+	if nonAuthor == "" {
+		return broadcast{}
+	}
+	cr.rememberMsg(m)
+	cr.recordHistory(m)
+	authorJSON, nonAuthorJSON := createChatMsgEvents(m)
+	b := broadcast{
+		html:       nonAuthor,
+		authorHTML: author,
+		json:       []string{nonAuthorJSON},
+		authorJSON: []string{authorJSON},
+		isChat:     true,
+		id:         m.id,
+		mentioned:  m.mentions,
+		alert:      newChatAlert(m),
+	}
+	return b
 }
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestRenderMsgTextLines(t *testing.T) {
+	tests := []struct {
+		text string
+		want string
+	}{
+		{"one\ntwo", "one<br />two"},
+		{"one\r\ntwo\rthree", "one<br />two<br />three"},
+		{"\n\nhi\n\n", "hi"},
+		{"<b>\n</b>", "&lt;b&gt;<br />&lt;/b&gt;"},
+		{"*bold*\nhttps://example.com", `<strong>bold</strong><br /><a href="https://example.com" target="_blank" rel="noopener noreferrer">https://example.com</a>`},
+		{"look:\n```\nfunc main() {\n}\n```", "look:<br /><pre><code>func main() {\n}\n</code></pre>"},
+	}
+	for _, tt := range tests {
+		if got := renderMsgText(tt.text, nil); got != tt.want {
+			t.Errorf("renderMsgText(%q) = %q, want %q", tt.text, got, tt.want)
+		}
+	}
+
+	defer func(f bool) { noFormatting = f }(noFormatting)
+	noFormatting = true
+	if got, want := renderMsgText("*a*\nb", nil), "*a*<br />b"; got != want {
+		t.Errorf("renderMsgText without formatting = %q, want %q", got, want)
+	}
+}
+
+func TestMsgTextError(t *testing.T) {
+	tests := []struct {
+		text string
+		ok   bool
+	}{
+		{"hello", true},
+		{strings.Repeat("a", maxMsgTextLen), true},
+		{strings.Repeat("a", maxMsgTextLen+1), false},
+		// Newlines count towards the length
+		{strings.Repeat("a\n", maxMsgTextLen/2+1), false},
+		{strings.Repeat("line\n", maxMsgLines), true},
+		{strings.Repeat("line\r\n", maxMsgLines+1) + "line", false},
+		// Trailing blank lines don't count
+		{"line" + strings.Repeat("\n", maxMsgLines*2), true},
+	}
+	for _, tt := range tests {
+		if got := msgTextError(tt.text); (got == "") != tt.ok {
+			t.Errorf("msgTextError(%q) = %q, want ok %v", tt.text, got, tt.ok)
+		}
+	}
+}
+
+func TestRenderMsgTextSpoilers(t *testing.T) {
+	tests := []struct {
+		text string
+		want string
+	}{
+		{"the answer is ||42||", `the answer is <span class="spoiler" tabindex="0" title="Spoiler, click to show">42</span>`},
+		{"||*a*|| and ||b||", `<span class="spoiler" tabindex="0" title="Spoiler, click to show"><strong>a</strong></span> and ` +
+			`<span class="spoiler" tabindex="0" title="Spoiler, click to show">b</span>`},
+		{"a || b || c", `a <span class="spoiler" tabindex="0" title="Spoiler, click to show"> b </span> c`},
+		{"`||code||`", "<code>||code||</code>"},
+		{"not || closed", "not || closed"},
+	}
+	for _, tt := range tests {
+		if got := renderMsgText(tt.text, nil); got != tt.want {
+			t.Errorf("renderMsgText(%q) = %q, want %q", tt.text, got, tt.want)
+		}
+	}
+
+	if got, want := quoteText("it was ||the butler|| all along"), "it was [spoiler] all along"; got != want {
+		t.Errorf("quoteText with a spoiler = %q, want %q", got, want)
+	}
+	if u := singlePreviewURL(hideSpoilers("||https://example.com/ending||")); u != "" {
+		t.Errorf("link in a spoiler would be previewed: %s", u)
+	}
+}
+
+func BenchmarkRenderMsgText(b *testing.B) {
+	benchmarks := []struct {
+		name string
+		text string
+	}{
+		{"plain", "hey, is anyone else here for the talk at three?"},
+		{"formatted", "*bold* _italic_ `code` ||spoiler|| :smile: @AbleAardvark https://example.com/a?b=c"},
+		{"long", strings.Repeat("lots of words in a long message ", maxMsgTextLen/32)},
+		{"code", "```\nfunc main() {\n\tfmt.Println(\"hi\")\n}\n```"},
+	}
+	mentions := []string{"AbleAardvark"}
+	for _, bm := range benchmarks {
+		b.Run(bm.name, func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				renderMsgText(bm.text, mentions)
+			}
+		})
+	}
+}
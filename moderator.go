@@ -0,0 +1,284 @@
+package main
+
+// This file handles room moderators. The admin can make someone in a room a
+// moderator from the admin page, or get a one-time code that the person sends
+// with "/claim <code>" to become one. Moderators can use /kick, /mute,
+// /unmute, and /clear in their room, and are marked in the user list. The
+// role is tied to the session, so it lasts until everyone leaves the room.
+
+import (
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/makeworld-the-better-one/neartalk/events"
+	"github.com/makeworld-the-better-one/neartalk/ids"
+	"nhooyr.io/websocket"
+)
+
+// modCodeTTL is how long a moderator code can be claimed for.
+const modCodeTTL = time.Hour
+
+// muteDuration is how long /mute stops someone from sending messages.
+const muteDuration = 10 * time.Minute
+
+// modCodes holds the unclaimed moderator codes.
+type modCodes struct {
+	mu sync.Mutex
+	// rooms holds the room key each code is for, by code.
+	rooms map[string]string
+	// expires holds when each code stops working, by code.
+	expires map[string]time.Time
+}
+
+func newModCodes() *modCodes {
+	return &modCodes{rooms: make(map[string]string), expires: make(map[string]time.Time)}
+}
+
+// issue returns a new code for the room.
+func (mc *modCodes) issue(key string) string {
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+	now := time.Now()
+	for code, exp := range mc.expires {
+		if now.After(exp) {
+			delete(mc.rooms, code)
+			delete(mc.expires, code)
+		}
+	}
+	code := ids.Token()
+	mc.rooms[code] = key
+	mc.expires[code] = now.Add(modCodeTTL)
+	return code
+}
+
+// claim uses up the code, returning true if it's valid for the room.
+func (mc *modCodes) claim(code, key string) bool {
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+	if mc.rooms[code] != key || time.Now().After(mc.expires[code]) {
+		return false
+	}
+	delete(mc.rooms, code)
+	delete(mc.expires, code)
+	return true
+}
+
+// makeModerator makes the client a moderator, returning the broadcast that
+// tells the room.
+// It does not lock the clientsMu, callers should do that.
+func (cr *chatRoom) makeModerator(c *client, when time.Time) broadcast {
+	for _, tab := range cr.tabsOf(c) {
+		tab.moderator = true
+	}
+	cr.moderators[c.session] = true
+	text := fmt.Sprintf("%s is now a moderator", isolateNick(c.nick))
+	users := cr.users()
+	s := createSpecialMsg(text, "notif") + createUserListMsg(users)
+	return broadcast{
+		html:       s,
+		authorHTML: s + clearInputFieldMsg,
+		json: []string{
+			encodeEvent(events.TypeNotice, events.Notice{Text: text, Time: when}),
+			createUserListEvent(users),
+		},
+	}
+}
+
+// isMuted returns true if the session was muted by a moderator, or for spam,
+// and can't send messages yet.
+// It does not lock the clientsMu, callers should do that.
+func (cr *chatRoom) isMuted(session string) bool {
+	until, ok := cr.muted[session]
+	if !ok {
+		return false
+	}
+	if time.Now().After(until) {
+		cr.unmute(session)
+		return false
+	}
+	return true
+}
+
+// modTarget returns the client named by the command argument, for commands
+// only moderators can use. If the author isn't a moderator or there's no such
+// client, it sends the author an error and returns nil.
+// It does not lock the clientsMu, callers should do that.
+func (cr *chatRoom) modTarget(m msg, cmd string) *client {
+	if !m.author.moderator {
+		m.author.sendError("Only moderators can use " + cmd)
+		return nil
+	}
+	nick := strings.TrimSpace(m.text[len(cmd):])
+	if nick == "" {
+		m.author.sendError(m.author.tr("Usage: %s <nick>", cmd))
+		return nil
+	}
+	target := cr.clientByNick(sanitizeNick(nick))
+	if target == nil {
+		m.author.sendError("There's nobody in the room with that nickname")
+		return nil
+	}
+	if target.moderator || target.bot != nil {
+		m.author.sendError(fmt.Sprintf("You can't use %s on moderators or bots", cmd))
+		return nil
+	}
+	return target
+}
+
+// handleModCmd handles the moderator commands: /claim, /kick, /mute,
+// /unmute, and /clear. It returns false if the message isn't one of them.
+// Anyone can use /clear to empty their own message log, "/clear room" is the
+// moderator command that clears it for everyone.
+// It does not lock the clientsMu, callers should do that.
+func (cr *chatRoom) handleModCmd(m msg) (broadcast, bool) {
+	cmd, _, _ := strings.Cut(m.text, " ")
+	switch cmd {
+	case "/claim":
+		code := strings.TrimSpace(m.text[len(cmd):])
+		if m.author.moderator {
+			m.author.sendError("You're already a moderator")
+			return broadcast{}, true
+		}
+		if code == "" || !cr.server.modCodes.claim(code, cr.key) {
+			m.author.sendError("That moderator code isn't valid for this room")
+			return broadcast{}, true
+		}
+		return cr.makeModerator(m.author, m.when), true
+
+	case "/kick":
+		target := cr.modTarget(m, cmd)
+		if target == nil {
+			return broadcast{}, true
+		}
+		cr.kicked[target.session] = time.Now().Add(kickBlockDuration)
+		for _, c := range cr.tabsOf(target) {
+			go c.disconnect(websocket.StatusPolicyViolation, "kicked from the room by a moderator")
+		}
+		return roomNotice(fmt.Sprintf("%s was kicked by %s", isolateNick(target.nick), isolateNick(m.author.nick)), m.when), true
+
+	case "/mute":
+		target := cr.modTarget(m, cmd)
+		if target == nil {
+			return broadcast{}, true
+		}
+		cr.muted[target.session] = time.Now().Add(muteDuration)
+		delete(cr.spamMuted, target.session)
+		return roomNotice(fmt.Sprintf("%s was muted for %d minutes by %s",
+			isolateNick(target.nick), int(muteDuration.Minutes()), isolateNick(m.author.nick)), m.when), true
+
+	case "/unmute":
+		target := cr.modTarget(m, cmd)
+		if target == nil {
+			return broadcast{}, true
+		}
+		if !cr.isMuted(target.session) {
+			m.author.sendError("They aren't muted")
+			return broadcast{}, true
+		}
+		cr.unmute(target.session)
+		return roomNotice(fmt.Sprintf("%s was unmuted by %s", isolateNick(target.nick), isolateNick(m.author.nick)), m.when), true
+
+	case "/clear":
+		switch strings.TrimSpace(m.text[len(cmd):]) {
+		case "":
+			if m.author.isJSON() {
+				m.author.sendFrame(encodeEvent(events.TypeClear, events.Clear{
+					Nick: plainNick(m.author.nick), Self: true, Time: m.when,
+				}))
+			} else {
+				m.author.sendFrame(createClearLogMsg() + clearInputFieldMsg)
+			}
+			return broadcast{}, true
+		case "room":
+		default:
+			m.author.sendError("Use /clear to clear your own chat, or /clear room to clear it for everyone")
+			return broadcast{}, true
+		}
+		if !m.author.moderator {
+			m.author.sendError("Only moderators can use /clear room")
+			return broadcast{}, true
+		}
+		cr.recent = nil
+		cr.seen = seenBy{}
+		cr.clearHistory()
+		text := fmt.Sprintf("%s cleared the chat", isolateNick(m.author.nick))
+		s := createClearLogMsg() + createSpecialMsg(text, "notif")
+		return broadcast{
+			html:       s,
+			authorHTML: s + clearInputFieldMsg,
+			json: []string{
+				encodeEvent(events.TypeClear, events.Clear{Nick: plainNick(m.author.nick), Time: m.when}),
+				encodeEvent(events.TypeNotice, events.Notice{Text: text, Time: m.when}),
+			},
+		}, true
+	}
+	return broadcast{}, false
+}
+
+// adminModeratorHandler makes someone a moderator of a room from the admin
+// page, or issues a code for the room if no nickname is given.
+func (cs *chatServer) adminModeratorHandler(w http.ResponseWriter, r *http.Request) {
+	keyID, ok := cs.adminSession(r)
+	if !ok || r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	key := r.FormValue("room")
+	nick := sanitizeNick(r.FormValue("nick"))
+	if key == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	if nick == "" {
+		code := cs.modCodes.issue(key)
+		cs.audit.record(keyID, auditModCode, key, "")
+		fmt.Fprintf(w, `<p>Send <code>/claim %s</code> in the room within an hour to become a moderator.</p>%s`,
+			template.HTMLEscapeString(code), adminModeratorForm(key))
+		return
+	}
+
+	cs.roomsMu.Lock()
+	room, ok := cs.rooms[key]
+	cs.roomsMu.Unlock()
+	if !ok {
+		fmt.Fprintf(w, `<p class="error">That room is gone.</p>`)
+		return
+	}
+	room.clientsMu.Lock()
+	c := room.clientByNick(nick)
+	var b broadcast
+	if c != nil && !c.moderator {
+		b = room.makeModerator(c, time.Now())
+	}
+	room.clientsMu.Unlock()
+	if c == nil {
+		fmt.Fprintf(w, `<p class="error">Nobody in the room is called %s.</p>%s`, nick, adminModeratorForm(key))
+		return
+	}
+	cs.audit.record(keyID, auditModerator, key, plainNick(nick))
+	if !b.empty() {
+		select {
+		case room.incoming <- msg{raw: b.html, rawJSON: b.json, when: time.Now()}:
+		default:
+			// Room is busy, they'll see it in the next user list
+		}
+	}
+	fmt.Fprintf(w, `<p>%s is a moderator.</p>%s`, nick, adminModeratorForm(key))
+}
+
+// adminModeratorForm returns the admin page form for making someone a
+// moderator of the room.
+func adminModeratorForm(key string) string {
+	vals, _ := json.Marshal(map[string]string{"room": key})
+	return fmt.Sprintf(
+		`<form hx-post="/admin-moderator" hx-vals="%s" hx-swap="outerHTML">`+
+			`<input name="nick" placeholder="Nickname, or empty for a code" /> <button>Make moderator</button></form>`,
+		template.HTMLEscapeString(string(vals)),
+	)
+}
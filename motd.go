@@ -0,0 +1,133 @@
+package main
+
+// This file handles the message of the day, which is shown to everyone when
+// they join a room. It's set with -motd or "motd" in the config file, and
+// admins can change it from the admin page, optionally sending it to every
+// room right away. A change made on the admin page lasts until NearTalk
+// restarts, or the config file changes the MOTD.
+
+import (
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/makeworld-the-better-one/neartalk/events"
+)
+
+// maxMOTDLen is the max length of the MOTD in bytes.
+const maxMOTDLen = 1000
+
+// getMOTD returns the message of the day, or an empty string if there isn't
+// one.
+func (cs *chatServer) getMOTD() string {
+	cs.motdMu.Lock()
+	defer cs.motdMu.Unlock()
+	return cs.motd
+}
+
+// setMOTD changes the message of the day.
+func (cs *chatServer) setMOTD(text string) {
+	cs.motdMu.Lock()
+	defer cs.motdMu.Unlock()
+	cs.motd = strings.TrimSpace(text)
+}
+
+// sendMOTD sends the message of the day to the client, if there is one.
+func (cs *chatServer) sendMOTD(c *client) {
+	text := cs.getMOTD()
+	if text == "" {
+		return
+	}
+	if c.isJSON() {
+		c.sendEvent(events.TypeMOTD, events.MOTD{Text: text, Time: time.Now()})
+	} else {
+		c.sendText(createSpecialMsg(text, "motd"))
+	}
+}
+
+// broadcastMOTD sends the message of the day to every room.
+func (cs *chatServer) broadcastMOTD() {
+	text := cs.getMOTD()
+	if text == "" {
+		return
+	}
+	now := time.Now()
+	cs.sendToRooms("", msg{
+		raw:     createSpecialMsg(text, "motd"),
+		rawJSON: []string{encodeEvent(events.TypeMOTD, events.MOTD{Text: text, Time: now})},
+		when:    now,
+	})
+}
+
+// sendToRooms sends the message to the room with the key, or every room if
+// the key is empty. Rooms too busy to take it are skipped.
+func (cs *chatServer) sendToRooms(key string, m msg) {
+	cs.roomsMu.Lock()
+	defer cs.roomsMu.Unlock()
+	for k, room := range cs.rooms {
+		if key != "" && k != key {
+			continue
+		}
+		select {
+		case room.incoming <- m:
+		default:
+			log.Printf("chatServer.sendToRooms: room %s is too busy, skipped", k)
+		}
+	}
+}
+
+// adminMOTDHandler serves the admin page form for the message of the day,
+// and changes it when the form is POSTed. If "broadcast" is set, the new
+// MOTD is sent to every room too.
+func (cs *chatServer) adminMOTDHandler(w http.ResponseWriter, r *http.Request) {
+	keyID, ok := cs.adminSession(r)
+	if !ok {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	if r.Method != http.MethodPost {
+		fmt.Fprint(w, adminMOTDForm(cs.getMOTD(), ""))
+		return
+	}
+	text := r.FormValue("motd")
+	if len(text) > maxMOTDLen {
+		fmt.Fprint(w, adminMOTDForm(text, fmt.Sprintf("The MOTD can be at most %d bytes long.", maxMOTDLen)))
+		return
+	}
+	cs.setMOTD(text)
+	broadcast := r.FormValue("broadcast") != ""
+	detail := ""
+	if broadcast {
+		cs.broadcastMOTD()
+		detail = "sent to all rooms"
+	}
+	cs.audit.record(keyID, auditMOTD, cs.getMOTD(), detail)
+	fmt.Fprint(w, adminMOTDForm(cs.getMOTD(), "Saved."))
+}
+
+// adminMOTDForm returns the admin page form for changing the message of the
+// day, with a status message under it if status isn't empty.
+func adminMOTDForm(text, status string) string {
+	var b strings.Builder
+	fmt.Fprintf(&b,
+		`<form hx-post="/admin-motd" hx-swap="outerHTML">`+
+			`<textarea name="motd" rows="3" maxlength="%d" placeholder="Shown to everyone when they join, empty for none">%s</textarea>`+
+			`<label><input type="checkbox" name="broadcast" /> Send to all rooms now</label> `+
+			`<button>Save MOTD</button>`,
+		maxMOTDLen, template.HTMLEscapeString(text),
+	)
+	if status != "" {
+		fmt.Fprintf(&b, `<p>%s</p>`, template.HTMLEscapeString(status))
+	}
+	b.WriteString(`</form>`)
+	return b.String()
+}
+
+// motdChanged returns true if the MOTD in the config differs from the one in
+// the config before it, which is nil on the first load.
+func motdChanged(old, c *config) bool {
+	return old == nil || old.MOTD != c.MOTD
+}
@@ -0,0 +1,123 @@
+package main
+
+// This file handles named rooms, which people join by visiting /room/<name>
+// instead of being grouped by IP address. They let people meet deliberately,
+// from any network. Named rooms can be turned off with -named-rooms=false.
+//
+// Named rooms have keys starting with namedRoomPrefix, so they can never be
+// confused with rooms for an IP address or place. Like any room, they can be
+// locked with a password, see lock.go.
+
+import (
+	"bytes"
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// namedRoomPrefix starts the key of every named room.
+const namedRoomPrefix = "#"
+
+// roomNameRe matches valid room names.
+var roomNameRe = regexp.MustCompile(`^[a-z0-9][a-z0-9-]{0,31}$`)
+
+// normalizeRoomName returns the canonical form of a room name, and whether
+// it's valid. Names are case insensitive, and made of up to 32 letters,
+// digits, and hyphens.
+func normalizeRoomName(name string) (string, bool) {
+	name = strings.ToLower(strings.TrimSpace(name))
+	return name, roomNameRe.MatchString(name)
+}
+
+// namedRoomKey returns the room key for a room name.
+func namedRoomKey(name string) string {
+	return namedRoomPrefix + name
+}
+
+// connectRoomKey returns the key of the room a connection request should
+// join. That's the named room in the "room" query parameter if there is one,
+// the room for the invite in the "invite" parameter, see invite.go, the LAN
+// room in the "lan" parameter in LAN mode, see lanmode.go, and the room for
+// the client's address otherwise, see clientRoomKey. The "sub" parameter joins a
+// subroom of the LAN room or the room for the address, see subroom.go. If
+// the client can't join the room, it responds with an error and returns
+// false.
+func (cs *chatServer) connectRoomKey(w http.ResponseWriter, r *http.Request, session string) (string, bool) {
+	key := cs.clientRoomKey(r)
+	if token := r.URL.Query().Get("invite"); token != "" {
+		var ok bool
+		if key, ok = cs.acceptInvite(token, session, key); !ok {
+			http.Error(w, "this invite has expired", http.StatusNotFound)
+			return "", false
+		}
+	} else if slug := r.URL.Query().Get("lan"); slug != "" {
+		var ok bool
+		if key, ok = lanRoomBySlug(slug); !ok || !lanMode {
+			http.Error(w, "there's no room here with that name", http.StatusNotFound)
+			return "", false
+		}
+	} else if name := r.URL.Query().Get("room"); name != "" {
+		if !namedRooms {
+			http.Error(w, "named rooms are disabled", http.StatusNotFound)
+			return "", false
+		}
+		name, ok := normalizeRoomName(name)
+		if !ok {
+			http.Error(w, "invalid room name", http.StatusBadRequest)
+			return "", false
+		}
+		key = namedRoomKey(name)
+	}
+	if name := r.URL.Query().Get("sub"); name != "" {
+		var ok bool
+		if key, ok = cs.connectSubroomKey(w, r, key, name, session); !ok {
+			return "", false
+		}
+	}
+	if !cs.mayJoinRoom(key, session) {
+		http.Error(w, "this room is locked", http.StatusForbidden)
+		return "", false
+	}
+	return key, true
+}
+
+// roomPageHandler serves the chat page for a named room at /room/<name>. If
+// the room is locked, visitors have to enter the password first.
+func (cs *chatServer) roomPageHandler(w http.ResponseWriter, r *http.Request) {
+	if !namedRooms {
+		http.NotFound(w, r)
+		return
+	}
+	name, ok := normalizeRoomName(strings.TrimPrefix(r.URL.Path, "/room/"))
+	if !ok {
+		http.Error(w, "Room names can only have up to 32 letters, numbers, and hyphens.", http.StatusNotFound)
+		return
+	}
+	if r.URL.Path != "/room/"+name {
+		// Redirect to the canonical name
+		http.Redirect(w, r, "/room/"+name, http.StatusFound)
+		return
+	}
+	if !cs.challengeGate(w, r) || !cs.passwordGate(w, r, namedRoomKey(name), namedRoomPrefix+name) {
+		return
+	}
+
+	page, err := os.ReadFile("html/index.html")
+	if err != nil {
+		log.Printf("chatServer.roomPageHandler: err reading index.html: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	// Connect to the named room instead of the one for the IP address
+	query := url.QueryEscape(name)
+	page = bytes.Replace(page, []byte(`<body hx-ws="connect:/connect">`), []byte(fmt.Sprintf(
+		`<body hx-ws="connect:/connect?room=%s" data-room="%s">`, query, template.HTMLEscapeString(name),
+	)), 1)
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Write(page)
+}
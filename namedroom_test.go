@@ -0,0 +1,29 @@
+package main
+
+import "testing"
+
+func TestNormalizeRoomName(t *testing.T) {
+	tests := []struct {
+		name string
+		want string
+		ok   bool
+	}{
+		{"book-club", "book-club", true},
+		{"Book-Club", "book-club", true},
+		{" party2022 ", "party2022", true},
+		{"a", "a", true},
+		{"", "", false},
+		{"-club", "-club", false},
+		{"book club", "book club", false},
+		{"café", "café", false},
+		{"../admin", "../admin", false},
+		{"abcdefghijklmnopqrstuvwxyz012345", "abcdefghijklmnopqrstuvwxyz012345", true},
+		{"abcdefghijklmnopqrstuvwxyz0123456", "abcdefghijklmnopqrstuvwxyz0123456", false},
+	}
+	for _, tt := range tests {
+		got, ok := normalizeRoomName(tt.name)
+		if got != tt.want || ok != tt.ok {
+			t.Errorf("normalizeRoomName(%q) = %q, %v, want %q, %v", tt.name, got, ok, tt.want, tt.ok)
+		}
+	}
+}
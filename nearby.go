@@ -0,0 +1,286 @@
+package main
+
+// This file handles nearby rooms, which let people find the rooms of other
+// networks close to theirs, like the other buildings of a campus. It's off
+// unless the server is started with -nearby, which says what counts as
+// nearby: the same /16 subnet (/32 for IPv6), or with "city", the same city
+// in the GeoIP database too, see geoip.go.
+//
+// Rooms are never shown to their neighbours unless someone in them sends
+// "/nearby on". Others nearby see them in "/nearby" with a short random ID
+// and a rough idea of how many people are there and how busy it is, never
+// the address. "/hop <id>" sends a link like an invite, see invite.go, that
+// joins the room as a guest. Only rooms for IP addresses can be nearby, and
+// only rooms on the same instance are found.
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/makeworld-the-better-one/neartalk/ids"
+)
+
+// Policies for the -nearby flag
+const (
+	nearbyOff    = "off"
+	nearbySubnet = "subnet"
+	nearbyCity   = "city"
+)
+
+const (
+	// nearbyIDLen is the length of the IDs rooms are shown with in /nearby.
+	nearbyIDLen = 6
+	// nearbyActivityWindow is how far back messages are counted for how busy
+	// a nearby room is.
+	nearbyActivityWindow = 10 * time.Minute
+	// hopTTL is how long the link from /hop works for.
+	hopTTL = 5 * time.Minute
+	// maxNearbyRooms is how many rooms /nearby lists.
+	maxNearbyRooms = 10
+)
+
+// validateNearby returns an error if the -nearby flag is invalid.
+func validateNearby() error {
+	if nearbyPolicy != nearbyOff && nearbyPolicy != nearbySubnet && nearbyPolicy != nearbyCity {
+		return fmt.Errorf("invalid nearby policy %q, must be %q, %q, or %q",
+			nearbyPolicy, nearbyOff, nearbySubnet, nearbyCity)
+	}
+	if nearbyPolicy != nearbyOff && privateRooms {
+		return fmt.Errorf("-nearby can't be used with -private-rooms, which doesn't keep addresses")
+	}
+	return nil
+}
+
+// nearbyAreas returns the areas the room for the key is in, so rooms that
+// share one are nearby. It returns nil for rooms that aren't for an IP
+// address, or if nearby rooms are off.
+func nearbyAreas(key string) []string {
+	ip := net.ParseIP(key)
+	if ip == nil || nearbyPolicy == nearbyOff || nearbyPolicy == "" {
+		return nil
+	}
+	var areas []string
+	if ip4 := ip.To4(); ip4 != nil {
+		areas = append(areas, ip4.Mask(net.CIDRMask(16, 32)).String()+"/16")
+	} else {
+		areas = append(areas, ip.Mask(net.CIDRMask(32, 128)).String()+"/32")
+	}
+	if nearbyPolicy == nearbyCity {
+		if city := lookupPlaceAt(key, geoLevelCity); city != "" {
+			areas = append(areas, city)
+		}
+	}
+	return areas
+}
+
+// isNearby returns true if the rooms for the two keys share an area.
+func isNearby(a, b string) bool {
+	if a == b {
+		return false
+	}
+	bAreas := nearbyAreas(b)
+	for _, area := range nearbyAreas(a) {
+		for _, other := range bAreas {
+			if area == other {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// nearbyEntry is a room shown in /nearby.
+type nearbyEntry struct {
+	id     string
+	topic  string
+	people int
+	msgs   int
+}
+
+// describe returns the entry as shown in /nearby, like
+// `K3M9QZ: a few people, active, "board games"`.
+func (e nearbyEntry) describe() string {
+	people := "1 person"
+	switch {
+	case e.people > 5:
+		people = "many people"
+	case e.people > 1:
+		people = "a few people"
+	}
+	activity := "quiet"
+	switch {
+	case e.msgs >= 30:
+		activity = "busy"
+	case e.msgs > 0:
+		activity = "active"
+	}
+	s := fmt.Sprintf("%s: %s, %s", e.id, people, activity)
+	if e.topic != "" {
+		s += fmt.Sprintf(", %q", e.topic)
+	}
+	return s
+}
+
+// nearbyEntry returns the entry for the room in /nearby, and false if it
+// shouldn't be listed.
+// It holds the client mutex.
+func (cr *chatRoom) nearbyEntry(now time.Time) (nearbyEntry, bool) {
+	cr.clientsMu.Lock()
+	defer cr.clientsMu.Unlock()
+	if cr.nearbyID == "" || cr.password != nil || len(cr.clients) == 0 {
+		return nearbyEntry{}, false
+	}
+	cr.stats.advance(now)
+	e := nearbyEntry{id: cr.nearbyID, topic: cr.topic, people: len(cr.users())}
+	window := int(nearbyActivityWindow / statsBucket)
+	for i := len(cr.stats.points) - 1; i >= 0 && i >= len(cr.stats.points)-window; i-- {
+		e.msgs += cr.stats.points[i].msgs
+	}
+	return e, true
+}
+
+// nearbyRooms returns the listed rooms nearby the room for the key, with
+// the busiest first.
+// It holds the roomsMu.
+func (cs *chatServer) nearbyRooms(key string, now time.Time) []nearbyEntry {
+	cs.roomsMu.Lock()
+	defer cs.roomsMu.Unlock()
+	var entries []nearbyEntry
+	for otherKey, room := range cs.rooms {
+		if !isNearby(key, otherKey) {
+			continue
+		}
+		if e, ok := room.nearbyEntry(now); ok {
+			entries = append(entries, e)
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].msgs != entries[j].msgs {
+			return entries[i].msgs > entries[j].msgs
+		}
+		return entries[i].id < entries[j].id
+	})
+	if len(entries) > maxNearbyRooms {
+		entries = entries[:maxNearbyRooms]
+	}
+	return entries
+}
+
+// nearbyRoomKey returns the key of the listed room with the ID that's nearby
+// the room for the key, and false if there isn't one.
+// It holds the roomsMu.
+func (cs *chatServer) nearbyRoomKey(key, id string, now time.Time) (string, bool) {
+	cs.roomsMu.Lock()
+	defer cs.roomsMu.Unlock()
+	for otherKey, room := range cs.rooms {
+		if !isNearby(key, otherKey) {
+			continue
+		}
+		if e, ok := room.nearbyEntry(now); ok && strings.EqualFold(e.id, id) {
+			return otherKey, true
+		}
+	}
+	return "", false
+}
+
+// handleNearbyCmd handles "/nearby", which lists the rooms nearby, and
+// "/nearby on" and "/nearby off", which list the room for them or stop.
+// It returns a broadcast like handleMsg, so the room knows it was listed.
+// It does not lock the clientsMu, callers should do that.
+func (cr *chatRoom) handleNearbyCmd(m msg) broadcast {
+	arg := strings.TrimSpace(m.text[len("/nearby"):])
+	if nearbyAreas(cr.key) == nil {
+		m.author.sendError("Nearby rooms aren't available here")
+		return broadcast{}
+	}
+	if m.author.guest || m.author.bot != nil {
+		m.author.sendError("Only people on this network can use nearby rooms")
+		return broadcast{}
+	}
+
+	switch arg {
+	case "":
+		// Other rooms are locked to list them, so it can't be done while
+		// this one is
+		go cr.sendNearby(m.author, m.when)
+		return broadcast{}
+	case "on":
+		if cr.nearbyID != "" {
+			m.author.sendError("This room is already shown to nearby rooms")
+			return broadcast{}
+		}
+		id := ids.Random()
+		cr.nearbyID = id[len(id)-nearbyIDLen:]
+		return roomNotice(fmt.Sprintf("%s showed this room to nearby rooms, without its address", isolateNick(m.author.nick)), m.when)
+	case "off":
+		if cr.nearbyID == "" {
+			m.author.sendError("This room isn't shown to nearby rooms")
+			return broadcast{}
+		}
+		cr.nearbyID = ""
+		return roomNotice(fmt.Sprintf("%s hid this room from nearby rooms", isolateNick(m.author.nick)), m.when)
+	}
+	m.author.sendError("Usage: /nearby, /nearby on, or /nearby off")
+	return broadcast{}
+}
+
+// sendNearby sends the client the list of rooms nearby.
+func (cr *chatRoom) sendNearby(c *client, now time.Time) {
+	entries := cr.server.nearbyRooms(cr.key, now)
+	if len(entries) == 0 {
+		c.sendNotice("No rooms nearby are showing themselves right now")
+		return
+	}
+	descs := make([]string, len(entries))
+	for i, e := range entries {
+		descs[i] = e.describe()
+	}
+	c.sendNotice(fmt.Sprintf("Rooms nearby: %s. Send /hop <id> to visit one.", strings.Join(descs, "; ")))
+}
+
+// handleHopCmd handles "/hop <id>", which sends the author a link that joins
+// the nearby room with the ID as a guest.
+// It does not lock the clientsMu, callers should do that.
+func (cr *chatRoom) handleHopCmd(m msg) {
+	id := strings.TrimSpace(m.text[len("/hop"):])
+	if id == "" {
+		m.author.sendError("Usage: /hop <id>, with an ID from /nearby")
+		return
+	}
+	if nearbyAreas(cr.key) == nil {
+		m.author.sendError("Nearby rooms aren't available here")
+		return
+	}
+	if m.author.guest || m.author.bot != nil {
+		m.author.sendError("Only people on this network can use nearby rooms")
+		return
+	}
+	go cr.sendHop(m.author, id, m.when)
+}
+
+// sendHop sends the client a link to join the nearby room with the ID.
+func (cr *chatRoom) sendHop(c *client, id string, now time.Time) {
+	key, ok := cr.server.nearbyRoomKey(cr.key, id, now)
+	if !ok {
+		c.sendError("There's no room nearby with that ID, send /nearby to see them")
+		return
+	}
+	token, ok := cr.server.invites.issue(key, now.Add(hopTTL))
+	if !ok {
+		c.sendError("Visiting other rooms is turned off on this server")
+		return
+	}
+	if c.isJSON() {
+		c.sendNotice(fmt.Sprintf("Open /invite/%s in the next %v to visit room %s as a guest", token, hopTTL, strings.ToUpper(id)))
+		return
+	}
+	c.sendFrame(renderTemplate("hop.html", struct {
+		Time  string
+		Token string
+		Room  string
+		TTL   string
+	}{now.UTC().Format(time.RFC3339), token, strings.ToUpper(id), hopTTL.String()}) + clearInputFieldMsg)
+}
@@ -0,0 +1,43 @@
+package main
+
+import "testing"
+
+func TestIsNearby(t *testing.T) {
+	defer func(p string) { nearbyPolicy = p }(nearbyPolicy)
+	tests := []struct {
+		policy string
+		a, b   string
+		want   bool
+	}{
+		{nearbySubnet, "203.0.113.5", "203.0.7.9", true},
+		{nearbySubnet, "203.0.113.5", "203.1.113.5", false},
+		{nearbySubnet, "203.0.113.5", "203.0.113.5", false},
+		{nearbySubnet, "2001:db8:1::1", "2001:db8:ffff::1", true},
+		{nearbySubnet, "2001:db8::1", "2001:db9::1", false},
+		{nearbySubnet, "lan", "lan", false},
+		{nearbySubnet, "#games", "203.0.7.9", false},
+		{nearbyOff, "203.0.113.5", "203.0.7.9", false},
+	}
+	for _, tt := range tests {
+		nearbyPolicy = tt.policy
+		if got := isNearby(tt.a, tt.b); got != tt.want {
+			t.Errorf("with %s, isNearby(%q, %q) = %v, want %v", tt.policy, tt.a, tt.b, got, tt.want)
+		}
+	}
+}
+
+func TestNearbyEntryDescribe(t *testing.T) {
+	tests := []struct {
+		e    nearbyEntry
+		want string
+	}{
+		{nearbyEntry{id: "K3M9QZ", people: 1}, "K3M9QZ: 1 person, quiet"},
+		{nearbyEntry{id: "K3M9QZ", people: 3, msgs: 4, topic: "board games"}, `K3M9QZ: a few people, active, "board games"`},
+		{nearbyEntry{id: "K3M9QZ", people: 40, msgs: 120}, "K3M9QZ: many people, busy"},
+	}
+	for _, tt := range tests {
+		if got := tt.e.describe(); got != tt.want {
+			t.Errorf("describe() = %q, want %q", got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,230 @@
+package main
+
+// This file shows which network a room is for, with -room-network, under the
+// room name in the header and on the admin page. That's the reverse DNS name
+// of the room's address with "rdns", like "gw.example.edu", or the
+// organization that owns it with "asn", like "Example University (AS64500)",
+// from a MaxMind ASN database given with -asn-db. Only rooms for IP
+// addresses have one, and their subrooms show their lobby's.
+//
+// Names are looked up when a room is created, without holding it up, and
+// sent to everyone in it once they're found. They're cached for a while, so
+// rooms that close and open again don't look them up every time, and reverse
+// DNS lookups that take too long are given up on.
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"html/template"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/makeworld-the-better-one/neartalk/events"
+	"github.com/oschwald/maxminddb-golang"
+)
+
+// What -room-network shows.
+const (
+	roomNetworkOff  = "off"
+	roomNetworkRDNS = "rdns"
+	roomNetworkASN  = "asn"
+)
+
+const (
+	// networkLookupTimeout is how long a reverse DNS lookup can take.
+	networkLookupTimeout = 2 * time.Second
+	// networkNameTTL is how long network names are cached.
+	networkNameTTL = time.Hour
+	// networkRetryAfter is how long addresses without a network name are
+	// cached, before they're looked up again.
+	networkRetryAfter = 5 * time.Minute
+	// maxNetworkNames is how many network names are cached at once.
+	maxNetworkNames = 10000
+)
+
+// asnDB is the open ASN database, or nil if it isn't used. It is set by
+// loadASN.
+var asnDB *maxminddb.Reader
+
+// asnRecord holds the parts of an ASN database record that are used.
+type asnRecord struct {
+	Number uint   `maxminddb:"autonomous_system_number"`
+	Org    string `maxminddb:"autonomous_system_organization"`
+}
+
+// validateRoomNetwork returns an error if -room-network is invalid, or can't
+// be used with the other flags.
+func validateRoomNetwork() error {
+	switch roomNetwork {
+	case roomNetworkOff:
+		return nil
+	case roomNetworkRDNS:
+		if roomDisplay != roomDisplayIP {
+			// Like "203-0-113-7.example.net"
+			return errors.New("-room-network rdns can't be used with -room-display, reverse DNS names often have the address in them")
+		}
+	case roomNetworkASN:
+		if asnDBPath == "" {
+			return errors.New("-room-network asn needs an ASN database given with -asn-db")
+		}
+	default:
+		return fmt.Errorf("invalid -room-network %q, must be %q, %q, or %q",
+			roomNetwork, roomNetworkOff, roomNetworkRDNS, roomNetworkASN)
+	}
+	if privateRooms {
+		return errors.New("-room-network can't be used with -private-rooms, the addresses of rooms aren't known")
+	}
+	return nil
+}
+
+// loadASN opens the ASN database at path. An empty path does nothing.
+func loadASN(path string) error {
+	if path == "" {
+		return nil
+	}
+	db, err := maxminddb.Open(path)
+	if err != nil {
+		return err
+	}
+	if !strings.Contains(db.Metadata.DatabaseType, "ASN") {
+		db.Close()
+		return fmt.Errorf("%s is a %s database, but an ASN database is needed", path, db.Metadata.DatabaseType)
+	}
+	asnDB = db
+	return nil
+}
+
+// lookupNetwork returns the network name of the address for -room-network,
+// or an empty string if it doesn't have one.
+func lookupNetwork(ctx context.Context, ip net.IP) string {
+	switch roomNetwork {
+	case roomNetworkRDNS:
+		names, err := net.DefaultResolver.LookupAddr(ctx, ip.String())
+		if err != nil || len(names) == 0 {
+			return ""
+		}
+		return strings.TrimSuffix(names[0], ".")
+	case roomNetworkASN:
+		if asnDB == nil {
+			return ""
+		}
+		var rec asnRecord
+		if err := asnDB.Lookup(ip, &rec); err != nil {
+			log.Printf("lookupNetwork: ASN lookup: %v", err)
+			return ""
+		}
+		if rec.Org == "" {
+			return ""
+		}
+		return fmt.Sprintf("%s (AS%d)", rec.Org, rec.Number)
+	}
+	return ""
+}
+
+// networkName is a cached network name.
+type networkName struct {
+	name    string
+	expires time.Time
+}
+
+// networkNameCache caches the network names of addresses.
+type networkNameCache struct {
+	mu    sync.Mutex
+	names map[string]networkName
+	// lookup finds the name of an address, see lookupNetwork.
+	lookup func(ctx context.Context, ip net.IP) string
+}
+
+func newNetworkNameCache(lookup func(ctx context.Context, ip net.IP) string) *networkNameCache {
+	return &networkNameCache{names: make(map[string]networkName), lookup: lookup}
+}
+
+// networkNames caches the network names of rooms.
+var networkNames = newNetworkNameCache(lookupNetwork)
+
+// get returns the network name of the address, looking it up if it isn't
+// cached. It returns an empty string if there isn't one.
+// It holds the mu, but not while looking it up.
+func (nc *networkNameCache) get(ip net.IP, now time.Time) string {
+	key := ip.String()
+	nc.mu.Lock()
+	n, ok := nc.names[key]
+	nc.mu.Unlock()
+	if ok && now.Before(n.expires) {
+		return n.name
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), networkLookupTimeout)
+	defer cancel()
+	n = networkName{name: nc.lookup(ctx, ip), expires: now.Add(networkNameTTL)}
+	if n.name == "" {
+		n.expires = now.Add(networkRetryAfter)
+	}
+
+	nc.mu.Lock()
+	defer nc.mu.Unlock()
+	if len(nc.names) >= maxNetworkNames {
+		for k, old := range nc.names {
+			if !now.Before(old.expires) {
+				delete(nc.names, k)
+			}
+		}
+		if len(nc.names) >= maxNetworkNames {
+			// Still full, start again
+			nc.names = make(map[string]networkName)
+		}
+	}
+	nc.names[key] = n
+	return n.name
+}
+
+// networkAddr returns the address of the room with the key for -room-network,
+// which is its lobby's for subrooms, or nil if it isn't a room for an
+// address.
+func networkAddr(key string) net.IP {
+	if lobby, _, ok := splitSubroomKey(key); ok {
+		key = lobby
+	}
+	return net.ParseIP(key)
+}
+
+// findNetwork looks up the room's network name, and sends it to everyone in
+// the room if there is one. It's run in its own goroutine when the room is
+// created.
+// It holds the client mutex, but not while looking it up.
+func (cr *chatRoom) findNetwork() {
+	ip := networkAddr(cr.key)
+	if ip == nil {
+		return
+	}
+	name := networkNames.get(ip, time.Now())
+	if name == "" {
+		return
+	}
+	cr.clientsMu.Lock()
+	defer cr.clientsMu.Unlock()
+	cr.network = name
+	for c := range cr.clients {
+		cr.sendNetwork(c)
+	}
+}
+
+// sendNetwork tells the client the room's network name, after it was found.
+// JSON clients get the room event again.
+// It does not lock the clientsMu, callers should do that.
+func (cr *chatRoom) sendNetwork(c *client) {
+	if c.isJSON() {
+		c.sendEvent(events.TypeRoom, events.Room{Name: roomTitle(cr.key), Nick: c.nick, Topic: cr.topic, Network: cr.network})
+	} else {
+		c.sendText(createNetworkMsg(cr.network))
+	}
+}
+
+// createNetworkMsg returns the room header line with the network name.
+func createNetworkMsg(network string) string {
+	return fmt.Sprintf(`<p id="room-network" hx-swap-oob="true">%s</p>`, template.HTMLEscapeString(network))
+}
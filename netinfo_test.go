@@ -0,0 +1,65 @@
+package main
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestNetworkNameCache(t *testing.T) {
+	lookups := 0
+	nc := newNetworkNameCache(func(ctx context.Context, ip net.IP) string {
+		lookups++
+		if ip.Equal(net.ParseIP("203.0.113.7")) {
+			return "gw.example.edu"
+		}
+		return ""
+	})
+	now := time.Now()
+	for i := 0; i < 2; i++ {
+		if got := nc.get(net.ParseIP("203.0.113.7"), now); got != "gw.example.edu" {
+			t.Errorf("got %q", got)
+		}
+		if got := nc.get(net.ParseIP("198.51.100.1"), now); got != "" {
+			t.Errorf("address without a name got %q", got)
+		}
+	}
+	if lookups != 2 {
+		t.Errorf("looked up %d times, want the names cached", lookups)
+	}
+	nc.get(net.ParseIP("198.51.100.1"), now.Add(networkRetryAfter))
+	nc.get(net.ParseIP("203.0.113.7"), now.Add(networkRetryAfter))
+	if lookups != 3 {
+		t.Errorf("looked up %d times, want only the missing name looked up again", lookups)
+	}
+}
+
+func TestValidateRoomNetwork(t *testing.T) {
+	defer func(n, d, a string, p bool) { roomNetwork, roomDisplay, asnDBPath, privateRooms = n, d, a, p }(roomNetwork, roomDisplay, asnDBPath, privateRooms)
+	tests := []struct {
+		network, display, asn string
+		private               bool
+		ok                    bool
+	}{
+		{roomNetworkOff, roomDisplayName, "", true, true},
+		{roomNetworkRDNS, roomDisplayIP, "", false, true},
+		{roomNetworkRDNS, roomDisplayName, "", false, false},
+		{roomNetworkASN, roomDisplayName, "asn.mmdb", false, true},
+		{roomNetworkASN, roomDisplayIP, "", false, false},
+		{roomNetworkASN, roomDisplayIP, "asn.mmdb", true, false},
+		{"whois", roomDisplayIP, "", false, false},
+	}
+	for _, tt := range tests {
+		roomNetwork, roomDisplay, asnDBPath, privateRooms = tt.network, tt.display, tt.asn, tt.private
+		if err := validateRoomNetwork(); (err == nil) != tt.ok {
+			t.Errorf("%+v: got %v", tt, err)
+		}
+	}
+	if ip := networkAddr("203.0.113.7#music"); !ip.Equal(net.ParseIP("203.0.113.7")) {
+		t.Errorf("subroom network address = %v", ip)
+	}
+	if networkAddr("University") != nil {
+		t.Error("a room alias has a network address")
+	}
+}
@@ -1,21 +1,99 @@
 package main
 
+// This file makes the random nicknames people get when they join, like
+// "AbleAardvark". By default they're an adjective and an animal from the data
+// package, but the operator can give their own wordlists in the config file,
+// for a different theme. A nickname gets one word from each list, in order,
+// so ["colors.txt", "fruits.txt"] makes nicknames like "TealMango".
+
 import (
+	"bufio"
 	"fmt"
 	"math/rand"
+	"os"
 	"strings"
+	"unicode"
 
 	"github.com/makeworld-the-better-one/neartalk/data"
 )
 
-// genNick returns a new random nickname.
+// maxNickLists is the most wordlists nicknames can be made from.
+const maxNickLists = 4
+
+// defaultNickLists are the wordlists used when the config doesn't have any.
+var defaultNickLists = [][]string{data.Adjectives, data.Animals}
+
+// isNickWord returns true if w can be part of a nickname: letters and
+// numbers, with hyphens or underscores in between.
+func isNickWord(w string) bool {
+	for _, r := range w {
+		if !unicode.IsLetter(r) && !unicode.IsDigit(r) && !unicode.IsMark(r) && r != '-' && r != '_' {
+			return false
+		}
+	}
+	return w != ""
+}
+
+// loadNickList reads a wordlist file, which has one word per line. Blank
+// lines and lines starting with # are skipped.
+func loadNickList(path string) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var words []string
+	sc := bufio.NewScanner(f)
+	for line := 1; sc.Scan(); line++ {
+		w := strings.TrimSpace(sc.Text())
+		if w == "" || strings.HasPrefix(w, "#") {
+			continue
+		}
+		if !isNickWord(w) {
+			return nil, fmt.Errorf("%s:%d: %q can't be in a nickname, use letters and numbers only", path, line, w)
+		}
+		words = append(words, w)
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+	if len(words) == 0 {
+		return nil, fmt.Errorf("%s has no words", path)
+	}
+	return words, nil
+}
+
+// loadNickLists reads the wordlist files, see loadNickList.
+func loadNickLists(paths []string) ([][]string, error) {
+	if len(paths) > maxNickLists {
+		return nil, fmt.Errorf("nicknames can be made from at most %d wordlists", maxNickLists)
+	}
+	lists := make([][]string, len(paths))
+	for i, path := range paths {
+		var err error
+		if lists[i], err = loadNickList(path); err != nil {
+			return nil, err
+		}
+	}
+	return lists, nil
+}
+
+// genNick returns a new random nickname, with a word from each of the
+// wordlists in the config. It's sanitized, so it fits in maxNickLen.
 func genNick() string {
-	adjective := data.Adjectives[rand.Intn(len(data.Adjectives))]
-	animal := data.Animals[rand.Intn(len(data.Animals))]
+	lists := currentConfig().nickLists
+	if len(lists) == 0 {
+		lists = defaultNickLists
+	}
+	words := make([]string, len(lists))
+	for i, list := range lists {
+		words[i] = list[rand.Intn(len(list))]
+	}
 
 	// Convert to CamelCase
-	return strings.ReplaceAll(
-		strings.Title(fmt.Sprintf("%s %s", adjective, animal)),
+	return sanitizeNick(strings.ReplaceAll(
+		strings.Title(strings.Join(words, " ")),
 		" ", "",
-	)
+	))
 }
@@ -0,0 +1,101 @@
+package main
+
+// This file sends notifications to the server operator, through a webhook
+// and/or email, depending on what's configured.
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/smtp"
+	"strings"
+	"time"
+)
+
+// notifyTimeout is the max time sending one notification can take.
+const notifyTimeout = 10 * time.Second
+
+// notifyConfigured returns true if there's any way to notify the operator.
+func notifyConfigured() bool {
+	return notifyWebhook != "" || notifyEmail != ""
+}
+
+// notifyOperator sends a notification with the given subject and body to
+// every configured channel. The first error is returned, but all channels
+// are tried.
+func notifyOperator(subject, body string) error {
+	var firstErr error
+	if notifyWebhook != "" {
+		if err := sendWebhook(subject, body); err != nil {
+			firstErr = fmt.Errorf("webhook: %w", err)
+		}
+	}
+	if notifyEmail != "" {
+		if err := sendEmail(subject, body); err != nil && firstErr == nil {
+			firstErr = fmt.Errorf("email: %w", err)
+		}
+	}
+	return firstErr
+}
+
+// sendWebhook POSTs the notification as JSON. The "text" field makes it work
+// with Slack and Mattermost incoming webhooks, and "content" with Discord.
+func sendWebhook(subject, body string) error {
+	text := subject + "\n\n" + body
+	b, err := json.Marshal(map[string]string{
+		"subject": subject,
+		"body":    body,
+		"text":    text,
+		"content": text,
+	})
+	if err != nil {
+		return err
+	}
+	return postJSON(notifyWebhook, b)
+}
+
+// postJSON POSTs the JSON to the URL, and returns an error if it doesn't
+// succeed within notifyTimeout.
+func postJSON(url string, b []byte) error {
+	ctx, cancel := context.WithTimeout(context.Background(), notifyTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return nil
+}
+
+// sendEmail sends the notification as a plain text email through the
+// configured SMTP server.
+func sendEmail(subject, body string) error {
+	host, _, err := net.SplitHostPort(smtpAddr)
+	if err != nil {
+		return fmt.Errorf("invalid SMTP address: %w", err)
+	}
+	var auth smtp.Auth
+	if smtpUser != "" {
+		auth = smtp.PlainAuth("", smtpUser, smtpPass, host)
+	}
+	from := smtpFrom
+	if from == "" {
+		from = "neartalk@" + host
+	}
+	msg := fmt.Sprintf(
+		"From: %s\r\nTo: %s\r\nSubject: %s\r\nContent-Type: text/plain; charset=utf-8\r\n\r\n%s\r\n",
+		from, notifyEmail, subject, strings.ReplaceAll(body, "\n", "\r\n"),
+	)
+	return smtp.SendMail(smtpAddr, auth, from, []string{notifyEmail}, []byte(msg))
+}
@@ -0,0 +1,132 @@
+package main
+
+// This file handles notification preferences: which chat messages someone
+// wants to be notified of (all of them, only mentions, or none), and whether
+// notifications play a sound. Clients set them over the websocket, they're
+// stored with the session's settings, and they're honored when composing
+// what each client is sent. A client that turned notifications off isn't
+// sent any alerts or push notifications at all, rather than being trusted to
+// ignore them.
+
+import (
+	"fmt"
+	"html/template"
+	"time"
+
+	"github.com/makeworld-the-better-one/neartalk/events"
+)
+
+// Values of the notify preference.
+const (
+	notifyAll      = "all"
+	notifyMentions = "mentions"
+	notifyOff      = "off"
+)
+
+// notifyPrefs is a client's notification preferences.
+type notifyPrefs struct {
+	notify string
+	sound  bool
+}
+
+func isValidNotify(notify string) bool {
+	return notify == notifyAll || notify == notifyMentions || notify == notifyOff
+}
+
+// prefsOf returns the notification preferences in the settings, with the
+// defaults filled in.
+func prefsOf(ss sessionSettings) notifyPrefs {
+	p := notifyPrefs{notify: ss.Notify, sound: ss.Sound}
+	if !isValidNotify(p.notify) {
+		p.notify = notifyMentions
+	}
+	return p
+}
+
+// wantsAlert returns true if the preferences want an alert for a chat
+// message by someone else.
+func (p notifyPrefs) wantsAlert(mentioned bool) bool {
+	return p.notify == notifyAll || (mentioned && p.notify == notifyMentions)
+}
+
+// notifyPrefs returns the client's notification preferences.
+func (c *client) notifyPrefs() notifyPrefs {
+	c.activityMu.Lock()
+	defer c.activityMu.Unlock()
+	return c.prefs
+}
+
+// chatAlert is what clients need to alert the user about a chat message.
+type chatAlert struct {
+	ID string `json:"id"`
+	// Nick is the author's nickname, sanitized.
+	Nick string `json:"nick"`
+	// Text is the message text with spoilers hidden, unsanitized.
+	Text string    `json:"text"`
+	Time time.Time `json:"time"`
+}
+
+// newChatAlert returns the alert for the chat message.
+func newChatAlert(m msg) *chatAlert {
+	return &chatAlert{ID: m.id, Nick: m.nick, Text: hideSpoilers(m.text), Time: m.when}
+}
+
+// createAlertMsg creates the HTML that tells the web UI to alert the user
+// about a message, so it can show a notification and play a sound.
+func createAlertMsg(a *chatAlert, mention, sound bool) string {
+	return fmt.Sprintf(`<div id="alert" data-msg-id="%s" data-nick="%s" data-text="%s" data-mention="%t" data-sound="%t" hx-swap-oob="true"></div>`,
+		a.ID, a.Nick, template.HTMLEscapeString(a.Text), mention, sound)
+}
+
+// createPrefsMsg creates the HTML that tells the web UI the current
+// notification preferences.
+func createPrefsMsg(p notifyPrefs) string {
+	return fmt.Sprintf(`<div id="prefs" data-notify="%s" data-sound="%t" hx-swap-oob="true"></div>`, p.notify, p.sound)
+}
+
+// sendPrefs sends the client its notification preferences, in its protocol.
+func (c *client) sendPrefs(p notifyPrefs) {
+	if c.isJSON() {
+		c.sendFrame(encodeEvent(events.TypePrefs, events.Prefs{Notify: p.notify, Sound: p.sound}))
+	} else {
+		c.sendFrame(createPrefsMsg(p))
+	}
+}
+
+// setNotifyPrefs handles a client changing its notification preferences.
+// An empty notify or sound is left as it was. The preferences are stored for
+// the session, and every client of the session in the room is updated, so
+// other tabs follow along.
+// It holds the client mutex.
+func (cr *chatRoom) setNotifyPrefs(c *client, notify, sound string) {
+	if notify != "" && !isValidNotify(notify) {
+		c.sendError("Unknown notification preference, use one of: all, mentions, off")
+		return
+	}
+	if sound != "" && sound != "on" && sound != "off" {
+		c.sendError("Sound must be on or off")
+		return
+	}
+	var p notifyPrefs
+	cr.server.settings.update(c.session, func(ss *sessionSettings) {
+		if notify != "" {
+			ss.Notify = notify
+		}
+		if sound != "" {
+			ss.Sound = sound == "on"
+		}
+		p = prefsOf(*ss)
+	})
+
+	cr.clientsMu.Lock()
+	defer cr.clientsMu.Unlock()
+	for other := range cr.clients {
+		if other.session != c.session {
+			continue
+		}
+		other.activityMu.Lock()
+		other.prefs = p
+		other.activityMu.Unlock()
+		other.sendPrefs(p)
+	}
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestDeliverAlerts(t *testing.T) {
+	b := broadcast{
+		html:      `<tr><td><bdi class="mention">@bob</bdi> hi</td></tr>`,
+		isChat:    true,
+		id:        "01A",
+		mentioned: []string{"bob"},
+		alert:     &chatAlert{ID: "01A", Nick: "ann", Text: "@bob hi"},
+	}
+	tests := []struct {
+		nick  string
+		prefs notifyPrefs
+		want  string
+	}{
+		{"bob", notifyPrefs{notify: notifyMentions}, `data-mention="true" data-sound="false"`},
+		{"bob", notifyPrefs{notify: notifyOff, sound: true}, ""},
+		{"cat", notifyPrefs{notify: notifyMentions}, ""},
+		{"cat", notifyPrefs{notify: notifyAll, sound: true}, `data-mention="false" data-sound="true"`},
+	}
+	for _, tt := range tests {
+		c := &client{nick: tt.nick, prefs: tt.prefs, active: true, outgoing: make(chan string, 1)}
+		c.deliver(b, false)
+		got := <-c.outgoing
+		if tt.want == "" {
+			if strings.Contains(got, `id="alert"`) {
+				t.Errorf("%s with %+v was alerted: %s", tt.nick, tt.prefs, got)
+			}
+		} else if !strings.Contains(got, tt.want) {
+			t.Errorf("%s with %+v got %s, want alert with %s", tt.nick, tt.prefs, got, tt.want)
+		}
+	}
+
+	// Authors are never alerted about their own messages
+	c := &client{nick: "ann", prefs: notifyPrefs{notify: notifyAll}, outgoing: make(chan string, 1)}
+	c.deliver(b, true)
+	if got := <-c.outgoing; strings.Contains(got, `id="alert"`) {
+		t.Errorf("author was alerted: %s", got)
+	}
+}
+
+func TestPrefsOf(t *testing.T) {
+	if p := prefsOf(sessionSettings{}); p != (notifyPrefs{notify: notifyMentions}) {
+		t.Errorf("default prefs = %+v", p)
+	}
+	if p := prefsOf(sessionSettings{Notify: "all", Sound: true}); p != (notifyPrefs{notify: notifyAll, sound: true}) {
+		t.Errorf("prefs = %+v", p)
+	}
+}
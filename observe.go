@@ -0,0 +1,134 @@
+package main
+
+// This file lets the admin watch a room, for responding to abuse reports. The
+// admin page links to /admin-room for each room, which shows the messages sent
+// in it live, read-only. The admin is connected as an observer, which gets
+// everything sent to the room but isn't a member of it: observers never
+// appear in the user list, can't send anything, and don't keep the room
+// open. Every time someone starts watching a room it's logged, and the privacy
+// policy tells users it can happen.
+
+import (
+	"errors"
+	"fmt"
+	"html/template"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+
+	"nhooyr.io/websocket"
+)
+
+// addObserver adds the client to the room with the key as an observer, and
+// sends it the user list. It returns false if there is no such room.
+func (cs *chatServer) addObserver(key string, c *client) (*chatRoom, bool) {
+	cs.roomsMu.Lock()
+	defer cs.roomsMu.Unlock()
+	room, ok := cs.rooms[key]
+	if !ok {
+		return nil, false
+	}
+	room.clientsMu.Lock()
+	defer room.clientsMu.Unlock()
+	room.observers[c] = struct{}{}
+	c.sendFrame(createUserListMsg(room.users()))
+	return room, true
+}
+
+// removeObserver removes the observer from the room. It holds the client
+// mutex.
+func (cr *chatRoom) removeObserver(c *client) {
+	cr.clientsMu.Lock()
+	defer cr.clientsMu.Unlock()
+	delete(cr.observers, c)
+}
+
+// closeObservers disconnects everyone watching the room, because it closed.
+// It does not lock the clientsMu, callers should do that.
+func (cr *chatRoom) closeObservers() {
+	for c := range cr.observers {
+		go c.disconnect(websocket.StatusNormalClosure, "chat room closed")
+	}
+	cr.observers = make(map[*client]struct{})
+}
+
+// adminWatchLink returns the admin page link to watch the room. The page is
+// titled with the room's name from roomTitle.
+func adminWatchLink(key string) string {
+	return fmt.Sprintf(`<p><a href="/admin-room?room=%s&name=%s" target="_blank">Watch live</a></p>`,
+		template.HTMLEscapeString(url.QueryEscape(key)), template.HTMLEscapeString(url.QueryEscape(roomTitle(key))))
+}
+
+// adminRoomHandler serves the page for watching a room.
+func (cs *chatServer) adminRoomHandler(w http.ResponseWriter, r *http.Request) {
+	if !cs.isAdmin(r) {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	f, err := os.Open("html/admin-room.html")
+	if err != nil {
+		log.Printf("chatServer.adminRoomHandler: err opening admin-room.html: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	defer f.Close()
+	io.Copy(w, f)
+}
+
+// adminRoomWSHandler connects the room watching page to the room as an
+// observer.
+func (cs *chatServer) adminRoomWSHandler(w http.ResponseWriter, r *http.Request) {
+	keyID, ok := cs.adminSession(r)
+	if !ok {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	key := r.URL.Query().Get("room")
+	conn, err := acceptWS(w, r, nil)
+	if err != nil {
+		log.Printf("chatServer.adminRoomWSHandler: websocket accept error: %v", err)
+		return
+	}
+	defer conn.Close(websocket.StatusInternalError, "")
+	t := newWSTransport(r.Context(), conn)
+
+	cl := &client{
+		proto:    protoHTML,
+		outgoing: make(chan string, clientMsgBuffer),
+		// So nothing is counted as unread
+		active: true,
+		closeSlow: func() {
+			t.close(websocket.StatusPolicyViolation, "connection too slow to keep up with messages")
+		},
+		disconnect: t.close,
+	}
+	room, ok := cs.addObserver(key, cl)
+	if !ok {
+		t.close(websocket.StatusNormalClosure, "that chat room is gone")
+		return
+	}
+	defer room.removeObserver(cl)
+	cs.audit.record(keyID, auditWatch, key, "")
+	defer log.Printf("chatServer.adminRoomWSHandler: admin with key %s stopped watching room %s", keyID, key)
+
+	for {
+		select {
+		case text := <-cl.outgoing:
+			err := t.send(r.Context(), text)
+			var wte *writeTimeoutError
+			if errors.As(err, &wte) {
+				t.close(websocket.StatusPolicyViolation, err.Error())
+				return
+			}
+			if err != nil {
+				return
+			}
+		case <-t.received():
+			// Observers can't send anything
+		case <-t.done():
+			return
+		}
+	}
+}
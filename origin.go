@@ -0,0 +1,123 @@
+package main
+
+// This file stops other sites from using NearTalk through their visitors'
+// browsers. Websockets, Server-Sent Events streams and POSTs are only
+// accepted from pages on the server's own host, or an origin listed in
+// -allowed-origins, like a site that embeds its own front-end. Requests
+// without an Origin header, like from bots, are let through, since they don't
+// come from a web page.
+//
+// The admin pages also put a CSRF token made from the admin's session in
+// every POST, which adminSession checks, so admin actions can't be forged
+// even by browsers that don't send the Origin header.
+
+import (
+	"crypto/hmac"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"nhooyr.io/websocket"
+)
+
+// csrfHeader is the header the admin page sends the CSRF token in. Plain
+// forms send it as the csrfField form value instead.
+const (
+	csrfHeader = "X-CSRF-Token"
+	csrfField  = "csrf"
+)
+
+// originList returns the origins in a comma-separated flag value, like
+// -allowed-origins.
+func originList(s string) []string {
+	var origins []string
+	for _, o := range strings.Split(s, ",") {
+		if o = strings.TrimSpace(o); o != "" {
+			origins = append(origins, strings.TrimSuffix(o, "/"))
+		}
+	}
+	return origins
+}
+
+// validateOrigins returns an error if the origins in the flag value aren't
+// all "*" or a scheme and host, like "https://example.com".
+func validateOrigins(flagName, s string) error {
+	for _, o := range originList(s) {
+		if o == "*" {
+			continue
+		}
+		u, err := url.Parse(o)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" ||
+			u.Path != "" || u.RawQuery != "" || u.Fragment != "" || u.User != nil {
+			return fmt.Errorf("invalid origin %q in %s, must look like https://example.com", o, flagName)
+		}
+	}
+	return nil
+}
+
+// originAllowed returns true if the request has no Origin header, or it's
+// the server's own host or in -allowed-origins.
+func originAllowed(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	if u, err := url.Parse(origin); err == nil && strings.EqualFold(u.Host, r.Host) {
+		return true
+	}
+	for _, o := range originList(allowedOrigins) {
+		if o == "*" || strings.EqualFold(o, origin) {
+			return true
+		}
+	}
+	return false
+}
+
+// refuseOrigin responds with 403 Forbidden and returns true if the request
+// is from a page whose origin isn't allowed to make it. Requests that can't
+// change anything, like GETs other than websockets and event streams, are
+// always allowed, as are API requests, which use tokens instead of cookies.
+func refuseOrigin(w http.ResponseWriter, r *http.Request) bool {
+	switch r.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		if !isWebsocketUpgrade(r) && r.URL.Path != "/sse" {
+			return false
+		}
+	}
+	if strings.HasPrefix(r.URL.Path, "/api/") || originAllowed(r) {
+		return false
+	}
+	http.Error(w, "origin not allowed", http.StatusForbidden)
+	return true
+}
+
+// acceptWS accepts a websocket connection whose origin has already been
+// checked by refuseOrigin.
+func acceptWS(w http.ResponseWriter, r *http.Request, opts *websocket.AcceptOptions) (*websocket.Conn, error) {
+	o := websocket.AcceptOptions{InsecureSkipVerify: true}
+	if opts != nil {
+		o = *opts
+		o.InsecureSkipVerify = true
+	}
+	return websocket.Accept(w, r, &o)
+}
+
+// csrfToken returns the CSRF token for the admin session cookie value.
+func (ks *adminKeyStore) csrfToken(session string) string {
+	return ks.sign("csrf." + session)
+}
+
+// checkCSRF returns true if the request is safe, or it has the CSRF token for
+// the admin session cookie value.
+func (ks *adminKeyStore) checkCSRF(r *http.Request, session string) bool {
+	switch r.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		return true
+	}
+	token := r.Header.Get(csrfHeader)
+	if token == "" {
+		token = r.PostFormValue(csrfField)
+	}
+	return hmac.Equal([]byte(token), []byte(ks.csrfToken(session)))
+}
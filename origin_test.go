@@ -0,0 +1,91 @@
+package main
+
+import (
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestOriginAllowed(t *testing.T) {
+	defer func(o string) { allowedOrigins = o }(allowedOrigins)
+	allowedOrigins = "https://example.com, http://localhost:3000/"
+
+	for _, tt := range []struct {
+		origin string
+		ok     bool
+	}{
+		{"", true},
+		{"https://chat.example.net", true},
+		{"http://CHAT.example.net", true},
+		{"https://example.com", true},
+		{"http://localhost:3000", true},
+		{"http://example.com", false},
+		{"https://evil.example", false},
+		{"null", false},
+	} {
+		r := httptest.NewRequest("GET", "https://chat.example.net/connect", nil)
+		if tt.origin != "" {
+			r.Header.Set("Origin", tt.origin)
+		}
+		if got := originAllowed(r); got != tt.ok {
+			t.Errorf("originAllowed() from %q = %v, want %v", tt.origin, got, tt.ok)
+		}
+	}
+
+	allowedOrigins = "*"
+	r := httptest.NewRequest("GET", "https://chat.example.net/connect", nil)
+	r.Header.Set("Origin", "https://evil.example")
+	if !originAllowed(r) {
+		t.Error("* didn't allow every origin")
+	}
+}
+
+func TestValidateOrigins(t *testing.T) {
+	for _, tt := range []struct {
+		origins string
+		ok      bool
+	}{
+		{"", true},
+		{"*", true},
+		{"https://example.com, http://localhost:3000", true},
+		{"example.com", false},
+		{"https://example.com/chat", false},
+		{"ftp://example.com", false},
+	} {
+		if err := validateOrigins("-allowed-origins", tt.origins); (err == nil) != tt.ok {
+			t.Errorf("validateOrigins(%q) = %v", tt.origins, err)
+		}
+	}
+}
+
+func TestCheckCSRF(t *testing.T) {
+	ks := newAdminKeyStore()
+	session := ks.newSession(mainAdminKeyID, "key", time.Now().Add(time.Hour))
+	token := ks.csrfToken(session)
+	if token == ks.csrfToken(session+"x") {
+		t.Error("different sessions have the same token")
+	}
+
+	if !ks.checkCSRF(httptest.NewRequest("GET", "/admin-motd", nil), session) {
+		t.Error("GET needed a CSRF token")
+	}
+	r := httptest.NewRequest("POST", "/admin-motd", nil)
+	if ks.checkCSRF(r, session) {
+		t.Error("POST without a token was allowed")
+	}
+	r.Header.Set(csrfHeader, token)
+	if !ks.checkCSRF(r, session) {
+		t.Error("POST with the token in the header was refused")
+	}
+	r = httptest.NewRequest("POST", "/admin-logout", strings.NewReader(url.Values{csrfField: {token}}.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if !ks.checkCSRF(r, session) {
+		t.Error("POST with the token in the form was refused")
+	}
+	r.Header.Set(csrfHeader, "wrong")
+	if ks.checkCSRF(r, session) {
+		t.Error("POST with the wrong token was allowed")
+	}
+}
@@ -0,0 +1,102 @@
+package main
+
+// This file paces how fast new connections are accepted. At the start of an
+// event, hundreds of people can scan the same QR code at once, and accepting
+// them all in the same moment spikes the CPU, which makes the server too slow
+// for the clients already connected, and they get kicked for being slow. So
+// new connections take turns from a token bucket (-accept-rate and
+// -accept-burst). A connection waits up to acceptMaxWait for its turn, and
+// beyond that is sent a page asking to retry shortly.
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// acceptMaxWait is the longest a new connection waits to be accepted.
+const acceptMaxWait = 5 * time.Second
+
+// acceptRetryAfter is how long clients turned away are asked to wait.
+const acceptRetryAfter = 10 * time.Second
+
+// turnedAway counts connections refused for being over the accept rate since
+// the server started.
+var turnedAway atomic.Int64
+
+// newAcceptLimiter returns the limiter for new connections.
+func newAcceptLimiter() *rate.Limiter {
+	c := currentConfig()
+	return rate.NewLimiter(acceptLimit(c.AcceptRate), acceptBurstOf(c.AcceptBurst))
+}
+
+// acceptLimit returns the limit for new connections per second, where 0 or
+// less means they aren't paced.
+func acceptLimit(perSecond float64) rate.Limit {
+	if perSecond <= 0 {
+		return rate.Inf
+	}
+	return rate.Limit(perSecond)
+}
+
+// acceptBurstOf returns the burst for new connections, which has to be at
+// least 1 for any to be accepted.
+func acceptBurstOf(burst int) int {
+	if burst < 1 {
+		return 1
+	}
+	return burst
+}
+
+// paceAccept waits for the request's turn to connect. If the wait would be
+// longer than acceptMaxWait, or the request is cancelled, it responds with
+// the busy page and returns false.
+func (cs *chatServer) paceAccept(w http.ResponseWriter, r *http.Request) bool {
+	if cs.accepts == nil {
+		return true
+	}
+	res := cs.accepts.Reserve()
+	delay := res.Delay()
+	if delay > acceptMaxWait {
+		res.Cancel()
+		turnedAway.Add(1)
+		busyHandler(w, r)
+		return false
+	}
+	if delay == 0 {
+		return true
+	}
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-r.Context().Done():
+		res.Cancel()
+		return false
+	}
+}
+
+// busyHandler responds with a page telling the visitor the server is busy,
+// which reloads itself after acceptRetryAfter.
+func busyHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Retry-After", strconv.Itoa(int(acceptRetryAfter.Seconds())))
+	busyHtml, err := os.Open("html/busy.html")
+	if err != nil {
+		log.Printf("busyHandler: err opening busy.html: %v", err)
+		http.Error(w, fmt.Sprintf("The server is busy, try again in %v.", acceptRetryAfter),
+			http.StatusServiceUnavailable)
+		return
+	}
+	defer busyHtml.Close()
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(http.StatusServiceUnavailable)
+	io.Copy(w, busyHtml)
+}
@@ -0,0 +1,32 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+func TestPaceAccept(t *testing.T) {
+	cs := &chatServer{accepts: rate.NewLimiter(rate.Every(time.Hour), 1)}
+	before := turnedAway.Load()
+
+	rec := httptest.NewRecorder()
+	if !cs.paceAccept(rec, httptest.NewRequest(http.MethodGet, "/connect", nil)) {
+		t.Fatal("first connection wasn't accepted")
+	}
+
+	// The next turn is an hour away, far beyond acceptMaxWait
+	rec = httptest.NewRecorder()
+	if cs.paceAccept(rec, httptest.NewRequest(http.MethodGet, "/connect", nil)) {
+		t.Fatal("connection over the rate was accepted")
+	}
+	if rec.Code != http.StatusServiceUnavailable || rec.Header().Get("Retry-After") == "" {
+		t.Errorf("turned away with status %d and Retry-After %q", rec.Code, rec.Header().Get("Retry-After"))
+	}
+	if turnedAway.Load() != before+1 {
+		t.Errorf("turnedAway = %d, want %d", turnedAway.Load(), before+1)
+	}
+}
@@ -0,0 +1,251 @@
+package main
+
+// This file has the long polling transport, the last resort for proxies that
+// block websockets and buffer streamed responses. The client opens a
+// connection with POST /poll, which responds with {"id": "..."}. It then
+// repeatedly requests GET /poll?id=..., which waits until there are frames to
+// send and responds with {"frames": [...]}. Once the connection has been
+// closed and every frame has been fetched, the response is
+// {"frames": [], "closed": true, "reason": "..."} instead. Messages are sent
+// with POST /poll/send?id=..., like for SSE.
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/makeworld-the-better-one/neartalk/ids"
+	"nhooyr.io/websocket"
+)
+
+// pollWait is the longest a poll request waits for frames before responding
+// with none. It's kept well below common proxy timeouts.
+const pollWait = 25 * time.Second
+
+// pollIdleTimeout is how long a client can go without polling before it's
+// disconnected.
+const pollIdleTimeout = 60 * time.Second
+
+// maxPollBacklog is how many frames can wait to be polled before the client
+// is disconnected for being too slow.
+const maxPollBacklog = 256
+
+var errStoppedPolling = errors.New("stopped polling")
+
+// pollTransport is a long polling connection.
+type pollTransport struct {
+	incoming chan htmxJson
+	// ready receives a value when there are new frames or the connection has
+	// been closed, to wake up a waiting poll.
+	ready chan struct{}
+
+	// mu protects the fields below.
+	mu sync.Mutex
+	// pending holds the frames that haven't been polled yet.
+	pending []string
+	// lastPoll is when a poll request last started or finished.
+	lastPoll time.Time
+	// polling is how many poll requests are waiting.
+	polling int
+	// reason is why the connection was closed.
+	reason string
+
+	// ctx is cancelled when the connection is closed.
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+func newPollTransport() *pollTransport {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &pollTransport{
+		incoming: make(chan htmxJson, serverMsgBuffer),
+		ready:    make(chan struct{}, 1),
+		lastPoll: time.Now(),
+		ctx:      ctx,
+		cancel:   cancel,
+	}
+}
+
+// wake wakes up a waiting poll, if there is one.
+func (t *pollTransport) wake() {
+	select {
+	case t.ready <- struct{}{}:
+	default:
+	}
+}
+
+func (t *pollTransport) send(ctx context.Context, text string) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.ctx.Err() != nil {
+		return t.ctx.Err()
+	}
+	if len(t.pending) >= maxPollBacklog {
+		return &writeTimeoutError{"too many messages waiting to be polled"}
+	}
+	t.pending = append(t.pending, text)
+	t.wake()
+	return nil
+}
+
+func (t *pollTransport) received() <-chan htmxJson {
+	return t.incoming
+}
+
+func (t *pollTransport) done() <-chan struct{} {
+	return t.ctx.Done()
+}
+
+func (t *pollTransport) close(code websocket.StatusCode, reason string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.ctx.Err() == nil {
+		t.reason = reason
+		t.cancel()
+		t.wake()
+	}
+}
+
+// ping fails if the connection was closed, or the client stopped polling.
+func (t *pollTransport) ping(ctx context.Context) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.ctx.Err() != nil {
+		return t.ctx.Err()
+	}
+	if t.polling == 0 && time.Since(t.lastPoll) > pollIdleTimeout {
+		return errStoppedPolling
+	}
+	return nil
+}
+
+// poll waits up to pollWait for frames and returns them. If there are none
+// because the connection was closed, it returns the reason and true.
+func (t *pollTransport) poll(ctx context.Context) (frames []string, reason string, closed bool) {
+	t.mu.Lock()
+	t.polling++
+	t.lastPoll = time.Now()
+	waiting := len(t.pending) == 0 && t.ctx.Err() == nil
+	t.mu.Unlock()
+
+	if waiting {
+		timer := time.NewTimer(pollWait)
+		select {
+		case <-t.ready:
+		case <-timer.C:
+		case <-ctx.Done():
+		}
+		timer.Stop()
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.polling--
+	t.lastPoll = time.Now()
+	frames, t.pending = t.pending, nil
+	if len(frames) == 0 && t.ctx.Err() != nil {
+		return nil, t.reason, true
+	}
+	return frames, "", false
+}
+
+// watchIdle closes the connection once the client stops polling.
+func (t *pollTransport) watchIdle() {
+	ticker := time.NewTicker(pollIdleTimeout / 4)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			t.mu.Lock()
+			idle := t.polling == 0 && time.Since(t.lastPoll) > pollIdleTimeout
+			t.mu.Unlock()
+			if idle {
+				t.close(websocket.StatusGoingAway, errStoppedPolling.Error())
+				return
+			}
+		case <-t.ctx.Done():
+			return
+		}
+	}
+}
+
+// pollHandler opens long polling connections on POST, and waits for frames
+// from them on GET.
+func (cs *chatServer) pollHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodPost:
+		cs.openPoll(w, r)
+	case http.MethodGet:
+		cs.waitPoll(w, r)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+// openPoll creates a client for a new long polling connection. The client
+// lives on between requests, until it's closed or stops polling.
+func (cs *chatServer) openPoll(w http.ResponseWriter, r *http.Request) {
+	if !cs.paceAccept(w, r) {
+		return
+	}
+	proto := protoHTML
+	if r.URL.Query().Get("proto") == protoJSON {
+		proto = protoJSON
+	}
+	session := getSession(w, r)
+	release, ok := cs.requireChallenge(w, r, session)
+	if !ok {
+		return
+	}
+	lang := matchLang(r.Header.Get("Accept-Language"))
+	ip, ok := cs.connectRoomKey(w, r, session)
+	addr := connAddr(r)
+	if !ok {
+		release()
+		return
+	}
+
+	t := newPollTransport()
+	id := ids.Token()
+	cs.addHTTPConn(id, &httpConn{session: session, incoming: t.incoming, poll: t})
+	go t.watchIdle()
+	go func() {
+		defer release()
+		err := cs.connect(t.ctx, ip, addr, session, proto, lang, nil, t)
+		if err != nil && !errors.Is(err, context.Canceled) && !errors.Is(err, errHeartbeatTimeout) {
+			log.Printf("chatServer.openPoll: %v", err)
+		}
+		t.close(websocket.StatusNormalClosure, "connection closed")
+		// Give the client a chance to fetch the last frames and the reason
+		time.AfterFunc(pollIdleTimeout, func() { cs.removeHTTPConn(id) })
+	}()
+
+	writeJSON(w, http.StatusOK, struct {
+		ID string `json:"id"`
+	}{id})
+}
+
+// waitPoll responds with the frames for a long polling connection, waiting
+// for some if there are none yet.
+func (cs *chatServer) waitPoll(w http.ResponseWriter, r *http.Request) {
+	conn, ok := cs.httpConnForRequest(r)
+	if !ok || conn.poll == nil {
+		http.Error(w, "no such connection", http.StatusNotFound)
+		return
+	}
+	// Waiting takes longer than the server's write timeout allows
+	http.NewResponseController(w).SetWriteDeadline(time.Now().Add(pollWait + writeTimeoutDuration))
+
+	frames, reason, closed := conn.poll.poll(r.Context())
+	if frames == nil {
+		frames = []string{}
+	}
+	writeJSON(w, http.StatusOK, struct {
+		Frames []string `json:"frames"`
+		Closed bool     `json:"closed,omitempty"`
+		Reason string   `json:"reason,omitempty"`
+	}{frames, closed, reason})
+}
@@ -0,0 +1,124 @@
+package main
+
+// This file handles presence, which is shown in the user list. People are
+// active while they're looking at the chat, and idle if they aren't, or if
+// they haven't sent a message or focused the tab for -idle-after. They can
+// also say they're away with "/away <reason>", until they send "/back".
+// Anyone replying to or @mentioning someone who is away is told the reason.
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// maxAwayLen is the max length of an away reason in bytes.
+const maxAwayLen = 100
+
+// interacted records that the user did something, like sending a message or
+// focusing the tab, so they aren't idle.
+func (c *client) interacted() {
+	c.activityMu.Lock()
+	defer c.activityMu.Unlock()
+	c.lastInteraction = time.Now()
+}
+
+// isIdle returns true if the user isn't looking at the chat, or hasn't done
+// anything for idleAfter.
+func (c *client) isIdle() bool {
+	c.activityMu.Lock()
+	defer c.activityMu.Unlock()
+	if !c.active {
+		return true
+	}
+	return idleAfter > 0 && time.Since(c.lastInteraction) > idleAfter
+}
+
+// checkPresence updates the user list if anyone has become idle since it was
+// last sent. It's called regularly by the room, as nothing else happens when
+// people stop doing things.
+func (cr *chatRoom) checkPresence() {
+	cr.clientsMu.Lock()
+	changed := false
+	for c := range cr.clients {
+		if c.isIdle() != c.shownIdle {
+			changed = true
+		}
+		// Clients that fell behind may have missed the last update
+		if c.missedUsers() {
+			changed = true
+		}
+	}
+	cr.clientsMu.Unlock()
+	if changed {
+		cr.queueUserList()
+	}
+}
+
+// handleAwayCmd handles "/away [reason]" and "/back". The user list is
+// updated for everyone.
+// It does not lock the clientsMu, callers should do that.
+func (cr *chatRoom) handleAwayCmd(m msg) broadcast {
+	if m.text == "/back" {
+		if !m.author.away {
+			m.author.sendError("You aren't away")
+			return broadcast{}
+		}
+		for _, c := range cr.tabsOf(m.author) {
+			c.away = false
+			c.awayReason = ""
+		}
+		m.author.sendNotice("Welcome back")
+	} else {
+		reason := strings.TrimSpace(m.text[len("/away"):])
+		if len(reason) > maxAwayLen {
+			m.author.sendError(fmt.Sprintf("Away reasons can be at most %d bytes long", maxAwayLen))
+			return broadcast{}
+		}
+		for _, c := range cr.tabsOf(m.author) {
+			c.away = true
+			c.awayReason = reason
+		}
+		m.author.sendNotice("You're marked as away, send /back when you return")
+	}
+	users := cr.users()
+	s := createUserListMsg(users)
+	return broadcast{html: s, authorHTML: s, json: []string{createUserListEvent(users)}}
+}
+
+// tellIfAway tells the client which of the people they replied to, if quoted
+// isn't nil, or mentioned are away. Each one is only told about once.
+// It does not lock the clientsMu, callers should do that.
+func (cr *chatRoom) tellIfAway(c *client, quoted *recentMsg, mentions []string) {
+	var told []string
+	tell := func(to *client) {
+		if to == nil || to.nick == c.nick || !to.away || containsNick(told, to.nick) {
+			return
+		}
+		if _, ok := cr.clients[to]; !ok {
+			return
+		}
+		told = append(told, to.nick)
+		cr.tellAway(c, to)
+	}
+	if quoted != nil {
+		tell(quoted.author)
+	}
+	for _, nick := range mentions {
+		for o := range cr.clients {
+			if o.nick == nick {
+				tell(o)
+				break
+			}
+		}
+	}
+}
+
+// tellAway tells the client that the other person is away, and why.
+func (cr *chatRoom) tellAway(c, to *client) {
+	if to.awayReason == "" {
+		c.sendNotice(c.tr("%s is away", isolateNick(to.nick)))
+	} else {
+		c.sendNotice(c.tr("%s is away: %s", isolateNick(to.nick), to.awayReason))
+	}
+}
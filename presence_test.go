@@ -0,0 +1,25 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestIsIdle(t *testing.T) {
+	defer func(d time.Duration) { idleAfter = d }(idleAfter)
+	idleAfter = time.Minute
+
+	c := &client{active: true, lastInteraction: time.Now()}
+	if c.isIdle() {
+		t.Error("active client that just did something is idle")
+	}
+	c.lastInteraction = time.Now().Add(-2 * time.Minute)
+	if !c.isIdle() {
+		t.Error("client is not idle after idleAfter")
+	}
+	c.interacted()
+	c.active = false
+	if !c.isIdle() {
+		t.Error("inactive client is not idle")
+	}
+}
@@ -0,0 +1,270 @@
+package main
+
+// This file handles link previews. When a message contains a single URL, the
+// server can fetch the page and show its title and description below the
+// message. As this makes requests to arbitrary URLs on behalf of users, it
+// has to be careful not to be used to reach internal services (SSRF).
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"html"
+	"html/template"
+	"io"
+	"log"
+	"math/rand"
+	"mime"
+	"net"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	// previewTimeout is the max time fetching a preview can take
+	previewTimeout = 5 * time.Second
+	// previewMaxBytes is the max number of bytes read from a page
+	previewMaxBytes = 512 * 1024
+	// previewMaxRedirects is the max number of redirects followed
+	previewMaxRedirects = 3
+	// previewCacheSize is the max number of previews cached
+	previewCacheSize = 256
+
+	maxPreviewTitleLen = 150
+	maxPreviewDescLen  = 300
+)
+
+var (
+	metaTagRe  = regexp.MustCompile(`(?is)<meta\s[^>]*>`)
+	attrRe     = regexp.MustCompile(`(?is)([a-z:-]+)\s*=\s*(?:"([^"]*)"|'([^']*)')`)
+	titleTagRe = regexp.MustCompile(`(?is)<title[^>]*>(.*?)</title>`)
+)
+
+var errForbiddenAddr = errors.New("address not allowed")
+
+// linkPreview is the information shown in a preview card.
+type linkPreview struct {
+	title       string
+	description string
+}
+
+// publicOnlyDial dials like a net.Dialer, but refuses to connect to non-public
+// IP addresses. This check happens at connection time, so DNS tricks and
+// redirects can't get around it.
+var publicOnlyDial = (&net.Dialer{
+	Timeout: previewTimeout,
+	Control: func(network, address string, _ syscall.RawConn) error {
+		host, _, err := net.SplitHostPort(address)
+		if err != nil {
+			return err
+		}
+		ip := net.ParseIP(host)
+		if ip == nil || !isPublicIP(ip) {
+			return errForbiddenAddr
+		}
+		return nil
+	},
+}).DialContext
+
+// previewClient is the HTTP client used to fetch previews. It uses
+// publicOnlyDial, so it can't be used to reach internal services.
+var previewClient = &http.Client{
+	Timeout: previewTimeout,
+	Transport: &http.Transport{
+		Proxy:                 nil,
+		DialContext:           publicOnlyDial,
+		TLSHandshakeTimeout:   previewTimeout,
+		ResponseHeaderTimeout: previewTimeout,
+		MaxIdleConns:          10,
+		IdleConnTimeout:       30 * time.Second,
+	},
+	CheckRedirect: func(req *http.Request, via []*http.Request) error {
+		if len(via) >= previewMaxRedirects {
+			return errors.New("too many redirects")
+		}
+		if req.URL.Scheme != "http" && req.URL.Scheme != "https" {
+			return errors.New("redirect to unsupported scheme")
+		}
+		return nil
+	},
+}
+
+// previewCache caches previews by URL, so a link that is posted many times
+// only gets fetched once. Failed fetches are cached as nil.
+var (
+	previewCache   = make(map[string]*linkPreview)
+	previewCacheMu sync.Mutex
+)
+
+// isPublicIP returns false for any IP address that isn't on the public
+// internet, like loopback, private, and link-local addresses.
+func isPublicIP(ip net.IP) bool {
+	return !(ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() ||
+		ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() ||
+		ip.IsInterfaceLocalMulticast() || ip.IsMulticast() ||
+		// Carrier-grade NAT, 100.64.0.0/10
+		(ip.To4() != nil && ip.To4()[0] == 100 && ip.To4()[1]&0xc0 == 64))
+}
+
+// singlePreviewURL returns the URL in the message text if there is exactly
+// one http or https URL, and an empty string otherwise.
+func singlePreviewURL(text string) string {
+	urls := urlRe.FindAllString(text, 2)
+	if len(urls) != 1 {
+		return ""
+	}
+	u, err := url.Parse(urls[0])
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return ""
+	}
+	return u.String()
+}
+
+// newPreviewID returns a random HTML element ID for a preview placeholder.
+func newPreviewID() string {
+	return fmt.Sprintf("preview-%016x", rand.Uint64())
+}
+
+// createPreviewPlaceholder creates the empty element that a preview card
+// replaces once it's fetched.
+func createPreviewPlaceholder(id string) string {
+	return fmt.Sprintf(`<div id="%s"></div>`, id)
+}
+
+// createPreviewMsg creates HTML that replaces the placeholder with the given
+// ID with a preview card.
+func createPreviewMsg(id, u string, p *linkPreview) string {
+	return renderTemplate("preview.html", struct {
+		ID          string
+		URL         template.URL
+		Title       string
+		Description string
+	}{id, template.URL(u), p.title, p.description})
+}
+
+// sendPreview fetches a preview for the URL, and if it works, queues a message
+// for the room that fills in the placeholder with the given ID.
+// It should be run in a goroutine.
+func (cr *chatRoom) sendPreview(id, u string) {
+	p := getLinkPreview(u)
+	if p == nil {
+		return
+	}
+	select {
+	case cr.incoming <- msg{raw: createPreviewMsg(id, u, p), when: time.Now()}:
+	default:
+		// Room is busy or gone, the preview isn't important
+	}
+}
+
+// getLinkPreview returns the preview for the URL, using the cache if possible.
+// It returns nil if there is no preview.
+func getLinkPreview(u string) *linkPreview {
+	previewCacheMu.Lock()
+	p, ok := previewCache[u]
+	previewCacheMu.Unlock()
+	if ok {
+		return p
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), previewTimeout)
+	defer cancel()
+	p, err := fetchLinkPreview(ctx, u)
+	if err != nil {
+		log.Printf("getLinkPreview: %v", err)
+	}
+
+	previewCacheMu.Lock()
+	if len(previewCache) >= previewCacheSize {
+		// Simplest eviction, just start over
+		previewCache = make(map[string]*linkPreview)
+	}
+	previewCache[u] = p
+	previewCacheMu.Unlock()
+	return p
+}
+
+// fetchLinkPreview downloads the page at the URL and extracts the Open Graph
+// title and description, falling back to the <title> tag. A nil preview is
+// returned if the page has no title.
+func fetchLinkPreview(ctx context.Context, u string) (*linkPreview, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("User-Agent", "NearTalk link preview")
+	req.Header.Set("Accept", "text/html")
+	resp, err := previewClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, nil
+	}
+	mediaType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if mediaType != "text/html" && mediaType != "application/xhtml+xml" {
+		return nil, nil
+	}
+	b, err := io.ReadAll(io.LimitReader(resp.Body, previewMaxBytes))
+	if err != nil {
+		return nil, err
+	}
+	return parseLinkPreview(string(b)), nil
+}
+
+// parseLinkPreview extracts preview info from an HTML page.
+func parseLinkPreview(page string) *linkPreview {
+	p := &linkPreview{}
+	for _, tag := range metaTagRe.FindAllString(page, -1) {
+		var property, content string
+		for _, attr := range attrRe.FindAllStringSubmatch(tag, -1) {
+			val := attr[2] + attr[3]
+			switch strings.ToLower(attr[1]) {
+			case "property", "name":
+				property = strings.ToLower(val)
+			case "content":
+				content = val
+			}
+		}
+		switch property {
+		case "og:title":
+			p.title = content
+		case "og:description":
+			p.description = content
+		case "description":
+			if p.description == "" {
+				p.description = content
+			}
+		}
+	}
+	if p.title == "" {
+		if m := titleTagRe.FindStringSubmatch(page); m != nil {
+			p.title = m[1]
+		}
+	}
+
+	p.title = cleanPreviewText(p.title, maxPreviewTitleLen)
+	p.description = cleanPreviewText(p.description, maxPreviewDescLen)
+	if p.title == "" {
+		return nil
+	}
+	return p
+}
+
+// cleanPreviewText unescapes HTML entities, collapses whitespace, and
+// truncates the text to max runes. The result is not HTML escaped.
+func cleanPreviewText(s string, max int) string {
+	s = strings.ToValidUTF8(html.UnescapeString(s), "\uFFFD")
+	s = strings.Join(strings.Fields(s), " ")
+	if r := []rune(s); len(r) > max {
+		s = string(r[:max-1]) + "…"
+	}
+	return s
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+)
+
+func TestIsPublicIP(t *testing.T) {
+	for _, c := range []struct {
+		ip     string
+		public bool
+	}{
+		{"8.8.8.8", true},
+		{"2001:4860:4860::8888", true},
+		{"100.63.255.255", true},
+		{"100.128.0.0", true},
+		{"127.0.0.1", false},
+		{"127.255.255.254", false},
+		{"::1", false},
+		{"10.1.2.3", false},
+		{"172.16.0.1", false},
+		{"172.31.255.255", false},
+		{"192.168.1.1", false},
+		{"fd00::1", false},
+		{"169.254.169.254", false},
+		{"fe80::1", false},
+		{"100.64.0.1", false},
+		{"100.127.255.255", false},
+		{"0.0.0.0", false},
+		{"::", false},
+		{"224.0.0.1", false},
+		{"ff02::1", false},
+		{"::ffff:127.0.0.1", false},
+		{"::ffff:10.0.0.1", false},
+		{"::ffff:169.254.169.254", false},
+		{"::ffff:100.64.0.1", false},
+		{"::ffff:8.8.8.8", true},
+	} {
+		if got := isPublicIP(net.ParseIP(c.ip)); got != c.public {
+			t.Errorf("isPublicIP(%s) = %v, want %v", c.ip, got, c.public)
+		}
+	}
+}
+
+func TestSinglePreviewURL(t *testing.T) {
+	for _, c := range []struct{ text, want string }{
+		{"look at https://example.com/page", "https://example.com/page"},
+		{"http://example.com", "http://example.com"},
+		{"no links here", ""},
+		{"https://example.com and https://example.org", ""},
+		{"ftp://example.com/file", ""},
+		{"javascript:alert(1)", ""},
+	} {
+		if got := singlePreviewURL(c.text); got != c.want {
+			t.Errorf("singlePreviewURL(%q) = %q, want %q", c.text, got, c.want)
+		}
+	}
+}
+
+func TestParseLinkPreview(t *testing.T) {
+	for _, c := range []struct {
+		name, page  string
+		title, desc string
+		none        bool
+	}{
+		{
+			name:  "open graph",
+			page:  `<meta property="og:title" content="OG title"><meta property="og:description" content="OG desc"><title>Page</title>`,
+			title: "OG title", desc: "OG desc",
+		},
+		{
+			name: "title tag and description",
+			page: `<title>  Page
+			title </title><meta name="description" content='Plain desc'>`,
+			title: "Page title", desc: "Plain desc",
+		},
+		{
+			name:  "og description wins",
+			page:  `<meta name="description" content="Plain"><meta property="og:description" content="OG"><title>T</title>`,
+			title: "T", desc: "OG",
+		},
+		{
+			name:  "entities",
+			page:  `<title>Fish &amp; chips &lt;b&gt;</title>`,
+			title: "Fish & chips <b>",
+		},
+		{
+			name: "no title",
+			page: `<meta name="description" content="Only a description">`,
+			none: true,
+		},
+	} {
+		p := parseLinkPreview(c.page)
+		if c.none {
+			if p != nil {
+				t.Errorf("%s: got %+v, want no preview", c.name, p)
+			}
+			continue
+		}
+		if p == nil || p.title != c.title || p.description != c.desc {
+			t.Errorf("%s: got %+v, want title %q and description %q", c.name, p, c.title, c.desc)
+		}
+	}
+}
+
+func TestFetchLinkPreviewRefusesLoopback(t *testing.T) {
+	var fetched atomic.Bool
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fetched.Store(true)
+		w.Header().Set("Content-Type", "text/html")
+		w.Write([]byte("<title>Internal</title>"))
+	}))
+	defer srv.Close()
+
+	p, err := fetchLinkPreview(context.Background(), srv.URL)
+	if !errors.Is(err, errForbiddenAddr) {
+		t.Errorf("fetching %s = %+v, %v, want %v", srv.URL, p, err, errForbiddenAddr)
+	}
+	if fetched.Load() {
+		t.Error("the server on 127.0.0.1 was reached")
+	}
+}
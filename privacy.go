@@ -0,0 +1,144 @@
+package main
+
+// This file has the privacy mode, for servers started with -private-rooms.
+// Rooms for IP addresses are keyed by an HMAC of the address instead of the
+// address itself, with a secret that's made when the server starts and
+// replaced every day, so the keys can't be turned back into addresses even
+// by someone who has the logs. People see a pseudonym for the room like
+// "Room AmberFox-42" in place of the address, and log lines that would show
+// an address show the hashed key instead.
+//
+// Without it, -room-display can still show the pseudonym instead of the
+// address, optionally with the subnet, for people who find it alarming to
+// see their address in the header.
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/makeworld-the-better-one/neartalk/data"
+)
+
+// privateRoomPrefix starts the key of every room keyed by a hashed address,
+// so they can't clash with places or named rooms.
+const privateRoomPrefix = "~"
+
+// privateSecretLifetime is how long a secret is used before it's replaced.
+// People on the same network who join after that end up in a new room, the
+// old one stays open until everyone leaves it.
+const privateSecretLifetime = 24 * time.Hour
+
+// Ways to show rooms for IP addresses, for the -room-display flag.
+const (
+	// roomDisplayIP shows the address.
+	roomDisplayIP = "ip"
+	// roomDisplayName shows a pseudonym, see roomPseudonym.
+	roomDisplayName = "name"
+	// roomDisplayNameSubnet shows a pseudonym and the subnet, see
+	// anonymizeIP.
+	roomDisplayNameSubnet = "name-subnet"
+)
+
+// validateRoomDisplay returns an error if the -room-display flag is invalid.
+func validateRoomDisplay() error {
+	if roomDisplay != roomDisplayIP && roomDisplay != roomDisplayName && roomDisplay != roomDisplayNameSubnet {
+		return fmt.Errorf("invalid room display %q, must be %q, %q, or %q",
+			roomDisplay, roomDisplayIP, roomDisplayName, roomDisplayNameSubnet)
+	}
+	return nil
+}
+
+// roomSecret is the rotating secret addresses are hashed with.
+type roomSecret struct {
+	mu   sync.Mutex
+	key  []byte
+	made time.Time
+}
+
+// privateSecret is the secret used for -private-rooms.
+var privateSecret roomSecret
+
+// hash returns the private room key for the address, making a new secret
+// first if the current one is too old.
+// It holds the mutex.
+func (rs *roomSecret) hash(addr string, now time.Time) string {
+	rs.mu.Lock()
+	if rs.key == nil || now.Sub(rs.made) >= privateSecretLifetime {
+		rs.key = make([]byte, 32)
+		if _, err := rand.Read(rs.key); err != nil {
+			panic(err)
+		}
+		rs.made = now
+	}
+	mac := hmac.New(sha256.New, rs.key)
+	rs.mu.Unlock()
+
+	mac.Write([]byte(addr))
+	return privateRoomPrefix + hex.EncodeToString(mac.Sum(nil)[:8])
+}
+
+// privateKey returns the private room key for the address.
+func privateKey(addr string) string {
+	return privateSecret.hash(addr, time.Now())
+}
+
+// roomPseudonym returns a name like "AmberFox-42" for a private room key.
+// It's always the same for the same key.
+func roomPseudonym(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	adj := data.Adjectives[binary.BigEndian.Uint32(sum[0:4])%uint32(len(data.Adjectives))]
+	animal := data.Animals[binary.BigEndian.Uint32(sum[4:8])%uint32(len(data.Animals))]
+	// Convert to CamelCase, like nicknames
+	name := strings.ReplaceAll(strings.Title(adj+" "+animal), " ", "")
+	return fmt.Sprintf("%s-%d", name, sum[8]%100)
+}
+
+// roomTitle returns what people are shown as the room's name: a pseudonym
+// for private rooms, and the key otherwise. Rooms for IP addresses get a
+// pseudonym too if -room-display says so. Subrooms are named after their
+// lobby, see subroom.go.
+func roomTitle(key string) string {
+	if lobby, name, ok := splitSubroomKey(key); ok {
+		return roomTitle(lobby) + " " + subroomSep + name
+	}
+	if strings.HasPrefix(key, privateRoomPrefix) {
+		return "Room " + roomPseudonym(key)
+	}
+	ip := net.ParseIP(key)
+	if ip == nil {
+		// Like "lan", a place, or a named room
+		return key
+	}
+	switch roomDisplay {
+	case roomDisplayName:
+		return "Room " + roomPseudonym(key)
+	case roomDisplayNameSubnet:
+		bits := 48
+		if ip.To4() != nil {
+			bits = 24
+		}
+		return fmt.Sprintf("Room %s (%s/%d)", roomPseudonym(key), anonymizeIP(ip), bits)
+	}
+	return key
+}
+
+// logAddr returns the address of the request's client for log lines and the
+// audit log. With -private-rooms that's the hashed key instead.
+func logAddr(r *http.Request) string {
+	if privateRooms {
+		if ip := clientAddr(r, int(trustedProxies)); ip != nil {
+			return privateKey(ip.String())
+		}
+		return "-"
+	}
+	return r.RemoteAddr
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRoomSecret(t *testing.T) {
+	var rs roomSecret
+	now := time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	key := rs.hash("203.0.113.5", now)
+	if !strings.HasPrefix(key, privateRoomPrefix) || strings.Contains(key, "203.0.113.5") {
+		t.Errorf("hash() = %q, want a hashed key", key)
+	}
+	if again := rs.hash("203.0.113.5", now.Add(time.Hour)); again != key {
+		t.Errorf("hash() = %q for the same address, want %q", again, key)
+	}
+	if other := rs.hash("203.0.113.6", now); other == key {
+		t.Errorf("hash() = %q for a different address", other)
+	}
+	if rotated := rs.hash("203.0.113.5", now.Add(privateSecretLifetime)); rotated == key {
+		t.Errorf("hash() = %q after the secret was replaced", rotated)
+	}
+}
+
+func TestRoomTitle(t *testing.T) {
+	key := privateKey("203.0.113.5")
+	name := roomTitle(key)
+	if !regexp.MustCompile(`^Room [A-Z][a-z]+[A-Z][a-z]+-[0-9]{1,2}$`).MatchString(name) {
+		t.Errorf("roomTitle(%q) = %q, want a pseudonym", key, name)
+	}
+	if again := roomTitle(key); again != name {
+		t.Errorf("roomTitle(%q) = %q then %q", key, name, again)
+	}
+	for _, key := range []string{"lan", "203.0.113.5", "#lobby", "Toronto, Ontario, Canada"} {
+		if got := roomTitle(key); got != key {
+			t.Errorf("roomTitle(%q) = %q, want it unchanged", key, got)
+		}
+	}
+}
+
+func TestRoomTitleDisplay(t *testing.T) {
+	defer func(d string) { roomDisplay = d }(roomDisplay)
+	name := "Room " + roomPseudonym("203.0.113.5")
+	tests := []struct {
+		display string
+		key     string
+		want    string
+	}{
+		{roomDisplayIP, "203.0.113.5", "203.0.113.5"},
+		{roomDisplayName, "203.0.113.5", name},
+		{roomDisplayNameSubnet, "203.0.113.5", name + " (203.0.113.0/24)"},
+		{roomDisplayNameSubnet, "2001:db8:1:2::5", "Room " + roomPseudonym("2001:db8:1:2::5") + " (2001:db8:1::/48)"},
+		{roomDisplayName, "lan", "lan"},
+		{roomDisplayName, "#lobby", "#lobby"},
+	}
+	for _, tt := range tests {
+		roomDisplay = tt.display
+		if got := roomTitle(tt.key); got != tt.want {
+			t.Errorf("roomTitle(%q) with %s = %q, want %q", tt.key, tt.display, got, tt.want)
+		}
+	}
+}
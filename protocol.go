@@ -0,0 +1,185 @@
+package main
+
+// This file handles the two protocols clients can use over the websocket.
+// The web UI gets HTML fragments for htmx, and other clients can connect with
+// /connect?proto=json to get JSON events instead, as described in the events
+// package. Both kinds of clients send the same JSON messages to the server.
+
+import (
+	"encoding/json"
+	"log"
+	"time"
+
+	"github.com/makeworld-the-better-one/neartalk/events"
+)
+
+// Protocols a client can use, chosen with the proto query parameter.
+const (
+	protoHTML = "html"
+	protoJSON = "json"
+)
+
+// broadcast is a message to send to every client in a room, in each protocol.
+type broadcast struct {
+	// html is sent to web UI clients, and authorHTML is sent instead to the
+	// client whose message caused the broadcast.
+	html       string
+	authorHTML string
+	// json is encoded events sent to JSON clients, and authorJSON is sent
+	// instead to the client whose message caused the broadcast. If
+	// authorJSON is nil, json is sent to the author too.
+	json       []string
+	authorJSON []string
+	// isChat is true if this is a regular chat message, rather than a
+	// notification.
+	isChat bool
+	// id is the ID of the chat message, if isChat is true.
+	id string
+	// local is true if the broadcast is only for clients on this instance.
+	// See roomBus.
+	local bool
+	// mentioned is the sanitized nicknames of the people mentioned in the
+	// message. Their mentions are highlighted for them.
+	mentioned []string
+	// langHTML holds html in other languages, by language, for the clients
+	// using them. It's only set when authorHTML is the same as html.
+	langHTML map[string]string
+	// alert is set for new chat messages, so clients can be alerted about
+	// them depending on their notification preferences.
+	alert *chatAlert
+	// topic is set when the broadcast changes the room topic, to the new one.
+	topic *string
+	// minor is true for presence updates, like a new user list, which are
+	// the first to be dropped for clients that can't keep up. See
+	// backpressure.go.
+	minor bool
+	// bridge is the network a chat message was relayed from, so it isn't
+	// relayed back there. See bridge.go.
+	bridge string
+	// encrypted is true for end-to-end encrypted chat messages, which
+	// aren't relayed to bridges.
+	encrypted bool
+}
+
+// empty returns true if there's nothing to send.
+func (b broadcast) empty() bool {
+	return b.html == "" && len(b.json) == 0
+}
+
+// encodeEvent encodes an event so it can be sent to JSON clients.
+func encodeEvent(t events.Type, data interface{}) string {
+	e, err := events.New(t, data)
+	if err != nil {
+		log.Printf("encodeEvent: %s: %v", t, err)
+		return ""
+	}
+	b, err := json.Marshal(e)
+	if err != nil {
+		log.Printf("encodeEvent: %s: %v", t, err)
+		return ""
+	}
+	return string(b)
+}
+
+// isJSON returns true if the client uses the JSON protocol.
+func (c *client) isJSON() bool {
+	return c.proto == protoJSON
+}
+
+// deliver sends the broadcast to the client in its protocol. isAuthor should
+// be true if the client caused the broadcast.
+// It reads the client's nickname, so callers should hold the clientsMu of its
+// room.
+func (c *client) deliver(b broadcast, isAuthor bool) {
+	c.deliverAs(b, c.nick, isAuthor)
+}
+
+// deliverAs is deliver for a client with the nickname, so the clientsMu
+// doesn't have to be held. See fanOut.
+func (c *client) deliverAs(b broadcast, nick string, isAuthor bool) {
+	mentioned := !isAuthor && containsNick(b.mentioned, nick)
+	prefs := c.notifyPrefs()
+	alert := b.alert != nil && !isAuthor && prefs.wantsAlert(mentioned)
+	kind := frameNormal
+	if b.minor {
+		kind = frameMinor
+	} else if b.isChat && !isAuthor {
+		kind = frameChat
+	}
+	if c.isJSON() {
+		frames := b.json
+		if isAuthor && b.authorJSON != nil {
+			frames = b.authorJSON
+		}
+		for _, f := range frames {
+			c.queueFrame(f, kind)
+		}
+		// JSON clients get every message anyway, so only mentions are sent
+		if alert && mentioned {
+			c.queueFrame(createMentionEvent(b.alert), kind)
+		}
+		if b.isChat && !isAuthor {
+			if n, ok := c.addUnread(b.id); ok {
+				c.sendUnread(n)
+			}
+		}
+		return
+	}
+
+	if b.html == "" {
+		return
+	}
+	html, authorHTML := b.html, b.authorHTML
+	if h, ok := b.langHTML[c.language()]; ok {
+		html, authorHTML = h, h
+	}
+	if mentioned {
+		html = highlightMentions(html, nick)
+	}
+	if alert {
+		html += createAlertMsg(b.alert, mentioned, prefs.sound)
+	}
+	if isAuthor {
+		// This client sent the message, so clear their input field
+		c.sendFrame(authorHTML + clearInputFieldMsg)
+	} else if b.isChat {
+		if n, ok := c.addUnread(b.id); ok {
+			c.queueFrame(html+createUnreadMsg(n), kind)
+		} else {
+			c.queueFrame(html, kind)
+		}
+	} else {
+		c.queueFrame(html, kind)
+	}
+}
+
+// sendEvent sends an event to the client if it uses the JSON protocol.
+// Web UI clients are skipped.
+func (c *client) sendEvent(t events.Type, data interface{}) {
+	if c.isJSON() {
+		c.sendFrame(encodeEvent(t, data))
+	}
+}
+
+// sendError sends an error message to the client, in its protocol and
+// language.
+func (c *client) sendError(text string) {
+	text = c.tr(text)
+	if c.isJSON() {
+		c.sendFrame(encodeEvent(events.TypeError, events.Error{Text: text}))
+	} else {
+		c.sendFrame(createSpecialMsg(text, "error"))
+	}
+}
+
+// sendNotice sends a notification to the client, in its protocol. For the web
+// UI, the input field is cleared as well, since notices are usually the
+// response to a command. The text is translated to the client's language.
+func (c *client) sendNotice(text string) {
+	text = c.tr(text)
+	if c.isJSON() {
+		c.sendFrame(encodeEvent(events.TypeNotice, events.Notice{Text: text, Time: time.Now()}))
+	} else {
+		c.sendFrame(createSpecialMsg(text, "notif") + clearInputFieldMsg)
+	}
+}
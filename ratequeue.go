@@ -0,0 +1,120 @@
+package main
+
+// This file applies the room's rate limit (message_rate and message_burst in
+// the config) without blocking the room's goroutine. Each message reserves
+// its turn as it arrives. Messages that have to wait are queued until their
+// turn, while the room carries on with joins, leaves, and closing. Messages
+// from people that would wait longer than maxQueueDelay are refused instead,
+// so a busy room tells people straight away rather than falling further
+// behind. Server messages and relayed ones wait up to maxServerQueueDelay, so
+// the queue can't grow without end when a bridge is busier than the room.
+
+import (
+	"time"
+)
+
+// maxQueueDelay is the longest a message from someone can wait for its turn
+// before it's refused.
+const maxQueueDelay = 2 * time.Second
+
+// maxServerQueueDelay is the longest a message without an author can wait for
+// its turn before it's dropped. Nobody can be told about it, so it's given
+// longer than people's.
+const maxServerQueueDelay = 30 * time.Second
+
+// queuedMsg is a message waiting for its turn.
+type queuedMsg struct {
+	m   msg
+	due time.Time
+}
+
+// rateQueue holds the messages waiting for their turn, in the order they
+// arrived, which is also the order they're due. It's only used by the room's
+// goroutine.
+type rateQueue struct {
+	msgs  []queuedMsg
+	timer *time.Timer
+}
+
+// push queues the message until it's due.
+func (q *rateQueue) push(m msg, due time.Time) {
+	q.msgs = append(q.msgs, queuedMsg{m: m, due: due})
+	if len(q.msgs) == 1 {
+		q.reset()
+	}
+}
+
+// ready returns a channel that receives once the first message is due, or nil
+// if nothing is queued.
+func (q *rateQueue) ready() <-chan time.Time {
+	if len(q.msgs) == 0 {
+		return nil
+	}
+	return q.timer.C
+}
+
+// pop removes and returns the messages that are due by now. It must only be
+// called after receiving from ready.
+func (q *rateQueue) pop(now time.Time) []msg {
+	var due []msg
+	for len(q.msgs) > 0 && !q.msgs[0].due.After(now) {
+		due = append(due, q.msgs[0].m)
+		q.msgs[0] = queuedMsg{}
+		q.msgs = q.msgs[1:]
+	}
+	if len(q.msgs) > 0 {
+		q.reset()
+	}
+	return due
+}
+
+// reset sets the timer for the first message.
+func (q *rateQueue) reset() {
+	d := time.Until(q.msgs[0].due)
+	if q.timer == nil {
+		q.timer = time.NewTimer(d)
+	} else {
+		q.timer.Reset(d)
+	}
+}
+
+// stop stops the timer, dropping whatever is queued.
+func (q *rateQueue) stop() {
+	if q.timer != nil {
+		q.timer.Stop()
+	}
+	q.msgs = nil
+}
+
+// admit handles the message now if the rate limit allows it, or queues it
+// until it does. Messages from people, and presence updates that a later one
+// will replace, are refused if they'd wait longer than maxQueueDelay, and
+// other messages if they'd wait longer than maxServerQueueDelay. It's only
+// called by the room's goroutine.
+func (cr *chatRoom) admit(q *rateQueue, m msg, now time.Time) {
+	r := cr.limiter.ReserveN(now, 1)
+	delay := r.DelayFrom(now)
+	if !r.OK() || delay > maxServerQueueDelay || (delay > maxQueueDelay && (m.author != nil || m.minor)) {
+		r.CancelAt(now)
+		if m.author != nil {
+			m.author.sendError("The room is too busy right now, that message was dropped")
+		}
+		return
+	}
+	if delay == 0 && len(q.msgs) == 0 {
+		cr.handle(m)
+		return
+	}
+	q.push(m, now.Add(delay))
+}
+
+// handle handles the message and sends what it results in. It's only called
+// by the room's goroutine.
+func (cr *chatRoom) handle(m msg) {
+	b := cr.handleMsg(m)
+	if b.empty() {
+		// No message needs to be sent to all clients
+		return
+	}
+	cr.publish(b, m.author)
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+func TestRateQueue(t *testing.T) {
+	var q rateQueue
+	defer q.stop()
+	if q.ready() != nil {
+		t.Fatal("empty queue is ready")
+	}
+	now := time.Now()
+	q.push(msg{text: "one"}, now.Add(10*time.Millisecond))
+	q.push(msg{text: "two"}, now.Add(10*time.Millisecond))
+	q.push(msg{text: "three"}, now.Add(30*time.Millisecond))
+
+	due := q.pop(<-q.ready())
+	if len(due) != 2 || due[0].text != "one" || due[1].text != "two" {
+		t.Fatalf("first messages due = %+v, want one and two", due)
+	}
+	at := <-q.ready()
+	if at.Before(now.Add(30 * time.Millisecond)) {
+		t.Errorf("last message was ready %v early", now.Add(30*time.Millisecond).Sub(at))
+	}
+	if due := q.pop(at); len(due) != 1 || due[0].text != "three" {
+		t.Fatalf("last messages due = %+v, want three", due)
+	}
+	if q.ready() != nil {
+		t.Error("queue is still ready once empty")
+	}
+}
+
+func TestAdmitServerMsgs(t *testing.T) {
+	cr := &chatRoom{limiter: rate.NewLimiter(1, 1)}
+	var q rateQueue
+	defer q.stop()
+	now := time.Now()
+	cr.limiter.ReserveN(now, 1)
+	// One a second can wait, up to maxServerQueueDelay
+	for i := 0; i < 100; i++ {
+		cr.admit(&q, msg{raw: "notice"}, now)
+	}
+	if want := int(maxServerQueueDelay / time.Second); len(q.msgs) != want {
+		t.Errorf("%d server messages queued, want %d", len(q.msgs), want)
+	}
+}
@@ -0,0 +1,103 @@
+package main
+
+// This file handles replying to messages. Every chat message gets an ID,
+// and the room remembers the most recent messages so replies can quote them,
+// and so authors can edit or delete them.
+
+import (
+	"html"
+	"strings"
+	"time"
+
+	"github.com/makeworld-the-better-one/neartalk/ids"
+	"github.com/rivo/uniseg"
+)
+
+// maxRecentMsgs is the number of messages a room remembers for quoting.
+const maxRecentMsgs = 100
+
+// maxQuoteLen is the max number of graphemes shown in a quote.
+const maxQuoteLen = 100
+
+// recentMsg is a message a room remembers so it can be quoted, edited,
+// or deleted.
+type recentMsg struct {
+	id      string
+	replyTo string
+	nick    string // Sanitized
+	text    string // Unsanitized
+	author  *client
+	when    time.Time
+	edited  bool
+}
+
+// newMsgID returns a new message ID. IDs sort in the order messages were
+// sent, see the ids package.
+func newMsgID() string {
+	return ids.New()
+}
+
+// rememberMsg stores a message so it can be quoted later. Old messages are
+// forgotten once there are more than maxRecentMsgs.
+// It does not lock the clientsMu, callers should do that.
+func (cr *chatRoom) rememberMsg(m msg) {
+	cr.recent = append(cr.recent, recentMsg{
+		id:      m.id,
+		replyTo: m.replyTo,
+		nick:    m.nick,
+		text:    m.text,
+		author:  m.author,
+		when:    m.when,
+	})
+	if len(cr.recent) > maxRecentMsgs {
+		cr.recent = cr.recent[len(cr.recent)-maxRecentMsgs:]
+	}
+}
+
+// findRecentMsg returns the remembered message with the given ID, or nil.
+// IDs typed by users are accepted in any case.
+// It does not lock the clientsMu, callers should do that.
+func (cr *chatRoom) findRecentMsg(id string) *recentMsg {
+	id = ids.Normalize(id)
+	for i := len(cr.recent) - 1; i >= 0; i-- {
+		if cr.recent[i].id == id {
+			return &cr.recent[i]
+		}
+	}
+	return nil
+}
+
+// quoteText returns a short HTML escaped snippet of message text for quoting.
+// Spoilers are left out.
+func quoteText(text string) string {
+	return html.EscapeString(closeBidi(shortText(text)))
+}
+
+// shortText returns a short snippet of message text on one line, with
+// spoilers left out.
+func shortText(text string) string {
+	text = strings.Join(strings.Fields(hideSpoilers(strings.ToValidUTF8(text, "\uFFFD"))), " ")
+	g := uniseg.NewGraphemes(text)
+	i := 0
+	var b strings.Builder
+	for g.Next() {
+		if i == maxQuoteLen {
+			b.WriteString("…")
+			break
+		}
+		b.Write(g.Bytes())
+		i++
+	}
+	return b.String()
+}
+
+// forgetMsg removes a remembered message.
+// It does not lock the clientsMu, callers should do that.
+func (cr *chatRoom) forgetMsg(id string) {
+	for i := range cr.recent {
+		if cr.recent[i].id == id {
+			cr.recent = append(cr.recent[:i], cr.recent[i+1:]...)
+			return
+		}
+	}
+}
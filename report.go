@@ -0,0 +1,171 @@
+package main
+
+// This file handles abuse reports. Users can file reports with /report, and
+// automatic spam detection can record them too. Reports are collected per
+// room, and a digest of the rooms with the most reports is sent to the
+// operator regularly, so they don't have to hear about every quiet room.
+// Without a way to notify the operator, or with digests turned off, reports
+// aren't kept, and people reporting are told nobody will see them.
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// maxReportReasons is the number of reasons kept per room for the digest.
+	maxReportReasons = 5
+	// maxReportReasonLen is the max length of a report reason in bytes.
+	maxReportReasonLen = 200
+	// reportCooldown is how long a client has to wait between reports.
+	reportCooldown = time.Minute
+)
+
+// roomReports holds the reports for one room since the last digest.
+type roomReports struct {
+	userReports int
+	spamReports int
+	// reasons holds the most recent reasons given.
+	reasons []string
+}
+
+func (rr *roomReports) total() int {
+	return rr.userReports + rr.spamReports
+}
+
+// reportLog collects reports for all rooms.
+type reportLog struct {
+	mu    sync.Mutex
+	rooms map[string]*roomReports
+}
+
+func newReportLog() *reportLog {
+	return &reportLog{rooms: make(map[string]*roomReports)}
+}
+
+// add records a report for the room with the given key. spam should be true
+// if it was filed by automatic spam detection rather than a user.
+func (rl *reportLog) add(roomKey, reason string, spam bool) {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	rr, ok := rl.rooms[roomKey]
+	if !ok {
+		rr = &roomReports{}
+		rl.rooms[roomKey] = rr
+	}
+	if spam {
+		rr.spamReports++
+		reason = "[auto] " + reason
+	} else {
+		rr.userReports++
+	}
+	if reason != "" {
+		rr.reasons = append(rr.reasons, reason)
+		if len(rr.reasons) > maxReportReasons {
+			rr.reasons = rr.reasons[len(rr.reasons)-maxReportReasons:]
+		}
+	}
+}
+
+// remove forgets the reports for the room. It returns false if there were
+// none.
+func (rl *reportLog) remove(roomKey string) bool {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	if _, ok := rl.rooms[roomKey]; !ok {
+		return false
+	}
+	delete(rl.rooms, roomKey)
+	return true
+}
+
+// reportsDelivered returns true if report digests reach the operator.
+func reportsDelivered() bool {
+	return reportInterval > 0 && notifyConfigured()
+}
+
+// recordSpam records an automatic spam detection for the room.
+func (cr *chatRoom) recordSpam(reason string) {
+	if reportsDelivered() {
+		cr.server.reports.add(cr.key, reason, true)
+	}
+}
+
+// digest returns the text of a digest for all rooms with at least threshold
+// reports, noisiest first, and resets the log. It returns an empty string if
+// no rooms reached the threshold.
+func (rl *reportLog) digest(threshold int) string {
+	rl.mu.Lock()
+	rooms := rl.rooms
+	rl.rooms = make(map[string]*roomReports)
+	rl.mu.Unlock()
+
+	keys := make([]string, 0, len(rooms))
+	for key, rr := range rooms {
+		if rr.total() >= threshold {
+			keys = append(keys, key)
+		}
+	}
+	if len(keys) == 0 {
+		return ""
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return rooms[keys[i]].total() > rooms[keys[j]].total()
+	})
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "%d of %d reported rooms reached %d reports.\n", len(keys), len(rooms), threshold)
+	for _, key := range keys {
+		rr := rooms[key]
+		fmt.Fprintf(&b, "\nRoom %s: %d user reports, %d spam detections\n", key, rr.userReports, rr.spamReports)
+		for _, reason := range rr.reasons {
+			fmt.Fprintf(&b, "  - %s\n", reason)
+		}
+	}
+	return b.String()
+}
+
+// runReportDigests sends a digest to the operator every interval, if there's
+// a way to notify them. Reports are cleared either way. It never returns, so
+// it should be run in a goroutine.
+func (cs *chatServer) runReportDigests(interval time.Duration, threshold int) {
+	for range time.Tick(interval) {
+		text := cs.reports.digest(threshold)
+		if text == "" || !notifyConfigured() {
+			continue
+		}
+		if err := notifyOperator("NearTalk abuse report digest", text); err != nil {
+			log.Printf("chatServer.runReportDigests: %v", err)
+		}
+	}
+}
+
+// handleReportCmd handles "/report <reason>".
+// It does not lock the clientsMu, callers should do that.
+func (cr *chatRoom) handleReportCmd(c *client, reason string) {
+	reason = strings.ToValidUTF8(strings.TrimSpace(reason), "\uFFFD")
+	if reason == "" {
+		c.sendError("Usage: /report <what's wrong>")
+		return
+	}
+	if time.Since(c.lastReport) < reportCooldown {
+		c.sendError("You've reported something recently, please wait a minute")
+		return
+	}
+	if len(reason) > maxReportReasonLen {
+		reason = strings.ToValidUTF8(reason[:maxReportReasonLen], "")
+	}
+	if !reportsDelivered() {
+		c.sendNotice("This server has no way to pass reports on to its operator, but you can stop seeing someone's messages with /ignore <nickname>")
+		return
+	}
+	c.lastReport = time.Now()
+	cr.server.reports.add(cr.key, fmt.Sprintf("%s: %s", plainNick(c.nick), reason), false)
+	c.sendNotice("Thanks, your report will be sent to the server operator")
+}
@@ -0,0 +1,72 @@
+package main
+
+// This file limits how many chat rooms can exist at once. Since rooms are
+// created for any new IP address, and X-Forwarded-For can be forged if the
+// reverse proxy isn't set up right, rooms could otherwise be created without
+// limit.
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"time"
+)
+
+// Room eviction policies, for the -room-policy flag.
+const (
+	// roomPolicyRefuse refuses clients that would create a new room.
+	roomPolicyRefuse = "refuse"
+	// roomPolicyEvictIdle closes the room that has been idle the longest to
+	// make space for the new one.
+	roomPolicyEvictIdle = "evict-idle"
+)
+
+var errTooManyRooms = errors.New("too many chat rooms")
+
+// lastActivity returns when the room last had a message, or when it was
+// created if there haven't been any.
+// It holds the client mutex.
+func (cr *chatRoom) lastActivity() time.Time {
+	cr.clientsMu.Lock()
+	defer cr.clientsMu.Unlock()
+
+	if cr.whenLastMsg.After(cr.created) {
+		return cr.whenLastMsg
+	}
+	return cr.created
+}
+
+// makeRoomSpace makes sure there is space for a new room, according to the
+// room policy. It returns errTooManyRooms if there isn't space.
+// It does not lock the roomsMu, callers should do that.
+func (cs *chatServer) makeRoomSpace() error {
+	if maxRooms == 0 || uint(len(cs.rooms)) < maxRooms {
+		return nil
+	}
+	if roomPolicy != roomPolicyEvictIdle {
+		return errTooManyRooms
+	}
+
+	var idlestKey string
+	var idlestRoom *chatRoom
+	var idlestTime time.Time
+	for key, room := range cs.rooms {
+		t := room.lastActivity()
+		if idlestRoom == nil || t.Before(idlestTime) {
+			idlestKey, idlestRoom, idlestTime = key, room, t
+		}
+	}
+	log.Printf("chatServer.makeRoomSpace: evicting room %s, idle since %v", idlestKey, idlestTime)
+	delete(cs.rooms, idlestKey)
+	idlestRoom.close(roomEvicted)
+	return nil
+}
+
+// validateRoomPolicy returns an error if the -room-policy flag is invalid.
+func validateRoomPolicy() error {
+	if roomPolicy != roomPolicyRefuse && roomPolicy != roomPolicyEvictIdle {
+		return fmt.Errorf("invalid room policy %q, must be %q or %q",
+			roomPolicy, roomPolicyRefuse, roomPolicyEvictIdle)
+	}
+	return nil
+}
@@ -0,0 +1,396 @@
+package main
+
+// This file lets admins merge rooms and split them. Merging is for one place
+// that gets more than one room, like an office with both IPv4 and IPv6
+// addresses, and splitting is for one room with too many places in it, like
+// everyone behind a big NAT or a whole city with -geoip-level. A split room
+// is split by subnets, and people in each subnet get a room named after it.
+// Since everyone behind a NAT has the same public address, that only works
+// where the server sees their own addresses, like the "lan" room, or rooms
+// for places.
+//
+// Both move everyone who's in the room right away, telling them why, and
+// send whoever connects to it later to the new room too, until the admin
+// undoes it or the server restarts. Only the room people get for their
+// address changes, not the rooms they join by name, with an invite, or from
+// the LAN landing page, and with Redis only on the instance the admin used.
+//
+// Admins can do both from the admin page, or with the API, see api.go.
+
+import (
+	"errors"
+	"fmt"
+	"html/template"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+
+	"nhooyr.io/websocket"
+)
+
+// maxSplitSubnets is how many subnets a room can be split into.
+const maxSplitSubnets = 16
+
+// roomRoutes holds the rooms admins have merged or split, to send people
+// who connect to them later to the right room.
+type roomRoutes struct {
+	mu sync.Mutex
+	// merged maps the keys of merged rooms to the key of the room they were
+	// merged into, which is never merged itself.
+	merged map[string]string
+	// split maps the keys of split rooms to the subnets they were split by.
+	split map[string][]*net.IPNet
+}
+
+func newRoomRoutes() *roomRoutes {
+	return &roomRoutes{
+		merged: make(map[string]string),
+		split:  make(map[string][]*net.IPNet),
+	}
+}
+
+// subnetRoomKey returns the key of the room for people in the subnet of a
+// split room.
+func subnetRoomKey(n *net.IPNet) string {
+	return n.String()
+}
+
+// route returns the key of the room people with the address should join
+// instead of the room with the key. The address can be nil.
+func (rr *roomRoutes) route(key string, ip net.IP) string {
+	rr.mu.Lock()
+	defer rr.mu.Unlock()
+	if to, ok := rr.merged[key]; ok {
+		key = to
+	}
+	if ip != nil {
+		for _, n := range rr.split[key] {
+			if n.Contains(ip) {
+				key = subnetRoomKey(n)
+				break
+			}
+		}
+	}
+	if to, ok := rr.merged[key]; ok {
+		// A subnet room that was merged
+		key = to
+	}
+	return key
+}
+
+// merge sends people for the room with the key from to the one with the key
+// into from now on. It returns the key of the room they'll join, which is
+// different if into was merged too.
+func (rr *roomRoutes) merge(from, into string) (string, error) {
+	rr.mu.Lock()
+	defer rr.mu.Unlock()
+	if to, ok := rr.merged[into]; ok {
+		into = to
+	}
+	if from == into {
+		return "", errors.New("a room can't be merged into itself")
+	}
+	if _, ok := rr.split[from]; ok {
+		return "", fmt.Errorf("%s was split, undo that first", from)
+	}
+	rr.merged[from] = into
+	// Rooms merged into this one go to the new room too, so there's never
+	// more than one step
+	for k, to := range rr.merged {
+		if to == from {
+			rr.merged[k] = into
+		}
+	}
+	return into, nil
+}
+
+// splitBy sends people for the room with the key to the rooms for their
+// subnets from now on.
+func (rr *roomRoutes) splitBy(key string, nets []*net.IPNet) error {
+	rr.mu.Lock()
+	defer rr.mu.Unlock()
+	if to, ok := rr.merged[key]; ok {
+		return fmt.Errorf("%s was merged into %s, split that instead", key, to)
+	}
+	rr.split[key] = nets
+	return nil
+}
+
+// remove stops merging or splitting the room with the key. It returns false
+// if it's neither.
+func (rr *roomRoutes) remove(key string) bool {
+	rr.mu.Lock()
+	defer rr.mu.Unlock()
+	_, merged := rr.merged[key]
+	_, split := rr.split[key]
+	delete(rr.merged, key)
+	delete(rr.split, key)
+	return merged || split
+}
+
+// apiRoute describes a merged or split room in API responses.
+type apiRoute struct {
+	Room string `json:"room"`
+	// MergedInto is the key of the room it was merged into, if it was.
+	MergedInto string `json:"merged_into,omitempty"`
+	// Subnets is what it was split by, if it was.
+	Subnets []string `json:"subnets,omitempty"`
+}
+
+// list returns the merged and split rooms, sorted by key.
+func (rr *roomRoutes) list() []apiRoute {
+	rr.mu.Lock()
+	defer rr.mu.Unlock()
+	routes := make([]apiRoute, 0, len(rr.merged)+len(rr.split))
+	for from, into := range rr.merged {
+		routes = append(routes, apiRoute{Room: from, MergedInto: into})
+	}
+	for key, nets := range rr.split {
+		r := apiRoute{Room: key}
+		for _, n := range nets {
+			r.Subnets = append(r.Subnets, n.String())
+		}
+		routes = append(routes, r)
+	}
+	sort.Slice(routes, func(i, j int) bool { return routes[i].Room < routes[j].Room })
+	return routes
+}
+
+// clientRoomKey returns the key of the room for the request's client, which
+// is the room for their address, see roomKey, unless the admin merged or
+// split it.
+func (cs *chatServer) clientRoomKey(r *http.Request) string {
+	return cs.routes.route(roomKey(r), clientAddr(r, int(trustedProxies)))
+}
+
+// movableRoom returns an error if the room with the key can't be merged or
+// split.
+func movableRoom(key string) error {
+	if key == "" {
+		return errors.New("a room key is required")
+	}
+	if !canHaveSubrooms(key) {
+		return fmt.Errorf("%s isn't the room for a network, only those can be merged or split", key)
+	}
+	return nil
+}
+
+// roomMove is the result of merging or splitting a room. It's the API
+// response for doing either.
+type roomMove struct {
+	Room string `json:"room"`
+	// Moved maps the keys of the rooms people were moved to, to how many
+	// went to each.
+	Moved map[string]int `json:"moved"`
+}
+
+// summary describes the move, for the admin page.
+func (m roomMove) summary() string {
+	if len(m.Moved) == 0 {
+		return fmt.Sprintf("Done, nobody was in %s right now.", roomTitle(m.Room))
+	}
+	var parts []string
+	for key, n := range m.Moved {
+		parts = append(parts, fmt.Sprintf("%d to %s", n, roomTitle(key)))
+	}
+	sort.Strings(parts)
+	return fmt.Sprintf("Done, moved %s.", strings.Join(parts, ", "))
+}
+
+// mergeRooms merges the room with the key from into the one with the key
+// into. Everyone in it is moved, and people who connect to it later join
+// into instead.
+// It holds the roomsMu.
+func (cs *chatServer) mergeRooms(from, into string) (roomMove, error) {
+	if err := movableRoom(from); err != nil {
+		return roomMove{}, err
+	}
+	if err := movableRoom(into); err != nil {
+		return roomMove{}, err
+	}
+	cs.roomsMu.Lock()
+	defer cs.roomsMu.Unlock()
+	into, err := cs.routes.merge(from, into)
+	if err != nil {
+		return roomMove{}, err
+	}
+	notice := fmt.Sprintf("The admin merged this room into %s, so you're there now.", roomTitle(into))
+	return cs.moveClients(from, func(*client) string { return into }, notice)
+}
+
+// splitRoom splits the room with the key by the subnets. Everyone in it with
+// an address in one of them is moved to the room for that subnet, and so are
+// people who connect to it later. Everyone else stays.
+// It holds the roomsMu.
+func (cs *chatServer) splitRoom(key string, nets []*net.IPNet) (roomMove, error) {
+	if err := movableRoom(key); err != nil {
+		return roomMove{}, err
+	}
+	if privateRooms {
+		// The rooms are named after the subnets
+		return roomMove{}, errors.New("rooms can't be split with -private-rooms")
+	}
+	if len(nets) == 0 || len(nets) > maxSplitSubnets {
+		return roomMove{}, fmt.Errorf("a room can be split by 1 to %d subnets", maxSplitSubnets)
+	}
+	cs.roomsMu.Lock()
+	defer cs.roomsMu.Unlock()
+	if err := cs.routes.splitBy(key, nets); err != nil {
+		return roomMove{}, err
+	}
+	return cs.moveClients(key, func(c *client) string {
+		ip := net.ParseIP(c.addr)
+		for _, n := range nets {
+			if ip != nil && n.Contains(ip) {
+				return subnetRoomKey(n)
+			}
+		}
+		return ""
+	}, "The admin split this room by network, so you're in the room for yours now.")
+}
+
+// moveClients moves everyone in the room with the key to the room pick
+// returns for them, creating it if needed, and sends them the notice first.
+// Nobody is moved if pick returns an empty string. Moved people can join the
+// new room even if it's locked. The room is closed if everyone was moved.
+// It does not lock the roomsMu, callers should do that.
+func (cs *chatServer) moveClients(key string, pick func(c *client) string, notice string) (roomMove, error) {
+	move := roomMove{Room: key, Moved: make(map[string]int)}
+	room, ok := cs.rooms[key]
+	if !ok {
+		return move, nil
+	}
+	room.clientsMu.Lock()
+	clients := make([]*client, 0, len(room.clients))
+	for c := range room.clients {
+		clients = append(clients, c)
+	}
+	room.clientsMu.Unlock()
+
+	defer cs.admins.poke()
+	for _, c := range clients {
+		to := pick(c)
+		if to == "" || to == key {
+			continue
+		}
+		target, ok := cs.rooms[to]
+		if !ok {
+			if err := cs.makeRoomSpace(); err != nil {
+				return move, err
+			}
+			target = newChatRoom(cs, to)
+			cs.rooms[to] = target
+			cs.roomCreated(target)
+		}
+		c.sendNotice(notice)
+		room.removeClient(c)
+		target.clientsMu.Lock()
+		if c.bot != nil && target.hasBot(c.bot) {
+			target.clientsMu.Unlock()
+			c.disconnectAfterSent(websocket.StatusNormalClosure, "bot is already in the room it was moved to")
+			continue
+		}
+		target.allowedSessions[c.session] = true
+		target.clientsMu.Unlock()
+		target.addClient(c)
+		c.moveTo(target)
+		move.Moved[to]++
+	}
+	if room.numClients() == 0 {
+		delete(cs.rooms, key)
+		room.close(roomMoved)
+	}
+	return move, nil
+}
+
+// moveTo tells the client's connection it's in the room now, replacing a
+// move it hasn't noticed yet. It's only called while holding the roomsMu,
+// so there's never more than one sender.
+func (c *client) moveTo(room *chatRoom) {
+	select {
+	case <-c.moved:
+	default:
+	}
+	c.moved <- room
+}
+
+// parseSubnets parses subnets in CIDR notation, separated by commas or
+// spaces.
+func parseSubnets(s string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, f := range strings.FieldsFunc(s, func(r rune) bool { return r == ',' || r == ' ' }) {
+		_, n, err := net.ParseCIDR(f)
+		if err != nil {
+			return nil, fmt.Errorf("%q isn't a subnet like 10.1.0.0/16", f)
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+// adminMoveHandler serves the admin page forms for merging and splitting
+// rooms, and does it when one is sent.
+func (cs *chatServer) adminMoveHandler(w http.ResponseWriter, r *http.Request) {
+	keyID, ok := cs.adminSession(r)
+	if !ok {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	if r.Method != http.MethodPost {
+		fmt.Fprint(w, adminMoveForms(""))
+		return
+	}
+	room := strings.TrimSpace(r.FormValue("room"))
+	var move roomMove
+	var err error
+	switch {
+	case r.FormValue("undo") != "":
+		if !cs.routes.remove(room) {
+			fmt.Fprint(w, adminMoveForms(fmt.Sprintf("%s wasn't merged or split.", room)))
+			return
+		}
+		cs.audit.record(keyID, auditUndoMove, room, "")
+		fmt.Fprint(w, adminMoveForms(fmt.Sprintf("People who join %s stay there again.", room)))
+		return
+	case r.FormValue("into") != "":
+		into := strings.TrimSpace(r.FormValue("into"))
+		if move, err = cs.mergeRooms(room, into); err == nil {
+			cs.audit.record(keyID, auditMergeRooms, room, into)
+		}
+	default:
+		var nets []*net.IPNet
+		if nets, err = parseSubnets(r.FormValue("subnets")); err == nil {
+			if move, err = cs.splitRoom(room, nets); err == nil {
+				cs.audit.record(keyID, auditSplitRoom, room, r.FormValue("subnets"))
+			}
+		}
+	}
+	if err != nil {
+		fmt.Fprint(w, adminMoveForms(err.Error()))
+		return
+	}
+	fmt.Fprint(w, adminMoveForms(move.summary()))
+}
+
+// adminMoveForms returns the admin page forms for merging, splitting, and
+// undoing either, with a status message under them if status isn't empty.
+func adminMoveForms(status string) string {
+	var b strings.Builder
+	b.WriteString(`<div hx-target="this" hx-swap="outerHTML">` +
+		`<form hx-post="/admin-move" hx-confirm="Move everyone in this room to the other one?">` +
+		`Merge <input name="room" placeholder="Room key" required /> into ` +
+		`<input name="into" placeholder="Room key" required /> <button>Merge</button></form>` +
+		`<form hx-post="/admin-move" hx-confirm="Move everyone in these subnets to rooms of their own?">` +
+		`Split <input name="room" placeholder="Room key" required /> by ` +
+		`<input name="subnets" placeholder="10.1.0.0/16, 10.2.0.0/16" required /> <button>Split</button></form>` +
+		`<form hx-post="/admin-move">` +
+		`Undo for <input name="room" placeholder="Room key" required /> ` +
+		`<input type="hidden" name="undo" value="1" /><button>Undo</button></form>`)
+	if status != "" {
+		fmt.Fprintf(&b, `<p>%s</p>`, template.HTMLEscapeString(status))
+	}
+	b.WriteString(`</div>`)
+	return b.String()
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"net"
+	"testing"
+)
+
+func TestRoomRoutes(t *testing.T) {
+	rr := newRoomRoutes()
+	if _, err := rr.merge("203.0.113.7", "203.0.113.7"); err == nil {
+		t.Error("merged a room into itself")
+	}
+	if into, err := rr.merge("203.0.113.7", "2001:db8::1"); err != nil || into != "2001:db8::1" {
+		t.Fatalf("merge = %q, %v", into, err)
+	}
+	// Merging into a merged room goes to where that one went
+	if into, err := rr.merge("198.51.100.1", "203.0.113.7"); err != nil || into != "2001:db8::1" {
+		t.Errorf("merge into a merged room = %q, %v", into, err)
+	}
+	if _, err := rr.merge("2001:db8::1", "203.0.113.7"); err == nil {
+		t.Error("merged a room into one merged into it")
+	}
+
+	nets, err := parseSubnets("10.1.0.0/16, 10.2.0.0/16")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := rr.splitBy("lan", nets); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := rr.merge("10.2.0.0/16", "10.1.0.0/16"); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		key  string
+		ip   string
+		want string
+	}{
+		{"203.0.113.7", "203.0.113.7", "2001:db8::1"},
+		{"198.51.100.1", "198.51.100.1", "2001:db8::1"},
+		{"192.0.2.1", "192.0.2.1", "192.0.2.1"},
+		{"lan", "10.1.2.3", "10.1.0.0/16"},
+		{"lan", "10.2.2.3", "10.1.0.0/16"},
+		{"lan", "10.3.2.3", "lan"},
+		{"lan", "", "lan"},
+	}
+	for _, tt := range tests {
+		if got := rr.route(tt.key, net.ParseIP(tt.ip)); got != tt.want {
+			t.Errorf("route(%q, %q) = %q, want %q", tt.key, tt.ip, got, tt.want)
+		}
+	}
+
+	if !rr.remove("lan") || rr.remove("lan") {
+		t.Error("remove didn't undo the split once")
+	}
+	if got := rr.route("lan", net.ParseIP("10.1.2.3")); got != "lan" {
+		t.Errorf("route after undoing the split = %q", got)
+	}
+	if _, err := parseSubnets("10.1.0.0/16 example.com"); err == nil {
+		t.Error("parsed a subnet that isn't one")
+	}
+}
@@ -0,0 +1,246 @@
+package main
+
+// This file saves room settings, so they survive restarts and the room
+// closing when everyone leaves. It's off unless -room-settings-file or
+// -storage is set, and then the topic, the password of a locked room and who
+// can rejoin it without one, and slow mode are saved in the storage by room
+// key, see storage.go. A
+// locked room stays locked even while it's empty. Rooms that haven't been
+// used in settingsTTL are forgotten. With Redis, each instance saves its
+// own.
+
+import (
+	"bytes"
+	"log"
+	"sync"
+	"time"
+)
+
+// savedRoom is the saved settings of a room.
+type savedRoom struct {
+	Topic string `json:"topic,omitempty"`
+	// PasswordSalt, PasswordHash and PasswordIterations are the roomPassword
+	// of a locked room.
+	PasswordSalt       []byte `json:"password_salt,omitempty"`
+	PasswordHash       []byte `json:"password_hash,omitempty"`
+	PasswordIterations int    `json:"password_iterations,omitempty"`
+	// AllowedSessions can join the locked room without the password.
+	AllowedSessions []string `json:"allowed_sessions,omitempty"`
+	// Creator is the session that created the room, who can unlock it.
+	Creator  string        `json:"creator,omitempty"`
+	SlowMode time.Duration `json:"slow_mode,omitempty"`
+	// LastUsed is when the room last changed or was open.
+	LastUsed time.Time `json:"last_used"`
+}
+
+// empty returns true if there's nothing worth saving.
+func (sr savedRoom) empty() bool {
+	return sr.Topic == "" && sr.PasswordHash == nil && sr.SlowMode == 0
+}
+
+// password returns the room password, or nil if the room isn't locked.
+func (sr savedRoom) password() *roomPassword {
+	if sr.PasswordHash == nil {
+		return nil
+	}
+	return &roomPassword{salt: sr.PasswordSalt, hash: sr.PasswordHash, iterations: sr.PasswordIterations}
+}
+
+// roomSettingsStore holds the saved settings of all rooms.
+type roomSettingsStore struct {
+	mu    sync.Mutex
+	rooms map[string]*savedRoom
+	// store is where settings are saved. Nothing is kept if it's nil.
+	store storage
+	// dirty is true if settings have changed since they were last saved.
+	dirty bool
+}
+
+// newRoomSettingsStore creates a room settings store. If store is not nil,
+// settings are loaded from it, and saved to it periodically.
+func newRoomSettingsStore(store storage) (*roomSettingsStore, error) {
+	s := &roomSettingsStore{
+		rooms: make(map[string]*savedRoom),
+		store: store,
+	}
+	if store == nil {
+		return s, nil
+	}
+
+	rooms, err := store.loadRoomSettings()
+	if err != nil {
+		return nil, err
+	}
+	s.rooms = rooms
+	s.expire()
+	go func() {
+		for range time.Tick(settingsSaveInterval) {
+			if err := s.save(); err != nil {
+				log.Printf("roomSettingsStore: %v", err)
+			}
+		}
+	}()
+	return s, nil
+}
+
+// get returns the saved settings of the room, and false if there are none.
+func (s *roomSettingsStore) get(key string) (savedRoom, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	sr, ok := s.rooms[key]
+	if !ok {
+		return savedRoom{}, false
+	}
+	return *sr, true
+}
+
+// put saves the settings of the room, or forgets them if they're empty. It
+// does nothing if the store has no storage.
+func (s *roomSettingsStore) put(key string, sr savedRoom) {
+	if s.store == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if sr.empty() {
+		if _, ok := s.rooms[key]; ok {
+			delete(s.rooms, key)
+			s.dirty = true
+		}
+		return
+	}
+	sr.LastUsed = time.Now()
+	s.rooms[key] = &sr
+	s.dirty = true
+}
+
+// mayJoin returns true if the session can join the room while it's closed,
+// because it wasn't locked or the session can rejoin it.
+func (s *roomSettingsStore) mayJoin(key, session string) bool {
+	sr, ok := s.get(key)
+	if !ok || sr.PasswordHash == nil {
+		return true
+	}
+	for _, allowed := range sr.AllowedSessions {
+		if allowed == session {
+			return true
+		}
+	}
+	return false
+}
+
+// enterPassword lets the session join the closed room if the password is
+// right. It returns false if it's wrong. The mutex isn't held while the slow
+// hash is checked.
+func (s *roomSettingsStore) enterPassword(key, session, password string) bool {
+	saved, ok := s.get(key)
+	if !ok || saved.PasswordHash == nil {
+		return true
+	}
+	if !saved.password().matches(password) {
+		return false
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sr, ok := s.rooms[key]
+	if !ok || sr.PasswordHash == nil {
+		return true
+	}
+	if !bytes.Equal(sr.PasswordHash, saved.PasswordHash) {
+		// Locked with another password while checking
+		return false
+	}
+	sr.AllowedSessions = append(sr.AllowedSessions, session)
+	s.dirty = true
+	return true
+}
+
+// remove forgets the settings of the room. It returns false if there were
+// none.
+func (s *roomSettingsStore) remove(key string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.rooms[key]; !ok {
+		return false
+	}
+	delete(s.rooms, key)
+	s.dirty = true
+	return true
+}
+
+// expire forgets rooms that haven't been used in settingsTTL, or -retention
+// if that's shorter.
+func (s *roomSettingsStore) expire() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	ttl := settingsTTL
+	if retention > 0 && retention < ttl {
+		ttl = retention
+	}
+	for key, sr := range s.rooms {
+		if time.Since(sr.LastUsed) > ttl {
+			delete(s.rooms, key)
+			s.dirty = true
+		}
+	}
+}
+
+// save writes the settings to the storage if they've changed. It does nothing
+// if the store has no storage.
+func (s *roomSettingsStore) save() error {
+	if s.store == nil {
+		return nil
+	}
+	s.expire()
+
+	s.mu.Lock()
+	if !s.dirty {
+		s.mu.Unlock()
+		return nil
+	}
+	rooms := copySavedRooms(s.rooms)
+	s.dirty = false
+	s.mu.Unlock()
+	return s.store.saveRoomSettings(rooms)
+}
+
+// saveSettings saves the room's settings in the server's room settings
+// store. It should be called whenever one of them changes.
+// It does not lock the clientsMu, callers should do that.
+func (cr *chatRoom) saveSettings() {
+	sr := savedRoom{
+		Topic:    cr.topic,
+		Creator:  cr.creator,
+		SlowMode: cr.slowMode,
+	}
+	if cr.password != nil {
+		sr.PasswordSalt = cr.password.salt
+		sr.PasswordHash = cr.password.hash
+		sr.PasswordIterations = cr.password.iterations
+		for session := range cr.allowedSessions {
+			sr.AllowedSessions = append(sr.AllowedSessions, session)
+		}
+	}
+	cr.server.roomSettings.put(cr.key, sr)
+}
+
+// restoreSettings sets up the new room with its saved settings, if it has
+// any.
+// It does not lock the clientsMu, callers should do that.
+func (cr *chatRoom) restoreSettings() {
+	sr, ok := cr.server.roomSettings.get(cr.key)
+	if !ok {
+		return
+	}
+	cr.topic = sr.Topic
+	cr.creator = sr.Creator
+	cr.slowMode = sr.SlowMode
+	cr.password = sr.password()
+	for _, session := range sr.AllowedSessions {
+		cr.allowedSessions[session] = true
+	}
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestRoomSettingsStore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "rooms.json")
+	s, err := newRoomSettingsStore(&fileStorage{roomsPath: path})
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := newRoomPassword("secret")
+	s.put("lan", savedRoom{Topic: "Games", SlowMode: 10 * time.Second})
+	s.put("locked", savedRoom{PasswordSalt: p.salt, PasswordHash: p.hash, PasswordIterations: p.iterations, AllowedSessions: []string{"a"}})
+	s.put("plain", savedRoom{Creator: "a"})
+	if err := s.save(); err != nil {
+		t.Fatal(err)
+	}
+
+	s, err = newRoomSettingsStore(&fileStorage{roomsPath: path})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sr, ok := s.get("lan"); !ok || sr.Topic != "Games" || sr.SlowMode != 10*time.Second {
+		t.Errorf("lan = %+v, %v after reloading", sr, ok)
+	}
+	if _, ok := s.get("plain"); ok {
+		t.Error("room with nothing worth saving was saved")
+	}
+
+	if !s.mayJoin("locked", "a") || s.mayJoin("locked", "b") {
+		t.Error("wrong sessions can join the locked room")
+	}
+	if s.enterPassword("locked", "b", "wrong") {
+		t.Error("wrong password accepted")
+	}
+	if !s.enterPassword("locked", "b", "secret") || !s.mayJoin("locked", "b") {
+		t.Error("session can't join after entering the password")
+	}
+	if !s.mayJoin("other", "b") {
+		t.Error("can't join a room with no saved settings")
+	}
+}
+
+func TestRoomSettingsStoreDisabled(t *testing.T) {
+	s, err := newRoomSettingsStore(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.put("lan", savedRoom{Topic: "Games"})
+	if _, ok := s.get("lan"); ok {
+		t.Error("settings kept without a storage")
+	}
+}
@@ -0,0 +1,234 @@
+package main
+
+// This file keeps activity statistics for each room, shown as graphs on the
+// admin page: messages and people per minute over the last statsHistory, the
+// most people there have been at once, and how long the room has been open.
+// When a room closes its totals are kept in a short list of recently closed
+// rooms, so operators can see how long rooms tend to last. Everything is kept
+// in memory only.
+
+import (
+	"fmt"
+	"html/template"
+	"strings"
+	"sync"
+	"time"
+)
+
+// statsBucket is how much time each point in the graphs covers.
+const statsBucket = time.Minute
+
+// statsHistory is how far back the graphs go.
+const statsHistory = time.Hour
+
+// maxClosedRooms is how many recently closed rooms are shown.
+const maxClosedRooms = 20
+
+// statsPoint is the activity in a room during one statsBucket.
+type statsPoint struct {
+	msgs int
+	// users is the most people there were in the room at once.
+	users int
+}
+
+// roomStats holds the activity statistics for a room. It's protected by the
+// room's clientsMu.
+type roomStats struct {
+	// points holds the activity per statsBucket, oldest first. The last one
+	// is the current bucket.
+	points []statsPoint
+	// start is when the first point's bucket started.
+	start time.Time
+	// users is how many people are in the room now.
+	users     int
+	peakUsers int
+	totalMsgs int
+}
+
+// advance adds empty points up to the bucket for now, dropping the ones
+// older than statsHistory.
+func (rs *roomStats) advance(now time.Time) {
+	bucket := now.Truncate(statsBucket)
+	if rs.points == nil {
+		rs.start = bucket
+		rs.points = []statsPoint{{users: rs.users}}
+		return
+	}
+	last := rs.start.Add(time.Duration(len(rs.points)-1) * statsBucket)
+	for ; last.Before(bucket); last = last.Add(statsBucket) {
+		rs.points = append(rs.points, statsPoint{users: rs.users})
+	}
+	if n := len(rs.points) - int(statsHistory/statsBucket); n > 0 {
+		rs.points = rs.points[n:]
+		rs.start = rs.start.Add(time.Duration(n) * statsBucket)
+	}
+}
+
+// recordMsg counts a chat message.
+func (rs *roomStats) recordMsg(now time.Time) {
+	rs.advance(now)
+	rs.points[len(rs.points)-1].msgs++
+	rs.totalMsgs++
+}
+
+// recordUsers records how many people are in the room.
+func (rs *roomStats) recordUsers(now time.Time, users int) {
+	rs.advance(now)
+	rs.users = users
+	p := &rs.points[len(rs.points)-1]
+	if users > p.users {
+		p.users = users
+	}
+	if users > rs.peakUsers {
+		rs.peakUsers = users
+	}
+}
+
+// closedRoom is the statistics of a room that closed.
+type closedRoom struct {
+	key       string
+	created   time.Time
+	closed    time.Time
+	reason    roomCloseReason
+	peakUsers int
+	totalMsgs int
+}
+
+// closedRooms holds the most recently closed rooms.
+type closedRooms struct {
+	mu    sync.Mutex
+	rooms []closedRoom
+}
+
+// add is the room hook that records rooms closing.
+func (c *closedRooms) add(e roomEvent) {
+	if e.Event != roomEventClosed {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.rooms = append(c.rooms, closedRoom{
+		key:       e.Room,
+		created:   e.Created,
+		closed:    e.Time,
+		reason:    e.Reason,
+		peakUsers: e.PeakUsers,
+		totalMsgs: e.Messages,
+	})
+	if len(c.rooms) > maxClosedRooms {
+		c.rooms = c.rooms[len(c.rooms)-maxClosedRooms:]
+	}
+}
+
+// remove forgets the statistics of the closed room, and returns how many
+// times it was in the list.
+func (c *closedRooms) remove(key string) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	kept := c.rooms[:0]
+	for _, r := range c.rooms {
+		if r.key != key {
+			kept = append(kept, r)
+		}
+	}
+	n := len(c.rooms) - len(kept)
+	c.rooms = kept
+	return n
+}
+
+// expire forgets the statistics of rooms that closed before the time.
+func (c *closedRooms) expire(before time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	kept := c.rooms[:0]
+	for _, r := range c.rooms {
+		if !r.closed.Before(before) {
+			kept = append(kept, r)
+		}
+	}
+	c.rooms = kept
+}
+
+// html returns the admin page table of recently closed rooms, newest first.
+func (c *closedRooms) html() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.rooms) == 0 {
+		return ""
+	}
+	var b strings.Builder
+	b.WriteString(`<details><summary>Recently closed rooms</summary><table><thead><tr>` +
+		`<th>Room</th><th>Closed</th><th>Why</th><th>Open for</th><th>Peak people</th><th>Messages</th></tr></thead><tbody>`)
+	for i := len(c.rooms) - 1; i >= 0; i-- {
+		r := c.rooms[i]
+		fmt.Fprintf(&b, `<tr><td>%s</td><td>%s</td><td>%s</td><td>%s</td><td>%d</td><td>%d</td></tr>`,
+			template.HTMLEscapeString(roomTitle(r.key)), r.closed.Format("15:04"), r.reason,
+			roundDuration(r.closed.Sub(r.created)), r.peakUsers, r.totalMsgs,
+		)
+	}
+	b.WriteString(`</tbody></table></details>`)
+	return b.String()
+}
+
+// statsHTML returns the admin page statistics and graphs for the room.
+// It does not lock the clientsMu, callers should do that.
+func (cr *chatRoom) statsHTML() string {
+	cr.stats.advance(time.Now())
+	msgs := make([]int, len(cr.stats.points))
+	users := make([]int, len(cr.stats.points))
+	for i, p := range cr.stats.points {
+		msgs[i] = p.msgs
+		users[i] = p.users
+	}
+	return fmt.Sprintf(
+		`<p>Open for %s, at most %d people at once, %d messages in total</p>`+
+			`<p>Messages per minute, last hour: %s</p><p>People, last hour: %s</p>`,
+		roundDuration(time.Since(cr.created)), cr.stats.peakUsers, cr.stats.totalMsgs,
+		sparkline(msgs), sparkline(users),
+	)
+}
+
+// roundDuration returns the duration to the minute, like 1h5m.
+func roundDuration(d time.Duration) string {
+	if d < time.Minute {
+		return "under a minute"
+	}
+	s := strings.TrimSuffix(d.Round(time.Minute).String(), "0s")
+	if strings.HasSuffix(s, "h0m") {
+		s = strings.TrimSuffix(s, "0m")
+	}
+	return s
+}
+
+// Sparkline size in pixels.
+const (
+	sparkWidth  = 180
+	sparkHeight = 30
+)
+
+// sparkline returns a small SVG graph of the values, oldest first, padded to
+// statsHistory on the left. The peak is given in the title.
+func sparkline(values []int) string {
+	n := int(statsHistory / statsBucket)
+	peak := 0
+	for _, v := range values {
+		if v > peak {
+			peak = v
+		}
+	}
+	var points strings.Builder
+	offset := n - len(values)
+	for i, v := range values {
+		x := float64(offset+i) * sparkWidth / float64(n-1)
+		y := float64(sparkHeight)
+		if peak > 0 {
+			y -= float64(v) * sparkHeight / float64(peak)
+		}
+		fmt.Fprintf(&points, "%.1f,%.1f ", x, y)
+	}
+	return fmt.Sprintf(
+		`<svg width="%d" height="%d" viewBox="0 -1 %d %d" role="img"><title>Peak %d</title>`+
+			`<polyline fill="none" stroke="currentColor" points="%s" /></svg>`,
+		sparkWidth, sparkHeight, sparkWidth, sparkHeight+2, peak, strings.TrimSpace(points.String()),
+	)
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRoomStats(t *testing.T) {
+	var rs roomStats
+	start := time.Date(2026, 10, 16, 12, 0, 30, 0, time.UTC)
+	rs.recordUsers(start, 1)
+	rs.recordUsers(start, 3)
+	rs.recordUsers(start, 2)
+	rs.recordMsg(start)
+	rs.recordMsg(start.Add(10 * time.Second))
+	rs.recordMsg(start.Add(2 * time.Minute))
+
+	if len(rs.points) != 3 {
+		t.Fatalf("got %d points, want 3", len(rs.points))
+	}
+	if rs.points[0].msgs != 2 || rs.points[0].users != 3 {
+		t.Errorf("first point = %+v, want 2 messages and 3 users", rs.points[0])
+	}
+	// Nobody left, so the empty minute has the same people
+	if rs.points[1] != (statsPoint{users: 2}) {
+		t.Errorf("empty point = %+v, want 2 users", rs.points[1])
+	}
+	if rs.peakUsers != 3 || rs.totalMsgs != 3 {
+		t.Errorf("peak = %d, total = %d, want 3 and 3", rs.peakUsers, rs.totalMsgs)
+	}
+
+	rs.advance(start.Add(3 * time.Hour))
+	if len(rs.points) != int(statsHistory/statsBucket) {
+		t.Errorf("got %d points after 3 hours, want %d", len(rs.points), statsHistory/statsBucket)
+	}
+	if rs.peakUsers != 3 || rs.totalMsgs != 3 {
+		t.Error("totals were dropped with the old points")
+	}
+}
+
+func TestSparkline(t *testing.T) {
+	s := sparkline([]int{0, 5, 10})
+	if !strings.Contains(s, "<title>Peak 10</title>") || !strings.HasSuffix(s, "</svg>") {
+		t.Errorf("sparkline = %q", s)
+	}
+	// The newest value is at the right edge, and the peak at the top
+	if !strings.Contains(s, "180.0,0.0\"") {
+		t.Errorf("sparkline doesn't end at the top right: %q", s)
+	}
+}
@@ -0,0 +1,124 @@
+package main
+
+// This file handles searching a room's history with "/search <term>", or the
+// search box in the web UI, see history.go. The results only go to whoever
+// searched, newest first, a page at a time. Older pages are found with
+// "/search before:<id> <term>", where the ID is of the oldest result so far,
+// which the web UI's "Older" button sends. Searching can be slow, so it
+// happens outside the room's goroutine, and each person's searches are rate
+// limited by searchRate and searchBurst.
+
+import (
+	"html/template"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/makeworld-the-better-one/neartalk/events"
+	"github.com/makeworld-the-better-one/neartalk/ids"
+	"github.com/rivo/uniseg"
+	"golang.org/x/time/rate"
+)
+
+// searchPageSize is how many results are sent at a time.
+const searchPageSize = 10
+
+// maxSearchLen is the max length of a search term, in characters.
+const maxSearchLen = 100
+
+// searchRate and searchBurst limit how often a client can search.
+const (
+	searchRate  = rate.Limit(0.5)
+	searchBurst = 3
+)
+
+// searchBox is the search form for the web UI, sent when history is kept.
+const searchBox = `<form id="search-form" hx-ws="send" hx-swap-oob="true" autocomplete="off">` +
+	`<input name="search" id="search-input" type="search" placeholder="Search messages" maxlength="100" /></form>`
+
+// searchData is the data for the search.html template.
+type searchData struct {
+	Term    string
+	Results []chatMsgData
+	// Before is the cursor for the next page, or empty if there isn't one.
+	Before string
+}
+
+// parseSearch splits the arguments of /search into the term and the cursor,
+// which is empty for the first page.
+func parseSearch(args string) (term, before string) {
+	args = strings.TrimSpace(args)
+	if strings.HasPrefix(args, "before:") {
+		cursor, rest, _ := strings.Cut(args[len("before:"):], " ")
+		if cursor = ids.Normalize(cursor); ids.Valid(cursor) {
+			return strings.TrimSpace(rest), cursor
+		}
+	}
+	return args, ""
+}
+
+// handleSearchCmd handles "/search [before:<id>] <term>", sending the
+// results to the author once they're found.
+// It does not lock the clientsMu, callers should do that.
+func (cr *chatRoom) handleSearchCmd(m msg) {
+	if historyLen == 0 {
+		m.author.sendError("Message history isn't kept on this server, so there's nothing to search")
+		return
+	}
+	term, before := parseSearch(m.text[len("/search"):])
+	if term == "" {
+		m.author.sendError("Usage: /search <words>")
+		return
+	}
+	if uniseg.GraphemeClusterCount(term) > maxSearchLen {
+		m.author.sendError("That search is too long")
+		return
+	}
+	if m.author.searchLimiter == nil {
+		m.author.searchLimiter = rate.NewLimiter(searchRate, searchBurst)
+	}
+	if !m.author.searchLimiter.Allow() {
+		m.author.sendError("You're searching too fast, wait a moment and try again")
+		return
+	}
+	go cr.search(m.author, term, before)
+}
+
+// search sends the client a page of the results for the term, before the
+// cursor if it isn't empty.
+func (cr *chatRoom) search(c *client, term, before string) {
+	cr.server.historyWriter.wait(cr.key)
+	// One more than a page, to tell if there are older results
+	found, err := cr.server.store.searchHistory(cr.key, term, before, searchPageSize+1)
+	if err != nil {
+		log.Printf("chatRoom.search: %v", err)
+		c.sendError("Searching failed, try again later")
+		return
+	}
+	var next string
+	if len(found) > searchPageSize {
+		found = found[:searchPageSize]
+		next = found[len(found)-1].ID
+	}
+
+	if c.isJSON() {
+		e := events.Search{Term: term, Messages: make([]events.Message, len(found)), Before: next}
+		for i, hm := range found {
+			e.Messages[i] = historyEvent(hm)
+		}
+		c.sendEvent(events.TypeSearch, e)
+		return
+	}
+	data := searchData{Term: term, Results: make([]chatMsgData, len(found)), Before: next}
+	for i, hm := range found {
+		data.Results[i] = chatMsgData{
+			ID:     hm.ID,
+			Time:   hm.Time.UTC().Format(time.RFC3339),
+			Nick:   nickHTML(hm.Nick),
+			Text:   template.HTML(renderMsgText(hm.Text, nil)),
+			Edited: hm.Edited,
+			Bot:    hm.Bot,
+		}
+	}
+	c.sendFrame(renderTemplate("search.html", data))
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseSearch(t *testing.T) {
+	for _, c := range []struct{ args, term, before string }{
+		{" pizza ", "pizza", ""},
+		{" before:01ARZ3NDEKTSV4RRFFQ69G5FAV pizza place", "pizza place", "01ARZ3NDEKTSV4RRFFQ69G5FAV"},
+		{" before:01arz3ndektsv4rrffq69g5fav pizza", "pizza", "01ARZ3NDEKTSV4RRFFQ69G5FAV"},
+		{" before:nope pizza", "before:nope pizza", ""},
+		{" before:01ARZ3NDEKTSV4RRFFQ69G5FAV", "", "01ARZ3NDEKTSV4RRFFQ69G5FAV"},
+	} {
+		term, before := parseSearch(c.args)
+		if term != c.term || before != c.before {
+			t.Errorf("parseSearch(%q) = %q, %q, want %q, %q", c.args, term, before, c.term, c.before)
+		}
+	}
+}
+
+func TestSearchTemplate(t *testing.T) {
+	var err error
+	loadTemplatesOnce.Do(func() { err = loadTemplates(t.TempDir()) })
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := renderTemplate("search.html", searchData{Term: `"><b>`, Before: "01A"})
+	if strings.Contains(s, "<b>") {
+		t.Errorf("results %s don't escape the term", s)
+	}
+	if !strings.Contains(s, "No messages found") || !strings.Contains(s, `value="before:01A &#34;&gt;&lt;b&gt;"`) {
+		t.Errorf("results %s should say nothing was found, with a button for older ones", s)
+	}
+}
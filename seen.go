@@ -0,0 +1,88 @@
+package main
+
+// This file has read receipts, which are off unless the -read-receipts flag
+// is set. Under the latest chat message, the web UI shows how many people in
+// the room have seen it, not counting the author or bots. People have seen a
+// message once they acknowledge it, see unread.go. With several instances,
+// only people connected to the same instance as the reader are counted.
+
+import (
+	"fmt"
+
+	"github.com/makeworld-the-better-one/neartalk/events"
+)
+
+// seenBy is the latest chat message in a room and how many people have seen
+// it.
+type seenBy struct {
+	// id is the ID of the latest chat message, or empty if there isn't one.
+	id string
+	// author is the client that sent it, or nil if they're on another
+	// instance.
+	author *client
+	// count is the last count sent to clients.
+	count int
+}
+
+// createSeenByMsg creates HTML that shows how many people have seen the latest
+// message. Nothing is shown if nobody has.
+func createSeenByMsg(n int) string {
+	if n == 0 {
+		return `<p id="seen-by" hx-swap-oob="true"></p>`
+	}
+	return fmt.Sprintf(`<p id="seen-by" hx-swap-oob="true">Seen by %d</p>`, n)
+}
+
+// setSeenMsg records that the chat message with the ID was just sent to the
+// room, and tells everyone how many people have seen it.
+// It does not lock the clientsMu, callers should do that.
+func (cr *chatRoom) setSeenMsg(id string, author *client) {
+	if !readReceipts {
+		return
+	}
+	cr.seen = seenBy{id: id, author: author, count: -1}
+	cr.sendSeenBy()
+}
+
+// updateSeenBy tells everyone in the room how many people have seen the latest
+// message, if it has changed. It's called when a client acknowledges messages.
+// It holds the client mutex.
+func (cr *chatRoom) updateSeenBy() {
+	if !readReceipts {
+		return
+	}
+	cr.clientsMu.Lock()
+	defer cr.clientsMu.Unlock()
+	cr.sendSeenBy()
+}
+
+// sendSeenBy counts who has seen the latest message, and sends the count to
+// everyone if it has changed.
+// It does not lock the clientsMu, callers should do that.
+func (cr *chatRoom) sendSeenBy() {
+	if cr.seen.id == "" {
+		return
+	}
+	n := 0
+	for c := range cr.clients {
+		if c != cr.seen.author && c.bot == nil && c.lastAckID() >= cr.seen.id {
+			n++
+		}
+	}
+	if n == cr.seen.count {
+		return
+	}
+	cr.seen.count = n
+
+	b := broadcast{
+		html:  createSeenByMsg(n),
+		json:  []string{encodeEvent(events.TypeSeen, events.Seen{ID: cr.seen.id, Count: n})},
+		minor: true,
+	}
+	for c := range cr.clients {
+		if c.isIgnoring(cr.seen.author) {
+			continue
+		}
+		c.deliver(b, false)
+	}
+}
@@ -0,0 +1,53 @@
+package main
+
+// This file handles browser sessions. A session is identified by a random
+// token stored in a cookie, and lets the server remember things about a
+// browser across page loads and devices that share the cookie.
+
+import (
+	"encoding/hex"
+	"net/http"
+
+	"github.com/makeworld-the-better-one/neartalk/ids"
+)
+
+const sessionCookieName = "neartalk_session"
+
+// newSessionToken returns a new random session token.
+func newSessionToken() string {
+	return ids.Token()
+}
+
+// validSessionToken returns true if token is a session token. Tokens used to
+// be 32 hex characters, those are still accepted so old sessions keep their
+// settings.
+func validSessionToken(token string) bool {
+	if ids.Valid(token) {
+		return true
+	}
+	if len(token) == 32 {
+		_, err := hex.DecodeString(token)
+		return err == nil
+	}
+	return false
+}
+
+// getSession returns the session token from the request cookie. If there
+// isn't a valid one, a new token is generated and set as a cookie on the
+// response, so this must be called before any headers are written.
+func getSession(w http.ResponseWriter, r *http.Request) string {
+	cookie, err := r.Cookie(sessionCookieName)
+	if err == nil && validSessionToken(cookie.Value) {
+		return cookie.Value
+	}
+	token := newSessionToken()
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookieName,
+		Value:    token,
+		Path:     "/",
+		MaxAge:   60 * 60 * 24 * 365,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+	return token
+}
@@ -0,0 +1,170 @@
+package main
+
+// This file stores per-session settings, like the theme and nickname a user
+// picked. Settings are kept in memory, and can optionally be saved to a JSON
+// file so they survive restarts. Sessions that haven't been seen in a while
+// are forgotten.
+
+import (
+	"encoding/json"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// settingsTTL is how long settings are kept after a session was last seen.
+const settingsTTL = 30 * 24 * time.Hour
+
+// settingsSaveInterval is how often settings are saved to disk, if changed.
+const settingsSaveInterval = time.Minute
+
+// sessionSettings are the preferences for one session. The zero value of a
+// field means the default.
+type sessionSettings struct {
+	// Nick is the last nickname set with /nick. It is stored sanitized.
+	Nick string `json:"nick,omitempty"`
+	// Theme is the theme set with /theme.
+	Theme string `json:"theme,omitempty"`
+	// LookSeed is where the session's color and avatar come from, for
+	// sessions given a random one before looks came from the token, see
+	// avatar.go.
+	LookSeed string `json:"look_seed,omitempty"`
+	// Lang is the language set with /language, see i18n.go.
+	Lang string `json:"lang,omitempty"`
+	// Notify is which messages trigger notifications, see notifyprefs.go.
+	Notify string `json:"notify,omitempty"`
+	// Sound is true if notifications should play a sound.
+	Sound bool `json:"sound,omitempty"`
+	// Push holds the Web Push subscriptions of the session's browsers, see
+	// webpush.go.
+	Push []pushSubscription `json:"push,omitempty"`
+	// LastSeen is when the session last connected or changed a setting.
+	LastSeen time.Time `json:"last_seen"`
+}
+
+// settingsStore holds the settings for all sessions.
+type settingsStore struct {
+	mu       sync.Mutex
+	sessions map[string]*sessionSettings
+	// path is the file settings are saved to, or empty to keep them in
+	// memory only.
+	path string
+	// dirty is true if settings have changed since they were last saved.
+	dirty bool
+}
+
+// newSettingsStore creates a settings store. If path is not empty, settings
+// are loaded from that file if it exists, and saved to it periodically.
+func newSettingsStore(path string) (*settingsStore, error) {
+	s := &settingsStore{
+		sessions: make(map[string]*sessionSettings),
+		path:     path,
+	}
+	if path == "" {
+		return s, nil
+	}
+
+	b, err := os.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if err == nil {
+		if err := json.Unmarshal(b, &s.sessions); err != nil {
+			return nil, err
+		}
+	}
+	s.expire()
+
+	go func() {
+		for range time.Tick(settingsSaveInterval) {
+			if err := s.save(); err != nil {
+				log.Printf("settingsStore: %v", err)
+			}
+		}
+	}()
+	return s, nil
+}
+
+// get returns a copy of the settings for the session. It also records that
+// the session was seen.
+func (s *settingsStore) get(session string) sessionSettings {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	ss, ok := s.sessions[session]
+	if !ok {
+		return sessionSettings{}
+	}
+	ss.LastSeen = time.Now()
+	return *ss
+}
+
+// update changes the settings for the session using the provided func.
+func (s *settingsStore) update(session string, f func(*sessionSettings)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	ss, ok := s.sessions[session]
+	if !ok {
+		ss = &sessionSettings{}
+		s.sessions[session] = ss
+	}
+	f(ss)
+	ss.LastSeen = time.Now()
+	s.dirty = true
+}
+
+// expire forgets sessions that haven't been seen in settingsTTL.
+func (s *settingsStore) expire() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for session, ss := range s.sessions {
+		if time.Since(ss.LastSeen) > settingsTTL {
+			delete(s.sessions, session)
+			s.dirty = true
+		}
+	}
+}
+
+// save writes the settings to disk if they've changed. It does nothing if
+// the store has no path.
+func (s *settingsStore) save() error {
+	if s.path == "" {
+		return nil
+	}
+	s.expire()
+
+	s.mu.Lock()
+	if !s.dirty {
+		s.mu.Unlock()
+		return nil
+	}
+	b, err := json.Marshal(s.sessions)
+	s.dirty = false
+	s.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(s.path, b)
+}
+
+// writeFileAtomic writes b to the file at path through a temp file that's
+// renamed over it, so the file is never half written.
+func writeFileAtomic(path string, b []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".neartalk-"+filepath.Base(path)+"-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(b); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
@@ -0,0 +1,164 @@
+package main
+
+// This file handles slow mode, where everyone in a room has to wait between
+// messages. Moderators turn it on with "/slowmode 10s", or the admin can from
+// the admin page, and "/slowmode off" turns it off. It's finer-grained than
+// the room's rate limiter, which is shared by everyone in the room: in slow
+// mode one person sending lots of messages can't crowd out everyone else.
+// Moderators aren't slowed down. Like passwords, slow mode isn't shared
+// between instances using Redis, and it's forgotten once everyone has left
+// unless room settings are saved, see roomsettings.go.
+
+import (
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// maxSlowMode is the longest wait slow mode can be set to.
+const maxSlowMode = time.Hour
+
+// parseSlowMode parses the wait for slow mode, like "10s" or "2m", or a
+// number of seconds. "off" and "0" turn it off.
+func parseSlowMode(s string) (time.Duration, error) {
+	if s == "off" {
+		return 0, nil
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		n, err := strconv.Atoi(s)
+		if err != nil {
+			return 0, fmt.Errorf("invalid slow mode %q, use a duration like 10s or 2m", s)
+		}
+		d = time.Duration(n) * time.Second
+	}
+	if d < 0 || d > maxSlowMode {
+		return 0, fmt.Errorf("slow mode can be at most %v", maxSlowMode)
+	}
+	return d.Round(time.Second), nil
+}
+
+// setSlowMode sets the wait between messages, and returns the broadcast that
+// tells the room. by is who set it.
+// It does not lock the clientsMu, callers should do that.
+func (cr *chatRoom) setSlowMode(d time.Duration, by string, when time.Time) broadcast {
+	cr.slowMode = d
+	cr.lastSent = make(map[string]time.Time)
+	cr.saveSettings()
+	if d == 0 {
+		return roomNotice(fmt.Sprintf("%s turned off slow mode", by), when)
+	}
+	return roomNotice(fmt.Sprintf("%s turned on slow mode, everyone can send one message every %v", by, d), when)
+}
+
+// slowModeWait returns how much longer the client has to wait before sending
+// a message, or 0 if they can send it now. checkSlowMode records when they
+// send one.
+// It does not lock the clientsMu, callers should do that.
+func (cr *chatRoom) slowModeWait(c *client, when time.Time) time.Duration {
+	if cr.slowMode == 0 || c.moderator {
+		return 0
+	}
+	wait := cr.lastSent[c.session].Add(cr.slowMode).Sub(when)
+	if wait <= 0 {
+		return 0
+	}
+	// Round up, so it never says 0s
+	return (wait + time.Second - 1).Truncate(time.Second)
+}
+
+// checkSlowMode returns true if the client can send a message now, and
+// records that it did. If not, it tells the client how long to wait.
+// It does not lock the clientsMu, callers should do that.
+func (cr *chatRoom) checkSlowMode(c *client, when time.Time) bool {
+	if wait := cr.slowModeWait(c, when); wait > 0 {
+		c.sendError(c.tr("Slow mode is on, you can send another message in %v", wait))
+		return false
+	}
+	if cr.slowMode != 0 {
+		cr.lastSent[c.session] = when
+	}
+	return true
+}
+
+// handleSlowModeCmd handles "/slowmode <duration>", "/slowmode off", and
+// "/slowmode", which shows the current setting.
+// It does not lock the clientsMu, callers should do that.
+func (cr *chatRoom) handleSlowModeCmd(m msg) broadcast {
+	arg := strings.TrimSpace(m.text[len("/slowmode"):])
+	if arg == "" {
+		if cr.slowMode == 0 {
+			m.author.sendNotice("Slow mode is off")
+		} else {
+			m.author.sendNotice(m.author.tr("Slow mode is on, everyone can send one message every %v", cr.slowMode))
+		}
+		return broadcast{}
+	}
+	if !m.author.moderator {
+		m.author.sendError("Only moderators can use /slowmode")
+		return broadcast{}
+	}
+	d, err := parseSlowMode(arg)
+	if err != nil {
+		m.author.sendError("Usage: /slowmode <duration>, like /slowmode 10s, or /slowmode off")
+		return broadcast{}
+	}
+	return cr.setSlowMode(d, isolateNick(m.author.nick), m.when)
+}
+
+// adminSlowModeHandler sets slow mode for a room from the admin page, with
+// the room key in the "room" form value and the wait in "wait".
+func (cs *chatServer) adminSlowModeHandler(w http.ResponseWriter, r *http.Request) {
+	keyID, ok := cs.adminSession(r)
+	if !ok || r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	key := r.FormValue("room")
+	if key == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	d, err := parseSlowMode(strings.TrimSpace(r.FormValue("wait")))
+	if err != nil {
+		fmt.Fprintf(w, `<p class="error">%s</p>%s`, template.HTMLEscapeString(err.Error()), adminSlowModeForm(key, 0))
+		return
+	}
+
+	cs.roomsMu.Lock()
+	room, ok := cs.rooms[key]
+	cs.roomsMu.Unlock()
+	if !ok {
+		fmt.Fprintf(w, `<p class="error">That room is gone.</p>`)
+		return
+	}
+	room.clientsMu.Lock()
+	b := room.setSlowMode(d, "The admin", time.Now())
+	room.clientsMu.Unlock()
+	cs.audit.record(keyID, auditSlowMode, key, d.String())
+	select {
+	case room.incoming <- msg{raw: b.html, rawJSON: b.json, when: time.Now()}:
+	default:
+		// Room is busy, they'll find out when they send a message
+	}
+	fmt.Fprint(w, adminSlowModeForm(key, d))
+}
+
+// adminSlowModeForm returns the admin page form for setting slow mode in the
+// room, which is currently d.
+func adminSlowModeForm(key string, d time.Duration) string {
+	vals, _ := json.Marshal(map[string]string{"room": key})
+	value := ""
+	if d != 0 {
+		value = d.String()
+	}
+	return fmt.Sprintf(
+		`<form hx-post="/admin-slowmode" hx-vals="%s" hx-swap="outerHTML">`+
+			`<input name="wait" value="%s" placeholder="Wait between messages, like 10s" /> <button>Set slow mode</button></form>`,
+		template.HTMLEscapeString(string(vals)), value,
+	)
+}
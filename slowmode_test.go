@@ -0,0 +1,51 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseSlowMode(t *testing.T) {
+	tests := []struct {
+		s    string
+		want time.Duration
+		ok   bool
+	}{
+		{"10s", 10 * time.Second, true},
+		{"2m", 2 * time.Minute, true},
+		{"30", 30 * time.Second, true},
+		{"1500ms", 2 * time.Second, true},
+		{"off", 0, true},
+		{"0", 0, true},
+		{"-5s", 0, false},
+		{"2h", 0, false},
+		{"soon", 0, false},
+	}
+	for _, tt := range tests {
+		got, err := parseSlowMode(tt.s)
+		if (err == nil) != tt.ok || got != tt.want {
+			t.Errorf("parseSlowMode(%q) = %v, %v", tt.s, got, err)
+		}
+	}
+}
+
+func TestSlowModeWait(t *testing.T) {
+	cr := &chatRoom{slowMode: 10 * time.Second, lastSent: make(map[string]time.Time)}
+	c := &client{session: "a"}
+	now := time.Now()
+
+	if wait := cr.slowModeWait(c, now); wait != 0 {
+		t.Errorf("first message has to wait %v", wait)
+	}
+	cr.lastSent[c.session] = now
+	if wait := cr.slowModeWait(c, now.Add(2500*time.Millisecond)); wait != 8*time.Second {
+		t.Errorf("wait after 2.5s = %v, want 8s", wait)
+	}
+	if wait := cr.slowModeWait(c, now.Add(10*time.Second)); wait != 0 {
+		t.Errorf("wait after 10s = %v, want 0", wait)
+	}
+	c.moderator = true
+	if wait := cr.slowModeWait(c, now); wait != 0 {
+		t.Errorf("moderator has to wait %v", wait)
+	}
+}
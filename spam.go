@@ -0,0 +1,299 @@
+package main
+
+// This file detects spam, if the config file has a "spam_filter" object.
+// Someone whose messages look like spam is muted in the room for a while, and
+// the room is told. The admin page lists everyone who's muted, with a button
+// to unmute them early. Three things count as spam:
+//
+//   - sending the same or nearly the same message several times in a row
+//   - sending lots of messages within a few seconds
+//   - a message with lots of links, or that's mostly links
+//
+// Moderators and bots are never muted for spam. Encrypted messages can only
+// be checked for bursts, since the server can't read them.
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// Defaults for the fields left out of the spam_filter config.
+const (
+	defaultSpamMute        = 5 * time.Minute
+	defaultSpamRepeats     = 4
+	defaultSpamSimilarity  = 0.9
+	defaultSpamBurst       = 8
+	defaultSpamWindow      = 10 * time.Second
+	defaultSpamMaxLinks    = 4
+	defaultSpamLinkDensity = 0.5
+)
+
+// configSpamFilter is the "spam_filter" object in the config file.
+type configSpamFilter struct {
+	// Mute is how long spammers are muted for, like "10m".
+	Mute string `json:"mute"`
+	// Repeats is how many nearly identical messages in a row are spam, and
+	// Similarity is how alike they have to be, from 0 to 1.
+	Repeats    int     `json:"repeats"`
+	Similarity float64 `json:"similarity"`
+	// Burst is how many messages within Window are spam.
+	Burst  int    `json:"burst"`
+	Window string `json:"window"`
+	// MaxLinks is the most links a message can have. Messages with at least
+	// two links are also spam if more than LinkDensity of their words are
+	// links.
+	MaxLinks    int     `json:"max_links"`
+	LinkDensity float64 `json:"link_density"`
+}
+
+// spamFilter holds the parsed spam_filter config.
+type spamFilter struct {
+	mute        time.Duration
+	repeats     int
+	similarity  float64
+	burst       int
+	window      time.Duration
+	maxLinks    int
+	linkDensity float64
+}
+
+// parseSpamFilter parses the spam_filter config, filling in the defaults.
+func parseSpamFilter(cf configSpamFilter) (*spamFilter, error) {
+	sf := &spamFilter{
+		mute:        defaultSpamMute,
+		repeats:     defaultSpamRepeats,
+		similarity:  defaultSpamSimilarity,
+		burst:       defaultSpamBurst,
+		window:      defaultSpamWindow,
+		maxLinks:    defaultSpamMaxLinks,
+		linkDensity: defaultSpamLinkDensity,
+	}
+	var err error
+	if cf.Mute != "" {
+		if sf.mute, err = time.ParseDuration(cf.Mute); err != nil || sf.mute < time.Minute {
+			return nil, errors.New("spam_filter mute must be a duration of at least a minute, like 10m")
+		}
+	}
+	if cf.Window != "" {
+		if sf.window, err = time.ParseDuration(cf.Window); err != nil || sf.window <= 0 {
+			return nil, errors.New("spam_filter window must be a positive duration, like 10s")
+		}
+	}
+	if cf.Repeats < 0 || cf.Burst < 0 || cf.MaxLinks < 0 {
+		return nil, errors.New("spam_filter repeats, burst, and max_links can't be negative")
+	}
+	if cf.Similarity < 0 || cf.Similarity > 1 || cf.LinkDensity < 0 || cf.LinkDensity > 1 {
+		return nil, errors.New("spam_filter similarity and link_density must be from 0 to 1")
+	}
+	if cf.Repeats != 0 {
+		sf.repeats = cf.Repeats
+	}
+	if cf.Similarity != 0 {
+		sf.similarity = cf.Similarity
+	}
+	if cf.Burst != 0 {
+		sf.burst = cf.Burst
+	}
+	if cf.MaxLinks != 0 {
+		sf.maxLinks = cf.MaxLinks
+	}
+	if cf.LinkDensity != 0 {
+		sf.linkDensity = cf.LinkDensity
+	}
+	return sf, nil
+}
+
+// spamState is what's remembered about the recent messages of a session in a
+// room, to spot spam.
+type spamState struct {
+	// last is the last message, normalized by normalizeSpam.
+	last string
+	// repeats is how many messages in a row have been like last.
+	repeats int
+	// times holds when the messages in the last window were sent.
+	times []time.Time
+}
+
+// normalizeSpam returns the text in lower case with only its letters and
+// numbers, so small changes don't hide a repeated message.
+func normalizeSpam(text string) string {
+	return strings.Map(func(r rune) rune {
+		if unicode.IsLetter(r) || unicode.IsNumber(r) {
+			return unicode.ToLower(r)
+		}
+		return -1
+	}, text)
+}
+
+// similarity returns how alike a and b are, from 0 to 1, as the Dice
+// coefficient of their character pairs.
+func similarity(a, b string) float64 {
+	ra, rb := []rune(a), []rune(b)
+	if len(ra) < 2 || len(rb) < 2 {
+		if a == b {
+			return 1
+		}
+		return 0
+	}
+	pairs := make(map[[2]rune]int, len(ra)-1)
+	for i := 0; i < len(ra)-1; i++ {
+		pairs[[2]rune{ra[i], ra[i+1]}]++
+	}
+	shared := 0
+	for i := 0; i < len(rb)-1; i++ {
+		p := [2]rune{rb[i], rb[i+1]}
+		if pairs[p] > 0 {
+			pairs[p]--
+			shared++
+		}
+	}
+	return 2 * float64(shared) / float64(len(ra)+len(rb)-2)
+}
+
+// check records the message and returns why it's spam, or "" if it isn't.
+// text is empty for encrypted messages.
+func (sf *spamFilter) check(st *spamState, text string, when time.Time) string {
+	cutoff := when.Add(-sf.window)
+	i := 0
+	for i < len(st.times) && !st.times[i].After(cutoff) {
+		i++
+	}
+	st.times = append(st.times[i:], when)
+	if len(st.times) > sf.burst {
+		return "sending too many messages"
+	}
+	if text == "" {
+		return ""
+	}
+
+	norm := normalizeSpam(text)
+	if st.repeats > 0 && similarity(norm, st.last) >= sf.similarity {
+		st.repeats++
+	} else {
+		st.repeats = 1
+	}
+	st.last = norm
+	if st.repeats >= sf.repeats {
+		return "repeating the same message"
+	}
+
+	links := len(urlRe.FindAllStringIndex(text, -1))
+	if links > sf.maxLinks ||
+		links >= 2 && float64(links)/float64(len(strings.Fields(text))) > sf.linkDensity {
+		return "posting too many links"
+	}
+	return ""
+}
+
+// checkSpam returns true if the message looks like spam, and if so mutes its
+// author and returns the broadcast that tells the room. text is empty for
+// encrypted messages.
+// It does not lock the clientsMu, callers should do that.
+func (cr *chatRoom) checkSpam(c *client, text string, when time.Time) (broadcast, bool) {
+	sf := currentConfig().spam
+	if sf == nil || c.moderator || c.bot != nil {
+		return broadcast{}, false
+	}
+	st, ok := cr.spam[c.session]
+	if !ok {
+		st = &spamState{}
+		cr.spam[c.session] = st
+	}
+	reason := sf.check(st, text, when)
+	if reason == "" {
+		return broadcast{}, false
+	}
+
+	delete(cr.spam, c.session)
+	cr.muted[c.session] = when.Add(sf.mute)
+	cr.spamMuted[c.session] = true
+	log.Printf("chatRoom.checkSpam: muted %s in room %s for %s", plainNick(c.nick), cr.key, reason)
+	cr.server.admins.poke()
+	return roomNotice(fmt.Sprintf("%s was muted for %d minutes for %s",
+		isolateNick(c.nick), int(sf.mute.Minutes()), reason), when), true
+}
+
+// unmute unmutes the session, however it was muted.
+// It does not lock the clientsMu, callers should do that.
+func (cr *chatRoom) unmute(session string) {
+	delete(cr.muted, session)
+	delete(cr.spamMuted, session)
+}
+
+// adminMutedHTML returns the list of muted people in the room for the admin
+// page, each with a button to unmute them.
+// It does not lock the clientsMu, callers should do that.
+func (cr *chatRoom) adminMutedHTML() string {
+	var b strings.Builder
+	done := make(map[string]bool)
+	for c := range cr.clients {
+		if done[c.session] || !cr.isMuted(c.session) {
+			continue
+		}
+		done[c.session] = true
+		why := "by a moderator"
+		if cr.spamMuted[c.session] {
+			why = "for spam"
+		}
+		vals, _ := json.Marshal(map[string]string{"room": cr.key, "nick": c.nick})
+		fmt.Fprintf(&b, `<li>%s, muted %s until %s <button hx-post="/admin-unmute" hx-vals="%s" hx-swap="outerHTML">Unmute</button></li>`,
+			template.HTMLEscapeString(plainNick(c.nick)), why, cr.muted[c.session].Format("15:04"),
+			template.HTMLEscapeString(string(vals)))
+	}
+	if b.Len() == 0 {
+		return ""
+	}
+	return "<p>Muted:</p><ul>" + b.String() + "</ul>"
+}
+
+// adminUnmuteHandler unmutes someone from the admin page, with the room key in
+// the "room" form value and their nickname in "nick".
+func (cs *chatServer) adminUnmuteHandler(w http.ResponseWriter, r *http.Request) {
+	keyID, ok := cs.adminSession(r)
+	if !ok || r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	key := r.FormValue("room")
+	nick := sanitizeNick(r.FormValue("nick"))
+	if key == "" || nick == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	cs.roomsMu.Lock()
+	room, ok := cs.rooms[key]
+	cs.roomsMu.Unlock()
+	if !ok {
+		fmt.Fprint(w, `<span class="error">That room is gone.</span>`)
+		return
+	}
+	room.clientsMu.Lock()
+	c := room.clientByNick(nick)
+	muted := c != nil && room.isMuted(c.session)
+	var b broadcast
+	if muted {
+		room.unmute(c.session)
+		b = roomNotice(fmt.Sprintf("%s was unmuted by the admin", isolateNick(c.nick)), time.Now())
+	}
+	room.clientsMu.Unlock()
+	if !muted {
+		fmt.Fprint(w, `<span class="error">They aren't muted anymore.</span>`)
+		return
+	}
+	cs.audit.record(keyID, auditUnmute, key, plainNick(nick))
+	cs.admins.poke()
+	select {
+	case room.incoming <- msg{raw: b.html, rawJSON: b.json, when: time.Now()}:
+	default:
+		// Room is busy, they'll find out when they send a message
+	}
+	fmt.Fprint(w, `<span>Unmuted.</span>`)
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSimilarity(t *testing.T) {
+	tests := []struct {
+		a, b string
+		min  float64
+		max  float64
+	}{
+		{"buynow", "buynow", 1, 1},
+		{"buymycoinsnow", "buymycoinsnow1", 0.9, 1},
+		{"hello", "goodbye", 0, 0.2},
+		{"a", "a", 1, 1},
+		{"a", "b", 0, 0},
+	}
+	for _, tt := range tests {
+		if got := similarity(tt.a, tt.b); got < tt.min || got > tt.max {
+			t.Errorf("similarity(%q, %q) = %v, want %v to %v", tt.a, tt.b, got, tt.min, tt.max)
+		}
+	}
+}
+
+func TestSpamFilterCheck(t *testing.T) {
+	sf, err := parseSpamFilter(configSpamFilter{Repeats: 3, Burst: 5, Window: "10s", MaxLinks: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+
+	var st spamState
+	for i, text := range []string{"Buy my coins!", "buy my coins!!", "BUY MY COINS"} {
+		reason := sf.check(&st, text, now.Add(time.Duration(i)*time.Minute))
+		if (reason != "") != (i == 2) {
+			t.Errorf("message %d: reason %q", i+1, reason)
+		}
+	}
+
+	st = spamState{}
+	for i := 0; i < 6; i++ {
+		reason := sf.check(&st, "", now.Add(time.Duration(i)*time.Second))
+		if (reason != "") != (i == 5) {
+			t.Errorf("burst message %d: reason %q", i+1, reason)
+		}
+	}
+	// Messages outside the window don't count
+	if reason := sf.check(&st, "", now.Add(time.Minute)); reason != "" {
+		t.Errorf("message after the window: reason %q", reason)
+	}
+
+	for text, spam := range map[string]bool{
+		"look at https://example.com it's great":                                false,
+		"https://example.com https://example.org":                               true,
+		"see https://a.example and https://b.example and more":                  false,
+		"a https://a.example b https://b.example c https://c.example d e f g h": true,
+	} {
+		st = spamState{}
+		if reason := sf.check(&st, text, now); (reason != "") != spam {
+			t.Errorf("check(%q) = %q", text, reason)
+		}
+	}
+}
+
+func TestParseSpamFilter(t *testing.T) {
+	sf, err := parseSpamFilter(configSpamFilter{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sf.mute != defaultSpamMute || sf.burst != defaultSpamBurst {
+		t.Errorf("defaults not used: %+v", sf)
+	}
+	for _, cf := range []configSpamFilter{
+		{Mute: "10s"},
+		{Window: "soon"},
+		{Similarity: 1.5},
+		{Burst: -1},
+	} {
+		if _, err := parseSpamFilter(cf); err == nil {
+			t.Errorf("parseSpamFilter(%+v) succeeded", cf)
+		}
+	}
+}
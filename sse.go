@@ -0,0 +1,179 @@
+package main
+
+// This file has the Server-Sent Events transport, for networks that block
+// websockets. The client gets messages from GET /sse as a stream of events,
+// and sends messages with POST /sse/send. Otherwise it works like a websocket
+// connection: the client joins a room, the same frames are sent, and the same
+// messages are accepted, in either protocol.
+//
+// The first event on the stream is a "connection" event holding the
+// connection ID, which must be passed to /sse/send as the "id" query
+// parameter. Every frame after that is a regular event, with a "close" event
+// sent if the server closes the stream.
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/makeworld-the-better-one/neartalk/ids"
+	"nhooyr.io/websocket"
+)
+
+// sseKeepAlive is how often a comment is sent on idle streams, so proxies
+// don't close them.
+const sseKeepAlive = 20 * time.Second
+
+// sseTransport is an SSE stream.
+type sseTransport struct {
+	w        io.Writer
+	rc       *http.ResponseController
+	incoming chan htmxJson
+
+	// writeMu stops events from being written at the same time.
+	writeMu sync.Mutex
+
+	// ctx is cancelled when the stream is closed.
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+func newSSETransport(ctx context.Context, w http.ResponseWriter) *sseTransport {
+	ctx, cancel := context.WithCancel(ctx)
+	return &sseTransport{
+		w:        w,
+		rc:       http.NewResponseController(w),
+		incoming: make(chan htmxJson, serverMsgBuffer),
+		ctx:      ctx,
+		cancel:   cancel,
+	}
+}
+
+// write writes an event and flushes it. event can be empty for a regular
+// message event. It does not lock writeMu, callers should do that.
+func (t *sseTransport) write(event, data string) error {
+	t.rc.SetWriteDeadline(time.Now().Add(writeTimeoutDuration))
+	var b strings.Builder
+	if event != "" {
+		fmt.Fprintf(&b, "event: %s\n", event)
+	}
+	for _, line := range strings.Split(data, "\n") {
+		fmt.Fprintf(&b, "data: %s\n", line)
+	}
+	b.WriteString("\n")
+	if _, err := io.WriteString(t.w, b.String()); err != nil {
+		return err
+	}
+	return t.rc.Flush()
+}
+
+// keepAlive writes a comment every sseKeepAlive, which clients ignore, until
+// the stream is closed.
+func (t *sseTransport) keepAlive() {
+	ticker := time.NewTicker(sseKeepAlive)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := t.ping(t.ctx); err != nil {
+				t.cancel()
+				return
+			}
+		case <-t.ctx.Done():
+			return
+		}
+	}
+}
+
+func (t *sseTransport) send(ctx context.Context, text string) error {
+	t.writeMu.Lock()
+	defer t.writeMu.Unlock()
+	return t.write("", text)
+}
+
+func (t *sseTransport) received() <-chan htmxJson {
+	return t.incoming
+}
+
+func (t *sseTransport) done() <-chan struct{} {
+	return t.ctx.Done()
+}
+
+// ping writes a comment, which clients ignore. It fails if the client can't
+// be written to.
+func (t *sseTransport) ping(ctx context.Context) error {
+	t.writeMu.Lock()
+	defer t.writeMu.Unlock()
+	t.rc.SetWriteDeadline(time.Now().Add(writeTimeoutDuration))
+	if _, err := io.WriteString(t.w, ": ping\n\n"); err != nil {
+		return err
+	}
+	return t.rc.Flush()
+}
+
+func (t *sseTransport) close(code websocket.StatusCode, reason string) {
+	t.writeMu.Lock()
+	defer t.writeMu.Unlock()
+	if t.ctx.Err() == nil {
+		t.write("close", reason)
+		t.cancel()
+	}
+}
+
+// sseHandler streams a client's messages as Server-Sent Events.
+func (cs *chatServer) sseHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	proto := protoHTML
+	if r.URL.Query().Get("proto") == protoJSON {
+		proto = protoJSON
+	}
+	if !cs.paceAccept(w, r) {
+		return
+	}
+	session := getSession(w, r)
+	release, ok := cs.requireChallenge(w, r, session)
+	if !ok {
+		return
+	}
+	defer release()
+	lang := matchLang(r.Header.Get("Accept-Language"))
+	key, ok := cs.connectRoomKey(w, r, session)
+	if !ok {
+		return
+	}
+
+	t := newSSETransport(r.Context(), w)
+	defer t.cancel()
+	// The stream lasts much longer than the server timeouts allow
+	if err := t.rc.SetReadDeadline(time.Time{}); err != nil && !errors.Is(err, http.ErrNotSupported) {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	// Tell nginx not to buffer the stream
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+
+	id := ids.Token()
+	cs.addHTTPConn(id, &httpConn{session: session, incoming: t.incoming})
+	defer cs.removeHTTPConn(id)
+	if err := t.write("connection", id); err != nil {
+		return
+	}
+	go t.keepAlive()
+
+	err := cs.connect(t.ctx, key, connAddr(r), session, proto, lang, nil, t)
+	if err != nil && !errors.Is(err, context.Canceled) && !errors.Is(err, errHeartbeatTimeout) {
+		log.Printf("chatServer.sseHandler: %v", err)
+	}
+}
@@ -0,0 +1,81 @@
+package main
+
+// This file has the public stats endpoint, /stats, for things like a counter
+// on a landing page. It's off unless -public-stats is set, and only gives
+// totals for the whole server, nothing about any room or person.
+
+import (
+	"net/http"
+	"sync"
+	"time"
+)
+
+// serverStarted is when the server started, for the uptime.
+var serverStarted = time.Now()
+
+// dailyCounter counts events in the current day, in the server's timezone.
+type dailyCounter struct {
+	mu    sync.Mutex
+	day   time.Time
+	count int
+}
+
+// dayOf returns the start of the day t is in.
+func dayOf(t time.Time) time.Time {
+	y, m, d := t.Date()
+	return time.Date(y, m, d, 0, 0, 0, 0, t.Location())
+}
+
+// add counts an event at t.
+func (dc *dailyCounter) add(t time.Time) {
+	dc.mu.Lock()
+	defer dc.mu.Unlock()
+	if day := dayOf(t); !day.Equal(dc.day) {
+		dc.day = day
+		dc.count = 0
+	}
+	dc.count++
+}
+
+// today returns the number of events so far today.
+func (dc *dailyCounter) today() int {
+	dc.mu.Lock()
+	defer dc.mu.Unlock()
+	if !dayOf(time.Now()).Equal(dc.day) {
+		return 0
+	}
+	return dc.count
+}
+
+// publicStats is the response of /stats.
+type publicStats struct {
+	Rooms int `json:"rooms"`
+	Users int `json:"users"`
+	// UptimeSeconds is how long the server has been running.
+	UptimeSeconds int64 `json:"uptime_seconds"`
+	// MessagesToday is how many chat messages were sent since midnight in
+	// the server's timezone.
+	MessagesToday int `json:"messages_today"`
+}
+
+// statsHandler serves the public stats as JSON.
+func (cs *chatServer) statsHandler(w http.ResponseWriter, r *http.Request) {
+	if !publicStatsFlag {
+		http.NotFound(w, r)
+		return
+	}
+	cs.roomsMu.Lock()
+	stats := publicStats{
+		Rooms:         len(cs.rooms),
+		UptimeSeconds: int64(time.Since(serverStarted).Seconds()),
+		MessagesToday: cs.msgsToday.today(),
+	}
+	for _, room := range cs.rooms {
+		stats.Users += room.numClients()
+	}
+	cs.roomsMu.Unlock()
+
+	// So landing pages on other sites can fetch it
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	writeJSON(w, http.StatusOK, stats)
+}
@@ -0,0 +1,332 @@
+package main
+
+// This file has the storage interface, which is where NearTalk keeps what has
+// to survive restarts: saved room settings, see roomsettings.go, the audit
+// log, see auditlog.go, bans, see bans.go, and message history with
+// -history, see history.go. It's chosen with -storage:
+//
+//   - not set, the default, uses the -room-settings-file and -audit-log
+//     files, see storage_file.go. Bans and history are only kept in memory.
+//   - "memory" keeps everything in memory, so room settings survive rooms
+//     closing but not restarts
+//   - "sqlite:<path>" uses an SQLite database file
+//   - "postgres://..." uses a PostgreSQL database, see storage_sql.go
+//
+// Session settings have their own file, see settings.go.
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// storage keeps room settings, the audit log, bans, and message history
+// across restarts.
+type storage interface {
+	// loadRoomSettings returns all the saved room settings, by room key.
+	loadRoomSettings() (map[string]*savedRoom, error)
+	// saveRoomSettings replaces all the saved room settings.
+	saveRoomSettings(rooms map[string]*savedRoom) error
+	// appendAudit adds an entry to the audit log.
+	appendAudit(e auditEntry) error
+	// loadAudit returns up to the n newest audit log entries, oldest first.
+	loadAudit(n int) ([]auditEntry, error)
+	// purgeAudit removes the audit log entries from before the time, for
+	// -retention.
+	purgeAudit(before time.Time) error
+	// loadBans returns all the bans, including expired ones.
+	loadBans() ([]ban, error)
+	// saveBan adds the ban, replacing any with the same target.
+	saveBan(b ban) error
+	// removeBan removes the ban with the target, if there is one.
+	removeBan(target string) error
+	// appendHistory adds a chat message to its room's history.
+	appendHistory(m historyMsg) error
+	// editHistory replaces the text of a message in a room's history, and
+	// marks it edited. Messages that aren't there are ignored.
+	editHistory(room, id, text string) error
+	// deleteHistory removes a message from a room's history.
+	deleteHistory(room, id string) error
+	// loadHistory returns up to the n newest messages in a room's history
+	// sent before the message with the ID, or the newest if before is empty,
+	// oldest first.
+	loadHistory(room, before string, n int) ([]historyMsg, error)
+	// searchHistory returns up to the n newest messages in a room's history
+	// with the term in their text, ignoring case, sent before the message
+	// with the ID, or the newest if before is empty. They're newest first.
+	searchHistory(room, term, before string, n int) ([]historyMsg, error)
+	// eraseHistory removes a room's history.
+	eraseHistory(room string) error
+	// purgeHistory removes the messages sent before the time, for
+	// -retention.
+	purgeHistory(before time.Time) error
+	close() error
+}
+
+// openStorage opens the storage for the -storage DSN. The empty DSN uses
+// the -room-settings-file and -audit-log files.
+func openStorage(dsn string) (storage, error) {
+	switch {
+	case dsn == "":
+		return openFileStorage(roomSettingsFile, auditLogFile)
+	case dsn == "memory":
+		return &memoryStorage{}, nil
+	case strings.HasPrefix(dsn, "sqlite:"):
+		return openSQLStorage(dialectSQLite, strings.TrimPrefix(dsn, "sqlite:"))
+	case strings.HasPrefix(dsn, "postgres://"), strings.HasPrefix(dsn, "postgresql://"):
+		return openSQLStorage(dialectPostgres, dsn)
+	}
+	return nil, fmt.Errorf(`invalid storage %q, must be "memory", "sqlite:<path>", or a postgres:// URL`, dsn)
+}
+
+// keepsRoomSettings returns true if room settings should be saved, because
+// -storage or -room-settings-file is set.
+func keepsRoomSettings() bool {
+	return storageDSN != "" || roomSettingsFile != ""
+}
+
+// maxMemoryHistory is how many messages memoryStorage keeps in each room's
+// history.
+const maxMemoryHistory = 1000
+
+// maxMemoryHistoryRooms is how many rooms memoryStorage keeps history for.
+// Past that, the history of the room that went quiet longest ago is dropped
+// to make space.
+const maxMemoryHistoryRooms = 1000
+
+// memoryStorage keeps everything in memory.
+type memoryStorage struct {
+	mu    sync.Mutex
+	rooms map[string]*savedRoom
+	audit []auditEntry
+	bans  []ban
+	// history holds each room's messages, oldest first, by room key.
+	history map[string][]historyMsg
+}
+
+func (ms *memoryStorage) loadRoomSettings() (map[string]*savedRoom, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	return copySavedRooms(ms.rooms), nil
+}
+
+func (ms *memoryStorage) saveRoomSettings(rooms map[string]*savedRoom) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	ms.rooms = copySavedRooms(rooms)
+	return nil
+}
+
+func (ms *memoryStorage) appendAudit(e auditEntry) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	ms.audit = append(ms.audit, e)
+	if len(ms.audit) > maxAuditEntries {
+		ms.audit = ms.audit[len(ms.audit)-maxAuditEntries:]
+	}
+	return nil
+}
+
+func (ms *memoryStorage) loadAudit(n int) ([]auditEntry, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	es := ms.audit
+	if len(es) > n {
+		es = es[len(es)-n:]
+	}
+	return append([]auditEntry(nil), es...), nil
+}
+
+func (ms *memoryStorage) purgeAudit(before time.Time) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	ms.audit = keepAuditSince(ms.audit, before)
+	return nil
+}
+
+func (ms *memoryStorage) loadBans() ([]ban, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	return append([]ban(nil), ms.bans...), nil
+}
+
+func (ms *memoryStorage) saveBan(b ban) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	for i := range ms.bans {
+		if ms.bans[i].Target == b.Target {
+			ms.bans[i] = b
+			return nil
+		}
+	}
+	ms.bans = append(ms.bans, b)
+	return nil
+}
+
+func (ms *memoryStorage) removeBan(target string) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	for i := range ms.bans {
+		if ms.bans[i].Target == target {
+			ms.bans = append(ms.bans[:i], ms.bans[i+1:]...)
+			break
+		}
+	}
+	return nil
+}
+
+func (ms *memoryStorage) appendHistory(m historyMsg) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	if ms.history == nil {
+		ms.history = make(map[string][]historyMsg)
+	}
+	if _, ok := ms.history[m.Room]; !ok && len(ms.history) >= maxMemoryHistoryRooms {
+		ms.dropQuietestHistory()
+	}
+	h := append(ms.history[m.Room], m)
+	if len(h) > maxMemoryHistory {
+		h = h[len(h)-maxMemoryHistory:]
+	}
+	ms.history[m.Room] = h
+	return nil
+}
+
+// dropQuietestHistory removes the history of the room whose last message is
+// the oldest. It does not lock the mutex, callers should do that.
+func (ms *memoryStorage) dropQuietestHistory() {
+	var quietest string
+	var last time.Time
+	for room, h := range ms.history {
+		if len(h) == 0 {
+			// Everything in it was deleted
+			quietest = room
+			break
+		}
+		if t := h[len(h)-1].Time; quietest == "" || t.Before(last) {
+			quietest, last = room, t
+		}
+	}
+	delete(ms.history, quietest)
+}
+
+// findHistory returns the index of the message in the room's history, or -1.
+// It does not lock the mutex, callers should do that.
+func (ms *memoryStorage) findHistory(room, id string) int {
+	for i, m := range ms.history[room] {
+		if m.ID == id {
+			return i
+		}
+	}
+	return -1
+}
+
+func (ms *memoryStorage) editHistory(room, id, text string) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	if i := ms.findHistory(room, id); i >= 0 {
+		ms.history[room][i].Text = text
+		ms.history[room][i].Edited = true
+	}
+	return nil
+}
+
+func (ms *memoryStorage) deleteHistory(room, id string) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	if i := ms.findHistory(room, id); i >= 0 {
+		h := ms.history[room]
+		ms.history[room] = append(h[:i:i], h[i+1:]...)
+	}
+	return nil
+}
+
+func (ms *memoryStorage) loadHistory(room, before string, n int) ([]historyMsg, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	h := ms.history[room]
+	if before != "" {
+		// IDs sort by time, see the ids package
+		end := 0
+		for end < len(h) && h[end].ID < before {
+			end++
+		}
+		h = h[:end]
+	}
+	if len(h) > n {
+		h = h[len(h)-n:]
+	}
+	return append([]historyMsg(nil), h...), nil
+}
+
+func (ms *memoryStorage) searchHistory(room, term, before string, n int) ([]historyMsg, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	term = strings.ToLower(term)
+	var found []historyMsg
+	h := ms.history[room]
+	for i := len(h) - 1; i >= 0 && len(found) < n; i-- {
+		if before != "" && h[i].ID >= before {
+			continue
+		}
+		if strings.Contains(strings.ToLower(h[i].Text), term) {
+			found = append(found, h[i])
+		}
+	}
+	return found, nil
+}
+
+func (ms *memoryStorage) eraseHistory(room string) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	delete(ms.history, room)
+	return nil
+}
+
+func (ms *memoryStorage) purgeHistory(before time.Time) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	for room, h := range ms.history {
+		kept := h[:0]
+		for _, m := range h {
+			if !m.Time.Before(before) {
+				kept = append(kept, m)
+			}
+		}
+		if len(kept) == 0 {
+			delete(ms.history, room)
+		} else {
+			ms.history[room] = kept
+		}
+	}
+	return nil
+}
+
+func (ms *memoryStorage) close() error {
+	return nil
+}
+
+// copySavedRooms returns a deep enough copy of the room settings that
+// changing one doesn't change the other.
+func copySavedRooms(rooms map[string]*savedRoom) map[string]*savedRoom {
+	c := make(map[string]*savedRoom, len(rooms))
+	for key, sr := range rooms {
+		sr := *sr
+		sr.AllowedSessions = append([]string(nil), sr.AllowedSessions...)
+		c[key] = &sr
+	}
+	return c
+}
+
+// keepAuditSince returns the audit log entries from the time on, in the same
+// order. It reuses the slice.
+func keepAuditSince(es []auditEntry, since time.Time) []auditEntry {
+	kept := es[:0]
+	for _, e := range es {
+		if !e.Time.Before(since) {
+			kept = append(kept, e)
+		}
+	}
+	return kept
+}
@@ -0,0 +1,206 @@
+package main
+
+// This file has the default storage, which saves room settings to the JSON
+// file given with -room-settings-file, and appends the audit log to the file
+// given with -audit-log, one JSON entry per line. Either can be left out, and
+// then it's only kept in memory. The audit log is only ever rewritten to
+// remove old entries for -retention. Bans and message history don't have
+// files, they're kept in memory.
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// fileStorage keeps room settings and the audit log in files, and the rest in
+// memory.
+type fileStorage struct {
+	// roomsPath is the room settings file, or empty to keep them in memory.
+	roomsPath string
+	// mem keeps what doesn't have a file.
+	mem memoryStorage
+
+	mu sync.Mutex
+	// audit is the audit log file, or nil to keep it in memory.
+	audit *os.File
+}
+
+// openFileStorage opens the files, creating the audit log if it doesn't
+// exist. Empty paths are kept in memory instead.
+func openFileStorage(roomsPath, auditPath string) (*fileStorage, error) {
+	fs := &fileStorage{roomsPath: roomsPath}
+	if auditPath == "" {
+		return fs, nil
+	}
+	f, err := os.OpenFile(auditPath, os.O_RDWR|os.O_APPEND|os.O_CREATE, 0o600)
+	if err != nil {
+		return nil, err
+	}
+	fs.audit = f
+	return fs, nil
+}
+
+func (fs *fileStorage) loadRoomSettings() (map[string]*savedRoom, error) {
+	if fs.roomsPath == "" {
+		return fs.mem.loadRoomSettings()
+	}
+	rooms := make(map[string]*savedRoom)
+	b, err := os.ReadFile(fs.roomsPath)
+	if os.IsNotExist(err) {
+		return rooms, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(b, &rooms); err != nil {
+		return nil, fmt.Errorf("%s: %w", fs.roomsPath, err)
+	}
+	return rooms, nil
+}
+
+func (fs *fileStorage) saveRoomSettings(rooms map[string]*savedRoom) error {
+	if fs.roomsPath == "" {
+		return fs.mem.saveRoomSettings(rooms)
+	}
+	b, err := json.Marshal(rooms)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(fs.roomsPath, b)
+}
+
+func (fs *fileStorage) appendAudit(e auditEntry) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	if fs.audit == nil {
+		return fs.mem.appendAudit(e)
+	}
+	b, _ := json.Marshal(e)
+	_, err := fs.audit.Write(append(b, '\n'))
+	return err
+}
+
+func (fs *fileStorage) loadAudit(n int) ([]auditEntry, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	if fs.audit == nil {
+		return fs.mem.loadAudit(n)
+	}
+	if _, err := fs.audit.Seek(0, 0); err != nil {
+		return nil, err
+	}
+	var es []auditEntry
+	s := bufio.NewScanner(fs.audit)
+	for line := 1; s.Scan(); line++ {
+		var e auditEntry
+		if err := json.Unmarshal(s.Bytes(), &e); err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", fs.audit.Name(), line, err)
+		}
+		es = append(es, e)
+		if len(es) > n {
+			es = es[1:]
+		}
+	}
+	return es, s.Err()
+}
+
+func (fs *fileStorage) purgeAudit(before time.Time) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	if fs.audit == nil {
+		return fs.mem.purgeAudit(before)
+	}
+	if _, err := fs.audit.Seek(0, 0); err != nil {
+		return err
+	}
+	var kept bytes.Buffer
+	purged := false
+	s := bufio.NewScanner(fs.audit)
+	for line := 1; s.Scan(); line++ {
+		var e auditEntry
+		if err := json.Unmarshal(s.Bytes(), &e); err != nil {
+			return fmt.Errorf("%s:%d: %w", fs.audit.Name(), line, err)
+		}
+		if e.Time.Before(before) {
+			purged = true
+			continue
+		}
+		kept.Write(s.Bytes())
+		kept.WriteByte('\n')
+	}
+	if err := s.Err(); err != nil {
+		return err
+	}
+	if !purged {
+		return nil
+	}
+
+	// Replace the file, and append to the new one from now on
+	path := fs.audit.Name()
+	if err := writeFileAtomic(path, kept.Bytes()); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_APPEND, 0o600)
+	if err != nil {
+		return err
+	}
+	fs.audit.Close()
+	fs.audit = f
+	return nil
+}
+
+func (fs *fileStorage) loadBans() ([]ban, error) {
+	return fs.mem.loadBans()
+}
+
+func (fs *fileStorage) saveBan(b ban) error {
+	return fs.mem.saveBan(b)
+}
+
+func (fs *fileStorage) removeBan(target string) error {
+	return fs.mem.removeBan(target)
+}
+
+func (fs *fileStorage) appendHistory(m historyMsg) error {
+	return fs.mem.appendHistory(m)
+}
+
+func (fs *fileStorage) editHistory(room, id, text string) error {
+	return fs.mem.editHistory(room, id, text)
+}
+
+func (fs *fileStorage) deleteHistory(room, id string) error {
+	return fs.mem.deleteHistory(room, id)
+}
+
+func (fs *fileStorage) loadHistory(room, before string, n int) ([]historyMsg, error) {
+	return fs.mem.loadHistory(room, before, n)
+}
+
+func (fs *fileStorage) searchHistory(room, term, before string, n int) ([]historyMsg, error) {
+	return fs.mem.searchHistory(room, term, before, n)
+}
+
+func (fs *fileStorage) eraseHistory(room string) error {
+	return fs.mem.eraseHistory(room)
+}
+
+func (fs *fileStorage) purgeHistory(before time.Time) error {
+	return fs.mem.purgeHistory(before)
+}
+
+func (fs *fileStorage) close() error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	if fs.audit == nil {
+		return nil
+	}
+	err := fs.audit.Close()
+	fs.audit = nil
+	return err
+}
@@ -0,0 +1,8 @@
+//go:build postgres
+
+package main
+
+// This file adds the PostgreSQL driver for -storage, in builds with
+// "-tags postgres".
+
+import _ "github.com/lib/pq"
@@ -0,0 +1,360 @@
+package main
+
+// This file has the SQL storage, for SQLite and PostgreSQL. The database
+// drivers aren't built in by default, so the binary stays small and doesn't
+// need cgo; build with "-tags sqlite" or "-tags postgres" to add them, see
+// storage_sqlite.go and storage_postgres.go. The SQLite driver needs cgo.
+// The tables are created if they don't exist.
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// SQL dialects, named after their build tags.
+const (
+	dialectSQLite   = "sqlite"
+	dialectPostgres = "postgres"
+)
+
+// sqlDrivers are the names of the database/sql drivers for the dialects.
+var sqlDrivers = map[string]string{
+	dialectSQLite:   "sqlite3",
+	dialectPostgres: "postgres",
+}
+
+// sqlSchema creates the tables. It works in both dialects.
+var sqlSchema = []string{
+	`CREATE TABLE IF NOT EXISTS room_settings (
+		room_key TEXT PRIMARY KEY,
+		settings TEXT NOT NULL
+	)`,
+	`CREATE TABLE IF NOT EXISTS audit_log (
+		time TIMESTAMP NOT NULL,
+		key_id TEXT NOT NULL,
+		action TEXT NOT NULL,
+		target TEXT NOT NULL,
+		detail TEXT NOT NULL
+	)`,
+	`CREATE INDEX IF NOT EXISTS audit_log_time ON audit_log (time)`,
+	`CREATE TABLE IF NOT EXISTS bans (
+		target TEXT PRIMARY KEY,
+		reason TEXT NOT NULL,
+		time TIMESTAMP NOT NULL,
+		expires TIMESTAMP
+	)`,
+	`CREATE TABLE IF NOT EXISTS history (
+		room_key TEXT NOT NULL,
+		id TEXT NOT NULL,
+		reply_to TEXT NOT NULL,
+		nick TEXT NOT NULL,
+		text TEXT NOT NULL,
+		time TIMESTAMP NOT NULL,
+		bot BOOLEAN NOT NULL,
+		edited BOOLEAN NOT NULL,
+		PRIMARY KEY (room_key, id)
+	)`,
+	`CREATE INDEX IF NOT EXISTS history_time ON history (time)`,
+}
+
+// sqlTimeout is how long a database call can take before it's given up on,
+// so a slow or unreachable database can't hold up everything waiting on it.
+const sqlTimeout = 5 * time.Second
+
+// sqlContext returns the context for a database call.
+func sqlContext() (context.Context, context.CancelFunc) {
+	return context.WithTimeout(context.Background(), sqlTimeout)
+}
+
+// sqlStorage keeps everything in an SQL database.
+type sqlStorage struct {
+	db      *sql.DB
+	dialect string
+}
+
+// openSQLStorage connects to the database and creates the tables. It returns
+// an error if NearTalk was built without the driver for the dialect.
+func openSQLStorage(dialect, dsn string) (*sqlStorage, error) {
+	found := false
+	for _, d := range sql.Drivers() {
+		if d == sqlDrivers[dialect] {
+			found = true
+		}
+	}
+	if !found {
+		return nil, fmt.Errorf("NearTalk was built without %s support, build it with -tags %s", dialect, dialect)
+	}
+	db, err := sql.Open(sqlDrivers[dialect], dsn)
+	if err != nil {
+		return nil, err
+	}
+	if dialect == dialectSQLite {
+		// SQLite only allows one writer at a time
+		db.SetMaxOpenConns(1)
+	}
+	ctx, cancel := sqlContext()
+	defer cancel()
+	for _, q := range sqlSchema {
+		if _, err := db.ExecContext(ctx, q); err != nil {
+			db.Close()
+			return nil, fmt.Errorf("creating tables: %w", err)
+		}
+	}
+	return &sqlStorage{db: db, dialect: dialect}, nil
+}
+
+// query returns q with its "?" placeholders changed to what the dialect
+// uses.
+func (ss *sqlStorage) query(q string) string {
+	if ss.dialect != dialectPostgres {
+		return q
+	}
+	var b strings.Builder
+	n := 0
+	for _, r := range q {
+		if r == '?' {
+			n++
+			fmt.Fprintf(&b, "$%d", n)
+			continue
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+func (ss *sqlStorage) loadRoomSettings() (map[string]*savedRoom, error) {
+	ctx, cancel := sqlContext()
+	defer cancel()
+	rows, err := ss.db.QueryContext(ctx, `SELECT room_key, settings FROM room_settings`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	rooms := make(map[string]*savedRoom)
+	for rows.Next() {
+		var key, settings string
+		if err := rows.Scan(&key, &settings); err != nil {
+			return nil, err
+		}
+		var sr savedRoom
+		if err := json.Unmarshal([]byte(settings), &sr); err != nil {
+			return nil, fmt.Errorf("room %q: %w", key, err)
+		}
+		rooms[key] = &sr
+	}
+	return rooms, rows.Err()
+}
+
+func (ss *sqlStorage) saveRoomSettings(rooms map[string]*savedRoom) error {
+	ctx, cancel := sqlContext()
+	defer cancel()
+	tx, err := ss.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, `DELETE FROM room_settings`); err != nil {
+		return err
+	}
+	insert := ss.query(`INSERT INTO room_settings (room_key, settings) VALUES (?, ?)`)
+	for key, sr := range rooms {
+		b, err := json.Marshal(sr)
+		if err != nil {
+			return err
+		}
+		if _, err := tx.ExecContext(ctx, insert, key, string(b)); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (ss *sqlStorage) appendAudit(e auditEntry) error {
+	ctx, cancel := sqlContext()
+	defer cancel()
+	_, err := ss.db.ExecContext(ctx,
+		ss.query(`INSERT INTO audit_log (time, key_id, action, target, detail) VALUES (?, ?, ?, ?, ?)`),
+		e.Time, e.KeyID, e.Action, e.Target, e.Detail,
+	)
+	return err
+}
+
+func (ss *sqlStorage) loadAudit(n int) ([]auditEntry, error) {
+	ctx, cancel := sqlContext()
+	defer cancel()
+	rows, err := ss.db.QueryContext(ctx,
+		ss.query(`SELECT time, key_id, action, target, detail FROM audit_log ORDER BY time DESC LIMIT ?`), n,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var es []auditEntry
+	for rows.Next() {
+		var e auditEntry
+		if err := rows.Scan(&e.Time, &e.KeyID, &e.Action, &e.Target, &e.Detail); err != nil {
+			return nil, err
+		}
+		e.Time = e.Time.In(time.UTC)
+		es = append(es, e)
+	}
+	// Oldest first
+	for i, j := 0, len(es)-1; i < j; i, j = i+1, j-1 {
+		es[i], es[j] = es[j], es[i]
+	}
+	return es, rows.Err()
+}
+
+func (ss *sqlStorage) purgeAudit(before time.Time) error {
+	ctx, cancel := sqlContext()
+	defer cancel()
+	_, err := ss.db.ExecContext(ctx, ss.query(`DELETE FROM audit_log WHERE time < ?`), before)
+	return err
+}
+
+func (ss *sqlStorage) loadBans() ([]ban, error) {
+	ctx, cancel := sqlContext()
+	defer cancel()
+	rows, err := ss.db.QueryContext(ctx, `SELECT target, reason, time, expires FROM bans`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var bans []ban
+	for rows.Next() {
+		var b ban
+		var expires sql.NullTime
+		if err := rows.Scan(&b.Target, &b.Reason, &b.Time, &expires); err != nil {
+			return nil, err
+		}
+		b.Time = b.Time.In(time.UTC)
+		if expires.Valid {
+			t := expires.Time.In(time.UTC)
+			b.Expires = &t
+		}
+		bans = append(bans, b)
+	}
+	return bans, rows.Err()
+}
+
+func (ss *sqlStorage) saveBan(b ban) error {
+	ctx, cancel := sqlContext()
+	defer cancel()
+	var expires sql.NullTime
+	if b.Expires != nil {
+		expires = sql.NullTime{Time: b.Expires.UTC(), Valid: true}
+	}
+	_, err := ss.db.ExecContext(ctx,
+		ss.query(`INSERT INTO bans (target, reason, time, expires) VALUES (?, ?, ?, ?)
+			ON CONFLICT (target) DO UPDATE SET reason = excluded.reason, time = excluded.time, expires = excluded.expires`),
+		b.Target, b.Reason, b.Time.UTC(), expires,
+	)
+	return err
+}
+
+func (ss *sqlStorage) removeBan(target string) error {
+	ctx, cancel := sqlContext()
+	defer cancel()
+	_, err := ss.db.ExecContext(ctx, ss.query(`DELETE FROM bans WHERE target = ?`), target)
+	return err
+}
+
+func (ss *sqlStorage) appendHistory(m historyMsg) error {
+	ctx, cancel := sqlContext()
+	defer cancel()
+	_, err := ss.db.ExecContext(ctx,
+		ss.query(`INSERT INTO history (room_key, id, reply_to, nick, text, time, bot, edited) VALUES (?, ?, ?, ?, ?, ?, ?, ?)`),
+		m.Room, m.ID, m.ReplyTo, m.Nick, m.Text, m.Time.UTC(), m.Bot, m.Edited,
+	)
+	return err
+}
+
+func (ss *sqlStorage) editHistory(room, id, text string) error {
+	ctx, cancel := sqlContext()
+	defer cancel()
+	_, err := ss.db.ExecContext(ctx,
+		ss.query(`UPDATE history SET text = ?, edited = ? WHERE room_key = ? AND id = ?`), text, true, room, id,
+	)
+	return err
+}
+
+func (ss *sqlStorage) deleteHistory(room, id string) error {
+	ctx, cancel := sqlContext()
+	defer cancel()
+	_, err := ss.db.ExecContext(ctx, ss.query(`DELETE FROM history WHERE room_key = ? AND id = ?`), room, id)
+	return err
+}
+
+// queryHistory returns the messages in a room's history matching the
+// conditions, up to the n newest sent before the message with the ID, or the
+// newest if before is empty. They're newest first.
+func (ss *sqlStorage) queryHistory(room, conds, before string, n int, args ...interface{}) ([]historyMsg, error) {
+	ctx, cancel := sqlContext()
+	defer cancel()
+	q := `SELECT room_key, id, reply_to, nick, text, time, bot, edited FROM history WHERE room_key = ?` + conds
+	args = append([]interface{}{room}, args...)
+	if before != "" {
+		// IDs sort by time, see the ids package
+		q += ` AND id < ?`
+		args = append(args, before)
+	}
+	rows, err := ss.db.QueryContext(ctx, ss.query(q+` ORDER BY id DESC LIMIT ?`), append(args, n)...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var ms []historyMsg
+	for rows.Next() {
+		var m historyMsg
+		if err := rows.Scan(&m.Room, &m.ID, &m.ReplyTo, &m.Nick, &m.Text, &m.Time, &m.Bot, &m.Edited); err != nil {
+			return nil, err
+		}
+		m.Time = m.Time.In(time.UTC)
+		ms = append(ms, m)
+	}
+	return ms, rows.Err()
+}
+
+func (ss *sqlStorage) loadHistory(room, before string, n int) ([]historyMsg, error) {
+	ms, err := ss.queryHistory(room, "", before, n)
+	// Oldest first
+	for i, j := 0, len(ms)-1; i < j; i, j = i+1, j-1 {
+		ms[i], ms[j] = ms[j], ms[i]
+	}
+	return ms, err
+}
+
+// likeEscaper escapes the wildcards in LIKE patterns.
+var likeEscaper = strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`)
+
+func (ss *sqlStorage) searchHistory(room, term, before string, n int) ([]historyMsg, error) {
+	pattern := "%" + likeEscaper.Replace(strings.ToLower(term)) + "%"
+	return ss.queryHistory(room, ` AND LOWER(text) LIKE ? ESCAPE '\'`, before, n, pattern)
+}
+
+func (ss *sqlStorage) eraseHistory(room string) error {
+	ctx, cancel := sqlContext()
+	defer cancel()
+	_, err := ss.db.ExecContext(ctx, ss.query(`DELETE FROM history WHERE room_key = ?`), room)
+	return err
+}
+
+func (ss *sqlStorage) purgeHistory(before time.Time) error {
+	ctx, cancel := sqlContext()
+	defer cancel()
+	_, err := ss.db.ExecContext(ctx, ss.query(`DELETE FROM history WHERE time < ?`), before.UTC())
+	return err
+}
+
+func (ss *sqlStorage) close() error {
+	return ss.db.Close()
+}
@@ -0,0 +1,8 @@
+//go:build sqlite
+
+package main
+
+// This file adds the SQLite driver for -storage, in builds with
+// "-tags sqlite". The driver uses cgo, so a C compiler is needed.
+
+import _ "github.com/mattn/go-sqlite3"
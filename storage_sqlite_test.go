@@ -0,0 +1,18 @@
+//go:build sqlite
+
+package main
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestSQLiteStorage(t *testing.T) {
+	store, err := openStorage("sqlite:" + filepath.Join(t.TempDir(), "neartalk.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.close()
+	testStorageHistory(t, store)
+	testStorageBans(t, store)
+}
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMemoryStorage(t *testing.T) {
+	var ms memoryStorage
+	rooms := map[string]*savedRoom{"lan": {Topic: "Games", AllowedSessions: []string{"a"}}}
+	if err := ms.saveRoomSettings(rooms); err != nil {
+		t.Fatal(err)
+	}
+	rooms["lan"].AllowedSessions[0] = "b"
+	got, err := ms.loadRoomSettings()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sr := got["lan"]; sr == nil || sr.Topic != "Games" || sr.AllowedSessions[0] != "a" {
+		t.Errorf("lan = %+v, want it unchanged by changes after saving", sr)
+	}
+
+	for i := 0; i < 3; i++ {
+		ms.appendAudit(auditEntry{Time: time.Now(), Action: auditWatch, Target: strings.Repeat("x", i)})
+	}
+	es, err := ms.loadAudit(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(es) != 2 || es[0].Target != "x" || es[1].Target != "xx" {
+		t.Errorf("loadAudit(2) = %+v, want the two newest, oldest first", es)
+	}
+}
+
+func TestOpenStorage(t *testing.T) {
+	if _, err := openStorage("memory"); err != nil {
+		t.Error(err)
+	}
+	if _, err := openStorage("mysql://localhost"); err == nil {
+		t.Error("no error for an unknown storage")
+	}
+}
+
+func TestSQLStorageQuery(t *testing.T) {
+	ss := &sqlStorage{dialect: dialectPostgres}
+	q := `INSERT INTO t (a, b) VALUES (?, ?)`
+	if got, want := ss.query(q), `INSERT INTO t (a, b) VALUES ($1, $2)`; got != want {
+		t.Errorf("postgres query = %q, want %q", got, want)
+	}
+	ss.dialect = dialectSQLite
+	if got := ss.query(q); got != q {
+		t.Errorf("sqlite query = %q, want it unchanged", got)
+	}
+}
+
+func TestFileStoragePurgeAudit(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	fs, err := openFileStorage("", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fs.close()
+	now := time.Now().UTC()
+	for target, when := range map[string]time.Time{"old": now.Add(-2 * time.Hour), "new": now} {
+		if err := fs.appendAudit(auditEntry{Time: when, Action: auditWatch, Target: target}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := fs.purgeAudit(now.Add(-time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	// Appending still works after the file is replaced
+	if err := fs.appendAudit(auditEntry{Time: now, Action: auditWatch, Target: "newer"}); err != nil {
+		t.Fatal(err)
+	}
+
+	es, err := fs.loadAudit(10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(es) != 2 || es[0].Target != "new" || es[1].Target != "newer" {
+		t.Errorf("audit log after purging = %+v, want the new entries", es)
+	}
+	b, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(b), "old") {
+		t.Errorf("audit log file still has old entries:\n%s", b)
+	}
+}
+
+func TestMemoryStorageHistory(t *testing.T) {
+	var ms memoryStorage
+	testStorageHistory(t, &ms)
+}
+
+func TestMemoryStorageHistoryRooms(t *testing.T) {
+	var ms memoryStorage
+	start := time.Now()
+	for i := 0; i <= maxMemoryHistoryRooms; i++ {
+		m := historyMsg{ID: fmt.Sprint(i), Room: fmt.Sprint("room", i), Time: start.Add(time.Duration(i) * time.Second)}
+		if i == 0 {
+			// The first room is busy again, so the second is the quietest
+			m.Time = start.Add(time.Hour)
+		}
+		if err := ms.appendHistory(m); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(ms.history) != maxMemoryHistoryRooms {
+		t.Errorf("keeping history for %d rooms, want %d", len(ms.history), maxMemoryHistoryRooms)
+	}
+	if _, ok := ms.history["room1"]; ok {
+		t.Error("the quietest room's history was kept")
+	}
+	if _, ok := ms.history["room0"]; !ok {
+		t.Error("the busy room's history was dropped")
+	}
+}
+
+// testStorageHistory checks that the storage keeps, edits, deletes, pages,
+// searches, and purges message history.
+func testStorageHistory(t *testing.T, s storage) {
+	now := time.Now().UTC().Truncate(time.Second)
+	for i, id := range []string{"A", "B", "C", "D"} {
+		m := historyMsg{ID: id, Room: "lan", Nick: "alice", Text: "msg " + id, Time: now.Add(time.Duration(i-3) * time.Hour)}
+		if err := s.appendHistory(m); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.appendHistory(historyMsg{ID: "E", Room: "other", Nick: "bob", Text: "hi", Time: now}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.editHistory("lan", "D", "edited"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.deleteHistory("lan", "B"); err != nil {
+		t.Fatal(err)
+	}
+
+	ids := func(ms []historyMsg) string {
+		var b strings.Builder
+		for _, m := range ms {
+			b.WriteString(m.ID)
+		}
+		return b.String()
+	}
+	ms, err := s.loadHistory("lan", "", 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ids(ms) != "CD" || ms[1].Text != "edited" || !ms[1].Edited || ms[0].Edited {
+		t.Errorf("loadHistory = %+v, want C and the edited D", ms)
+	}
+	if !ms[0].Time.Equal(now.Add(-time.Hour)) {
+		t.Errorf("C's time = %v, want %v", ms[0].Time, now.Add(-time.Hour))
+	}
+	if ms, err = s.loadHistory("lan", "C", 10); err != nil || ids(ms) != "A" {
+		t.Errorf("loadHistory before C = %+v, %v, want A", ms, err)
+	}
+
+	if err := s.appendHistory(historyMsg{ID: "F", Room: "lan", Nick: "bob", Text: "100% Sure_thing", Time: now}); err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range []struct{ term, before, want string }{
+		{"MSG", "", "CA"},
+		{"msg", "C", "A"},
+		{"edited", "", "D"},
+		{"% sure_", "", "F"},
+		{"%", "F", ""},
+		{"_", "F", ""},
+		{"hello", "", ""},
+	} {
+		if ms, err := s.searchHistory("lan", c.term, c.before, 10); err != nil || ids(ms) != c.want {
+			t.Errorf("searchHistory(%q, %q) = %+v, %v, want %s", c.term, c.before, ms, err, c.want)
+		}
+	}
+	if ms, err := s.searchHistory("lan", "msg", "", 1); err != nil || ids(ms) != "C" {
+		t.Errorf("searchHistory limited to 1 = %+v, %v, want C", ms, err)
+	}
+	if err := s.deleteHistory("lan", "F"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.purgeHistory(now.Add(-90 * time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	if ms, err = s.loadHistory("lan", "", 10); err != nil || ids(ms) != "CD" {
+		t.Errorf("history after purging = %+v, %v, want C and D", ms, err)
+	}
+	if err := s.eraseHistory("lan"); err != nil {
+		t.Fatal(err)
+	}
+	if ms, err = s.loadHistory("lan", "", 10); err != nil || len(ms) != 0 {
+		t.Errorf("history after erasing = %+v, %v, want none", ms, err)
+	}
+	if ms, err = s.loadHistory("other", "", 10); err != nil || ids(ms) != "E" {
+		t.Errorf("other room's history = %+v, %v, want it kept", ms, err)
+	}
+}
+
+func TestMemoryStorageBans(t *testing.T) {
+	var ms memoryStorage
+	testStorageBans(t, &ms)
+}
+
+// testStorageBans checks that the storage keeps, replaces, and removes bans.
+func testStorageBans(t *testing.T, s storage) {
+	now := time.Now().UTC().Truncate(time.Second)
+	expires := now.Add(time.Hour)
+	if err := s.saveBan(ban{Target: "203.0.113.7", Reason: "spam", Time: now}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.saveBan(ban{Target: "198.51.100.0/24", Time: now}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.saveBan(ban{Target: "203.0.113.7", Reason: "more spam", Time: now, Expires: &expires}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.removeBan("198.51.100.0/24"); err != nil {
+		t.Fatal(err)
+	}
+	bans, err := s.loadBans()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(bans) != 1 || bans[0].Reason != "more spam" || bans[0].Expires == nil || !bans[0].Expires.Equal(expires) {
+		t.Errorf("loadBans = %+v, want the replaced ban", bans)
+	}
+}
@@ -0,0 +1,336 @@
+package main
+
+// This file has subrooms, which let people on the same network split off
+// into rooms for a topic with "/join #music", while the room for the network
+// stays as the lobby everyone starts in. "/join lobby" goes back.
+//
+// A subroom's key is its lobby's key followed by subroomSep and its name,
+// like "203.0.113.7#music". Named rooms start with the same character, so
+// they're told apart by it being first, and can't have subrooms themselves.
+// Like any room, a subroom closes when the last person leaves it, which is
+// how it's removed from the list.
+//
+// Everyone in the lobby and its subrooms gets the list of subrooms with how
+// many people are in each, which the web UI shows beside the user list.
+// Locked lobbies lock their subrooms too, and subrooms can also be locked on
+// their own.
+
+import (
+	"bytes"
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/makeworld-the-better-one/neartalk/events"
+)
+
+// subroomSep separates the lobby key from the subroom name in subroom keys.
+const subroomSep = "#"
+
+// subroomLobby is the name "/join" takes to go back to the lobby, so it can't
+// be used for a subroom.
+const subroomLobby = "lobby"
+
+// maxSubrooms is how many subrooms a lobby can have at once.
+const maxSubrooms = 20
+
+// subroomKey returns the key of the subroom with the name in the lobby with
+// the key.
+func subroomKey(lobby, name string) string {
+	return lobby + subroomSep + name
+}
+
+// splitSubroomKey returns the key of the lobby and the name of the subroom
+// for a subroom key, and false if the key isn't for a subroom.
+func splitSubroomKey(key string) (lobby, name string, ok bool) {
+	i := strings.Index(key, subroomSep)
+	if i <= 0 {
+		// Not a subroom, or a named room
+		return "", "", false
+	}
+	return key[:i], key[i+len(subroomSep):], true
+}
+
+// canHaveSubrooms returns whether the room with the key can be a lobby. Only
+// the rooms for networks can, not named rooms or subrooms.
+func canHaveSubrooms(key string) bool {
+	return !strings.Contains(key, subroomSep)
+}
+
+// lobbyHref returns the path of the chat page for the lobby with the key.
+func lobbyHref(lobby string) string {
+	if lanMode {
+		return "/lan/" + lanSlug(lobby)
+	}
+	return "/"
+}
+
+// subroomHref returns the path of the chat page for the subroom with the
+// name in the lobby with the key.
+func subroomHref(lobby, name string) string {
+	if lanMode {
+		return lobbyHref(lobby) + "/" + name
+	}
+	return "/sub/" + name
+}
+
+// subroomQuery returns the query string /connect takes to join the subroom
+// with the name in the lobby with the key.
+func subroomQuery(lobby, name string) string {
+	q := url.Values{"sub": {name}}
+	if lanMode {
+		q.Set("lan", lanSlug(lobby))
+	}
+	return q.Encode()
+}
+
+// handleJoinCmd handles "/join #<name>", which takes the author to the
+// subroom with the name, creating it if nobody is in it yet, and "/join
+// lobby", which takes them back to the lobby.
+// It does not lock the clientsMu, callers should do that.
+func (cr *chatRoom) handleJoinCmd(m msg) {
+	arg := strings.TrimPrefix(strings.TrimSpace(m.text[len("/join"):]), subroomSep)
+	if arg == "" {
+		m.author.sendError("Usage: /join #<name>, or /join lobby to go back")
+		return
+	}
+	lobby, current, ok := splitSubroomKey(cr.key)
+	if !ok {
+		lobby = cr.key
+	}
+	if !canHaveSubrooms(lobby) {
+		m.author.sendError("Subrooms can only be made in the room for a network")
+		return
+	}
+	if m.author.guest || m.author.bot != nil {
+		m.author.sendError("Only people on this network can join subrooms")
+		return
+	}
+	name, ok := normalizeRoomName(arg)
+	if !ok {
+		m.author.sendError("Subroom names can only have up to 32 letters, numbers, and hyphens")
+		return
+	}
+	if name == subroomLobby && current == "" {
+		m.author.sendError("You're already in the lobby")
+		return
+	}
+	if name == current {
+		m.author.sendError(fmt.Sprintf("You're already in #%s", name))
+		return
+	}
+	go cr.server.sendJoin(m.author, lobby, name)
+}
+
+// sendJoin takes the client to the subroom with the name in the lobby with
+// the key, or back to the lobby. The web UI goes to the subroom's page, and
+// JSON clients are told how to connect to it.
+func (cs *chatServer) sendJoin(c *client, lobby, name string) {
+	href := lobbyHref(lobby)
+	if name != subroomLobby {
+		if cs.subroomsFull(subroomKey(lobby, name)) {
+			c.sendError(fmt.Sprintf("There can only be %d subrooms at once, join one of the others", maxSubrooms))
+			return
+		}
+		href = subroomHref(lobby, name)
+	}
+	if !c.isJSON() {
+		c.sendFrame(fmt.Sprintf(`<div id="goto" data-href="%s" hx-swap-oob="true"></div>`, template.HTMLEscapeString(href)) +
+			clearInputFieldMsg)
+		return
+	}
+	if name == subroomLobby {
+		c.sendNotice("Reconnect without the sub parameter to go back to the lobby")
+		return
+	}
+	c.sendNotice(fmt.Sprintf("Connect to /connect?%s to join #%s", subroomQuery(lobby, name), name))
+}
+
+// subroomsFull returns true if the subroom with the key isn't open, and its
+// lobby already has maxSubrooms subrooms.
+// It holds the roomsMu.
+func (cs *chatServer) subroomsFull(key string) bool {
+	lobby, _, _ := splitSubroomKey(key)
+	cs.roomsMu.Lock()
+	defer cs.roomsMu.Unlock()
+	if _, ok := cs.rooms[key]; ok {
+		return false
+	}
+	n := 0
+	for k := range cs.rooms {
+		if l, _, ok := splitSubroomKey(k); ok && l == lobby {
+			n++
+		}
+	}
+	return n >= maxSubrooms
+}
+
+// connectSubroomKey returns the key of the subroom with the name in the
+// lobby with the key, for the "sub" parameter of a connection request. If
+// the client can't join it, it responds with an error and returns false.
+func (cs *chatServer) connectSubroomKey(w http.ResponseWriter, r *http.Request, lobby, name, session string) (string, bool) {
+	if !canHaveSubrooms(lobby) || r.URL.Query().Get("invite") != "" {
+		http.Error(w, "subrooms can only be joined from the room for a network", http.StatusBadRequest)
+		return "", false
+	}
+	name, ok := normalizeRoomName(name)
+	if !ok || name == subroomLobby {
+		http.Error(w, "invalid subroom name", http.StatusBadRequest)
+		return "", false
+	}
+	if !cs.mayJoinRoom(lobby, session) {
+		http.Error(w, "this room is locked", http.StatusForbidden)
+		return "", false
+	}
+	key := subroomKey(lobby, name)
+	if cs.subroomsFull(key) {
+		http.Error(w, "there are too many subrooms here", http.StatusForbidden)
+		return "", false
+	}
+	return key, true
+}
+
+// subroomPageHandler serves the chat page for a subroom of the room for the
+// visitor's network at /sub/<name>.
+func (cs *chatServer) subroomPageHandler(w http.ResponseWriter, r *http.Request) {
+	if lanMode {
+		// LAN rooms have them at /lan/<slug>/<name>, see lanRoomPageHandler
+		http.NotFound(w, r)
+		return
+	}
+	cs.serveSubroomPage(w, r, cs.clientRoomKey(r), strings.TrimPrefix(r.URL.Path, "/sub/"))
+}
+
+// serveSubroomPage serves the chat page for the subroom with the name in the
+// lobby with the key. If the lobby or the subroom is locked, visitors have to
+// enter the password first.
+func (cs *chatServer) serveSubroomPage(w http.ResponseWriter, r *http.Request, lobby, name string) {
+	name, ok := normalizeRoomName(name)
+	if !ok {
+		http.Error(w, "Subroom names can only have up to 32 letters, numbers, and hyphens.", http.StatusNotFound)
+		return
+	}
+	if name == subroomLobby {
+		http.Redirect(w, r, lobbyHref(lobby), http.StatusFound)
+		return
+	}
+	if href := subroomHref(lobby, name); r.URL.Path != href {
+		// Redirect to the canonical name
+		http.Redirect(w, r, href, http.StatusFound)
+		return
+	}
+	if !cs.challengeGate(w, r) {
+		return
+	}
+	// The lobby's password is asked for first, then the subroom's
+	key := subroomKey(lobby, name)
+	if !cs.mayJoinRoom(lobby, getSession(w, r)) {
+		key = lobby
+	}
+	if !cs.passwordGate(w, r, key, roomTitle(key)) {
+		return
+	}
+
+	page, err := os.ReadFile("html/index.html")
+	if err != nil {
+		log.Printf("chatServer.serveSubroomPage: err reading index.html: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	// Connect to the subroom instead of the lobby
+	page = bytes.Replace(page, []byte(`<body hx-ws="connect:/connect">`), []byte(fmt.Sprintf(
+		`<body hx-ws="connect:/connect?%s">`, template.HTMLEscapeString(subroomQuery(lobby, name)),
+	)), 1)
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Write(page)
+}
+
+// subroomsChanged sends the new subroom list to the lobby of the room and
+// its subrooms, after someone joined or left it.
+func (cr *chatRoom) subroomsChanged() {
+	lobby, _, ok := splitSubroomKey(cr.key)
+	if !ok {
+		if !canHaveSubrooms(cr.key) {
+			return
+		}
+		lobby = cr.key
+	}
+	// The room holds its clientsMu, which can't be held while locking the
+	// roomsMu
+	go cr.server.refreshSubrooms(lobby, ok)
+}
+
+// refreshSubrooms sends the list of subrooms to everyone in the lobby with
+// the key and its subrooms. Unless force is true, nothing is sent if there
+// aren't any subrooms, so lobbies that never had any aren't sent an empty
+// list every time someone joins. The list is made and sent with the roomsMu
+// held, so lists sent by different calls can't arrive out of order.
+// It holds the roomsMu.
+func (cs *chatServer) refreshSubrooms(lobby string, force bool) {
+	cs.roomsMu.Lock()
+	defer cs.roomsMu.Unlock()
+
+	var list events.Subrooms
+	family := make(map[string]*chatRoom)
+	for k, room := range cs.rooms {
+		l, name, ok := splitSubroomKey(k)
+		if k != lobby && (!ok || l != lobby) {
+			continue
+		}
+		family[name] = room
+		room.clientsMu.Lock()
+		users := len(room.users())
+		room.clientsMu.Unlock()
+		if k == lobby {
+			list.LobbyUsers = users
+		} else if users > 0 {
+			list.Rooms = append(list.Rooms, events.Subroom{Name: name, Users: users})
+		}
+	}
+	if len(list.Rooms) == 0 && !force {
+		return
+	}
+	sort.Slice(list.Rooms, func(i, j int) bool { return list.Rooms[i].Name < list.Rooms[j].Name })
+
+	for name, room := range family {
+		list.Current = name
+		m := msg{
+			raw:     createSubroomsMsg(lobby, list),
+			rawJSON: []string{encodeEvent(events.TypeSubrooms, list)},
+			when:    time.Now(),
+			// Other instances have their own list
+			local: true,
+		}
+		select {
+		case room.incoming <- m:
+		default:
+			log.Printf("chatServer.refreshSubrooms: room %s is too busy, skipped", room.key)
+		}
+	}
+}
+
+// createSubroomsMsg renders the subroom list for the web UI.
+func createSubroomsMsg(lobby string, list events.Subrooms) string {
+	type entry struct {
+		Name  string
+		Href  string
+		Users int
+		Here  bool
+	}
+	rooms := make([]entry, len(list.Rooms))
+	for i, s := range list.Rooms {
+		rooms[i] = entry{s.Name, subroomHref(lobby, s.Name), s.Users, s.Name == list.Current}
+	}
+	return renderTemplate("subrooms.html", struct {
+		LobbyHref  string
+		LobbyUsers int
+		InLobby    bool
+		Rooms      []entry
+	}{lobbyHref(lobby), list.LobbyUsers, list.Current == "", rooms})
+}
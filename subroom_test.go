@@ -0,0 +1,67 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSplitSubroomKey(t *testing.T) {
+	tests := []struct {
+		key   string
+		lobby string
+		name  string
+		ok    bool
+	}{
+		{"203.0.113.7#music", "203.0.113.7", "music", true},
+		{"~abc#book-club", "~abc", "book-club", true},
+		{"203.0.113.7", "", "", false},
+		{"#music", "", "", false},
+	}
+	for _, tt := range tests {
+		lobby, name, ok := splitSubroomKey(tt.key)
+		if lobby != tt.lobby || name != tt.name || ok != tt.ok {
+			t.Errorf("splitSubroomKey(%q) = %q, %q, %v, want %q, %q, %v", tt.key, lobby, name, ok, tt.lobby, tt.name, tt.ok)
+		}
+	}
+	if canHaveSubrooms("#music") || canHaveSubrooms("203.0.113.7#music") || !canHaveSubrooms("203.0.113.7") {
+		t.Error("only rooms for networks can have subrooms")
+	}
+	if got := roomTitle(subroomKey("203.0.113.7", "music")); got != "203.0.113.7 #music" {
+		t.Errorf("subroom title is %q", got)
+	}
+}
+
+func TestHandleJoinCmd(t *testing.T) {
+	var err error
+	loadTemplatesOnce.Do(func() { err = loadTemplates(t.TempDir()) })
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		key   string
+		text  string
+		guest bool
+		want  string
+	}{
+		{"203.0.113.7", "/join", false, "Usage"},
+		{"#book-club", "/join #music", false, "network"},
+		{"203.0.113.7", "/join #music", true, "Only people"},
+		{"203.0.113.7", "/join #rock & roll", false, "letters"},
+		{"203.0.113.7", "/join lobby", false, "already in the lobby"},
+		{"203.0.113.7#music", "/join #Music", false, "already in #music"},
+	}
+	for _, tt := range tests {
+		cr := &chatRoom{key: tt.key}
+		c := &client{guest: tt.guest, outgoing: make(chan string, 1)}
+		cr.handleJoinCmd(msg{text: tt.text, author: c, when: time.Now()})
+		select {
+		case got := <-c.outgoing:
+			if !strings.Contains(got, tt.want) {
+				t.Errorf("%q in %q got %q, want an error with %q", tt.text, tt.key, got, tt.want)
+			}
+		default:
+			t.Errorf("%q in %q got no error", tt.text, tt.key)
+		}
+	}
+}
@@ -0,0 +1,93 @@
+package main
+
+// This file merges tabs. Every tab or window of the same browser has the same
+// session cookie, so when someone opens the room twice they're shown as one
+// person with one nickname, instead of two random animals. Joining and
+// leaving are only announced for their first and last tab, the user list
+// shows them once, idle only if every tab is, and their messages show as
+// their own in all their tabs. Changing their nickname, going away, becoming
+// a moderator, or being kicked applies to all of them. Bots aren't merged.
+
+// isTabOf returns true if the clients are tabs of the same person.
+func (c *client) isTabOf(o *client) bool {
+	return o != nil && c.person() == o.person()
+}
+
+// tabsOf returns the client and its other tabs in the room.
+// It does not lock the clientsMu, callers should do that.
+func (cr *chatRoom) tabsOf(c *client) []*client {
+	tabs := []*client{c}
+	for o := range cr.clients {
+		if o != c && o.isTabOf(c) {
+			tabs = append(tabs, o)
+		}
+	}
+	return tabs
+}
+
+// otherTab returns one of the client's other tabs in the room, or nil if it
+// has none.
+// It does not lock the clientsMu, callers should do that.
+func (cr *chatRoom) otherTab(c *client) *client {
+	for o := range cr.clients {
+		if o != c && o.isTabOf(c) {
+			return o
+		}
+	}
+	return nil
+}
+
+// addTab adds the client to the room as another tab of tab, taking on its
+// nickname and status. Nobody else is told, because the user list hasn't
+// changed.
+// It does not lock the clientsMu, callers should do that.
+func (cr *chatRoom) addTab(c, tab *client) {
+	c.nick = tab.nick
+	c.away = tab.away
+	c.awayReason = tab.awayReason
+	c.moderator = tab.moderator
+	cr.clients[c] = struct{}{}
+}
+
+// deliverToTab sends the broadcast to one of the author's other tabs. Their
+// own messages are shown as theirs, but their input field isn't cleared and
+// they aren't alerted.
+func (c *client) deliverToTab(b broadcast) {
+	if !b.isChat {
+		c.deliver(b, false)
+		return
+	}
+	if c.isJSON() {
+		frames := b.json
+		if b.authorJSON != nil {
+			frames = b.authorJSON
+		}
+		for _, f := range frames {
+			c.queueFrame(f, frameChat)
+		}
+		return
+	}
+	if b.authorHTML != "" {
+		c.queueFrame(b.authorHTML, frameChat)
+	}
+}
+
+// person returns what identifies the person using the client, the same for
+// all their tabs.
+func (c *client) person() any {
+	if c.bot != nil || c.session == "" {
+		return c
+	}
+	return c.session
+}
+
+// numPeople returns how many people are in the room, counting all the tabs
+// of each once.
+// It does not lock the clientsMu, callers should do that.
+func (cr *chatRoom) numPeople() int {
+	people := make(map[any]bool)
+	for c := range cr.clients {
+		people[c.person()] = true
+	}
+	return len(people)
+}
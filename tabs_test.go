@@ -0,0 +1,30 @@
+package main
+
+import "testing"
+
+func TestTabsMerged(t *testing.T) {
+	a1 := &client{nick: "alice", session: "a", active: true}
+	a2 := &client{nick: "alice", session: "a"}
+	b := &client{nick: "bob", session: "b", active: true}
+	bot := &client{nick: "bot", session: "a", bot: &botAccount{}}
+	cr := &chatRoom{clients: map[*client]struct{}{a1: {}, a2: {}, b: {}, bot: {}}}
+
+	if !a1.isTabOf(a2) || a1.isTabOf(b) || a1.isTabOf(bot) {
+		t.Error("isTabOf matched the wrong clients")
+	}
+	if n := cr.numPeople(); n != 3 {
+		t.Errorf("numPeople() = %d, want 3", n)
+	}
+	if tabs := cr.tabsOf(a2); len(tabs) != 2 {
+		t.Errorf("tabsOf(a2) = %v, want both of alice's tabs", tabs)
+	}
+	users := cr.localUsers()
+	if len(users) != 3 {
+		t.Fatalf("localUsers() has %d users, want 3", len(users))
+	}
+	for _, u := range users {
+		if u.nick == "alice" && u.idle {
+			t.Error("alice is idle though one of their tabs is active")
+		}
+	}
+}
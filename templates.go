@@ -0,0 +1,75 @@
+package main
+
+// This file handles the HTML templates used for messages sent to the web UI.
+// Operators can override any of them by putting a file with the same name in
+// the templates directory, otherwise the defaults embedded in the binary are
+// used.
+
+import (
+	"embed"
+	"fmt"
+	"html/template"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+//go:embed templates/*.html
+var defaultTemplates embed.FS
+
+// templateNames are the names of all the message templates.
+var templateNames = []string{
+	"message.html",   // Chat message
+	"special.html",   // Notifications and errors
+	"join.html",      // Join notice
+	"leave.html",     // Leave notice
+	"userlist.html",  // User list
+	"preview.html",   // Link preview card
+	"directory.html", // Public room directory page
+	"widget.html",    // Embeddable chat widget page
+	"password.html",  // Password form for locked rooms
+	"challenge.html", // Proof-of-work page, see challenge.go
+	"invite.html",    // Invite link, see invite.go
+	"hop.html",       // Link to a nearby room, see nearby.go
+	"lan.html",       // LAN mode landing page, see lanmode.go
+	"subrooms.html",  // Subroom list, see subroom.go
+	"search.html",    // Search results, see search.go
+}
+
+// msgTemplates holds all the parsed message templates.
+// It is set by loadTemplates.
+var msgTemplates *template.Template
+
+// loadTemplates parses all the message templates, using the files in dir
+// where they exist and the embedded defaults otherwise.
+func loadTemplates(dir string) error {
+	t := template.New("")
+	for _, name := range templateNames {
+		b, err := os.ReadFile(filepath.Join(dir, name))
+		if err == nil {
+			log.Printf("using custom template %s", filepath.Join(dir, name))
+		} else if os.IsNotExist(err) {
+			b, err = defaultTemplates.ReadFile("templates/" + name)
+		}
+		if err != nil {
+			return fmt.Errorf("loading template %s: %w", name, err)
+		}
+		if _, err := t.New(name).Parse(string(b)); err != nil {
+			return fmt.Errorf("parsing template %s: %w", name, err)
+		}
+	}
+	msgTemplates = t
+	return nil
+}
+
+// renderTemplate executes the named message template and returns the result.
+// Errors are logged, and an empty string is returned.
+func renderTemplate(name string, data interface{}) string {
+	var b strings.Builder
+	if err := msgTemplates.ExecuteTemplate(&b, name, data); err != nil {
+		log.Printf("renderTemplate: %s: %v", name, err)
+		return ""
+	}
+	return b.String()
+}
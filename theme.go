@@ -0,0 +1,43 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// themes are the valid theme names that can be set with /theme.
+var themes = []string{"light", "dark", "high-contrast"}
+
+func isValidTheme(theme string) bool {
+	for _, t := range themes {
+		if t == theme {
+			return true
+		}
+	}
+	return false
+}
+
+// createThemeMsg creates HTML that tells the web UI which theme to use.
+func createThemeMsg(theme string) string {
+	return fmt.Sprintf(`<div id="theme" data-theme="%s" hx-swap-oob="true"></div>`, theme)
+}
+
+// handleThemeCmd handles the /theme command.
+func (cr *chatRoom) handleThemeCmd(c *client, arg string) {
+	theme := strings.ToLower(strings.TrimSpace(arg))
+	if theme == "" {
+		current := cr.server.settings.get(c.session).Theme
+		if current == "" {
+			current = "light"
+		}
+		c.sendNotice(fmt.Sprintf("Your theme is %s. Available themes: %s", current, strings.Join(themes, ", ")))
+		return
+	}
+	if !isValidTheme(theme) {
+		c.sendError("Unknown theme, use one of: " + strings.Join(themes, ", "))
+		return
+	}
+	cr.server.settings.update(c.session, func(ss *sessionSettings) { ss.Theme = theme })
+	c.sendText(createThemeMsg(theme))
+	c.sendNotice("Theme set to " + theme)
+}
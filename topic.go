@@ -0,0 +1,101 @@
+package main
+
+// This file handles room topics. Anyone in a room can set its topic with
+// "/topic <text>", or remove it with "/topic off", unless the operator only
+// lets moderators do that with "topic_mods_only" in the config file. The
+// topic is shown under the room name, sent to everyone who joins, and is the
+// room's topic in the directory if it's listed.
+
+import (
+	"fmt"
+	"html/template"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/makeworld-the-better-one/neartalk/events"
+)
+
+// maxTopicLen is the max length of a room topic in bytes.
+const maxTopicLen = 200
+
+// sanitizeTopic returns the topic on one line, with control characters
+// removed and any bidi controls it leaves open closed.
+func sanitizeTopic(s string) string {
+	s = strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) {
+			return ' '
+		}
+		return r
+	}, strings.ToValidUTF8(s, "\uFFFD"))
+	return closeBidi(strings.Join(strings.Fields(s), " "))
+}
+
+// createTopicMsg creates the htmx swap that shows the topic under the room
+// name. An empty topic hides it.
+func createTopicMsg(topic string) string {
+	return fmt.Sprintf(`<p id="room-topic" dir="auto" hx-swap-oob="true">%s</p>`, template.HTMLEscapeString(topic))
+}
+
+// mayChangeTopic returns true if the client can change the topic, and sends
+// it an error if not.
+func (cr *chatRoom) mayChangeTopic(c *client) bool {
+	if currentConfig().TopicModsOnly && !c.moderator {
+		c.sendError("Only moderators can change the topic")
+		return false
+	}
+	return true
+}
+
+// changeTopic sets the room topic and returns the broadcast that tells the
+// room, with text as the notice.
+// It does not lock the clientsMu, callers should do that.
+func (cr *chatRoom) changeTopic(c *client, topic, text string, when time.Time) broadcast {
+	cr.topic = topic
+	cr.saveSettings()
+	s := createTopicMsg(topic) + createSpecialMsg(text, "notif")
+	return broadcast{
+		html:       s,
+		authorHTML: s + clearInputFieldMsg,
+		json: []string{
+			encodeEvent(events.TypeTopic, events.Topic{Topic: topic, Nick: plainNick(c.nick), Time: when}),
+			encodeEvent(events.TypeNotice, events.Notice{Text: text, Time: when}),
+		},
+		topic: &topic,
+	}
+}
+
+// handleTopicCmd handles "/topic <text>", "/topic off", and "/topic", which
+// shows the current topic.
+// It does not lock the clientsMu, callers should do that.
+func (cr *chatRoom) handleTopicCmd(m msg) broadcast {
+	arg := strings.TrimSpace(m.text[len("/topic"):])
+	switch arg {
+	case "":
+		if cr.topic == "" {
+			m.author.sendNotice("This room has no topic")
+		} else {
+			m.author.sendNotice(m.author.tr("The topic is: %s", cr.topic))
+		}
+		return broadcast{}
+	case "off":
+		if cr.topic == "" {
+			m.author.sendError("This room has no topic")
+			return broadcast{}
+		}
+		if !cr.mayChangeTopic(m.author) {
+			return broadcast{}
+		}
+		return cr.changeTopic(m.author, "", fmt.Sprintf("%s removed the topic", isolateNick(m.author.nick)), m.when)
+	}
+
+	if len(arg) > maxTopicLen {
+		m.author.sendError(m.author.tr("Topics can be at most %d bytes long", maxTopicLen))
+		return broadcast{}
+	}
+	if !cr.mayChangeTopic(m.author) {
+		return broadcast{}
+	}
+	topic := sanitizeTopic(arg)
+	return cr.changeTopic(m.author, topic, fmt.Sprintf("%s changed the topic to: %s", isolateNick(m.author.nick), topic), m.when)
+}
@@ -0,0 +1,20 @@
+package main
+
+import "testing"
+
+func TestSanitizeTopic(t *testing.T) {
+	tests := []struct {
+		in, want string
+	}{
+		{"Board games", "Board games"},
+		{"  one\ntwo\t\tthree  ", "one two three"},
+		{"bell\x07", "bell"},
+		{"\u202Eevil", "\u202Eevil\u202C"},
+		{"bad \xff byte", "bad \uFFFD byte"},
+	}
+	for _, tt := range tests {
+		if got := sanitizeTopic(tt.in); got != tt.want {
+			t.Errorf("sanitizeTopic(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
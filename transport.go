@@ -0,0 +1,181 @@
+package main
+
+// This file has the transport abstraction. Clients can connect over a
+// websocket, Server-Sent Events, or long polling, and each of those is a
+// transport. connect runs the client the same way whatever the transport is,
+// so rooms never need to know how a client is connected.
+//
+// The HTTP transports (SSE and long polling) can't receive messages on the
+// same request they send them on, so they register a connection ID, and the
+// client POSTs its messages to a send endpoint with that ID.
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+
+	"github.com/makeworld-the-better-one/neartalk/events"
+	"nhooyr.io/websocket"
+)
+
+// transport carries frames between the server and a single client connection.
+type transport interface {
+	// send sends a frame to the client. It returns a *writeTimeoutError if
+	// the client is too slow and should be disconnected.
+	send(ctx context.Context, text string) error
+	// received returns the channel that messages from the client arrive on.
+	received() <-chan htmxJson
+	// done returns a channel that's closed when the connection has ended.
+	done() <-chan struct{}
+	// close ends the connection, telling the client the reason if it can.
+	// It's safe to call from any goroutine, and more than once.
+	close(code websocket.StatusCode, reason string)
+	// ping checks the connection is still alive, returning an error if it
+	// isn't. It's safe to call from any goroutine.
+	ping(ctx context.Context) error
+}
+
+// wsTransport is a websocket connection.
+type wsTransport struct {
+	conn     *websocket.Conn
+	writer   *connWriter
+	incoming chan htmxJson
+	// ctx is cancelled when the connection can't be read from anymore.
+	ctx context.Context
+	// binary is true if the client asked for events as CBOR, see binary.go.
+	binary bool
+}
+
+// newWSTransport returns a transport for the websocket, and starts reading
+// messages from it. Reading stops when ctx is cancelled.
+func newWSTransport(ctx context.Context, conn *websocket.Conn) *wsTransport {
+	ctx, cancel := context.WithCancel(ctx)
+	t := &wsTransport{
+		conn:     conn,
+		writer:   &connWriter{conn: conn},
+		incoming: make(chan htmxJson, serverMsgBuffer),
+		ctx:      ctx,
+		binary:   conn.Subprotocol() == events.SubprotocolCBOR,
+	}
+	go func() {
+		defer cancel()
+		for {
+			var webMsg htmxJson
+			typ, b, err := conn.Read(ctx)
+			if err == nil {
+				err = decodeClientMsg(typ, b, t.binary, &webMsg)
+			}
+			if err != nil {
+				// Treat any error the same as it being closed
+				conn.Close(websocket.StatusPolicyViolation, "unexpected error")
+				return
+			}
+			select {
+			case t.incoming <- webMsg:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return t
+}
+
+func (t *wsTransport) send(ctx context.Context, text string) error {
+	if !t.binary {
+		return t.writer.write(ctx, websocket.MessageText, []byte(text))
+	}
+	b, err := binaryFrames.get(text)
+	if err != nil {
+		log.Printf("wsTransport.send: converting frame to CBOR: %v", err)
+		return nil
+	}
+	return t.writer.write(ctx, websocket.MessageBinary, b)
+}
+
+func (t *wsTransport) received() <-chan htmxJson {
+	return t.incoming
+}
+
+func (t *wsTransport) done() <-chan struct{} {
+	return t.ctx.Done()
+}
+
+func (t *wsTransport) close(code websocket.StatusCode, reason string) {
+	t.conn.Close(code, reason)
+}
+
+func (t *wsTransport) ping(ctx context.Context) error {
+	return t.conn.Ping(ctx)
+}
+
+// httpConn is an open connection over one of the HTTP transports, which
+// messages from the send endpoint are passed to.
+type httpConn struct {
+	// session is the session that opened the connection. Only it can send.
+	session  string
+	incoming chan htmxJson
+	// poll is the transport for long polling connections, and nil otherwise.
+	poll *pollTransport
+}
+
+// addHTTPConn registers the connection under id.
+func (cs *chatServer) addHTTPConn(id string, conn *httpConn) {
+	cs.httpConnsMu.Lock()
+	defer cs.httpConnsMu.Unlock()
+	cs.httpConns[id] = conn
+}
+
+// removeHTTPConn removes the connection registered under id.
+func (cs *chatServer) removeHTTPConn(id string) {
+	cs.httpConnsMu.Lock()
+	defer cs.httpConnsMu.Unlock()
+	delete(cs.httpConns, id)
+}
+
+// httpConnForRequest returns the connection for the "id" query parameter,
+// if it exists and was opened by the session making the request.
+func (cs *chatServer) httpConnForRequest(r *http.Request) (*httpConn, bool) {
+	cookie, err := r.Cookie(sessionCookieName)
+	if err != nil {
+		return nil, false
+	}
+	cs.httpConnsMu.Lock()
+	conn, ok := cs.httpConns[r.URL.Query().Get("id")]
+	cs.httpConnsMu.Unlock()
+	if !ok || conn.session != cookie.Value {
+		// Closed, or someone else's connection
+		return nil, false
+	}
+	return conn, true
+}
+
+// maxSendBody is the max size of a message sent to a send endpoint in bytes.
+const maxSendBody = 64 * 1024
+
+// httpSendHandler passes a message from the client to its SSE or long polling
+// connection. The body is JSON like websocket messages, see htmxJson.
+func (cs *chatServer) httpSendHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	conn, ok := cs.httpConnForRequest(r)
+	if !ok {
+		http.Error(w, "no such connection", http.StatusNotFound)
+		return
+	}
+
+	var webMsg htmxJson
+	if err := json.NewDecoder(io.LimitReader(r.Body, maxSendBody)).Decode(&webMsg); err != nil {
+		http.Error(w, "invalid JSON", http.StatusBadRequest)
+		return
+	}
+	select {
+	case conn.incoming <- webMsg:
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "sending too fast", http.StatusTooManyRequests)
+	}
+}
@@ -0,0 +1,83 @@
+package main
+
+// This file handles tripcodes, which let people prove they're the same person
+// across sessions without an account. "/nick name#secret" sets the nickname
+// to name!a1b2c3, where the part after the ! is derived from the secret. Only
+// someone who knows the secret can get the same tripcode, and nicknames set
+// without one can't contain a !, so nobody can pretend to have it.
+//
+// Tripcodes are keyed with -tripcode-key, or the admin key if that isn't
+// set, so they can't be worked out offline. Changing the key changes
+// everyone's tripcodes.
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"html/template"
+	"strings"
+)
+
+// tripcodeLen is the number of hex characters in a tripcode.
+const tripcodeLen = 6
+
+// tripcodeSep separates the nickname from the tripcode.
+const tripcodeSep = "!"
+
+// tripcode returns the tripcode for the secret.
+func tripcode(secret string) string {
+	key := tripcodeKey
+	if key == "" {
+		key = adminKey
+	}
+	mac := hmac.New(sha256.New, []byte(key))
+	mac.Write([]byte(secret))
+	return hex.EncodeToString(mac.Sum(nil))[:tripcodeLen]
+}
+
+// parseNick returns the sanitized nickname for the argument to /nick, with a
+// tripcode if it's given as name#secret. The error is meant to be shown to
+// the user.
+func parseNick(s string) (string, error) {
+	name, secret, found := strings.Cut(s, "#")
+	if !found || secret == "" {
+		name = s
+	}
+	if strings.Contains(name, tripcodeSep) {
+		return "", errors.New("Nicknames can't contain " + tripcodeSep + ", use name#secret for a tripcode")
+	}
+	nick := sanitizeNick(name)
+	if nick == "" {
+		return "", errors.New("Nickname cannot be empty")
+	}
+	if found && secret != "" {
+		nick += tripcodeSep + tripcode(secret)
+	}
+	return nick, nil
+}
+
+// nickHTML returns the sanitized nickname for use in templates, with any
+// tripcode marked so it can be styled. It's isolated from the text around it,
+// see bidi.go.
+func nickHTML(nick string) template.HTML {
+	name, trip, ok := cutTripcode(nick)
+	if !ok {
+		return template.HTML("<bdi>" + nick + "</bdi>")
+	}
+	return template.HTML("<bdi>" + name + `<span class="tripcode">` + tripcodeSep + trip + "</span></bdi>")
+}
+
+// cutTripcode splits the nickname into the name and the tripcode, returning
+// false if it doesn't have one.
+func cutTripcode(nick string) (string, string, bool) {
+	i := strings.LastIndex(nick, tripcodeSep)
+	if i < 0 || len(nick)-i-1 != tripcodeLen {
+		return nick, "", false
+	}
+	trip := nick[i+1:]
+	if _, err := hex.DecodeString(trip); err != nil {
+		return nick, "", false
+	}
+	return nick[:i], trip, true
+}
@@ -0,0 +1,50 @@
+package main
+
+import "testing"
+
+func TestParseNick(t *testing.T) {
+	defer func(k string) { tripcodeKey = k }(tripcodeKey)
+	tripcodeKey = "test key"
+
+	nick, err := parseNick("alice#hunter2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	name, trip, ok := cutTripcode(nick)
+	if !ok || name != "alice" || len(trip) != tripcodeLen {
+		t.Errorf("parseNick(alice#hunter2) = %q, want alice with a tripcode", nick)
+	}
+	if again, _ := parseNick("alice#hunter2"); again != nick {
+		t.Errorf("same secret gave %q then %q", nick, again)
+	}
+	if other, _ := parseNick("alice#hunter3"); other == nick {
+		t.Errorf("different secrets both gave %q", nick)
+	}
+
+	tests := []struct {
+		in      string
+		want    string
+		wantErr bool
+	}{
+		{"bob", "bob", false},
+		{"bob#", "bob#", false},
+		{"<b>", "&lt;b&gt;", false},
+		{"bob!" + trip, "", true},
+		{"#secret", "", true},
+	}
+	for _, tt := range tests {
+		got, err := parseNick(tt.in)
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("parseNick(%q) = %q, %v, want %q", tt.in, got, err, tt.want)
+		}
+	}
+}
+
+func TestNickHTML(t *testing.T) {
+	if got := nickHTML("bob!a1b2c3"); got != `<bdi>bob<span class="tripcode">!a1b2c3</span></bdi>` {
+		t.Errorf("nickHTML with tripcode = %q", got)
+	}
+	if got := nickHTML("bob!"); got != "<bdi>bob!</bdi>" {
+		t.Errorf("nickHTML without tripcode = %q", got)
+	}
+}
@@ -0,0 +1,106 @@
+package main
+
+// This file tracks whether clients are looking at the chat, and which
+// messages they've seen, so that the web UI can show the number of unread
+// messages in the tab title. Clients acknowledge messages by sending the ID
+// of the latest one they've seen, and become active when they look at the
+// chat, which acknowledges everything. Messages that arrive while a client is
+// active don't count as unread at all.
+
+import (
+	"fmt"
+
+	"github.com/makeworld-the-better-one/neartalk/events"
+)
+
+// maxUnreadIDs is how many unread message IDs are kept for each client. Older
+// ones are forgotten, so the count stops going up after this.
+const maxUnreadIDs = 1000
+
+// createUnreadMsg creates HTML that tells the web UI how many unread messages
+// there are.
+func createUnreadMsg(n int) string {
+	return fmt.Sprintf(`<div id="unread" data-count="%d" hx-swap-oob="true"></div>`, n)
+}
+
+// sendUnread sends the unread count to the client, in its protocol.
+func (c *client) sendUnread(n int) {
+	if c.isJSON() {
+		c.queueFrame(encodeEvent(events.TypeUnread, events.Unread{Count: n}), frameMinor)
+	} else {
+		c.queueFrame(createUnreadMsg(n), frameMinor)
+	}
+}
+
+// addUnread records that the chat message with the ID was sent to the client.
+// If the client is active it's acknowledged straight away. Otherwise the
+// unread count goes up, and the new count is returned with true.
+func (c *client) addUnread(id string) (int, bool) {
+	c.activityMu.Lock()
+	defer c.activityMu.Unlock()
+
+	if c.active {
+		if id > c.lastAck {
+			c.lastAck = id
+		}
+		return 0, false
+	}
+	c.unreadIDs = append(c.unreadIDs, id)
+	if len(c.unreadIDs) > maxUnreadIDs {
+		c.unreadIDs = c.unreadIDs[1:]
+	}
+	return len(c.unreadIDs), true
+}
+
+// ack records that the client has seen the message with the ID, and every
+// message before it. The new unread count is returned, and the bool is true
+// if the latest acknowledged message changed.
+func (c *client) ack(id string) (int, bool) {
+	c.activityMu.Lock()
+	defer c.activityMu.Unlock()
+
+	if id <= c.lastAck {
+		return len(c.unreadIDs), false
+	}
+	c.lastAck = id
+	// IDs sort in the order messages were sent, so the unread ones left are
+	// at the end
+	i := 0
+	for i < len(c.unreadIDs) && c.unreadIDs[i] <= id {
+		i++
+	}
+	c.unreadIDs = c.unreadIDs[i:]
+	return len(c.unreadIDs), true
+}
+
+// lastAckID returns the ID of the latest message the client has seen.
+func (c *client) lastAckID() string {
+	c.activityMu.Lock()
+	defer c.activityMu.Unlock()
+	return c.lastAck
+}
+
+// setActive records whether the client is looking at the chat. Becoming
+// active acknowledges all the unread messages. The unread count is returned,
+// and the bool is true if the client's activity changed.
+func (c *client) setActive(active bool) (int, bool) {
+	c.activityMu.Lock()
+	defer c.activityMu.Unlock()
+
+	changed := c.active != active
+	c.active = active
+	if active && len(c.unreadIDs) > 0 {
+		if last := c.unreadIDs[len(c.unreadIDs)-1]; last > c.lastAck {
+			c.lastAck = last
+		}
+		c.unreadIDs = nil
+	}
+	return len(c.unreadIDs), changed
+}
+
+// isActive returns whether the client is looking at the chat.
+func (c *client) isActive() bool {
+	c.activityMu.Lock()
+	defer c.activityMu.Unlock()
+	return c.active
+}
@@ -0,0 +1,30 @@
+package main
+
+import "testing"
+
+func TestUnreadAck(t *testing.T) {
+	c := &client{active: false}
+	for i, id := range []string{"01A", "01B", "01C"} {
+		if n, ok := c.addUnread(id); !ok || n != i+1 {
+			t.Fatalf("addUnread(%s) = %d, %v, want %d, true", id, n, ok, i+1)
+		}
+	}
+	if n, ok := c.ack("01B"); !ok || n != 1 {
+		t.Errorf("ack(01B) = %d, %v, want 1, true", n, ok)
+	}
+	if n, ok := c.ack("01A"); ok || n != 1 {
+		t.Errorf("ack of an older message = %d, %v, want 1, false", n, ok)
+	}
+	if n, _ := c.setActive(true); n != 0 {
+		t.Errorf("unread after becoming active = %d, want 0", n)
+	}
+	if got := c.lastAckID(); got != "01C" {
+		t.Errorf("lastAckID = %s, want 01C", got)
+	}
+	if _, ok := c.addUnread("01D"); ok {
+		t.Error("message counted as unread while active")
+	}
+	if got := c.lastAckID(); got != "01D" {
+		t.Errorf("lastAckID = %s, want 01D", got)
+	}
+}
@@ -0,0 +1,171 @@
+package main
+
+// This file handles votes to kick someone out of a room. Anyone can start one
+// with "/votekick <nick>", and everyone else agrees with "/votekick yes". If
+// most of the room agrees within kickVoteDuration, the person is disconnected
+// and can't rejoin the room for kickBlockDuration. Kicks are tracked by
+// session, and forgotten once everyone has left the room.
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/makeworld-the-better-one/neartalk/events"
+	"nhooyr.io/websocket"
+)
+
+// kickVoteDuration is how long a vote to kick someone lasts.
+const kickVoteDuration = time.Minute
+
+// kickBlockDuration is how long someone kicked by vote can't rejoin the room.
+const kickBlockDuration = 10 * time.Minute
+
+// errKicked is returned when a client joining a room was recently kicked from
+// it.
+var errKicked = errors.New("kicked from room")
+
+// kickVote is a vote in progress to kick someone from a room.
+type kickVote struct {
+	target *client
+	yes    map[*client]bool
+}
+
+// clientByNick returns the client in the room with the nickname, or nil.
+// It does not lock the clientsMu, callers should do that.
+func (cr *chatRoom) clientByNick(nick string) *client {
+	for c := range cr.clients {
+		if c.nick == nick {
+			return c
+		}
+	}
+	return nil
+}
+
+// isKicked returns true if the session was kicked from the room and can't
+// rejoin yet.
+// It does not lock the clientsMu, callers should do that.
+func (cr *chatRoom) isKicked(session string) bool {
+	until, ok := cr.kicked[session]
+	if !ok {
+		return false
+	}
+	if time.Now().After(until) {
+		delete(cr.kicked, session)
+		return false
+	}
+	return true
+}
+
+// kickVotesNeeded returns how many more votes the current kick vote needs to
+// pass, which is a majority of the people in the room.
+// It does not lock the clientsMu, callers should do that.
+func (cr *chatRoom) kickVotesNeeded() int {
+	yes := make(map[any]bool)
+	for c := range cr.kickVote.yes {
+		if _, ok := cr.clients[c]; ok {
+			yes[c.person()] = true
+		}
+	}
+	return cr.numPeople()/2 + 1 - len(yes)
+}
+
+// handleVotekickCmd handles "/votekick <nick>", and "/votekick yes" to agree
+// with the vote in progress.
+// It does not lock the clientsMu, callers should do that.
+func (cr *chatRoom) handleVotekickCmd(m msg) broadcast {
+	arg := strings.TrimSpace(m.text[len("/votekick"):])
+	if arg == "" {
+		m.author.sendError("Usage: /votekick <nick>, or /votekick yes to agree with a vote")
+		return broadcast{}
+	}
+
+	if arg == "yes" && cr.kickVote != nil {
+		for c := range cr.kickVote.yes {
+			if c.person() == m.author.person() {
+				m.author.sendError("You already voted")
+				return broadcast{}
+			}
+		}
+		cr.kickVote.yes[m.author] = true
+		return cr.countKickVote(m.when)
+	}
+
+	if cr.kickVote != nil {
+		m.author.sendError(fmt.Sprintf("There's already a vote to kick %s, send /votekick yes to agree",
+			isolateNick(cr.kickVote.target.nick)))
+		return broadcast{}
+	}
+	target := cr.clientByNick(sanitizeNick(arg))
+	if target == nil {
+		m.author.sendError("There's nobody in the room with that nickname")
+		return broadcast{}
+	}
+	if target.person() == m.author.person() {
+		m.author.sendError("You can't kick yourself, just leave")
+		return broadcast{}
+	}
+	if target.bot != nil {
+		m.author.sendError("Bots can't be kicked, ask the server operator")
+		return broadcast{}
+	}
+
+	v := &kickVote{target: target, yes: map[*client]bool{m.author: true}}
+	cr.kickVote = v
+	time.AfterFunc(kickVoteDuration, func() { cr.expireKickVote(v) })
+	b := cr.countKickVote(m.when)
+	if cr.kickVote == nil {
+		// Passed straight away
+		return b
+	}
+	return roomNotice(fmt.Sprintf("%s wants to kick %s. Send /votekick yes within a minute to agree, %d more votes are needed",
+		isolateNick(m.author.nick), isolateNick(target.nick), cr.kickVotesNeeded()), m.when)
+}
+
+// countKickVote kicks the target of the vote if enough people agreed.
+// It does not lock the clientsMu, callers should do that.
+func (cr *chatRoom) countKickVote(when time.Time) broadcast {
+	v := cr.kickVote
+	if _, ok := cr.clients[v.target]; !ok {
+		// They left already
+		cr.kickVote = nil
+		return broadcast{}
+	}
+	if needed := cr.kickVotesNeeded(); needed > 0 {
+		return roomNotice(fmt.Sprintf("%d more votes are needed to kick %s", needed, isolateNick(v.target.nick)), when)
+	}
+
+	cr.kickVote = nil
+	cr.kicked[v.target.session] = time.Now().Add(kickBlockDuration)
+	v.target.sendError("You were kicked from this room by vote")
+	for _, c := range cr.tabsOf(v.target) {
+		go c.disconnect(websocket.StatusPolicyViolation, "kicked from the room by vote")
+	}
+	return roomNotice(fmt.Sprintf("%s was kicked by vote", isolateNick(v.target.nick)), when)
+}
+
+// expireKickVote ends the vote if it's still in progress, telling the room.
+func (cr *chatRoom) expireKickVote(v *kickVote) {
+	cr.clientsMu.Lock()
+	if cr.kickVote != v {
+		cr.clientsMu.Unlock()
+		return
+	}
+	cr.kickVote = nil
+	// The nickname can change, so it's only read while locked
+	text := fmt.Sprintf("The vote to kick %s ended without enough votes", isolateNick(v.target.nick))
+	cr.clientsMu.Unlock()
+
+	now := time.Now()
+	select {
+	case cr.incoming <- msg{
+		raw:     createSpecialMsg(text, "notif"),
+		rawJSON: []string{encodeEvent(events.TypeNotice, events.Notice{Text: text, Time: now})},
+		when:    now,
+		local:   true,
+	}:
+	default:
+		// Room is busy, the notice isn't important
+	}
+}
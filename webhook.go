@@ -0,0 +1,382 @@
+package main
+
+// This file mirrors rooms into Slack or Discord channels with webhooks, like
+// an office's building room into the channel IT watches. Each webhook listed
+// under "webhooks" in the config file gets the room's chat messages, sent as
+// "nick: text":
+//
+//	"webhooks": [{"room": "203.0.113.5", "url": "https://hooks.slack.com/services/..."},
+//	    {"room": "lan", "url": "https://discord.com/api/webhooks/...", "inbound_token": "..."}]
+//
+// Mirroring is one-way unless the webhook has an inbound_token. Then messages
+// POSTed to /hooks/<inbound_token> show up in the room from "slack/nick" or
+// "discord/nick", so a Slack outgoing webhook, or a Discord bot, can send the
+// channel's messages back. It takes Slack's outgoing webhook form, or JSON
+// like Discord's webhooks: {"username": "...", "content": "..."}.
+//
+// Like the bridges, see bridge.go, encrypted messages aren't mirrored,
+// messages from the channel are dropped while nobody's in the room, and with
+// Redis only messages sent through the instance with the webhook reach it.
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"html"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+const (
+	// webhookTimeout is how long posting to a webhook can take.
+	webhookTimeout = 10 * time.Second
+	// webhookQueue is how many messages can wait to be posted to a webhook.
+	webhookQueue = 100
+	// webhookRate and webhookBurst limit how fast messages are posted, under
+	// what Slack and Discord allow.
+	webhookRate  = 1
+	webhookBurst = 5
+	// webhookMaxRetryAfter is the longest a webhook is waited for when it
+	// says it's rate limited.
+	webhookMaxRetryAfter = time.Minute
+	// minInboundTokenLen is the shortest inbound token allowed, so the URL
+	// can't be guessed.
+	minInboundTokenLen = 16
+	// maxInboundBody is the largest message POSTed to /hooks/ that's read.
+	maxInboundBody = 64 * 1024
+	// discordMaxContent is how long messages to Discord can be.
+	discordMaxContent = 2000
+)
+
+// configWebhook is a webhook in the config file.
+type configWebhook struct {
+	// Room is the key of the room, like an IP address or "#name" for a named
+	// room.
+	Room string `json:"room"`
+	URL  string `json:"url"`
+	// Kind is "slack" or "discord". It's worked out from the URL if it's
+	// empty.
+	Kind string `json:"kind"`
+	// InboundToken is the secret in the URL that sends messages back to the
+	// room, or empty if the webhook is one-way.
+	InboundToken string `json:"inbound_token"`
+}
+
+// validateWebhooks returns an error if a webhook in the config file is
+// invalid, and fills in their kinds.
+func validateWebhooks(cws []configWebhook) error {
+	tokens := make(map[string]bool)
+	for i := range cws {
+		cw := &cws[i]
+		if cw.Room == "" {
+			return fmt.Errorf("webhook %d: room is missing", i+1)
+		}
+		u, err := url.Parse(cw.URL)
+		if err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+			return fmt.Errorf("webhook %d: url must be an http or https URL", i+1)
+		}
+		if cw.Kind == "" {
+			switch host := strings.ToLower(u.Hostname()); {
+			case host == "hooks.slack.com":
+				cw.Kind = bridgeSlack
+			case host == "discord.com" || host == "discordapp.com" || strings.HasSuffix(host, ".discord.com"):
+				cw.Kind = bridgeDiscord
+			default:
+				return fmt.Errorf("webhook %d: set kind to %q or %q, it can't be worked out from the URL", i+1, bridgeSlack, bridgeDiscord)
+			}
+		}
+		if cw.Kind != bridgeSlack && cw.Kind != bridgeDiscord {
+			return fmt.Errorf("webhook %d: invalid kind %q, must be %q or %q", i+1, cw.Kind, bridgeSlack, bridgeDiscord)
+		}
+		if cw.InboundToken != "" {
+			if len(cw.InboundToken) < minInboundTokenLen || strings.ContainsAny(cw.InboundToken, "/?#% ") {
+				return fmt.Errorf("webhook %d: inbound_token must be at least %d characters, with no /?#%% or spaces", i+1, minInboundTokenLen)
+			}
+			if tokens[cw.InboundToken] {
+				return fmt.Errorf("webhook %d: inbound_token is already used", i+1)
+			}
+			tokens[cw.InboundToken] = true
+		}
+	}
+	return nil
+}
+
+// webhooks holds the webhooks in use.
+type webhooks struct {
+	cs    *chatServer
+	mu    sync.Mutex
+	hooks map[configWebhook]*webhook
+}
+
+func newWebhooks(cs *chatServer) *webhooks {
+	return &webhooks{cs: cs, hooks: make(map[configWebhook]*webhook)}
+}
+
+// setConfigured starts the webhooks from the config file that aren't in use
+// yet, and stops the ones that aren't in it anymore.
+// It holds the mutex.
+func (wh *webhooks) setConfigured(cws []configWebhook) {
+	wh.mu.Lock()
+	defer wh.mu.Unlock()
+	keep := make(map[configWebhook]bool)
+	for _, cw := range cws {
+		keep[cw] = true
+		if _, ok := wh.hooks[cw]; !ok {
+			h := newWebhook(cw)
+			wh.hooks[cw] = h
+			go h.run()
+		}
+	}
+	for cw, h := range wh.hooks {
+		if !keep[cw] {
+			h.stop()
+			delete(wh.hooks, cw)
+		}
+	}
+}
+
+// relay posts the chat message in the room with the key to the room's
+// webhooks, except ones of the kind it came from.
+// It holds the mutex.
+func (wh *webhooks) relay(key, from string, a *chatAlert) {
+	wh.mu.Lock()
+	defer wh.mu.Unlock()
+	for cw, h := range wh.hooks {
+		if cw.Room == key && cw.Kind != from {
+			h.send(plainNick(a.Nick), a.Text)
+		}
+	}
+}
+
+// webhook posts messages to one webhook, one at a time.
+type webhook struct {
+	cfg     configWebhook
+	client  *http.Client
+	limiter *rate.Limiter
+	// out holds the payloads waiting to be posted.
+	out chan []byte
+
+	done     chan struct{}
+	stopOnce sync.Once
+}
+
+func newWebhook(cfg configWebhook) *webhook {
+	return &webhook{
+		cfg:     cfg,
+		client:  &http.Client{Timeout: webhookTimeout},
+		limiter: rate.NewLimiter(webhookRate, webhookBurst),
+		out:     make(chan []byte, webhookQueue),
+		done:    make(chan struct{}),
+	}
+}
+
+// stop stops posting to the webhook. Messages still waiting are dropped.
+func (h *webhook) stop() {
+	h.stopOnce.Do(func() { close(h.done) })
+}
+
+// send queues the message to be posted. It's dropped if the webhook is too
+// far behind.
+func (h *webhook) send(nick, text string) {
+	select {
+	case h.out <- webhookPayload(h.cfg.Kind, nick, text):
+	default:
+		log.Printf("webhook: room %s is too far behind, dropping a message", h.cfg.Room)
+	}
+}
+
+// run posts the queued messages until the webhook is stopped.
+func (h *webhook) run() {
+	for {
+		var body []byte
+		select {
+		case <-h.done:
+			return
+		case body = <-h.out:
+		}
+		if !h.wait(h.limiter.Reserve().Delay()) {
+			return
+		}
+		retryAfter, err := h.post(body)
+		if retryAfter > 0 {
+			// Rate limited, so try once more when it says to
+			if !h.wait(retryAfter) {
+				return
+			}
+			_, err = h.post(body)
+		}
+		if err != nil {
+			log.Printf("webhook: room %s: %v", h.cfg.Room, err)
+		}
+	}
+}
+
+// wait waits for the duration, and returns false if the webhook was stopped
+// first.
+func (h *webhook) wait(d time.Duration) bool {
+	if d <= 0 {
+		return true
+	}
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-h.done:
+		return false
+	case <-t.C:
+		return true
+	}
+}
+
+// post posts the payload to the webhook. If it's rate limited, it returns
+// how long to wait before trying again.
+func (h *webhook) post(body []byte) (time.Duration, error) {
+	resp, err := h.client.Post(h.cfg.URL, "application/json", bytes.NewReader(body))
+	if err != nil {
+		// The URL has a secret in it, so it's left out
+		if uerr, ok := err.(*url.Error); ok {
+			err = uerr.Err
+		}
+		return 0, err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 4096))
+	if resp.StatusCode == http.StatusTooManyRequests {
+		secs, _ := strconv.ParseFloat(resp.Header.Get("Retry-After"), 64)
+		d := time.Duration(secs * float64(time.Second))
+		if d <= 0 || d > webhookMaxRetryAfter {
+			d = webhookMaxRetryAfter
+		}
+		return d, fmt.Errorf("rate limited")
+	}
+	if resp.StatusCode/100 != 2 {
+		return 0, fmt.Errorf("webhook returned %s", resp.Status)
+	}
+	return 0, nil
+}
+
+// webhookPayload returns the JSON posted to a webhook of the kind for the
+// message.
+func webhookPayload(kind, nick, text string) []byte {
+	var v interface{}
+	switch kind {
+	case bridgeSlack:
+		// Slack only needs these escaped, see
+		// https://api.slack.com/reference/surfaces/formatting#escaping
+		esc := strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;")
+		v = map[string]string{"text": "*" + esc.Replace(nick) + "*: " + esc.Replace(text)}
+	case bridgeDiscord:
+		content := "**" + nick + "**: " + text
+		if r := []rune(content); len(r) > discordMaxContent {
+			content = string(r[:discordMaxContent-1]) + "…"
+		}
+		// No allowed mentions, so messages can't ping people in Discord, like
+		// with @everyone
+		v = map[string]interface{}{
+			"content":          content,
+			"allowed_mentions": map[string][]string{"parse": {}},
+		}
+	}
+	b, _ := json.Marshal(v)
+	return b
+}
+
+// inboundMsg is a message POSTed to /hooks/ as JSON.
+type inboundMsg struct {
+	Username string `json:"username"`
+	Content  string `json:"content"`
+	// WebhookID is set on Discord messages from webhooks, which are likely
+	// the room's own messages coming back.
+	WebhookID string `json:"webhook_id"`
+}
+
+// webhookInboundHandler serves /hooks/<token>, which sends a message from a
+// channel to the room of the webhook with the inbound token.
+func (cs *chatServer) webhookInboundHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	cw, ok := inboundWebhook(currentConfig().Webhooks, strings.TrimPrefix(r.URL.Path, "/hooks/"))
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, maxInboundBody)
+
+	var nick, text string
+	if ct, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); ct == "application/json" {
+		var im inboundMsg
+		if err := json.NewDecoder(r.Body).Decode(&im); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		if im.WebhookID != "" {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		nick, text = im.Username, im.Content
+	} else {
+		if err := r.ParseForm(); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		// Slack's outgoing webhooks, which see the room's own messages too
+		if r.PostForm.Get("bot_id") != "" || r.PostForm.Get("user_id") == "USLACKBOT" {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		nick, text = r.PostForm.Get("user_name"), slackText(r.PostForm.Get("text"))
+	}
+	text = strings.TrimSpace(text)
+	if nick == "" || text == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	cs.deliverBridged(cw.Room, msg{nick: sanitizeNick(cw.Kind + "/" + nick), text: text, when: time.Now(), bridge: cw.Kind})
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// inboundWebhook returns the webhook with the inbound token, and false if
+// there isn't one.
+func inboundWebhook(cws []configWebhook, token string) (configWebhook, bool) {
+	if token == "" {
+		return configWebhook{}, false
+	}
+	for _, cw := range cws {
+		if cw.InboundToken != "" && subtle.ConstantTimeCompare([]byte(cw.InboundToken), []byte(token)) == 1 {
+			return cw, true
+		}
+	}
+	return configWebhook{}, false
+}
+
+// slackLinkRe matches Slack's links and mentions, like <https://example.com|text>.
+var slackLinkRe = regexp.MustCompile(`<([^<>|]*)(?:\|([^<>]*))?>`)
+
+// slackText turns a message from Slack into plain text. Links become their
+// URL, and mentions like <@U123|bob> become @bob.
+func slackText(s string) string {
+	s = slackLinkRe.ReplaceAllStringFunc(s, func(link string) string {
+		m := slackLinkRe.FindStringSubmatch(link)
+		switch {
+		case m[2] == "" || m[1] == "" || !strings.ContainsAny(m[1][:1], "@#!"):
+			return m[1]
+		case m[1][0] == '!':
+			// Like <!here|here>
+			return "@" + m[2]
+		}
+		return m[1][:1] + m[2]
+	})
+	return html.UnescapeString(s)
+}
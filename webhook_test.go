@@ -0,0 +1,77 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestValidateWebhooks(t *testing.T) {
+	cws := []configWebhook{
+		{Room: "lan", URL: "https://hooks.slack.com/services/T0/B0/x"},
+		{Room: "lan", URL: "https://discord.com/api/webhooks/1/x", InboundToken: "0123456789abcdef"},
+		{Room: "lan", URL: "http://localhost:8080/hook", Kind: "slack"},
+	}
+	if err := validateWebhooks(cws); err != nil {
+		t.Fatal(err)
+	}
+	if cws[0].Kind != bridgeSlack || cws[1].Kind != bridgeDiscord {
+		t.Errorf("got kinds %q and %q, want them from the URLs", cws[0].Kind, cws[1].Kind)
+	}
+	valid := configWebhook{Room: "lan", URL: "https://hooks.slack.com/services/T0/B0/x"}
+	bad := []func(*configWebhook){
+		func(cw *configWebhook) { cw.Room = "" },
+		func(cw *configWebhook) { cw.URL = "hooks.slack.com/services" },
+		func(cw *configWebhook) { cw.URL = "https://example.com/hook" },
+		func(cw *configWebhook) { cw.Kind = "teams" },
+		func(cw *configWebhook) { cw.InboundToken = "short" },
+		func(cw *configWebhook) { cw.InboundToken = "0123456789abcdef/" },
+	}
+	for i, change := range bad {
+		cw := valid
+		change(&cw)
+		if err := validateWebhooks([]configWebhook{cw}); err == nil {
+			t.Errorf("bad webhook %d was accepted", i)
+		}
+	}
+	dup := configWebhook{Room: "lan", URL: "https://hooks.slack.com/services/T0/B0/x", InboundToken: "0123456789abcdef"}
+	if err := validateWebhooks([]configWebhook{dup, dup}); err == nil {
+		t.Error("an inbound token used twice was accepted")
+	}
+}
+
+func TestWebhookPayload(t *testing.T) {
+	var slack struct{ Text string }
+	if err := json.Unmarshal(webhookPayload(bridgeSlack, "<bob>", "a & b"), &slack); err != nil {
+		t.Fatal(err)
+	}
+	if want := "*&lt;bob&gt;*: a &amp; b"; slack.Text != want {
+		t.Errorf("Slack got %q, want %q", slack.Text, want)
+	}
+	var discord struct {
+		Content         string
+		AllowedMentions *struct{ Parse []string } `json:"allowed_mentions"`
+	}
+	if err := json.Unmarshal(webhookPayload(bridgeDiscord, "<bob>", "a & b"), &discord); err != nil {
+		t.Fatal(err)
+	}
+	if want := "**<bob>**: a & b"; discord.Content != want {
+		t.Errorf("Discord got %q, want %q", discord.Content, want)
+	}
+	if discord.AllowedMentions == nil || len(discord.AllowedMentions.Parse) != 0 {
+		t.Error("Discord mentions aren't turned off")
+	}
+}
+
+func TestSlackText(t *testing.T) {
+	tests := []struct{ in, want string }{
+		{"see <https://example.com|this> &amp; that", "see https://example.com & that"},
+		{"hi <@U123|bob> in <#C123|general>", "hi @bob in #general"},
+		{"<!here|here> &lt;3", "@here <3"},
+		{"<@U123> <|odd>", "@U123 "},
+	}
+	for _, tt := range tests {
+		if got := slackText(tt.in); got != tt.want {
+			t.Errorf("slackText(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
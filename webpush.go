@@ -0,0 +1,458 @@
+package main
+
+// This file sends Web Push notifications, so people are told when someone
+// mentions them even if the chat tab isn't focused or their phone is locked.
+// It's enabled by putting a VAPID key in the config file, see
+// "neartalk vapid-keys". Browsers subscribe with POST /push/subscribe once the
+// user allows notifications, and the subscription is kept with the session's
+// settings. When a message mentions someone whose tab isn't active, the
+// mention event is encrypted (RFC 8291) and sent to the browser's push
+// service with a VAPID signature (RFC 8292), and html/push-sw.js shows it.
+//
+// There are no private messages, so mentions are the only thing pushed.
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/makeworld-the-better-one/neartalk/events"
+)
+
+const (
+	// pushTimeout is the max time sending one push notification can take.
+	pushTimeout = 10 * time.Second
+	// pushTTL is how long push services keep a notification for a browser
+	// that's offline. A mention is old news after that.
+	pushTTL = 60 * 60
+	// pushMinInterval is the min time between push notifications to one
+	// session, so a flood of mentions doesn't become a flood of
+	// notifications.
+	pushMinInterval = 10 * time.Second
+	// maxPushSubscriptions is the max number of browsers a session can
+	// subscribe. The oldest subscription is dropped for a new one.
+	maxPushSubscriptions = 5
+	// maxPushPayload is the max size of the event sent in a push. Push
+	// services accept 4096 bytes, which has to include the encryption
+	// overhead.
+	maxPushPayload = 3800
+	// maxPushBody is the max size of a subscription request body.
+	maxPushBody = 4096
+)
+
+var b64 = base64.RawURLEncoding
+
+// vapidKey is the server's key for signing pushes.
+type vapidKey struct {
+	private *ecdsa.PrivateKey
+	// public is the uncompressed public key, base64url encoded, as browsers
+	// need it for subscribing.
+	public string
+}
+
+// parseVAPIDKey parses a base64url encoded P-256 private key, as made by
+// "neartalk vapid-keys".
+func parseVAPIDKey(s string) (*vapidKey, error) {
+	d, err := b64.DecodeString(strings.TrimRight(s, "="))
+	if err != nil {
+		return nil, errors.New("vapid_private_key isn't base64url")
+	}
+	priv, err := ecdh.P256().NewPrivateKey(d)
+	if err != nil {
+		return nil, fmt.Errorf("invalid vapid_private_key: %w", err)
+	}
+	pub := priv.PublicKey().Bytes()
+	key := &ecdsa.PrivateKey{D: new(big.Int).SetBytes(d)}
+	key.PublicKey.Curve = elliptic.P256()
+	key.PublicKey.X = new(big.Int).SetBytes(pub[1:33])
+	key.PublicKey.Y = new(big.Int).SetBytes(pub[33:])
+	return &vapidKey{private: key, public: b64.EncodeToString(pub)}, nil
+}
+
+// runVAPIDKeys prints a new VAPID key for the config file, for
+// "neartalk vapid-keys".
+func runVAPIDKeys(w io.Writer) error {
+	priv, err := ecdh.P256().GenerateKey(rand.Reader)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(w, "Add these to the -config file to enable Web Push notifications:\n\n")
+	fmt.Fprintf(w, "    \"vapid_private_key\": %q,\n", b64.EncodeToString(priv.Bytes()))
+	fmt.Fprintf(w, "    \"vapid_subject\": \"mailto:you@example.com\"\n\n")
+	fmt.Fprintf(w, "Keep the key secret, and don't change it, or everyone has to allow notifications again.\n")
+	return nil
+}
+
+// pushSubscription is a browser's push subscription, as its JSON is sent by
+// the browser.
+type pushSubscription struct {
+	Endpoint string `json:"endpoint"`
+	Keys     struct {
+		// P256dh is the browser's public key, base64url encoded.
+		P256dh string `json:"p256dh"`
+		// Auth is the authentication secret, base64url encoded.
+		Auth string `json:"auth"`
+	} `json:"keys"`
+}
+
+// validate checks the subscription can be used.
+func (ps *pushSubscription) validate() error {
+	u, err := url.Parse(ps.Endpoint)
+	if err != nil || u.Scheme != "https" || u.Host == "" {
+		return errors.New("endpoint must be an https URL")
+	}
+	pub, err := b64.DecodeString(strings.TrimRight(ps.Keys.P256dh, "="))
+	if err != nil {
+		return errors.New("invalid p256dh key")
+	}
+	if _, err := ecdh.P256().NewPublicKey(pub); err != nil {
+		return errors.New("invalid p256dh key")
+	}
+	auth, err := b64.DecodeString(strings.TrimRight(ps.Keys.Auth, "="))
+	if err != nil || len(auth) != 16 {
+		return errors.New("invalid auth secret")
+	}
+	return nil
+}
+
+// hkdf derives a key of the given length, which can be at most 32 bytes, as
+// in RFC 5869.
+func hkdf(salt, ikm, info []byte, length int) []byte {
+	mac := hmac.New(sha256.New, salt)
+	mac.Write(ikm)
+	prk := mac.Sum(nil)
+	mac = hmac.New(sha256.New, prk)
+	mac.Write(info)
+	mac.Write([]byte{1})
+	return mac.Sum(nil)[:length]
+}
+
+// encryptPush encrypts the payload for the subscription, using the
+// aes128gcm content encoding from RFC 8291.
+func encryptPush(ps *pushSubscription, payload []byte) ([]byte, error) {
+	uaPubBytes, _ := b64.DecodeString(strings.TrimRight(ps.Keys.P256dh, "="))
+	authSecret, _ := b64.DecodeString(strings.TrimRight(ps.Keys.Auth, "="))
+	uaPub, err := ecdh.P256().NewPublicKey(uaPubBytes)
+	if err != nil {
+		return nil, err
+	}
+	asPriv, err := ecdh.P256().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	secret, err := asPriv.ECDH(uaPub)
+	if err != nil {
+		return nil, err
+	}
+	asPub := asPriv.PublicKey().Bytes()
+
+	keyInfo := append([]byte("WebPush: info\x00"), uaPubBytes...)
+	keyInfo = append(keyInfo, asPub...)
+	ikm := hkdf(authSecret, secret, keyInfo, 32)
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	cek := hkdf(salt, ikm, []byte("Content-Encoding: aes128gcm\x00"), 16)
+	nonce := hkdf(salt, ikm, []byte("Content-Encoding: nonce\x00"), 12)
+
+	block, err := aes.NewCipher(cek)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	// A single record, ended with the last record delimiter
+	plain := append(append([]byte(nil), payload...), 2)
+
+	var b bytes.Buffer
+	b.Write(salt)
+	binary.Write(&b, binary.BigEndian, uint32(4096))
+	b.WriteByte(byte(len(asPub)))
+	b.Write(asPub)
+	b.Write(gcm.Seal(nil, nonce, plain, nil))
+	return b.Bytes(), nil
+}
+
+// vapidAuth returns the Authorization header for a push to the endpoint,
+// with a JWT signed by the key.
+func vapidAuth(key *vapidKey, subject, endpoint string) (string, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return "", err
+	}
+	header := b64.EncodeToString([]byte(`{"typ":"JWT","alg":"ES256"}`))
+	claims, err := json.Marshal(map[string]interface{}{
+		"aud": u.Scheme + "://" + u.Host,
+		"exp": time.Now().Add(12 * time.Hour).Unix(),
+		"sub": subject,
+	})
+	if err != nil {
+		return "", err
+	}
+	unsigned := header + "." + b64.EncodeToString(claims)
+	hash := sha256.Sum256([]byte(unsigned))
+	r, s, err := ecdsa.Sign(rand.Reader, key.private, hash[:])
+	if err != nil {
+		return "", err
+	}
+	// JWTs use the raw 64 byte signature, not ASN.1
+	sig := make([]byte, 64)
+	r.FillBytes(sig[:32])
+	s.FillBytes(sig[32:])
+	return fmt.Sprintf("vapid t=%s.%s, k=%s", unsigned, b64.EncodeToString(sig), key.public), nil
+}
+
+// errPushGone means the subscription has expired or was removed by the user,
+// and should be forgotten.
+var errPushGone = errors.New("push subscription is gone")
+
+// pushClient is the HTTP client used for pushes. The endpoints come from
+// browsers, so like link previews it refuses to connect to non-public
+// addresses, and it doesn't follow redirects.
+var pushClient = &http.Client{
+	Timeout: pushTimeout,
+	Transport: &http.Transport{
+		Proxy:                 nil,
+		DialContext:           publicOnlyDial,
+		TLSHandshakeTimeout:   pushTimeout,
+		ResponseHeaderTimeout: pushTimeout,
+		MaxIdleConns:          10,
+		IdleConnTimeout:       30 * time.Second,
+	},
+	CheckRedirect: func(req *http.Request, via []*http.Request) error {
+		return http.ErrUseLastResponse
+	},
+}
+
+// sendPush sends the payload to the subscription.
+func sendPush(key *vapidKey, subject string, ps *pushSubscription, payload []byte) error {
+	body, err := encryptPush(ps, payload)
+	if err != nil {
+		return err
+	}
+	auth, err := vapidAuth(key, subject, ps.Endpoint)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), pushTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, ps.Endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", auth)
+	req.Header.Set("Content-Encoding", "aes128gcm")
+	req.Header.Set("Content-Type", "application/octet-stream")
+	req.Header.Set("TTL", fmt.Sprint(pushTTL))
+	req.Header.Set("Urgency", "high")
+	resp, err := pushClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	switch {
+	case resp.StatusCode == http.StatusNotFound || resp.StatusCode == http.StatusGone:
+		return errPushGone
+	case resp.StatusCode >= 300:
+		return fmt.Errorf("push service returned status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// pushPayload returns the mention event to push, with the text shortened if
+// it's too big.
+func pushPayload(mentionJSON string) []byte {
+	if len(mentionJSON) <= maxPushPayload {
+		return []byte(mentionJSON)
+	}
+	var e events.Envelope
+	var m events.Mention
+	if json.Unmarshal([]byte(mentionJSON), &e) != nil || json.Unmarshal(e.Data, &m) != nil {
+		return nil
+	}
+	m.Text = shortText(m.Text)
+	return []byte(encodeEvent(events.TypeMention, m))
+}
+
+// pusher sends push notifications, and remembers when each session last got
+// one.
+type pusher struct {
+	cs *chatServer
+	mu sync.Mutex
+	// last is when each session was last sent a push.
+	last map[string]time.Time
+}
+
+// pushEnabled returns true if the config has a VAPID key.
+func pushEnabled() bool {
+	return currentConfig().vapid != nil
+}
+
+// push sends the mention event to every browser the session subscribed,
+// unless it was sent one too recently. Subscriptions that are gone are
+// forgotten. It doesn't block.
+func (p *pusher) push(session, mentionJSON string) {
+	c := currentConfig()
+	if c.vapid == nil {
+		return
+	}
+	subs := p.cs.settings.get(session).Push
+	if len(subs) == 0 {
+		return
+	}
+	p.mu.Lock()
+	if time.Since(p.last[session]) < pushMinInterval {
+		p.mu.Unlock()
+		return
+	}
+	p.last[session] = time.Now()
+	for s, t := range p.last {
+		if time.Since(t) > pushMinInterval {
+			delete(p.last, s)
+		}
+	}
+	p.mu.Unlock()
+
+	payload := pushPayload(mentionJSON)
+	if payload == nil {
+		return
+	}
+	for i := range subs {
+		go func(ps pushSubscription) {
+			err := sendPush(c.vapid, c.VAPIDSubject, &ps, payload)
+			if errors.Is(err, errPushGone) {
+				p.cs.settings.update(session, func(ss *sessionSettings) { ss.removePush(ps.Endpoint) })
+			} else if err != nil {
+				log.Printf("pusher.push: %v", err)
+			}
+		}(subs[i])
+	}
+}
+
+// removePush removes the subscription with the endpoint, if there is one.
+// The slice is copied rather than changed in place, since copies of the
+// settings from settingsStore.get share it.
+func (ss *sessionSettings) removePush(endpoint string) {
+	var kept []pushSubscription
+	for _, ps := range ss.Push {
+		if ps.Endpoint != endpoint {
+			kept = append(kept, ps)
+		}
+	}
+	ss.Push = kept
+}
+
+// pushMentions sends push notifications to the people mentioned in the
+// broadcast whose chat isn't active, unless they turned notifications off.
+// author is the client that sent the message, or nil if it came from another
+// instance.
+// It does not lock the clientsMu, callers should do that.
+func (cr *chatRoom) pushMentions(b broadcast, author *client) {
+	if b.alert == nil || len(b.mentioned) == 0 || !pushEnabled() {
+		return
+	}
+	// A session with any active tab in the room is already looking
+	active := make(map[string]bool)
+	var sessions []string
+	for c := range cr.clients {
+		if c.isActive() {
+			active[c.session] = true
+		}
+		if c != author && containsNick(b.mentioned, c.nick) && !c.isIgnoring(author) &&
+			c.notifyPrefs().wantsAlert(true) {
+			sessions = append(sessions, c.session)
+		}
+	}
+	var mentionJSON string
+	for _, s := range sessions {
+		if !active[s] {
+			if mentionJSON == "" {
+				mentionJSON = createMentionEvent(b.alert)
+			}
+			cr.server.pusher.push(s, mentionJSON)
+		}
+	}
+}
+
+// pushKeyHandler gives browsers the public VAPID key to subscribe with.
+func pushKeyHandler(w http.ResponseWriter, r *http.Request) {
+	c := currentConfig()
+	if c.vapid == nil {
+		http.NotFound(w, r)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]string{"public_key": c.vapid.public})
+}
+
+// pushSubscribeHandler adds the push subscription in the body to the
+// session.
+func (cs *chatServer) pushSubscribeHandler(w http.ResponseWriter, r *http.Request) {
+	if !pushEnabled() {
+		http.NotFound(w, r)
+		return
+	}
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var ps pushSubscription
+	if err := json.NewDecoder(io.LimitReader(r.Body, maxPushBody)).Decode(&ps); err != nil {
+		http.Error(w, "invalid JSON body", http.StatusBadRequest)
+		return
+	}
+	if err := ps.validate(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	session := getSession(w, r)
+	cs.settings.update(session, func(ss *sessionSettings) {
+		ss.removePush(ps.Endpoint)
+		ss.Push = append(ss.Push, ps)
+		if len(ss.Push) > maxPushSubscriptions {
+			ss.Push = ss.Push[len(ss.Push)-maxPushSubscriptions:]
+		}
+	})
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// pushUnsubscribeHandler removes the push subscription with the endpoint in
+// the body from the session.
+func (cs *chatServer) pushUnsubscribeHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var ps pushSubscription
+	if err := json.NewDecoder(io.LimitReader(r.Body, maxPushBody)).Decode(&ps); err != nil {
+		http.Error(w, "invalid JSON body", http.StatusBadRequest)
+		return
+	}
+	session := getSession(w, r)
+	cs.settings.update(session, func(ss *sessionSettings) { ss.removePush(ps.Endpoint) })
+	w.WriteHeader(http.StatusNoContent)
+}
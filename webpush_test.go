@@ -0,0 +1,125 @@
+package main
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"math/big"
+	"strings"
+	"testing"
+)
+
+// testPushSubscription makes a subscription like a browser would, returning
+// the browser's private key and auth secret too.
+func testPushSubscription(t *testing.T, endpoint string) (*pushSubscription, *ecdh.PrivateKey, []byte) {
+	t.Helper()
+	priv, err := ecdh.P256().GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	auth := make([]byte, 16)
+	rand.Read(auth)
+	ps := &pushSubscription{Endpoint: endpoint}
+	ps.Keys.P256dh = b64.EncodeToString(priv.PublicKey().Bytes())
+	ps.Keys.Auth = b64.EncodeToString(auth)
+	return ps, priv, auth
+}
+
+// decryptPush decrypts a push body like a browser would.
+func decryptPush(t *testing.T, body []byte, priv *ecdh.PrivateKey, auth []byte) []byte {
+	t.Helper()
+	salt, rs, idLen := body[:16], binary.BigEndian.Uint32(body[16:20]), int(body[20])
+	asPubBytes := body[21 : 21+idLen]
+	if rs != 4096 {
+		t.Errorf("record size = %d", rs)
+	}
+	asPub, err := ecdh.P256().NewPublicKey(asPubBytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	secret, err := priv.ECDH(asPub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyInfo := append(append([]byte("WebPush: info\x00"), priv.PublicKey().Bytes()...), asPubBytes...)
+	ikm := hkdf(auth, secret, keyInfo, 32)
+	cek := hkdf(salt, ikm, []byte("Content-Encoding: aes128gcm\x00"), 16)
+	nonce := hkdf(salt, ikm, []byte("Content-Encoding: nonce\x00"), 12)
+	block, _ := aes.NewCipher(cek)
+	gcm, _ := cipher.NewGCM(block)
+	plain, err := gcm.Open(nil, nonce, body[21+idLen:], nil)
+	if err != nil {
+		t.Fatalf("decrypting push: %v", err)
+	}
+	if plain[len(plain)-1] != 2 {
+		t.Errorf("push doesn't end with the last record delimiter")
+	}
+	return plain[:len(plain)-1]
+}
+
+func TestEncryptPush(t *testing.T) {
+	ps, priv, auth := testPushSubscription(t, "https://push.example.com/abc")
+	if err := ps.validate(); err != nil {
+		t.Fatal(err)
+	}
+	body, err := encryptPush(ps, []byte("hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := decryptPush(t, body, priv, auth); string(got) != "hello" {
+		t.Errorf("decrypted push = %q", got)
+	}
+}
+
+func TestPushSubscriptionValidate(t *testing.T) {
+	ps, _, _ := testPushSubscription(t, "http://push.example.com/abc")
+	if ps.validate() == nil {
+		t.Error("http endpoint was accepted")
+	}
+	ps.Endpoint = "https://push.example.com/abc"
+	ps.Keys.Auth = "short"
+	if ps.validate() == nil {
+		t.Error("short auth secret was accepted")
+	}
+}
+
+func TestVAPIDAuth(t *testing.T) {
+	var out bytes.Buffer
+	if err := runVAPIDKeys(&out); err != nil {
+		t.Fatal(err)
+	}
+	_, rest, _ := strings.Cut(out.String(), `"vapid_private_key": "`)
+	encoded, _, _ := strings.Cut(rest, `"`)
+	key, err := parseVAPIDKey(encoded)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	auth, err := vapidAuth(key, "mailto:a@example.com", "https://push.example.com/abc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	jwt, k, ok := strings.Cut(strings.TrimPrefix(auth, "vapid t="), ", k=")
+	if !ok || k != key.public {
+		t.Fatalf("Authorization header = %q", auth)
+	}
+	i := strings.LastIndexByte(jwt, '.')
+	sig, err := b64.DecodeString(jwt[i+1:])
+	if err != nil || len(sig) != 64 {
+		t.Fatalf("bad signature %q", jwt[i+1:])
+	}
+	hash := sha256.Sum256([]byte(jwt[:i]))
+	r, s := new(big.Int).SetBytes(sig[:32]), new(big.Int).SetBytes(sig[32:])
+	if !ecdsa.Verify(&key.private.PublicKey, hash[:], r, s) {
+		t.Error("VAPID signature doesn't verify")
+	}
+	claims, _ := b64.DecodeString(strings.Split(jwt, ".")[1])
+	if !strings.Contains(string(claims), `"aud":"https://push.example.com"`) {
+		t.Errorf("claims = %s", claims)
+	}
+}
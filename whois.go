@@ -0,0 +1,83 @@
+package main
+
+// This file has the /users and /whois commands, which tell whoever sends them
+// who's in the room. They're meant for clients without a user list, like
+// terminal clients. /whois only shares what the user list already shows,
+// plus when the person joined and how many messages they've sent, never
+// anything about their address or session.
+
+import (
+	"strings"
+	"time"
+)
+
+// userTags returns what the user list shows about the user, in the client's
+// language.
+func userTags(c *client, u roomUser) []string {
+	var tags []string
+	if u.bot {
+		tags = append(tags, c.tr("bot"))
+	}
+	if u.mod {
+		tags = append(tags, c.tr("moderator"))
+	}
+	if u.guest {
+		tags = append(tags, c.tr("guest"))
+	}
+	if u.away && u.awayReason != "" {
+		tags = append(tags, c.tr("away: %s", u.awayReason))
+	} else if u.away {
+		tags = append(tags, c.tr("away"))
+	} else if u.idle {
+		tags = append(tags, c.tr("idle"))
+	}
+	return tags
+}
+
+// handleUsersCmd handles /users, which lists everyone in the room.
+// It does not lock the clientsMu, callers should do that.
+func (cr *chatRoom) handleUsersCmd(c *client) {
+	users := cr.users()
+	names := make([]string, len(users))
+	for i, u := range users {
+		names[i] = isolateNick(u.nick)
+		if tags := userTags(c, u); len(tags) > 0 {
+			names[i] += " (" + strings.Join(tags, ", ") + ")"
+		}
+	}
+	c.sendNotice(c.tr("%d people here: %s", len(users), strings.Join(names, ", ")))
+}
+
+// handleWhoisCmd handles "/whois <nick>".
+// It does not lock the clientsMu, callers should do that.
+func (cr *chatRoom) handleWhoisCmd(c *client, arg string) {
+	nick := sanitizeNick(arg)
+	if nick == "" {
+		c.sendError(c.tr("Usage: %s <nick>", "/whois"))
+		return
+	}
+	var user *roomUser
+	for _, u := range cr.users() {
+		if u.nick == nick {
+			user = &u
+			break
+		}
+	}
+	if user == nil {
+		c.sendError("There's nobody in the room with that nickname")
+		return
+	}
+
+	var info []string
+	if target := cr.clientByNick(nick); target != nil {
+		info = append(info,
+			c.tr("joined %s ago", c.tr(roundDuration(time.Since(target.joined)))),
+			c.tr("%d messages sent", target.msgCount),
+		)
+	} else {
+		// Other instances only share their user lists
+		info = append(info, c.tr("connected to another server"))
+	}
+	info = append(info, userTags(c, *user)...)
+	c.sendNotice(isolateNick(nick) + ": " + strings.Join(info, ", "))
+}
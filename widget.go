@@ -0,0 +1,44 @@
+package main
+
+// This file serves the embeddable widget at /widget, a minimal chat page meant
+// to be put in an iframe on another site, like a venue's intranet or event
+// page. Only the origins in the -widget-origins flag can embed it. The widget
+// talks to the page embedding it with postMessage, see html/widget.js
+// for the messages.
+
+import (
+	"fmt"
+	"net/http"
+)
+
+// widgetOriginList returns the origins allowed to embed the widget. It
+// returns nil if the widget is disabled.
+func widgetOriginList() []string {
+	return originList(widgetOrigins)
+}
+
+// validateWidgetOrigins returns an error if the -widget-origins flag is
+// invalid. Every origin must be "*" or a scheme and host, like
+// "https://example.com".
+func validateWidgetOrigins() error {
+	return validateOrigins("-widget-origins", widgetOrigins)
+}
+
+// widgetHandler serves the widget page, with a Content-Security-Policy that
+// lets the allowed origins embed it, as well as any in -frame-ancestors.
+func (cs *chatServer) widgetHandler(w http.ResponseWriter, r *http.Request) {
+	origins := widgetOriginList()
+	if len(origins) == 0 {
+		// Widget is disabled
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Security-Policy", contentSecurityPolicy(append(frameAncestorList(), origins...)))
+	if !cs.challengeGate(w, r) {
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	fmt.Fprint(w, renderTemplate("widget.html", struct {
+		Origins []string
+	}{origins}))
+}
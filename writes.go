@@ -0,0 +1,90 @@
+package main
+
+// This file handles writing messages to websocket clients. Phones on bad
+// networks often stall for a few seconds, so a write that times out is given
+// another chance instead of dropping the client right away. Clients are only
+// disconnected when writes keep timing out, and the number of timeouts is shown
+// on the admin page so admins can tell when the network is the problem.
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sync/atomic"
+	"time"
+
+	"nhooyr.io/websocket"
+)
+
+// writeTimeoutDuration is how long a single attempt at a write can take.
+const writeTimeoutDuration = 5 * time.Second
+
+// maxWriteFailures is how many writes in a row can need a retry before the
+// client is disconnected.
+const maxWriteFailures = 3
+
+// writeTimeouts counts every write attempt that has timed out since the
+// server started.
+var writeTimeouts atomic.Int64
+
+// writeTimeoutError is returned when a client is too slow to write to, and
+// should be disconnected.
+type writeTimeoutError struct {
+	reason string
+}
+
+func (e *writeTimeoutError) Error() string {
+	return e.reason
+}
+
+// connWriter writes messages to a websocket, keeping track of failed writes.
+//
+// Cancelling a write closes the whole websocket connection, so writes that
+// time out aren't cancelled. Instead they are waited on for one more timeout
+// period, which is the retry.
+type connWriter struct {
+	conn *websocket.Conn
+	// failures is how many writes in a row have needed a retry.
+	failures int
+}
+
+// write writes a message of the type to the websocket. It returns a *writeTimeoutError if the
+// write didn't finish after being retried, or if too many writes in a row
+// have needed a retry. The write is only cancelled when ctx is.
+func (w *connWriter) write(ctx context.Context, typ websocket.MessageType, b []byte) error {
+	done := make(chan error, 1)
+	go func() {
+		done <- w.conn.Write(ctx, typ, b)
+	}()
+
+	timer := time.NewTimer(writeTimeoutDuration)
+	defer timer.Stop()
+	retried := false
+	for {
+		select {
+		case err := <-done:
+			if err != nil {
+				return err
+			}
+			if !retried {
+				w.failures = 0
+				return nil
+			}
+			w.failures++
+			if w.failures >= maxWriteFailures {
+				return &writeTimeoutError{fmt.Sprintf("writes timed out %d times in a row", w.failures)}
+			}
+			return nil
+		case <-timer.C:
+			writeTimeouts.Add(1)
+			if retried {
+				return &writeTimeoutError{fmt.Sprintf("write still not done after %v", 2*writeTimeoutDuration)}
+			}
+			log.Printf("connWriter.write: write timed out after %v, retrying", writeTimeoutDuration)
+			retried = true
+			timer.Reset(writeTimeoutDuration)
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
@@ -0,0 +1,663 @@
+package main
+
+// This file is the XMPP gateway, which lets people join rooms as XMPP
+// multi-user chats (XEP-0045) with the XMPP client they already use. NearTalk
+// connects to the operator's XMPP server as a component (XEP-0114), which
+// gives it a domain of its own, and each room listed in the config file
+// becomes a MUC on that domain:
+//
+//	"xmpp_gateway": {"server": "localhost:5347", "domain": "chat.example.com",
+//	    "secret": "...", "rooms": {"lan": "lan", "games": "#games"}}
+//
+// Here, joining lan@chat.example.com with an XMPP client joins the "lan"
+// room. The rooms are listed explicitly, since whoever can use the XMPP
+// server can join them from anywhere, like a room invite that doesn't
+// expire.
+//
+// People in the room show up as occupants of the MUC, and people on XMPP
+// send messages to the room from "xmpp/nick", with notices when they join and
+// leave. Like the other bridges, see bridge.go, messages only reach the room
+// while somebody is in it, and the gateway follows the config file when it's
+// reloaded. Only messages to the whole room are supported, not private
+// messages, and the MUC is only as persistent as the room.
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// xmppNickPrefix is added to the nicknames of people on XMPP in the room.
+	xmppNickPrefix = bridgeXMPP + "/"
+	// xmppDialTimeout is how long connecting and logging in to the XMPP
+	// server can take.
+	xmppDialTimeout = 30 * time.Second
+	// xmppKeepalive is how often a space is sent to keep the connection
+	// open.
+	xmppKeepalive = time.Minute
+	// xmppMaxBackoff is the longest wait between reconnecting.
+	xmppMaxBackoff = 5 * time.Minute
+	// xmppQueue is how many stanzas can wait to be sent.
+	xmppQueue = 256
+)
+
+// XML namespaces the gateway uses
+const (
+	xmlnsComponent = "jabber:component:accept"
+	xmlnsStreams   = "http://etherx.jabber.org/streams"
+	xmlnsStanzas   = "urn:ietf:params:xml:ns:xmpp-stanzas"
+	xmlnsMUC       = "http://jabber.org/protocol/muc"
+	xmlnsMUCUser   = "http://jabber.org/protocol/muc#user"
+	xmlnsDiscoInfo = "http://jabber.org/protocol/disco#info"
+	xmlnsDiscoItem = "http://jabber.org/protocol/disco#items"
+)
+
+// configXMPPGateway is the XMPP gateway in the config file.
+type configXMPPGateway struct {
+	// Server is the host and port of the XMPP server's component port.
+	Server string `json:"server"`
+	// Domain is the component's domain, and Secret is the password the XMPP
+	// server has for it.
+	Domain string `json:"domain"`
+	Secret string `json:"secret"`
+	// Rooms maps the MUC names to the keys of the rooms they join.
+	Rooms map[string]string `json:"rooms"`
+}
+
+// validateXMPPGateway returns an error if the XMPP gateway in the config file
+// is invalid. It can be nil.
+func validateXMPPGateway(cg *configXMPPGateway) error {
+	if cg == nil {
+		return nil
+	}
+	if _, _, err := net.SplitHostPort(cg.Server); err != nil {
+		return errors.New("xmpp_gateway: server must be a host and port, like localhost:5347")
+	}
+	if cg.Domain == "" || strings.ContainsAny(cg.Domain, "@/ ") {
+		return fmt.Errorf("xmpp_gateway: invalid domain %q", cg.Domain)
+	}
+	if cg.Secret == "" {
+		return errors.New("xmpp_gateway: secret is missing")
+	}
+	if len(cg.Rooms) == 0 {
+		return errors.New("xmpp_gateway: no rooms are listed")
+	}
+	for name, key := range cg.Rooms {
+		if name == "" || name != strings.ToLower(name) || strings.ContainsAny(name, "\"&'/:<>@ ") {
+			return fmt.Errorf("xmpp_gateway: invalid room name %q, it must be lowercase with no spaces or \"&'/:<>@", name)
+		}
+		if key == "" {
+			return fmt.Errorf("xmpp_gateway: room %s has no room key", name)
+		}
+	}
+	return nil
+}
+
+// xmppGateway runs the gateway from the config file, if there is one.
+type xmppGateway struct {
+	cs *chatServer
+	mu sync.Mutex
+	// cfg is the running gateway's config, and conn is its connection, or
+	// nil if there's no gateway.
+	cfg  *configXMPPGateway
+	conn *xmppConn
+}
+
+func newXMPPGateway(cs *chatServer) *xmppGateway {
+	return &xmppGateway{cs: cs}
+}
+
+// setConfigured starts the gateway from the config file, restarting it if
+// its config changed, or stops it if it was removed.
+// It holds the mutex.
+func (xg *xmppGateway) setConfigured(cg *configXMPPGateway) {
+	xg.mu.Lock()
+	defer xg.mu.Unlock()
+	if reflect.DeepEqual(xg.cfg, cg) {
+		return
+	}
+	if xg.conn != nil {
+		xg.conn.stop()
+		xg.conn = nil
+	}
+	xg.cfg = cg
+	if cg != nil {
+		xg.conn = newXMPPConn(xg.cs, *cg)
+		go xg.conn.run()
+	}
+}
+
+// relay passes the chat message in the room with the key on to its MUCs.
+// It holds the mutex.
+func (xg *xmppGateway) relay(key string, a *chatAlert) {
+	xg.mu.Lock()
+	defer xg.mu.Unlock()
+	if xg.conn != nil {
+		xg.conn.relay(key, plainNick(a.Nick), a.Text)
+	}
+}
+
+// relayPresence tells the occupants of the room's MUCs that someone joined or
+// left the room with the key.
+// It holds the mutex.
+func (xg *xmppGateway) relayPresence(key, nick string, joined bool) {
+	xg.mu.Lock()
+	defer xg.mu.Unlock()
+	if xg.conn != nil {
+		xg.conn.relayPresence(key, nick, joined)
+	}
+}
+
+// xmppStanza is a stanza received from the XMPP server, with the parts that
+// are used.
+type xmppStanza struct {
+	XMLName xml.Name
+	From    string `xml:"from,attr"`
+	To      string `xml:"to,attr"`
+	Type    string `xml:"type,attr"`
+	ID      string `xml:"id,attr"`
+	Body    string `xml:"body"`
+	// Query is the child of an iq.
+	Query *struct {
+		XMLName xml.Name
+	} `xml:"query"`
+}
+
+// xmppConn is the component connection to the XMPP server, and the state of
+// the MUCs.
+type xmppConn struct {
+	cs  *chatServer
+	cfg configXMPPGateway
+	// out holds the stanzas waiting to be sent.
+	out chan string
+
+	done     chan struct{}
+	stopOnce sync.Once
+	// mu protects conn, the current connection, and occupants.
+	mu   sync.Mutex
+	conn net.Conn
+	// occupants holds the nicknames of the people in each MUC from XMPP, by
+	// MUC name and then full JID.
+	occupants map[string]map[string]string
+}
+
+func newXMPPConn(cs *chatServer, cfg configXMPPGateway) *xmppConn {
+	return &xmppConn{
+		cs:        cs,
+		cfg:       cfg,
+		out:       make(chan string, xmppQueue),
+		done:      make(chan struct{}),
+		occupants: make(map[string]map[string]string),
+	}
+}
+
+// stop disconnects the gateway for good.
+func (xc *xmppConn) stop() {
+	xc.stopOnce.Do(func() {
+		close(xc.done)
+		xc.mu.Lock()
+		if xc.conn != nil {
+			xc.conn.Close()
+		}
+		xc.mu.Unlock()
+	})
+}
+
+// run connects to the XMPP server and reconnects whenever the connection
+// drops, until the gateway is stopped.
+func (xc *xmppConn) run() {
+	backoff := time.Second
+	for {
+		start := time.Now()
+		err := xc.session()
+		select {
+		case <-xc.done:
+			return
+		default:
+		}
+		if time.Since(start) > xmppMaxBackoff {
+			// It was working for a while
+			backoff = time.Second
+		}
+		log.Printf("xmppConn: %s on %s: %v, reconnecting in %v", xc.cfg.Domain, xc.cfg.Server, err, backoff)
+		select {
+		case <-xc.done:
+			return
+		case <-time.After(backoff):
+		}
+		if backoff *= 2; backoff > xmppMaxBackoff {
+			backoff = xmppMaxBackoff
+		}
+	}
+}
+
+// session connects and logs in to the XMPP server, and handles stanzas until
+// the connection drops. Everyone on XMPP has left the MUCs once it returns,
+// as their server tells them when it can't reach the gateway.
+func (xc *xmppConn) session() error {
+	conn, err := net.DialTimeout("tcp", xc.cfg.Server, xmppDialTimeout)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	xc.mu.Lock()
+	xc.conn = conn
+	xc.mu.Unlock()
+	defer xc.clearOccupants()
+	select {
+	case <-xc.done:
+		// Stopped while connecting
+		return nil
+	default:
+	}
+
+	// Log in, see XEP-0114
+	conn.SetDeadline(time.Now().Add(xmppDialTimeout))
+	fmt.Fprintf(conn, `<stream:stream xmlns='%s' xmlns:stream='%s' to='%s'>`, xmlnsComponent, xmlnsStreams, xmlEscape(xc.cfg.Domain))
+	d := xml.NewDecoder(conn)
+	var streamID string
+	for streamID == "" {
+		se, err := nextStartElement(d)
+		if err != nil {
+			return err
+		}
+		if se.Name.Local != "stream" {
+			return fmt.Errorf("unexpected <%s> at the start of the stream", se.Name.Local)
+		}
+		for _, a := range se.Attr {
+			if a.Name.Local == "id" {
+				streamID = a.Value
+			}
+		}
+		if streamID == "" {
+			return errors.New("the stream has no ID")
+		}
+	}
+	sum := sha1.Sum([]byte(streamID + xc.cfg.Secret))
+	fmt.Fprintf(conn, "<handshake>%s</handshake>", hex.EncodeToString(sum[:]))
+	se, err := nextStartElement(d)
+	if err != nil {
+		return err
+	}
+	if se.Name.Local != "handshake" {
+		return errors.New("the XMPP server refused the secret")
+	}
+	d.Skip()
+	conn.SetDeadline(time.Time{})
+	log.Printf("xmppConn: connected to %s as %s", xc.cfg.Server, xc.cfg.Domain)
+
+	stopWriter := make(chan struct{})
+	defer close(stopWriter)
+	go xc.writeLoop(conn, stopWriter)
+
+	for {
+		se, err := nextStartElement(d)
+		if err != nil {
+			return err
+		}
+		if se.Name.Local == "error" && se.Name.Space == xmlnsStreams {
+			return errors.New("stream error from the XMPP server")
+		}
+		var s xmppStanza
+		if err := d.DecodeElement(&s, &se); err != nil {
+			return err
+		}
+		switch s.XMLName.Local {
+		case "presence":
+			xc.handlePresence(s)
+		case "message":
+			xc.handleMessage(s)
+		case "iq":
+			xc.handleIQ(s)
+		}
+	}
+}
+
+// nextStartElement returns the next start element from the decoder, or an
+// error if the stream ended.
+func nextStartElement(d *xml.Decoder) (xml.StartElement, error) {
+	for {
+		t, err := d.Token()
+		if err != nil {
+			return xml.StartElement{}, err
+		}
+		switch t := t.(type) {
+		case xml.StartElement:
+			return t, nil
+		case xml.EndElement:
+			return xml.StartElement{}, io.EOF
+		}
+	}
+}
+
+// writeLoop sends the waiting stanzas, and a space every xmppKeepalive, until
+// stop is closed. Write errors are ignored, since reading fails too when the
+// connection is broken.
+func (xc *xmppConn) writeLoop(conn net.Conn, stop chan struct{}) {
+	t := time.NewTicker(xmppKeepalive)
+	defer t.Stop()
+	for {
+		var s string
+		select {
+		case <-stop:
+			return
+		case s = <-xc.out:
+		case <-t.C:
+			s = " "
+		}
+		conn.SetWriteDeadline(time.Now().Add(xmppDialTimeout))
+		io.WriteString(conn, s)
+	}
+}
+
+// send queues the stanza to be sent. It's dropped if the gateway is too far
+// behind.
+func (xc *xmppConn) send(stanza string) {
+	select {
+	case xc.out <- stanza:
+	default:
+		log.Printf("xmppConn: %s is too far behind, dropping a stanza", xc.cfg.Domain)
+	}
+}
+
+// clearOccupants forgets everyone on XMPP, for when the connection drops.
+// It holds the mutex.
+func (xc *xmppConn) clearOccupants() {
+	xc.mu.Lock()
+	defer xc.mu.Unlock()
+	xc.occupants = make(map[string]map[string]string)
+}
+
+// handlePresence handles someone joining or leaving a MUC.
+func (xc *xmppConn) handlePresence(s xmppStanza) {
+	name, nick := splitMUCJID(s.To, xc.cfg.Domain)
+	key, ok := xc.cfg.Rooms[name]
+	if s.Type == "unavailable" {
+		if ok {
+			xc.leave(name, key, s.From)
+		}
+		return
+	}
+	if s.Type != "" {
+		// Like subscription requests, or errors
+		return
+	}
+	switch {
+	case !ok:
+		xc.send(xmppError("presence", s, "cancel", "item-not-found"))
+		return
+	case nick == "":
+		xc.send(xmppError("presence", s, "modify", "jid-malformed"))
+		return
+	}
+	xc.join(name, key, s, nick)
+}
+
+// join adds the sender of the presence to the MUC with the nickname, unless
+// it's taken.
+func (xc *xmppConn) join(name, key string, s xmppStanza, nick string) {
+	// The room is read first, so its lock is never taken while holding xc.mu
+	topic, nicks := xc.cs.roomSnapshot(key)
+	muc := name + "@" + xc.cfg.Domain
+
+	xc.mu.Lock()
+	occupants := xc.occupants[name]
+	if occupants == nil {
+		occupants = make(map[string]string)
+		xc.occupants[name] = occupants
+	}
+	if old, ok := occupants[s.From]; ok && old == nick {
+		// Already in, like a status change
+		xc.mu.Unlock()
+		return
+	}
+	taken := false
+	for _, n := range nicks {
+		taken = taken || n == nick
+	}
+	for jid, n := range occupants {
+		taken = taken || (n == nick && jid != s.From)
+	}
+	if taken {
+		xc.mu.Unlock()
+		xc.send(xmppError("presence", s, "cancel", "conflict"))
+		return
+	}
+	old, rejoin := occupants[s.From]
+	if rejoin {
+		// A nickname change, which is treated as leaving and joining again
+		for jid := range occupants {
+			xc.send(xmppPresence(muc+"/"+old, jid, true, jid == s.From))
+		}
+	}
+	occupants[s.From] = nick
+	for _, n := range nicks {
+		xc.send(xmppPresence(muc+"/"+n, s.From, false, false))
+	}
+	for jid, n := range occupants {
+		if jid != s.From {
+			xc.send(xmppPresence(muc+"/"+n, s.From, false, false))
+			xc.send(xmppPresence(muc+"/"+nick, jid, false, false))
+		}
+	}
+	xc.send(xmppPresence(muc+"/"+nick, s.From, false, true))
+	xc.send(fmt.Sprintf(`<message from='%s' to='%s' type='groupchat'><subject>%s</subject></message>`,
+		xmlEscape(muc), xmlEscape(s.From), xmlEscape(topic)))
+	xc.mu.Unlock()
+
+	if rejoin {
+		xc.cs.deliverBridged(key, bridgeNotice(bridgeXMPP, fmt.Sprintf("%s is now known as %s on XMPP", old, nick)))
+	} else {
+		xc.cs.deliverBridged(key, bridgeNotice(bridgeXMPP, fmt.Sprintf("%s joined on XMPP", nick)))
+	}
+}
+
+// leave removes the JID from the MUC.
+func (xc *xmppConn) leave(name, key, jid string) {
+	muc := name + "@" + xc.cfg.Domain
+	xc.mu.Lock()
+	nick, ok := xc.occupants[name][jid]
+	if !ok {
+		xc.mu.Unlock()
+		return
+	}
+	for other := range xc.occupants[name] {
+		xc.send(xmppPresence(muc+"/"+nick, other, true, other == jid))
+	}
+	delete(xc.occupants[name], jid)
+	xc.mu.Unlock()
+	xc.cs.deliverBridged(key, bridgeNotice(bridgeXMPP, fmt.Sprintf("%s left on XMPP", nick)))
+}
+
+// handleMessage handles a message to a MUC.
+func (xc *xmppConn) handleMessage(s xmppStanza) {
+	if s.Type == "error" {
+		return
+	}
+	name, to := splitMUCJID(s.To, xc.cfg.Domain)
+	key, ok := xc.cfg.Rooms[name]
+	if !ok {
+		xc.send(xmppError("message", s, "cancel", "item-not-found"))
+		return
+	}
+	if s.Type != "groupchat" || to != "" {
+		xc.send(xmppError("message", s, "cancel", "feature-not-implemented"))
+		return
+	}
+	text := strings.TrimSpace(s.Body)
+	if text == "" {
+		// Like chat states
+		return
+	}
+
+	muc := name + "@" + xc.cfg.Domain
+	xc.mu.Lock()
+	nick, ok := xc.occupants[name][s.From]
+	if !ok {
+		xc.mu.Unlock()
+		xc.send(xmppError("message", s, "modify", "not-acceptable"))
+		return
+	}
+	// Everyone on XMPP gets it, including who sent it
+	for jid := range xc.occupants[name] {
+		xc.send(xmppMessage(muc+"/"+nick, jid, text))
+	}
+	xc.mu.Unlock()
+	xc.cs.deliverBridged(key, msg{nick: sanitizeNick(xmppNickPrefix + nick), text: text, when: time.Now(), bridge: bridgeXMPP})
+}
+
+// handleIQ answers service discovery, so clients can find the MUCs, and
+// refuses every other request.
+func (xc *xmppConn) handleIQ(s xmppStanza) {
+	if s.Type != "get" && s.Type != "set" {
+		return
+	}
+	name, nick := splitMUCJID(s.To, xc.cfg.Domain)
+	_, isRoom := xc.cfg.Rooms[name]
+	if s.Type != "get" || s.Query == nil || nick != "" || (name != "" && !isRoom) {
+		xc.send(xmppError("iq", s, "cancel", "service-unavailable"))
+		return
+	}
+	var query string
+	switch s.Query.XMLName.Space {
+	case xmlnsDiscoInfo:
+		category, kind := "conference", "text"
+		if name != "" {
+			query = fmt.Sprintf(`<identity category='%s' type='%s' name='%s'/><feature var='%s'/><feature var='muc_public'/><feature var='muc_open'/><feature var='muc_temporary'/>`,
+				category, kind, xmlEscape(name), xmlnsMUC)
+		} else {
+			query = fmt.Sprintf(`<identity category='%s' type='%s' name='NearTalk'/><feature var='%s'/><feature var='%s'/><feature var='%s'/>`,
+				category, kind, xmlnsMUC, xmlnsDiscoInfo, xmlnsDiscoItem)
+		}
+	case xmlnsDiscoItem:
+		if name == "" {
+			var b strings.Builder
+			for n := range xc.cfg.Rooms {
+				fmt.Fprintf(&b, `<item jid='%s@%s' name='%s'/>`, xmlEscape(n), xmlEscape(xc.cfg.Domain), xmlEscape(n))
+			}
+			query = b.String()
+		}
+	default:
+		xc.send(xmppError("iq", s, "cancel", "service-unavailable"))
+		return
+	}
+	xc.send(fmt.Sprintf(`<iq from='%s' to='%s' id='%s' type='result'><query xmlns='%s'>%s</query></iq>`,
+		xmlEscape(s.To), xmlEscape(s.From), xmlEscape(s.ID), s.Query.XMLName.Space, query))
+}
+
+// relay sends the chat message from the room with the key to everyone on
+// XMPP in its MUCs.
+// It holds the mutex.
+func (xc *xmppConn) relay(key, nick, text string) {
+	xc.mu.Lock()
+	defer xc.mu.Unlock()
+	for name, k := range xc.cfg.Rooms {
+		if k != key {
+			continue
+		}
+		muc := name + "@" + xc.cfg.Domain
+		for jid := range xc.occupants[name] {
+			xc.send(xmppMessage(muc+"/"+nick, jid, text))
+		}
+	}
+}
+
+// relayPresence tells everyone on XMPP in the MUCs of the room with the key
+// that someone joined or left it.
+// It holds the mutex.
+func (xc *xmppConn) relayPresence(key, nick string, joined bool) {
+	xc.mu.Lock()
+	defer xc.mu.Unlock()
+	for name, k := range xc.cfg.Rooms {
+		if k != key {
+			continue
+		}
+		muc := name + "@" + xc.cfg.Domain
+		for jid := range xc.occupants[name] {
+			xc.send(xmppPresence(muc+"/"+nick, jid, !joined, false))
+		}
+	}
+}
+
+// roomSnapshot returns the topic of the room with the key and the plain
+// nicknames of the people in it, or nothing if it isn't open.
+// It holds the roomsMu and the room's client mutex.
+func (cs *chatServer) roomSnapshot(key string) (string, []string) {
+	cs.roomsMu.Lock()
+	room, ok := cs.rooms[key]
+	cs.roomsMu.Unlock()
+	if !ok {
+		return "", nil
+	}
+	room.clientsMu.Lock()
+	defer room.clientsMu.Unlock()
+	users := room.users()
+	nicks := make([]string, len(users))
+	for i, u := range users {
+		nicks[i] = plainNick(u.nick)
+	}
+	return room.topic, nicks
+}
+
+// splitMUCJID splits a JID on the domain into the MUC name and the nickname,
+// which are empty if the JID doesn't have them. The name is empty for JIDs
+// on other domains.
+func splitMUCJID(jid, domain string) (name, nick string) {
+	bare, nick, _ := strings.Cut(jid, "/")
+	name, host, ok := strings.Cut(bare, "@")
+	if !ok {
+		name, host = "", bare
+	}
+	if !strings.EqualFold(host, domain) {
+		return "", ""
+	}
+	return strings.ToLower(name), nick
+}
+
+// xmppPresence returns a presence stanza for an occupant of a MUC, from
+// their occupant JID. If self is true, it's the recipient's own presence.
+func xmppPresence(from, to string, unavailable, self bool) string {
+	typ := ""
+	if unavailable {
+		typ = " type='unavailable'"
+	}
+	role := "participant"
+	if unavailable {
+		role = "none"
+	}
+	status := ""
+	if self {
+		status = "<status code='110'/>"
+	}
+	return fmt.Sprintf(`<presence from='%s' to='%s'%s><x xmlns='%s'><item affiliation='none' role='%s'/>%s</x></presence>`,
+		xmlEscape(from), xmlEscape(to), typ, xmlnsMUCUser, role, status)
+}
+
+// xmppMessage returns a groupchat message stanza.
+func xmppMessage(from, to, text string) string {
+	return fmt.Sprintf(`<message from='%s' to='%s' type='groupchat'><body>%s</body></message>`,
+		xmlEscape(from), xmlEscape(to), xmlEscape(text))
+}
+
+// xmppError returns an error stanza of the kind in reply to the stanza.
+func xmppError(kind string, s xmppStanza, errType, condition string) string {
+	return fmt.Sprintf(`<%s from='%s' to='%s' id='%s' type='error'><error type='%s'><%s xmlns='%s'/></error></%s>`,
+		kind, xmlEscape(s.To), xmlEscape(s.From), xmlEscape(s.ID), errType, condition, xmlnsStanzas, kind)
+}
+
+// xmlEscape escapes the text for XML character data and attributes.
+func xmlEscape(s string) string {
+	var b strings.Builder
+	xml.EscapeText(&b, []byte(s))
+	return b.String()
+}
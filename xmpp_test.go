@@ -0,0 +1,53 @@
+package main
+
+import "testing"
+
+func TestValidateXMPPGateway(t *testing.T) {
+	if err := validateXMPPGateway(nil); err != nil {
+		t.Fatal(err)
+	}
+	valid := configXMPPGateway{Server: "localhost:5347", Domain: "chat.example.com", Secret: "secret", Rooms: map[string]string{"lan": "lan"}}
+	if err := validateXMPPGateway(&valid); err != nil {
+		t.Fatal(err)
+	}
+	bad := []func(*configXMPPGateway){
+		func(cg *configXMPPGateway) { cg.Server = "localhost" },
+		func(cg *configXMPPGateway) { cg.Domain = "" },
+		func(cg *configXMPPGateway) { cg.Domain = "room@chat.example.com" },
+		func(cg *configXMPPGateway) { cg.Secret = "" },
+		func(cg *configXMPPGateway) { cg.Rooms = nil },
+		func(cg *configXMPPGateway) { cg.Rooms = map[string]string{"Lan": "lan"} },
+		func(cg *configXMPPGateway) { cg.Rooms = map[string]string{"the lan": "lan"} },
+		func(cg *configXMPPGateway) { cg.Rooms = map[string]string{"lan": ""} },
+	}
+	for i, change := range bad {
+		cg := valid
+		change(&cg)
+		if err := validateXMPPGateway(&cg); err == nil {
+			t.Errorf("bad gateway %d was accepted", i)
+		}
+	}
+}
+
+func TestSplitMUCJID(t *testing.T) {
+	tests := []struct{ jid, name, nick string }{
+		{"lan@chat.example.com/bob", "lan", "bob"},
+		{"LAN@Chat.Example.com/Bob/2", "lan", "Bob/2"},
+		{"lan@chat.example.com", "lan", ""},
+		{"chat.example.com", "", ""},
+		{"lan@other.example.com/bob", "", ""},
+	}
+	for _, tt := range tests {
+		if name, nick := splitMUCJID(tt.jid, "chat.example.com"); name != tt.name || nick != tt.nick {
+			t.Errorf("splitMUCJID(%q) = %q, %q, want %q, %q", tt.jid, name, nick, tt.name, tt.nick)
+		}
+	}
+}
+
+func TestXMPPMessage(t *testing.T) {
+	got := xmppMessage("lan@chat.example.com/<bob>", "alice@example.com/phone", `"hi" & 'bye'`)
+	want := `<message from='lan@chat.example.com/&lt;bob&gt;' to='alice@example.com/phone' type='groupchat'><body>&#34;hi&#34; &amp; &#39;bye&#39;</body></message>`
+	if got != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+}